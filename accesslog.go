@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redactedValue replaces secrets in logged requests and responses
+const redactedValue = "[REDACTED]"
+
+// sensitiveHeaders are never written to the access log
+var sensitiveHeaders = map[string]bool{
+	"Authorization":       true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+	"X-Api-Key":           true,
+	"X-Hub-Signature":     true,
+	"X-Hub-Signature-256": true,
+	"X-Gitlab-Token":      true,
+	"X-Slack-Signature":   true,
+}
+
+// secretBodyRoutes carry secret values in their request bodies, which are
+// never logged
+var secretBodyRoutes = map[string]bool{
+	"/api/v1/projects/{id}/secrets/{name}": true,
+}
+
+// sensitiveKeyPattern matches JSON keys and form/query parameters that hold secrets
+var sensitiveKeyPattern = regexp.MustCompile(`(?i)(password|passwd|secret|token|api[_-]?key|authorization|credential|private[_-]?key)`)
+
+// sensitiveParamPattern redacts key=value pairs in non-JSON bodies
+var sensitiveParamPattern = regexp.MustCompile(`(?i)((?:password|passwd|secret|token|api[_-]?key|credential)[^=&\s]*=)[^&\s]*`)
+
+// AccessLogRule controls body logging for a single route
+type AccessLogRule struct {
+	Route      string  `json:"route"`
+	Enabled    bool    `json:"enabled"`
+	SampleRate float64 `json:"sample_rate"`
+}
+
+// AccessLogger logs sampled, size-capped and redacted request/response bodies
+// for routes on which it has been enabled at runtime
+type AccessLogger struct {
+	mu      sync.RWMutex
+	rules   map[string]AccessLogRule
+	maxBody int
+	out     *log.Logger
+}
+
+// NewAccessLogger creates an access logger that captures at most maxBody bytes of each body
+func NewAccessLogger(maxBody int) *AccessLogger {
+	return &AccessLogger{
+		rules:   make(map[string]AccessLogRule),
+		maxBody: maxBody,
+		out:     log.New(os.Stdout, "access ", log.LstdFlags),
+	}
+}
+
+// SetRule enables, disables or changes the sampling of a route
+func (al *AccessLogger) SetRule(rule AccessLogRule) {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	if !rule.Enabled {
+		delete(al.rules, rule.Route)
+		return
+	}
+	al.rules[rule.Route] = rule
+}
+
+// Rules returns the active rules ordered by route
+func (al *AccessLogger) Rules() []AccessLogRule {
+	al.mu.RLock()
+	defer al.mu.RUnlock()
+
+	rules := make([]AccessLogRule, 0, len(al.rules))
+	for _, rule := range al.rules {
+		rules = append(rules, rule)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Route < rules[j].Route })
+	return rules
+}
+
+func (al *AccessLogger) sampled(route string) bool {
+	al.mu.RLock()
+	rule, ok := al.rules[route]
+	al.mu.RUnlock()
+
+	return ok && rand.Float64() < rule.SampleRate
+}
+
+// Middleware logs the bodies of sampled requests on enabled routes
+func (al *AccessLogger) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeTemplate(r)
+		if !al.sampled(route) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+
+		// Capture the head of the request body and hand the full body on
+		var requestBody []byte
+		if r.Body != nil {
+			requestBody, _ = io.ReadAll(io.LimitReader(r.Body, int64(al.maxBody)))
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(requestBody), r.Body), r.Body}
+		}
+
+		rw := newResponseWriter(w)
+		rw.capture = &bytes.Buffer{}
+		rw.captureLimit = al.maxBody
+
+		next.ServeHTTP(rw, r)
+
+		entry := map[string]interface{}{
+			"method":        r.Method,
+			"route":         route,
+			"path":          r.URL.Path,
+			"query":         redactQuery(r.URL.Query()),
+			"status":        rw.status,
+			"duration_ms":   time.Since(start).Milliseconds(),
+			"remote_addr":   r.RemoteAddr,
+			"headers":       redactHeaders(r.Header),
+			"request_body":  redactBody(requestBody),
+			"response_body": redactBody(rw.capture.Bytes()),
+			"response_size": rw.written,
+		}
+
+		if name := clientCertificateName(r); name != "" {
+			entry["client_cert"] = name
+		}
+
+		if secretBodyRoutes[route] {
+			entry["request_body"] = redactedValue
+		}
+
+		line, err := json.Marshal(entry)
+		if err != nil {
+			log.Printf("Error encoding access log entry: %v", err)
+			return
+		}
+		al.out.Println(string(line))
+	})
+}
+
+func redactHeaders(headers http.Header) map[string]string {
+	out := make(map[string]string, len(headers))
+	for name, values := range headers {
+		if sensitiveHeaders[http.CanonicalHeaderKey(name)] {
+			out[name] = redactedValue
+			continue
+		}
+		out[name] = strings.Join(values, ", ")
+	}
+	return out
+}
+
+func redactQuery(query map[string][]string) map[string]string {
+	out := make(map[string]string, len(query))
+	for key, values := range query {
+		if sensitiveKeyPattern.MatchString(key) {
+			out[key] = redactedValue
+			continue
+		}
+		out[key] = strings.Join(values, ",")
+	}
+	return out
+}
+
+// redactBody masks secrets in a captured body. JSON bodies have sensitive
+// keys replaced; anything else has key=value secrets masked.
+func redactBody(body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+
+	var doc interface{}
+	if err := json.Unmarshal(body, &doc); err == nil {
+		redacted, _ := json.Marshal(redactJSON(doc))
+		return string(redacted)
+	}
+
+	// Truncated or non-JSON bodies
+	return sensitiveParamPattern.ReplaceAllString(string(body), "${1}"+redactedValue)
+}
+
+func redactJSON(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if sensitiveKeyPattern.MatchString(key) {
+				v[key] = redactedValue
+			} else {
+				v[key] = redactJSON(child)
+			}
+		}
+		return v
+	case []interface{}:
+		for i, child := range v {
+			v[i] = redactJSON(child)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// List access log rules endpoint
+func (bs *BuildService) listAccessLogRulesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bs.accessLog.Rules())
+}
+
+// Update access log rule endpoint
+func (bs *BuildService) updateAccessLogRuleHandler(w http.ResponseWriter, r *http.Request) {
+	var rule AccessLogRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if rule.Route == "" {
+		http.Error(w, "route is required", http.StatusBadRequest)
+		return
+	}
+	if rule.SampleRate == 0 {
+		rule.SampleRate = 1
+	}
+	if rule.SampleRate < 0 || rule.SampleRate > 1 {
+		http.Error(w, "sample_rate must be between 0 and 1", http.StatusBadRequest)
+		return
+	}
+
+	bs.accessLog.SetRule(rule)
+	log.Printf("Access logging for %s set to enabled=%t sample_rate=%.2f", rule.Route, rule.Enabled, rule.SampleRate)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rule)
+}
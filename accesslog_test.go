@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestAccessLogRouter(al *AccessLogger) *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/builds", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+		w.Write(body)
+	}).Methods("POST")
+	router.Use(al.Middleware)
+	return router
+}
+
+func TestAccessLoggerMiddleware(t *testing.T) {
+	var out bytes.Buffer
+	al := NewAccessLogger(4096)
+	al.out = log.New(&out, "", 0)
+	router := newTestAccessLogRouter(al)
+
+	body := `{"project_name":"test-project","git_url":"https://github.com/test/repo.git","token":"s3cr3t"}`
+
+	// Disabled by default
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/api/v1/builds", strings.NewReader(body)))
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	assert.Empty(t, out.String())
+
+	al.SetRule(AccessLogRule{Route: "/api/v1/builds", Enabled: true, SampleRate: 1})
+
+	req := httptest.NewRequest("POST", "/api/v1/builds", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer abc")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	// The handler still sees the full, unredacted body
+	assert.Equal(t, body, rr.Body.String())
+
+	var entry map[string]interface{}
+	require.NoError(t, json.Unmarshal(out.Bytes(), &entry))
+	assert.Equal(t, "/api/v1/builds", entry["route"])
+	assert.Equal(t, float64(http.StatusCreated), entry["status"])
+	assert.NotContains(t, entry["request_body"], "s3cr3t")
+	assert.Contains(t, entry["request_body"], "test-project")
+	assert.Equal(t, redactedValue, entry["headers"].(map[string]interface{})["Authorization"])
+
+	// Disabling stops logging again
+	out.Reset()
+	al.SetRule(AccessLogRule{Route: "/api/v1/builds", Enabled: false})
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/api/v1/builds", strings.NewReader(body)))
+	assert.Empty(t, out.String())
+}
+
+func TestAccessLoggerCapsBodySize(t *testing.T) {
+	var out bytes.Buffer
+	al := NewAccessLogger(16)
+	al.out = log.New(&out, "", 0)
+	al.SetRule(AccessLogRule{Route: "/api/v1/builds", Enabled: true, SampleRate: 1})
+	router := newTestAccessLogRouter(al)
+
+	body := strings.Repeat("x", 100)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/api/v1/builds", strings.NewReader(body)))
+	assert.Equal(t, body, rr.Body.String())
+
+	var entry map[string]interface{}
+	require.NoError(t, json.Unmarshal(out.Bytes(), &entry))
+	assert.Len(t, entry["request_body"], 16)
+	assert.Len(t, entry["response_body"], 16)
+	assert.Equal(t, float64(100), entry["response_size"])
+}
+
+func TestRedactBody(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		expected string
+	}{
+		{name: "json", body: `{"password":"hunter2","nested":{"api_key":"k"},"name":"ok"}`, expected: `{"name":"ok","nested":{"api_key":"[REDACTED]"},"password":"[REDACTED]"}`},
+		{name: "form", body: `user=bob&password=hunter2&x=1`, expected: `user=bob&password=[REDACTED]&x=1`},
+		{name: "truncated json", body: `{"token":"abc`, expected: `{"token":"abc`},
+		{name: "empty", body: ``, expected: ``},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, redactBody([]byte(tt.body)))
+		})
+	}
+}
+
+func TestUpdateAccessLogRuleHandler(t *testing.T) {
+	service, _ := setupTestService()
+
+	tests := []struct {
+		name           string
+		body           string
+		expectedStatus int
+	}{
+		{name: "enable route", body: `{"route":"/api/v1/builds","enabled":true,"sample_rate":0.5}`, expectedStatus: http.StatusOK},
+		{name: "missing route", body: `{"enabled":true}`, expectedStatus: http.StatusBadRequest},
+		{name: "invalid sample rate", body: `{"route":"/api/v1/builds","enabled":true,"sample_rate":2}`, expectedStatus: http.StatusBadRequest},
+		{name: "invalid body", body: `{`, expectedStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			service.updateAccessLogRuleHandler(rr, httptest.NewRequest("PUT", "/api/v1/admin/access-log", strings.NewReader(tt.body)))
+			assert.Equal(t, tt.expectedStatus, rr.Code)
+		})
+	}
+
+	assert.Equal(t, []AccessLogRule{{Route: "/api/v1/builds", Enabled: true, SampleRate: 0.5}}, service.accessLog.Rules())
+}
+
+func TestRequireAdmin(t *testing.T) {
+	handler := requireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	t.Setenv("ADMIN_TOKEN", "")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/admin/access-log", nil))
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	t.Setenv("ADMIN_TOKEN", "admin-secret")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/admin/access-log", nil))
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	req := httptest.NewRequest("GET", "/api/v1/admin/access-log", nil)
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
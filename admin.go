@@ -0,0 +1,45 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// requireAdmin guards admin endpoints with the bearer token configured in
+// ADMIN_TOKEN or an SSO token with the admin role. Admin endpoints are
+// disabled entirely when neither is configured.
+func requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if os.Getenv("ADMIN_TOKEN") == "" && os.Getenv("OIDC_ADMIN_ROLE") == "" {
+			http.Error(w, "Admin API is disabled", http.StatusForbidden)
+			return
+		}
+
+		if !isAdminRequest(r) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isAdminRequest reports whether the request carries the ADMIN_TOKEN or an
+// SSO token with the admin role, for admin-only options on otherwise public
+// endpoints
+func isAdminRequest(r *http.Request) bool {
+	return hasAdminToken(r) || requestTenant(r).Admin
+}
+
+// hasAdminToken reports whether the request carries the ADMIN_TOKEN
+func hasAdminToken(r *http.Request) bool {
+	token := os.Getenv("ADMIN_TOKEN")
+	if token == "" {
+		return false
+	}
+
+	provided := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(provided), []byte(token)) == 1
+}
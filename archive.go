@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// archiveBatchSize is how many builds the archiver moves per statement
+const archiveBatchSize = 500
+
+// BuildArchiver moves finished builds older than the retention window out of
+// the builds table and into builds_archive
+type BuildArchiver struct {
+	db        DatabaseInterface
+	errors    *ErrorTracker
+	retention time.Duration
+	interval  time.Duration
+}
+
+// NewBuildArchiverFromEnv creates an archiver keeping builds for
+// BUILD_ARCHIVE_AFTER and checking every BUILD_ARCHIVE_INTERVAL. A zero
+// BUILD_ARCHIVE_AFTER disables archiving.
+func NewBuildArchiverFromEnv(db DatabaseInterface, errors *ErrorTracker) *BuildArchiver {
+	return &BuildArchiver{
+		db:        db,
+		errors:    errors,
+		retention: getEnvDuration("BUILD_ARCHIVE_AFTER", 90*24*time.Hour),
+		interval:  getEnvDuration("BUILD_ARCHIVE_INTERVAL", time.Hour),
+	}
+}
+
+// Start archives old builds every interval until ctx is cancelled
+func (ba *BuildArchiver) Start(ctx context.Context) {
+	if ba.retention <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(ba.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				ba.Archive(time.Now())
+			}
+		}
+	}()
+}
+
+// Archive moves every finished build created before now minus the retention
+// window into the archive, a batch at a time, and returns how many it moved
+func (ba *BuildArchiver) Archive(now time.Time) int64 {
+	cutoff := now.Add(-ba.retention)
+	var total int64
+	for {
+		n, err := ba.db.ArchiveBuilds(cutoff, archiveBatchSize)
+		if err != nil {
+			ba.errors.Capture("archiver", fmt.Errorf("archiving builds: %w", err), nil)
+			break
+		}
+		total += n
+		if n < archiveBatchSize {
+			break
+		}
+	}
+
+	if total > 0 {
+		log.Printf("Archived %d builds created before %s", total, cutoff.Format(time.RFC3339))
+	}
+	return total
+}
+
+// Delete build endpoint. Soft deletes a finished build, hiding it from build
+// listings until it's archived.
+func (bs *BuildService) deleteBuildHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid build ID", http.StatusBadRequest)
+		return
+	}
+
+	build, err := bs.db.DeleteBuild(id)
+	if err != nil {
+		switch err.Error() {
+		case "build not found":
+			http.Error(w, "Build not found", http.StatusNotFound)
+		case "build not finished":
+			http.Error(w, "Only finished builds can be deleted", http.StatusConflict)
+		default:
+			log.Printf("Error deleting build: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	bs.cache.InvalidateBuild(build)
+	log.Printf("Build %d deleted", build.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// includeDeleted reads the admin-only include_deleted query parameter,
+// writing an error and returning false when a non-admin asks for it
+func includeDeleted(w http.ResponseWriter, r *http.Request) (bool, bool) {
+	if r.URL.Query().Get("include_deleted") != "true" {
+		return false, true
+	}
+	if !isAdminRequest(r) {
+		http.Error(w, "include_deleted requires the admin token", http.StatusForbidden)
+		return false, false
+	}
+	return true, true
+}
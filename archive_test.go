@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeleteBuildHandler(t *testing.T) {
+	service, mockDB := setupTestService()
+	deletedAt := time.Now()
+	mockDB.On("DeleteBuild", 1).Return(&BuildRequest{ID: 1, Status: "success", DeletedAt: &deletedAt}, nil)
+	mockDB.On("DeleteBuild", 2).Return(nil, fmt.Errorf("build not finished"))
+	mockDB.On("DeleteBuild", 3).Return(nil, fmt.Errorf("build not found"))
+	mockDB.On("DeleteBuild", 4).Return(nil, fmt.Errorf("database error"))
+
+	remove := func(id string) *httptest.ResponseRecorder {
+		req := mux.SetURLVars(httptest.NewRequest("DELETE", "/api/v1/builds/"+id, nil), map[string]string{"id": id})
+		rr := httptest.NewRecorder()
+		service.deleteBuildHandler(rr, req)
+		return rr
+	}
+
+	assert.Equal(t, http.StatusNoContent, remove("1").Code)
+	assert.Equal(t, http.StatusConflict, remove("2").Code)
+	assert.Equal(t, http.StatusNotFound, remove("3").Code)
+	assert.Equal(t, http.StatusInternalServerError, remove("4").Code)
+	assert.Equal(t, http.StatusBadRequest, remove("abc").Code)
+	mockDB.AssertExpectations(t)
+}
+
+func TestListBuildsIncludeDeleted(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "admin-secret")
+	service, mockDB := setupTestService()
+	deletedAt := time.Now()
+	mockDB.On("ListBuilds", true, "", Labels(nil)).Return([]*BuildRequest{{ID: 1, Status: "success", DeletedAt: &deletedAt}}, nil).Once()
+
+	list := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/v1/builds?include_deleted=true", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		service.listBuildsHandler(rr, req)
+		return rr
+	}
+
+	assert.Equal(t, http.StatusForbidden, list("").Code)
+	assert.Equal(t, http.StatusForbidden, list("wrong").Code)
+
+	rr := list("admin-secret")
+	require.Equal(t, http.StatusOK, rr.Code)
+	var builds []BuildRequest
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &builds))
+	require.Len(t, builds, 1)
+	assert.NotNil(t, builds[0].DeletedAt)
+	mockDB.AssertExpectations(t)
+}
+
+func TestBuildArchiverArchivesInBatches(t *testing.T) {
+	service, mockDB := setupTestService()
+	archiver := &BuildArchiver{db: mockDB, errors: service.errors, retention: 24 * time.Hour, interval: time.Hour}
+	now := time.Date(2030, 1, 2, 0, 0, 0, 0, time.UTC)
+	cutoff := now.Add(-24 * time.Hour)
+	mockDB.On("ArchiveBuilds", cutoff, archiveBatchSize).Return(int64(archiveBatchSize), nil).Once()
+	mockDB.On("ArchiveBuilds", cutoff, archiveBatchSize).Return(int64(12), nil).Once()
+
+	assert.Equal(t, int64(archiveBatchSize+12), archiver.Archive(now))
+	mockDB.AssertExpectations(t)
+}
+
+func TestBuildArchiverStopsOnError(t *testing.T) {
+	service, mockDB := setupTestService()
+	archiver := &BuildArchiver{db: mockDB, errors: service.errors, retention: time.Hour, interval: time.Hour}
+	mockDB.On("ArchiveBuilds", mock.AnythingOfType("time.Time"), archiveBatchSize).Return(int64(0), fmt.Errorf("database error")).Once()
+
+	assert.Equal(t, int64(0), archiver.Archive(time.Now()))
+	mockDB.AssertExpectations(t)
+}
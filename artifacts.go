@@ -0,0 +1,508 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// errArtifactNotFound is returned by artifact stores for missing objects
+var errArtifactNotFound = errors.New("artifact not found")
+
+// Artifact is a file produced by a build
+type Artifact struct {
+	ID          int    `json:"id" db:"id"`
+	BuildID     int    `json:"build_id" db:"build_id"`
+	Name        string `json:"name" db:"name"`
+	Size        int64  `json:"size" db:"size"`
+	SHA256      string `json:"sha256" db:"sha256"`
+	ContentType string `json:"content_type" db:"content_type"`
+	// Step is the index of the build stage that produced the artifact, in
+	// the order of GET /builds/{id}/stages
+	Step *int `json:"step,omitempty" db:"step"`
+	// Published is set on artifacts the build's pipeline published, which
+	// its provenance attests, and not on artifacts uploaded through the API
+	Published  bool      `json:"published" db:"published"`
+	StorageKey string    `json:"-" db:"storage_key"`
+	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+}
+
+// ObjectInfo describes an object held by a store
+type ObjectInfo struct {
+	Key     string    `json:"key"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modified_at"`
+}
+
+// ArtifactStore persists artifact contents
+type ArtifactStore interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+}
+
+// URLSigner is implemented by stores that can hand out time-limited URLs,
+// letting clients download artifacts directly from the store
+type URLSigner interface {
+	SignedURL(ctx context.Context, key string, expires time.Duration) (string, error)
+}
+
+// NewArtifactStoreFromEnv returns the store selected by the ARTIFACT_STORE environment variable
+func NewArtifactStoreFromEnv() ArtifactStore {
+	switch os.Getenv("ARTIFACT_STORE") {
+	case "s3":
+		return NewS3ArtifactStoreFromEnv()
+	case "gcs":
+		return NewGCSArtifactStoreFromEnv()
+	case "azure":
+		return NewAzureArtifactStoreFromEnv()
+	default:
+		return NewLocalArtifactStore(os.Getenv("ARTIFACT_DIR"))
+	}
+}
+
+// LocalArtifactStore keeps artifacts on the local filesystem
+type LocalArtifactStore struct {
+	Root string
+}
+
+// NewLocalArtifactStore creates a store rooted at the given directory
+func NewLocalArtifactStore(root string) *LocalArtifactStore {
+	if root == "" {
+		root = filepath.Join(os.TempDir(), "build-service-artifacts")
+	}
+	return &LocalArtifactStore{Root: root}
+}
+
+func (ls *LocalArtifactStore) path(key string) string {
+	return filepath.Join(ls.Root, filepath.FromSlash(key))
+}
+
+// Put writes the artifact to a temporary file and renames it into place so
+// readers never observe a partial upload
+func (ls *LocalArtifactStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	dest := ls.path(key)
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dest), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dest)
+}
+
+// Get opens a stored artifact
+func (ls *LocalArtifactStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	f, err := os.Open(ls.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errArtifactNotFound
+	}
+	return f, err
+}
+
+// Delete removes a stored artifact; missing artifacts are not an error
+func (ls *LocalArtifactStore) Delete(ctx context.Context, key string) error {
+	err := os.Remove(ls.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// List returns the stored objects whose key starts with prefix
+func (ls *LocalArtifactStore) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	err := filepath.WalkDir(ls.Root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		rel, err := filepath.Rel(ls.Root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, ObjectInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return objects, err
+}
+
+// ArtifactManager records artifacts in the database, stores their contents
+// and deletes them once they exceed the retention period
+type ArtifactManager struct {
+	db        DatabaseInterface
+	store     ArtifactStore
+	errors    *ErrorTracker
+	maxSize   int64
+	retention time.Duration
+	interval  time.Duration
+	// signedURLTTL, when positive, makes downloads redirect to a signed URL
+	// of stores that support them instead of streaming through the service
+	signedURLTTL time.Duration
+}
+
+// NewArtifactManager creates an artifact manager configured from the environment
+func NewArtifactManager(db DatabaseInterface, store ArtifactStore, errors *ErrorTracker) *ArtifactManager {
+	return &ArtifactManager{
+		db:           db,
+		store:        store,
+		errors:       errors,
+		maxSize:      int64(getEnvInt("ARTIFACT_MAX_SIZE_MB", 1024)) << 20,
+		retention:    getEnvDuration("ARTIFACT_RETENTION", 30*24*time.Hour),
+		interval:     time.Hour,
+		signedURLTTL: getEnvDuration("ARTIFACT_SIGNED_URL_TTL", 0),
+	}
+}
+
+// Start deletes expired artifacts periodically until ctx is cancelled. A
+// retention of zero keeps artifacts forever.
+func (am *ArtifactManager) Start(ctx context.Context) {
+	if am.retention <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(am.interval)
+		defer ticker.Stop()
+
+		for {
+			am.purgeExpired(ctx)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// purgeExpired deletes artifacts created before the retention cutoff
+func (am *ArtifactManager) purgeExpired(ctx context.Context) {
+	expired, err := am.db.ListArtifactsCreatedBefore(time.Now().Add(-am.retention), 500)
+	if err != nil {
+		am.errors.Capture("artifacts", fmt.Errorf("listing expired artifacts: %w", err), nil)
+		return
+	}
+
+	for _, artifact := range expired {
+		if err := am.store.Delete(ctx, artifact.StorageKey); err != nil {
+			am.errors.Capture("artifacts", fmt.Errorf("deleting %s: %w", artifact.StorageKey, err), nil)
+			continue
+		}
+		if err := am.db.DeleteArtifact(artifact.ID); err != nil {
+			am.errors.Capture("artifacts", fmt.Errorf("deleting artifact %d: %w", artifact.ID, err), nil)
+		}
+	}
+
+	if len(expired) > 0 {
+		log.Printf("Deleted %d artifacts older than %s", len(expired), am.retention)
+	}
+}
+
+// newArtifact describes an artifact of a build before it is stored, guessing
+// the content type from the name when none is given
+func newArtifact(build *BuildRequest, name string, size int64, contentType string) *Artifact {
+	if contentType == "" {
+		if contentType = mime.TypeByExtension(path.Ext(name)); contentType == "" {
+			contentType = "application/octet-stream"
+		}
+	}
+
+	return &Artifact{
+		BuildID:     build.ID,
+		Name:        name,
+		Size:        size,
+		ContentType: contentType,
+		StorageKey:  fmt.Sprintf("builds/%d/%s", build.ID, name),
+		CreatedAt:   time.Now().UTC(),
+	}
+}
+
+// put writes an artifact's contents to the store, recording their checksum
+func (am *ArtifactManager) put(ctx context.Context, artifact *Artifact, r io.Reader) error {
+	hash := sha256.New()
+	if err := am.store.Put(ctx, artifact.StorageKey, io.TeeReader(r, hash), artifact.Size, artifact.ContentType); err != nil {
+		return err
+	}
+	artifact.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	return nil
+}
+
+// Publish stores a file produced by a running build, such as one declared in
+// its pipeline file, as one of the build's artifacts. The project's
+// artifact_tag_pattern and ARTIFACT_MAX_SIZE_MB apply as they do to uploads.
+// step is the index of the stage publishing it.
+func (am *ArtifactManager) Publish(ctx context.Context, build *BuildRequest, step int, name string, r io.Reader, size int64) (*Artifact, error) {
+	if !validArtifactName(name) || reservedArtifactName(name) {
+		return nil, fmt.Errorf("invalid artifact name %q", name)
+	}
+	if size > am.maxSize {
+		return nil, fmt.Errorf("artifact is larger than %d bytes", am.maxSize)
+	}
+
+	project, err := am.db.GetProjectByName(build.ProjectName)
+	if err != nil {
+		if err.Error() != "project not found" {
+			return nil, fmt.Errorf("getting project: %w", err)
+		}
+	} else if project.ArtifactTagPattern != "" && !matchTagPattern(project.ArtifactTagPattern, build.Tag) {
+		return nil, fmt.Errorf("project %s only publishes artifacts for tags matching %s", project.Name, project.ArtifactTagPattern)
+	}
+
+	artifact := newArtifact(build, name, size, "")
+	artifact.Step = &step
+	artifact.Published = true
+	if err := am.put(ctx, artifact, io.LimitReader(r, size)); err != nil {
+		return nil, fmt.Errorf("storing %s: %w", artifact.StorageKey, err)
+	}
+	id, err := am.db.CreateArtifact(artifact)
+	if err != nil {
+		return nil, err
+	}
+	artifact.ID = id
+	return artifact, nil
+}
+
+// validArtifactName rejects names that are empty, absolute or escape the
+// build's artifact directory
+func validArtifactName(name string) bool {
+	if name == "" || len(name) > 255 || strings.HasPrefix(name, "/") || strings.Contains(name, "\\") {
+		return false
+	}
+	return path.Clean(name) == name && name != "." && !strings.HasPrefix(name, "../") && name != ".."
+}
+
+// artifactBuild loads the build addressed by an artifact route, writing an
+// error response when it cannot
+func (bs *BuildService) artifactBuild(w http.ResponseWriter, r *http.Request) (*BuildRequest, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid build ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	build, err := bs.db.GetBuild(id)
+	if err != nil {
+		if err.Error() == "build not found" {
+			http.Error(w, "Build not found", http.StatusNotFound)
+			return nil, false
+		}
+		log.Printf("Error getting build: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	return build, true
+}
+
+// artifactsAllowed checks the project's artifact_tag_pattern, which limits
+// publishing artifacts to builds of matching tags (e.g. "v*.*.*")
+func (bs *BuildService) artifactsAllowed(w http.ResponseWriter, build *BuildRequest) bool {
+	project, err := bs.db.GetProjectByName(build.ProjectName)
+	if err != nil {
+		if err.Error() == "project not found" {
+			// Ad-hoc builds of unregistered repositories have no restrictions
+			return true
+		}
+		log.Printf("Error getting project: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return false
+	}
+
+	if project.ArtifactTagPattern != "" && !matchTagPattern(project.ArtifactTagPattern, build.Tag) {
+		http.Error(w, fmt.Sprintf("Project %s only publishes artifacts for tags matching %s", project.Name, project.ArtifactTagPattern), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// Upload artifact endpoint. Artifacts can only be uploaded while the build
+// runs. ?step= associates the artifact with one of the build's stages.
+func (bs *BuildService) uploadArtifactHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if !validArtifactName(name) {
+		http.Error(w, "Invalid artifact name", http.StatusBadRequest)
+		return
+	}
+	if reservedArtifactName(name) {
+		http.Error(w, "Artifact name is reserved", http.StatusBadRequest)
+		return
+	}
+
+	var step *int
+	if value := r.URL.Query().Get("step"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			http.Error(w, "Invalid step", http.StatusBadRequest)
+			return
+		}
+		step = &parsed
+	}
+
+	build, ok := bs.artifactBuild(w, r)
+	if !ok {
+		return
+	}
+
+	if build.Status != "running" {
+		http.Error(w, "Artifacts can only be uploaded while the build is running", http.StatusConflict)
+		return
+	}
+	if !bs.artifactsAllowed(w, build) {
+		return
+	}
+	if r.ContentLength < 0 {
+		http.Error(w, "Content-Length is required", http.StatusLengthRequired)
+		return
+	}
+	if r.ContentLength > bs.artifacts.maxSize {
+		http.Error(w, "Artifact too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if _, err := bs.db.GetArtifact(build.ID, name); err == nil {
+		http.Error(w, "Artifact already exists", http.StatusConflict)
+		return
+	} else if err.Error() != "artifact not found" {
+		log.Printf("Error getting artifact: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	artifact := newArtifact(build, name, r.ContentLength, r.Header.Get("Content-Type"))
+	artifact.Step = step
+	if err := bs.artifacts.put(r.Context(), artifact, io.LimitReader(r.Body, r.ContentLength)); err != nil {
+		bs.errors.Capture("artifacts", fmt.Errorf("storing %s: %w", artifact.StorageKey, err), build)
+		http.Error(w, "Failed to store artifact", http.StatusInternalServerError)
+		return
+	}
+
+	id, err := bs.db.CreateArtifact(artifact)
+	if err != nil {
+		if err.Error() == "artifact already exists" {
+			http.Error(w, "Artifact already exists", http.StatusConflict)
+			return
+		}
+		log.Printf("Error creating artifact: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	artifact.ID = id
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(artifact)
+}
+
+// List artifacts endpoint
+func (bs *BuildService) listArtifactsHandler(w http.ResponseWriter, r *http.Request) {
+	build, ok := bs.artifactBuild(w, r)
+	if !ok {
+		return
+	}
+
+	artifacts, err := bs.db.ListArtifacts(build.ID)
+	if err != nil {
+		log.Printf("Error listing artifacts: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(artifacts)
+}
+
+// Download artifact endpoint
+func (bs *BuildService) downloadArtifactHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if !validArtifactName(name) {
+		http.Error(w, "Invalid artifact name", http.StatusBadRequest)
+		return
+	}
+
+	build, ok := bs.artifactBuild(w, r)
+	if !ok {
+		return
+	}
+
+	artifact, err := bs.db.GetArtifact(build.ID, name)
+	if err != nil {
+		if err.Error() == "artifact not found" {
+			http.Error(w, "Artifact not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error getting artifact: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if signer, ok := bs.artifacts.store.(URLSigner); ok && bs.artifacts.signedURLTTL > 0 {
+		signed, err := signer.SignedURL(r.Context(), artifact.StorageKey, bs.artifacts.signedURLTTL)
+		if err == nil {
+			w.Header().Set("Cache-Control", "no-store")
+			http.Redirect(w, r, signed, http.StatusFound)
+			return
+		}
+		// Fall back to streaming the artifact through the service
+		bs.errors.Capture("artifacts", fmt.Errorf("signing URL for %s: %w", artifact.StorageKey, err), build)
+	}
+
+	content, err := bs.artifacts.store.Get(r.Context(), artifact.StorageKey)
+	if err != nil {
+		if errors.Is(err, errArtifactNotFound) {
+			http.Error(w, "Artifact not found", http.StatusNotFound)
+			return
+		}
+		bs.errors.Capture("artifacts", fmt.Errorf("reading %s: %w", artifact.StorageKey, err), build)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer content.Close()
+
+	w.Header().Set("Content-Type", artifact.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(artifact.Size, 10))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(artifact.Name)}))
+	w.Header().Set("ETag", `"`+artifact.SHA256+`"`)
+	io.Copy(w, content)
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// azureSASVersion is the storage service version SAS tokens are signed for
+const azureSASVersion = "2022-11-02"
+
+// azureRequestTTL is how long the SAS token of a single API request is valid
+const azureRequestTTL = 15 * time.Minute
+
+// AzureArtifactStore keeps artifacts in an Azure Blob Storage container.
+// Every request carries a short-lived service SAS signed with the account
+// key, the same mechanism used for signed download URLs.
+type AzureArtifactStore struct {
+	Endpoint   string
+	Account    string
+	AccountKey []byte
+	Container  string
+	Prefix     string
+	client     *http.Client
+	now        func() time.Time
+}
+
+// NewAzureArtifactStoreFromEnv creates an Azure store from the AZURE_STORAGE_*
+// environment variables
+func NewAzureArtifactStoreFromEnv() *AzureArtifactStore {
+	account := os.Getenv("AZURE_STORAGE_ACCOUNT")
+	endpoint := os.Getenv("AZURE_STORAGE_ENDPOINT")
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.blob.core.windows.net", account)
+	}
+	key, err := base64.StdEncoding.DecodeString(os.Getenv("AZURE_STORAGE_KEY"))
+	if err != nil {
+		log.Printf("AZURE_STORAGE_KEY is not valid base64: %v", err)
+	}
+
+	return &AzureArtifactStore{
+		Endpoint:   strings.TrimSuffix(endpoint, "/"),
+		Account:    account,
+		AccountKey: key,
+		Container:  os.Getenv("AZURE_STORAGE_CONTAINER"),
+		Prefix:     os.Getenv("AZURE_STORAGE_PREFIX"),
+		client:     &http.Client{Timeout: 30 * time.Minute},
+		now:        time.Now,
+	}
+}
+
+// blobPath is the escaped path of a blob below the endpoint
+func (az *AzureArtifactStore) blobPath(key string) string {
+	var escaped []string
+	for _, segment := range strings.Split(az.Prefix+key, "/") {
+		escaped = append(escaped, url.PathEscape(segment))
+	}
+	return "/" + url.PathEscape(az.Container) + "/" + strings.Join(escaped, "/")
+}
+
+// sas returns a service SAS query granting permissions on a blob, or on the
+// container when key is empty, until expiry
+func (az *AzureArtifactStore) sas(key, permissions string, expiry time.Time) url.Values {
+	resource, canonical := "c", fmt.Sprintf("/blob/%s/%s", az.Account, az.Container)
+	if key != "" {
+		resource, canonical = "b", canonical+"/"+az.Prefix+key
+	}
+	expires := expiry.UTC().Format(time.RFC3339)
+
+	// Fields: permissions, start, expiry, resource, identifier, IP, protocol,
+	// version, resource type, snapshot time, encryption scope and the five
+	// response header overrides
+	stringToSign := strings.Join([]string{
+		permissions, "", expires, canonical, "", "", "", azureSASVersion, resource, "", "", "", "", "", "", "",
+	}, "\n")
+	mac := hmac.New(sha256.New, az.AccountKey)
+	mac.Write([]byte(stringToSign))
+
+	return url.Values{
+		"sv":  {azureSASVersion},
+		"sr":  {resource},
+		"sp":  {permissions},
+		"se":  {expires},
+		"sig": {base64.StdEncoding.EncodeToString(mac.Sum(nil))},
+	}
+}
+
+// request builds a request for a blob (or the container when key is empty)
+// authorised by a SAS with the given permissions
+func (az *AzureArtifactStore) request(ctx context.Context, method, key, permissions string, query url.Values, body io.Reader) (*http.Request, error) {
+	target := az.Endpoint + "/" + url.PathEscape(az.Container)
+	if key != "" {
+		target = az.Endpoint + az.blobPath(key)
+	}
+
+	sas := az.sas(key, permissions, az.now().Add(azureRequestTTL))
+	for name, values := range query {
+		sas[name] = values
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, target+"?"+sas.Encode(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("x-ms-version", azureSASVersion)
+	return req, nil
+}
+
+// Put uploads an artifact as a block blob with a single Put Blob request
+func (az *AzureArtifactStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	req, err := az.request(ctx, "PUT", key, "cw", nil, r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("x-ms-blob-type", "BlockBlob")
+
+	resp, err := az.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Get downloads an artifact
+func (az *AzureArtifactStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	req, err := az.request(ctx, "GET", key, "r", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := az.do(req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Delete removes an artifact; deleting a missing blob is not an error
+func (az *AzureArtifactStore) Delete(ctx context.Context, key string) error {
+	req, err := az.request(ctx, "DELETE", key, "d", nil, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := az.do(req)
+	if err == errArtifactNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// azureListResult is the subset of a List Blobs response we use
+type azureListResult struct {
+	Blobs []struct {
+		Name       string `xml:"Name"`
+		Properties struct {
+			ContentLength int64  `xml:"Content-Length"`
+			LastModified  string `xml:"Last-Modified"`
+		} `xml:"Properties"`
+	} `xml:"Blobs>Blob"`
+	NextMarker string `xml:"NextMarker"`
+}
+
+// List returns the stored objects whose key starts with prefix, following
+// List Blobs pagination
+func (az *AzureArtifactStore) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	marker := ""
+
+	for {
+		query := url.Values{"restype": {"container"}, "comp": {"list"}, "prefix": {az.Prefix + prefix}}
+		if marker != "" {
+			query.Set("marker", marker)
+		}
+
+		req, err := az.request(ctx, "GET", "", "l", query, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := az.do(req)
+		if err != nil {
+			return nil, err
+		}
+		var result azureListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("decoding list response: %w", err)
+		}
+
+		for _, blob := range result.Blobs {
+			modified, _ := time.Parse(time.RFC1123, blob.Properties.LastModified)
+			objects = append(objects, ObjectInfo{
+				Key:     strings.TrimPrefix(blob.Name, az.Prefix),
+				Size:    blob.Properties.ContentLength,
+				ModTime: modified,
+			})
+		}
+
+		if result.NextMarker == "" {
+			return objects, nil
+		}
+		marker = result.NextMarker
+	}
+}
+
+// SignedURL returns a read-only SAS URL for an artifact valid for expires
+func (az *AzureArtifactStore) SignedURL(ctx context.Context, key string, expires time.Duration) (string, error) {
+	return az.Endpoint + az.blobPath(key) + "?" + az.sas(key, "r", az.now().Add(expires)).Encode(), nil
+}
+
+// do sends a request, converting error responses into errors
+func (az *AzureArtifactStore) do(req *http.Request) (*http.Response, error) {
+	resp, err := az.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, errArtifactNotFound
+	}
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("azure %s %s: status %d: %s", req.Method, req.URL.Path, resp.StatusCode, body)
+	}
+	return resp, nil
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gcsEndpoint serves both the JSON API and signed URL downloads
+const gcsEndpoint = "https://storage.googleapis.com"
+
+// GCSArtifactStore keeps artifacts in a Google Cloud Storage bucket using the
+// JSON API, authenticated with the instance's service account (Workload
+// Identity on GKE)
+type GCSArtifactStore struct {
+	Endpoint string
+	Bucket   string
+	Prefix   string
+	// SignerEmail is the service account signed URLs are issued by; the
+	// instance's own service account when empty
+	SignerEmail string
+	// tokens is nil when talking to an emulator, which needs no auth
+	tokens      *GCPTokenSource
+	iamEndpoint string
+	client      *http.Client
+	now         func() time.Time
+}
+
+// NewGCSArtifactStoreFromEnv creates a GCS store from the GCS_* environment
+// variables. STORAGE_EMULATOR_HOST points it at a local emulator.
+func NewGCSArtifactStoreFromEnv() *GCSArtifactStore {
+	store := &GCSArtifactStore{
+		Endpoint:    gcsEndpoint,
+		Bucket:      os.Getenv("GCS_BUCKET"),
+		Prefix:      os.Getenv("GCS_PREFIX"),
+		SignerEmail: os.Getenv("GCS_SIGNER_EMAIL"),
+		tokens:      NewGCPTokenSource(),
+		iamEndpoint: gcpIAMCredentialsEndpoint,
+		client:      &http.Client{Timeout: 30 * time.Minute},
+		now:         time.Now,
+	}
+	if emulator := os.Getenv("STORAGE_EMULATOR_HOST"); emulator != "" {
+		if !strings.Contains(emulator, "://") {
+			emulator = "http://" + emulator
+		}
+		store.Endpoint = strings.TrimSuffix(emulator, "/")
+		store.tokens = nil
+	}
+	return store
+}
+
+// objectPath is the JSON API path of an object; the whole name, slashes
+// included, is a single path segment
+func (gcs *GCSArtifactStore) objectPath(key string) string {
+	name := strings.ReplaceAll(url.QueryEscape(gcs.Prefix+key), "+", "%20")
+	return fmt.Sprintf("%s/storage/v1/b/%s/o/%s", gcs.Endpoint, url.PathEscape(gcs.Bucket), name)
+}
+
+// Put uploads an artifact with a single media upload
+func (gcs *GCSArtifactStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	query := url.Values{"uploadType": {"media"}, "name": {gcs.Prefix + key}}
+	target := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?%s", gcs.Endpoint, url.PathEscape(gcs.Bucket), canonicalQuery(query))
+
+	req, err := http.NewRequestWithContext(ctx, "POST", target, r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := gcs.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Get downloads an artifact
+func (gcs *GCSArtifactStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", gcs.objectPath(key)+"?alt=media", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := gcs.do(req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Delete removes an artifact; deleting a missing object is not an error
+func (gcs *GCSArtifactStore) Delete(ctx context.Context, key string) error {
+	req, err := http.NewRequestWithContext(ctx, "DELETE", gcs.objectPath(key), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := gcs.do(req)
+	if err == errArtifactNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// gcsListResult is the subset of an objects.list response we use
+type gcsListResult struct {
+	Items []struct {
+		Name    string    `json:"name"`
+		Size    string    `json:"size"`
+		Updated time.Time `json:"updated"`
+	} `json:"items"`
+	NextPageToken string `json:"nextPageToken"`
+}
+
+// List returns the stored objects whose key starts with prefix, following pagination
+func (gcs *GCSArtifactStore) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	token := ""
+
+	for {
+		query := url.Values{"prefix": {gcs.Prefix + prefix}}
+		if token != "" {
+			query.Set("pageToken", token)
+		}
+
+		target := fmt.Sprintf("%s/storage/v1/b/%s/o?%s", gcs.Endpoint, url.PathEscape(gcs.Bucket), canonicalQuery(query))
+		req, err := http.NewRequestWithContext(ctx, "GET", target, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := gcs.do(req)
+		if err != nil {
+			return nil, err
+		}
+		var result gcsListResult
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("decoding list response: %w", err)
+		}
+
+		for _, item := range result.Items {
+			size, _ := strconv.ParseInt(item.Size, 10, 64)
+			objects = append(objects, ObjectInfo{
+				Key:     strings.TrimPrefix(item.Name, gcs.Prefix),
+				Size:    size,
+				ModTime: item.Updated,
+			})
+		}
+
+		if result.NextPageToken == "" {
+			return objects, nil
+		}
+		token = result.NextPageToken
+	}
+}
+
+// SignedURL returns a V4 signed GET URL for an artifact valid for expires.
+// The signature comes from the IAM credentials API, so no private key has
+// to be mounted into the service.
+func (gcs *GCSArtifactStore) SignedURL(ctx context.Context, key string, expires time.Duration) (string, error) {
+	if gcs.tokens == nil {
+		return "", fmt.Errorf("signed URLs are not supported by the storage emulator")
+	}
+
+	email := gcs.SignerEmail
+	if email == "" {
+		var err error
+		if email, err = gcs.tokens.Email(ctx); err != nil {
+			return "", err
+		}
+	}
+
+	now := gcs.now().UTC()
+	timestamp := now.Format("20060102T150405Z")
+	scope := now.Format("20060102") + "/auto/storage/goog4_request"
+
+	u, err := url.Parse(gcs.Endpoint)
+	if err != nil {
+		return "", err
+	}
+	var segments []string
+	for _, segment := range strings.Split(gcs.Bucket+"/"+gcs.Prefix+key, "/") {
+		segments = append(segments, url.PathEscape(segment))
+	}
+	u.Path = "/" + gcs.Bucket + "/" + gcs.Prefix + key
+	u.RawPath = "/" + strings.Join(segments, "/")
+
+	query := url.Values{
+		"X-Goog-Algorithm":     {"GOOG4-RSA-SHA256"},
+		"X-Goog-Credential":    {email + "/" + scope},
+		"X-Goog-Date":          {timestamp},
+		"X-Goog-Expires":       {strconv.Itoa(int(expires.Seconds()))},
+		"X-Goog-SignedHeaders": {"host"},
+	}
+
+	canonicalRequest := strings.Join([]string{
+		"GET",
+		u.EscapedPath(),
+		canonicalQuery(query),
+		"host:" + u.Host + "\n",
+		"host",
+		unsignedPayload,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"GOOG4-RSA-SHA256",
+		timestamp,
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	signature, err := gcs.tokens.SignBlob(ctx, gcs.iamEndpoint, email, []byte(stringToSign))
+	if err != nil {
+		return "", err
+	}
+	query.Set("X-Goog-Signature", hex.EncodeToString(signature))
+	u.RawQuery = canonicalQuery(query)
+	return u.String(), nil
+}
+
+// authorize adds the instance's access token to a request
+func (gcs *GCSArtifactStore) authorize(req *http.Request) error {
+	if gcs.tokens == nil {
+		return nil
+	}
+	token, err := gcs.tokens.Token(req.Context())
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// do authenticates and sends a request, converting error responses into errors
+func (gcs *GCSArtifactStore) do(req *http.Request) (*http.Response, error) {
+	if err := gcs.authorize(req); err != nil {
+		return nil, err
+	}
+
+	resp, err := gcs.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, errArtifactNotFound
+	}
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("gcs %s %s: status %d: %s", req.Method, req.URL.Path, resp.StatusCode, body)
+	}
+	return resp, nil
+}
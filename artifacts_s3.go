@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// unsignedPayload tells S3 not to verify the payload hash, so uploads can be
+// streamed without buffering them to compute the hash first
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// S3ArtifactStore keeps artifacts in an S3-compatible bucket (AWS S3, MinIO,
+// Ceph, R2, ...) using path-style requests signed with AWS Signature V4
+type S3ArtifactStore struct {
+	Endpoint        string
+	Bucket          string
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+	Prefix          string
+	client          *http.Client
+	now             func() time.Time
+}
+
+// NewS3ArtifactStoreFromEnv creates an S3 store from the S3_* environment variables
+func NewS3ArtifactStoreFromEnv() *S3ArtifactStore {
+	region := os.Getenv("S3_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+	endpoint := os.Getenv("S3_ENDPOINT")
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", region)
+	}
+
+	return &S3ArtifactStore{
+		Endpoint:        strings.TrimSuffix(endpoint, "/"),
+		Bucket:          os.Getenv("S3_BUCKET"),
+		Region:          region,
+		AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+		Prefix:          os.Getenv("S3_PREFIX"),
+		client:          &http.Client{Timeout: 30 * time.Minute},
+		now:             time.Now,
+	}
+}
+
+func (s3 *S3ArtifactStore) objectURL(key string) string {
+	var escaped []string
+	for _, segment := range strings.Split(s3.Prefix+key, "/") {
+		escaped = append(escaped, url.PathEscape(segment))
+	}
+	return fmt.Sprintf("%s/%s/%s", s3.Endpoint, url.PathEscape(s3.Bucket), strings.Join(escaped, "/"))
+}
+
+// Put uploads an artifact with a single PUT Object request
+func (s3 *S3ArtifactStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	req, err := http.NewRequestWithContext(ctx, "PUT", s3.objectURL(key), r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := s3.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Get downloads an artifact
+func (s3 *S3ArtifactStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", s3.objectURL(key), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s3.do(req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// listBucketResult is the subset of a ListObjectsV2 response we use
+type listBucketResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List returns the stored objects whose key starts with prefix, following
+// ListObjectsV2 pagination
+func (s3 *S3ArtifactStore) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	token := ""
+
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {s3.Prefix + prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/%s", s3.Endpoint, url.PathEscape(s3.Bucket)), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.URL.RawQuery = canonicalQuery(query)
+
+		resp, err := s3.do(req)
+		if err != nil {
+			return nil, err
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("decoding list response: %w", err)
+		}
+
+		for _, object := range result.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:     strings.TrimPrefix(object.Key, s3.Prefix),
+				Size:    object.Size,
+				ModTime: object.LastModified,
+			})
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// canonicalQuery encodes a query string the way Signature V4 expects:
+// sorted by key with spaces as %20
+func canonicalQuery(query url.Values) string {
+	return strings.ReplaceAll(query.Encode(), "+", "%20")
+}
+
+// Delete removes an artifact; S3 treats deleting a missing key as success
+func (s3 *S3ArtifactStore) Delete(ctx context.Context, key string) error {
+	req, err := http.NewRequestWithContext(ctx, "DELETE", s3.objectURL(key), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s3.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// SignedURL returns a presigned GET URL for an artifact valid for expires
+func (s3 *S3ArtifactStore) SignedURL(ctx context.Context, key string, expires time.Duration) (string, error) {
+	u, err := url.Parse(s3.objectURL(key))
+	if err != nil {
+		return "", err
+	}
+	credentials := awsCredentials{AccessKeyID: s3.AccessKeyID, SecretAccessKey: s3.SecretAccessKey}
+	return presignAWSURL(u, credentials, "s3", s3.Region, expires, s3.now().UTC()), nil
+}
+
+// do signs and sends a request, converting error responses into errors
+func (s3 *S3ArtifactStore) do(req *http.Request) (*http.Response, error) {
+	s3.sign(req, s3.now().UTC())
+
+	resp, err := s3.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, errArtifactNotFound
+	}
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3 %s %s: status %d: %s", req.Method, req.URL.Path, resp.StatusCode, body)
+	}
+	return resp, nil
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req
+func (s3 *S3ArtifactStore) sign(req *http.Request, now time.Time) {
+	req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+	credentials := awsCredentials{AccessKeyID: s3.AccessKeyID, SecretAccessKey: s3.SecretAccessKey}
+	signAWSRequest(req, credentials, "s3", s3.Region, unsignedPayload, now)
+}
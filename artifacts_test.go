@@ -0,0 +1,467 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidArtifactName(t *testing.T) {
+	for _, name := range []string{"app.tar.gz", "dist/app.js", "reports/junit.xml"} {
+		assert.True(t, validArtifactName(name), name)
+	}
+	for _, name := range []string{"", "/etc/passwd", "../secret", "..", ".", "a/../../b", "a//b", "dist/", `a\b`} {
+		assert.False(t, validArtifactName(name), name)
+	}
+}
+
+func TestLocalArtifactStore(t *testing.T) {
+	store := NewLocalArtifactStore(t.TempDir())
+	ctx := context.Background()
+
+	require.NoError(t, store.Put(ctx, "builds/1/dist/app.js", strings.NewReader("console.log(1)"), 14, "text/javascript"))
+
+	content, err := store.Get(ctx, "builds/1/dist/app.js")
+	require.NoError(t, err)
+	data, _ := io.ReadAll(content)
+	content.Close()
+	assert.Equal(t, "console.log(1)", string(data))
+
+	require.NoError(t, store.Delete(ctx, "builds/1/dist/app.js"))
+	_, err = store.Get(ctx, "builds/1/dist/app.js")
+	assert.ErrorIs(t, err, errArtifactNotFound)
+	assert.NoError(t, store.Delete(ctx, "builds/1/dist/app.js"))
+}
+
+func newArtifactRouter(service *BuildService) *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/builds/{id}/artifacts", service.listArtifactsHandler).Methods("GET")
+	router.HandleFunc("/api/v1/builds/{id}/artifacts/{name:.+}", service.uploadArtifactHandler).Methods("PUT")
+	router.HandleFunc("/api/v1/builds/{id}/artifacts/{name:.+}", service.downloadArtifactHandler).Methods("GET")
+	return router
+}
+
+func TestArtifactUploadAndDownload(t *testing.T) {
+	service, mockDB := setupTestService()
+	service.artifacts.store = NewLocalArtifactStore(t.TempDir())
+	router := newArtifactRouter(service)
+
+	build := &BuildRequest{ID: 3, ProjectName: "api", Status: "running"}
+	mockDB.On("GetBuild", 3).Return(build, nil)
+	mockDB.On("GetProjectByName", "api").Return(nil, fmt.Errorf("project not found"))
+	mockDB.On("GetArtifact", 3, "dist/app.txt").Return(nil, fmt.Errorf("artifact not found")).Once()
+
+	var stored *Artifact
+	mockDB.On("CreateArtifact", mock.AnythingOfType("*main.Artifact")).Run(func(args mock.Arguments) {
+		stored = args.Get(0).(*Artifact)
+	}).Return(9, nil)
+
+	req := httptest.NewRequest("PUT", "/api/v1/builds/3/artifacts/dist/app.txt?step=2", strings.NewReader("hello"))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	assert.Equal(t, 2, *stored.Step)
+	assert.False(t, stored.Published)
+	var artifact Artifact
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&artifact))
+	assert.Equal(t, 9, artifact.ID)
+	assert.Equal(t, int64(5), artifact.Size)
+	assert.Equal(t, "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", artifact.SHA256)
+	assert.Equal(t, "builds/3/dist/app.txt", stored.StorageKey)
+	assert.Contains(t, artifact.ContentType, "text/plain")
+
+	mockDB.On("GetArtifact", 3, "dist/app.txt").Return(stored, nil)
+
+	req = httptest.NewRequest("GET", "/api/v1/builds/3/artifacts/dist/app.txt", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "hello", w.Body.String())
+	assert.Equal(t, `attachment; filename=app.txt`, w.Header().Get("Content-Disposition"))
+
+	// Uploading the same name again is rejected
+	req = httptest.NewRequest("PUT", "/api/v1/builds/3/artifacts/dist/app.txt", strings.NewReader("again"))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	mockDB.AssertExpectations(t)
+}
+
+func TestArtifactUploadRejected(t *testing.T) {
+	project := &Project{Name: "api", ArtifactTagPattern: "v*.*.*"}
+
+	tests := []struct {
+		name           string
+		path           string
+		build          *BuildRequest
+		expectedStatus int
+	}{
+		{"finished build", "/api/v1/builds/3/artifacts/app.txt", &BuildRequest{ID: 3, ProjectName: "api", Status: "success"}, http.StatusConflict},
+		{"directory name", "/api/v1/builds/3/artifacts/dist/", nil, http.StatusBadRequest},
+		{"branch build with artifact tag pattern", "/api/v1/builds/3/artifacts/app.txt", &BuildRequest{ID: 3, ProjectName: "api", Branch: "main", Status: "running"}, http.StatusForbidden},
+		{"non-release tag", "/api/v1/builds/3/artifacts/app.txt", &BuildRequest{ID: 3, ProjectName: "api", Tag: "nightly", Status: "running"}, http.StatusForbidden},
+		{"too large", "/api/v1/builds/3/artifacts/app.txt", &BuildRequest{ID: 3, ProjectName: "api", Tag: "v1.2.0", Status: "running"}, http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service, mockDB := setupTestService()
+			service.artifacts.maxSize = 3
+			if tt.build != nil {
+				mockDB.On("GetBuild", 3).Return(tt.build, nil)
+			}
+			if tt.build != nil && tt.build.Status == "running" {
+				mockDB.On("GetProjectByName", "api").Return(project, nil)
+			}
+
+			req := httptest.NewRequest("PUT", tt.path, strings.NewReader("hello"))
+			w := httptest.NewRecorder()
+			newArtifactRouter(service).ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			mockDB.AssertExpectations(t)
+		})
+	}
+}
+
+func TestArtifactManagerPurgeExpired(t *testing.T) {
+	service, mockDB := setupTestService()
+	store := NewLocalArtifactStore(t.TempDir())
+	service.artifacts.store = store
+	service.artifacts.retention = time.Hour
+
+	ctx := context.Background()
+	require.NoError(t, store.Put(ctx, "builds/1/old.txt", strings.NewReader("x"), 1, "text/plain"))
+
+	mockDB.On("ListArtifactsCreatedBefore", mock.AnythingOfType("time.Time"), 500).
+		Return([]*Artifact{{ID: 4, StorageKey: "builds/1/old.txt"}}, nil)
+	mockDB.On("DeleteArtifact", 4).Return(nil)
+
+	service.artifacts.purgeExpired(ctx)
+
+	_, err := store.Get(ctx, "builds/1/old.txt")
+	assert.ErrorIs(t, err, errArtifactNotFound)
+	mockDB.AssertExpectations(t)
+}
+
+func TestS3ArtifactStore(t *testing.T) {
+	objects := make(map[string]string)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		assert.True(t, strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/20240102/eu-west-1/s3/aws4_request, SignedHeaders="), auth)
+		assert.Equal(t, unsignedPayload, r.Header.Get("X-Amz-Content-Sha256"))
+
+		switch r.Method {
+		case "PUT":
+			body, _ := io.ReadAll(r.Body)
+			objects[r.URL.Path] = string(body)
+		case "GET":
+			if r.URL.Path == "/artifacts" {
+				assert.Equal(t, "2", r.URL.Query().Get("list-type"))
+				assert.Equal(t, "ci/builds/", r.URL.Query().Get("prefix"))
+				w.Write([]byte(`<ListBucketResult><Contents><Key>ci/builds/1/app v1.txt</Key><Size>4</Size><LastModified>2024-01-02T03:04:05.000Z</LastModified></Contents><IsTruncated>false</IsTruncated></ListBucketResult>`))
+				return
+			}
+			body, ok := objects[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write([]byte(body))
+		case "DELETE":
+			delete(objects, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer server.Close()
+
+	t.Setenv("S3_ENDPOINT", server.URL)
+	t.Setenv("S3_BUCKET", "artifacts")
+	t.Setenv("S3_REGION", "eu-west-1")
+	t.Setenv("S3_ACCESS_KEY_ID", "AKID")
+	t.Setenv("S3_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("S3_PREFIX", "ci/")
+	store := NewS3ArtifactStoreFromEnv()
+	store.now = func() time.Time { return time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC) }
+	ctx := context.Background()
+
+	require.NoError(t, store.Put(ctx, "builds/1/app v1.txt", strings.NewReader("data"), 4, "text/plain"))
+	assert.Equal(t, "data", objects["/artifacts/ci/builds/1/app v1.txt"])
+
+	content, err := store.Get(ctx, "builds/1/app v1.txt")
+	require.NoError(t, err)
+	data, _ := io.ReadAll(content)
+	content.Close()
+	assert.Equal(t, "data", string(data))
+
+	listed, err := store.List(ctx, "builds/")
+	require.NoError(t, err)
+	require.Len(t, listed, 1)
+	assert.Equal(t, "builds/1/app v1.txt", listed[0].Key)
+	assert.Equal(t, int64(4), listed[0].Size)
+
+	require.NoError(t, store.Delete(ctx, "builds/1/app v1.txt"))
+	_, err = store.Get(ctx, "builds/1/app v1.txt")
+	assert.ErrorIs(t, err, errArtifactNotFound)
+}
+
+func TestS3SignedURL(t *testing.T) {
+	t.Setenv("S3_ENDPOINT", "https://s3.eu-west-1.amazonaws.com")
+	t.Setenv("S3_BUCKET", "artifacts")
+	t.Setenv("S3_REGION", "eu-west-1")
+	t.Setenv("S3_ACCESS_KEY_ID", "AKID")
+	t.Setenv("S3_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("S3_PREFIX", "")
+	store := NewS3ArtifactStoreFromEnv()
+	store.now = func() time.Time { return time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC) }
+
+	signed, err := store.SignedURL(context.Background(), "builds/1/app v1.txt", 15*time.Minute)
+	require.NoError(t, err)
+	u, err := url.Parse(signed)
+	require.NoError(t, err)
+	assert.Equal(t, "/artifacts/builds/1/app v1.txt", u.Path)
+	assert.Equal(t, "AKID/20240102/eu-west-1/s3/aws4_request", u.Query().Get("X-Amz-Credential"))
+	assert.Equal(t, "900", u.Query().Get("X-Amz-Expires"))
+	assert.Len(t, u.Query().Get("X-Amz-Signature"), 64)
+}
+
+func TestGCSArtifactStore(t *testing.T) {
+	objects := make(map[string]string)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.Header.Get("Authorization"))
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/upload/storage/v1/b/artifacts/o":
+			assert.Equal(t, "media", r.URL.Query().Get("uploadType"))
+			body, _ := io.ReadAll(r.Body)
+			objects[r.URL.Query().Get("name")] = string(body)
+			w.Write([]byte(`{}`))
+		case r.Method == "GET" && r.URL.Path == "/storage/v1/b/artifacts/o":
+			assert.Equal(t, "ci/builds/", r.URL.Query().Get("prefix"))
+			w.Write([]byte(`{"items": [{"name": "ci/builds/1/app v1.txt", "size": "4", "updated": "2024-01-02T03:04:05.000Z"}]}`))
+		case strings.HasPrefix(r.URL.Path, "/storage/v1/b/artifacts/o/"):
+			name := strings.TrimPrefix(r.URL.Path, "/storage/v1/b/artifacts/o/")
+			body, ok := objects[name]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if r.Method == "DELETE" {
+				delete(objects, name)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			assert.Equal(t, "media", r.URL.Query().Get("alt"))
+			w.Write([]byte(body))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		}
+	}))
+	defer server.Close()
+
+	t.Setenv("STORAGE_EMULATOR_HOST", strings.TrimPrefix(server.URL, "http://"))
+	t.Setenv("GCS_BUCKET", "artifacts")
+	t.Setenv("GCS_PREFIX", "ci/")
+	store := NewGCSArtifactStoreFromEnv()
+	ctx := context.Background()
+
+	require.NoError(t, store.Put(ctx, "builds/1/app v1.txt", strings.NewReader("data"), 4, "text/plain"))
+	assert.Equal(t, "data", objects["ci/builds/1/app v1.txt"])
+
+	content, err := store.Get(ctx, "builds/1/app v1.txt")
+	require.NoError(t, err)
+	data, _ := io.ReadAll(content)
+	content.Close()
+	assert.Equal(t, "data", string(data))
+
+	listed, err := store.List(ctx, "builds/")
+	require.NoError(t, err)
+	require.Len(t, listed, 1)
+	assert.Equal(t, "builds/1/app v1.txt", listed[0].Key)
+	assert.Equal(t, int64(4), listed[0].Size)
+
+	require.NoError(t, store.Delete(ctx, "builds/1/app v1.txt"))
+	require.NoError(t, store.Delete(ctx, "builds/1/app v1.txt"))
+	_, err = store.Get(ctx, "builds/1/app v1.txt")
+	assert.ErrorIs(t, err, errArtifactNotFound)
+
+	_, err = store.SignedURL(ctx, "builds/1/app v1.txt", time.Minute)
+	assert.Error(t, err)
+}
+
+func TestGCSSignedURL(t *testing.T) {
+	var signed []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			w.Write([]byte(`{"access_token": "ya29.token", "expires_in": 3600}`))
+		case "/email":
+			w.Write([]byte("ci@project.iam.gserviceaccount.com"))
+		case "/v1/projects/-/serviceAccounts/ci@project.iam.gserviceaccount.com:signBlob":
+			assert.Equal(t, "Bearer ya29.token", r.Header.Get("Authorization"))
+			var body struct{ Payload []byte }
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			signed = body.Payload
+			w.Write([]byte(`{"keyId": "1", "signedBlob": "c2lnbmF0dXJl"}`))
+		default:
+			t.Errorf("unexpected request %s", r.URL)
+		}
+	}))
+	defer server.Close()
+
+	t.Setenv("STORAGE_EMULATOR_HOST", "")
+	t.Setenv("GCS_BUCKET", "artifacts")
+	t.Setenv("GCS_PREFIX", "")
+	t.Setenv("GCS_SIGNER_EMAIL", "")
+	store := NewGCSArtifactStoreFromEnv()
+	store.tokens.metadata = server.URL
+	store.iamEndpoint = server.URL
+	store.now = func() time.Time { return time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC) }
+
+	raw, err := store.SignedURL(context.Background(), "builds/1/app v1.txt", time.Hour)
+	require.NoError(t, err)
+	u, err := url.Parse(raw)
+	require.NoError(t, err)
+	assert.Equal(t, "storage.googleapis.com", u.Host)
+	assert.Equal(t, "/artifacts/builds/1/app%20v1.txt", u.EscapedPath())
+	assert.Equal(t, "ci@project.iam.gserviceaccount.com/20240102/auto/storage/goog4_request", u.Query().Get("X-Goog-Credential"))
+	assert.Equal(t, "3600", u.Query().Get("X-Goog-Expires"))
+	assert.Equal(t, "7369676e6174757265", u.Query().Get("X-Goog-Signature"))
+	assert.True(t, strings.HasPrefix(string(signed), "GOOG4-RSA-SHA256\n20240102T030405Z\n20240102/auto/storage/goog4_request\n"), string(signed))
+}
+
+func TestAzureArtifactStore(t *testing.T) {
+	objects := make(map[string]string)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		assert.Equal(t, azureSASVersion, query.Get("sv"))
+		assert.NotEmpty(t, query.Get("sig"))
+		assert.Equal(t, azureSASVersion, r.Header.Get("x-ms-version"))
+
+		if r.URL.Path == "/artifacts" {
+			assert.Equal(t, "c", query.Get("sr"))
+			assert.Equal(t, "l", query.Get("sp"))
+			assert.Equal(t, "list", query.Get("comp"))
+			assert.Equal(t, "ci/builds/", query.Get("prefix"))
+			w.Write([]byte(`<EnumerationResults><Blobs><Blob><Name>ci/builds/1/app v1.txt</Name><Properties><Last-Modified>Tue, 02 Jan 2024 03:04:05 GMT</Last-Modified><Content-Length>4</Content-Length></Properties></Blob></Blobs><NextMarker/></EnumerationResults>`))
+			return
+		}
+
+		assert.Equal(t, "b", query.Get("sr"))
+		switch r.Method {
+		case "PUT":
+			assert.Equal(t, "cw", query.Get("sp"))
+			assert.Equal(t, "BlockBlob", r.Header.Get("x-ms-blob-type"))
+			body, _ := io.ReadAll(r.Body)
+			objects[r.URL.Path] = string(body)
+			w.WriteHeader(http.StatusCreated)
+		case "GET":
+			body, ok := objects[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write([]byte(body))
+		case "DELETE":
+			if _, ok := objects[r.URL.Path]; !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			delete(objects, r.URL.Path)
+			w.WriteHeader(http.StatusAccepted)
+		}
+	}))
+	defer server.Close()
+
+	t.Setenv("AZURE_STORAGE_ENDPOINT", server.URL)
+	t.Setenv("AZURE_STORAGE_ACCOUNT", "devstoreaccount1")
+	t.Setenv("AZURE_STORAGE_KEY", "c2VjcmV0")
+	t.Setenv("AZURE_STORAGE_CONTAINER", "artifacts")
+	t.Setenv("AZURE_STORAGE_PREFIX", "ci/")
+	store := NewAzureArtifactStoreFromEnv()
+	ctx := context.Background()
+
+	require.NoError(t, store.Put(ctx, "builds/1/app v1.txt", strings.NewReader("data"), 4, "text/plain"))
+	assert.Equal(t, "data", objects["/artifacts/ci/builds/1/app v1.txt"])
+
+	content, err := store.Get(ctx, "builds/1/app v1.txt")
+	require.NoError(t, err)
+	data, _ := io.ReadAll(content)
+	content.Close()
+	assert.Equal(t, "data", string(data))
+
+	listed, err := store.List(ctx, "builds/")
+	require.NoError(t, err)
+	require.Len(t, listed, 1)
+	assert.Equal(t, "builds/1/app v1.txt", listed[0].Key)
+	assert.Equal(t, int64(4), listed[0].Size)
+	assert.Equal(t, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), listed[0].ModTime.UTC())
+
+	require.NoError(t, store.Delete(ctx, "builds/1/app v1.txt"))
+	require.NoError(t, store.Delete(ctx, "builds/1/app v1.txt"))
+	_, err = store.Get(ctx, "builds/1/app v1.txt")
+	assert.ErrorIs(t, err, errArtifactNotFound)
+}
+
+func TestAzureSAS(t *testing.T) {
+	store := &AzureArtifactStore{Account: "acct", AccountKey: []byte("secret"), Container: "artifacts", Prefix: "ci/"}
+	expiry := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	sas := store.sas("builds/1/app.txt", "r", expiry)
+	stringToSign := "r\n\n2024-01-02T03:04:05Z\n/blob/acct/artifacts/ci/builds/1/app.txt\n\n\n\n" + azureSASVersion + "\nb\n\n\n\n\n\n\n"
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(stringToSign))
+	assert.Equal(t, base64.StdEncoding.EncodeToString(mac.Sum(nil)), sas.Get("sig"))
+	assert.Equal(t, "2024-01-02T03:04:05Z", sas.Get("se"))
+}
+
+// signingStore is a local store that hands out signed URLs
+type signingStore struct {
+	*LocalArtifactStore
+	err error
+}
+
+func (ss *signingStore) SignedURL(ctx context.Context, key string, expires time.Duration) (string, error) {
+	return "https://storage.example.com/" + key + "?expires=" + expires.String(), ss.err
+}
+
+func TestArtifactDownloadRedirectsToSignedURL(t *testing.T) {
+	service, mockDB := setupTestService()
+	store := &signingStore{LocalArtifactStore: NewLocalArtifactStore(t.TempDir())}
+	service.artifacts.store = store
+	service.artifacts.signedURLTTL = 5 * time.Minute
+	router := newArtifactRouter(service)
+
+	require.NoError(t, store.Put(context.Background(), "builds/3/app.txt", strings.NewReader("hello"), 5, "text/plain"))
+	mockDB.On("GetBuild", 3).Return(&BuildRequest{ID: 3, ProjectName: "api", Status: "success"}, nil)
+	mockDB.On("GetArtifact", 3, "app.txt").Return(&Artifact{BuildID: 3, Name: "app.txt", Size: 5, ContentType: "text/plain", StorageKey: "builds/3/app.txt"}, nil)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/builds/3/artifacts/app.txt", nil))
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "https://storage.example.com/builds/3/app.txt?expires=5m0s", w.Header().Get("Location"))
+
+	// Signing failures fall back to streaming
+	store.err = fmt.Errorf("signing unavailable")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/builds/3/artifacts/app.txt", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "hello", w.Body.String())
+}
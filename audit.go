@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// auditMaxState caps the bytes of a response recorded as a change's after state
+const auditMaxState = 64 << 10
+
+// AuditEntry records a change made through the API: who made it, from
+// where, and the state of the resource before and after
+type AuditEntry struct {
+	ID         int64           `json:"id"`
+	CreatedAt  time.Time       `json:"created_at"`
+	Actor      string          `json:"actor"`
+	Org        string          `json:"org,omitempty"`
+	IP         string          `json:"ip"`
+	Method     string          `json:"method"`
+	Route      string          `json:"route"`
+	Path       string          `json:"path"`
+	Resource   string          `json:"resource"`
+	ResourceID string          `json:"resource_id,omitempty"`
+	Status     int             `json:"status"`
+	Before     json.RawMessage `json:"before,omitempty"`
+	After      json.RawMessage `json:"after,omitempty"`
+}
+
+// AuditFilter narrows a listing of the audit log. Empty fields match every entry.
+type AuditFilter struct {
+	Actor      string
+	Org        string
+	Resource   string
+	ResourceID string
+	Method     string
+	Since      *time.Time
+	Until      *time.Time
+	// BeforeID pages through the log, returning entries older than it
+	BeforeID int64
+	Limit    int
+}
+
+// auditSkippedRoutes accept POST without changing anything
+var auditSkippedRoutes = map[string]bool{
+	"POST /api/v1/graphql":                    true,
+	"POST /api/v1/pipelines/validate":         true,
+	"POST /api/v1/builds/{id}/otlp/v1/traces": true,
+}
+
+// auditActors names the systems behind requests that authenticate themselves
+var auditActors = map[string]string{
+	"/api/v1/webhooks/github":    "github",
+	"/api/v1/webhooks/gitlab":    "gitlab",
+	"/api/v1/webhooks/sonarqube": "sonarqube",
+	"/api/v1/slack/commands":     "slack",
+}
+
+// auditLoaders read the current state of a resource by its route's ID, for
+// the before state of changes to it
+func (bs *BuildService) auditLoaders() map[string]func(id string) (interface{}, error) {
+	byID := func(get func(id int) (interface{}, error)) func(string) (interface{}, error) {
+		return func(value string) (interface{}, error) {
+			id, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, err
+			}
+			return get(id)
+		}
+	}
+	return map[string]func(string) (interface{}, error){
+		"builds":        byID(func(id int) (interface{}, error) { return bs.db.GetBuild(id) }),
+		"projects":      byID(func(id int) (interface{}, error) { return bs.db.GetProject(id) }),
+		"deployments":   byID(func(id int) (interface{}, error) { return bs.db.GetDeployment(id) }),
+		"schedules":     byID(func(id int) (interface{}, error) { return bs.db.GetBuildSchedule(id) }),
+		"subscriptions": byID(func(id int) (interface{}, error) { return bs.db.GetWebhookSubscription(id) }),
+		"orgs":          func(name string) (interface{}, error) { return bs.db.GetOrganization(name) },
+	}
+}
+
+// auditResource returns the kind of resource a route acts on, the static
+// segment before its first variable or else its last, and the resource's ID
+func auditResource(route string, vars map[string]string) (resource, id string) {
+	segments := strings.Split(strings.TrimPrefix(route, "/api/v1/"), "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, "{") {
+			name := strings.Trim(segment, "{}")
+			if i > 0 {
+				resource = segments[i-1]
+			}
+			return resource, vars[name]
+		}
+		resource = segment
+	}
+	return resource, ""
+}
+
+// trustedProxies are the load balancers and proxies in TRUSTED_PROXIES
+// whose X-Forwarded-For and X-Forwarded-User headers are believed. Any other client could write
+// whatever it likes in them.
+var trustedProxies = parseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+
+// parseTrustedProxies reads a comma-separated list of addresses and CIDR
+// ranges, skipping invalid entries
+func parseTrustedProxies(value string) []netip.Prefix {
+	var proxies []netip.Prefix
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if prefix, err := netip.ParsePrefix(entry); err == nil {
+			proxies = append(proxies, prefix.Masked())
+		} else if addr, err := netip.ParseAddr(entry); err == nil {
+			proxies = append(proxies, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+		} else {
+			log.Printf("Ignoring invalid trusted proxy %q", entry)
+		}
+	}
+	return proxies
+}
+
+// trustedProxy reports whether addr is one of the trustedProxies
+func trustedProxy(addr string) bool {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return false
+	}
+	for _, proxy := range trustedProxies {
+		if proxy.Contains(ip.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP returns the address of the connection a request came over
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// clientIP returns the address a request came from. Behind trusted proxies
+// that's the last X-Forwarded-For hop they didn't add, otherwise the
+// connection's address.
+func clientIP(r *http.Request) string {
+	ip := remoteIP(r)
+	if !trustedProxy(ip) {
+		return ip
+	}
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			break
+		}
+		ip = hop
+		if !trustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// auditActor identifies who made a request: the admin, an API key, the
+// integration a webhook came from, or the user named by the X-Forwarded-User
+// of an authenticating proxy among the trustedProxies
+func auditActor(r *http.Request, route string) string {
+	switch {
+	case requestTenant(r).identity() != "":
+		return requestTenant(r).identity()
+	case auditActors[route] != "":
+		return auditActors[route]
+	case r.Header.Get("X-Forwarded-User") != "" && trustedProxy(remoteIP(r)):
+		return r.Header.Get("X-Forwarded-User")
+	}
+	return "anonymous"
+}
+
+// auditState encodes a before or after state with its secrets redacted,
+// returning nil for bodies that aren't complete JSON documents
+func auditState(body []byte) json.RawMessage {
+	var doc interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil
+	}
+	// Newly issued API keys are only shown once, never stored
+	if object, ok := doc.(map[string]interface{}); ok {
+		if key, ok := object["key"].(string); ok && strings.HasPrefix(key, apiKeyPrefix) {
+			object["key"] = redactedValue
+		}
+	}
+	state, err := json.Marshal(redactJSON(doc))
+	if err != nil {
+		return nil
+	}
+	return state
+}
+
+// AuditMiddleware records every successful POST, PUT, PATCH and DELETE in
+// the audit log, with the resource's state before the change and the
+// response as its state after. It must run after the tenancy middleware,
+// which identifies the caller.
+func (bs *BuildService) AuditMiddleware(next http.Handler) http.Handler {
+	loaders := bs.auditLoaders()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeTemplate(r)
+		if r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions || auditSkippedRoutes[r.Method+" "+route] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		entry := &AuditEntry{
+			Actor:  auditActor(r, route),
+			Org:    requestTenant(r).Org,
+			IP:     clientIP(r),
+			Method: r.Method,
+			Route:  route,
+			Path:   r.URL.Path,
+		}
+		if entry.Org == "" {
+			entry.Org = strings.ToLower(strings.TrimSpace(r.Header.Get("X-Organization")))
+		}
+		entry.Resource, entry.ResourceID = auditResource(route, mux.Vars(r))
+		if load := loaders[entry.Resource]; load != nil && entry.ResourceID != "" {
+			if before, err := load(entry.ResourceID); err == nil {
+				if encoded, err := json.Marshal(before); err == nil {
+					entry.Before = auditState(encoded)
+				}
+			}
+		}
+
+		rw := newResponseWriter(w)
+		rw.capture = &bytes.Buffer{}
+		rw.captureLimit = auditMaxState
+		next.ServeHTTP(rw, r)
+
+		entry.Status = rw.status
+		if rw.status >= http.StatusBadRequest {
+			return
+		}
+		entry.After = auditState(rw.capture.Bytes())
+		if err := bs.db.CreateAuditEntry(entry); err != nil {
+			bs.errors.Capture("audit", fmt.Errorf("recording %s %s: %w", entry.Method, entry.Path, err), nil)
+		}
+	})
+}
+
+// Audit log endpoint, newest first. Filters by ?actor=, ?org=, ?resource=,
+// ?resource_id=, ?method= and the ?since= and ?until= RFC 3339 times; pages
+// with ?before=<id> and ?limit= (100 by default, at most 1000).
+func (bs *BuildService) listAuditLogHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := AuditFilter{
+		Actor:      query.Get("actor"),
+		Org:        strings.ToLower(query.Get("org")),
+		Resource:   query.Get("resource"),
+		ResourceID: query.Get("resource_id"),
+		Method:     strings.ToUpper(query.Get("method")),
+		Limit:      100,
+	}
+
+	for name, target := range map[string]**time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if value := query.Get(name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				http.Error(w, name+" must be an RFC 3339 time", http.StatusBadRequest)
+				return
+			}
+			*target = &t
+		}
+	}
+	if value := query.Get("before"); value != "" {
+		id, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || id < 1 {
+			http.Error(w, "before must be an audit entry ID", http.StatusBadRequest)
+			return
+		}
+		filter.BeforeID = id
+	}
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > 1000 {
+			http.Error(w, "limit must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+		filter.Limit = limit
+	}
+
+	entries, err := bs.db.ListAuditEntries(filter)
+	if err != nil {
+		log.Printf("Error listing audit log: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
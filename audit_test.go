@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// auditRouter routes a few endpoints through the tenancy and audit middleware
+func auditRouter(service *BuildService) *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/builds/{id}", service.getBuildHandler).Methods("GET")
+	router.HandleFunc("/api/v1/builds/{id}", service.deleteBuildHandler).Methods("DELETE")
+	router.HandleFunc("/api/v1/admin/orgs/{org}/api-keys", service.createAPIKeyHandler).Methods("POST")
+	router.Use(service.tenancy.Middleware, service.AuditMiddleware)
+	return router
+}
+
+func TestAuditMiddlewareRecordsChanges(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "admin-secret")
+	withTrustedProxies(t, "192.0.2.1, 10.0.0.0/8")
+	service, mockDB := setupTestService()
+	router := auditRouter(service)
+	// Replace the catch-all expectation of setupTestService to collect the entries
+	for i, call := range mockDB.ExpectedCalls {
+		if call.Method == "CreateAuditEntry" {
+			mockDB.ExpectedCalls = append(mockDB.ExpectedCalls[:i], mockDB.ExpectedCalls[i+1:]...)
+			break
+		}
+	}
+
+	var entries []*AuditEntry
+	mockDB.On("GetBuild", 5).Return(&BuildRequest{ID: 5, ProjectName: "api", Status: "success"}, nil)
+	mockDB.On("DeleteBuild", 5).Return(&BuildRequest{ID: 5, ProjectName: "api", Status: "success"}, nil).Twice()
+	mockDB.On("GetBuild", 6).Return(nil, fmt.Errorf("build not found"))
+	mockDB.On("DeleteBuild", 6).Return(nil, fmt.Errorf("build not found")).Once()
+	mockDB.On("CreateAPIKey", mock.Anything, mock.AnythingOfType("string")).Return(nil).Once()
+	mockDB.On("GetOrganization", "acme").Return(&Organization{Name: "acme"}, nil)
+	mockDB.On("CreateAuditEntry", mock.Anything).Run(func(args mock.Arguments) {
+		entries = append(entries, args.Get(0).(*AuditEntry))
+	}).Return(nil)
+
+	req := httptest.NewRequest("DELETE", "/api/v1/builds/5", nil)
+	req.Header.Set("X-Forwarded-User", "jane")
+	req.Header.Set("X-Forwarded-For", "203.0.113.7, 10.0.0.1")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusNoContent, rr.Code, rr.Body.String())
+
+	// Reads and failed changes aren't recorded
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/v1/builds/5", nil))
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("DELETE", "/api/v1/builds/6", nil))
+
+	req = tenantRequest("POST", "/api/v1/admin/orgs/acme/api-keys", "admin-secret", `{"name": "ci"}`)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusCreated, rr.Code)
+
+	// Clients other than trusted proxies can't name a user
+	req = httptest.NewRequest("DELETE", "/api/v1/builds/5", nil)
+	req.RemoteAddr = "203.0.113.8:5000"
+	req.Header.Set("X-Forwarded-User", "mallory")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusNoContent, rr.Code, rr.Body.String())
+
+	require.Len(t, entries, 3)
+	deletion := entries[0]
+	assert.Equal(t, "jane", deletion.Actor)
+	assert.Equal(t, "203.0.113.7", deletion.IP)
+	assert.Equal(t, "DELETE", deletion.Method)
+	assert.Equal(t, "/api/v1/builds/{id}", deletion.Route)
+	assert.Equal(t, "builds", deletion.Resource)
+	assert.Equal(t, "5", deletion.ResourceID)
+	assert.Equal(t, http.StatusNoContent, deletion.Status)
+	assert.Contains(t, string(deletion.Before), `"project_name":"api"`)
+	assert.Nil(t, deletion.After)
+
+	// Issued API keys aren't kept in the log
+	key := entries[1]
+	assert.Equal(t, "admin", key.Actor)
+	assert.Equal(t, "orgs", key.Resource)
+	var after map[string]interface{}
+	require.NoError(t, json.Unmarshal(key.After, &after))
+	assert.Equal(t, redactedValue, after["key"])
+
+	spoofed := entries[2]
+	assert.Equal(t, "anonymous", spoofed.Actor)
+	assert.Equal(t, "203.0.113.8", spoofed.IP)
+}
+
+// withTrustedProxies trusts proxies for the rest of the test
+func withTrustedProxies(t *testing.T, value string) {
+	previous := trustedProxies
+	trustedProxies = parseTrustedProxies(value)
+	t.Cleanup(func() { trustedProxies = previous })
+}
+
+func TestClientIP(t *testing.T) {
+	request := func(remote, forwarded string) *http.Request {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remote
+		if forwarded != "" {
+			req.Header.Set("X-Forwarded-For", forwarded)
+		}
+		return req
+	}
+
+	// Without trusted proxies X-Forwarded-For is whatever the client wrote
+	assert.Equal(t, "203.0.113.9", clientIP(request("203.0.113.9:5000", "10.9.9.9")))
+
+	withTrustedProxies(t, "10.0.0.0/8, 192.0.2.1, not-an-address")
+	assert.Len(t, trustedProxies, 2)
+	assert.Equal(t, "203.0.113.9", clientIP(request("203.0.113.9:5000", "10.9.9.9")), "only trusted proxies forward addresses")
+	assert.Equal(t, "198.51.100.4", clientIP(request("192.0.2.1:5000", "198.51.100.4")))
+	// The client may prepend hops of its own; the proxies' last one counts
+	assert.Equal(t, "198.51.100.4", clientIP(request("192.0.2.1:5000", "1.2.3.4, 198.51.100.4, 10.0.0.5")))
+	assert.Equal(t, "10.0.0.6", clientIP(request("192.0.2.1:5000", "10.0.0.6")))
+	assert.Equal(t, "192.0.2.1", clientIP(request("192.0.2.1:5000", "")))
+}
+
+func TestAuditResource(t *testing.T) {
+	for route, want := range map[string][2]string{
+		"/api/v1/builds":                       {"builds", ""},
+		"/api/v1/builds/{id}/retry":            {"builds", "7"},
+		"/api/v1/webhooks/subscriptions/{id}":  {"subscriptions", "7"},
+		"/api/v1/admin/orgs/{org}/api-keys":    {"orgs", "acme"},
+		"/api/v1/admin/fair-share/{org}":       {"fair-share", "acme"},
+		"/api/v1/webhooks/github":              {"github", ""},
+		"/api/v1/builds/{id}/artifacts/{name}": {"builds", "7"},
+		"/api/v1/admin/credentials/rotate":     {"rotate", ""},
+		"/api/v1/notifications/digests/{id}":   {"digests", "7"},
+	} {
+		resource, id := auditResource(route, map[string]string{"id": "7", "org": "acme", "name": "out.tar"})
+		assert.Equal(t, want, [2]string{resource, id}, route)
+	}
+}
+
+func TestListAuditLogHandler(t *testing.T) {
+	service, mockDB := setupTestService()
+	since := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	mockDB.On("ListAuditEntries", AuditFilter{Actor: "admin", Resource: "builds", Method: "DELETE", Since: &since, BeforeID: 90, Limit: 10}).
+		Return([]*AuditEntry{{ID: 89, Actor: "admin", Method: "DELETE", Resource: "builds", ResourceID: "3"}}, nil).Once()
+
+	rr := httptest.NewRecorder()
+	service.listAuditLogHandler(rr, httptest.NewRequest("GET", "/api/v1/audit?actor=admin&resource=builds&method=delete&since=2026-01-02T03:04:05Z&before=90&limit=10", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"resource_id":"3"`)
+
+	for _, query := range []string{"since=yesterday", "before=x", "limit=5000"} {
+		rr = httptest.NewRecorder()
+		service.listAuditLogHandler(rr, httptest.NewRequest("GET", "/api/v1/audit?"+query, nil))
+		assert.Equal(t, http.StatusBadRequest, rr.Code, query)
+	}
+	mockDB.AssertExpectations(t)
+}
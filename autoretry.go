@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+)
+
+// maxAutoRetriesLimit bounds a project's max_auto_retries
+const maxAutoRetriesLimit = 5
+
+// failureCategories are the categories classifyFailure assigns
+var failureCategories = map[string]bool{
+	failureCompile: true,
+	failureTest:    true,
+	failureInfra:   true,
+	failureOOM:     true,
+	failureTimeout: true,
+	failureUnknown: true,
+}
+
+// defaultAutoRetryCategories are retried when a project enables automatic
+// retries without choosing categories: only failures of the build
+// infrastructure, which a rerun can fix, and not test failures, which a rerun
+// would only hide
+var defaultAutoRetryCategories = []string{failureInfra}
+
+// validateAutoRetry checks a project's automatic retry policy, defaulting the
+// retried categories when retries are enabled
+func validateAutoRetry(project *Project) error {
+	if project.MaxAutoRetries < 0 || project.MaxAutoRetries > maxAutoRetriesLimit {
+		return fmt.Errorf("max_auto_retries must be between 0 and %d", maxAutoRetriesLimit)
+	}
+	for _, category := range project.AutoRetryCategories {
+		if !failureCategories[category] {
+			return fmt.Errorf("invalid auto_retry_categories category %q", category)
+		}
+	}
+	if project.MaxAutoRetries > 0 && len(project.AutoRetryCategories) == 0 {
+		project.AutoRetryCategories = defaultAutoRetryCategories
+	}
+	return nil
+}
+
+// autoRetry queues a retry of a finished build when its project retries
+// failures of its category and the build hasn't used up its retries
+func (bs *BuildService) autoRetry(ctx context.Context, build *BuildRequest, project *Project) {
+	if project == nil || project.MaxAutoRetries == 0 || build.FailureCategory == "" ||
+		!containsString(project.AutoRetryCategories, build.FailureCategory) {
+		return
+	}
+
+	retries, err := bs.db.CountAutoRetries(build.ID)
+	if err != nil {
+		bs.errors.Capture("executor", fmt.Errorf("counting automatic retries: %w", err), build)
+		return
+	}
+	if retries >= project.MaxAutoRetries {
+		log.Printf("Build %d failed with %s after %d automatic retries, not retrying", build.ID, build.FailureCategory, retries)
+		return
+	}
+
+	if _, err := bs.retryBuild(ctx, build, triggerAutoRetry); err != nil {
+		bs.errors.Capture("executor", fmt.Errorf("retrying %s failure: %w", build.FailureCategory, err), build)
+		return
+	}
+	bs.metrics.AutoRetries.WithLabelValues(build.ProjectName, build.FailureCategory).Inc()
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestValidateAutoRetry(t *testing.T) {
+	project := &Project{MaxAutoRetries: 2}
+	assert.NoError(t, validateAutoRetry(project))
+	assert.Equal(t, []string{failureInfra}, project.AutoRetryCategories)
+
+	project = &Project{MaxAutoRetries: 1, AutoRetryCategories: []string{failureOOM, failureTimeout}}
+	assert.NoError(t, validateAutoRetry(project))
+	assert.Equal(t, []string{failureOOM, failureTimeout}, project.AutoRetryCategories)
+
+	assert.NoError(t, validateAutoRetry(&Project{}))
+	assert.Error(t, validateAutoRetry(&Project{MaxAutoRetries: -1}))
+	assert.Error(t, validateAutoRetry(&Project{MaxAutoRetries: maxAutoRetriesLimit + 1}))
+	assert.Error(t, validateAutoRetry(&Project{MaxAutoRetries: 1, AutoRetryCategories: []string{"flaky"}}))
+}
+
+func TestAutoRetryInfrastructureFailures(t *testing.T) {
+	service, mockDB := setupTestService()
+	project := &Project{Name: "api", MaxAutoRetries: 2, AutoRetryCategories: []string{failureInfra}}
+	original := 7
+
+	mockDB.On("CountAutoRetries", 7).Return(1, nil).Once()
+	mockDB.On("CreateBuild", mock.MatchedBy(func(b *BuildRequest) bool {
+		return b.TriggerSource == triggerAutoRetry && *b.RetriedFrom == original && b.CommitSHA == "abc1234"
+	})).Return(8, nil).Once()
+	mockDB.On("ListBuildIssues", 7).Return([]string{}, nil).Once()
+
+	service.autoRetry(context.Background(), &BuildRequest{ID: 7, ProjectName: "api", CommitSHA: "abc1234", Status: "failed", FailureCategory: failureInfra}, project)
+	assert.Equal(t, 1.0, testutil.ToFloat64(service.metrics.AutoRetries.WithLabelValues("api", failureInfra)))
+
+	// Test failures are left for people to look at
+	service.autoRetry(context.Background(), &BuildRequest{ID: 9, ProjectName: "api", Status: "failed", FailureCategory: failureTest}, project)
+	// as are builds that used up their retries
+	mockDB.On("CountAutoRetries", 10).Return(2, nil).Once()
+	service.autoRetry(context.Background(), &BuildRequest{ID: 10, ProjectName: "api", Status: "failed", FailureCategory: failureInfra}, project)
+	// and builds of projects without a retry policy
+	service.autoRetry(context.Background(), &BuildRequest{ID: 11, ProjectName: "web", Status: "failed", FailureCategory: failureInfra}, &Project{Name: "web"})
+	service.autoRetry(context.Background(), &BuildRequest{ID: 12, ProjectName: "web", Status: "failed", FailureCategory: failureInfra}, nil)
+
+	mockDB.AssertExpectations(t)
+	mockDB.AssertNumberOfCalls(t, "CreateBuild", 1)
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// awsCredentials are the keys requests to AWS are signed with
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Expires         time.Time
+}
+
+// awsCredentialRefreshMargin is how long before expiry temporary credentials
+// are replaced
+const awsCredentialRefreshMargin = 5 * time.Minute
+
+// AWSCredentialProvider supplies credentials for AWS requests. With
+// AWS_ROLE_ARN and AWS_WEB_IDENTITY_TOKEN_FILE set (IAM roles for service
+// accounts on EKS) it assumes the role with the projected token and refreshes
+// the temporary credentials before they expire; otherwise it uses the static
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN.
+type AWSCredentialProvider struct {
+	static      awsCredentials
+	roleARN     string
+	tokenFile   string
+	sessionName string
+	stsEndpoint string
+	client      *http.Client
+	now         func() time.Time
+
+	mu     sync.Mutex
+	cached awsCredentials
+}
+
+// NewAWSCredentialProviderFromEnv creates a credential provider from the
+// standard AWS_* environment variables, using the STS endpoint of region
+func NewAWSCredentialProviderFromEnv(region string) *AWSCredentialProvider {
+	sessionName := os.Getenv("AWS_ROLE_SESSION_NAME")
+	if sessionName == "" {
+		sessionName = "build-service"
+	}
+
+	return &AWSCredentialProvider{
+		static: awsCredentials{
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		},
+		roleARN:     os.Getenv("AWS_ROLE_ARN"),
+		tokenFile:   os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"),
+		sessionName: sessionName,
+		stsEndpoint: fmt.Sprintf("https://sts.%s.amazonaws.com", region),
+		client:      &http.Client{Timeout: 10 * time.Second},
+		now:         time.Now,
+	}
+}
+
+// Credentials returns valid credentials, assuming the configured role when
+// the cached ones are about to expire
+func (ap *AWSCredentialProvider) Credentials(ctx context.Context) (awsCredentials, error) {
+	if ap.roleARN == "" || ap.tokenFile == "" {
+		if ap.static.AccessKeyID == "" || ap.static.SecretAccessKey == "" {
+			return awsCredentials{}, fmt.Errorf("no AWS credentials: set AWS_ROLE_ARN and AWS_WEB_IDENTITY_TOKEN_FILE, or AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+		}
+		return ap.static, nil
+	}
+
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
+
+	if ap.cached.AccessKeyID != "" && ap.now().Add(awsCredentialRefreshMargin).Before(ap.cached.Expires) {
+		return ap.cached, nil
+	}
+
+	credentials, err := ap.assumeRoleWithWebIdentity(ctx)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("assuming role %s: %w", ap.roleARN, err)
+	}
+	ap.cached = credentials
+	return credentials, nil
+}
+
+// assumeRoleWithWebIdentityResponse is the subset of the STS response we use
+type assumeRoleWithWebIdentityResponse struct {
+	Credentials struct {
+		AccessKeyID     string    `xml:"AccessKeyId"`
+		SecretAccessKey string    `xml:"SecretAccessKey"`
+		SessionToken    string    `xml:"SessionToken"`
+		Expiration      time.Time `xml:"Expiration"`
+	} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+}
+
+// assumeRoleWithWebIdentity exchanges the projected service account token for
+// temporary credentials. The call is authenticated by the token itself, so
+// the request is not signed.
+func (ap *AWSCredentialProvider) assumeRoleWithWebIdentity(ctx context.Context) (awsCredentials, error) {
+	token, err := os.ReadFile(ap.tokenFile)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+
+	query := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {ap.roleARN},
+		"RoleSessionName":  {ap.sessionName},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", ap.stsEndpoint+"/", strings.NewReader(query.Encode()))
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := ap.client.Do(req)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return awsCredentials{}, fmt.Errorf("sts: status %d: %s", resp.StatusCode, body)
+	}
+
+	var result assumeRoleWithWebIdentityResponse
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return awsCredentials{}, fmt.Errorf("decoding sts response: %w", err)
+	}
+	return awsCredentials{
+		AccessKeyID:     result.Credentials.AccessKeyID,
+		SecretAccessKey: result.Credentials.SecretAccessKey,
+		SessionToken:    result.Credentials.SessionToken,
+		Expires:         result.Credentials.Expiration,
+	}, nil
+}
+
+// signAWSRequest adds an AWS Signature Version 4 Authorization header to req
+// for the given service. payloadHash is the hex SHA-256 of the body, or
+// UNSIGNED-PAYLOAD where the service allows it.
+func signAWSRequest(req *http.Request, credentials awsCredentials, service, region, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if credentials.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", credentials.SessionToken)
+	}
+
+	// Canonical headers: host plus every x-amz-* and content-type header
+	names := []string{"host"}
+	for name := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "content-type" {
+			names = append(names, lower)
+		}
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		value := req.URL.Host
+		if name != "host" {
+			value = strings.TrimSpace(req.Header.Get(name))
+		}
+		canonicalHeaders.WriteString(name + ":" + value + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/%s/aws4_request", date, region, service)
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+credentials.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		credentials.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// presignAWSURL returns u with Signature Version 4 query authentication, so
+// that a GET of the URL is allowed until expires has passed
+func presignAWSURL(u *url.URL, credentials awsCredentials, service, region string, expires time.Duration, now time.Time) string {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	scope := fmt.Sprintf("%s/%s/%s/aws4_request", date, region, service)
+
+	query := u.Query()
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", credentials.AccessKeyID+"/"+scope)
+	query.Set("X-Amz-Date", amzDate)
+	query.Set("X-Amz-Expires", strconv.Itoa(int(expires.Seconds())))
+	query.Set("X-Amz-SignedHeaders", "host")
+	if credentials.SessionToken != "" {
+		query.Set("X-Amz-Security-Token", credentials.SessionToken)
+	}
+
+	canonicalRequest := strings.Join([]string{
+		"GET",
+		u.EscapedPath(),
+		canonicalQuery(query),
+		"host:" + u.Host + "\n",
+		"host",
+		unsignedPayload,
+	}, "\n")
+
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+credentials.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	query.Set("X-Amz-Signature", hex.EncodeToString(hmacSHA256(key, stringToSign)))
+
+	signed := *u
+	signed.RawQuery = canonicalQuery(query)
+	return signed.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAWSCredentialProviderStatic(t *testing.T) {
+	t.Setenv("AWS_ROLE_ARN", "")
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	_, err := NewAWSCredentialProviderFromEnv("eu-west-1").Credentials(context.Background())
+	assert.Error(t, err)
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_SESSION_TOKEN", "session")
+	credentials, err := NewAWSCredentialProviderFromEnv("eu-west-1").Credentials(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, awsCredentials{AccessKeyID: "AKID", SecretAccessKey: "secret", SessionToken: "session"}, credentials)
+}
+
+func TestAWSCredentialProviderWebIdentity(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 0, 0, 0, time.UTC)
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		require.NoError(t, r.ParseForm())
+		assert.Equal(t, "AssumeRoleWithWebIdentity", r.PostForm.Get("Action"))
+		assert.Equal(t, "arn:aws:iam::123456789012:role/build-service", r.PostForm.Get("RoleArn"))
+		assert.Equal(t, "projected-token", r.PostForm.Get("WebIdentityToken"))
+		assert.Empty(t, r.Header.Get("Authorization"))
+		w.Write([]byte(`<AssumeRoleWithWebIdentityResponse><AssumeRoleWithWebIdentityResult><Credentials>
+			<AccessKeyId>ASIA</AccessKeyId><SecretAccessKey>temp-secret</SecretAccessKey>
+			<SessionToken>temp-session</SessionToken><Expiration>2024-01-02T04:00:00Z</Expiration>
+		</Credentials></AssumeRoleWithWebIdentityResult></AssumeRoleWithWebIdentityResponse>`))
+	}))
+	defer server.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("projected-token\n"), 0o600))
+	t.Setenv("AWS_ROLE_ARN", "arn:aws:iam::123456789012:role/build-service")
+	t.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", tokenFile)
+
+	provider := NewAWSCredentialProviderFromEnv("eu-west-1")
+	provider.stsEndpoint = server.URL
+	provider.now = func() time.Time { return now }
+
+	credentials, err := provider.Credentials(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "ASIA", credentials.AccessKeyID)
+	assert.Equal(t, "temp-session", credentials.SessionToken)
+
+	// Cached until shortly before expiry
+	now = now.Add(50 * time.Minute)
+	_, err = provider.Credentials(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, calls)
+
+	now = now.Add(6 * time.Minute)
+	_, err = provider.Credentials(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 2, calls)
+}
+
+func TestSignAWSRequest(t *testing.T) {
+	req, _ := http.NewRequest("POST", "https://events.eu-west-1.amazonaws.com/", nil)
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	signAWSRequest(req, awsCredentials{AccessKeyID: "AKID", SecretAccessKey: "secret", SessionToken: "session"}, "events", "eu-west-1", "UNSIGNED-PAYLOAD", now)
+
+	assert.Equal(t, "20240102T030405Z", req.Header.Get("X-Amz-Date"))
+	assert.Equal(t, "session", req.Header.Get("X-Amz-Security-Token"))
+	assert.Contains(t, req.Header.Get("Authorization"), "Credential=AKID/20240102/eu-west-1/events/aws4_request")
+	assert.Contains(t, req.Header.Get("Authorization"), "SignedHeaders=content-type;host;x-amz-date;x-amz-security-token")
+}
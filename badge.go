@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// badgeColors maps each badge message to its color
+var badgeColors = map[string]string{
+	"passing": "#4c1",
+	"failing": "#e05d44",
+	"unknown": "#9f9f9f",
+}
+
+// badgeTemplate renders a flat status badge in the style of shields.io,
+// linking to the build it shows when there is one
+var badgeTemplate = template.Must(template.New("badge").Parse(`<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" width="{{.Width}}" height="20" role="img" aria-label="build: {{.Message}}">
+<title>build: {{.Message}}</title>{{if .Link}}<a xlink:href="{{.Link}}">{{end}}
+<linearGradient id="s" x2="0" y2="100%"><stop offset="0" stop-color="#bbb" stop-opacity=".1"/><stop offset="1" stop-opacity=".1"/></linearGradient>
+<clipPath id="r"><rect width="{{.Width}}" height="20" rx="3" fill="#fff"/></clipPath>
+<g clip-path="url(#r)"><rect width="{{.LabelWidth}}" height="20" fill="#555"/><rect x="{{.LabelWidth}}" width="{{.MessageWidth}}" height="20" fill="{{.Color}}"/><rect width="{{.Width}}" height="20" fill="url(#s)"/></g>
+<g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">
+<text x="{{.LabelX}}" y="15" fill="#010101" fill-opacity=".3">build</text><text x="{{.LabelX}}" y="14">build</text>
+<text x="{{.MessageX}}" y="15" fill="#010101" fill-opacity=".3">{{.Message}}</text><text x="{{.MessageX}}" y="14">{{.Message}}</text>
+</g>{{if .Link}}</a>{{end}}
+</svg>
+`))
+
+// badgeMessage summarises a build as passing, failing or unknown
+func badgeMessage(build *BuildRequest) string {
+	switch {
+	case build == nil:
+		return "unknown"
+	case build.Status == "success":
+		return "passing"
+	default:
+		return "failing"
+	}
+}
+
+// renderBadge draws the badge for message, sizing each half to its text at
+// roughly 7 pixels per character
+func renderBadge(message, link string) []byte {
+	labelWidth, messageWidth := 10+7*len("build"), 10+7*len(message)
+	var buf bytes.Buffer
+	badgeTemplate.Execute(&buf, map[string]interface{}{
+		"Message":      message,
+		"Link":         link,
+		"Color":        badgeColors[message],
+		"Width":        labelWidth + messageWidth,
+		"LabelWidth":   labelWidth,
+		"MessageWidth": messageWidth,
+		"LabelX":       labelWidth / 2,
+		"MessageX":     labelWidth + messageWidth/2,
+	})
+	return buf.Bytes()
+}
+
+// Project badge endpoint. Shows the outcome of the latest finished build of
+// the project's default branch; unauthenticated so it can be embedded.
+func (bs *BuildService) badgeHandler(w http.ResponseWriter, r *http.Request) {
+	project, err := bs.cachedProject(mux.Vars(r)["name"])
+	if err == nil && !requestTenant(r).Sees(project.Org) {
+		err = fmt.Errorf("project not found")
+	}
+	if err != nil {
+		if err.Error() == "project not found" {
+			http.Error(w, "Project not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error getting project: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	build, err := bs.cachedLatestFinishedBuild(project.Name, project.DefaultBranch)
+	if err != nil && err.Error() != "build not found" {
+		log.Printf("Error getting latest build: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	var link string
+	if build != nil {
+		link = bs.links.BuildURL(build)
+	}
+	body := renderBadge(badgeMessage(build), link)
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+
+	// Image proxies such as GitHub's camo must revalidate to pick up new builds
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Write(body)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBadgeHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		build    *BuildRequest
+		buildErr error
+		message  string
+	}{
+		{name: "passing", build: &BuildRequest{ID: 3, Status: "success"}, message: "passing"},
+		{name: "failing", build: &BuildRequest{ID: 4, Status: "timeout"}, message: "failing"},
+		{name: "no builds", buildErr: fmt.Errorf("build not found"), message: "unknown"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service, mockDB := setupTestService()
+			mockDB.On("GetProjectByName", "api").Return(&Project{ID: 1, Name: "api", DefaultBranch: "main"}, nil)
+			mockDB.On("GetLatestFinishedBuild", "api", "main").Return(tt.build, tt.buildErr)
+
+			router := mux.NewRouter()
+			router.HandleFunc("/api/v1/projects/{name}/badge.svg", service.badgeHandler).Methods("GET")
+
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/projects/api/badge.svg", nil))
+			assert.Equal(t, http.StatusOK, rr.Code)
+			assert.Equal(t, "image/svg+xml", rr.Header().Get("Content-Type"))
+			assert.Equal(t, "no-cache", rr.Header().Get("Cache-Control"))
+			assert.Contains(t, rr.Body.String(), `aria-label="build: `+tt.message+`"`)
+			assert.Contains(t, rr.Body.String(), badgeColors[tt.message])
+
+			etag := rr.Header().Get("ETag")
+			assert.NotEmpty(t, etag)
+			req := httptest.NewRequest("GET", "/api/v1/projects/api/badge.svg", nil)
+			req.Header.Set("If-None-Match", etag)
+			rr = httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			assert.Equal(t, http.StatusNotModified, rr.Code)
+			assert.Empty(t, rr.Body.String())
+		})
+	}
+}
+
+func TestBadgeHandlerUnknownProject(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.On("GetProjectByName", "missing").Return(nil, fmt.Errorf("project not found"))
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/projects/{name}/badge.svg", service.badgeHandler).Methods("GET")
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/projects/missing/badge.svg", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
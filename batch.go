@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// maxBatchBuilds is how many builds a single batch request may create
+const maxBatchBuilds = 100
+
+// BatchBuildResult is the outcome of one build of a batch, in request order
+type BatchBuildResult struct {
+	Index int           `json:"index"`
+	Build *BuildRequest `json:"build,omitempty"`
+	// Error is why the build was rejected. When any build of a batch is,
+	// none are created.
+	Error string `json:"error,omitempty"`
+}
+
+// BatchBuildResponse lists the outcome of each build of a batch
+type BatchBuildResponse struct {
+	Results []BatchBuildResult `json:"results"`
+}
+
+// batchBuildError returns why a build of a batch can't be created, with the
+// status it would get on its own, or nil when it can
+func (bs *BuildService) batchBuildError(r *http.Request, build *BuildRequest) (int, error) {
+	if build == nil {
+		return http.StatusBadRequest, fmt.Errorf("build must be an object")
+	}
+	if err := build.validate(); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	if bs.projectOfOtherOrg(r, build.ProjectName) {
+		return http.StatusNotFound, fmt.Errorf("Project not found")
+	}
+	return bs.upstreamBuildsError(requestTenant(r), build.DependsOn)
+}
+
+// Create build batch endpoint. The builds are validated together and created
+// in a single transaction, so either all of them are queued or none.
+func (bs *BuildService) createBuildBatchHandler(w http.ResponseWriter, r *http.Request) {
+	var builds []*BuildRequest
+	if err := json.NewDecoder(r.Body).Decode(&builds); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(builds) == 0 || len(builds) > maxBatchBuilds {
+		http.Error(w, fmt.Sprintf("A batch must have between 1 and %d builds", maxBatchBuilds), http.StatusBadRequest)
+		return
+	}
+
+	response := BatchBuildResponse{Results: make([]BatchBuildResult, len(builds))}
+	rejected := false
+	for i, build := range builds {
+		response.Results[i].Index = i
+		status, err := bs.batchBuildError(r, build)
+		if status == http.StatusInternalServerError {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if err != nil {
+			response.Results[i].Error = err.Error()
+			rejected = true
+		}
+	}
+	if rejected {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	for _, build := range builds {
+		build.IdempotencyKey = ""
+		build.requestedBy(r)
+		prepareBuild(r.Context(), build)
+	}
+	ids, err := bs.db.CreateBuilds(builds)
+	if err != nil {
+		log.Printf("Error creating build batch: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	for i, build := range builds {
+		bs.buildQueued(build, ids[i])
+		response.Results[i].Build = build
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
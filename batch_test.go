@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateBuildBatchHandler(t *testing.T) {
+	createBatch := func(service *BuildService, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/v1/builds/batch", bytes.NewBufferString(body))
+		rr := httptest.NewRecorder()
+		service.createBuildBatchHandler(rr, req)
+		return rr
+	}
+
+	t.Run("creates all builds in one transaction", func(t *testing.T) {
+		service, mockDB := setupTestService()
+		mockDB.On("CreateBuilds", mock.MatchedBy(func(builds []*BuildRequest) bool {
+			return len(builds) == 2 &&
+				builds[0].Branch == "main" && builds[0].Status == "queued" && builds[0].TriggerSource == triggerManual &&
+				builds[1].Tag == "v2.0.0" && builds[1].Version == "2.0.0" && builds[1].Status == "draft"
+		})).Return([]int{7, 8}, nil).Once()
+
+		rr := createBatch(service, `[
+			{"project_name": "api", "git_url": "https://github.com/test/api.git", "trigger_source": "schedule"},
+			{"project_name": "web", "git_url": "https://github.com/test/web.git", "tag": "v2.0.0", "draft": true}
+		]`)
+
+		require.Equal(t, http.StatusCreated, rr.Code)
+		var response BatchBuildResponse
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+		require.Len(t, response.Results, 2)
+		assert.Equal(t, 0, response.Results[0].Index)
+		assert.Equal(t, 7, response.Results[0].Build.ID)
+		assert.Equal(t, "api", response.Results[0].Build.ProjectName)
+		assert.Equal(t, 1, response.Results[1].Index)
+		assert.Equal(t, 8, response.Results[1].Build.ID)
+		assert.Empty(t, response.Results[1].Error)
+		mockDB.AssertExpectations(t)
+	})
+
+	t.Run("rejects the whole batch when a build is invalid", func(t *testing.T) {
+		service, mockDB := setupTestService()
+		mockDB.On("GetBuild", 3).Return(&BuildRequest{ID: 3, Status: "failed"}, nil).Once()
+
+		rr := createBatch(service, `[
+			{"project_name": "api", "git_url": "https://github.com/test/api.git"},
+			{"project_name": "web"},
+			{"project_name": "cli", "git_url": "https://github.com/test/cli.git", "depends_on": [3]},
+			null
+		]`)
+
+		require.Equal(t, http.StatusBadRequest, rr.Code)
+		var response BatchBuildResponse
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+		require.Len(t, response.Results, 4)
+		assert.Empty(t, response.Results[0].Error)
+		assert.Nil(t, response.Results[0].Build)
+		assert.Equal(t, "project_name and git_url are required", response.Results[1].Error)
+		assert.Equal(t, "Build 3 in depends_on is failed and will never succeed", response.Results[2].Error)
+		assert.Equal(t, "build must be an object", response.Results[3].Error)
+		mockDB.AssertNotCalled(t, "CreateBuilds", mock.Anything)
+	})
+
+	t.Run("hides other orgs' projects", func(t *testing.T) {
+		service, mockDB := setupTestService()
+		mockDB.On("GetProjectByName", "billing").Return(&Project{Name: "billing", Org: "globex"}, nil).Once()
+
+		req := httptest.NewRequest("POST", "/api/v1/builds/batch",
+			bytes.NewBufferString(`[{"project_name": "billing", "git_url": "https://github.com/test/billing.git"}]`))
+		req = req.WithContext(context.WithValue(req.Context(), tenantContextKey{}, Tenant{Org: "acme"}))
+		rr := httptest.NewRecorder()
+		service.createBuildBatchHandler(rr, req)
+
+		require.Equal(t, http.StatusBadRequest, rr.Code)
+		assert.Contains(t, rr.Body.String(), "Project not found")
+		mockDB.AssertNotCalled(t, "CreateBuilds", mock.Anything)
+	})
+
+	t.Run("batch size", func(t *testing.T) {
+		service, _ := setupTestService()
+		assert.Equal(t, http.StatusBadRequest, createBatch(service, `[]`).Code)
+		assert.Equal(t, http.StatusBadRequest, createBatch(service, `{"project_name": "api"}`).Code)
+
+		builds := make([]map[string]string, maxBatchBuilds+1)
+		for i := range builds {
+			builds[i] = map[string]string{"project_name": "api", "git_url": "https://github.com/test/api.git"}
+		}
+		body, _ := json.Marshal(builds)
+		assert.Equal(t, http.StatusBadRequest, createBatch(service, string(body)).Code)
+	})
+
+	t.Run("database error", func(t *testing.T) {
+		service, mockDB := setupTestService()
+		mockDB.On("CreateBuilds", mock.Anything).Return(nil, fmt.Errorf("connection reset")).Once()
+
+		rr := createBatch(service, `[{"project_name": "api", "git_url": "https://github.com/test/api.git"}]`)
+
+		assert.Equal(t, http.StatusInternalServerError, rr.Code)
+		mockDB.AssertExpectations(t)
+	})
+}
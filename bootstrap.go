@@ -0,0 +1,505 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	// errRepositoryNotFound is returned by forges for repositories that
+	// don't exist or that the token can't see
+	errRepositoryNotFound = errors.New("repository not found")
+	// errWebhookExists is returned when the repository already has a
+	// webhook for the service
+	errWebhookExists = errors.New("webhook already exists")
+)
+
+// Webhook registration outcomes reported by the bootstrap endpoint
+const (
+	webhookRegistered = "registered"
+	webhookExists     = "exists"
+	webhookSkipped    = "skipped"
+	webhookFailed     = "failed"
+)
+
+// toolchainImages are the container images starter pipelines run in, by
+// detected build tool
+var toolchainImages = map[string]string{
+	"go":     "golang:1.24",
+	"gradle": "gradle:8-jdk21",
+	"npm":    "node:22",
+}
+
+// toolchainLanguages are the languages the detected build tools imply
+var toolchainLanguages = map[string]string{
+	"go":     "go",
+	"gradle": "java",
+	"npm":    "javascript",
+}
+
+// bootstrapForge is a git host whose API the bootstrap endpoint inspects
+// repositories and registers webhooks through
+type bootstrapForge interface {
+	Name() string
+	// DefaultBranch returns the repository's default branch
+	DefaultBranch(ctx context.Context, repo string) (string, error)
+	// ListFiles returns the names of the files at the repository's root
+	ListFiles(ctx context.Context, repo, ref string) ([]string, error)
+	// CreateWebhook registers the service's push webhook
+	CreateWebhook(ctx context.Context, repo, hookURL, secret string) error
+}
+
+// ProjectBootstrapRequest is the body of a bootstrap request. Only git_url is
+// required; the name defaults to the repository's and the default branch to
+// the forge's.
+type ProjectBootstrapRequest struct {
+	GitURL        string `json:"git_url"`
+	Name          string `json:"name,omitempty"`
+	Org           string `json:"org,omitempty"`
+	DefaultBranch string `json:"default_branch,omitempty"`
+}
+
+// BootstrapWebhook reports whether the forge webhook was registered
+type BootstrapWebhook struct {
+	Forge  string `json:"forge"`
+	URL    string `json:"url"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ProjectBootstrap is the outcome of onboarding a repository
+type ProjectBootstrap struct {
+	Project   *Project `json:"project"`
+	Language  string   `json:"language,omitempty"`
+	Toolchain string   `json:"toolchain"`
+	// Pipeline is a starter pipeline file for the repository to commit, empty
+	// when it already has one
+	Pipeline       string            `json:"pipeline,omitempty"`
+	PipelineExists bool              `json:"pipeline_exists"`
+	Webhook        *BootstrapWebhook `json:"webhook"`
+	// Build is the first build, validating the project builds as detected
+	Build *BuildRequest `json:"build"`
+}
+
+// starterPipeline renders a pipeline file running a build tool's steps
+func starterPipeline(tool string, steps [][]string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Starter pipeline for a %s project, generated by build-service.\n", tool)
+	fmt.Fprintf(&b, "# Commit it as %s and adjust the stages to taste.\n", pipelineFile)
+	if image := toolchainImages[tool]; image != "" {
+		fmt.Fprintf(&b, "image: %s\n", image)
+	}
+	b.WriteString("stages:\n")
+	for _, group := range groupStages(steps) {
+		fmt.Fprintf(&b, "  - name: %s\n    steps:\n", group.name)
+		for _, step := range group.steps {
+			fmt.Fprintf(&b, "      - %s\n", strings.Join(step, " "))
+		}
+	}
+	return b.String()
+}
+
+// forgeFor returns the forge hosting a repository and the repository's path
+// on it, or nil when the repository isn't on a forge the service has API
+// access to
+func (bs *BuildService) forgeFor(gitURL string) (bootstrapForge, string) {
+	key := repositoryKey(gitURL)
+	slash := strings.Index(key, "/")
+	if slash < 0 || !strings.Contains(key[slash+1:], "/") {
+		return nil, ""
+	}
+	host, repo := key[:slash], key[slash+1:]
+
+	if bs.github != nil && host == bs.github.Host() {
+		return bs.github, repo
+	}
+	if bs.gitlab != nil && host == bs.gitlab.Host() {
+		return bs.gitlab, repo
+	}
+	return nil, ""
+}
+
+// Bootstrap project endpoint. Onboards a repository in one call: detects its
+// toolchain, generates a starter pipeline, registers the project and the
+// forge webhook, and queues a first build to validate the setup.
+func (bs *BuildService) bootstrapProjectHandler(w http.ResponseWriter, r *http.Request) {
+	var req ProjectBootstrapRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.GitURL = strings.TrimSpace(req.GitURL)
+	if req.GitURL == "" {
+		http.Error(w, "git_url is required", http.StatusBadRequest)
+		return
+	}
+
+	forge, repo := bs.forgeFor(req.GitURL)
+	if forge == nil {
+		http.Error(w, "Bootstrapping needs a GitHub or GitLab repository the service has an API token for", http.StatusUnprocessableEntity)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	branch := req.DefaultBranch
+	if branch == "" {
+		var err error
+		if branch, err = forge.DefaultBranch(ctx, repo); err != nil {
+			bs.forgeError(w, forge, repo, err)
+			return
+		}
+	}
+	files, err := forge.ListFiles(ctx, repo, branch)
+	if err != nil {
+		bs.forgeError(w, forge, repo, err)
+		return
+	}
+
+	present := make(map[string]bool, len(files))
+	for _, name := range files {
+		present[name] = true
+	}
+	bootstrap := &ProjectBootstrap{PipelineExists: present[pipelineFile]}
+	tool, steps := buildToolSteps(func(name string) bool { return present[name] })
+	switch {
+	case bootstrap.PipelineExists:
+		bootstrap.Toolchain = "pipeline"
+	case tool == "":
+		http.Error(w, fmt.Sprintf("No supported build tool detected (expected %s, go.mod, build.gradle, package.json or Makefile)", pipelineFile), http.StatusUnprocessableEntity)
+		return
+	default:
+		bootstrap.Toolchain = tool
+		bootstrap.Pipeline = starterPipeline(tool, steps)
+	}
+	if tool != "" {
+		bootstrap.Language = toolchainLanguages[tool]
+		if tool == "npm" && present["tsconfig.json"] {
+			bootstrap.Language = "typescript"
+		}
+	}
+
+	project := &Project{
+		Name:          strings.TrimSpace(req.Name),
+		Org:           strings.ToLower(strings.TrimSpace(req.Org)),
+		GitURL:        req.GitURL,
+		DefaultBranch: branch,
+	}
+	if project.Name == "" {
+		project.Name = repo[strings.LastIndex(repo, "/")+1:]
+	}
+	if tenant := requestTenant(r); tenant.Org != "" {
+		project.Org = tenant.Org
+	}
+	project.CreatedAt = time.Now().UTC()
+	project.UpdatedAt = time.Now().UTC()
+
+	id, err := bs.db.CreateProject(project)
+	if err != nil {
+		if err.Error() == "project already exists" {
+			http.Error(w, "Project already exists", http.StatusConflict)
+			return
+		}
+		log.Printf("Error creating project: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	project.ID = id
+	bootstrap.Project = project
+
+	bootstrap.Webhook = bs.registerBootstrapWebhook(ctx, forge, repo, project.Org)
+
+	build := &BuildRequest{
+		ProjectName:   project.Name,
+		GitURL:        project.GitURL,
+		Branch:        project.DefaultBranch,
+		TriggerSource: triggerBootstrap,
+		Org:           project.Org,
+	}
+	if err := bs.enqueueBuild(r.Context(), build); err != nil {
+		// The project exists now; report the failed build rather than the
+		// whole onboarding so the caller doesn't retry into a conflict
+		log.Printf("Error queueing validation build of %s: %v", project.Name, err)
+	} else {
+		bootstrap.Build = build
+	}
+
+	log.Printf("Bootstrapped project %s from %s (%s, webhook %s)", project.Name, repo, bootstrap.Toolchain, bootstrap.Webhook.Status)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(bootstrap)
+}
+
+// registerBootstrapWebhook points the repository's push webhook at the
+// service. Failures are reported rather than failing the onboarding, as the
+// webhook can be added by hand.
+func (bs *BuildService) registerBootstrapWebhook(ctx context.Context, forge bootstrapForge, repo, org string) *BootstrapWebhook {
+	secretVar := "GITHUB_WEBHOOK_SECRET"
+	if forge.Name() == "gitlab" {
+		secretVar = "GITLAB_WEBHOOK_TOKEN"
+	}
+	webhook := &BootstrapWebhook{Forge: forge.Name(), URL: bs.links.Base(org) + "/api/v1/webhooks/" + forge.Name()}
+
+	secret := os.Getenv(secretVar)
+	if secret == "" {
+		webhook.Status = webhookSkipped
+		webhook.Error = secretVar + " is not set, so the service would reject the webhook's deliveries"
+		return webhook
+	}
+
+	err := forge.CreateWebhook(ctx, repo, webhook.URL, secret)
+	switch {
+	case err == nil:
+		webhook.Status = webhookRegistered
+	case errors.Is(err, errWebhookExists):
+		webhook.Status = webhookExists
+	default:
+		log.Printf("Error registering %s webhook of %s: %v", forge.Name(), repo, err)
+		webhook.Status = webhookFailed
+		webhook.Error = err.Error()
+	}
+	return webhook
+}
+
+// forgeError responds to a failed forge API call
+func (bs *BuildService) forgeError(w http.ResponseWriter, forge bootstrapForge, repo string, err error) {
+	if errors.Is(err, errRepositoryNotFound) {
+		http.Error(w, fmt.Sprintf("Repository %s not found on %s", repo, forge.Name()), http.StatusUnprocessableEntity)
+		return
+	}
+	log.Printf("Error inspecting %s repository %s: %v", forge.Name(), repo, err)
+	http.Error(w, fmt.Sprintf("Error inspecting the repository on %s", forge.Name()), http.StatusBadGateway)
+}
+
+// Name identifies the forge
+func (gc *GitHubClient) Name() string {
+	return "github"
+}
+
+// Host is the git host of the GitHub instance the client talks to
+func (gc *GitHubClient) Host() string {
+	u, err := url.Parse(gc.baseURL)
+	if err != nil {
+		return ""
+	}
+	if u.Hostname() == "api.github.com" {
+		return "github.com"
+	}
+	return u.Hostname()
+}
+
+// DefaultBranch returns the repository's default branch
+func (gc *GitHubClient) DefaultBranch(ctx context.Context, repo string) (string, error) {
+	var repository struct {
+		DefaultBranch string `json:"default_branch"`
+	}
+	if err := gc.getJSON(ctx, "/repos/"+repo, &repository); err != nil {
+		return "", err
+	}
+	return repository.DefaultBranch, nil
+}
+
+// ListFiles returns the names of the files at the repository's root
+func (gc *GitHubClient) ListFiles(ctx context.Context, repo, ref string) ([]string, error) {
+	var entries []struct {
+		Name string `json:"name"`
+	}
+	if err := gc.getJSON(ctx, fmt.Sprintf("/repos/%s/contents/?ref=%s", repo, url.QueryEscape(ref)), &entries); err != nil {
+		return nil, err
+	}
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.Name
+	}
+	return names, nil
+}
+
+// CreateWebhook registers a push and pull request webhook
+func (gc *GitHubClient) CreateWebhook(ctx context.Context, repo, hookURL, secret string) error {
+	body, _ := json.Marshal(map[string]interface{}{
+		"name":   "web",
+		"active": true,
+		"events": []string{"push", "pull_request"},
+		"config": map[string]string{"url": hookURL, "content_type": "json", "secret": secret},
+	})
+	resp, err := gc.do(ctx, "POST", "/repos/"+repo+"/hooks", bytes.NewReader(body), "application/vnd.github+json")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		return nil
+	case http.StatusUnprocessableEntity:
+		// GitHub refuses a second hook with the same URL
+		return errWebhookExists
+	}
+	return fmt.Errorf("github api: unexpected status %d creating webhook", resp.StatusCode)
+}
+
+func (gc *GitHubClient) getJSON(ctx context.Context, path string, dest interface{}) error {
+	resp, err := gc.do(ctx, "GET", path, nil, "application/vnd.github+json")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return errRepositoryNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("github api: unexpected status %d fetching %s", resp.StatusCode, path)
+	}
+	return json.NewDecoder(resp.Body).Decode(dest)
+}
+
+// GitLabClient inspects projects and registers webhooks through the GitLab
+// REST API
+type GitLabClient struct {
+	token   string
+	baseURL string
+	client  *http.Client
+}
+
+// NewGitLabClientFromEnv creates a GitLab client, or returns nil when
+// GITLAB_TOKEN is not set
+func NewGitLabClientFromEnv() *GitLabClient {
+	token := os.Getenv("GITLAB_TOKEN")
+	if token == "" {
+		return nil
+	}
+	return newGitLabClient(token)
+}
+
+// newGitLabClient creates a client of the GitLab API at GITLAB_API_URL
+// authenticating with token
+func newGitLabClient(token string) *GitLabClient {
+	baseURL := os.Getenv("GITLAB_API_URL")
+	if baseURL == "" {
+		baseURL = "https://gitlab.com/api/v4"
+	}
+
+	return &GitLabClient{
+		token:   token,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Name identifies the forge
+func (gl *GitLabClient) Name() string {
+	return "gitlab"
+}
+
+// Host is the git host of the GitLab instance the client talks to
+func (gl *GitLabClient) Host() string {
+	u, err := url.Parse(gl.baseURL)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+func (gl *GitLabClient) do(ctx context.Context, method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, gl.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("PRIVATE-TOKEN", gl.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return gl.client.Do(req)
+}
+
+func (gl *GitLabClient) getJSON(ctx context.Context, path string, dest interface{}) error {
+	resp, err := gl.do(ctx, "GET", path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return errRepositoryNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("gitlab api: unexpected status %d fetching %s", resp.StatusCode, path)
+	}
+	return json.NewDecoder(resp.Body).Decode(dest)
+}
+
+// DefaultBranch returns the project's default branch
+func (gl *GitLabClient) DefaultBranch(ctx context.Context, repo string) (string, error) {
+	var project struct {
+		DefaultBranch string `json:"default_branch"`
+	}
+	if err := gl.getJSON(ctx, "/projects/"+url.PathEscape(repo), &project); err != nil {
+		return "", err
+	}
+	return project.DefaultBranch, nil
+}
+
+// ListFiles returns the names of the files at the project's root
+func (gl *GitLabClient) ListFiles(ctx context.Context, repo, ref string) ([]string, error) {
+	var entries []struct {
+		Name string `json:"name"`
+	}
+	path := fmt.Sprintf("/projects/%s/repository/tree?ref=%s&per_page=100", url.PathEscape(repo), url.QueryEscape(ref))
+	if err := gl.getJSON(ctx, path, &entries); err != nil {
+		return nil, err
+	}
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.Name
+	}
+	return names, nil
+}
+
+// CreateWebhook registers a push and merge request webhook, unless the
+// project already has one for hookURL
+func (gl *GitLabClient) CreateWebhook(ctx context.Context, repo, hookURL, secret string) error {
+	var hooks []struct {
+		URL string `json:"url"`
+	}
+	if err := gl.getJSON(ctx, "/projects/"+url.PathEscape(repo)+"/hooks", &hooks); err != nil {
+		return err
+	}
+	for _, hook := range hooks {
+		if hook.URL == hookURL {
+			return errWebhookExists
+		}
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"url":                     hookURL,
+		"token":                   secret,
+		"push_events":             true,
+		"tag_push_events":         true,
+		"merge_requests_events":   true,
+		"enable_ssl_verification": true,
+	})
+	resp, err := gl.do(ctx, "POST", "/projects/"+url.PathEscape(repo)+"/hooks", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("gitlab api: unexpected status %d creating webhook", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeForge serves the repository and webhook endpoints of a forge API,
+// recording the webhooks created
+type fakeForge struct {
+	*httptest.Server
+	hooks []map[string]interface{}
+}
+
+func newFakeForge(t *testing.T, routes map[string]string) *fakeForge {
+	forge := &fakeForge{}
+	forge.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			hook := map[string]interface{}{}
+			json.NewDecoder(r.Body).Decode(&hook)
+			forge.hooks = append(forge.hooks, hook)
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		body, ok := routes[r.URL.RequestURI()]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, body)
+	}))
+	t.Cleanup(forge.Close)
+	return forge
+}
+
+func postBootstrap(service *BuildService, body string) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	service.bootstrapProjectHandler(rr, httptest.NewRequest("POST", "/api/v1/projects/bootstrap", bytes.NewBufferString(body)))
+	return rr
+}
+
+func TestBootstrapGitHubProject(t *testing.T) {
+	github := newFakeForge(t, map[string]string{
+		"/repos/acme/api":                     `{"default_branch": "trunk"}`,
+		"/repos/acme/api/contents/?ref=trunk": `[{"name": "go.mod"}, {"name": "main.go"}]`,
+	})
+	t.Setenv("GITHUB_TOKEN", "token")
+	t.Setenv("GITHUB_API_URL", github.URL)
+	t.Setenv("GITHUB_WEBHOOK_SECRET", "s3cret")
+	service, mockDB := setupTestService()
+	mockDB.On("CreateProject", mock.MatchedBy(func(p *Project) bool {
+		return p.Name == "api" && p.DefaultBranch == "trunk" && p.GitURL == "https://127.0.0.1/acme/api.git"
+	})).Return(7, nil).Once()
+	mockDB.On("CreateBuild", mock.MatchedBy(func(b *BuildRequest) bool {
+		return b.ProjectName == "api" && b.Branch == "trunk" && b.TriggerSource == triggerBootstrap
+	})).Return(12, nil).Once()
+
+	rr := postBootstrap(service, `{"git_url": "https://127.0.0.1/acme/api.git"}`)
+	require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+
+	var result ProjectBootstrap
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &result))
+	assert.Equal(t, 7, result.Project.ID)
+	assert.Equal(t, "go", result.Language)
+	assert.Equal(t, "go", result.Toolchain)
+	assert.False(t, result.PipelineExists)
+	assert.Equal(t, 12, result.Build.ID)
+	assert.Equal(t, webhookRegistered, result.Webhook.Status)
+
+	pipeline, err := parsePipeline([]byte(result.Pipeline))
+	require.NoError(t, err, result.Pipeline)
+	assert.Equal(t, "golang:1.24", pipeline.Image)
+	assert.Equal(t, []string{"go build ./..."}, pipeline.Stages[0].Steps)
+	assert.Equal(t, "test", pipeline.Stages[1].Name)
+
+	require.Len(t, github.hooks, 1)
+	config := github.hooks[0]["config"].(map[string]interface{})
+	assert.Equal(t, "http://localhost:8080/api/v1/webhooks/github", config["url"])
+	assert.Equal(t, "s3cret", config["secret"])
+	mockDB.AssertExpectations(t)
+}
+
+func TestBootstrapGitLabProject(t *testing.T) {
+	gitlab := newFakeForge(t, map[string]string{
+		"/api/v4/projects/acme%2Fweb%2Fsite/repository/tree?ref=main&per_page=100": `[{"name": ".buildservice.yml"}, {"name": "package.json"}, {"name": "tsconfig.json"}]`,
+		"/api/v4/projects/acme%2Fweb%2Fsite/hooks":                                 `[{"url": "http://localhost:8080/api/v1/webhooks/gitlab"}]`,
+	})
+	t.Setenv("GITLAB_TOKEN", "token")
+	t.Setenv("GITLAB_API_URL", gitlab.URL+"/api/v4")
+	t.Setenv("GITLAB_WEBHOOK_TOKEN", "s3cret")
+	service, mockDB := setupTestService()
+	mockDB.On("CreateProject", mock.MatchedBy(func(p *Project) bool { return p.Name == "storefront" })).Return(8, nil).Once()
+	mockDB.On("CreateBuild", mock.Anything).Return(13, nil).Once()
+
+	rr := postBootstrap(service, `{"git_url": "git@127.0.0.1:acme/web/site.git", "name": "storefront", "default_branch": "main"}`)
+	require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+
+	var result ProjectBootstrap
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &result))
+	assert.True(t, result.PipelineExists)
+	assert.Empty(t, result.Pipeline, "repositories with a pipeline keep it")
+	assert.Equal(t, "typescript", result.Language)
+	assert.Equal(t, webhookExists, result.Webhook.Status)
+	assert.Empty(t, gitlab.hooks)
+	mockDB.AssertExpectations(t)
+}
+
+func TestBootstrapProjectErrors(t *testing.T) {
+	github := newFakeForge(t, map[string]string{
+		"/repos/acme/api":                     `{"default_branch": "main"}`,
+		"/repos/acme/api/contents/?ref=main":  `[{"name": "go.mod"}]`,
+		"/repos/acme/docs":                    `{"default_branch": "main"}`,
+		"/repos/acme/docs/contents/?ref=main": `[{"name": "README.md"}]`,
+	})
+	t.Setenv("GITHUB_TOKEN", "token")
+	t.Setenv("GITHUB_API_URL", github.URL)
+	t.Setenv("GITHUB_WEBHOOK_SECRET", "")
+	service, mockDB := setupTestService()
+	mockDB.On("CreateProject", mock.MatchedBy(func(p *Project) bool { return p.Name == "api" })).Return(0, fmt.Errorf("project already exists")).Once()
+	mockDB.On("CreateProject", mock.MatchedBy(func(p *Project) bool { return p.Name == "api2" })).Return(9, nil).Once()
+	mockDB.On("CreateBuild", mock.Anything).Return(14, nil).Once()
+
+	for body, want := range map[string]int{
+		`{}`: http.StatusBadRequest,
+		`{"git_url": "https://bitbucket.org/acme/api.git"}`: http.StatusUnprocessableEntity,
+		`{"git_url": "https://127.0.0.1/acme/missing"}`:     http.StatusUnprocessableEntity,
+		`{"git_url": "https://127.0.0.1/acme/docs"}`:        http.StatusUnprocessableEntity,
+		`{"git_url": "https://127.0.0.1/acme/api"}`:         http.StatusConflict,
+	} {
+		assert.Equal(t, want, postBootstrap(service, body).Code, body)
+	}
+
+	// Without a webhook secret the project is onboarded without the webhook
+	rr := postBootstrap(service, `{"git_url": "https://127.0.0.1/acme/api", "name": "api2"}`)
+	require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	assert.Contains(t, rr.Body.String(), `"status":"skipped"`)
+	assert.Empty(t, github.hooks)
+	mockDB.AssertExpectations(t)
+}
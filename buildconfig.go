@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ConfigSnapshot is the effective configuration a build ran with, flattened
+// to dotted keys (e.g. "project.tag_pattern") so that snapshots diff cleanly
+type ConfigSnapshot map[string]string
+
+// ConfigChange is a key whose value differs between two snapshots. From or
+// To is omitted when the key is missing on that side.
+type ConfigChange struct {
+	Key  string  `json:"key"`
+	From *string `json:"from,omitempty"`
+	To   *string `json:"to,omitempty"`
+}
+
+// ConfigDiff lists the configuration changes from one build to another
+type ConfigDiff struct {
+	FromBuild int            `json:"from_build"`
+	ToBuild   int            `json:"to_build"`
+	Changes   []ConfigChange `json:"changes"`
+}
+
+// configSnapshot records the project settings, service settings and build
+// steps that determined how a build ran
+func (bs *BuildService) configSnapshot(build *BuildRequest, project *Project, timeout time.Duration, result *BuildResult) ConfigSnapshot {
+	executor := os.Getenv("EXECUTOR")
+	if executor == "" {
+		executor = "local"
+	}
+
+	snapshot := ConfigSnapshot{
+		"executor":           executor,
+		"build.timeout":      timeout.String(),
+		"build.auto_version": strconv.FormatBool(build.AutoVersion),
+	}
+	if project != nil {
+		snapshot["project.default_branch"] = project.DefaultBranch
+		snapshot["project.skip_ci_enabled"] = strconv.FormatBool(project.SkipCIEnabled)
+		snapshot["project.skip_ci_token"] = project.SkipCIToken
+		snapshot["project.tag_pattern"] = project.TagPattern
+		snapshot["project.artifact_tag_pattern"] = project.ArtifactTagPattern
+		snapshot["project.auto_version"] = strconv.FormatBool(project.AutoVersion)
+		snapshot["project.build_timeout_seconds"] = strconv.Itoa(project.BuildTimeout)
+		snapshot["project.build_image"] = project.BuildImage
+	}
+	if result != nil && result.Tool != "" {
+		snapshot["build.tool"] = result.Tool
+		if result.Image != "" {
+			snapshot["build.image"] = result.Image
+		}
+		for i, step := range result.Steps {
+			snapshot[fmt.Sprintf("build.steps.%d", i+1)] = step
+		}
+	}
+	return snapshot
+}
+
+// diffConfigs returns the changes from one snapshot to another, sorted by key
+func diffConfigs(from, to ConfigSnapshot) []ConfigChange {
+	changes := []ConfigChange{}
+	for key, value := range from {
+		if newValue, ok := to[key]; !ok {
+			changes = append(changes, ConfigChange{Key: key, From: &value})
+		} else if newValue != value {
+			changes = append(changes, ConfigChange{Key: key, From: &value, To: &newValue})
+		}
+	}
+	for key, value := range to {
+		if _, ok := from[key]; !ok {
+			changes = append(changes, ConfigChange{Key: key, To: &value})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Key < changes[j].Key })
+	return changes
+}
+
+// buildConfig loads the config snapshot of the build with the given ID,
+// writing an error response when it can't. Builds of orgs the tenant doesn't
+// see have no snapshot as far as it's concerned.
+func (bs *BuildService) buildConfig(w http.ResponseWriter, r *http.Request, value string) (int, ConfigSnapshot, bool) {
+	id, err := strconv.Atoi(value)
+	if err != nil {
+		http.Error(w, "Invalid build ID", http.StatusBadRequest)
+		return 0, nil, false
+	}
+
+	config, err := bs.db.GetBuildConfig(id)
+	if err == nil && !bs.tenantSeesBuild(requestTenant(r), id) {
+		err = fmt.Errorf("build config not found")
+	}
+	if err != nil {
+		if err.Error() == "build config not found" {
+			http.Error(w, fmt.Sprintf("No config snapshot for build %d", id), http.StatusNotFound)
+			return 0, nil, false
+		}
+		log.Printf("Error getting build config: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return 0, nil, false
+	}
+	return id, config, true
+}
+
+// Build config endpoint
+func (bs *BuildService) buildConfigHandler(w http.ResponseWriter, r *http.Request) {
+	_, config, ok := bs.buildConfig(w, r, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(config)
+}
+
+// Build config diff endpoint. Lists the changes from the build given in
+// ?against= to this build.
+func (bs *BuildService) buildConfigDiffHandler(w http.ResponseWriter, r *http.Request) {
+	against := r.URL.Query().Get("against")
+	if against == "" {
+		http.Error(w, "against is required", http.StatusBadRequest)
+		return
+	}
+
+	fromID, from, ok := bs.buildConfig(w, r, against)
+	if !ok {
+		return
+	}
+	toID, to, ok := bs.buildConfig(w, r, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ConfigDiff{FromBuild: fromID, ToBuild: toID, Changes: diffConfigs(from, to)})
+}
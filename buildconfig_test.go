@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigSnapshot(t *testing.T) {
+	service, _ := setupTestService()
+	t.Setenv("EXECUTOR", "simulated")
+
+	build := &BuildRequest{ID: 1, ProjectName: "api", AutoVersion: true}
+	project := &Project{Name: "api", DefaultBranch: "main", SkipCIEnabled: true, TagPattern: "v*", BuildTimeout: 600}
+	result := &BuildResult{Tool: "go", Steps: []string{"go build ./...", "go test ./..."}}
+
+	snapshot := service.configSnapshot(build, project, 10*time.Minute, result)
+	assert.Equal(t, "simulated", snapshot["executor"])
+	assert.Equal(t, "10m0s", snapshot["build.timeout"])
+	assert.Equal(t, "true", snapshot["build.auto_version"])
+	assert.Equal(t, "v*", snapshot["project.tag_pattern"])
+	assert.Equal(t, "600", snapshot["project.build_timeout_seconds"])
+	assert.Equal(t, "go", snapshot["build.tool"])
+	assert.Equal(t, "go test ./...", snapshot["build.steps.2"])
+
+	// Unregistered projects and builds that never reached the build tool
+	snapshot = service.configSnapshot(build, nil, time.Minute, nil)
+	assert.NotContains(t, snapshot, "project.default_branch")
+	assert.NotContains(t, snapshot, "build.tool")
+}
+
+func TestDiffConfigs(t *testing.T) {
+	from := ConfigSnapshot{"executor": "local", "build.tool": "npm", "build.steps.3": "npm run test --if-present", "build.timeout": "30m0s"}
+	to := ConfigSnapshot{"executor": "local", "build.tool": "go", "build.timeout": "30m0s", "project.tag_pattern": "v*"}
+
+	changes := diffConfigs(from, to)
+	require.Len(t, changes, 3)
+
+	assert.Equal(t, "build.steps.3", changes[0].Key)
+	assert.Equal(t, "npm run test --if-present", *changes[0].From)
+	assert.Nil(t, changes[0].To)
+
+	assert.Equal(t, "build.tool", changes[1].Key)
+	assert.Equal(t, "npm", *changes[1].From)
+	assert.Equal(t, "go", *changes[1].To)
+
+	assert.Equal(t, "project.tag_pattern", changes[2].Key)
+	assert.Nil(t, changes[2].From)
+
+	assert.Empty(t, diffConfigs(to, to))
+}
+
+func TestBuildConfigDiffHandler(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.On("GetBuildConfig", 1).Return(ConfigSnapshot{"build.timeout": "30m0s"}, nil)
+	mockDB.On("GetBuildConfig", 2).Return(ConfigSnapshot{"build.timeout": "1h0m0s"}, nil)
+	mockDB.On("GetBuildConfig", 3).Return(nil, fmt.Errorf("build config not found"))
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/builds/{id}/config", service.buildConfigHandler).Methods("GET")
+	router.HandleFunc("/api/v1/builds/{id}/config/diff", service.buildConfigDiffHandler).Methods("GET")
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/builds/2/config/diff?against=1", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var diff ConfigDiff
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&diff))
+	assert.Equal(t, 1, diff.FromBuild)
+	assert.Equal(t, 2, diff.ToBuild)
+	require.Len(t, diff.Changes, 1)
+	assert.Equal(t, "1h0m0s", *diff.Changes[0].To)
+
+	for path, expected := range map[string]int{
+		"/api/v1/builds/1/config":                http.StatusOK,
+		"/api/v1/builds/3/config":                http.StatusNotFound,
+		"/api/v1/builds/2/config/diff":           http.StatusBadRequest,
+		"/api/v1/builds/2/config/diff?against=x": http.StatusBadRequest,
+		"/api/v1/builds/2/config/diff?against=3": http.StatusNotFound,
+	} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		assert.Equal(t, expected, rr.Code, path)
+	}
+
+	// A tenant can't diff against another org's build
+	mockDB.On("GetBuild", 1).Return(&BuildRequest{ID: 1, Org: "globex"}, nil)
+	mockDB.On("GetBuild", 2).Return(&BuildRequest{ID: 2, Org: "acme"}, nil)
+	req := httptest.NewRequest("GET", "/api/v1/builds/2/config/diff?against=1", nil)
+	req = req.WithContext(context.WithValue(req.Context(), tenantContextKey{}, Tenant{Org: "acme"}))
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	assert.NotContains(t, rr.Body.String(), "30m0s")
+}
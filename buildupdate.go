@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxBuildDescriptionLength bounds the free-form description of a build
+const maxBuildDescriptionLength = 1000
+
+// buildTransitions lists the statuses a build can be moved to by a PATCH
+// request from each status. A draft can be queued and a queued build held
+// back as a draft; other transitions belong to workers or go through the
+// start, cancel and retry endpoints.
+var buildTransitions = map[string][]string{
+	"draft":  {"queued"},
+	"queued": {"draft"},
+}
+
+// BuildUpdate holds the fields of a build that can be changed; nil fields are
+// left untouched
+type BuildUpdate struct {
+	Status *string `json:"status"`
+	// StartAt is when a draft build is queued automatically
+	StartAt     *time.Time `json:"start_at"`
+	Description *string    `json:"description"`
+	// DebugLogging turns debug logging of a build that hasn't started on or
+	// off
+	DebugLogging *bool `json:"debug_logging"`
+	// Labels replace all of the build's labels
+	Labels *Labels `json:"labels"`
+}
+
+// Validate checks the values of the update
+func (bu *BuildUpdate) Validate() error {
+	if bu.Description != nil && len(*bu.Description) > maxBuildDescriptionLength {
+		return fmt.Errorf("description must be at most %d characters", maxBuildDescriptionLength)
+	}
+	if bu.Labels != nil {
+		return bu.Labels.validate()
+	}
+	return nil
+}
+
+// Check reports why the update can't be applied to build in its current state
+func (bu *BuildUpdate) Check(build *BuildRequest) error {
+	status := build.Status
+	if bu.Status != nil && *bu.Status != build.Status {
+		allowed := buildTransitions[build.Status]
+		if !slices.Contains(allowed, *bu.Status) {
+			if len(allowed) == 0 {
+				return fmt.Errorf("status of a %s build can't be changed", build.Status)
+			}
+			return fmt.Errorf("build can move from %s to %s, not %s", build.Status, strings.Join(allowed, " or "), *bu.Status)
+		}
+		status = *bu.Status
+	}
+	if bu.StartAt != nil && status != "draft" {
+		return fmt.Errorf("start_at can only be set on draft builds")
+	}
+	if bu.DebugLogging != nil && build.Status != "draft" && build.Status != "queued" {
+		return fmt.Errorf("debug_logging can only be changed before the build starts")
+	}
+	return nil
+}
+
+// buildETag identifies a version of a build for conditional requests. Every
+// write to a build moves its updated_at.
+func buildETag(build *BuildRequest) string {
+	return `"` + strconv.Itoa(build.ID) + "-" + strconv.FormatInt(build.UpdatedAt.UnixMicro(), 36) + `"`
+}
+
+// Update build endpoint. Requires the build's ETag in If-Match, so that
+// concurrent changes by workers or other clients aren't overwritten.
+func (bs *BuildService) updateBuildHandler(w http.ResponseWriter, r *http.Request) {
+	var update BuildUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := update.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		http.Error(w, "If-Match header with the build's ETag is required", http.StatusPreconditionRequired)
+		return
+	}
+
+	build, ok := bs.artifactBuild(w, r)
+	if !ok {
+		return
+	}
+	if ifMatch != "*" && ifMatch != buildETag(build) {
+		w.Header().Set("ETag", buildETag(build))
+		http.Error(w, "Build was modified, reload and retry", http.StatusPreconditionFailed)
+		return
+	}
+	if err := update.Check(build); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	updated, err := bs.db.UpdateBuild(build.ID, &update, build.UpdatedAt)
+	if err != nil {
+		if err.Error() == "build changed" {
+			http.Error(w, "Build was modified, reload and retry", http.StatusPreconditionFailed)
+			return
+		}
+		log.Printf("Error updating build: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if updated.Status != build.Status {
+		log.Printf("Build %d moved from %s to %s", updated.ID, build.Status, updated.Status)
+		bs.events.Publish(updated)
+		if updated.Status == "queued" {
+			bs.queue.Notify()
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", buildETag(updated))
+	json.NewEncoder(w).Encode(updated)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildUpdateCheck(t *testing.T) {
+	status := func(s string) *string { return &s }
+	debug := true
+	startAt := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name   string
+		build  string
+		update BuildUpdate
+		ok     bool
+	}{
+		{"queue a draft", "draft", BuildUpdate{Status: status("queued")}, true},
+		{"hold a queued build", "queued", BuildUpdate{Status: status("draft")}, true},
+		{"same status", "running", BuildUpdate{Status: status("running")}, true},
+		{"finish a running build", "running", BuildUpdate{Status: status("success")}, false},
+		{"revive a failed build", "failed", BuildUpdate{Status: status("queued")}, false},
+		{"reschedule a draft", "draft", BuildUpdate{StartAt: &startAt}, true},
+		{"hold with a start time", "queued", BuildUpdate{Status: status("draft"), StartAt: &startAt}, true},
+		{"start time of a queued build", "queued", BuildUpdate{StartAt: &startAt}, false},
+		{"debug a queued build", "queued", BuildUpdate{DebugLogging: &debug}, true},
+		{"debug a running build", "running", BuildUpdate{DebugLogging: &debug}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.update.Check(&BuildRequest{Status: tt.build})
+			assert.Equal(t, tt.ok, err == nil, "%v", err)
+		})
+	}
+}
+
+func TestBuildETag(t *testing.T) {
+	updatedAt := time.Date(2030, 1, 2, 3, 4, 5, 6000, time.UTC)
+	etag := buildETag(&BuildRequest{ID: 7, UpdatedAt: updatedAt})
+	assert.True(t, strings.HasPrefix(etag, `"7-`) && strings.HasSuffix(etag, `"`), etag)
+	assert.NotEqual(t, etag, buildETag(&BuildRequest{ID: 7, UpdatedAt: updatedAt.Add(time.Microsecond)}))
+}
+
+func TestUpdateBuildHandler(t *testing.T) {
+	updatedAt := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	draft := &BuildRequest{ID: 7, ProjectName: "api", Status: "draft", Draft: true, UpdatedAt: updatedAt}
+	etag := buildETag(draft)
+
+	patch := func(service *BuildService, id, ifMatch, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PATCH", "/api/v1/builds/"+id, bytes.NewBufferString(body))
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		req = mux.SetURLVars(req, map[string]string{"id": id})
+		rr := httptest.NewRecorder()
+		service.updateBuildHandler(rr, req)
+		return rr
+	}
+
+	t.Run("queues a draft", func(t *testing.T) {
+		service, mockDB := setupTestService()
+		queued := &BuildRequest{ID: 7, ProjectName: "api", Status: "queued", Description: "RC 2", UpdatedAt: updatedAt.Add(time.Second)}
+		mockDB.On("GetBuild", 7).Return(draft, nil).Once()
+		mockDB.On("UpdateBuild", 7, mock.MatchedBy(func(u *BuildUpdate) bool {
+			return *u.Status == "queued" && *u.Description == "RC 2"
+		}), updatedAt).Return(queued, nil).Once()
+
+		events, unsubscribe := service.events.Subscribe(1)
+		defer unsubscribe()
+
+		rr := patch(service, "7", etag, `{"status": "queued", "description": "RC 2"}`)
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		assert.Equal(t, buildETag(queued), rr.Header().Get("ETag"))
+		var build BuildRequest
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &build))
+		assert.Equal(t, "RC 2", build.Description)
+
+		select {
+		case event := <-events:
+			assert.Equal(t, "queued", event.Build.Status)
+		case <-time.After(time.Second):
+			t.Fatal("status change was not published")
+		}
+		mockDB.AssertExpectations(t)
+	})
+
+	t.Run("requires If-Match", func(t *testing.T) {
+		service, _ := setupTestService()
+		assert.Equal(t, http.StatusPreconditionRequired, patch(service, "7", "", `{"description": "x"}`).Code)
+	})
+
+	t.Run("stale ETag", func(t *testing.T) {
+		service, mockDB := setupTestService()
+		mockDB.On("GetBuild", 7).Return(draft, nil).Once()
+		rr := patch(service, "7", `"7-old"`, `{"description": "x"}`)
+		assert.Equal(t, http.StatusPreconditionFailed, rr.Code)
+		assert.Equal(t, etag, rr.Header().Get("ETag"))
+	})
+
+	t.Run("concurrent change", func(t *testing.T) {
+		service, mockDB := setupTestService()
+		mockDB.On("GetBuild", 7).Return(draft, nil).Once()
+		mockDB.On("UpdateBuild", 7, mock.Anything, updatedAt).Return(nil, fmt.Errorf("build changed")).Once()
+		assert.Equal(t, http.StatusPreconditionFailed, patch(service, "7", etag, `{"description": "x"}`).Code)
+	})
+
+	t.Run("disallowed transition", func(t *testing.T) {
+		service, mockDB := setupTestService()
+		mockDB.On("GetBuild", 7).Return(draft, nil).Once()
+		rr := patch(service, "7", "*", `{"status": "success"}`)
+		assert.Equal(t, http.StatusConflict, rr.Code)
+		assert.Contains(t, rr.Body.String(), "build can move from draft to queued, not success")
+	})
+
+	t.Run("invalid requests", func(t *testing.T) {
+		service, mockDB := setupTestService()
+		mockDB.On("GetBuild", 999).Return(nil, fmt.Errorf("build not found")).Once()
+		assert.Equal(t, http.StatusBadRequest, patch(service, "7", etag, `{`).Code)
+		assert.Equal(t, http.StatusBadRequest, patch(service, "7", etag, `{"description": "`+strings.Repeat("x", maxBuildDescriptionLength+1)+`"}`).Code)
+		assert.Equal(t, http.StatusBadRequest, patch(service, "abc", etag, `{}`).Code)
+		assert.Equal(t, http.StatusNotFound, patch(service, "999", etag, `{}`).Code)
+	})
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// defaultWaitTimeout and maxWaitTimeout bound how long a wait request
+	// blocks for a build to finish
+	defaultWaitTimeout = 60 * time.Second
+	maxWaitTimeout     = 10 * time.Minute
+	// waitPollInterval is how often waiting requests re-read the build, which
+	// catches builds finished by workers of other instances
+	waitPollInterval = 5 * time.Second
+)
+
+// waitRouteDeprecation retires the /wait endpoint, which ?wait=true on the
+// build itself has replaced
+var waitRouteDeprecation = Deprecation{
+	Method:    "GET",
+	Route:     "/api/v1/builds/{id}/wait",
+	Since:     time.Date(2026, 10, 15, 0, 0, 0, 0, time.UTC),
+	Sunset:    time.Date(2027, 4, 15, 0, 0, 0, 0, time.UTC),
+	Successor: "/api/v1/builds/{id}?wait=true",
+}
+
+// parseWaitTimeout reads ?timeout= as a duration such as 90s or 5m, or as
+// a number of seconds
+func parseWaitTimeout(value string) (time.Duration, bool) {
+	if value == "" {
+		return defaultWaitTimeout, true
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, err := strconv.Atoi(value)
+		if err != nil {
+			return 0, false
+		}
+		timeout = time.Duration(seconds) * time.Second
+	}
+	if timeout < 0 || timeout > maxWaitTimeout {
+		return 0, false
+	}
+	return timeout, true
+}
+
+// Wait for build endpoint. Blocks until the build has finished or the
+// timeout elapses, then returns the build; X-Build-Finished tells the two
+// apart. Deprecated in favour of ?wait=true on the get build endpoint.
+func (bs *BuildService) waitBuildHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid build ID", http.StatusBadRequest)
+		return
+	}
+	timeout, ok := parseWaitTimeout(r.URL.Query().Get("timeout"))
+	if !ok {
+		http.Error(w, "timeout must be a duration of at most 10m", http.StatusBadRequest)
+		return
+	}
+	bs.waitForBuild(w, r, id, timeout)
+}
+
+// waitForBuild responds with the build once it has finished or the timeout
+// elapses. Waiting follows the build's events rather than re-reading it, apart
+// from an occasional poll for builds finished by other instances.
+func (bs *BuildService) waitForBuild(w http.ResponseWriter, r *http.Request, id int, timeout time.Duration) {
+	// Subscribe before reading the build so a transition in between isn't
+	// missed
+	events, unsubscribe := bs.events.Subscribe(16)
+	defer unsubscribe()
+
+	build, err := bs.db.GetBuild(id)
+	if err != nil {
+		if err.Error() == "build not found" {
+			http.Error(w, "Build not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error getting build: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Waits may outlive the server's write timeout
+	if timeout > 0 && !finishedStatuses[build.Status] {
+		if err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(timeout + 10*time.Second)); err != nil {
+			log.Printf("Error extending write deadline for build wait: %v", err)
+		}
+	}
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	poll := time.NewTicker(waitPollInterval)
+	defer poll.Stop()
+
+wait:
+	for !finishedStatuses[build.Status] {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				break wait
+			}
+			if event.Build.ID == id {
+				snapshot := event.Build
+				build = &snapshot
+			}
+		case <-poll.C:
+			current, err := bs.db.GetBuild(id)
+			if err != nil {
+				log.Printf("Error getting build: %v", err)
+				continue
+			}
+			build = current
+		case <-deadline.C:
+			break wait
+		case <-bs.streamsDone:
+			break wait
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	bs.setBuildETA(build, time.Now())
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", buildETag(build))
+	w.Header().Set("X-Build-Finished", strconv.FormatBool(finishedStatuses[build.Status]))
+	json.NewEncoder(w).Encode(build)
+}
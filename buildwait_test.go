@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseWaitTimeout(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected time.Duration
+		ok       bool
+	}{
+		{"", defaultWaitTimeout, true},
+		{"90s", 90 * time.Second, true},
+		{"5m", 5 * time.Minute, true},
+		{"30", 30 * time.Second, true},
+		{"0", 0, true},
+		{"11m", 0, false},
+		{"-1s", 0, false},
+		{"soon", 0, false},
+	}
+	for _, tt := range tests {
+		timeout, ok := parseWaitTimeout(tt.value)
+		assert.Equal(t, tt.ok, ok, tt.value)
+		assert.Equal(t, tt.expected, timeout, tt.value)
+	}
+}
+
+func TestWaitBuildHandler(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.On("GetBuild", 1).Return(&BuildRequest{ID: 1, Status: "success"}, nil)
+	mockDB.On("GetBuild", 2).Return(&BuildRequest{ID: 2, Status: "running"}, nil)
+	mockDB.On("GetBuild", 3).Return(&BuildRequest{ID: 3, Status: "queued"}, nil)
+	mockDB.On("GetBuild", 4).Return(nil, fmt.Errorf("build not found"))
+
+	wait := func(id, timeout string) (*httptest.ResponseRecorder, *BuildRequest) {
+		req := httptest.NewRequest("GET", "/api/v1/builds/"+id+"/wait?timeout="+timeout, nil)
+		req = mux.SetURLVars(req, map[string]string{"id": id})
+		rr := httptest.NewRecorder()
+		service.waitBuildHandler(rr, req)
+		var build BuildRequest
+		if rr.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &build))
+		}
+		return rr, &build
+	}
+
+	// Finished builds are returned straight away
+	rr, build := wait("1", "")
+	assert.Equal(t, "true", rr.Header().Get("X-Build-Finished"))
+	assert.Equal(t, "success", build.Status)
+
+	// Running builds are returned once they finish
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		// Other builds' events don't end the wait
+		service.events.Publish(&BuildRequest{ID: 3, Status: "failed"})
+		service.events.Publish(&BuildRequest{ID: 2, Status: "failed", FailureCategory: failureTest})
+	}()
+	rr, build = wait("2", "5s")
+	assert.Equal(t, "true", rr.Header().Get("X-Build-Finished"))
+	assert.Equal(t, "failed", build.Status)
+	assert.Equal(t, failureTest, build.FailureCategory)
+
+	// Or as they are when the timeout elapses
+	rr, build = wait("3", "20ms")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "false", rr.Header().Get("X-Build-Finished"))
+	assert.Equal(t, "queued", build.Status)
+
+	rr, _ = wait("4", "")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	rr, _ = wait("1", "1h")
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	rr, _ = wait("x", "")
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestGetBuildWait(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.On("GetBuild", 2).Return(&BuildRequest{ID: 2, Status: "running"}, nil)
+
+	get := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/v1/builds/2?"+query, nil)
+		req = mux.SetURLVars(req, map[string]string{"id": "2"})
+		rr := httptest.NewRecorder()
+		service.getBuildHandler(rr, req)
+		return rr
+	}
+
+	// ?wait=true blocks until the build finishes
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		service.events.Publish(&BuildRequest{ID: 2, Status: "success"})
+	}()
+	rr := get("wait=true&timeout=5s")
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "true", rr.Header().Get("X-Build-Finished"))
+	assert.NotEmpty(t, rr.Header().Get("ETag"))
+	var build BuildRequest
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &build))
+	assert.Equal(t, "success", build.Status)
+
+	// Without it, the build is returned as it is
+	rr = get("wait=false")
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Empty(t, rr.Header().Get("X-Build-Finished"))
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &build))
+	assert.Equal(t, "running", build.Status)
+
+	assert.Equal(t, http.StatusBadRequest, get("wait=soon").Code)
+	assert.Equal(t, http.StatusBadRequest, get("wait=true&timeout=1h").Code)
+}
+
+func TestWaitBuildRouteDeprecated(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.On("GetBuild", 1).Return(&BuildRequest{ID: 1, Status: "success"}, nil)
+	router, err := service.Router()
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "/api/v1/builds/1/wait?timeout=0", nil)
+	req.Header.Set("X-Client-Version", "buildctl/1.4.0")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "@1792022400", rr.Header().Get("Deprecation"))
+	assert.Equal(t, "Thu, 15 Apr 2027 00:00:00 GMT", rr.Header().Get("Sunset"))
+	assert.Equal(t, `</api/v1/builds/1?wait=true>; rel="successor-version"`, rr.Header().Get("Link"))
+
+	// Its successor isn't deprecated
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/builds/1?wait=true&timeout=0", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Empty(t, rr.Header().Get("Deprecation"))
+
+	report := service.deprecations.Report()
+	require.Len(t, report, 1)
+	assert.Equal(t, waitRouteDeprecation, report[0].Deprecation)
+	require.Len(t, report[0].Clients, 1)
+	assert.Equal(t, ClientInfo{Name: "buildctl", Version: "1.4.0"}, report[0].Clients[0].ClientInfo)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ReadCache keeps the builds and projects read by the build and badge
+// endpoints in Redis, so dashboards polling them don't each hit Postgres.
+// Entries are invalidated whenever a build event is published, and expire
+// after their TTL to bound staleness from changes made without one. A nil
+// ReadCache reads straight through to the database.
+type ReadCache struct {
+	client   *RedisClient
+	ttls     map[string]time.Duration
+	timeout  time.Duration
+	requests *prometheus.CounterVec
+}
+
+// NewReadCacheFromEnv creates a cache on the Redis server at REDIS_URL, or
+// returns nil when it isn't set
+func NewReadCacheFromEnv(requests *prometheus.CounterVec) *ReadCache {
+	redisURL := os.Getenv("REDIS_URL")
+	if redisURL == "" {
+		return nil
+	}
+
+	timeout := getEnvDuration("REDIS_TIMEOUT", 500*time.Millisecond)
+	client, err := NewRedisClient(redisURL, timeout)
+	if err != nil {
+		log.Printf("Invalid REDIS_URL, caching disabled: %v", err)
+		return nil
+	}
+
+	return &ReadCache{
+		client: client,
+		ttls: map[string]time.Duration{
+			"build":   getEnvDuration("CACHE_BUILD_TTL", 30*time.Second),
+			"project": getEnvDuration("CACHE_PROJECT_TTL", 5*time.Minute),
+			"latest":  getEnvDuration("CACHE_BADGE_TTL", time.Minute),
+		},
+		timeout:  timeout,
+		requests: requests,
+	}
+}
+
+func buildCacheKey(id int) string {
+	return "build-service:build:" + strconv.Itoa(id)
+}
+
+func projectCacheKey(name string) string {
+	return "build-service:project:" + name
+}
+
+func latestBuildCacheKey(projectName, branch string) string {
+	return "build-service:latest:" + projectName + ":" + branch
+}
+
+// Get decodes the value cached under key into dest, or on a miss fetches it,
+// caches it for the kind's TTL and decodes it into dest. Fetch errors aren't
+// cached, and Redis errors fall back to fetching.
+func (rc *ReadCache) Get(kind, key string, dest interface{}, fetch func() (interface{}, error)) error {
+	ctx, cancel := context.WithTimeout(context.Background(), rc.timeout)
+	defer cancel()
+
+	body, err := rc.client.Get(ctx, key)
+	switch {
+	case err == nil:
+		if json.Unmarshal(body, dest) == nil {
+			rc.requests.WithLabelValues(kind, "hit").Inc()
+			return nil
+		}
+		rc.requests.WithLabelValues(kind, "error").Inc()
+	case errors.Is(err, errRedisNil):
+		rc.requests.WithLabelValues(kind, "miss").Inc()
+	default:
+		rc.requests.WithLabelValues(kind, "error").Inc()
+		log.Printf("Error reading %s from cache: %v", key, err)
+	}
+
+	value, err := fetch()
+	if err != nil {
+		return err
+	}
+	if body, err = json.Marshal(value); err != nil {
+		return err
+	}
+	if ttl := rc.ttls[kind]; ttl > 0 {
+		if err := rc.client.Set(ctx, key, body, ttl); err != nil {
+			log.Printf("Error caching %s: %v", key, err)
+		}
+	}
+	return json.Unmarshal(body, dest)
+}
+
+// invalidate removes keys, logging rather than failing when Redis is down
+func (rc *ReadCache) invalidate(keys ...string) {
+	if rc == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), rc.timeout)
+	defer cancel()
+	if err := rc.client.Del(ctx, keys...); err != nil {
+		log.Printf("Error invalidating cache: %v", err)
+	}
+}
+
+// InvalidateBuild removes a build and the latest finished build of its
+// branch, which it may have become
+func (rc *ReadCache) InvalidateBuild(build *BuildRequest) {
+	rc.invalidate(buildCacheKey(build.ID), latestBuildCacheKey(build.ProjectName, build.Branch))
+}
+
+// InvalidateProject removes a project
+func (rc *ReadCache) InvalidateProject(name string) {
+	rc.invalidate(projectCacheKey(name))
+}
+
+// cachedBuild reads a build through the cache
+func (bs *BuildService) cachedBuild(id int) (*BuildRequest, error) {
+	if bs.cache == nil {
+		return bs.db.GetBuild(id)
+	}
+	build := &BuildRequest{}
+	err := bs.cache.Get("build", buildCacheKey(id), build, func() (interface{}, error) {
+		return bs.db.GetBuild(id)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return build, nil
+}
+
+// cachedProject reads a project by name through the cache
+func (bs *BuildService) cachedProject(name string) (*Project, error) {
+	if bs.cache == nil {
+		return bs.db.GetProjectByName(name)
+	}
+	project := &Project{}
+	err := bs.cache.Get("project", projectCacheKey(name), project, func() (interface{}, error) {
+		return bs.db.GetProjectByName(name)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return project, nil
+}
+
+// cachedLatestFinishedBuild reads the latest finished build of a branch
+// through the cache. Branches without one aren't cached.
+func (bs *BuildService) cachedLatestFinishedBuild(projectName, branch string) (*BuildRequest, error) {
+	if bs.cache == nil {
+		return bs.db.GetLatestFinishedBuild(projectName, branch)
+	}
+	build := &BuildRequest{}
+	err := bs.cache.Get("latest", latestBuildCacheKey(projectName, branch), build, func() (interface{}, error) {
+		return bs.db.GetLatestFinishedBuild(projectName, branch)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return build, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadCacheBuilds(t *testing.T) {
+	server := newFakeRedisServer(t, "")
+	t.Setenv("REDIS_URL", server.URL("", ""))
+	service, mockDB := setupTestService()
+	require.NotNil(t, service.cache)
+	mockDB.On("GetBuild", 1).Return(&BuildRequest{ID: 1, ProjectName: "api", Branch: "main", Status: "running"}, nil).Once()
+	mockDB.On("GetBuild", 2).Return(nil, fmt.Errorf("build not found")).Twice()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/builds/{id}", service.getBuildHandler).Methods("GET")
+	get := func(path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		return rr
+	}
+
+	first := get("/api/v1/builds/1")
+	require.Equal(t, http.StatusOK, first.Code)
+	second := get("/api/v1/builds/1")
+	assert.Equal(t, first.Body.String(), second.Body.String())
+	assert.Equal(t, first.Header().Get("ETag"), second.Header().Get("ETag"))
+	assert.Equal(t, 1.0, testutil.ToFloat64(service.metrics.CacheRequests.WithLabelValues("build", "hit")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(service.metrics.CacheRequests.WithLabelValues("build", "miss")))
+
+	// Status updates invalidate the build
+	mockDB.On("GetBuild", 1).Return(&BuildRequest{ID: 1, ProjectName: "api", Branch: "main", Status: "success"}, nil).Once()
+	service.events.Publish(&BuildRequest{ID: 1, ProjectName: "api", Branch: "main", Status: "success"})
+	assert.Contains(t, get("/api/v1/builds/1").Body.String(), `"status":"success"`)
+
+	// Missing builds aren't cached
+	assert.Equal(t, http.StatusNotFound, get("/api/v1/builds/2").Code)
+	assert.Equal(t, http.StatusNotFound, get("/api/v1/builds/2").Code)
+	mockDB.AssertExpectations(t)
+}
+
+func TestReadCacheBadges(t *testing.T) {
+	server := newFakeRedisServer(t, "")
+	t.Setenv("REDIS_URL", server.URL("", ""))
+	service, mockDB := setupTestService()
+	mockDB.On("GetProjectByName", "api").Return(&Project{ID: 1, Name: "api", DefaultBranch: "main"}, nil).Once()
+	mockDB.On("GetLatestFinishedBuild", "api", "main").Return(&BuildRequest{ID: 3, ProjectName: "api", Branch: "main", Status: "failed"}, nil).Once()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/projects/{name}/badge.svg", service.badgeHandler).Methods("GET")
+	for i := 0; i < 3; i++ {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/projects/api/badge.svg", nil))
+		require.Equal(t, http.StatusOK, rr.Code)
+		assert.Contains(t, rr.Body.String(), "failing")
+	}
+
+	// A newly finished build of the branch replaces the badge's build
+	mockDB.On("GetLatestFinishedBuild", "api", "main").Return(&BuildRequest{ID: 4, ProjectName: "api", Branch: "main", Status: "success"}, nil).Once()
+	service.events.Publish(&BuildRequest{ID: 4, ProjectName: "api", Branch: "main", Status: "success"})
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/projects/api/badge.svg", nil))
+	assert.Contains(t, rr.Body.String(), "passing")
+	mockDB.AssertExpectations(t)
+}
+
+func TestReadCacheFallsBackWithoutRedis(t *testing.T) {
+	server := newFakeRedisServer(t, "")
+	t.Setenv("REDIS_URL", server.URL("", ""))
+	service, mockDB := setupTestService()
+	server.listener.Close()
+	mockDB.On("GetBuild", 1).Return(&BuildRequest{ID: 1, Status: "running"}, nil).Twice()
+
+	for i := 0; i < 2; i++ {
+		build, err := service.cachedBuild(1)
+		require.NoError(t, err)
+		assert.Equal(t, "running", build.Status)
+	}
+	assert.Equal(t, 2.0, testutil.ToFloat64(service.metrics.CacheRequests.WithLabelValues("build", "error")))
+	mockDB.AssertExpectations(t)
+}
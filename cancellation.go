@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Reasons a build ended without finishing, recorded as its cancel_reason
+const (
+	cancelUserRequested = "user_requested"
+	// cancelSuperseded is for builds made redundant by a newer build
+	cancelSuperseded = "superseded"
+	// cancelPreempted is for builds stopped to make room for other work
+	cancelPreempted = "preempted"
+	cancelTimeout   = "timeout"
+	// cancelQueueExpired is for builds that waited longer than QUEUE_MAX_AGE
+	cancelQueueExpired = "queue_expired"
+)
+
+// Actors recorded for builds the service ended itself
+const (
+	actorExecutor = "system:executor"
+	actorQueue    = "system:queue"
+)
+
+// cancelRequestReasons are the reasons a cancel request may give
+var cancelRequestReasons = map[string]bool{
+	cancelUserRequested: true,
+	cancelSuperseded:    true,
+	cancelPreempted:     true,
+}
+
+// errBuildCancelled is the cause of the execution context of a cancelled build
+var errBuildCancelled = errors.New("build cancelled")
+
+// CancelRequest is the optional body of a cancel request
+type CancelRequest struct {
+	// Reason is user_requested (the default), superseded or preempted
+	Reason string `json:"reason"`
+	// Actor is the user or system asking for the cancellation
+	Actor string `json:"actor"`
+	// Force cancels the build even though waiting builds depend on it
+	Force bool `json:"force"`
+}
+
+// runningBuilds tracks the builds executing on this instance so that they
+// can be stopped when cancelled
+type runningBuilds struct {
+	mu      sync.Mutex
+	cancels map[int]context.CancelCauseFunc
+}
+
+func newRunningBuilds() *runningBuilds {
+	return &runningBuilds{cancels: make(map[int]context.CancelCauseFunc)}
+}
+
+func (rb *runningBuilds) add(id int, cancel context.CancelCauseFunc) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.cancels[id] = cancel
+}
+
+func (rb *runningBuilds) remove(id int) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	delete(rb.cancels, id)
+}
+
+// cancel stops the build if it is running on this instance
+func (rb *runningBuilds) cancel(id int) bool {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	cancel, ok := rb.cancels[id]
+	if ok {
+		cancel(errBuildCancelled)
+	}
+	return ok
+}
+
+// watchCancellation stops a running build once it has been cancelled through
+// another instance, checking every cancelCheckInterval until ctx is done
+func (bs *BuildService) watchCancellation(ctx context.Context, id int, cancel context.CancelCauseFunc) {
+	if bs.cancelCheckInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(bs.cancelCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			build, err := bs.db.GetBuild(id)
+			if err != nil {
+				log.Printf("Error checking build %d for cancellation: %v", id, err)
+				continue
+			}
+			if build.Status == "cancelled" {
+				cancel(errBuildCancelled)
+				return
+			}
+		}
+	}
+}
+
+// recordCancellation counts a build that ended without finishing
+func (bs *BuildService) recordCancellation(build *BuildRequest) {
+	bs.metrics.BuildsTotal.WithLabelValues(build.Status).Inc()
+	bs.metrics.BuildCancellations.WithLabelValues(build.CancelReason).Inc()
+}
+
+// Cancel build endpoint. Draft, queued and running builds can be cancelled;
+// running builds are stopped by the worker executing them. Builds that other
+// waiting builds depend on are only cancelled with force, otherwise the
+// downstream impact is returned with 409 Conflict.
+func (bs *BuildService) cancelBuildHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid build ID", http.StatusBadRequest)
+		return
+	}
+
+	// The body is optional
+	var req CancelRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Reason == "" {
+		req.Reason = cancelUserRequested
+	}
+	if !cancelRequestReasons[req.Reason] {
+		http.Error(w, "reason must be one of user_requested, superseded or preempted", http.StatusBadRequest)
+		return
+	}
+	actor := strings.TrimSpace(req.Actor)
+	if actor == "" {
+		actor = "api"
+	}
+
+	if !req.Force {
+		impact, err := bs.downstreamImpact(id)
+		if err != nil {
+			log.Printf("Error listing downstream builds: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if len(impact.Blocked) > 0 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(impact)
+			return
+		}
+	}
+
+	build, err := bs.db.CancelBuild(id, req.Reason, actor)
+	if err != nil {
+		switch err.Error() {
+		case "build not found":
+			http.Error(w, "Build not found", http.StatusNotFound)
+		case "build already finished":
+			http.Error(w, "Build has already finished", http.StatusConflict)
+		default:
+			log.Printf("Error cancelling build: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	log.Printf("Build %d cancelled by %s: %s", build.ID, build.CancelledBy, build.CancelReason)
+	bs.running.cancel(build.ID)
+	bs.recordCancellation(build)
+	bs.events.Publish(build)
+	bs.cancelMatrixBuilds(build)
+	bs.blockDownstream(build)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(build)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCancelBuildHandler(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.On("CancelBuild", 1, "user_requested", "api").Return(&BuildRequest{ID: 1, Status: "cancelled", CancelReason: "user_requested", CancelledBy: "api"}, nil).Once()
+	mockDB.On("CancelBuild", 2, "superseded", "deploy-bot").Return(&BuildRequest{ID: 2, Status: "cancelled", CancelReason: "superseded", CancelledBy: "deploy-bot"}, nil).Once()
+	mockDB.On("CancelBuild", 3, "user_requested", "api").Return(nil, fmt.Errorf("build already finished")).Once()
+	mockDB.On("CancelBuild", 4, "user_requested", "api").Return(nil, fmt.Errorf("build not found")).Once()
+	mockDB.On("ListDownstreamBuilds", mock.AnythingOfType("int")).Return([]*BuildRequest{}, nil)
+
+	cancel := func(id, body string) *httptest.ResponseRecorder {
+		req := mux.SetURLVars(httptest.NewRequest("POST", "/api/v1/builds/"+id+"/cancel", bytes.NewBufferString(body)), map[string]string{"id": id})
+		rr := httptest.NewRecorder()
+		service.cancelBuildHandler(rr, req)
+		return rr
+	}
+
+	rr := cancel("1", "")
+	require.Equal(t, http.StatusOK, rr.Code)
+	var build BuildRequest
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &build))
+	assert.Equal(t, "user_requested", build.CancelReason)
+	assert.Equal(t, "api", build.CancelledBy)
+
+	assert.Equal(t, http.StatusOK, cancel("2", `{"reason":"superseded","actor":"deploy-bot"}`).Code)
+	assert.Equal(t, http.StatusConflict, cancel("3", "").Code)
+	assert.Equal(t, http.StatusNotFound, cancel("4", "").Code)
+	assert.Equal(t, http.StatusBadRequest, cancel("5", `{"reason":"timeout"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, cancel("x", "").Code)
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(service.metrics.BuildsTotal.WithLabelValues("cancelled")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(service.metrics.BuildCancellations.WithLabelValues("user_requested")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(service.metrics.BuildCancellations.WithLabelValues("superseded")))
+	mockDB.AssertExpectations(t)
+}
+
+// processUntilCancelled runs a build that would take an hour and waits for
+// processing to return once it has been cancelled by cancel
+func processUntilCancelled(t *testing.T, service *BuildService, mockDB *MockDatabase, cancel func()) {
+	t.Helper()
+	service.defaultTimeout = time.Hour
+	mockDB.On("GetProjectByName", "test-project").Return(nil, fmt.Errorf("project not found"))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		service.processBuild(context.Background(), &BuildRequest{ID: 1, ProjectName: "test-project", Status: "running"})
+	}()
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("cancelled build kept running")
+	}
+	mockDB.AssertNotCalled(t, "UpdateBuildResult", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestProcessBuildStopsWhenCancelledLocally(t *testing.T) {
+	service, mockDB := setupTestService()
+	processUntilCancelled(t, service, mockDB, func() {
+		require.Eventually(t, func() bool { return service.running.cancel(1) }, time.Second, time.Millisecond)
+	})
+	assert.False(t, service.running.cancel(1))
+}
+
+func TestProcessBuildStopsWhenCancelledElsewhere(t *testing.T) {
+	service, mockDB := setupTestService()
+	service.cancelCheckInterval = 5 * time.Millisecond
+	mockDB.On("GetBuild", 1).Return(&BuildRequest{ID: 1, Status: "running"}, nil).Twice()
+	mockDB.On("GetBuild", 1).Return(&BuildRequest{ID: 1, Status: "cancelled", CancelReason: "preempted"}, nil)
+
+	processUntilCancelled(t, service, mockDB, func() {})
+	mockDB.AssertNumberOfCalls(t, "GetBuild", 3)
+}
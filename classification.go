@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Categories failed and timed out builds are classified into
+const (
+	failureCompile = "compile_error"
+	failureTest    = "test_failure"
+	failureInfra   = "infrastructure"
+	failureOOM     = "out_of_memory"
+	failureTimeout = "timeout"
+	failureUnknown = "unknown"
+	// failureQualityGate marks successful builds failed by an external
+	// quality gate (see QualityGatePolicy)
+	failureQualityGate = "quality_gate"
+)
+
+// failureRule assigns a category to failures matching any of its conditions
+type failureRule struct {
+	category string
+	// exitCodes match the build's exit code
+	exitCodes []int
+	// stages match when the failed stage's name contains one of them
+	stages []string
+	// pattern matches a line of the failed stage's output
+	pattern *regexp.Regexp
+}
+
+// failureRules are tried in order and the first matching rule wins, so
+// causes that also break compilation or tests, such as running out of memory
+// or losing the network, come first
+var failureRules = []failureRule{
+	{
+		category:  failureOOM,
+		exitCodes: []int{137},
+		pattern:   regexp.MustCompile(`(?im)out of memory|OOMKilled|cannot allocate memory|java\.lang\.OutOfMemoryError|signal: killed`),
+	},
+	{
+		category: failureInfra,
+		stages:   []string{"clone"},
+		pattern: regexp.MustCompile(`(?im)connection refused|connection reset by peer|could not resolve host|temporary failure in name resolution|` +
+			`i/o timeout|TLS handshake timeout|network is unreachable|no space left on device|toomanyrequests|` +
+			`cannot connect to the docker daemon`),
+	},
+	{
+		category: failureTest,
+		stages:   []string{"test"},
+		pattern:  regexp.MustCompile(`(?m)^\s*--- FAIL: |^FAILED |^\s*● |Tests run: \d+, Failures: [1-9]|test result: FAILED`),
+	},
+	{
+		category: failureCompile,
+		pattern: regexp.MustCompile(`(?m)^\s*[^\s:]+\.go:\d+(:\d+)?: |^[^\s:]+:\d+:(\d+:)? (fatal )?error: |error TS\d+: |` +
+			`^error(\[E\d+\])?: |COMPILATION ERROR|cannot find symbol|SyntaxError: `),
+	},
+}
+
+// matches reports whether a failure matches the rule
+func (fr failureRule) matches(exitCode int, stage string, output []byte) bool {
+	for _, code := range fr.exitCodes {
+		if exitCode == code {
+			return true
+		}
+	}
+	for _, name := range fr.stages {
+		if stage != "" && strings.Contains(stage, name) {
+			return true
+		}
+	}
+	return fr.pattern != nil && fr.pattern.Match(output)
+}
+
+// classifyFailure returns the category of a failed or timed out build from
+// its exit code and the output of the stage that failed, or the combined
+// output when the build has no stages. Other builds have no category.
+func classifyFailure(status string, exitCode int, stages []*BuildStage, output []byte) string {
+	switch status {
+	case "timeout":
+		return failureTimeout
+	case "failed":
+	default:
+		return ""
+	}
+
+	stage := ""
+	for i := len(stages) - 1; i >= 0; i-- {
+		if stages[i].Status == "failed" {
+			stage, output = stages[i].Name, []byte(stages[i].Log)
+			break
+		}
+	}
+
+	for _, rule := range failureRules {
+		if rule.matches(exitCode, stage, output) {
+			return rule.category
+		}
+	}
+	return failureUnknown
+}
+
+// FailureCauses counts a project's failed builds by category
+type FailureCauses struct {
+	Project  string         `json:"project"`
+	Since    time.Time      `json:"since"`
+	Failures int            `json:"failures"`
+	Causes   map[string]int `json:"causes"`
+}
+
+// Project failure causes endpoint
+func (bs *BuildService) failureCausesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	since, ok := statsSince(w, r, time.Now())
+	if !ok {
+		return
+	}
+
+	project, err := bs.db.GetProject(id)
+	if err != nil {
+		if err.Error() == "project not found" {
+			http.Error(w, "Project not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error getting project: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	causes, err := bs.db.CountFailureCategories(project.Name, since)
+	if err != nil {
+		log.Printf("Error counting failure causes: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	result := FailureCauses{Project: project.Name, Since: since, Causes: causes}
+	for _, count := range causes {
+		result.Failures += count
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
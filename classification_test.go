@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassifyFailure(t *testing.T) {
+	failedStage := func(name, log string) []*BuildStage {
+		return []*BuildStage{
+			{Name: "clone", Status: "success", Log: "Cloning into 'api'...\n"},
+			{Name: name, Status: "failed", Log: log},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		status   string
+		exitCode int
+		stages   []*BuildStage
+		output   string
+		expected string
+	}{
+		{"success", "success", 0, nil, "", ""},
+		{"cancelled", "cancelled", -1, nil, "", ""},
+		{"timeout", "timeout", -1, nil, "", failureTimeout},
+		{"killed", "failed", 137, failedStage("test", "--- FAIL: TestApi\n"), "", failureOOM},
+		{"out of memory", "failed", 1, failedStage("build", "FATAL ERROR: Reached heap limit JavaScript heap out of memory\n"), "", failureOOM},
+		{"clone failed", "failed", 128, []*BuildStage{{Name: "clone", Status: "failed", Log: "fatal: repository not found\n"}}, "", failureInfra},
+		{"network", "failed", 1, failedStage("build", "go: downloading x\ndial tcp 10.0.0.1:443: i/o timeout\n"), "", failureInfra},
+		{"test stage", "failed", 1, failedStage("unit-tests", "1 assertion failed\n"), "", failureTest},
+		{"go test", "failed", 1, failedStage("build", "=== RUN   TestApi\n--- FAIL: TestApi (0.01s)\n"), "", failureTest},
+		{"go compile", "failed", 1, failedStage("build", "# api\n./main.go:12:5: undefined: handler\n"), "", failureCompile},
+		{"tsc", "failed", 2, failedStage("build", "src/app.ts(3,7): error TS2304: Cannot find name 'x'.\n"), "", failureCompile},
+		{"no stages", "failed", -1, nil, "gcc: main.c:1:1: error: expected ';'\nlib.c:2:1: error: unknown type\n", failureCompile},
+		{"unrecognised", "failed", 3, failedStage("package", "something went wrong\n"), "", failureUnknown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, classifyFailure(tt.status, tt.exitCode, tt.stages, []byte(tt.output)))
+		})
+	}
+}
+
+func TestFailureCausesHandler(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.On("GetProject", 1).Return(&Project{ID: 1, Name: "api"}, nil)
+	mockDB.On("GetProject", 2).Return(nil, fmt.Errorf("project not found"))
+	mockDB.On("CountFailureCategories", "api", mock.AnythingOfType("time.Time")).
+		Return(map[string]int{failureTest: 5, failureInfra: 2}, nil).Once()
+
+	get := func(id, query string) *httptest.ResponseRecorder {
+		req := mux.SetURLVars(httptest.NewRequest("GET", "/api/v1/projects/"+id+"/failure-causes"+query, nil), map[string]string{"id": id})
+		rr := httptest.NewRecorder()
+		service.failureCausesHandler(rr, req)
+		return rr
+	}
+
+	rr := get("1", "?days=7")
+	require.Equal(t, http.StatusOK, rr.Code)
+	var causes FailureCauses
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &causes))
+	assert.Equal(t, "api", causes.Project)
+	assert.Equal(t, 7, causes.Failures)
+	assert.Equal(t, 5, causes.Causes[failureTest])
+
+	assert.Equal(t, http.StatusBadRequest, get("1", "?days=0").Code)
+	assert.Equal(t, http.StatusNotFound, get("2", "").Code)
+	assert.Equal(t, http.StatusBadRequest, get("x", "").Code)
+	mockDB.AssertExpectations(t)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Trigger sources record what created a build
+const (
+	triggerManual   = "manual"
+	triggerWebhook  = "webhook"
+	triggerSchedule = "schedule"
+	triggerRetry    = "retry"
+	// triggerAutoRetry builds were queued by their project's retry policy
+	triggerAutoRetry = "auto-retry"
+	// triggerUpstream builds were queued by the success of a build of an
+	// upstream project
+	triggerUpstream = "upstream"
+	// triggerBootstrap builds validate a newly onboarded project
+	triggerBootstrap = "bootstrap"
+	// triggerPullRequest builds check out the merge of a pull or merge request
+	triggerPullRequest = "pull-request"
+	// triggerMatrix builds run one combination of a matrix build's matrix
+	triggerMatrix = "matrix"
+)
+
+// maxCommitMessageLength bounds the commit message stored with a build
+const maxCommitMessageLength = 4096
+
+// CommitInfo describes the commit a build checked out
+type CommitInfo struct {
+	SHA     string
+	Message string
+	// Author is the commit's author as "Name <email>"
+	Author string
+}
+
+// truncateCommitMessage trims a commit message to maxCommitMessageLength bytes
+// without splitting a UTF-8 sequence
+func truncateCommitMessage(message string) string {
+	message = strings.TrimSpace(message)
+	if len(message) <= maxCommitMessageLength {
+		return message
+	}
+	return strings.ToValidUTF8(message[:maxCommitMessageLength], "")
+}
+
+// commitAuthor formats a commit author as "Name <email>"
+func commitAuthor(name, email string) string {
+	switch {
+	case email == "":
+		return name
+	case name == "":
+		return "<" + email + ">"
+	default:
+		return name + " <" + email + ">"
+	}
+}
+
+// describeCommit reads the SHA, author and message of the checked out commit.
+// It returns nil when git can't describe it, which doesn't fail the build.
+func (le *LocalExecutor) describeCommit(ctx context.Context, workspace, srcDir string, output *tailBuffer) *CommitInfo {
+	var stdout bytes.Buffer
+	show := []string{"git", "log", "-1", "--format=%H%x00%an%x00%ae%x00%B", "HEAD"}
+	if exitCode, err := le.runCapture(ctx, workspace, srcDir, &stdout, output, show); err != nil || exitCode != 0 {
+		return nil
+	}
+
+	fields := strings.SplitN(stdout.String(), "\x00", 4)
+	if len(fields) != 4 || !commitSHAPattern.MatchString(fields[0]) {
+		fmt.Fprintf(output, "unexpected git log output %q\n", stdout.String())
+		return nil
+	}
+	return &CommitInfo{
+		SHA:     fields[0],
+		Author:  commitAuthor(fields[1], fields[2]),
+		Message: truncateCommitMessage(fields[3]),
+	}
+}
+
+// recordCommit stores the commit a build checked out, which for builds of a
+// branch head is only known once it has been cloned
+func (bs *BuildService) recordCommit(build *BuildRequest, commit *CommitInfo) {
+	if commit == nil || (commit.SHA == build.CommitSHA && commit.Message == build.CommitMessage && commit.Author == build.CommitAuthor) {
+		return
+	}
+
+	build.CommitSHA, build.CommitMessage, build.CommitAuthor = commit.SHA, commit.Message, commit.Author
+	if err := bs.db.UpdateBuildCommit(build.ID, commit); err != nil {
+		bs.errors.Capture("executor", fmt.Errorf("recording commit %s: %w", commit.SHA, err), build)
+	}
+}
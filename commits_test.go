@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCommitAuthor(t *testing.T) {
+	assert.Equal(t, "Jane Doe <jane@example.com>", commitAuthor("Jane Doe", "jane@example.com"))
+	assert.Equal(t, "Jane Doe", commitAuthor("Jane Doe", ""))
+	assert.Equal(t, "<jane@example.com>", commitAuthor("", "jane@example.com"))
+	assert.Equal(t, "", commitAuthor("", ""))
+}
+
+func TestTruncateCommitMessage(t *testing.T) {
+	assert.Equal(t, "Fix login", truncateCommitMessage("Fix login\n\n"))
+
+	long := truncateCommitMessage(strings.Repeat("a", maxCommitMessageLength-1) + "é")
+	assert.Len(t, long, maxCommitMessageLength-1)
+}
+
+func TestDescribeCommit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	repo := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(repo, "README"), []byte("hello\n"), 0o644))
+	for _, args := range [][]string{
+		{"init", "-q", "-b", "main"},
+		{"add", "README"},
+		{"-c", "user.name=Jane Doe", "-c", "user.email=jane@example.com", "commit", "-q", "-m", "Add README", "-m", "With a body."},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repo
+		require.NoError(t, cmd.Run())
+	}
+	head, err := exec.Command("git", "-C", repo, "rev-parse", "HEAD").Output()
+	require.NoError(t, err)
+
+	executor := NewLocalExecutor(t.TempDir())
+	output := &tailBuffer{limit: maxOutputBytes}
+	commit := executor.describeCommit(context.Background(), t.TempDir(), repo, output)
+	require.NotNil(t, commit, string(output.Bytes()))
+	assert.Equal(t, strings.TrimSpace(string(head)), commit.SHA)
+	assert.Equal(t, "Jane Doe <jane@example.com>", commit.Author)
+	assert.Equal(t, "Add README\n\nWith a body.", commit.Message)
+
+	// A directory that isn't a repository doesn't fail the build
+	assert.Nil(t, executor.describeCommit(context.Background(), t.TempDir(), t.TempDir(), output))
+}
+
+func TestRecordCommit(t *testing.T) {
+	service, mockDB := setupTestService()
+	commit := &CommitInfo{SHA: testCommitSHA, Message: "Add README", Author: "Jane Doe <jane@example.com>"}
+	mockDB.On("UpdateBuildCommit", 5, commit).Return(nil).Once()
+
+	build := &BuildRequest{ID: 5, Branch: "main"}
+	service.recordCommit(build, commit)
+	assert.Equal(t, testCommitSHA, build.CommitSHA)
+	assert.Equal(t, "Jane Doe <jane@example.com>", build.CommitAuthor)
+
+	// Unchanged metadata and failed checkouts aren't written again
+	service.recordCommit(build, commit)
+	service.recordCommit(build, nil)
+	mockDB.AssertExpectations(t)
+}
+
+func TestCreateBuildTriggerSource(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.On("CreateBuild", mock.MatchedBy(func(b *BuildRequest) bool {
+		return b.TriggerSource == triggerManual && b.CommitAuthor == "Jane Doe"
+	})).Return(3, nil).Once()
+
+	body := `{"project_name": "api", "git_url": "https://github.com/acme/api.git", "trigger_source": "schedule", "commit_author": "Jane Doe"}`
+	rr := httptest.NewRecorder()
+	service.createBuildHandler(rr, httptest.NewRequest("POST", "/api/v1/builds", bytes.NewBufferString(body)))
+
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	mockDB.AssertExpectations(t)
+}
+
+func TestListBuildsByCommit(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.On("ListBuildsByCommit", "abc1234", false, "", Labels(nil)).Return([]*BuildRequest{{ID: 1, CommitSHA: testCommitSHA}}, nil).Once()
+	mockDB.On("ListBuildsByCommit", "def5678", false, "", Labels(nil)).Return(nil, fmt.Errorf("database error")).Once()
+
+	list := func(sha string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		service.listBuildsHandler(rr, httptest.NewRequest("GET", "/api/v1/builds?commit_sha="+sha, nil))
+		return rr
+	}
+
+	rr := list("ABC1234")
+	require.Equal(t, http.StatusOK, rr.Code)
+	var builds []*BuildRequest
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &builds))
+	assert.Len(t, builds, 1)
+
+	assert.Equal(t, http.StatusBadRequest, list("abc").Code)
+	assert.Equal(t, http.StatusBadRequest, list("not-a-sha").Code)
+	assert.Equal(t, http.StatusInternalServerError, list("def5678").Code)
+	mockDB.AssertExpectations(t)
+}
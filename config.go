@@ -0,0 +1,56 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// getEnvInt reads an integer from the environment, falling back to the
+// default when the variable is unset or malformed
+func getEnvInt(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid value %q for %s, using default %d", value, key, fallback)
+		return fallback
+	}
+	return n
+}
+
+// getEnvDuration reads a duration (e.g. "30s", "5m") from the environment,
+// falling back to the default when the variable is unset or malformed
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid value %q for %s, using default %s", value, key, fallback)
+		return fallback
+	}
+	return d
+}
+
+// getEnvBool reads a boolean (e.g. "true", "1") from the environment,
+// falling back to the default when the variable is unset or malformed
+func getEnvBool(key string, fallback bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Invalid value %q for %s, using default %t", value, key, fallback)
+		return fallback
+	}
+	return b
+}
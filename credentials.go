@@ -0,0 +1,365 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// credentialPrefix marks a stored credential encrypted with a keyring key. It
+// is followed by the key ID and the base64 nonce and ciphertext.
+const credentialPrefix = "enc:v1:"
+
+// CredentialKeyring encrypts credentials stored in the database with AES-GCM.
+// New values are sealed with the primary key; values sealed with any key in
+// the ring, or stored before encryption was enabled, can be opened.
+type CredentialKeyring struct {
+	primary string
+	keys    map[string]cipher.AEAD
+}
+
+// NewCredentialKeyring parses a comma separated list of id:base64-key pairs,
+// each key 32 bytes. The first key is the primary key.
+func NewCredentialKeyring(spec string) (*CredentialKeyring, error) {
+	kr := &CredentialKeyring{keys: make(map[string]cipher.AEAD)}
+	for _, entry := range strings.Split(spec, ",") {
+		id, encoded, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("credential key %q must be id:base64-key", entry)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("credential key %s must be 32 base64 encoded bytes", id)
+		}
+		if _, exists := kr.keys[id]; exists {
+			return nil, fmt.Errorf("duplicate credential key %s", id)
+		}
+
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		kr.keys[id] = aead
+		if kr.primary == "" {
+			kr.primary = id
+		}
+	}
+	return kr, nil
+}
+
+// NewCredentialKeyringFromEnv returns the keyring configured by
+// CREDENTIAL_KEYS, or read from CREDENTIAL_KEYS_FILE as mounted by a KMS
+// backed secret store, or nil when credentials are stored unencrypted
+func NewCredentialKeyringFromEnv() (*CredentialKeyring, error) {
+	spec := os.Getenv("CREDENTIAL_KEYS")
+	if path := os.Getenv("CREDENTIAL_KEYS_FILE"); spec == "" && path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading CREDENTIAL_KEYS_FILE: %w", err)
+		}
+		spec = strings.TrimSpace(string(data))
+	}
+	if spec == "" {
+		return nil, nil
+	}
+	return NewCredentialKeyring(spec)
+}
+
+// PrimaryKey returns the ID of the key new values are sealed with
+func (kr *CredentialKeyring) PrimaryKey() string {
+	if kr == nil {
+		return ""
+	}
+	return kr.primary
+}
+
+// Seal encrypts value with the primary key. Empty values, and every value
+// when no keyring is configured, are returned unchanged.
+func (kr *CredentialKeyring) Seal(value string) (string, error) {
+	if kr == nil || value == "" {
+		return value, nil
+	}
+
+	aead := kr.keys[kr.primary]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(value), []byte(kr.primary))
+	return credentialPrefix + kr.primary + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a stored value. Values without credentialPrefix were stored
+// unencrypted and are returned as they are.
+func (kr *CredentialKeyring) Open(stored string) (string, error) {
+	if !strings.HasPrefix(stored, credentialPrefix) {
+		return stored, nil
+	}
+
+	id, encoded, ok := strings.Cut(strings.TrimPrefix(stored, credentialPrefix), ":")
+	if !ok {
+		return "", fmt.Errorf("malformed encrypted credential")
+	}
+	var aead cipher.AEAD
+	if kr != nil {
+		aead = kr.keys[id]
+	}
+	if aead == nil {
+		return "", fmt.Errorf("credential encrypted with unknown key %s", id)
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("malformed encrypted credential")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(id))
+	if err != nil {
+		return "", fmt.Errorf("decrypting credential with key %s: %w", id, err)
+	}
+	return string(plaintext), nil
+}
+
+// errRotationRunning is returned when a credential rotation is started while
+// another is in progress
+var errRotationRunning = errors.New("credential rotation already running")
+
+// CredentialRotation reports the progress of re-encrypting the stored
+// credentials with the primary key
+type CredentialRotation struct {
+	ID                       int      `json:"id"`
+	Status                   string   `json:"status"`
+	KeyID                    string   `json:"key_id,omitempty"`
+	RegenerateWebhookSecrets bool     `json:"regenerate_webhook_secrets"`
+	Total                    int      `json:"total"`
+	Rotated                  int      `json:"rotated"`
+	Failed                   int      `json:"failed"`
+	Errors                   []string `json:"errors,omitempty"`
+	// WebhookSecrets are the regenerated secrets by subscription ID, for
+	// updating the receivers
+	WebhookSecrets map[int]string `json:"webhook_secrets,omitempty"`
+	StartedAt      time.Time      `json:"started_at"`
+	FinishedAt     *time.Time     `json:"finished_at,omitempty"`
+}
+
+// CredentialRotator re-encrypts every stored credential with the primary
+// credential key, one rotation at a time
+type CredentialRotator struct {
+	db     DatabaseInterface
+	keyID  string
+	errors *ErrorTracker
+
+	mu   sync.Mutex
+	last *CredentialRotation
+}
+
+// NewCredentialRotator creates a rotator sealing with the keyring's primary
+// key, which the database must be configured with too
+func NewCredentialRotator(db DatabaseInterface, keyring *CredentialKeyring, errors *ErrorTracker) *CredentialRotator {
+	return &CredentialRotator{db: db, keyID: keyring.PrimaryKey(), errors: errors}
+}
+
+// Start begins a rotation in the background. With regenerateWebhookSecrets,
+// every webhook subscription with a secret is given a new random one.
+func (cr *CredentialRotator) Start(regenerateWebhookSecrets bool) (*CredentialRotation, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	if cr.last != nil && cr.last.Status == "running" {
+		return nil, errRotationRunning
+	}
+
+	id := 1
+	if cr.last != nil {
+		id = cr.last.ID + 1
+	}
+	cr.last = &CredentialRotation{
+		ID:                       id,
+		Status:                   "running",
+		KeyID:                    cr.keyID,
+		RegenerateWebhookSecrets: regenerateWebhookSecrets,
+		StartedAt:                time.Now().UTC(),
+	}
+	rotation := cr.last
+	go cr.run(rotation)
+	return cr.snapshot(rotation), nil
+}
+
+// Last returns the progress of the current or most recent rotation, or nil
+func (cr *CredentialRotator) Last() *CredentialRotation {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	if cr.last == nil {
+		return nil
+	}
+	return cr.snapshot(cr.last)
+}
+
+// snapshot copies a rotation so it can be encoded without holding mu
+func (cr *CredentialRotator) snapshot(rotation *CredentialRotation) *CredentialRotation {
+	copied := *rotation
+	copied.Errors = append([]string(nil), rotation.Errors...)
+	if rotation.WebhookSecrets != nil {
+		copied.WebhookSecrets = make(map[int]string, len(rotation.WebhookSecrets))
+		for id, secret := range rotation.WebhookSecrets {
+			copied.WebhookSecrets[id] = secret
+		}
+	}
+	return &copied
+}
+
+// run rewrites every webhook subscription and project secret, which opens
+// the credential with whichever key sealed it and seals it again with the
+// primary key
+func (cr *CredentialRotator) run(rotation *CredentialRotation) {
+	subscriptions, err := cr.db.ListWebhookSubscriptions()
+	if err != nil {
+		cr.errors.Capture("credentials", fmt.Errorf("listing webhook subscriptions: %w", err), nil)
+		cr.finish(rotation, "failed", err)
+		return
+	}
+	secrets, err := cr.db.ListProjectSecrets(0)
+	if err != nil {
+		cr.errors.Capture("credentials", fmt.Errorf("listing project secrets: %w", err), nil)
+		cr.finish(rotation, "failed", err)
+		return
+	}
+
+	cr.mu.Lock()
+	rotation.Total = len(subscriptions) + len(secrets)
+	cr.mu.Unlock()
+
+	for _, subscription := range subscriptions {
+		var secret string
+		if rotation.RegenerateWebhookSecrets && subscription.Secret != "" {
+			if secret, err = newWebhookSecret(); err != nil {
+				cr.fail(rotation, fmt.Sprintf("webhook subscription %d", subscription.ID), err)
+				continue
+			}
+			subscription.Secret = secret
+			subscription.UpdatedAt = time.Now().UTC()
+		}
+
+		if err := cr.db.UpdateWebhookSubscription(subscription); err != nil {
+			cr.fail(rotation, fmt.Sprintf("webhook subscription %d", subscription.ID), err)
+			continue
+		}
+
+		cr.mu.Lock()
+		rotation.Rotated++
+		if secret != "" {
+			if rotation.WebhookSecrets == nil {
+				rotation.WebhookSecrets = make(map[int]string)
+			}
+			rotation.WebhookSecrets[subscription.ID] = secret
+		}
+		cr.mu.Unlock()
+	}
+
+	for _, secret := range secrets {
+		if err := cr.db.ResealProjectSecret(secret); err != nil {
+			cr.fail(rotation, fmt.Sprintf("project %d secret %s", secret.ProjectID, secret.Name), err)
+			continue
+		}
+		cr.mu.Lock()
+		rotation.Rotated++
+		cr.mu.Unlock()
+	}
+
+	status := "completed"
+	if rotation.Failed > 0 {
+		status = "failed"
+	}
+	cr.finish(rotation, status, nil)
+}
+
+// fail records a credential that could not be rotated
+func (cr *CredentialRotator) fail(rotation *CredentialRotation, credential string, err error) {
+	err = fmt.Errorf("%s: %w", credential, err)
+	cr.errors.Capture("credentials", err, nil)
+
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	rotation.Failed++
+	rotation.Errors = append(rotation.Errors, err.Error())
+}
+
+func (cr *CredentialRotator) finish(rotation *CredentialRotation, status string, err error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	now := time.Now().UTC()
+	rotation.Status = status
+	rotation.FinishedAt = &now
+	if err != nil {
+		rotation.Errors = append(rotation.Errors, err.Error())
+	}
+	log.Printf("Credential rotation %d %s: %d of %d credentials rotated to key %q", rotation.ID, status, rotation.Rotated, rotation.Total, rotation.KeyID)
+}
+
+// newWebhookSecret generates a random webhook signing secret
+func newWebhookSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, secret); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(secret), nil
+}
+
+// CredentialRotationRequest are the options of a credential rotation
+type CredentialRotationRequest struct {
+	RegenerateWebhookSecrets bool `json:"regenerate_webhook_secrets"`
+}
+
+// Rotate credentials endpoint
+func (bs *BuildService) rotateCredentialsHandler(w http.ResponseWriter, r *http.Request) {
+	var req CredentialRotationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	rotation, err := bs.credentials.Start(req.RegenerateWebhookSecrets)
+	if err == errRotationRunning {
+		http.Error(w, "A credential rotation is already running", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Error starting credential rotation: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(rotation)
+}
+
+// Credential rotation progress endpoint
+func (bs *BuildService) credentialRotationHandler(w http.ResponseWriter, r *http.Request) {
+	rotation := bs.credentials.Last()
+	if rotation == nil {
+		http.Error(w, "No credential rotation has run", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rotation)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func testCredentialKey(b byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+}
+
+func TestCredentialKeyring(t *testing.T) {
+	old, err := NewCredentialKeyring("old:" + testCredentialKey(1))
+	require.NoError(t, err)
+
+	sealed, err := old.Seal("s3cret")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(sealed, "enc:v1:old:"))
+	assert.NotContains(t, sealed, "s3cret")
+
+	opened, err := old.Open(sealed)
+	require.NoError(t, err)
+	assert.Equal(t, "s3cret", opened)
+
+	// Values stored before encryption was enabled open as they are
+	opened, err = old.Open("plain")
+	require.NoError(t, err)
+	assert.Equal(t, "plain", opened)
+
+	empty, err := old.Seal("")
+	require.NoError(t, err)
+	assert.Equal(t, "", empty)
+
+	// A new primary key still opens values sealed with the old one
+	rotated, err := NewCredentialKeyring("new:" + testCredentialKey(2) + ", old:" + testCredentialKey(1))
+	require.NoError(t, err)
+	assert.Equal(t, "new", rotated.PrimaryKey())
+	opened, err = rotated.Open(sealed)
+	require.NoError(t, err)
+	assert.Equal(t, "s3cret", opened)
+	resealed, err := rotated.Seal(opened)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(resealed, "enc:v1:new:"))
+
+	// Once the old key is dropped, its values can no longer be opened
+	current, err := NewCredentialKeyring("new:" + testCredentialKey(2))
+	require.NoError(t, err)
+	_, err = current.Open(sealed)
+	assert.Error(t, err)
+	_, err = current.Open(strings.Replace(resealed, "enc:v1:new:", "enc:v1:new:AAAA", 1))
+	assert.Error(t, err)
+
+	var unconfigured *CredentialKeyring
+	plain, err := unconfigured.Seal("s3cret")
+	require.NoError(t, err)
+	assert.Equal(t, "s3cret", plain)
+	_, err = unconfigured.Open(sealed)
+	assert.Error(t, err)
+
+	for _, spec := range []string{"nokey", "short:" + base64.StdEncoding.EncodeToString([]byte("abc")), "a:" + testCredentialKey(1) + ",a:" + testCredentialKey(2)} {
+		_, err := NewCredentialKeyring(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestCredentialKeyringFromEnvFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	require.NoError(t, os.WriteFile(path, []byte("kms1:"+testCredentialKey(7)+"\n"), 0o600))
+	t.Setenv("CREDENTIAL_KEYS", "")
+	t.Setenv("CREDENTIAL_KEYS_FILE", path)
+
+	keyring, err := NewCredentialKeyringFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, "kms1", keyring.PrimaryKey())
+
+	t.Setenv("CREDENTIAL_KEYS", "env:"+testCredentialKey(8))
+	keyring, err = NewCredentialKeyringFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, "env", keyring.PrimaryKey(), "CREDENTIAL_KEYS takes precedence")
+
+	t.Setenv("CREDENTIAL_KEYS", "")
+	t.Setenv("CREDENTIAL_KEYS_FILE", filepath.Join(t.TempDir(), "missing"))
+	_, err = NewCredentialKeyringFromEnv()
+	assert.Error(t, err)
+}
+
+func TestCredentialRotator(t *testing.T) {
+	mockDB := new(MockDatabase)
+	mockDB.On("ListWebhookSubscriptions").Return([]*WebhookSubscription{
+		{ID: 1, URL: "https://example.com/a", Secret: "old-secret"},
+		{ID: 2, URL: "https://example.com/b"},
+		{ID: 3, URL: "https://example.com/c", Secret: "other"},
+	}, nil).Once()
+	mockDB.On("UpdateWebhookSubscription", mock.MatchedBy(func(s *WebhookSubscription) bool { return s.ID == 1 })).Return(nil).Once()
+	mockDB.On("UpdateWebhookSubscription", mock.MatchedBy(func(s *WebhookSubscription) bool { return s.ID == 2 && s.Secret == "" })).Return(nil).Once()
+	mockDB.On("UpdateWebhookSubscription", mock.MatchedBy(func(s *WebhookSubscription) bool { return s.ID == 3 })).Return(fmt.Errorf("connection reset")).Once()
+	deployKey := &ProjectSecret{ID: 9, ProjectID: 4, Name: "DEPLOY_KEY", Value: "hunter2", Version: 3}
+	mockDB.On("ListProjectSecrets", 0).Return([]*ProjectSecret{deployKey}, nil).Once()
+	mockDB.On("ResealProjectSecret", deployKey).Return(nil).Once()
+
+	keyring, err := NewCredentialKeyring("k2:" + testCredentialKey(2))
+	require.NoError(t, err)
+	errors := NewErrorTracker(&LogErrorReporter{}, prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_errors_total"}, []string{"subsystem"}))
+	rotator := NewCredentialRotator(mockDB, keyring, errors)
+
+	rotation, err := rotator.Start(true)
+	require.NoError(t, err)
+	assert.Equal(t, 1, rotation.ID)
+	assert.Equal(t, "k2", rotation.KeyID)
+
+	require.Eventually(t, func() bool { return rotator.Last().Status != "running" }, time.Second, 5*time.Millisecond)
+	rotation = rotator.Last()
+	assert.Equal(t, "failed", rotation.Status)
+	assert.Equal(t, 4, rotation.Total)
+	assert.Equal(t, 3, rotation.Rotated)
+	assert.Equal(t, 1, rotation.Failed)
+	assert.Equal(t, []string{"webhook subscription 3: connection reset"}, rotation.Errors)
+	require.Len(t, rotation.WebhookSecrets, 1)
+	assert.Len(t, rotation.WebhookSecrets[1], 64)
+	assert.NotNil(t, rotation.FinishedAt)
+	mockDB.AssertExpectations(t)
+}
+
+func TestCredentialRotationHandlers(t *testing.T) {
+	service, _ := setupTestService()
+	mockDB := new(MockDatabase)
+	release := make(chan time.Time)
+	mockDB.On("ListWebhookSubscriptions").Return([]*WebhookSubscription{}, nil).WaitUntil(release).Once()
+	mockDB.On("ListProjectSecrets", 0).Return([]*ProjectSecret{}, nil).Once()
+	service.credentials = NewCredentialRotator(mockDB, nil, service.errors)
+
+	rr := httptest.NewRecorder()
+	service.credentialRotationHandler(rr, httptest.NewRequest("GET", "/api/v1/admin/credentials/rotation", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	rr = httptest.NewRecorder()
+	service.rotateCredentialsHandler(rr, httptest.NewRequest("POST", "/api/v1/admin/credentials/rotate", nil))
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+	var rotation CredentialRotation
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &rotation))
+	assert.Equal(t, "running", rotation.Status)
+	assert.False(t, rotation.RegenerateWebhookSecrets)
+
+	rr = httptest.NewRecorder()
+	service.rotateCredentialsHandler(rr, httptest.NewRequest("POST", "/api/v1/admin/credentials/rotate", bytes.NewBufferString(`{"regenerate_webhook_secrets": true}`)))
+	assert.Equal(t, http.StatusConflict, rr.Code)
+
+	rr = httptest.NewRecorder()
+	service.rotateCredentialsHandler(rr, httptest.NewRequest("POST", "/api/v1/admin/credentials/rotate", bytes.NewBufferString(`{`)))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	close(release)
+	require.Eventually(t, func() bool { return service.credentials.Last().Status == "completed" }, time.Second, 5*time.Millisecond)
+
+	rr = httptest.NewRecorder()
+	service.credentialRotationHandler(rr, httptest.NewRequest("GET", "/api/v1/admin/credentials/rotation", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"status":"completed"`)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	// Schedules name IANA time zones, which the alpine image has no database for
+	_ "time/tzdata"
+)
+
+// cronSchedule is a parsed five-field cron expression (minute, hour, day of
+// month, month, day of week), each field held as a bitset of allowed values
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// domStar and dowStar record an unrestricted day field: when both day
+	// fields are restricted, a day matching either one runs, as in cron(8)
+	domStar, dowStar bool
+}
+
+// cronMacros are the shorthand expressions accepted in place of five fields
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var cronMonthNames = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+var cronDayNames = map[string]int{
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+// parseCron parses a cron expression such as "0 2 * * 1-5" or "@daily"
+func parseCron(expr string) (*cronSchedule, error) {
+	expr = strings.TrimSpace(expr)
+	if macro, ok := cronMacros[strings.ToLower(expr)]; ok {
+		expr = macro
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression must have 5 fields, got %d", len(fields))
+	}
+
+	cs := &cronSchedule{
+		domStar: fields[2] == "*" || fields[2] == "?",
+		dowStar: fields[4] == "*" || fields[4] == "?",
+	}
+	var err error
+	if cs.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("minute: %w", err)
+	}
+	if cs.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("hour: %w", err)
+	}
+	if cs.dom, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("day of month: %w", err)
+	}
+	if cs.month, err = parseCronField(fields[3], 1, 12, cronMonthNames); err != nil {
+		return nil, fmt.Errorf("month: %w", err)
+	}
+	// 7 is accepted for Sunday alongside 0
+	if cs.dow, err = parseCronField(fields[4], 0, 7, cronDayNames); err != nil {
+		return nil, fmt.Errorf("day of week: %w", err)
+	}
+	if cs.dow&(1<<7) != 0 {
+		cs.dow = cs.dow&^(1<<7) | 1
+	}
+	return cs, nil
+}
+
+// parseCronField parses a comma-separated list of values, ranges and steps
+// (e.g. "*/15", "1-5", "mon,wed,fri") into a bitset
+func parseCronField(field string, min, max int, names map[string]int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepPart)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step %q", stepPart)
+			}
+			step = n
+		}
+
+		lo, hi := min, max
+		switch {
+		case rangePart == "*" || rangePart == "?":
+		default:
+			from, to, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if lo, err = cronValue(from, names); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if isRange {
+				if hi, err = cronValue(to, names); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				// "5/15" means every 15 starting at 5
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func cronValue(s string, names map[string]int) (int, error) {
+	if v, ok := names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", s)
+	}
+	return v, nil
+}
+
+func (cs *cronSchedule) dayMatches(t time.Time) bool {
+	dom := cs.dom&(1<<uint(t.Day())) != 0
+	dow := cs.dow&(1<<uint(t.Weekday())) != 0
+	switch {
+	case cs.domStar && cs.dowStar:
+		return true
+	case cs.domStar:
+		return dow
+	case cs.dowStar:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+// Next returns the first time after t the schedule fires, in t's location,
+// or the zero time when it never does (e.g. "0 0 30 2 *")
+func (cs *cronSchedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Add(time.Minute - time.Duration(t.Second())*time.Second - time.Duration(t.Nanosecond()))
+	limit := t.Year() + 5
+
+	// Each field is advanced in turn, starting over when a wrap-around
+	// changes a field that was already matched
+wrap:
+	for t.Year() <= limit {
+		for cs.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			if t.Year() > limit {
+				break wrap
+			}
+		}
+		for !cs.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			if t.Day() == 1 {
+				continue wrap
+			}
+		}
+		for cs.hour&(1<<uint(t.Hour())) == 0 {
+			// Adding the time to the next hour steps over DST gaps
+			t = t.Add(time.Duration(60-t.Minute()) * time.Minute)
+			if t.Hour() == 0 {
+				continue wrap
+			}
+		}
+		for cs.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			if t.Minute() == 0 {
+				continue wrap
+			}
+		}
+		return t
+	}
+	return time.Time{}
+}
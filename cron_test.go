@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCronNext(t *testing.T) {
+	utc := func(s string) time.Time {
+		parsed, err := time.Parse(time.RFC3339, s)
+		require.NoError(t, err)
+		return parsed
+	}
+
+	tests := []struct {
+		expr  string
+		after string
+		want  string
+	}{
+		{"0 2 * * *", "2030-01-02T01:59:30Z", "2030-01-02T02:00:00Z"},
+		{"0 2 * * *", "2030-01-02T02:00:00Z", "2030-01-03T02:00:00Z"},
+		{"*/15 * * * *", "2030-01-02T10:07:00Z", "2030-01-02T10:15:00Z"},
+		{"0 9 * * mon-fri", "2030-01-04T12:00:00Z", "2030-01-07T09:00:00Z"},
+		{"30 23 31 * *", "2030-02-01T00:00:00Z", "2030-03-31T23:30:00Z"},
+		{"0 0 29 2 *", "2030-03-01T00:00:00Z", "2032-02-29T00:00:00Z"},
+		{"@hourly", "2030-12-31T23:30:00Z", "2031-01-01T00:00:00Z"},
+		{"0 0 * * 7", "2030-01-01T00:00:00Z", "2030-01-06T00:00:00Z"},
+		// Both day fields restricted: either matches
+		{"0 0 15 * fri", "2030-01-01T00:00:00Z", "2030-01-04T00:00:00Z"},
+		{"5/20 * * * *", "2030-01-01T00:26:00Z", "2030-01-01T00:45:00Z"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			cron, err := parseCron(tt.expr)
+			require.NoError(t, err)
+			assert.Equal(t, utc(tt.want), cron.Next(utc(tt.after)))
+		})
+	}
+}
+
+func TestCronNextInTimezone(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	require.NoError(t, err)
+	cron, err := parseCron("30 2 * * *")
+	require.NoError(t, err)
+
+	// 02:30 doesn't exist on the day clocks go forward
+	next := cron.Next(time.Date(2030, 3, 30, 12, 0, 0, 0, berlin))
+	assert.Equal(t, time.Date(2030, 4, 1, 2, 30, 0, 0, berlin), next)
+
+	next = cron.Next(time.Date(2030, 1, 10, 12, 0, 0, 0, berlin))
+	assert.Equal(t, "2030-01-11T01:30:00Z", next.UTC().Format(time.RFC3339))
+}
+
+func TestCronNeverFires(t *testing.T) {
+	cron, err := parseCron("0 0 30 2 *")
+	require.NoError(t, err)
+	assert.True(t, cron.Next(time.Now()).IsZero())
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"* * * foo *",
+		"@every 5m",
+	} {
+		_, err := parseCron(expr)
+		assert.Error(t, err, expr)
+	}
+}
@@ -1,19 +1,189 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 // DatabaseInterface defines the database operations
 type DatabaseInterface interface {
 	CreateBuild(build *BuildRequest) (int, error)
 	GetBuild(id int) (*BuildRequest, error)
-	ListBuilds() ([]*BuildRequest, error)
+	GetBuildByIdempotencyKey(org, key string) (*BuildRequest, error)
+	CreateBuildUnlessActive(build *BuildRequest) (int, *BuildRequest, error)
+	CreateBuilds(builds []*BuildRequest) ([]int, error)
+	GetLatestFinishedBuild(projectName, branch string) (*BuildRequest, error)
+	GetPreviousFinishedBuild(projectName, branch string, beforeID int) (*BuildRequest, error)
+	GetTagBuild(projectName, tag string) (*BuildRequest, error)
+	StartDraftBuild(id int) (*BuildRequest, error)
+	StartDueDraftBuilds() ([]*BuildRequest, error)
+	ListBuildFamily(id int) ([]*BuildRequest, error)
+	ListBuilds(includeDeleted bool, org string, labels Labels) ([]*BuildRequest, error)
+	ListRecentBuilds(projectName, status, org string, limit int) ([]*BuildRequest, error)
+	DeleteBuild(id int) (*BuildRequest, error)
+	ArchiveBuilds(before time.Time, limit int) (int64, error)
 	UpdateBuildStatus(id int, status string) error
+	UpdateBuildResult(id int, status string, exitCode int) error
+	CancelBuild(id int, reason, actor string) (*BuildRequest, error)
+	ListDownstreamBuilds(id int) ([]*BuildRequest, error)
+	BlockDownstreamBuilds(id int) ([]*BuildRequest, error)
+	SetBuildCancellation(id int, reason, actor string) error
+	SetBuildFailureCategory(id int, category string) error
+	SetBuildLogTruncation(id int, reason string) error
+	CountAutoRetries(id int) (int, error)
+	CountFailureCategories(projectName string, since time.Time) (map[string]int, error)
+	GetProjectStats(since time.Time, org string) ([]*ProjectStats, error)
+	GetDurationStats(since time.Time, interval, projectName, org string) ([]*DurationStats, error)
+	GetDailyBuildCounts(since time.Time, projectName, org string) ([]*DailyBuildCount, error)
+	GetFlakyProjects(since time.Time, org string, limit int) ([]*FlakyProject, error)
+	UpdateBuildVersion(id int, version string) error
+	ClaimNextBuild(workerID string, lease time.Duration, fairShare int) (*BuildRequest, error)
+	ReleaseBuild(id int) error
+	RenewBuildLease(id int, workerID string, lease time.Duration) (bool, error)
+	RequeueExpiredBuilds() (int64, error)
+	ExpireQueuedBuilds(maxAge time.Duration) ([]*BuildRequest, error)
+	CreateProject(project *Project) (int, error)
+	GetProject(id int) (*Project, error)
+	GetProjectByRepository(repoKey string) (*Project, error)
+	UpdateProject(project *Project) error
+	SetProjectPaused(id int, paused bool, reason string) (*Project, error)
+	GetQueueStats(since time.Time) (*QueueStats, error)
+	CreateIncident(incident *Incident) error
+	GetIncident(id int) (*Incident, error)
+	UpdateIncident(incident *Incident) error
+	ListIncidents(includeResolved bool) ([]*Incident, error)
+	GetProjectByName(name string) (*Project, error)
+	CreateSlackThread(thread *SlackThread) error
+	GetSlackThread(buildID int) (*SlackThread, error)
+	AddBuildIssues(buildID int, keys []string) error
+	ListBuildIssues(buildID int) ([]string, error)
+	ListBuildsByIssue(key, org string) ([]*BuildRequest, error)
+	ListBuildsByCommit(sha string, includeDeleted bool, org string, labels Labels) ([]*BuildRequest, error)
+	UpdateBuildCommit(id int, commit *CommitInfo) error
+	UpdateBuild(id int, update *BuildUpdate, updatedAt time.Time) (*BuildRequest, error)
+	ListProjectBuildsBetween(projectName string, afterID, throughID int) ([]*BuildRequest, error)
+	CreateArtifact(artifact *Artifact) (int, error)
+	GetArtifact(buildID int, name string) (*Artifact, error)
+	ListArtifacts(buildID int) ([]*Artifact, error)
+	ListStepArtifacts(buildID, step int) ([]*Artifact, error)
+	ListArtifactsCreatedBefore(cutoff time.Time, limit int) ([]*Artifact, error)
+	ListAllArtifacts() ([]*Artifact, error)
+	DeleteArtifact(id int) error
+	GetIntegration(name string) (*IntegrationState, error)
+	ListIntegrations() ([]*IntegrationState, error)
+	RecordIntegrationFailure(name, lastError string, threshold int) (*IntegrationState, error)
+	ResetIntegrationFailures(name string) error
+	EnableIntegration(name string) error
+	CreateOutboxEvent(event *OutboxEvent) error
+	ClaimOutboxEvents(limit int, lease time.Duration) ([]*OutboxEvent, error)
+	MarkOutboxEventDelivered(id int64) error
+	RetryOutboxEvent(id int64, lastError string, nextAttemptAt time.Time) error
+	DeferOutboxEvent(id int64, nextAttemptAt time.Time) error
+	FailOutboxEvent(id int64, lastError string) error
+	OutboxBacklog() ([]*OutboxBacklog, error)
+	DeleteDeliveredOutboxEvents(before time.Time) (int64, error)
+	ProjectQueueWaits() ([]*ProjectQueueWait, error)
+	ListUserQueueUsage(org string, fairShare int) ([]*UserQueueUsage, error)
+	GetQueueState(id int, fairShare int) (*QueueState, error)
+	GetQueueDepth() (*QueueDepth, error)
+	GetQueueControl() (*QueueControl, error)
+	SetQueuePaused(paused bool, reason string) (*QueueControl, error)
+	RegisterWorker(worker *Worker) error
+	ListWorkers(since time.Time) ([]*Worker, error)
+	SetWorkerDraining(id string, draining bool) (*Worker, error)
+	ListInFlightBuilds() ([]*InFlightBuild, error)
+	ListFairShareLimits() ([]*FairShareLimit, error)
+	SetFairShareLimit(limit *FairShareLimit) error
+	DeleteFairShareLimit(org string) error
+	ListImagePolicies() ([]*ImagePolicy, error)
+	GetImagePolicy(org string) (*ImagePolicy, error)
+	SetImagePolicy(policy *ImagePolicy) error
+	DeleteImagePolicy(org string) error
+	EraseUserData(erasure *UserErasure, pseudonym string) (*DataErasure, error)
+	ListDataErasures() ([]*DataErasure, error)
+	CreateNotificationDigest(digest *NotificationDigest) error
+	ListNotificationDigests() ([]*NotificationDigest, error)
+	DeleteNotificationDigest(id int) error
+	ClaimDueNotificationDigests(now time.Time) ([]*NotificationDigest, error)
+	ListBuildsFinishedBetween(since, until time.Time, projects, statuses []string, limit int) ([]*BuildRequest, error)
+	CreateDeployment(deployment *Deployment) error
+	GetDeployment(id int) (*Deployment, error)
+	UpdateDeploymentStatus(id int, from, to string) (*Deployment, error)
+	ListDeployments(projectName, environment, org string) ([]*Deployment, error)
+	CreateWebhookSubscription(subscription *WebhookSubscription) error
+	GetWebhookSubscription(id int) (*WebhookSubscription, error)
+	UpdateWebhookSubscription(subscription *WebhookSubscription) error
+	DeleteWebhookSubscription(id int) error
+	ListWebhookSubscriptions() ([]*WebhookSubscription, error)
+	CreateWebhookDelivery(delivery *WebhookDelivery) error
+	GetWebhookDelivery(id int) (*WebhookDelivery, error)
+	UpdateWebhookDelivery(delivery *WebhookDelivery) error
+	ListWebhookDeliveries(subscriptionID int, status string, limit int) ([]*WebhookDelivery, error)
+	ClaimWebhookDeliveries(limit int, lease time.Duration) ([]*WebhookDelivery, error)
+	DeleteWebhookDeliveriesBefore(cutoff time.Time) (int64, error)
+	CreateBuildSchedule(schedule *BuildSchedule) error
+	GetBuildSchedule(id int) (*BuildSchedule, error)
+	ListBuildSchedules(projectID int) ([]*BuildSchedule, error)
+	UpdateBuildSchedule(schedule *BuildSchedule) error
+	DeleteBuildSchedule(id int) error
+	ListDueBuildSchedules(now time.Time) ([]*BuildSchedule, error)
+	DisableBuildSchedules(ids []int) (int64, error)
+	ListStaleBranches(project *Project, before time.Time, activity []string) ([]*StaleBranch, error)
+	RecordBuildScheduleRun(id int, ranAt time.Time, buildID *int, next *time.Time) error
+	TryAdvisoryLock(key int64) (AdvisoryLock, error)
+	SaveBuildConfig(buildID int, config ConfigSnapshot) error
+	GetBuildConfig(buildID int) (ConfigSnapshot, error)
+	SaveBuildStages(buildID int, stages []*BuildStage) error
+	ListBuildStages(buildID int) ([]*BuildStage, error)
+	SaveBuildProblems(buildID int, problems []*BuildProblem) error
+	ListBuildProblems(buildID int) ([]*BuildProblem, error)
+	RecordAPIUsage(records []*APIUsage) error
+	GetUsageReport(since time.Time, org string) (*UsageReport, error)
+	DeleteAPIUsageBefore(before time.Time) (int64, error)
+	ListProjects(org string, labels Labels) ([]*Project, error)
+	CreateOrganization(org *Organization) error
+	GetOrganization(name string) (*Organization, error)
+	UpdateOrganization(org *Organization) error
+	ListOrganizations() ([]*Organization, error)
+	CreateAPIKey(key *APIKey, hash string) error
+	GetAPIKeyByHash(hash string) (*APIKey, error)
+	ListAPIKeys(org string) ([]*APIKey, error)
+	RevokeAPIKey(id int) (*APIKey, error)
+	TouchAPIKey(id int) error
+	CreateAuditEntry(entry *AuditEntry) error
+	ListAuditEntries(filter AuditFilter) ([]*AuditEntry, error)
+	ListProjectSecrets(projectID int) ([]*ProjectSecret, error)
+	SetProjectSecret(secret *ProjectSecret) error
+	ResealProjectSecret(secret *ProjectSecret) error
+	DeleteProjectSecret(projectID int, name string) error
+	SaveQualityGate(gate *QualityGate) error
+	ListQualityGates(projectName, commitSHA string) ([]*QualityGate, error)
+	ListProjectDependencies(org string) ([]*ProjectDependency, error)
+	SetDownstreamProjects(projectID int, downstreamIDs []int) error
+	ListDownstreamProjects(projectID int) ([]*Project, error)
+	ListTriggeringBuilds(id int) ([]*BuildRequest, error)
+	ListTriggeredBuilds(id int) ([]*BuildRequest, error)
+	CreateEscalation(escalation *Escalation) error
+	ListOpenEscalations(dedupKey string) ([]*Escalation, error)
+	UpdateEscalationStatus(id int, status string) error
+	ListBuildEscalations(buildID int) ([]*Escalation, error)
+	RecordBuildUsage(id int, usage *ResourceUsage) error
+	ListBuildUsage(projectName string, limit int) ([]*BuildUsage, error)
+	RecordBuildDuration(projectName, branch string, seconds float64, window int) error
+	GetBuildDurations(projectName, branch string) ([]float64, error)
+	ListMatrixBuilds(parentID int) ([]*BuildRequest, error)
+	DetachMatrixBuild(id int) error
+	FinishMatrixBuild(id int, status string, exitCode int) (bool, error)
 	Ping() error
 	Close() error
 	InitTables() error
@@ -21,7 +191,9 @@ type DatabaseInterface interface {
 
 // PostgreSQLDatabase implements DatabaseInterface
 type PostgreSQLDatabase struct {
-	db *sql.DB
+	db *timedDB
+	// credentials encrypts stored secrets, nil when CREDENTIAL_KEYS is unset
+	credentials *CredentialKeyring
 }
 
 // NewPostgreSQLDatabase creates a new PostgreSQL database connection
@@ -47,72 +219,370 @@ func NewPostgreSQLDatabase() (*PostgreSQLDatabase, error) {
 		return nil, fmt.Errorf("failed to ping database: %w", err)
 	}
 
-	return &PostgreSQLDatabase{db: db}, nil
+	credentials, err := NewCredentialKeyringFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("invalid CREDENTIAL_KEYS: %w", err)
+	}
+
+	return &PostgreSQLDatabase{db: &timedDB{DB: db}, credentials: credentials}, nil
 }
 
-// InitTables creates the necessary database tables
+// InitTables brings the schema up to date by applying pending migrations
 func (pg *PostgreSQLDatabase) InitTables() error {
-	query := `
-	CREATE TABLE IF NOT EXISTS builds (
-		id SERIAL PRIMARY KEY,
-		project_name VARCHAR(255) NOT NULL,
-		git_url VARCHAR(500) NOT NULL,
-		branch VARCHAR(100) NOT NULL DEFAULT 'main',
-		status VARCHAR(50) NOT NULL DEFAULT 'queued',
-		created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
-		updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
-	);
-
-	CREATE INDEX IF NOT EXISTS idx_builds_status ON builds(status);
-	CREATE INDEX IF NOT EXISTS idx_builds_project ON builds(project_name);
-	CREATE INDEX IF NOT EXISTS idx_builds_created_at ON builds(created_at);
-	`
+	migrator, err := NewMigrator(pg.db.DB)
+	if err != nil {
+		return err
+	}
 
-	_, err := pg.db.Exec(query)
+	applied, err := migrator.Up()
+	for _, migration := range applied {
+		log.Printf("Applied migration %04d %s", migration.Version, migration.Name)
+	}
 	return err
 }
 
 // CreateBuild creates a new build record
 func (pg *PostgreSQLDatabase) CreateBuild(build *BuildRequest) (int, error) {
+	return insertBuild(pg.db, build)
+}
+
+// rowQuerier is satisfied by both *sql.DB and *sql.Tx
+type rowQuerier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// insertBuild inserts a build record, returning its ID. The build's labels
+// are merged over its project's.
+func insertBuild(q rowQuerier, build *BuildRequest) (int, error) {
 	query := `
-	INSERT INTO builds (project_name, git_url, branch, status, created_at, updated_at)
-	VALUES ($1, $2, $3, $4, $5, $6)
-	RETURNING id
+	INSERT INTO builds (project_name, git_url, branch, commit_sha, tag, version, auto_version, triggered_by, status, retried_from, created_at, updated_at, idempotency_key, trace_parent, org, start_at, depends_on, schedule_id, commit_message, commit_author, trigger_source, upstream_build_id, pull_request, pull_request_fork, parent_build_id, matrix, skip_reason, debug_logging, labels)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, NULLIF($13, ''), $14, $15, $16, $17, $18, $19, $20, COALESCE(NULLIF($21, ''), 'manual'), $22, NULLIF($23, 0), $24, $25, $26, $27, $28,
+		COALESCE((SELECT labels FROM projects WHERE name = $1), '{}') || $29)
+	RETURNING id, labels
 	`
 
 	var id int
-	err := pg.db.QueryRow(
+	var labels []byte
+	err := q.QueryRow(
 		query,
 		build.ProjectName,
 		build.GitURL,
 		build.Branch,
+		build.CommitSHA,
+		build.Tag,
+		build.Version,
+		build.AutoVersion,
+		build.TriggeredBy,
 		build.Status,
+		build.RetriedFrom,
 		build.CreatedAt,
 		build.UpdatedAt,
-	).Scan(&id)
+		build.IdempotencyKey,
+		build.TraceParent,
+		build.Org,
+		build.StartAt,
+		pq.Array(int64s(build.DependsOn)),
+		build.ScheduleID,
+		build.CommitMessage,
+		build.CommitAuthor,
+		build.TriggerSource,
+		build.UpstreamBuildID,
+		build.PullRequest,
+		build.PullRequestFork,
+		build.ParentBuildID,
+		matrixValues(build.Matrix),
+		build.SkipReason,
+		build.DebugLogging,
+		build.Labels.jsonb(),
+	).Scan(&id, &labels)
+	if err == nil {
+		err = json.Unmarshal(labels, &build.Labels)
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return 0, fmt.Errorf("build already exists")
+	}
 
 	return id, err
 }
 
-// GetBuild retrieves a build by ID
-func (pg *PostgreSQLDatabase) GetBuild(id int) (*BuildRequest, error) {
+// CreateBuildUnlessActive creates a build unless a build of the same project,
+// branch, tag and commit is queued or running, in which case it returns that
+// build instead. Without a commit, any active build of the branch or tag
+// matches. Requests for the same project, branch and tag are serialized with
+// an advisory lock, so concurrent requests create at most one build.
+func (pg *PostgreSQLDatabase) CreateBuildUnlessActive(build *BuildRequest) (int, *BuildRequest, error) {
+	tx, err := pg.db.Begin()
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+
+	// Git ref names can't contain colons
+	lockKey := build.ProjectName + ":" + build.Branch + ":" + build.Tag
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext('builds'), hashtext($1))`, lockKey); err != nil {
+		return 0, nil, err
+	}
+
 	query := `
-	SELECT id, project_name, git_url, branch, status, created_at, updated_at
+	SELECT ` + buildColumns + `
 	FROM builds
-	WHERE id = $1
-	`
+	WHERE project_name = $1 AND branch = $2 AND tag = $3 AND ($4 = '' OR commit_sha = $4)
+	AND status IN ('queued', 'running') AND parent_build_id IS NULL AND deleted_at IS NULL
+	ORDER BY id DESC
+	LIMIT 1`
+	active, err := scanBuild(tx.QueryRow(query, build.ProjectName, build.Branch, build.Tag, build.CommitSHA))
+	if err == nil {
+		return 0, active, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, nil, err
+	}
+
+	id, err := insertBuild(tx, build)
+	if err != nil {
+		return 0, nil, err
+	}
+	return id, nil, tx.Commit()
+}
+
+// CreateBuilds creates several build records in a single transaction,
+// returning their IDs in order. Either all of them are created or none.
+func (pg *PostgreSQLDatabase) CreateBuilds(builds []*BuildRequest) ([]int, error) {
+	tx, err := pg.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	ids := make([]int, 0, len(builds))
+	for _, build := range builds {
+		id, err := insertBuild(tx, build)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, tx.Commit()
+}
+
+// buildColumns lists the builds table columns in the order scanBuild expects
+const buildColumns = `id, project_name, git_url, branch, commit_sha, tag, version, auto_version, triggered_by, status, exit_code, retried_from, started_at, created_at, updated_at, trace_parent, org, start_at, cancel_reason, cancelled_by, depends_on, schedule_id, commit_message, commit_author, trigger_source, description, deleted_at, failure_category, upstream_build_id, pull_request, pull_request_fork, parent_build_id, matrix, skip_reason, log_truncation, debug_logging, labels`
+
+// matrixValues encodes the matrix values of a build for its JSONB column,
+// NULL for builds that aren't part of a matrix
+func matrixValues(values map[string]string) interface{} {
+	if len(values) == 0 {
+		return nil
+	}
+	encoded, _ := json.Marshal(values)
+	return encoded
+}
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
 
+// scanBuild reads a single builds row selected with buildColumns
+func scanBuild(row rowScanner) (*BuildRequest, error) {
 	build := &BuildRequest{}
-	err := pg.db.QueryRow(query, id).Scan(
+	var dependsOn pq.Int64Array
+	var pullRequest sql.NullInt64
+	var matrix, labels []byte
+	err := row.Scan(
 		&build.ID,
 		&build.ProjectName,
 		&build.GitURL,
 		&build.Branch,
+		&build.CommitSHA,
+		&build.Tag,
+		&build.Version,
+		&build.AutoVersion,
+		&build.TriggeredBy,
 		&build.Status,
+		&build.ExitCode,
+		&build.RetriedFrom,
+		&build.StartedAt,
 		&build.CreatedAt,
 		&build.UpdatedAt,
+		&build.TraceParent,
+		&build.Org,
+		&build.StartAt,
+		&build.CancelReason,
+		&build.CancelledBy,
+		&dependsOn,
+		&build.ScheduleID,
+		&build.CommitMessage,
+		&build.CommitAuthor,
+		&build.TriggerSource,
+		&build.Description,
+		&build.DeletedAt,
+		&build.FailureCategory,
+		&build.UpstreamBuildID,
+		&pullRequest,
+		&build.PullRequestFork,
+		&build.ParentBuildID,
+		&matrix,
+		&build.SkipReason,
+		&build.LogTruncation,
+		&build.DebugLogging,
+		&labels,
+	)
+	build.PullRequest = int(pullRequest.Int64)
+	if err == nil && matrix != nil {
+		err = json.Unmarshal(matrix, &build.Matrix)
+	}
+	if err == nil && len(labels) > 0 {
+		err = json.Unmarshal(labels, &build.Labels)
+	}
+	build.Draft = build.Status == "draft"
+	for _, id := range dependsOn {
+		build.DependsOn = append(build.DependsOn, int(id))
+	}
+	return build, err
+}
+
+// GetBuild retrieves a build by ID
+func (pg *PostgreSQLDatabase) GetBuild(id int) (*BuildRequest, error) {
+	query := `
+	SELECT ` + buildColumns + `
+	FROM builds
+	WHERE id = $1
+	`
+
+	build, err := scanBuild(pg.db.QueryRow(query, id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("build not found")
+	}
+
+	return build, err
+}
+
+// GetLatestFinishedBuild retrieves the most recent build of a branch that
+// succeeded, failed or timed out
+func (pg *PostgreSQLDatabase) GetLatestFinishedBuild(projectName, branch string) (*BuildRequest, error) {
+	query := `
+	SELECT ` + buildColumns + `
+	FROM builds
+	WHERE project_name = $1 AND branch = $2 AND status IN ('success', 'failed', 'timeout')
+	ORDER BY id DESC
+	LIMIT 1
+	`
+
+	build, err := scanBuild(pg.db.QueryRow(query, projectName, branch))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("build not found")
+	}
+
+	return build, err
+}
+
+// GetPreviousFinishedBuild retrieves the last finished build of a project's
+// branch before the given build
+func (pg *PostgreSQLDatabase) GetPreviousFinishedBuild(projectName, branch string, beforeID int) (*BuildRequest, error) {
+	query := `
+	SELECT ` + buildColumns + `
+	FROM builds
+	WHERE project_name = $1 AND branch = $2 AND id < $3 AND status IN ('success', 'failed', 'timeout')
+	ORDER BY id DESC
+	LIMIT 1
+	`
+
+	build, err := scanBuild(pg.db.QueryRow(query, projectName, branch, beforeID))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("build not found")
+	}
+
+	return build, err
+}
+
+// GetTagBuild retrieves the latest successful build of a project's tag
+func (pg *PostgreSQLDatabase) GetTagBuild(projectName, tag string) (*BuildRequest, error) {
+	query := `
+	SELECT ` + buildColumns + `
+	FROM builds
+	WHERE project_name = $1 AND tag = $2 AND status = 'success'
+	ORDER BY id DESC
+	LIMIT 1
+	`
+
+	build, err := scanBuild(pg.db.QueryRow(query, projectName, tag))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("build not found")
+	}
+
+	return build, err
+}
+
+// StartDraftBuild moves a draft build to the queue
+func (pg *PostgreSQLDatabase) StartDraftBuild(id int) (*BuildRequest, error) {
+	query := `
+	UPDATE builds
+	SET status = 'queued', updated_at = NOW()
+	WHERE id = $1 AND status = 'draft'
+	RETURNING ` + buildColumns
+
+	build, err := scanBuild(pg.db.QueryRow(query, id))
+	if err == sql.ErrNoRows {
+		if _, err := pg.GetBuild(id); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("build is not a draft")
+	}
+
+	return build, err
+}
+
+// StartDueDraftBuilds moves draft builds whose start_at has passed to the queue
+func (pg *PostgreSQLDatabase) StartDueDraftBuilds() ([]*BuildRequest, error) {
+	query := `
+	UPDATE builds
+	SET status = 'queued', updated_at = NOW()
+	WHERE status = 'draft' AND start_at <= NOW()
+	RETURNING ` + buildColumns
+
+	return pg.queryBuilds(query)
+}
+
+// ListBuildFamily retrieves every build related to a build: its original
+// build and all builds descending from that original, oldest first
+func (pg *PostgreSQLDatabase) ListBuildFamily(id int) ([]*BuildRequest, error) {
+	query := `
+	WITH RECURSIVE ancestors AS (
+		SELECT id, retried_from FROM builds WHERE id = $1
+		UNION
+		SELECT b.id, b.retried_from FROM builds b JOIN ancestors a ON b.id = a.retried_from
+	), family AS (
+		SELECT id FROM ancestors WHERE retried_from IS NULL
+		UNION
+		SELECT b.id FROM builds b JOIN family f ON b.retried_from = f.id
 	)
+	SELECT ` + buildColumns + `
+	FROM builds
+	WHERE id IN (SELECT id FROM family)
+	ORDER BY id
+	`
+
+	builds, err := pg.queryBuilds(query, id)
+	if err == nil && len(builds) == 0 {
+		return nil, fmt.Errorf("build not found")
+	}
+
+	return builds, err
+}
+
+// GetBuildByIdempotencyKey retrieves the build an org created with an
+// Idempotency-Key. Keys are chosen by clients, so each org has its own.
+func (pg *PostgreSQLDatabase) GetBuildByIdempotencyKey(org, key string) (*BuildRequest, error) {
+	query := `
+	SELECT ` + buildColumns + `
+	FROM builds
+	WHERE org = $1 AND idempotency_key = $2
+	`
 
+	build, err := scanBuild(pg.db.QueryRow(query, org, key))
 	if err == sql.ErrNoRows {
 		return nil, fmt.Errorf("build not found")
 	}
@@ -120,16 +590,93 @@ func (pg *PostgreSQLDatabase) GetBuild(id int) (*BuildRequest, error) {
 	return build, err
 }
 
-// ListBuilds retrieves all builds
-func (pg *PostgreSQLDatabase) ListBuilds() ([]*BuildRequest, error) {
+// ListBuilds retrieves the most recent builds, leaving out deleted builds
+// unless includeDeleted is set. An org limits them to the org's builds and
+// labels to the builds having all of them.
+func (pg *PostgreSQLDatabase) ListBuilds(includeDeleted bool, org string, labels Labels) ([]*BuildRequest, error) {
 	query := `
-	SELECT id, project_name, git_url, branch, status, created_at, updated_at
+	SELECT ` + buildColumns + `
 	FROM builds
+	WHERE ($1 OR deleted_at IS NULL) AND ($2 = '' OR org = $2) AND labels @> $3
 	ORDER BY created_at DESC
 	LIMIT 100
 	`
 
-	rows, err := pg.db.Query(query)
+	return pg.queryBuilds(query, includeDeleted, org, labels.jsonb())
+}
+
+// ListRecentBuilds retrieves up to limit of the newest builds that aren't
+// deleted, of a project, with a status and of an org when they're given
+func (pg *PostgreSQLDatabase) ListRecentBuilds(projectName, status, org string, limit int) ([]*BuildRequest, error) {
+	query := `
+	SELECT ` + buildColumns + `
+	FROM builds
+	WHERE deleted_at IS NULL AND ($1 = '' OR project_name = $1) AND ($2 = '' OR status = $2) AND ($3 = '' OR org = $3)
+	ORDER BY created_at DESC, id DESC
+	LIMIT $4
+	`
+
+	return pg.queryBuilds(query, projectName, status, org, limit)
+}
+
+// DeleteBuild soft deletes a finished build. Deleting a build that's already
+// deleted returns it unchanged.
+func (pg *PostgreSQLDatabase) DeleteBuild(id int) (*BuildRequest, error) {
+	query := `
+	UPDATE builds
+	SET deleted_at = NOW(), updated_at = NOW()
+	WHERE id = $1 AND deleted_at IS NULL AND status NOT IN ('draft', 'queued', 'running')
+	RETURNING ` + buildColumns
+
+	build, err := scanBuild(pg.db.QueryRow(query, id))
+	if err == sql.ErrNoRows {
+		build, err := pg.GetBuild(id)
+		if err != nil {
+			return nil, err
+		}
+		if build.DeletedAt != nil {
+			return build, nil
+		}
+		return nil, fmt.Errorf("build not finished")
+	}
+
+	return build, err
+}
+
+// ArchiveBuilds moves up to limit finished builds created before the cutoff,
+// along with their stages and config, into builds_archive. Builds that still
+// have deployments or artifacts are kept until those are gone.
+func (pg *PostgreSQLDatabase) ArchiveBuilds(before time.Time, limit int) (int64, error) {
+	query := `
+	WITH candidates AS (
+		SELECT id FROM builds
+		WHERE created_at < $1 AND status NOT IN ('draft', 'queued', 'running')
+		AND NOT EXISTS (SELECT 1 FROM deployments WHERE deployments.build_id = builds.id)
+		AND NOT EXISTS (SELECT 1 FROM artifacts WHERE artifacts.build_id = builds.id)
+		ORDER BY id
+		LIMIT $2
+		FOR UPDATE SKIP LOCKED
+	), archived AS (
+		INSERT INTO builds_archive (id, project_name, created_at, deleted_at, build, stages, config)
+		SELECT b.id, b.project_name, b.created_at, b.deleted_at, to_jsonb(b),
+			(SELECT jsonb_agg(to_jsonb(s) ORDER BY s.position) FROM build_stages s WHERE s.build_id = b.id),
+			(SELECT c.config FROM build_configs c WHERE c.build_id = b.id)
+		FROM builds b JOIN candidates USING (id)
+		RETURNING id
+	)
+	DELETE FROM builds WHERE id IN (SELECT id FROM archived)
+	`
+
+	result, err := pg.db.Exec(query, before, limit)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// queryBuilds runs a query selecting buildColumns and scans every row
+func (pg *PostgreSQLDatabase) queryBuilds(query string, args ...interface{}) ([]*BuildRequest, error) {
+	rows, err := pg.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -137,16 +684,7 @@ func (pg *PostgreSQLDatabase) ListBuilds() ([]*BuildRequest, error) {
 
 	var builds []*BuildRequest
 	for rows.Next() {
-		build := &BuildRequest{}
-		err := rows.Scan(
-			&build.ID,
-			&build.ProjectName,
-			&build.GitURL,
-			&build.Branch,
-			&build.Status,
-			&build.CreatedAt,
-			&build.UpdatedAt,
-		)
+		build, err := scanBuild(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -156,6 +694,20 @@ func (pg *PostgreSQLDatabase) ListBuilds() ([]*BuildRequest, error) {
 	return builds, rows.Err()
 }
 
+// ListProjectBuildsBetween retrieves a project's builds with IDs after afterID
+// up to and including throughID, oldest first
+func (pg *PostgreSQLDatabase) ListProjectBuildsBetween(projectName string, afterID, throughID int) ([]*BuildRequest, error) {
+	query := `
+	SELECT ` + buildColumns + `
+	FROM builds
+	WHERE project_name = $1 AND id > $2 AND id <= $3
+	ORDER BY id
+	LIMIT 1000
+	`
+
+	return pg.queryBuilds(query, projectName, afterID, throughID)
+}
+
 // UpdateBuildStatus updates the status of a build
 func (pg *PostgreSQLDatabase) UpdateBuildStatus(id int, status string) error {
 	query := `
@@ -168,9 +720,3385 @@ func (pg *PostgreSQLDatabase) UpdateBuildStatus(id int, status string) error {
 	return err
 }
 
-// Ping checks if the database connection is alive
-func (pg *PostgreSQLDatabase) Ping() error {
-	return pg.db.Ping()
+// UpdateBuildResult records the final status and exit code of a build
+func (pg *PostgreSQLDatabase) UpdateBuildResult(id int, status string, exitCode int) error {
+	query := `
+	UPDATE builds
+	SET status = $1, exit_code = $2, claimed_by = NULL, lease_expires_at = NULL, updated_at = NOW()
+	WHERE id = $3 AND status <> 'cancelled'
+	`
+
+	_, err := pg.db.Exec(query, status, exitCode, id)
+	return err
+}
+
+// CancelBuild ends a draft, queued or running build with status cancelled,
+// recording why and by whom
+func (pg *PostgreSQLDatabase) CancelBuild(id int, reason, actor string) (*BuildRequest, error) {
+	query := `
+	UPDATE builds
+	SET status = 'cancelled', cancel_reason = $2, cancelled_by = $3,
+		claimed_by = NULL, lease_expires_at = NULL, updated_at = NOW()
+	WHERE id = $1 AND status IN ('draft', 'queued', 'running')
+	RETURNING ` + buildColumns
+
+	build, err := scanBuild(pg.db.QueryRow(query, id, reason, actor))
+	if err == sql.ErrNoRows {
+		if _, err := pg.GetBuild(id); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("build already finished")
+	}
+
+	return build, err
+}
+
+// ListDownstreamBuilds returns the draft and queued builds that depend on a
+// build, directly or through other waiting builds. Only builds of the same
+// org, or of none, count as depending on a build.
+func (pg *PostgreSQLDatabase) ListDownstreamBuilds(id int) ([]*BuildRequest, error) {
+	query := `
+	WITH RECURSIVE downstream AS (
+		SELECT builds.id, builds.org FROM builds
+		JOIN builds upstream ON upstream.id = $1
+		WHERE $1 = ANY(builds.depends_on) AND builds.status IN ('draft', 'queued') AND builds.org IN ('', upstream.org)
+		UNION
+		SELECT builds.id, builds.org FROM builds
+		JOIN downstream ON downstream.id = ANY(builds.depends_on)
+		WHERE builds.status IN ('draft', 'queued') AND builds.org IN ('', downstream.org)
+	)
+	SELECT ` + buildColumns + `
+	FROM builds
+	WHERE id IN (SELECT id FROM downstream)
+	ORDER BY id
+	`
+
+	return pg.queryBuilds(query, id)
+}
+
+// BlockDownstreamBuilds marks the draft and queued builds that depend on a
+// build that won't succeed, directly or through other waiting builds, as
+// blocked. Like ListDownstreamBuilds, it leaves builds of other orgs alone.
+func (pg *PostgreSQLDatabase) BlockDownstreamBuilds(id int) ([]*BuildRequest, error) {
+	query := `
+	WITH RECURSIVE downstream AS (
+		SELECT builds.id, builds.org FROM builds
+		JOIN builds upstream ON upstream.id = $1
+		WHERE $1 = ANY(builds.depends_on) AND builds.status IN ('draft', 'queued') AND builds.org IN ('', upstream.org)
+		UNION
+		SELECT builds.id, builds.org FROM builds
+		JOIN downstream ON downstream.id = ANY(builds.depends_on)
+		WHERE builds.status IN ('draft', 'queued') AND builds.org IN ('', downstream.org)
+	)
+	UPDATE builds
+	SET status = 'blocked', skip_reason = 'dependency_failed', updated_at = NOW()
+	WHERE id IN (SELECT id FROM downstream) AND status IN ('draft', 'queued')
+	RETURNING ` + buildColumns
+
+	return pg.queryBuilds(query, id)
+}
+
+// SetBuildCancellation records why and by whom a build was ended before it
+// finished, for builds the service stopped itself
+func (pg *PostgreSQLDatabase) SetBuildCancellation(id int, reason, actor string) error {
+	_, err := pg.db.Exec(`UPDATE builds SET cancel_reason = $2, cancelled_by = $3 WHERE id = $1`, id, reason, actor)
+	return err
+}
+
+// SetBuildFailureCategory records the classified cause of a failed build
+func (pg *PostgreSQLDatabase) SetBuildFailureCategory(id int, category string) error {
+	_, err := pg.db.Exec(`UPDATE builds SET failure_category = $2 WHERE id = $1`, id, category)
+	return err
+}
+
+// SetBuildLogTruncation records the limit a build's log was truncated at
+func (pg *PostgreSQLDatabase) SetBuildLogTruncation(id int, reason string) error {
+	_, err := pg.db.Exec(`UPDATE builds SET log_truncation = $2 WHERE id = $1`, id, reason)
+	return err
+}
+
+// CountAutoRetries counts the automatic retries in a row that led to a build
+func (pg *PostgreSQLDatabase) CountAutoRetries(id int) (int, error) {
+	query := `
+	WITH RECURSIVE chain AS (
+		SELECT id, retried_from, trigger_source FROM builds WHERE id = $1
+		UNION ALL
+		SELECT b.id, b.retried_from, b.trigger_source
+		FROM builds b JOIN chain c ON b.id = c.retried_from
+		WHERE c.trigger_source = 'auto-retry'
+	)
+	SELECT COUNT(*) FROM chain WHERE trigger_source = 'auto-retry'`
+
+	var count int
+	err := pg.db.QueryRow(query, id).Scan(&count)
+	return count, err
+}
+
+// CountFailureCategories counts a project's builds created since the given
+// time by failure category
+func (pg *PostgreSQLDatabase) CountFailureCategories(projectName string, since time.Time) (map[string]int, error) {
+	query := `
+	SELECT failure_category, COUNT(*)
+	FROM builds
+	WHERE project_name = $1 AND created_at >= $2 AND failure_category <> '' AND deleted_at IS NULL
+	GROUP BY failure_category`
+
+	rows, err := pg.db.Query(query, projectName, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := map[string]int{}
+	for rows.Next() {
+		var category string
+		var count int
+		if err := rows.Scan(&category, &count); err != nil {
+			return nil, err
+		}
+		counts[category] = count
+	}
+
+	return counts, rows.Err()
+}
+
+// GetProjectStats summarises the builds of each project created since the
+// given time that have finished, optionally of one org
+func (pg *PostgreSQLDatabase) GetProjectStats(since time.Time, org string) ([]*ProjectStats, error) {
+	query := `
+	SELECT project_name,
+		COUNT(*),
+		COUNT(*) FILTER (WHERE status = 'success'),
+		COUNT(*) FILTER (WHERE status <> 'success'),
+		COALESCE(AVG(EXTRACT(EPOCH FROM updated_at - started_at)), 0),
+		COALESCE(PERCENTILE_CONT(0.5) WITHIN GROUP (ORDER BY EXTRACT(EPOCH FROM updated_at - started_at)), 0),
+		COALESCE(PERCENTILE_CONT(0.95) WITHIN GROUP (ORDER BY EXTRACT(EPOCH FROM updated_at - started_at)), 0)
+	FROM builds
+	WHERE status IN ('success', 'failed', 'timeout') AND created_at >= $1 AND deleted_at IS NULL
+	AND ($2 = '' OR org = $2)
+	GROUP BY project_name
+	ORDER BY project_name`
+
+	rows, err := pg.db.Query(query, since, org)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := []*ProjectStats{}
+	for rows.Next() {
+		s := &ProjectStats{}
+		if err := rows.Scan(&s.Project, &s.Builds, &s.Succeeded, &s.Failed,
+			&s.AvgDurationSeconds, &s.P50DurationSeconds, &s.P95DurationSeconds); err != nil {
+			return nil, err
+		}
+		s.SuccessRate = float64(s.Succeeded) / float64(s.Builds)
+		stats = append(stats, s)
+	}
+
+	return stats, rows.Err()
+}
+
+// GetDurationStats summarises the durations of builds finished since the
+// given time in windows of interval (a date_trunc field), optionally of one
+// project and of one org
+func (pg *PostgreSQLDatabase) GetDurationStats(since time.Time, interval, projectName, org string) ([]*DurationStats, error) {
+	query := `
+	SELECT date_trunc($2, updated_at AT TIME ZONE 'UTC') AS start,
+		COUNT(*),
+		AVG(EXTRACT(EPOCH FROM updated_at - started_at)),
+		PERCENTILE_CONT(0.5) WITHIN GROUP (ORDER BY EXTRACT(EPOCH FROM updated_at - started_at)),
+		PERCENTILE_CONT(0.95) WITHIN GROUP (ORDER BY EXTRACT(EPOCH FROM updated_at - started_at))
+	FROM builds
+	WHERE status IN ('success', 'failed', 'timeout') AND started_at IS NOT NULL AND updated_at >= $1
+	AND deleted_at IS NULL AND ($3 = '' OR project_name = $3) AND ($4 = '' OR org = $4)
+	GROUP BY start
+	ORDER BY start`
+
+	rows, err := pg.db.Query(query, since, interval, projectName, org)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := []*DurationStats{}
+	for rows.Next() {
+		s := &DurationStats{}
+		if err := rows.Scan(&s.Start, &s.Builds, &s.AvgDurationSeconds, &s.P50DurationSeconds, &s.P95DurationSeconds); err != nil {
+			return nil, err
+		}
+		stats = append(stats, s)
+	}
+
+	return stats, rows.Err()
+}
+
+// GetDailyBuildCounts counts the builds created on each day since the given
+// time, optionally of one project and of one org. Days without builds are
+// left out.
+func (pg *PostgreSQLDatabase) GetDailyBuildCounts(since time.Time, projectName, org string) ([]*DailyBuildCount, error) {
+	query := `
+	SELECT date_trunc('day', created_at AT TIME ZONE 'UTC') AS day,
+		COUNT(*),
+		COUNT(*) FILTER (WHERE status = 'success'),
+		COUNT(*) FILTER (WHERE status IN ('failed', 'timeout')),
+		COUNT(*) FILTER (WHERE status = 'skipped'),
+		COUNT(*) FILTER (WHERE status = 'blocked')
+	FROM builds
+	WHERE created_at >= $1 AND deleted_at IS NULL AND ($2 = '' OR project_name = $2) AND ($3 = '' OR org = $3)
+	GROUP BY day
+	ORDER BY day`
+
+	rows, err := pg.db.Query(query, since, projectName, org)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := []*DailyBuildCount{}
+	for rows.Next() {
+		c := &DailyBuildCount{}
+		if err := rows.Scan(&c.Day, &c.Builds, &c.Succeeded, &c.Failed, &c.Skipped, &c.Blocked); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+
+	return counts, rows.Err()
+}
+
+// GetFlakyProjects ranks projects by the share of their commits built more
+// than once since the given time that both failed and succeeded, optionally
+// only the projects of one org
+func (pg *PostgreSQLDatabase) GetFlakyProjects(since time.Time, org string, limit int) ([]*FlakyProject, error) {
+	query := `
+	WITH commits AS (
+		SELECT project_name,
+			bool_or(status = 'success') AND bool_or(status IN ('failed', 'timeout')) AS flaky
+		FROM builds
+		WHERE commit_sha <> '' AND status IN ('success', 'failed', 'timeout') AND created_at >= $1 AND deleted_at IS NULL
+		AND ($3 = '' OR org = $3)
+		GROUP BY project_name, commit_sha
+		HAVING COUNT(*) > 1
+	)
+	SELECT project_name, COUNT(*), COUNT(*) FILTER (WHERE flaky)
+	FROM commits
+	GROUP BY project_name
+	HAVING COUNT(*) FILTER (WHERE flaky) > 0
+	ORDER BY COUNT(*) FILTER (WHERE flaky)::float / COUNT(*) DESC, project_name
+	LIMIT $2`
+
+	rows, err := pg.db.Query(query, since, limit, org)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	projects := []*FlakyProject{}
+	for rows.Next() {
+		p := &FlakyProject{}
+		if err := rows.Scan(&p.Project, &p.Commits, &p.FlakyCommits); err != nil {
+			return nil, err
+		}
+		p.FlakeRate = float64(p.FlakyCommits) / float64(p.Commits)
+		projects = append(projects, p)
+	}
+
+	return projects, rows.Err()
+}
+
+// UpdateBuildVersion records the version computed for a build
+func (pg *PostgreSQLDatabase) UpdateBuildVersion(id int, version string) error {
+	_, err := pg.db.Exec(`UPDATE builds SET version = $1 WHERE id = $2`, version, id)
+	return err
+}
+
+// ClaimNextBuild atomically moves the oldest queued build to running and
+// leases it to the given worker. Builds of users already running their org's
+// fair share (fairShare unless the org sets its own limit, 0 for no limit)
+// only start when no other build is waiting. It returns nil when the queue is
+// empty, paused or the worker is draining.
+func (pg *PostgreSQLDatabase) ClaimNextBuild(workerID string, lease time.Duration, fairShare int) (*BuildRequest, error) {
+	query := `
+	UPDATE builds
+	SET status = 'running', claimed_by = $1, lease_expires_at = NOW() + $2 * INTERVAL '1 second', started_at = NOW(), updated_at = NOW()
+	WHERE id = (
+		SELECT builds.id FROM builds
+		LEFT JOIN fair_share_limits ON fair_share_limits.org = builds.org
+		WHERE builds.status = 'queued'
+		AND NOT EXISTS (SELECT 1 FROM projects WHERE projects.name = builds.project_name AND projects.paused_at IS NOT NULL)
+		AND NOT EXISTS (SELECT 1 FROM builds upstream WHERE upstream.id = ANY(builds.depends_on) AND upstream.status <> 'success')
+		AND NOT EXISTS (SELECT 1 FROM queue_state WHERE paused_at IS NOT NULL)
+		AND NOT EXISTS (SELECT 1 FROM workers WHERE workers.id = $1 AND workers.draining_at IS NOT NULL)
+		ORDER BY
+			COALESCE(fair_share_limits.max_running_per_user, $3) > 0 AND (
+				SELECT COUNT(*) FROM builds running
+				WHERE running.status = 'running' AND running.org = builds.org AND running.triggered_by = builds.triggered_by
+			) >= COALESCE(fair_share_limits.max_running_per_user, $3),
+			builds.created_at, builds.id
+		LIMIT 1
+		FOR UPDATE OF builds SKIP LOCKED
+	)
+	RETURNING ` + buildColumns
+
+	build, err := scanBuild(pg.db.QueryRow(query, workerID, lease.Seconds(), fairShare))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return build, err
+}
+
+// ReleaseBuild returns a claimed build to the queue
+func (pg *PostgreSQLDatabase) ReleaseBuild(id int) error {
+	query := `
+	UPDATE builds
+	SET status = 'queued', claimed_by = NULL, lease_expires_at = NULL, updated_at = NOW()
+	WHERE id = $1 AND status = 'running'
+	`
+
+	_, err := pg.db.Exec(query, id)
+	return err
+}
+
+// RenewBuildLease extends a worker's lease on a running build, reporting
+// false when the worker no longer holds it
+func (pg *PostgreSQLDatabase) RenewBuildLease(id int, workerID string, lease time.Duration) (bool, error) {
+	query := `
+	UPDATE builds
+	SET lease_expires_at = NOW() + $3 * INTERVAL '1 second'
+	WHERE id = $1 AND claimed_by = $2 AND status = 'running'
+	`
+
+	res, err := pg.db.Exec(query, id, workerID, lease.Seconds())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// RequeueExpiredBuilds returns running builds whose lease has lapsed to the
+// queue, recovering work from crashed workers
+func (pg *PostgreSQLDatabase) RequeueExpiredBuilds() (int64, error) {
+	query := `
+	UPDATE builds
+	SET status = 'queued', claimed_by = NULL, lease_expires_at = NULL, updated_at = NOW()
+	WHERE status = 'running' AND (lease_expires_at IS NULL OR lease_expires_at < NOW())
+	AND NOT EXISTS (SELECT 1 FROM builds child WHERE child.parent_build_id = builds.id)
+	`
+
+	res, err := pg.db.Exec(query)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// ExpireQueuedBuilds marks builds that have been queued for longer than maxAge
+// as expired. Builds that waiting builds depend on are kept until their
+// dependents have expired themselves.
+func (pg *PostgreSQLDatabase) ExpireQueuedBuilds(maxAge time.Duration) ([]*BuildRequest, error) {
+	query := `
+	UPDATE builds
+	SET status = 'expired', cancel_reason = 'queue_expired', cancelled_by = 'system:queue', updated_at = NOW()
+	WHERE status = 'queued' AND updated_at < NOW() - $1 * INTERVAL '1 second'
+	AND NOT EXISTS (
+		SELECT 1 FROM builds downstream
+		WHERE builds.id = ANY(downstream.depends_on) AND downstream.status IN ('draft', 'queued') AND downstream.org IN ('', builds.org)
+	)
+	RETURNING ` + buildColumns
+
+	return pg.queryBuilds(query, maxAge.Seconds())
+}
+
+// CreateProject registers a new project
+func (pg *PostgreSQLDatabase) CreateProject(project *Project) (int, error) {
+	query := `
+	INSERT INTO projects (org, name, git_url, repository_key, default_branch, skip_ci_enabled, skip_ci_token, tag_pattern, artifact_tag_pattern, auto_version, build_timeout_seconds, max_queue_wait_seconds, build_image, notify_on, notify_slack_webhook_url, notify_emails, problem_patterns, max_auto_retries, auto_retry_categories, quality_gate_policy, cpu_limit, memory_limit_mb, auto_apply_recommendations, matrix, labels, created_at, updated_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25, $26, $27)
+	RETURNING id
+	`
+
+	var id int
+	err := pg.db.QueryRow(
+		query,
+		project.Org,
+		project.Name,
+		project.GitURL,
+		repositoryKey(project.GitURL),
+		project.DefaultBranch,
+		project.SkipCIEnabled,
+		project.SkipCIToken,
+		project.TagPattern,
+		project.ArtifactTagPattern,
+		project.AutoVersion,
+		project.BuildTimeout,
+		project.MaxQueueWait,
+		project.BuildImage,
+		project.NotifyOn,
+		project.NotifySlackWebhookURL,
+		pq.Array(nonNilStrings(project.NotifyEmails)),
+		pq.Array(nonNilStrings(project.ProblemPatterns)),
+		project.MaxAutoRetries,
+		pq.Array(nonNilStrings(project.AutoRetryCategories)),
+		project.QualityGatePolicy,
+		project.CPULimit,
+		project.MemoryLimitMB,
+		project.AutoApplyRecommendations,
+		projectMatrix(project.Matrix),
+		project.Labels.jsonb(),
+		project.CreatedAt,
+		project.UpdatedAt,
+	).Scan(&id)
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return 0, fmt.Errorf("project already exists")
+	}
+
+	return id, err
+}
+
+// projectMatrix encodes a project's build matrix for its JSONB column
+func projectMatrix(matrix BuildMatrix) []byte {
+	if matrix == nil {
+		matrix = BuildMatrix{}
+	}
+	encoded, _ := json.Marshal(matrix)
+	return encoded
+}
+
+// projectColumns lists the projects table columns in the order scanProject expects
+const projectColumns = `id, org, name, git_url, default_branch, skip_ci_enabled, skip_ci_token, tag_pattern, artifact_tag_pattern, auto_version, build_timeout_seconds, max_queue_wait_seconds, build_image, notify_on, notify_slack_webhook_url, notify_emails, problem_patterns, max_auto_retries, auto_retry_categories, quality_gate_policy, cpu_limit, memory_limit_mb, auto_apply_recommendations, matrix, labels, paused_at, pause_reason, created_at, updated_at`
+
+// scanProject reads a single projects row selected with projectColumns
+func scanProject(row rowScanner) (*Project, error) {
+	project := &Project{}
+	var matrix, labels []byte
+	err := row.Scan(
+		&project.ID,
+		&project.Org,
+		&project.Name,
+		&project.GitURL,
+		&project.DefaultBranch,
+		&project.SkipCIEnabled,
+		&project.SkipCIToken,
+		&project.TagPattern,
+		&project.ArtifactTagPattern,
+		&project.AutoVersion,
+		&project.BuildTimeout,
+		&project.MaxQueueWait,
+		&project.BuildImage,
+		&project.NotifyOn,
+		&project.NotifySlackWebhookURL,
+		pq.Array(&project.NotifyEmails),
+		pq.Array(&project.ProblemPatterns),
+		&project.MaxAutoRetries,
+		pq.Array(&project.AutoRetryCategories),
+		&project.QualityGatePolicy,
+		&project.CPULimit,
+		&project.MemoryLimitMB,
+		&project.AutoApplyRecommendations,
+		&matrix,
+		&labels,
+		&project.PausedAt,
+		&project.PauseReason,
+		&project.CreatedAt,
+		&project.UpdatedAt,
+	)
+	project.Paused = project.PausedAt != nil
+	if err == nil && len(matrix) > 0 {
+		err = json.Unmarshal(matrix, &project.Matrix)
+	}
+	if err == nil && len(labels) > 0 {
+		err = json.Unmarshal(labels, &project.Labels)
+	}
+	return project, err
+}
+
+// GetProject retrieves a project by ID
+func (pg *PostgreSQLDatabase) GetProject(id int) (*Project, error) {
+	query := `SELECT ` + projectColumns + ` FROM projects WHERE id = $1`
+
+	project, err := scanProject(pg.db.QueryRow(query, id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("project not found")
+	}
+
+	return project, err
+}
+
+// GetProjectByName retrieves a project by its unique name
+func (pg *PostgreSQLDatabase) GetProjectByName(name string) (*Project, error) {
+	query := `SELECT ` + projectColumns + ` FROM projects WHERE name = $1`
+
+	project, err := scanProject(pg.db.QueryRow(query, name))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("project not found")
+	}
+
+	return project, err
+}
+
+// GetProjectByRepository retrieves the project registered for a normalised
+// repository key (see repositoryKey)
+func (pg *PostgreSQLDatabase) GetProjectByRepository(repoKey string) (*Project, error) {
+	query := `SELECT ` + projectColumns + ` FROM projects WHERE repository_key = $1 ORDER BY id LIMIT 1`
+
+	project, err := scanProject(pg.db.QueryRow(query, repoKey))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("project not found")
+	}
+
+	return project, err
+}
+
+// UpdateProject saves the mutable fields of a project
+func (pg *PostgreSQLDatabase) UpdateProject(project *Project) error {
+	query := `
+	UPDATE projects
+	SET git_url = $1, repository_key = $2, default_branch = $3, skip_ci_enabled = $4, skip_ci_token = $5,
+		tag_pattern = $6, artifact_tag_pattern = $7, auto_version = $8, build_timeout_seconds = $9,
+		max_queue_wait_seconds = $10, build_image = $11, notify_on = $12, notify_slack_webhook_url = $13,
+		notify_emails = $14, problem_patterns = $15, max_auto_retries = $16, auto_retry_categories = $17,
+		quality_gate_policy = $18, cpu_limit = $19, memory_limit_mb = $20, auto_apply_recommendations = $21,
+		matrix = $22, labels = $23, updated_at = $24
+	WHERE id = $25
+	`
+
+	_, err := pg.db.Exec(
+		query,
+		project.GitURL,
+		repositoryKey(project.GitURL),
+		project.DefaultBranch,
+		project.SkipCIEnabled,
+		project.SkipCIToken,
+		project.TagPattern,
+		project.ArtifactTagPattern,
+		project.AutoVersion,
+		project.BuildTimeout,
+		project.MaxQueueWait,
+		project.BuildImage,
+		project.NotifyOn,
+		project.NotifySlackWebhookURL,
+		pq.Array(nonNilStrings(project.NotifyEmails)),
+		pq.Array(nonNilStrings(project.ProblemPatterns)),
+		project.MaxAutoRetries,
+		pq.Array(nonNilStrings(project.AutoRetryCategories)),
+		project.QualityGatePolicy,
+		project.CPULimit,
+		project.MemoryLimitMB,
+		project.AutoApplyRecommendations,
+		projectMatrix(project.Matrix),
+		project.Labels.jsonb(),
+		project.UpdatedAt,
+		project.ID,
+	)
+	return err
+}
+
+// SetProjectPaused pauses or resumes scheduling of a project's queued builds
+func (pg *PostgreSQLDatabase) SetProjectPaused(id int, paused bool, reason string) (*Project, error) {
+	query := `
+	UPDATE projects
+	SET paused_at = CASE WHEN $2 THEN COALESCE(paused_at, NOW()) END,
+		pause_reason = CASE WHEN $2 THEN $3 ELSE '' END,
+		updated_at = NOW()
+	WHERE id = $1
+	RETURNING ` + projectColumns
+
+	project, err := scanProject(pg.db.QueryRow(query, id, paused, reason))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("project not found")
+	}
+
+	return project, err
+}
+
+// ListProjects retrieves all projects, or an org's projects when it's given,
+// having all the given labels
+func (pg *PostgreSQLDatabase) ListProjects(org string, labels Labels) ([]*Project, error) {
+	query := `SELECT ` + projectColumns + ` FROM projects WHERE ($1 = '' OR org = $1) AND labels @> $2 ORDER BY name`
+
+	rows, err := pg.db.Query(query, org, labels.jsonb())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var projects []*Project
+	for rows.Next() {
+		project, err := scanProject(rows)
+		if err != nil {
+			return nil, err
+		}
+		projects = append(projects, project)
+	}
+
+	return projects, rows.Err()
+}
+
+// CreateSlackThread records the Slack message a build's updates are threaded under
+func (pg *PostgreSQLDatabase) CreateSlackThread(thread *SlackThread) error {
+	query := `
+	INSERT INTO slack_threads (build_id, channel_id, thread_ts)
+	VALUES ($1, $2, $3)
+	ON CONFLICT (build_id) DO UPDATE SET channel_id = EXCLUDED.channel_id, thread_ts = EXCLUDED.thread_ts
+	`
+
+	_, err := pg.db.Exec(query, thread.BuildID, thread.ChannelID, thread.ThreadTS)
+	return err
+}
+
+// GetSlackThread retrieves the Slack thread of a build
+func (pg *PostgreSQLDatabase) GetSlackThread(buildID int) (*SlackThread, error) {
+	query := `SELECT build_id, channel_id, thread_ts FROM slack_threads WHERE build_id = $1`
+
+	thread := &SlackThread{}
+	err := pg.db.QueryRow(query, buildID).Scan(&thread.BuildID, &thread.ChannelID, &thread.ThreadTS)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("slack thread not found")
+	}
+
+	return thread, err
+}
+
+// AddBuildIssues links issue keys to a build
+func (pg *PostgreSQLDatabase) AddBuildIssues(buildID int, keys []string) error {
+	query := `
+	INSERT INTO build_issues (build_id, issue_key)
+	SELECT $1, unnest($2::text[])
+	ON CONFLICT DO NOTHING
+	`
+
+	_, err := pg.db.Exec(query, buildID, pq.Array(keys))
+	return err
+}
+
+// ListBuildIssues retrieves the issue keys linked to a build
+func (pg *PostgreSQLDatabase) ListBuildIssues(buildID int) ([]string, error) {
+	query := `SELECT issue_key FROM build_issues WHERE build_id = $1 ORDER BY issue_key`
+
+	rows, err := pg.db.Query(query, buildID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// ListBuildsByIssue retrieves the builds that reference an issue key,
+// optionally only those of an org
+func (pg *PostgreSQLDatabase) ListBuildsByIssue(key, org string) ([]*BuildRequest, error) {
+	query := `
+	SELECT ` + buildColumns + `
+	FROM builds
+	WHERE id IN (SELECT build_id FROM build_issues WHERE issue_key = $1) AND ($2 = '' OR org = $2)
+	ORDER BY created_at DESC
+	LIMIT 100
+	`
+
+	return pg.queryBuilds(query, key, org)
+}
+
+// ListBuildsByCommit retrieves the builds of commits whose hash starts with
+// sha, leaving out deleted builds unless includeDeleted is set. An org
+// limits them to the org's builds and labels to the builds having all of
+// them.
+func (pg *PostgreSQLDatabase) ListBuildsByCommit(sha string, includeDeleted bool, org string, labels Labels) ([]*BuildRequest, error) {
+	query := `
+	SELECT ` + buildColumns + `
+	FROM builds
+	WHERE commit_sha LIKE $1 || '%' AND commit_sha <> '' AND ($2 OR deleted_at IS NULL) AND ($3 = '' OR org = $3) AND labels @> $4
+	ORDER BY created_at DESC
+	LIMIT 100
+	`
+
+	return pg.queryBuilds(query, sha, includeDeleted, org, labels.jsonb())
+}
+
+// UpdateBuildCommit records the commit a build checked out
+func (pg *PostgreSQLDatabase) UpdateBuildCommit(id int, commit *CommitInfo) error {
+	_, err := pg.db.Exec(`UPDATE builds SET commit_sha = $2, commit_message = $3, commit_author = $4, updated_at = NOW() WHERE id = $1`, id, commit.SHA, commit.Message, commit.Author)
+	return err
+}
+
+// UpdateBuild applies the set fields of update to a build, provided it hasn't
+// been modified since updatedAt
+func (pg *PostgreSQLDatabase) UpdateBuild(id int, update *BuildUpdate, updatedAt time.Time) (*BuildRequest, error) {
+	query := `
+	UPDATE builds
+	SET status = COALESCE($3, status),
+	    start_at = COALESCE($4, start_at),
+	    description = COALESCE($5, description),
+	    debug_logging = COALESCE($6, debug_logging),
+	    labels = COALESCE($7, labels),
+	    updated_at = NOW()
+	WHERE id = $1 AND updated_at = $2
+	RETURNING ` + buildColumns
+
+	var labels []byte
+	if update.Labels != nil {
+		labels = update.Labels.jsonb()
+	}
+	build, err := scanBuild(pg.db.QueryRow(query, id, updatedAt, update.Status, update.StartAt, update.Description, update.DebugLogging, labels))
+	if err == sql.ErrNoRows {
+		if _, err := pg.GetBuild(id); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("build changed")
+	}
+
+	return build, err
+}
+
+// CreateArtifact records an uploaded artifact
+func (pg *PostgreSQLDatabase) CreateArtifact(artifact *Artifact) (int, error) {
+	query := `
+	INSERT INTO artifacts (build_id, name, size, sha256, content_type, storage_key, created_at, step, published)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	RETURNING id
+	`
+
+	var id int
+	err := pg.db.QueryRow(
+		query,
+		artifact.BuildID,
+		artifact.Name,
+		artifact.Size,
+		artifact.SHA256,
+		artifact.ContentType,
+		artifact.StorageKey,
+		artifact.CreatedAt,
+		artifact.Step,
+		artifact.Published,
+	).Scan(&id)
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return 0, fmt.Errorf("artifact already exists")
+	}
+
+	return id, err
+}
+
+// artifactColumns lists the artifacts table columns in the order scanArtifact expects
+const artifactColumns = `id, build_id, name, size, sha256, content_type, storage_key, created_at, step, published`
+
+// scanArtifact reads a single artifacts row selected with artifactColumns
+func scanArtifact(row rowScanner) (*Artifact, error) {
+	artifact := &Artifact{}
+	err := row.Scan(
+		&artifact.ID,
+		&artifact.BuildID,
+		&artifact.Name,
+		&artifact.Size,
+		&artifact.SHA256,
+		&artifact.ContentType,
+		&artifact.StorageKey,
+		&artifact.CreatedAt,
+		&artifact.Step,
+		&artifact.Published,
+	)
+	return artifact, err
+}
+
+// GetArtifact retrieves a build's artifact by name
+func (pg *PostgreSQLDatabase) GetArtifact(buildID int, name string) (*Artifact, error) {
+	query := `SELECT ` + artifactColumns + ` FROM artifacts WHERE build_id = $1 AND name = $2`
+
+	artifact, err := scanArtifact(pg.db.QueryRow(query, buildID, name))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("artifact not found")
+	}
+	return artifact, err
+}
+
+// ListArtifacts retrieves the artifacts of a build
+func (pg *PostgreSQLDatabase) ListArtifacts(buildID int) ([]*Artifact, error) {
+	query := `SELECT ` + artifactColumns + ` FROM artifacts WHERE build_id = $1 ORDER BY name`
+	return pg.queryArtifacts(query, buildID)
+}
+
+// ListStepArtifacts retrieves the artifacts a stage of a build produced
+func (pg *PostgreSQLDatabase) ListStepArtifacts(buildID, step int) ([]*Artifact, error) {
+	query := `SELECT ` + artifactColumns + ` FROM artifacts WHERE build_id = $1 AND step = $2 ORDER BY name`
+	return pg.queryArtifacts(query, buildID, step)
+}
+
+// ListArtifactsCreatedBefore retrieves up to limit artifacts created before cutoff, oldest first
+func (pg *PostgreSQLDatabase) ListArtifactsCreatedBefore(cutoff time.Time, limit int) ([]*Artifact, error) {
+	query := `SELECT ` + artifactColumns + ` FROM artifacts WHERE created_at < $1 ORDER BY created_at LIMIT $2`
+	return pg.queryArtifacts(query, cutoff, limit)
+}
+
+// ListAllArtifacts retrieves every artifact record
+func (pg *PostgreSQLDatabase) ListAllArtifacts() ([]*Artifact, error) {
+	query := `SELECT ` + artifactColumns + ` FROM artifacts ORDER BY id`
+	return pg.queryArtifacts(query)
+}
+
+// queryArtifacts runs a query selecting artifactColumns and scans every row
+func (pg *PostgreSQLDatabase) queryArtifacts(query string, args ...interface{}) ([]*Artifact, error) {
+	rows, err := pg.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	artifacts := []*Artifact{}
+	for rows.Next() {
+		artifact, err := scanArtifact(rows)
+		if err != nil {
+			return nil, err
+		}
+		artifacts = append(artifacts, artifact)
+	}
+
+	return artifacts, rows.Err()
+}
+
+// DeleteArtifact removes an artifact record
+func (pg *PostgreSQLDatabase) DeleteArtifact(id int) error {
+	_, err := pg.db.Exec(`DELETE FROM artifacts WHERE id = $1`, id)
+	return err
+}
+
+// integrationColumns lists the integrations table columns in the order scanIntegration expects
+const integrationColumns = `name, consecutive_failures, last_error, last_failure_at, disabled_at`
+
+// scanIntegration reads a single integrations row selected with integrationColumns
+func scanIntegration(row rowScanner) (*IntegrationState, error) {
+	state := &IntegrationState{}
+	err := row.Scan(
+		&state.Name,
+		&state.ConsecutiveFailures,
+		&state.LastError,
+		&state.LastFailureAt,
+		&state.DisabledAt,
+	)
+	return state, err
+}
+
+// GetIntegration retrieves the health state of an integration
+func (pg *PostgreSQLDatabase) GetIntegration(name string) (*IntegrationState, error) {
+	query := `SELECT ` + integrationColumns + ` FROM integrations WHERE name = $1`
+
+	state, err := scanIntegration(pg.db.QueryRow(query, name))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("integration not found")
+	}
+	return state, err
+}
+
+// ListIntegrations retrieves the health state of every integration that has failed
+func (pg *PostgreSQLDatabase) ListIntegrations() ([]*IntegrationState, error) {
+	rows, err := pg.db.Query(`SELECT ` + integrationColumns + ` FROM integrations ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	integrations := []*IntegrationState{}
+	for rows.Next() {
+		state, err := scanIntegration(rows)
+		if err != nil {
+			return nil, err
+		}
+		integrations = append(integrations, state)
+	}
+
+	return integrations, rows.Err()
+}
+
+// RecordIntegrationFailure atomically counts a failed delivery, disabling the
+// integration when the count reaches threshold
+func (pg *PostgreSQLDatabase) RecordIntegrationFailure(name, lastError string, threshold int) (*IntegrationState, error) {
+	query := `
+	INSERT INTO integrations (name, consecutive_failures, last_error, last_failure_at, disabled_at)
+	VALUES ($1, 1, $2, NOW(), CASE WHEN $3 <= 1 THEN NOW() END)
+	ON CONFLICT (name) DO UPDATE SET
+		consecutive_failures = integrations.consecutive_failures + 1,
+		last_error = EXCLUDED.last_error,
+		last_failure_at = NOW(),
+		disabled_at = CASE
+			WHEN integrations.disabled_at IS NULL AND integrations.consecutive_failures + 1 >= $3 THEN NOW()
+			ELSE integrations.disabled_at
+		END
+	RETURNING ` + integrationColumns
+
+	return scanIntegration(pg.db.QueryRow(query, name, lastError, threshold))
+}
+
+// ResetIntegrationFailures clears the failure count after a successful delivery
+func (pg *PostgreSQLDatabase) ResetIntegrationFailures(name string) error {
+	query := `UPDATE integrations SET consecutive_failures = 0 WHERE name = $1 AND consecutive_failures > 0 AND disabled_at IS NULL`
+
+	_, err := pg.db.Exec(query, name)
+	return err
+}
+
+// EnableIntegration re-enables a disabled integration and clears its failures
+func (pg *PostgreSQLDatabase) EnableIntegration(name string) error {
+	result, err := pg.db.Exec(`UPDATE integrations SET disabled_at = NULL, consecutive_failures = 0 WHERE name = $1`, name)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("integration not found")
+	}
+	return nil
+}
+
+// CreateOutboxEvent queues an event for durable delivery to an integration
+func (pg *PostgreSQLDatabase) CreateOutboxEvent(event *OutboxEvent) error {
+	payload, err := json.Marshal(event.Event)
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO event_outbox (integration, payload) VALUES ($1, $2) RETURNING id, created_at`
+	return pg.db.QueryRow(query, event.Integration, payload).Scan(&event.ID, &event.CreatedAt)
+}
+
+// ClaimOutboxEvents returns up to limit undelivered events that are due,
+// hiding them from other instances for the lease duration
+func (pg *PostgreSQLDatabase) ClaimOutboxEvents(limit int, lease time.Duration) ([]*OutboxEvent, error) {
+	query := `
+	UPDATE event_outbox SET next_attempt_at = NOW() + $2 * INTERVAL '1 second'
+	WHERE id IN (
+		SELECT id FROM event_outbox
+		WHERE delivered_at IS NULL AND failed_at IS NULL AND next_attempt_at <= NOW()
+		ORDER BY id
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED
+	)
+	RETURNING id, integration, payload, attempts, last_error, created_at`
+
+	rows, err := pg.db.Query(query, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []*OutboxEvent{}
+	for rows.Next() {
+		event := &OutboxEvent{}
+		var payload []byte
+		if err := rows.Scan(&event.ID, &event.Integration, &payload, &event.Attempts, &event.LastError, &event.CreatedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(payload, &event.Event); err != nil {
+			return nil, fmt.Errorf("decoding outbox event %d: %w", event.ID, err)
+		}
+		events = append(events, event)
+	}
+
+	return events, rows.Err()
+}
+
+// MarkOutboxEventDelivered records that an outbox event was delivered
+func (pg *PostgreSQLDatabase) MarkOutboxEventDelivered(id int64) error {
+	_, err := pg.db.Exec(`UPDATE event_outbox SET delivered_at = NOW() WHERE id = $1`, id)
+	return err
+}
+
+// RetryOutboxEvent records a failed delivery attempt and schedules the next one
+func (pg *PostgreSQLDatabase) RetryOutboxEvent(id int64, lastError string, nextAttemptAt time.Time) error {
+	query := `UPDATE event_outbox SET attempts = attempts + 1, last_error = $2, next_attempt_at = $3 WHERE id = $1`
+
+	_, err := pg.db.Exec(query, id, lastError, nextAttemptAt)
+	return err
+}
+
+// DeferOutboxEvent postpones an outbox event without counting an attempt
+func (pg *PostgreSQLDatabase) DeferOutboxEvent(id int64, nextAttemptAt time.Time) error {
+	_, err := pg.db.Exec(`UPDATE event_outbox SET next_attempt_at = $2 WHERE id = $1`, id, nextAttemptAt)
+	return err
+}
+
+// FailOutboxEvent gives up on an outbox event after its final failed attempt
+func (pg *PostgreSQLDatabase) FailOutboxEvent(id int64, lastError string) error {
+	query := `UPDATE event_outbox SET attempts = attempts + 1, last_error = $2, failed_at = NOW() WHERE id = $1`
+
+	_, err := pg.db.Exec(query, id, lastError)
+	return err
+}
+
+// OutboxBacklog counts undelivered outbox events per integration
+func (pg *PostgreSQLDatabase) OutboxBacklog() ([]*OutboxBacklog, error) {
+	query := `
+	SELECT integration, COUNT(*), MIN(created_at) FROM event_outbox
+	WHERE delivered_at IS NULL AND failed_at IS NULL
+	GROUP BY integration`
+
+	rows, err := pg.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	backlogs := []*OutboxBacklog{}
+	for rows.Next() {
+		backlog := &OutboxBacklog{}
+		if err := rows.Scan(&backlog.Integration, &backlog.Pending, &backlog.OldestCreated); err != nil {
+			return nil, err
+		}
+		backlogs = append(backlogs, backlog)
+	}
+
+	return backlogs, rows.Err()
+}
+
+// DeleteDeliveredOutboxEvents removes events delivered before the cutoff
+func (pg *PostgreSQLDatabase) DeleteDeliveredOutboxEvents(before time.Time) (int64, error) {
+	result, err := pg.db.Exec(`DELETE FROM event_outbox WHERE delivered_at < $1`, before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// GetQueueStats summarises the queue now and the wait of builds started since the given time
+func (pg *PostgreSQLDatabase) GetQueueStats(since time.Time) (*QueueStats, error) {
+	// Builds of paused projects are waiting on purpose, not on the service
+	query := `
+	WITH schedulable AS (
+		SELECT created_at FROM builds
+		WHERE status = 'queued'
+		AND NOT EXISTS (SELECT 1 FROM projects WHERE projects.name = builds.project_name AND projects.paused_at IS NOT NULL)
+	)
+	SELECT
+		(SELECT COUNT(*) FROM schedulable),
+		(SELECT COUNT(*) FROM builds WHERE status = 'running'),
+		(SELECT MIN(created_at) FROM schedulable),
+		COUNT(*),
+		COALESCE(PERCENTILE_CONT(0.5) WITHIN GROUP (ORDER BY EXTRACT(EPOCH FROM started_at - created_at)), 0),
+		COALESCE(PERCENTILE_CONT(0.95) WITHIN GROUP (ORDER BY EXTRACT(EPOCH FROM started_at - created_at)), 0)
+	FROM builds
+	WHERE started_at >= $1`
+
+	stats := &QueueStats{}
+	var p50, p95 float64
+	err := pg.db.QueryRow(query, since).Scan(&stats.Queued, &stats.Running, &stats.OldestQueuedAt, &stats.Started, &p50, &p95)
+	if err != nil {
+		return nil, err
+	}
+	stats.WaitP50 = time.Duration(p50 * float64(time.Second))
+	stats.WaitP95 = time.Duration(p95 * float64(time.Second))
+
+	return stats, nil
+}
+
+// incidentColumns lists the status_incidents table columns in the order scanIncident expects
+const incidentColumns = `id, kind, impact, title, message, starts_at, ends_at, resolved_at, created_at, updated_at`
+
+// scanIncident reads a single status_incidents row selected with incidentColumns
+func scanIncident(row rowScanner) (*Incident, error) {
+	incident := &Incident{}
+	err := row.Scan(
+		&incident.ID,
+		&incident.Kind,
+		&incident.Impact,
+		&incident.Title,
+		&incident.Message,
+		&incident.StartsAt,
+		&incident.EndsAt,
+		&incident.ResolvedAt,
+		&incident.CreatedAt,
+		&incident.UpdatedAt,
+	)
+	return incident, err
+}
+
+// CreateIncident records an incident or scheduled maintenance
+func (pg *PostgreSQLDatabase) CreateIncident(incident *Incident) error {
+	query := `
+	INSERT INTO status_incidents (kind, impact, title, message, starts_at, ends_at)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	RETURNING id, created_at, updated_at`
+
+	return pg.db.QueryRow(
+		query,
+		incident.Kind,
+		incident.Impact,
+		incident.Title,
+		incident.Message,
+		incident.StartsAt,
+		incident.EndsAt,
+	).Scan(&incident.ID, &incident.CreatedAt, &incident.UpdatedAt)
+}
+
+// GetIncident retrieves an incident by ID
+func (pg *PostgreSQLDatabase) GetIncident(id int) (*Incident, error) {
+	query := `SELECT ` + incidentColumns + ` FROM status_incidents WHERE id = $1`
+
+	incident, err := scanIncident(pg.db.QueryRow(query, id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("incident not found")
+	}
+
+	return incident, err
+}
+
+// UpdateIncident saves the mutable fields of an incident
+func (pg *PostgreSQLDatabase) UpdateIncident(incident *Incident) error {
+	query := `
+	UPDATE status_incidents
+	SET impact = $1, title = $2, message = $3, starts_at = $4, ends_at = $5, resolved_at = $6, updated_at = $7
+	WHERE id = $8
+	`
+
+	_, err := pg.db.Exec(
+		query,
+		incident.Impact,
+		incident.Title,
+		incident.Message,
+		incident.StartsAt,
+		incident.EndsAt,
+		incident.ResolvedAt,
+		incident.UpdatedAt,
+		incident.ID,
+	)
+	return err
+}
+
+// ListIncidents retrieves unresolved incidents, or the 100 most recent of all
+// incidents when includeResolved is set
+func (pg *PostgreSQLDatabase) ListIncidents(includeResolved bool) ([]*Incident, error) {
+	query := `SELECT ` + incidentColumns + ` FROM status_incidents WHERE resolved_at IS NULL ORDER BY starts_at`
+	if includeResolved {
+		query = `SELECT ` + incidentColumns + ` FROM status_incidents ORDER BY starts_at DESC LIMIT 100`
+	}
+
+	rows, err := pg.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	incidents := []*Incident{}
+	for rows.Next() {
+		incident, err := scanIncident(rows)
+		if err != nil {
+			return nil, err
+		}
+		incidents = append(incidents, incident)
+	}
+
+	return incidents, rows.Err()
+}
+
+// deploymentColumns lists the deployments table columns in the order scanDeployment expects
+const deploymentColumns = `id, build_id, project_name, environment, status, description, triggered_by, live_at, rolled_back_at, created_at, updated_at`
+
+// scanDeployment reads a single deployments row selected with deploymentColumns
+func scanDeployment(row rowScanner) (*Deployment, error) {
+	deployment := &Deployment{}
+	err := row.Scan(
+		&deployment.ID,
+		&deployment.BuildID,
+		&deployment.ProjectName,
+		&deployment.Environment,
+		&deployment.Status,
+		&deployment.Description,
+		&deployment.TriggeredBy,
+		&deployment.LiveAt,
+		&deployment.RolledBackAt,
+		&deployment.CreatedAt,
+		&deployment.UpdatedAt,
+	)
+	return deployment, err
+}
+
+// CreateDeployment records a new deployment
+func (pg *PostgreSQLDatabase) CreateDeployment(deployment *Deployment) error {
+	query := `
+	INSERT INTO deployments (build_id, project_name, environment, status, description, triggered_by)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	RETURNING id, created_at, updated_at`
+
+	return pg.db.QueryRow(
+		query,
+		deployment.BuildID,
+		deployment.ProjectName,
+		deployment.Environment,
+		deployment.Status,
+		deployment.Description,
+		deployment.TriggeredBy,
+	).Scan(&deployment.ID, &deployment.CreatedAt, &deployment.UpdatedAt)
+}
+
+// GetDeployment retrieves a deployment by ID
+func (pg *PostgreSQLDatabase) GetDeployment(id int) (*Deployment, error) {
+	query := `SELECT ` + deploymentColumns + ` FROM deployments WHERE id = $1`
+
+	deployment, err := scanDeployment(pg.db.QueryRow(query, id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("deployment not found")
+	}
+
+	return deployment, err
+}
+
+// UpdateDeploymentStatus moves a deployment from one status to another,
+// recording when it went live or was rolled back. It fails if the deployment
+// is no longer in the from status.
+func (pg *PostgreSQLDatabase) UpdateDeploymentStatus(id int, from, to string) (*Deployment, error) {
+	query := `
+	UPDATE deployments
+	SET status = $3,
+	    live_at = CASE WHEN $3 = 'live' THEN NOW() ELSE live_at END,
+	    rolled_back_at = CASE WHEN $3 = 'rolled_back' THEN NOW() ELSE rolled_back_at END,
+	    updated_at = NOW()
+	WHERE id = $1 AND status = $2
+	RETURNING ` + deploymentColumns
+
+	deployment, err := scanDeployment(pg.db.QueryRow(query, id, from, to))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("deployment status changed")
+	}
+
+	return deployment, err
+}
+
+// ListDeployments retrieves the 100 most recent deployments, optionally only
+// those of a project and/or environment, and of builds of an org
+func (pg *PostgreSQLDatabase) ListDeployments(projectName, environment, org string) ([]*Deployment, error) {
+	query := `
+	SELECT ` + deploymentColumns + `
+	FROM deployments
+	WHERE ($1 = '' OR project_name = $1) AND ($2 = '' OR environment = $2)
+	AND ($3 = '' OR build_id IN (SELECT id FROM builds WHERE org = $3))
+	ORDER BY created_at DESC, id DESC
+	LIMIT 100`
+
+	rows, err := pg.db.Query(query, projectName, environment, org)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deployments := []*Deployment{}
+	for rows.Next() {
+		deployment, err := scanDeployment(rows)
+		if err != nil {
+			return nil, err
+		}
+		deployments = append(deployments, deployment)
+	}
+
+	return deployments, rows.Err()
+}
+
+// webhookSubscriptionColumns lists the webhook_subscriptions table columns in
+// the order scanWebhookSubscription expects
+const webhookSubscriptionColumns = `id, url, secret, statuses, projects, fields, enabled, created_at, updated_at, events`
+
+// scanWebhookSubscription reads a single webhook_subscriptions row selected
+// with webhookSubscriptionColumns, decrypting its secret
+func (pg *PostgreSQLDatabase) scanWebhookSubscription(row rowScanner) (*WebhookSubscription, error) {
+	subscription := &WebhookSubscription{}
+	var fields []byte
+	err := row.Scan(
+		&subscription.ID,
+		&subscription.URL,
+		&subscription.Secret,
+		pq.Array(&subscription.Statuses),
+		pq.Array(&subscription.Projects),
+		&fields,
+		&subscription.Enabled,
+		&subscription.CreatedAt,
+		&subscription.UpdatedAt,
+		pq.Array(&subscription.Events),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(fields, &subscription.Fields); err != nil {
+		return nil, fmt.Errorf("decoding webhook subscription fields: %w", err)
+	}
+	if subscription.Secret, err = pg.credentials.Open(subscription.Secret); err != nil {
+		return nil, fmt.Errorf("webhook subscription %d: %w", subscription.ID, err)
+	}
+	return subscription, nil
+}
+
+// webhookSubscriptionArgs returns the mutable columns of a subscription in the
+// order CreateWebhookSubscription and UpdateWebhookSubscription expect, with
+// the secret sealed with the primary credential key
+func (pg *PostgreSQLDatabase) webhookSubscriptionArgs(subscription *WebhookSubscription) ([]interface{}, error) {
+	fields, err := json.Marshal(subscription.Fields)
+	if err != nil {
+		return nil, err
+	}
+	if subscription.Fields == nil {
+		fields = []byte("{}")
+	}
+	secret, err := pg.credentials.Seal(subscription.Secret)
+	if err != nil {
+		return nil, fmt.Errorf("encrypting webhook secret: %w", err)
+	}
+	return []interface{}{
+		subscription.URL,
+		secret,
+		pq.Array(nonNilStrings(subscription.Statuses)),
+		pq.Array(nonNilStrings(subscription.Projects)),
+		fields,
+		subscription.Enabled,
+		pq.Array(nonNilStrings(subscription.Events)),
+	}, nil
+}
+
+// nonNilStrings returns values, or an empty slice when it is nil, so that it
+// is stored as an empty array rather than NULL
+func nonNilStrings(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+	return values
+}
+
+// int64s converts IDs for storing in an INTEGER[] column, never returning nil
+func int64s(values []int) []int64 {
+	converted := make([]int64, len(values))
+	for i, value := range values {
+		converted[i] = int64(value)
+	}
+	return converted
+}
+
+// CreateWebhookSubscription stores a new webhook subscription
+func (pg *PostgreSQLDatabase) CreateWebhookSubscription(subscription *WebhookSubscription) error {
+	query := `
+	INSERT INTO webhook_subscriptions (url, secret, statuses, projects, fields, enabled, events)
+	VALUES ($1, $2, $3, $4, $5, $6, $7)
+	RETURNING id, created_at, updated_at`
+
+	args, err := pg.webhookSubscriptionArgs(subscription)
+	if err != nil {
+		return err
+	}
+	return pg.db.QueryRow(query, args...).Scan(&subscription.ID, &subscription.CreatedAt, &subscription.UpdatedAt)
+}
+
+// GetWebhookSubscription retrieves a webhook subscription by ID
+func (pg *PostgreSQLDatabase) GetWebhookSubscription(id int) (*WebhookSubscription, error) {
+	query := `SELECT ` + webhookSubscriptionColumns + ` FROM webhook_subscriptions WHERE id = $1`
+
+	subscription, err := pg.scanWebhookSubscription(pg.db.QueryRow(query, id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("webhook subscription not found")
+	}
+
+	return subscription, err
+}
+
+// UpdateWebhookSubscription saves the mutable fields of a webhook subscription
+func (pg *PostgreSQLDatabase) UpdateWebhookSubscription(subscription *WebhookSubscription) error {
+	query := `
+	UPDATE webhook_subscriptions
+	SET url = $1, secret = $2, statuses = $3, projects = $4, fields = $5, enabled = $6, events = $7, updated_at = $8
+	WHERE id = $9
+	`
+
+	args, err := pg.webhookSubscriptionArgs(subscription)
+	if err != nil {
+		return err
+	}
+	_, err = pg.db.Exec(query, append(args, subscription.UpdatedAt, subscription.ID)...)
+	return err
+}
+
+// DeleteWebhookSubscription removes a webhook subscription
+func (pg *PostgreSQLDatabase) DeleteWebhookSubscription(id int) error {
+	result, err := pg.db.Exec(`DELETE FROM webhook_subscriptions WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return fmt.Errorf("webhook subscription not found")
+	}
+	return nil
+}
+
+// ListWebhookSubscriptions retrieves every webhook subscription
+func (pg *PostgreSQLDatabase) ListWebhookSubscriptions() ([]*WebhookSubscription, error) {
+	rows, err := pg.db.Query(`SELECT ` + webhookSubscriptionColumns + ` FROM webhook_subscriptions ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subscriptions := []*WebhookSubscription{}
+	for rows.Next() {
+		subscription, err := pg.scanWebhookSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, subscription)
+	}
+
+	return subscriptions, rows.Err()
+}
+
+// webhookDeliveryColumns lists the webhook_deliveries table columns in the
+// order scanWebhookDelivery expects
+const webhookDeliveryColumns = `id, subscription_id, build_id, event, build_status, payload, status, attempts, response_status, last_error, next_attempt_at, delivered_at, created_at, updated_at`
+
+// scanWebhookDelivery reads a single webhook_deliveries row selected with
+// webhookDeliveryColumns
+func scanWebhookDelivery(row rowScanner) (*WebhookDelivery, error) {
+	delivery := &WebhookDelivery{}
+	var payload string
+	err := row.Scan(
+		&delivery.ID,
+		&delivery.SubscriptionID,
+		&delivery.BuildID,
+		&delivery.Event,
+		&delivery.BuildStatus,
+		&payload,
+		&delivery.Status,
+		&delivery.Attempts,
+		&delivery.ResponseStatus,
+		&delivery.LastError,
+		&delivery.NextAttemptAt,
+		&delivery.DeliveredAt,
+		&delivery.CreatedAt,
+		&delivery.UpdatedAt,
+	)
+	delivery.Payload = json.RawMessage(payload)
+	return delivery, err
+}
+
+// queryWebhookDeliveries runs a query selecting webhookDeliveryColumns
+func (pg *PostgreSQLDatabase) queryWebhookDeliveries(query string, args ...interface{}) ([]*WebhookDelivery, error) {
+	rows, err := pg.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []*WebhookDelivery{}
+	for rows.Next() {
+		delivery, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, rows.Err()
+}
+
+// CreateWebhookDelivery records a delivery about to be sent
+func (pg *PostgreSQLDatabase) CreateWebhookDelivery(delivery *WebhookDelivery) error {
+	query := `
+	INSERT INTO webhook_deliveries (subscription_id, build_id, event, build_status, payload, status)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	RETURNING id, created_at, updated_at`
+
+	return pg.db.QueryRow(query, delivery.SubscriptionID, delivery.BuildID, delivery.Event, delivery.BuildStatus,
+		string(delivery.Payload), delivery.Status).Scan(&delivery.ID, &delivery.CreatedAt, &delivery.UpdatedAt)
+}
+
+// GetWebhookDelivery retrieves a webhook delivery by ID
+func (pg *PostgreSQLDatabase) GetWebhookDelivery(id int) (*WebhookDelivery, error) {
+	query := `SELECT ` + webhookDeliveryColumns + ` FROM webhook_deliveries WHERE id = $1`
+
+	delivery, err := scanWebhookDelivery(pg.db.QueryRow(query, id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("webhook delivery not found")
+	}
+
+	return delivery, err
+}
+
+// UpdateWebhookDelivery saves the outcome of a delivery attempt
+func (pg *PostgreSQLDatabase) UpdateWebhookDelivery(delivery *WebhookDelivery) error {
+	query := `
+	UPDATE webhook_deliveries
+	SET status = $2, attempts = $3, response_status = $4, last_error = $5, next_attempt_at = $6, delivered_at = $7, updated_at = $8
+	WHERE id = $1
+	`
+
+	_, err := pg.db.Exec(query, delivery.ID, delivery.Status, delivery.Attempts, delivery.ResponseStatus,
+		delivery.LastError, delivery.NextAttemptAt, delivery.DeliveredAt, delivery.UpdatedAt)
+	return err
+}
+
+// ListWebhookDeliveries returns the most recent deliveries of a subscription,
+// optionally only those with the given status
+func (pg *PostgreSQLDatabase) ListWebhookDeliveries(subscriptionID int, status string, limit int) ([]*WebhookDelivery, error) {
+	query := `
+	SELECT ` + webhookDeliveryColumns + `
+	FROM webhook_deliveries
+	WHERE subscription_id = $1 AND ($2 = '' OR status = $2)
+	ORDER BY id DESC
+	LIMIT $3
+	`
+
+	return pg.queryWebhookDeliveries(query, subscriptionID, status, limit)
+}
+
+// ClaimWebhookDeliveries leases up to limit pending deliveries whose next
+// attempt is due, hiding them from other instances for the lease
+func (pg *PostgreSQLDatabase) ClaimWebhookDeliveries(limit int, lease time.Duration) ([]*WebhookDelivery, error) {
+	query := `
+	UPDATE webhook_deliveries SET next_attempt_at = NOW() + $2 * INTERVAL '1 second'
+	WHERE id IN (
+		SELECT id FROM webhook_deliveries
+		WHERE status = 'pending' AND next_attempt_at <= NOW()
+		ORDER BY id
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED
+	)
+	RETURNING ` + webhookDeliveryColumns
+
+	return pg.queryWebhookDeliveries(query, limit, lease.Seconds())
+}
+
+// DeleteWebhookDeliveriesBefore prunes the delivery history created before
+// cutoff, keeping deliveries that are still being retried
+func (pg *PostgreSQLDatabase) DeleteWebhookDeliveriesBefore(cutoff time.Time) (int64, error) {
+	result, err := pg.db.Exec(`DELETE FROM webhook_deliveries WHERE created_at < $1 AND status <> 'pending'`, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// buildScheduleColumns lists the build_schedules table columns in the order
+// scanBuildSchedule expects
+const buildScheduleColumns = `id, project_id, cron, timezone, branch, enabled, next_run_at, last_run_at, last_build_id, created_at, updated_at`
+
+func scanBuildSchedule(row rowScanner) (*BuildSchedule, error) {
+	schedule := &BuildSchedule{}
+	err := row.Scan(
+		&schedule.ID,
+		&schedule.ProjectID,
+		&schedule.Cron,
+		&schedule.Timezone,
+		&schedule.Branch,
+		&schedule.Enabled,
+		&schedule.NextRunAt,
+		&schedule.LastRunAt,
+		&schedule.LastBuildID,
+		&schedule.CreatedAt,
+		&schedule.UpdatedAt,
+	)
+	return schedule, err
+}
+
+func (pg *PostgreSQLDatabase) queryBuildSchedules(query string, args ...interface{}) ([]*BuildSchedule, error) {
+	rows, err := pg.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	schedules := []*BuildSchedule{}
+	for rows.Next() {
+		schedule, err := scanBuildSchedule(rows)
+		if err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, schedule)
+	}
+
+	return schedules, rows.Err()
+}
+
+// CreateBuildSchedule stores a new build schedule
+func (pg *PostgreSQLDatabase) CreateBuildSchedule(schedule *BuildSchedule) error {
+	query := `
+	INSERT INTO build_schedules (project_id, cron, timezone, branch, enabled, next_run_at)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	RETURNING id, created_at, updated_at`
+
+	err := pg.db.QueryRow(query, schedule.ProjectID, schedule.Cron, schedule.Timezone, schedule.Branch, schedule.Enabled, schedule.NextRunAt).
+		Scan(&schedule.ID, &schedule.CreatedAt, &schedule.UpdatedAt)
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+		return fmt.Errorf("project not found")
+	}
+	return err
+}
+
+// GetBuildSchedule retrieves a build schedule by ID
+func (pg *PostgreSQLDatabase) GetBuildSchedule(id int) (*BuildSchedule, error) {
+	query := `SELECT ` + buildScheduleColumns + ` FROM build_schedules WHERE id = $1`
+
+	schedule, err := scanBuildSchedule(pg.db.QueryRow(query, id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("build schedule not found")
+	}
+
+	return schedule, err
+}
+
+// ListBuildSchedules retrieves the build schedules of a project
+func (pg *PostgreSQLDatabase) ListBuildSchedules(projectID int) ([]*BuildSchedule, error) {
+	query := `SELECT ` + buildScheduleColumns + ` FROM build_schedules WHERE project_id = $1 ORDER BY id`
+
+	return pg.queryBuildSchedules(query, projectID)
+}
+
+// UpdateBuildSchedule saves the mutable fields of a build schedule
+func (pg *PostgreSQLDatabase) UpdateBuildSchedule(schedule *BuildSchedule) error {
+	query := `
+	UPDATE build_schedules
+	SET cron = $1, timezone = $2, branch = $3, enabled = $4, next_run_at = $5, updated_at = $6
+	WHERE id = $7
+	`
+
+	_, err := pg.db.Exec(query, schedule.Cron, schedule.Timezone, schedule.Branch, schedule.Enabled, schedule.NextRunAt, schedule.UpdatedAt, schedule.ID)
+	return err
+}
+
+// DisableBuildSchedules disables the given schedules, returning how many
+// were enabled
+func (pg *PostgreSQLDatabase) DisableBuildSchedules(ids []int) (int64, error) {
+	query := `
+	UPDATE build_schedules
+	SET enabled = FALSE, next_run_at = NULL, updated_at = NOW()
+	WHERE id = ANY($1) AND enabled`
+
+	result, err := pg.db.Exec(query, pq.Array(int64s(ids)))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// ListStaleBranches retrieves the branches of a project, other than its
+// default branch, whose last build triggered by one of the activity sources
+// was before the given time. Branches known from their builds or schedules
+// that never had such a build are stale once they're older than that.
+// Least recently active branches come first.
+func (pg *PostgreSQLDatabase) ListStaleBranches(project *Project, before time.Time, activity []string) ([]*StaleBranch, error) {
+	query := `
+	WITH branches AS (
+		SELECT branch,
+			MAX(created_at) FILTER (WHERE trigger_source = ANY($3)) AS last_activity_at,
+			MIN(created_at) AS first_seen_at,
+			MAX(created_at) AS last_build_at,
+			(ARRAY_AGG(id ORDER BY created_at DESC, id DESC))[1] AS last_build_id
+		FROM builds
+		WHERE project_name = $1 AND branch <> '' AND pull_request IS NULL
+		GROUP BY branch
+		UNION ALL
+		SELECT branch, NULL, MIN(created_at), NULL, NULL
+		FROM build_schedules
+		WHERE project_id = $2
+		GROUP BY branch
+	), merged AS (
+		SELECT branch, MAX(last_activity_at) AS last_activity_at, MIN(first_seen_at) AS first_seen_at,
+			MAX(last_build_at) AS last_build_at, MAX(last_build_id) AS last_build_id
+		FROM branches
+		GROUP BY branch
+	)
+	SELECT merged.branch, merged.last_activity_at, merged.last_build_at, merged.last_build_id,
+		ARRAY(SELECT id FROM build_schedules WHERE project_id = $2 AND branch = merged.branch AND enabled ORDER BY id)
+	FROM merged
+	WHERE merged.branch <> $4 AND COALESCE(merged.last_activity_at, merged.first_seen_at) < $5
+	ORDER BY merged.last_activity_at NULLS FIRST, merged.branch`
+
+	rows, err := pg.db.Query(query, project.Name, project.ID, pq.Array(activity), project.DefaultBranch, before)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	branches := []*StaleBranch{}
+	for rows.Next() {
+		branch := &StaleBranch{ScheduleIDs: []int{}}
+		var scheduleIDs pq.Int64Array
+		if err := rows.Scan(&branch.Branch, &branch.LastActivityAt, &branch.LastBuildAt, &branch.LastBuildID, &scheduleIDs); err != nil {
+			return nil, err
+		}
+		for _, id := range scheduleIDs {
+			branch.ScheduleIDs = append(branch.ScheduleIDs, int(id))
+		}
+		branches = append(branches, branch)
+	}
+
+	return branches, rows.Err()
+}
+
+// DeleteBuildSchedule removes a build schedule. Builds it enqueued keep
+// running but no longer refer to it.
+func (pg *PostgreSQLDatabase) DeleteBuildSchedule(id int) error {
+	result, err := pg.db.Exec(`DELETE FROM build_schedules WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return fmt.Errorf("build schedule not found")
+	}
+	return nil
+}
+
+// ListDueBuildSchedules retrieves the enabled schedules whose next run is at
+// or before now
+func (pg *PostgreSQLDatabase) ListDueBuildSchedules(now time.Time) ([]*BuildSchedule, error) {
+	query := `
+	SELECT ` + buildScheduleColumns + `
+	FROM build_schedules
+	WHERE enabled AND next_run_at <= $1
+	ORDER BY next_run_at, id
+	`
+
+	return pg.queryBuildSchedules(query, now)
+}
+
+// RecordBuildScheduleRun records a run of a schedule, the build it enqueued
+// if any, and when it runs next
+func (pg *PostgreSQLDatabase) RecordBuildScheduleRun(id int, ranAt time.Time, buildID *int, next *time.Time) error {
+	query := `
+	UPDATE build_schedules
+	SET last_run_at = $2, last_build_id = COALESCE($3, last_build_id), next_run_at = $4
+	WHERE id = $1
+	`
+
+	_, err := pg.db.Exec(query, id, ranAt, buildID, next)
+	return err
+}
+
+// pgAdvisoryLock is a session-level advisory lock, held for as long as its
+// dedicated connection stays open
+type pgAdvisoryLock struct {
+	conn *sql.Conn
+	key  int64
+}
+
+// TryAdvisoryLock takes the advisory lock key without waiting, returning nil
+// when another session holds it
+func (pg *PostgreSQLDatabase) TryAdvisoryLock(key int64) (AdvisoryLock, error) {
+	ctx := context.Background()
+
+	// Advisory locks belong to a session, so the lock keeps its connection
+	conn, err := pg.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var acquired bool
+	if err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, key).Scan(&acquired); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !acquired {
+		conn.Close()
+		return nil, nil
+	}
+	return &pgAdvisoryLock{conn: conn, key: key}, nil
+}
+
+// Held reports whether the lock's session is still alive; the server
+// releases the lock when the connection is lost
+func (l *pgAdvisoryLock) Held() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := l.conn.ExecContext(ctx, `SELECT 1`)
+	return err == nil
+}
+
+// Release unlocks and returns the connection to the pool
+func (l *pgAdvisoryLock) Release() {
+	l.conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, l.key)
+	l.conn.Close()
+}
+
+// ProjectQueueWaits reports the queue of every unpaused project with a queue
+// wait SLA
+func (pg *PostgreSQLDatabase) ProjectQueueWaits() ([]*ProjectQueueWait, error) {
+	query := `
+	SELECT p.name, p.max_queue_wait_seconds, COUNT(b.id), MIN(b.created_at)
+	FROM projects p
+	LEFT JOIN builds b ON b.project_name = p.name AND b.status = 'queued'
+	WHERE p.max_queue_wait_seconds > 0 AND p.paused_at IS NULL
+	GROUP BY p.name, p.max_queue_wait_seconds`
+
+	rows, err := pg.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	waits := []*ProjectQueueWait{}
+	for rows.Next() {
+		wait := &ProjectQueueWait{}
+		var maxWait int
+		if err := rows.Scan(&wait.Project, &maxWait, &wait.Queued, &wait.OldestQueuedAt); err != nil {
+			return nil, err
+		}
+		wait.MaxWait = time.Duration(maxWait) * time.Second
+		waits = append(waits, wait)
+	}
+
+	return waits, rows.Err()
+}
+
+// ListUserQueueUsage reports the queued and running builds of every user with
+// builds in the queue, of one org or of all orgs when org is empty
+func (pg *PostgreSQLDatabase) ListUserQueueUsage(org string, fairShare int) ([]*UserQueueUsage, error) {
+	query := `
+	SELECT b.org, b.triggered_by,
+		COUNT(*) FILTER (WHERE b.status = 'queued'),
+		COUNT(*) FILTER (WHERE b.status = 'running'),
+		COALESCE(f.max_running_per_user, $2)
+	FROM builds b
+	LEFT JOIN fair_share_limits f ON f.org = b.org
+	WHERE b.status IN ('queued', 'running') AND ($1 = '' OR b.org = $1)
+	GROUP BY b.org, b.triggered_by, f.max_running_per_user
+	ORDER BY b.org, COUNT(*) DESC, b.triggered_by`
+
+	rows, err := pg.db.Query(query, org, fairShare)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usage := []*UserQueueUsage{}
+	for rows.Next() {
+		user := &UserQueueUsage{}
+		if err := rows.Scan(&user.Org, &user.User, &user.Queued, &user.Running, &user.MaxRunning); err != nil {
+			return nil, err
+		}
+		usage = append(usage, user)
+	}
+
+	return usage, rows.Err()
+}
+
+// GetQueueState reports a queued build's place in the queue, counting the
+// claimable builds ClaimNextBuild claims before it, and what keeps it waiting
+func (pg *PostgreSQLDatabase) GetQueueState(id int, fairShare int) (*QueueState, error) {
+	query := `
+	WITH queued AS (
+		SELECT builds.id, builds.created_at,
+			EXISTS (SELECT 1 FROM projects WHERE projects.name = builds.project_name AND projects.paused_at IS NOT NULL) AS paused,
+			ARRAY(
+				SELECT upstream.id FROM builds upstream
+				WHERE upstream.id = ANY(builds.depends_on) AND upstream.status <> 'success'
+				ORDER BY upstream.id
+			) AS blocked_by,
+			(
+				SELECT COUNT(*) FROM builds running
+				WHERE running.status = 'running' AND running.org = builds.org AND running.triggered_by = builds.triggered_by
+			) AS user_running,
+			COALESCE(fair_share_limits.max_running_per_user, $2) AS max_running
+		FROM builds
+		LEFT JOIN fair_share_limits ON fair_share_limits.org = builds.org
+		WHERE builds.status = 'queued'
+	), ranked AS (
+		SELECT *, max_running > 0 AND user_running >= max_running AS over_share FROM queued
+	)
+	SELECT
+		(
+			SELECT COUNT(*) FROM ranked ahead
+			WHERE NOT ahead.paused AND cardinality(ahead.blocked_by) = 0
+			AND (ahead.over_share, ahead.created_at, ahead.id) < (target.over_share, target.created_at, target.id)
+		),
+		(SELECT COUNT(*) FROM ranked),
+		(SELECT COUNT(*) FROM builds WHERE status = 'running'),
+		target.paused, target.blocked_by, target.user_running, target.max_running, target.over_share,
+		(SELECT COUNT(*) FROM builds WHERE started_at > NOW() - INTERVAL '1 hour'),
+		EXISTS (SELECT 1 FROM queue_state WHERE paused_at IS NOT NULL)
+	FROM ranked target
+	WHERE target.id = $1`
+
+	state := &QueueState{}
+	var blockedBy pq.Int64Array
+	err := pg.db.QueryRow(query, id, fairShare).Scan(&state.Ahead, &state.Queued, &state.Running,
+		&state.Paused, &blockedBy, &state.UserRunning, &state.MaxRunning, &state.OverShare, &state.StartedLastHour, &state.QueuePaused)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("build not queued")
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, upstream := range blockedBy {
+		state.BlockedBy = append(state.BlockedBy, int(upstream))
+	}
+	return state, nil
+}
+
+// GetQueueDepth counts the queued builds by what they wait for and by org
+func (pg *PostgreSQLDatabase) GetQueueDepth() (*QueueDepth, error) {
+	query := `
+	SELECT builds.org,
+		CASE
+			WHEN EXISTS (SELECT 1 FROM projects WHERE projects.name = builds.project_name AND projects.paused_at IS NOT NULL) THEN 'project_paused'
+			WHEN EXISTS (SELECT 1 FROM builds upstream WHERE upstream.id = ANY(builds.depends_on) AND upstream.status <> 'success') THEN 'dependencies'
+			ELSE 'ready'
+		END AS reason,
+		COUNT(*)
+	FROM builds
+	WHERE builds.status = 'queued'
+	GROUP BY 1, 2`
+
+	rows, err := pg.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	depth := &QueueDepth{ByReason: map[string]int{}, ByOrg: map[string]int{}}
+	for rows.Next() {
+		var org, reason string
+		var count int
+		if err := rows.Scan(&org, &reason, &count); err != nil {
+			return nil, err
+		}
+		depth.Queued += count
+		depth.ByReason[reason] += count
+		depth.ByOrg[org] += count
+	}
+
+	return depth, rows.Err()
+}
+
+// GetQueueControl reports whether the queue is paused
+func (pg *PostgreSQLDatabase) GetQueueControl() (*QueueControl, error) {
+	control := &QueueControl{}
+	err := pg.db.QueryRow(`SELECT paused_at, pause_reason FROM queue_state`).Scan(&control.PausedAt, &control.PauseReason)
+	control.Paused = control.PausedAt != nil
+	return control, err
+}
+
+// SetQueuePaused pauses or resumes claiming of queued builds by every worker
+func (pg *PostgreSQLDatabase) SetQueuePaused(paused bool, reason string) (*QueueControl, error) {
+	query := `
+	UPDATE queue_state
+	SET paused_at = CASE WHEN $1 THEN COALESCE(paused_at, NOW()) END,
+		pause_reason = CASE WHEN $1 THEN $2 ELSE '' END
+	RETURNING paused_at, pause_reason`
+
+	control := &QueueControl{}
+	err := pg.db.QueryRow(query, paused, reason).Scan(&control.PausedAt, &control.PauseReason)
+	control.Paused = control.PausedAt != nil
+	return control, err
+}
+
+// RegisterWorker records a worker's heartbeat, keeping whether it's draining,
+// and forgets workers that haven't been heard from in a day
+func (pg *PostgreSQLDatabase) RegisterWorker(worker *Worker) error {
+	query := `
+	INSERT INTO workers (id, hostname, slots, started_at, heartbeat_at)
+	VALUES ($1, $2, $3, $4, NOW())
+	ON CONFLICT (id) DO UPDATE SET slots = EXCLUDED.slots, heartbeat_at = NOW()`
+
+	if _, err := pg.db.Exec(query, worker.ID, worker.Hostname, worker.Slots, worker.StartedAt); err != nil {
+		return err
+	}
+	_, err := pg.db.Exec(`DELETE FROM workers WHERE heartbeat_at < NOW() - INTERVAL '1 day'`)
+	return err
+}
+
+const workerColumns = `id, hostname, slots, started_at, heartbeat_at, draining_at,
+	(SELECT COUNT(*) FROM builds WHERE builds.claimed_by = workers.id AND builds.status = 'running')`
+
+func scanWorker(scanner interface{ Scan(...interface{}) error }) (*Worker, error) {
+	worker := &Worker{}
+	err := scanner.Scan(&worker.ID, &worker.Hostname, &worker.Slots, &worker.StartedAt, &worker.HeartbeatAt, &worker.DrainingAt, &worker.Running)
+	worker.Draining = worker.DrainingAt != nil
+	return worker, err
+}
+
+// ListWorkers retrieves the workers heard from since the given time
+func (pg *PostgreSQLDatabase) ListWorkers(since time.Time) ([]*Worker, error) {
+	rows, err := pg.db.Query(`SELECT `+workerColumns+` FROM workers WHERE heartbeat_at >= $1 ORDER BY id`, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	workers := []*Worker{}
+	for rows.Next() {
+		worker, err := scanWorker(rows)
+		if err != nil {
+			return nil, err
+		}
+		workers = append(workers, worker)
+	}
+
+	return workers, rows.Err()
+}
+
+// SetWorkerDraining stops or resumes a worker claiming builds
+func (pg *PostgreSQLDatabase) SetWorkerDraining(id string, draining bool) (*Worker, error) {
+	query := `
+	UPDATE workers
+	SET draining_at = CASE WHEN $2 THEN COALESCE(draining_at, NOW()) END
+	WHERE id = $1
+	RETURNING ` + workerColumns
+
+	worker, err := scanWorker(pg.db.QueryRow(query, id, draining))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("worker not found")
+	}
+
+	return worker, err
+}
+
+// ListInFlightBuilds retrieves the running builds, longest running first
+func (pg *PostgreSQLDatabase) ListInFlightBuilds() ([]*InFlightBuild, error) {
+	query := `
+	SELECT id, project_name, org, COALESCE(claimed_by, ''), started_at, lease_expires_at,
+		EXTRACT(EPOCH FROM NOW() - COALESCE(started_at, NOW()))
+	FROM builds
+	WHERE status = 'running'
+	ORDER BY started_at, id`
+
+	rows, err := pg.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	builds := []*InFlightBuild{}
+	for rows.Next() {
+		build := &InFlightBuild{}
+		if err := rows.Scan(&build.ID, &build.ProjectName, &build.Org, &build.WorkerID, &build.StartedAt, &build.LeaseExpiresAt, &build.DurationSeconds); err != nil {
+			return nil, err
+		}
+		builds = append(builds, build)
+	}
+
+	return builds, rows.Err()
+}
+
+// ListFairShareLimits retrieves the fair share limits set for orgs
+func (pg *PostgreSQLDatabase) ListFairShareLimits() ([]*FairShareLimit, error) {
+	rows, err := pg.db.Query(`SELECT org, max_running_per_user, updated_at FROM fair_share_limits ORDER BY org`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	limits := []*FairShareLimit{}
+	for rows.Next() {
+		limit := &FairShareLimit{}
+		if err := rows.Scan(&limit.Org, &limit.MaxRunningPerUser, &limit.UpdatedAt); err != nil {
+			return nil, err
+		}
+		limits = append(limits, limit)
+	}
+
+	return limits, rows.Err()
+}
+
+// SetFairShareLimit creates or replaces the fair share limit of an org
+func (pg *PostgreSQLDatabase) SetFairShareLimit(limit *FairShareLimit) error {
+	query := `
+	INSERT INTO fair_share_limits (org, max_running_per_user, updated_at)
+	VALUES ($1, $2, NOW())
+	ON CONFLICT (org) DO UPDATE SET max_running_per_user = EXCLUDED.max_running_per_user, updated_at = NOW()
+	RETURNING updated_at`
+
+	return pg.db.QueryRow(query, limit.Org, limit.MaxRunningPerUser).Scan(&limit.UpdatedAt)
+}
+
+// DeleteFairShareLimit removes the fair share limit of an org
+func (pg *PostgreSQLDatabase) DeleteFairShareLimit(org string) error {
+	result, err := pg.db.Exec(`DELETE FROM fair_share_limits WHERE org = $1`, org)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return fmt.Errorf("fair share limit not found")
+	}
+	return nil
+}
+
+// ListImagePolicies retrieves the image policies of every org
+func (pg *PostgreSQLDatabase) ListImagePolicies() ([]*ImagePolicy, error) {
+	rows, err := pg.db.Query(`SELECT org, allowed_images, digest_required_stages, updated_at FROM image_policies ORDER BY org`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	policies := []*ImagePolicy{}
+	for rows.Next() {
+		policy := &ImagePolicy{}
+		if err := rows.Scan(&policy.Org, pq.Array(&policy.AllowedImages), pq.Array(&policy.DigestRequiredStages), &policy.UpdatedAt); err != nil {
+			return nil, err
+		}
+		policies = append(policies, policy)
+	}
+
+	return policies, rows.Err()
+}
+
+// GetImagePolicy retrieves the image policy of an org, or the "*" policy when
+// the org has none of its own
+func (pg *PostgreSQLDatabase) GetImagePolicy(org string) (*ImagePolicy, error) {
+	query := `
+	SELECT org, allowed_images, digest_required_stages, updated_at
+	FROM image_policies
+	WHERE org IN ($1, '*')
+	ORDER BY org = '*'
+	LIMIT 1`
+
+	policy := &ImagePolicy{}
+	err := pg.db.QueryRow(query, org).Scan(&policy.Org, pq.Array(&policy.AllowedImages), pq.Array(&policy.DigestRequiredStages), &policy.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("image policy not found")
+	}
+
+	return policy, err
+}
+
+// SetImagePolicy creates or replaces the image policy of an org
+func (pg *PostgreSQLDatabase) SetImagePolicy(policy *ImagePolicy) error {
+	query := `
+	INSERT INTO image_policies (org, allowed_images, digest_required_stages, updated_at)
+	VALUES ($1, $2, $3, NOW())
+	ON CONFLICT (org) DO UPDATE SET allowed_images = EXCLUDED.allowed_images, digest_required_stages = EXCLUDED.digest_required_stages, updated_at = NOW()
+	RETURNING updated_at`
+
+	return pg.db.QueryRow(query, policy.Org, pq.Array(nonNilStrings(policy.AllowedImages)), pq.Array(nonNilStrings(policy.DigestRequiredStages))).Scan(&policy.UpdatedAt)
+}
+
+// DeleteImagePolicy removes the image policy of an org
+func (pg *PostgreSQLDatabase) DeleteImagePolicy(org string) error {
+	result, err := pg.db.Exec(`DELETE FROM image_policies WHERE org = $1`, org)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return fmt.Errorf("image policy not found")
+	}
+	return nil
+}
+
+// SaveBuildConfig stores the config snapshot of a build, replacing the
+// snapshot of an earlier attempt
+func (pg *PostgreSQLDatabase) SaveBuildConfig(buildID int, config ConfigSnapshot) error {
+	payload, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+
+	query := `
+	INSERT INTO build_configs (build_id, config) VALUES ($1, $2)
+	ON CONFLICT (build_id) DO UPDATE SET config = EXCLUDED.config, created_at = NOW()
+	`
+
+	_, err = pg.db.Exec(query, buildID, payload)
+	return err
+}
+
+// GetBuildConfig retrieves the config snapshot of a build
+func (pg *PostgreSQLDatabase) GetBuildConfig(buildID int) (ConfigSnapshot, error) {
+	var payload []byte
+	err := pg.db.QueryRow(`SELECT config FROM build_configs WHERE build_id = $1`, buildID).Scan(&payload)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("build config not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var config ConfigSnapshot
+	err = json.Unmarshal(payload, &config)
+	return config, err
+}
+
+// SaveBuildStages stores the stages of a build, replacing those of an earlier
+// attempt
+func (pg *PostgreSQLDatabase) SaveBuildStages(buildID int, stages []*BuildStage) error {
+	var names, statuses, exitCodes, startedAt, finishedAt, logs []string
+	for _, stage := range stages {
+		names = append(names, stage.Name)
+		statuses = append(statuses, stage.Status)
+		exitCode, started, finished := "", "", ""
+		if stage.ExitCode != nil {
+			exitCode = strconv.Itoa(*stage.ExitCode)
+		}
+		if stage.StartedAt != nil {
+			started = stage.StartedAt.Format(time.RFC3339Nano)
+		}
+		if stage.FinishedAt != nil {
+			finished = stage.FinishedAt.Format(time.RFC3339Nano)
+		}
+		exitCodes = append(exitCodes, exitCode)
+		startedAt = append(startedAt, started)
+		finishedAt = append(finishedAt, finished)
+		logs = append(logs, stage.Log)
+	}
+
+	query := `
+	WITH saved AS (
+		INSERT INTO build_stages (build_id, position, name, status, exit_code, started_at, finished_at, log)
+		SELECT $1, s.position - 1, s.name, s.status, NULLIF(s.exit_code, '')::integer, NULLIF(s.started_at, '')::timestamptz, NULLIF(s.finished_at, '')::timestamptz, s.log
+		FROM unnest($2::text[], $3::text[], $4::text[], $5::text[], $6::text[], $7::text[])
+			WITH ORDINALITY AS s(name, status, exit_code, started_at, finished_at, log, position)
+		ON CONFLICT (build_id, position) DO UPDATE
+		SET name = EXCLUDED.name, status = EXCLUDED.status, exit_code = EXCLUDED.exit_code,
+			started_at = EXCLUDED.started_at, finished_at = EXCLUDED.finished_at, log = EXCLUDED.log
+	)
+	DELETE FROM build_stages WHERE build_id = $1 AND position >= $8
+	`
+
+	_, err := pg.db.Exec(query, buildID, pq.Array(names), pq.Array(statuses), pq.Array(exitCodes),
+		pq.Array(startedAt), pq.Array(finishedAt), pq.Array(logs), len(stages))
+	return err
+}
+
+// ListBuildStages retrieves the stages of a build in the order they ran
+func (pg *PostgreSQLDatabase) ListBuildStages(buildID int) ([]*BuildStage, error) {
+	query := `
+	SELECT name, status, exit_code, started_at, finished_at, log
+	FROM build_stages
+	WHERE build_id = $1
+	ORDER BY position`
+
+	rows, err := pg.db.Query(query, buildID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stages := []*BuildStage{}
+	for rows.Next() {
+		stage := &BuildStage{}
+		if err := rows.Scan(&stage.Name, &stage.Status, &stage.ExitCode, &stage.StartedAt, &stage.FinishedAt, &stage.Log); err != nil {
+			return nil, err
+		}
+		stages = append(stages, stage)
+	}
+
+	return stages, rows.Err()
+}
+
+// SaveBuildProblems stores the problems found in a build's logs, replacing
+// those of an earlier attempt
+func (pg *PostgreSQLDatabase) SaveBuildProblems(buildID int, problems []*BuildProblem) error {
+	var stageIndexes, lines, offsets, fileLines []int64
+	var stages, severities, messages, files []string
+	for _, problem := range problems {
+		stageIndexes = append(stageIndexes, int64(problem.StageIndex))
+		stages = append(stages, problem.Stage)
+		lines = append(lines, int64(problem.Line))
+		offsets = append(offsets, int64(problem.Offset))
+		severities = append(severities, problem.Severity)
+		messages = append(messages, problem.Message)
+		files = append(files, problem.File)
+		fileLines = append(fileLines, int64(problem.FileLine))
+	}
+
+	tx, err := pg.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM build_problems WHERE build_id = $1`, buildID); err != nil {
+		return err
+	}
+
+	query := `
+	INSERT INTO build_problems (build_id, position, stage_index, stage, line, log_offset, severity, message, file, file_line)
+	SELECT $1, p.position - 1, p.stage_index, p.stage, p.line, p.log_offset, p.severity, p.message, p.file, p.file_line
+	FROM unnest($2::integer[], $3::text[], $4::integer[], $5::integer[], $6::text[], $7::text[], $8::text[], $9::integer[])
+		WITH ORDINALITY AS p(stage_index, stage, line, log_offset, severity, message, file, file_line, position)
+	`
+	if _, err := tx.Exec(query, buildID, pq.Array(stageIndexes), pq.Array(stages), pq.Array(lines), pq.Array(offsets),
+		pq.Array(severities), pq.Array(messages), pq.Array(files), pq.Array(fileLines)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ListBuildProblems retrieves the problems found in a build's logs, in log
+// order
+func (pg *PostgreSQLDatabase) ListBuildProblems(buildID int) ([]*BuildProblem, error) {
+	query := `
+	SELECT stage_index, stage, line, log_offset, severity, message, file, file_line
+	FROM build_problems
+	WHERE build_id = $1
+	ORDER BY position`
+
+	rows, err := pg.db.Query(query, buildID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	problems := []*BuildProblem{}
+	for rows.Next() {
+		problem := &BuildProblem{}
+		if err := rows.Scan(&problem.StageIndex, &problem.Stage, &problem.Line, &problem.Offset,
+			&problem.Severity, &problem.Message, &problem.File, &problem.FileLine); err != nil {
+			return nil, err
+		}
+		problems = append(problems, problem)
+	}
+
+	return problems, rows.Err()
+}
+
+// RecordAPIUsage adds request counts to the api_usage table
+func (pg *PostgreSQLDatabase) RecordAPIUsage(records []*APIUsage) error {
+	var days, orgs, methods, routes, clients, versions, callers, lastSeen []string
+	var requests, errors []int64
+	for _, usage := range records {
+		days = append(days, usage.Day.Format("2006-01-02"))
+		orgs = append(orgs, usage.Org)
+		methods = append(methods, usage.Method)
+		routes = append(routes, usage.Route)
+		clients = append(clients, usage.Client)
+		versions = append(versions, usage.ClientVersion)
+		callers = append(callers, usage.Caller)
+		requests = append(requests, usage.Requests)
+		errors = append(errors, usage.Errors)
+		lastSeen = append(lastSeen, usage.LastSeen.Format(time.RFC3339Nano))
+	}
+
+	query := `
+	INSERT INTO api_usage (day, org, method, route, client, client_version, caller, requests, errors, last_seen)
+	SELECT * FROM unnest($1::date[], $2::text[], $3::text[], $4::text[], $5::text[], $6::text[], $7::text[], $8::bigint[], $9::bigint[], $10::timestamptz[])
+	ON CONFLICT (day, org, method, route, client, client_version, caller) DO UPDATE
+	SET requests = api_usage.requests + EXCLUDED.requests,
+		errors = api_usage.errors + EXCLUDED.errors,
+		last_seen = GREATEST(api_usage.last_seen, EXCLUDED.last_seen)
+	`
+
+	_, err := pg.db.Exec(query, pq.Array(days), pq.Array(orgs), pq.Array(methods), pq.Array(routes),
+		pq.Array(clients), pq.Array(versions), pq.Array(callers), pq.Array(requests), pq.Array(errors), pq.Array(lastSeen))
+	return err
+}
+
+// GetUsageReport aggregates API usage since the given day, optionally for one organization
+func (pg *PostgreSQLDatabase) GetUsageReport(since time.Time, org string) (*UsageReport, error) {
+	const filter = ` FROM api_usage WHERE day >= $1 AND ($2 = '' OR org = $2)`
+	const counts = `SUM(requests), SUM(errors), COUNT(DISTINCT caller)`
+
+	report := &UsageReport{
+		Since:     since,
+		Org:       org,
+		Endpoints: []EndpointUsage{},
+		Orgs:      []OrgUsage{},
+		Clients:   []ClientVersionUsage{},
+	}
+
+	err := pg.db.QueryRow(`SELECT COALESCE(SUM(requests), 0), COALESCE(SUM(errors), 0), COUNT(DISTINCT caller)`+filter, since, org).
+		Scan(&report.Total.Requests, &report.Total.Errors, &report.Total.UniqueCallers)
+	if err != nil {
+		return nil, err
+	}
+
+	err = pg.queryUsage(`SELECT method, route, `+counts+filter+` GROUP BY method, route ORDER BY 3 DESC`, since, org, func(row rowScanner) error {
+		var usage EndpointUsage
+		if err := row.Scan(&usage.Method, &usage.Route, &usage.Requests, &usage.Errors, &usage.UniqueCallers); err != nil {
+			return err
+		}
+		report.Endpoints = append(report.Endpoints, usage)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = pg.queryUsage(`SELECT org, `+counts+filter+` GROUP BY org ORDER BY 2 DESC`, since, org, func(row rowScanner) error {
+		var usage OrgUsage
+		if err := row.Scan(&usage.Org, &usage.Requests, &usage.Errors, &usage.UniqueCallers); err != nil {
+			return err
+		}
+		report.Orgs = append(report.Orgs, usage)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = pg.queryUsage(`SELECT client, client_version, `+counts+filter+` GROUP BY client, client_version ORDER BY 3 DESC`, since, org, func(row rowScanner) error {
+		var usage ClientVersionUsage
+		if err := row.Scan(&usage.Client, &usage.Version, &usage.Requests, &usage.Errors, &usage.UniqueCallers); err != nil {
+			return err
+		}
+		report.Clients = append(report.Clients, usage)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// queryUsage runs one of the usage report's grouping queries
+func (pg *PostgreSQLDatabase) queryUsage(query string, since time.Time, org string, scan func(rowScanner) error) error {
+	rows, err := pg.db.Query(query, since, org)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// DeleteAPIUsageBefore removes usage counts of days before the cutoff
+func (pg *PostgreSQLDatabase) DeleteAPIUsageBefore(before time.Time) (int64, error) {
+	result, err := pg.db.Exec(`DELETE FROM api_usage WHERE day < $1`, before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Ping checks if the database connection is alive
+func (pg *PostgreSQLDatabase) Ping() error {
+	return pg.db.Ping()
+}
+
+// replaceSQL returns an expression applying the REPLACE of each from/to pair
+// of parameters, numbered from first, to column, and a condition matching
+// rows where any of the froms occurs
+func replaceSQL(column string, first, pairs int) (expr, cond string) {
+	expr = column
+	var conds []string
+	for i := 0; i < pairs; i++ {
+		from, to := first+2*i, first+2*i+1
+		expr = fmt.Sprintf("REPLACE(%s, $%d, $%d)", expr, from, to)
+		conds = append(conds, fmt.Sprintf("strpos(%s, $%d) > 0", column, from))
+	}
+	if len(conds) == 0 {
+		return column, "FALSE"
+	}
+	return expr, "(" + strings.Join(conds, " OR ") + ")"
+}
+
+// EraseUserData replaces a person's identifiers with pseudonym in a single
+// transaction: the usernames and commit authors of builds and deployments,
+// project notification emails, and occurrences in commit messages, stage
+// logs, config snapshots and stored event payloads. The erasure is recorded
+// without the erased data.
+func (pg *PostgreSQLDatabase) EraseUserData(erasure *UserErasure, pseudonym string) (*DataErasure, error) {
+	tx, err := pg.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	scrubbed := map[string]int64{}
+	exec := func(table, query string, args ...interface{}) error {
+		result, err := tx.Exec(query, args...)
+		if err != nil {
+			return fmt.Errorf("scrubbing %s: %w", table, err)
+		}
+		n, err := result.RowsAffected()
+		scrubbed[table] += n
+		return err
+	}
+
+	pairs := erasure.replacements(pseudonym)
+	args := make([]interface{}, len(pairs))
+	for i, s := range pairs {
+		args[i] = s
+	}
+
+	message, messageCond := replaceSQL("commit_message", 4, len(pairs)/2)
+	query := `
+	UPDATE builds SET
+		triggered_by = CASE WHEN $1 <> '' AND triggered_by = $1 THEN $3 ELSE triggered_by END,
+		cancelled_by = CASE WHEN $1 <> '' AND cancelled_by = $1 THEN $3 ELSE cancelled_by END,
+		commit_author = CASE WHEN lower(commit_author) = ANY($2) THEN $3 ELSE commit_author END,
+		commit_message = ` + message + `
+	WHERE ($1 <> '' AND (triggered_by = $1 OR cancelled_by = $1)) OR lower(commit_author) = ANY($2) OR ` + messageCond
+	if err := exec("builds", query, append([]interface{}{erasure.Username, pq.Array(erasure.authors()), pseudonym}, args...)...); err != nil {
+		return nil, err
+	}
+
+	if err := exec("deployments", `UPDATE deployments SET triggered_by = $2 WHERE $1 <> '' AND triggered_by = $1`, erasure.Username, pseudonym); err != nil {
+		return nil, err
+	}
+
+	if err := exec("audit_logs", `UPDATE audit_logs SET actor = $2 WHERE $1 <> '' AND actor = $1`, erasure.Username, pseudonym); err != nil {
+		return nil, err
+	}
+
+	emails := make([]string, len(erasure.Emails))
+	for i, email := range erasure.Emails {
+		emails[i] = strings.ToLower(email)
+	}
+	query = `
+	UPDATE projects SET notify_emails = ARRAY(SELECT e FROM unnest(notify_emails) AS e WHERE lower(e) <> ALL($1))
+	WHERE EXISTS (SELECT 1 FROM unnest(notify_emails) AS e WHERE lower(e) = ANY($1))`
+	if err := exec("projects", query, pq.Array(emails)); err != nil {
+		return nil, err
+	}
+
+	for _, target := range []struct {
+		table, column string
+		jsonb         bool
+	}{
+		{"build_stages", "log", false},
+		{"build_problems", "message", false},
+		{"build_configs", "config", true},
+		{"event_outbox", "payload", true},
+		{"webhook_deliveries", "payload", false},
+		{"builds_archive", "build", true},
+		{"builds_archive", "stages", true},
+		{"builds_archive", "config", true},
+		{"audit_logs", "before", true},
+		{"audit_logs", "after", true},
+	} {
+		column := target.column
+		if target.jsonb {
+			column += "::text"
+		}
+		expr, cond := replaceSQL(column, 1, len(pairs)/2)
+		if target.jsonb {
+			expr += "::jsonb"
+		}
+		if err := exec(target.table, `UPDATE `+target.table+` SET `+target.column+` = `+expr+` WHERE `+cond, args...); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := exec("notification_digests", `DELETE FROM notification_digests WHERE channel = 'email' AND lower(target) = ANY($1)`, pq.Array(emails)); err != nil {
+		return nil, err
+	}
+
+	record, err := json.Marshal(scrubbed)
+	if err != nil {
+		return nil, err
+	}
+	result := &DataErasure{Pseudonym: pseudonym, Reference: erasure.Reference, Scrubbed: scrubbed}
+	err = tx.QueryRow(`INSERT INTO data_erasures (pseudonym, reference, scrubbed) VALUES ($1, $2, $3) RETURNING id, created_at`,
+		pseudonym, erasure.Reference, record).Scan(&result.ID, &result.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, tx.Commit()
+}
+
+// ListDataErasures retrieves the recorded erasures, newest first
+func (pg *PostgreSQLDatabase) ListDataErasures() ([]*DataErasure, error) {
+	rows, err := pg.db.Query(`SELECT id, pseudonym, reference, scrubbed, created_at FROM data_erasures ORDER BY id DESC LIMIT 1000`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	erasures := []*DataErasure{}
+	for rows.Next() {
+		erasure := &DataErasure{}
+		var scrubbed []byte
+		if err := rows.Scan(&erasure.ID, &erasure.Pseudonym, &erasure.Reference, &scrubbed, &erasure.CreatedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(scrubbed, &erasure.Scrubbed); err != nil {
+			return nil, err
+		}
+		erasures = append(erasures, erasure)
+	}
+
+	return erasures, rows.Err()
+}
+
+const notificationDigestColumns = `id, channel, target, projects, statuses, interval_seconds, next_run_at, last_run_at, created_at`
+
+func scanNotificationDigest(row rowScanner, extra ...interface{}) (*NotificationDigest, error) {
+	digest := &NotificationDigest{}
+	err := row.Scan(append([]interface{}{&digest.ID, &digest.Channel, &digest.Target, pq.Array(&digest.Projects), pq.Array(&digest.Statuses),
+		&digest.IntervalSeconds, &digest.NextRunAt, &digest.LastRunAt, &digest.CreatedAt}, extra...)...)
+	return digest, err
+}
+
+// CreateNotificationDigest stores a new digest
+func (pg *PostgreSQLDatabase) CreateNotificationDigest(digest *NotificationDigest) error {
+	query := `
+	INSERT INTO notification_digests (channel, target, projects, statuses, interval_seconds, next_run_at)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	RETURNING id, created_at
+	`
+
+	return pg.db.QueryRow(query, digest.Channel, digest.Target, pq.Array(digest.Projects), pq.Array(digest.Statuses),
+		digest.IntervalSeconds, digest.NextRunAt).Scan(&digest.ID, &digest.CreatedAt)
+}
+
+// ListNotificationDigests retrieves every digest
+func (pg *PostgreSQLDatabase) ListNotificationDigests() ([]*NotificationDigest, error) {
+	rows, err := pg.db.Query(`SELECT ` + notificationDigestColumns + ` FROM notification_digests ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	digests := []*NotificationDigest{}
+	for rows.Next() {
+		digest, err := scanNotificationDigest(rows)
+		if err != nil {
+			return nil, err
+		}
+		digests = append(digests, digest)
+	}
+
+	return digests, rows.Err()
+}
+
+// DeleteNotificationDigest removes a digest
+func (pg *PostgreSQLDatabase) DeleteNotificationDigest(id int) error {
+	result, err := pg.db.Exec(`DELETE FROM notification_digests WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("notification digest not found")
+	}
+	return nil
+}
+
+// ClaimDueNotificationDigests moves the window of every digest due at now
+// forward and returns them with the start of the window they're due for
+func (pg *PostgreSQLDatabase) ClaimDueNotificationDigests(now time.Time) ([]*NotificationDigest, error) {
+	query := `
+	WITH due AS (
+		SELECT id, COALESCE(last_run_at, created_at) AS window_start
+		FROM notification_digests
+		WHERE next_run_at <= $1
+		FOR UPDATE SKIP LOCKED
+	)
+	UPDATE notification_digests
+	SET last_run_at = $1, next_run_at = $1 + interval_seconds * INTERVAL '1 second'
+	FROM due
+	WHERE notification_digests.id = due.id
+	RETURNING notification_digests.id, channel, target, projects, statuses, interval_seconds,
+		next_run_at, last_run_at, created_at, due.window_start
+	`
+
+	rows, err := pg.db.Query(query, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var digests []*NotificationDigest
+	for rows.Next() {
+		var windowStart time.Time
+		digest, err := scanNotificationDigest(rows, &windowStart)
+		if err != nil {
+			return nil, err
+		}
+		digest.WindowStart = windowStart
+		digests = append(digests, digest)
+	}
+
+	return digests, rows.Err()
+}
+
+// ListBuildsFinishedBetween retrieves the builds with one of statuses that
+// finished after since up to until, optionally only of some projects
+func (pg *PostgreSQLDatabase) ListBuildsFinishedBetween(since, until time.Time, projects, statuses []string, limit int) ([]*BuildRequest, error) {
+	query := `
+	SELECT ` + buildColumns + `
+	FROM builds
+	WHERE status = ANY($3) AND updated_at > $1 AND updated_at <= $2
+	AND (cardinality($4::text[]) = 0 OR project_name = ANY($4))
+	AND deleted_at IS NULL
+	ORDER BY project_name, id
+	LIMIT $5
+	`
+
+	return pg.queryBuilds(query, since, until, pq.Array(statuses), pq.Array(projects), limit)
+}
+
+// CreateOrganization registers an organization
+func (pg *PostgreSQLDatabase) CreateOrganization(org *Organization) error {
+	query := `
+	INSERT INTO organizations (name, display_name, domain)
+	VALUES ($1, $2, NULLIF($3, ''))
+	RETURNING created_at`
+
+	err := pg.db.QueryRow(query, org.Name, org.DisplayName, org.Domain).Scan(&org.CreatedAt)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		if pqErr.Constraint == "organizations_domain_key" {
+			return fmt.Errorf("domain already in use")
+		}
+		return fmt.Errorf("organization already exists")
+	}
+	return err
+}
+
+// organizationColumns lists the organizations table columns in the order
+// scanOrganization expects
+const organizationColumns = `name, display_name, COALESCE(domain, ''), created_at`
+
+func scanOrganization(row rowScanner) (*Organization, error) {
+	org := &Organization{}
+	err := row.Scan(&org.Name, &org.DisplayName, &org.Domain, &org.CreatedAt)
+	return org, err
+}
+
+// GetOrganization retrieves an organization by name
+func (pg *PostgreSQLDatabase) GetOrganization(name string) (*Organization, error) {
+	org, err := scanOrganization(pg.db.QueryRow(`SELECT `+organizationColumns+` FROM organizations WHERE name = $1`, name))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("organization not found")
+	}
+
+	return org, err
+}
+
+// UpdateOrganization saves the display name and domain of an organization
+func (pg *PostgreSQLDatabase) UpdateOrganization(org *Organization) error {
+	_, err := pg.db.Exec(`UPDATE organizations SET display_name = $2, domain = NULLIF($3, '') WHERE name = $1`, org.Name, org.DisplayName, org.Domain)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return fmt.Errorf("domain already in use")
+	}
+	return err
+}
+
+// ListOrganizations retrieves every organization
+func (pg *PostgreSQLDatabase) ListOrganizations() ([]*Organization, error) {
+	rows, err := pg.db.Query(`SELECT ` + organizationColumns + ` FROM organizations ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orgs := []*Organization{}
+	for rows.Next() {
+		org, err := scanOrganization(rows)
+		if err != nil {
+			return nil, err
+		}
+		orgs = append(orgs, org)
+	}
+
+	return orgs, rows.Err()
+}
+
+// apiKeyColumns lists the api_keys table columns in the order scanAPIKey expects
+const apiKeyColumns = `id, org, name, prefix, created_at, last_used_at, revoked_at`
+
+func scanAPIKey(row rowScanner) (*APIKey, error) {
+	key := &APIKey{}
+	err := row.Scan(&key.ID, &key.Org, &key.Name, &key.Prefix, &key.CreatedAt, &key.LastUsedAt, &key.RevokedAt)
+	return key, err
+}
+
+// CreateAPIKey stores an API key of an org by the SHA-256 hash of its secret
+func (pg *PostgreSQLDatabase) CreateAPIKey(key *APIKey, hash string) error {
+	query := `
+	INSERT INTO api_keys (org, name, prefix, key_hash)
+	VALUES ($1, $2, $3, $4)
+	RETURNING id, created_at`
+
+	err := pg.db.QueryRow(query, key.Org, key.Name, key.Prefix, hash).Scan(&key.ID, &key.CreatedAt)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+		return fmt.Errorf("organization not found")
+	}
+	return err
+}
+
+// GetAPIKeyByHash retrieves the API key that hasn't been revoked with the
+// hash of a secret
+func (pg *PostgreSQLDatabase) GetAPIKeyByHash(hash string) (*APIKey, error) {
+	query := `SELECT ` + apiKeyColumns + ` FROM api_keys WHERE key_hash = $1 AND revoked_at IS NULL`
+
+	key, err := scanAPIKey(pg.db.QueryRow(query, hash))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("api key not found")
+	}
+
+	return key, err
+}
+
+// ListAPIKeys retrieves an org's API keys, including revoked ones
+func (pg *PostgreSQLDatabase) ListAPIKeys(org string) ([]*APIKey, error) {
+	rows, err := pg.db.Query(`SELECT `+apiKeyColumns+` FROM api_keys WHERE org = $1 ORDER BY id`, org)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// RevokeAPIKey revokes an API key. Revoking a revoked key returns it unchanged.
+func (pg *PostgreSQLDatabase) RevokeAPIKey(id int) (*APIKey, error) {
+	query := `
+	UPDATE api_keys
+	SET revoked_at = COALESCE(revoked_at, NOW())
+	WHERE id = $1
+	RETURNING ` + apiKeyColumns
+
+	key, err := scanAPIKey(pg.db.QueryRow(query, id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("api key not found")
+	}
+
+	return key, err
+}
+
+// TouchAPIKey records that an API key was just used
+func (pg *PostgreSQLDatabase) TouchAPIKey(id int) error {
+	_, err := pg.db.Exec(`UPDATE api_keys SET last_used_at = NOW() WHERE id = $1`, id)
+	return err
+}
+
+// auditEntryColumns lists the audit_logs table columns in the order
+// scanAuditEntry expects
+const auditEntryColumns = `id, created_at, actor, org, ip, method, route, path, resource, resource_id, status, before, after`
+
+// scanAuditEntry reads a single audit_logs row selected with auditEntryColumns
+func scanAuditEntry(row rowScanner) (*AuditEntry, error) {
+	entry := &AuditEntry{}
+	var before, after sql.NullString
+	err := row.Scan(&entry.ID, &entry.CreatedAt, &entry.Actor, &entry.Org, &entry.IP, &entry.Method, &entry.Route,
+		&entry.Path, &entry.Resource, &entry.ResourceID, &entry.Status, &before, &after)
+	if before.Valid {
+		entry.Before = json.RawMessage(before.String)
+	}
+	if after.Valid {
+		entry.After = json.RawMessage(after.String)
+	}
+	return entry, err
+}
+
+// nullJSON stores an empty document as NULL
+func nullJSON(doc json.RawMessage) interface{} {
+	if len(doc) == 0 {
+		return nil
+	}
+	return string(doc)
+}
+
+// CreateAuditEntry records a change made through the API
+func (pg *PostgreSQLDatabase) CreateAuditEntry(entry *AuditEntry) error {
+	query := `
+	INSERT INTO audit_logs (actor, org, ip, method, route, path, resource, resource_id, status, before, after)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+	RETURNING id, created_at`
+
+	return pg.db.QueryRow(query, entry.Actor, entry.Org, entry.IP, entry.Method, entry.Route, entry.Path,
+		entry.Resource, entry.ResourceID, entry.Status, nullJSON(entry.Before), nullJSON(entry.After)).Scan(&entry.ID, &entry.CreatedAt)
+}
+
+// ListAuditEntries retrieves the audit log entries matching filter, newest first
+func (pg *PostgreSQLDatabase) ListAuditEntries(filter AuditFilter) ([]*AuditEntry, error) {
+	query := `
+	SELECT ` + auditEntryColumns + `
+	FROM audit_logs
+	WHERE ($1 = '' OR actor = $1) AND ($2 = '' OR org = $2) AND ($3 = '' OR resource = $3) AND ($4 = '' OR resource_id = $4)
+		AND ($5 = '' OR method = $5) AND ($6::timestamptz IS NULL OR created_at >= $6) AND ($7::timestamptz IS NULL OR created_at < $7)
+		AND ($8 = 0 OR id < $8)
+	ORDER BY id DESC
+	LIMIT $9
+	`
+
+	rows, err := pg.db.Query(query, filter.Actor, filter.Org, filter.Resource, filter.ResourceID, filter.Method,
+		filter.Since, filter.Until, filter.BeforeID, filter.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []*AuditEntry{}
+	for rows.Next() {
+		entry, err := scanAuditEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+// ListProjectSecrets retrieves the secrets of a project, or of every project
+// when projectID is 0, with their values decrypted
+func (pg *PostgreSQLDatabase) ListProjectSecrets(projectID int) ([]*ProjectSecret, error) {
+	query := `
+	SELECT id, project_id, name, value, version, created_at, updated_at
+	FROM project_secrets
+	WHERE $1 = 0 OR project_id = $1
+	ORDER BY project_id, name
+	`
+
+	rows, err := pg.db.Query(query, projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	secrets := []*ProjectSecret{}
+	for rows.Next() {
+		secret := &ProjectSecret{}
+		if err := rows.Scan(&secret.ID, &secret.ProjectID, &secret.Name, &secret.Value, &secret.Version, &secret.CreatedAt, &secret.UpdatedAt); err != nil {
+			return nil, err
+		}
+		if secret.Value, err = pg.credentials.Open(secret.Value); err != nil {
+			return nil, fmt.Errorf("project %d secret %s: %w", secret.ProjectID, secret.Name, err)
+		}
+		secrets = append(secrets, secret)
+	}
+
+	return secrets, rows.Err()
+}
+
+// sealSecret encrypts a secret's value, refusing to store it in the clear
+func (pg *PostgreSQLDatabase) sealSecret(secret *ProjectSecret) (string, error) {
+	if pg.credentials == nil {
+		return "", errSecretsDisabled
+	}
+	return pg.credentials.Seal(secret.Value)
+}
+
+// SetProjectSecret creates a secret or replaces its value, incrementing its
+// version
+func (pg *PostgreSQLDatabase) SetProjectSecret(secret *ProjectSecret) error {
+	value, err := pg.sealSecret(secret)
+	if err != nil {
+		return err
+	}
+
+	query := `
+	INSERT INTO project_secrets (project_id, name, value)
+	VALUES ($1, $2, $3)
+	ON CONFLICT (project_id, name) DO UPDATE SET
+		value = EXCLUDED.value, version = project_secrets.version + 1, updated_at = NOW()
+	RETURNING id, version, created_at, updated_at`
+
+	return pg.db.QueryRow(query, secret.ProjectID, secret.Name, value).Scan(&secret.ID, &secret.Version, &secret.CreatedAt, &secret.UpdatedAt)
+}
+
+// ResealProjectSecret stores a secret's value sealed with the primary
+// credential key, keeping its version
+func (pg *PostgreSQLDatabase) ResealProjectSecret(secret *ProjectSecret) error {
+	value, err := pg.sealSecret(secret)
+	if err != nil {
+		return err
+	}
+
+	result, err := pg.db.Exec(`UPDATE project_secrets SET value = $1 WHERE id = $2`, value, secret.ID)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return fmt.Errorf("project secret not found")
+	}
+	return nil
+}
+
+// DeleteProjectSecret removes a secret of a project
+func (pg *PostgreSQLDatabase) DeleteProjectSecret(projectID int, name string) error {
+	result, err := pg.db.Exec(`DELETE FROM project_secrets WHERE project_id = $1 AND name = $2`, projectID, name)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return fmt.Errorf("project secret not found")
+	}
+	return nil
+}
+
+// SaveQualityGate records a quality gate result, replacing the earlier result
+// of the same gate for the commit
+func (pg *PostgreSQLDatabase) SaveQualityGate(gate *QualityGate) error {
+	conditions, err := json.Marshal(gate.Conditions)
+	if err != nil {
+		return err
+	}
+	if gate.Conditions == nil {
+		conditions = []byte("[]")
+	}
+
+	query := `
+	INSERT INTO quality_gates (project_name, commit_sha, tool, name, status, url, conditions)
+	VALUES ($1, $2, $3, $4, $5, $6, $7)
+	ON CONFLICT (project_name, commit_sha, tool, name) DO UPDATE SET
+		status = EXCLUDED.status, url = EXCLUDED.url, conditions = EXCLUDED.conditions, updated_at = NOW()
+	RETURNING id, created_at, updated_at`
+
+	return pg.db.QueryRow(query, gate.ProjectName, gate.CommitSHA, gate.Tool, gate.Name, gate.Status, gate.URL, conditions).
+		Scan(&gate.ID, &gate.CreatedAt, &gate.UpdatedAt)
+}
+
+// ListQualityGates retrieves the quality gates reported for a commit of a project
+func (pg *PostgreSQLDatabase) ListQualityGates(projectName, commitSHA string) ([]*QualityGate, error) {
+	query := `
+	SELECT id, project_name, commit_sha, tool, name, status, url, conditions, created_at, updated_at
+	FROM quality_gates
+	WHERE project_name = $1 AND commit_sha = $2
+	ORDER BY tool, name
+	`
+
+	rows, err := pg.db.Query(query, projectName, commitSHA)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	gates := []*QualityGate{}
+	for rows.Next() {
+		gate := &QualityGate{}
+		var conditions []byte
+		if err := rows.Scan(&gate.ID, &gate.ProjectName, &gate.CommitSHA, &gate.Tool, &gate.Name, &gate.Status, &gate.URL, &conditions, &gate.CreatedAt, &gate.UpdatedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(conditions, &gate.Conditions); err != nil {
+			return nil, fmt.Errorf("decoding quality gate conditions: %w", err)
+		}
+		gates = append(gates, gate)
+	}
+
+	return gates, rows.Err()
+}
+
+// ListProjectDependencies retrieves the edges of the project dependency
+// graph between projects of an org, or every edge for an empty org
+func (pg *PostgreSQLDatabase) ListProjectDependencies(org string) ([]*ProjectDependency, error) {
+	query := `
+	SELECT d.upstream_project_id, u.name, d.downstream_project_id, p.name
+	FROM project_dependencies d
+	JOIN projects u ON u.id = d.upstream_project_id
+	JOIN projects p ON p.id = d.downstream_project_id
+	WHERE $1 = '' OR (u.org = $1 AND p.org = $1)
+	ORDER BY u.name, p.name
+	`
+
+	rows, err := pg.db.Query(query, org)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	dependencies := []*ProjectDependency{}
+	for rows.Next() {
+		dependency := &ProjectDependency{}
+		if err := rows.Scan(&dependency.UpstreamID, &dependency.UpstreamName, &dependency.DownstreamID, &dependency.DownstreamName); err != nil {
+			return nil, err
+		}
+		dependencies = append(dependencies, dependency)
+	}
+
+	return dependencies, rows.Err()
+}
+
+// SetDownstreamProjects replaces the projects built after a project's
+// successful builds
+func (pg *PostgreSQLDatabase) SetDownstreamProjects(projectID int, downstreamIDs []int) error {
+	query := `
+	WITH removed AS (
+		DELETE FROM project_dependencies
+		WHERE upstream_project_id = $1 AND NOT (downstream_project_id = ANY($2::integer[]))
+	)
+	INSERT INTO project_dependencies (upstream_project_id, downstream_project_id)
+	SELECT $1, unnest($2::integer[])
+	ON CONFLICT DO NOTHING
+	`
+
+	_, err := pg.db.Exec(query, projectID, pq.Array(int64s(downstreamIDs)))
+	return err
+}
+
+// ListDownstreamProjects retrieves the projects built after a project's
+// successful builds
+func (pg *PostgreSQLDatabase) ListDownstreamProjects(projectID int) ([]*Project, error) {
+	query := `
+	SELECT ` + projectColumns + `
+	FROM projects
+	WHERE id IN (SELECT downstream_project_id FROM project_dependencies WHERE upstream_project_id = $1)
+	ORDER BY name
+	`
+
+	rows, err := pg.db.Query(query, projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	projects := []*Project{}
+	for rows.Next() {
+		project, err := scanProject(rows)
+		if err != nil {
+			return nil, err
+		}
+		projects = append(projects, project)
+	}
+
+	return projects, rows.Err()
+}
+
+// ListTriggeringBuilds retrieves the chain of upstream builds that triggered
+// a build, starting from the first
+func (pg *PostgreSQLDatabase) ListTriggeringBuilds(id int) ([]*BuildRequest, error) {
+	query := `
+	WITH RECURSIVE upstream AS (
+		SELECT upstream_build_id AS id, 1 AS depth FROM builds WHERE id = $1 AND upstream_build_id IS NOT NULL
+		UNION ALL
+		SELECT b.upstream_build_id, u.depth + 1 FROM builds b JOIN upstream u ON b.id = u.id WHERE b.upstream_build_id IS NOT NULL
+	)
+	SELECT ` + buildColumns + `
+	FROM builds
+	JOIN upstream USING (id)
+	ORDER BY upstream.depth DESC
+	`
+
+	return pg.queryBuilds(query, id)
+}
+
+// ListTriggeredBuilds retrieves the builds triggered by a build's success,
+// directly or through other downstream builds, oldest first
+func (pg *PostgreSQLDatabase) ListTriggeredBuilds(id int) ([]*BuildRequest, error) {
+	query := `
+	WITH RECURSIVE downstream AS (
+		SELECT id FROM builds WHERE upstream_build_id = $1
+		UNION
+		SELECT b.id FROM builds b JOIN downstream d ON b.upstream_build_id = d.id
+	)
+	SELECT ` + buildColumns + `
+	FROM builds
+	WHERE id IN (SELECT id FROM downstream)
+	ORDER BY id
+	`
+
+	return pg.queryBuilds(query, id)
+}
+
+// escalationColumns lists the escalations table columns in the order scanEscalations expects
+const escalationColumns = `id, dedup_key, provider, reference, status, build_id, deployment_id, summary, created_at, updated_at, resolved_at`
+
+// scanEscalations reads escalations rows selected with escalationColumns
+func scanEscalations(rows *sql.Rows) ([]*Escalation, error) {
+	defer rows.Close()
+
+	escalations := []*Escalation{}
+	for rows.Next() {
+		escalation := &Escalation{}
+		var deploymentID sql.NullInt64
+		var resolvedAt sql.NullTime
+		if err := rows.Scan(&escalation.ID, &escalation.DedupKey, &escalation.Provider, &escalation.Reference, &escalation.Status,
+			&escalation.BuildID, &deploymentID, &escalation.Summary, &escalation.CreatedAt, &escalation.UpdatedAt, &resolvedAt); err != nil {
+			return nil, err
+		}
+		if deploymentID.Valid {
+			id := int(deploymentID.Int64)
+			escalation.DeploymentID = &id
+		}
+		if resolvedAt.Valid {
+			escalation.ResolvedAt = &resolvedAt.Time
+		}
+		escalations = append(escalations, escalation)
+	}
+
+	return escalations, rows.Err()
+}
+
+// CreateEscalation records an incident opened for a build
+func (pg *PostgreSQLDatabase) CreateEscalation(escalation *Escalation) error {
+	query := `
+	INSERT INTO escalations (dedup_key, provider, reference, status, build_id, deployment_id, summary)
+	VALUES ($1, $2, $3, $4, $5, $6, $7)
+	RETURNING id, created_at, updated_at`
+
+	return pg.db.QueryRow(query, escalation.DedupKey, escalation.Provider, escalation.Reference, escalation.Status,
+		escalation.BuildID, escalation.DeploymentID, escalation.Summary).
+		Scan(&escalation.ID, &escalation.CreatedAt, &escalation.UpdatedAt)
+}
+
+// ListOpenEscalations retrieves the unresolved escalations of a dedup key
+func (pg *PostgreSQLDatabase) ListOpenEscalations(dedupKey string) ([]*Escalation, error) {
+	query := `
+	SELECT ` + escalationColumns + `
+	FROM escalations
+	WHERE dedup_key = $1 AND status <> 'resolved'
+	ORDER BY id
+	`
+
+	rows, err := pg.db.Query(query, dedupKey)
+	if err != nil {
+		return nil, err
+	}
+	return scanEscalations(rows)
+}
+
+// UpdateEscalationStatus moves an escalation to a new status, noting when it
+// was resolved
+func (pg *PostgreSQLDatabase) UpdateEscalationStatus(id int, status string) error {
+	query := `
+	UPDATE escalations
+	SET status = $2, updated_at = NOW(), resolved_at = CASE WHEN $2 = 'resolved' THEN NOW() ELSE resolved_at END
+	WHERE id = $1`
+
+	result, err := pg.db.Exec(query, id, status)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+		return fmt.Errorf("escalation not found")
+	}
+	return nil
+}
+
+// ListBuildEscalations retrieves the escalations triggered by a build
+func (pg *PostgreSQLDatabase) ListBuildEscalations(buildID int) ([]*Escalation, error) {
+	query := `
+	SELECT ` + escalationColumns + `
+	FROM escalations
+	WHERE build_id = $1
+	ORDER BY id
+	`
+
+	rows, err := pg.db.Query(query, buildID)
+	if err != nil {
+		return nil, err
+	}
+	return scanEscalations(rows)
+}
+
+// RecordBuildUsage records the CPU time and peak memory a build used
+func (pg *PostgreSQLDatabase) RecordBuildUsage(id int, usage *ResourceUsage) error {
+	_, err := pg.db.Exec(`UPDATE builds SET cpu_seconds = $1, peak_memory_bytes = $2 WHERE id = $3`,
+		usage.CPUSeconds, usage.PeakMemoryBytes, id)
+	return err
+}
+
+// ListBuildUsage retrieves the resource usage and duration of a project's
+// latest successful builds, newest first
+func (pg *PostgreSQLDatabase) ListBuildUsage(projectName string, limit int) ([]*BuildUsage, error) {
+	query := `
+	SELECT id, cpu_seconds, peak_memory_bytes, EXTRACT(EPOCH FROM updated_at - started_at)
+	FROM builds
+	WHERE project_name = $1 AND status = 'success' AND cpu_seconds IS NOT NULL
+		AND started_at IS NOT NULL AND deleted_at IS NULL
+	ORDER BY id DESC
+	LIMIT $2
+	`
+
+	rows, err := pg.db.Query(query, projectName, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usages := []*BuildUsage{}
+	for rows.Next() {
+		usage := &BuildUsage{}
+		if err := rows.Scan(&usage.BuildID, &usage.CPUSeconds, &usage.PeakMemoryBytes, &usage.DurationSeconds); err != nil {
+			return nil, err
+		}
+		usages = append(usages, usage)
+	}
+	return usages, rows.Err()
+}
+
+// RecordBuildDuration adds the duration of a successful build to the rolling
+// windows of its branch and of its whole project, keeping the latest window
+// durations of each
+func (pg *PostgreSQLDatabase) RecordBuildDuration(projectName, branch string, seconds float64, window int) error {
+	query := `
+	INSERT INTO build_duration_estimates AS e (project_name, branch, durations, updated_at)
+	SELECT $1, b.branch, ARRAY[$3::double precision], NOW()
+	FROM (SELECT DISTINCT unnest(ARRAY[$2::varchar, '']) AS branch) b
+	ON CONFLICT (project_name, branch) DO UPDATE
+	SET durations = (e.durations || EXCLUDED.durations)[GREATEST(cardinality(e.durations) + 2 - $4, 1):],
+		updated_at = NOW()
+	`
+
+	_, err := pg.db.Exec(query, projectName, branch, seconds, window)
+	return err
+}
+
+// GetBuildDurations retrieves the rolling window of successful build
+// durations of a project's branch, oldest first, or of the whole project for
+// an empty branch. It's empty when none were recorded.
+func (pg *PostgreSQLDatabase) GetBuildDurations(projectName, branch string) ([]float64, error) {
+	var durations []float64
+	err := pg.db.QueryRow(`SELECT durations FROM build_duration_estimates WHERE project_name = $1 AND branch = $2`,
+		projectName, branch).Scan(pq.Array(&durations))
+	if err == sql.ErrNoRows {
+		return []float64{}, nil
+	}
+	return durations, err
+}
+
+// ListMatrixBuilds retrieves the builds of a matrix build's combinations
+func (pg *PostgreSQLDatabase) ListMatrixBuilds(parentID int) ([]*BuildRequest, error) {
+	query := `SELECT ` + buildColumns + ` FROM builds WHERE parent_build_id = $1 ORDER BY id`
+
+	return pg.queryBuilds(query, parentID)
+}
+
+// DetachMatrixBuild releases the lease on a matrix build that expanded into
+// its combinations, which it waits for without a worker
+func (pg *PostgreSQLDatabase) DetachMatrixBuild(id int) error {
+	query := `
+	UPDATE builds
+	SET claimed_by = NULL, lease_expires_at = NULL, updated_at = NOW()
+	WHERE id = $1 AND status = 'running'
+	`
+
+	_, err := pg.db.Exec(query, id)
+	return err
+}
+
+// FinishMatrixBuild records the final status of a running matrix build,
+// reporting false when it had already finished
+func (pg *PostgreSQLDatabase) FinishMatrixBuild(id int, status string, exitCode int) (bool, error) {
+	query := `
+	UPDATE builds
+	SET status = $2, exit_code = $3, claimed_by = NULL, lease_expires_at = NULL, updated_at = NOW()
+	WHERE id = $1 AND status = 'running'
+	`
+
+	res, err := pg.db.Exec(query, id, status, exitCode)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
 }
 
 // Close closes the database connection
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"database/sql"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// timedDB wraps a connection pool to observe the latency of every statement,
+// labeled by the PostgreSQLDatabase method that ran it, and to send
+// statements through the circuit breaker
+type timedDB struct {
+	*sql.DB
+	// duration is nil until the database is instrumented
+	duration *prometheus.HistogramVec
+	// breaker is nil until the database is protected
+	breaker *CircuitBreaker
+}
+
+func (t *timedDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	defer t.observe(time.Now())
+	var result sql.Result
+	err := t.guard(func() (err error) {
+		result, err = t.DB.Exec(query, args...)
+		return err
+	})
+	return result, err
+}
+
+func (t *timedDB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	defer t.observe(time.Now())
+	var rows *sql.Rows
+	err := t.guard(func() (err error) {
+		rows, err = t.DB.Query(query, args...)
+		return err
+	})
+	return rows, err
+}
+
+func (t *timedDB) QueryRow(query string, args ...interface{}) *sql.Row {
+	defer t.observe(time.Now())
+	var row *sql.Row
+	t.guard(func() error {
+		row = t.DB.QueryRow(query, args...)
+		return row.Err()
+	})
+	if row == nil {
+		return unavailableRow(t.DB, query)
+	}
+	return row
+}
+
+// Begin starts a transaction once the breaker allows it. Statements within
+// the transaction aren't retried.
+func (t *timedDB) Begin() (*sql.Tx, error) {
+	var tx *sql.Tx
+	err := t.guard(func() (err error) {
+		tx, err = t.DB.Begin()
+		return err
+	})
+	return tx, err
+}
+
+// guard runs op through the circuit breaker, if there is one
+func (t *timedDB) guard(op func() error) error {
+	if t.breaker == nil {
+		return op()
+	}
+	return t.breaker.Do(op)
+}
+
+// observe records the time since start under the calling method's name
+func (t *timedDB) observe(start time.Time) {
+	if t.duration == nil {
+		return
+	}
+	t.duration.WithLabelValues(dbOperation(3)).Observe(time.Since(start).Seconds())
+}
+
+// dbOperation names the method skip frames up the stack, such as "GetBuild"
+// for main.(*PostgreSQLDatabase).GetBuild or its closures
+func dbOperation(skip int) string {
+	pc, _, _, ok := runtime.Caller(skip)
+	if !ok {
+		return "unknown"
+	}
+	name := runtime.FuncForPC(pc).Name()
+	name, _, _ = strings.Cut(name, ".func")
+	return name[strings.LastIndex(name, ".")+1:]
+}
+
+// Instrument observes the latency of database operations in duration
+func (pg *PostgreSQLDatabase) Instrument(duration *prometheus.HistogramVec) {
+	pg.db.duration = duration
+}
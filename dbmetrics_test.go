@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeDatabase stands in for a PostgreSQLDatabase method calling timedDB
+type fakeDatabase struct{}
+
+func (fakeDatabase) ListThings() string {
+	return dbOperation(1)
+}
+
+func (fakeDatabase) UpdateThings() string {
+	var operation string
+	func() { operation = dbOperation(1) }()
+	return operation
+}
+
+func TestDBOperation(t *testing.T) {
+	assert.Equal(t, "ListThings", fakeDatabase{}.ListThings())
+	assert.Equal(t, "UpdateThings", fakeDatabase{}.UpdateThings(), "closures are attributed to their method")
+}
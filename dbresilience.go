@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// errDatabaseUnavailable is returned without touching the database while the
+// circuit breaker is open
+var errDatabaseUnavailable = errors.New("database unavailable")
+
+// Circuit breaker states, as reported by the db_circuit_state gauge
+const (
+	circuitClosed   = 0
+	circuitOpen     = 1
+	circuitHalfOpen = 2
+)
+
+// dbIndependentRoutes are served while the database is unavailable: the
+// health check reports the outage itself, and the others don't use it
+var dbIndependentRoutes = map[string]bool{
+	"/metrics":             true,
+	"/docs":                true,
+	"/api/v1/health":       true,
+	"/api/v1/openapi.json": true,
+}
+
+// CircuitBreaker retries transient database errors with backoff and stops
+// sending statements to a database that keeps failing. After threshold
+// consecutive connection failures it opens for cooldown, failing statements
+// immediately, then lets one statement through to probe whether the database
+// is back.
+type CircuitBreaker struct {
+	threshold  int
+	cooldown   time.Duration
+	attempts   int
+	backoff    time.Duration
+	stateGauge prometheus.Gauge
+	retries    prometheus.Counter
+
+	mu        sync.Mutex
+	state     int
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// NewCircuitBreakerFromEnv creates a breaker opening after
+// DB_BREAKER_THRESHOLD consecutive connection failures for
+// DB_BREAKER_COOLDOWN, and making up to DB_RETRY_ATTEMPTS attempts at
+// statements that failed transiently, DB_RETRY_BACKOFF apart and doubling
+func NewCircuitBreakerFromEnv(state prometheus.Gauge, retries prometheus.Counter) *CircuitBreaker {
+	return &CircuitBreaker{
+		threshold:  getEnvInt("DB_BREAKER_THRESHOLD", 5),
+		cooldown:   getEnvDuration("DB_BREAKER_COOLDOWN", 30*time.Second),
+		attempts:   getEnvInt("DB_RETRY_ATTEMPTS", 3),
+		backoff:    getEnvDuration("DB_RETRY_BACKOFF", 50*time.Millisecond),
+		stateGauge: state,
+		retries:    retries,
+	}
+}
+
+// connectionError reports whether err means the database couldn't be reached
+// or dropped the connection, as opposed to rejecting the statement
+func connectionError(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case "57P01", "57P02", "57P03", "53300":
+			// admin or crash shutdown, starting up, too many connections
+			return true
+		}
+		return pqErr.Code.Class() == "08"
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// retryableError reports whether a failed statement certainly had no effect
+// and may be sent again: the connection was never made or was refused, or
+// Postgres rolled the statement back on a serialization failure or deadlock
+func retryableError(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case "40001", "40P01", "57P03", "53300":
+			return true
+		}
+		return false
+	}
+
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// Do runs a database operation through the breaker, retrying it while it
+// fails with retryable errors
+func (cb *CircuitBreaker) Do(op func() error) error {
+	if err := cb.allow(); err != nil {
+		return err
+	}
+
+	var err error
+	delay := cb.backoff
+	for attempt := 1; ; attempt++ {
+		err = op()
+		if err == nil || attempt >= cb.attempts || !retryableError(err) {
+			break
+		}
+		cb.retries.Inc()
+		time.Sleep(delay)
+		delay *= 2
+	}
+
+	cb.record(err)
+	return err
+}
+
+// allow rejects operations while the breaker is open and lets a single probe
+// through once the cooldown has passed
+func (cb *CircuitBreaker) allow() error {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case circuitOpen:
+		if time.Now().Before(cb.openUntil) {
+			return errDatabaseUnavailable
+		}
+		cb.setState(circuitHalfOpen)
+		cb.probing = true
+	case circuitHalfOpen:
+		if cb.probing {
+			return errDatabaseUnavailable
+		}
+		cb.probing = true
+	}
+	return nil
+}
+
+// record closes the breaker when an operation reached the database and opens
+// it after too many connection failures in a row, or a failed probe
+func (cb *CircuitBreaker) record(err error) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.probing = false
+	if err == nil || !connectionError(err) {
+		cb.failures = 0
+		cb.setState(circuitClosed)
+		return
+	}
+
+	cb.failures++
+	if cb.state == circuitHalfOpen || cb.failures >= cb.threshold {
+		cb.openUntil = time.Now().Add(cb.cooldown)
+		cb.setState(circuitOpen)
+	}
+}
+
+func (cb *CircuitBreaker) setState(state int) {
+	cb.state = state
+	cb.stateGauge.Set(float64(state))
+}
+
+// Open reports whether the breaker is open and, if so, how long until it
+// probes the database again
+func (cb *CircuitBreaker) Open() (bool, time.Duration) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state != circuitOpen {
+		return false, 0
+	}
+	remaining := time.Until(cb.openUntil)
+	return remaining > 0, remaining
+}
+
+// Middleware answers API requests with 503 Service Unavailable while the
+// breaker is open, instead of letting them fail one statement at a time
+func (cb *CircuitBreaker) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if open, remaining := cb.Open(); open && !dbIndependentRoutes[routeTemplate(r)] {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(remaining.Seconds()))))
+			http.Error(w, "Database unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// unavailableContext is an already cancelled context whose error is
+// errDatabaseUnavailable. A *sql.Row can't be built outside database/sql, so
+// QueryRow fails fast by querying with it: the pool checks the context before
+// taking a connection.
+type unavailableContext struct{ context.Context }
+
+func (unavailableContext) Done() <-chan struct{} { return closedChannel }
+func (unavailableContext) Err() error            { return errDatabaseUnavailable }
+
+var closedChannel = func() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}()
+
+// unavailableRow returns a row whose Scan fails with errDatabaseUnavailable
+func unavailableRow(db *sql.DB, query string) *sql.Row {
+	return db.QueryRowContext(unavailableContext{context.Background()}, query)
+}
+
+// Protect sends the database's statements through breaker
+func (pg *PostgreSQLDatabase) Protect(breaker *CircuitBreaker) {
+	pg.db.breaker = breaker
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	metrics := NewMetrics()
+	return &CircuitBreaker{
+		threshold:  threshold,
+		cooldown:   cooldown,
+		attempts:   3,
+		backoff:    time.Millisecond,
+		stateGauge: metrics.DBCircuitState,
+		retries:    metrics.DBRetries,
+	}
+}
+
+var errConnectionRefused = &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+func TestCircuitBreakerRetriesTransientErrors(t *testing.T) {
+	cb := newTestBreaker(5, time.Minute)
+
+	calls := 0
+	err := cb.Do(func() error {
+		calls++
+		if calls < 3 {
+			return &pq.Error{Code: "40001"}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 3, calls)
+	assert.Equal(t, 2.0, testutil.ToFloat64(cb.retries))
+
+	// Statements that may have taken effect are not sent again
+	calls = 0
+	err = cb.Do(func() error {
+		calls++
+		return &pq.Error{Code: "23505"}
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, calls)
+
+	// Retries are bounded
+	calls = 0
+	err = cb.Do(func() error {
+		calls++
+		return errConnectionRefused
+	})
+	assert.ErrorIs(t, err, errConnectionRefused)
+	assert.Equal(t, 3, calls)
+}
+
+func TestCircuitBreakerOpensAndRecovers(t *testing.T) {
+	cb := newTestBreaker(2, 20*time.Millisecond)
+	cb.attempts = 1
+	failing := func() error { return errConnectionRefused }
+
+	assert.Error(t, cb.Do(failing))
+	open, _ := cb.Open()
+	assert.False(t, open)
+
+	// Statement errors don't count towards opening the breaker
+	assert.Error(t, cb.Do(func() error { return sql.ErrNoRows }))
+	assert.Error(t, cb.Do(failing))
+	open, _ = cb.Open()
+	assert.False(t, open)
+
+	assert.Error(t, cb.Do(failing))
+	open, remaining := cb.Open()
+	assert.True(t, open)
+	assert.Greater(t, remaining, time.Duration(0))
+	assert.Equal(t, float64(circuitOpen), testutil.ToFloat64(cb.stateGauge))
+
+	// While open, operations fail without being run
+	called := false
+	err := cb.Do(func() error { called = true; return nil })
+	assert.ErrorIs(t, err, errDatabaseUnavailable)
+	assert.False(t, called)
+
+	// After the cooldown a failed probe opens the breaker again at once
+	time.Sleep(25 * time.Millisecond)
+	assert.Error(t, cb.Do(failing))
+	open, _ = cb.Open()
+	assert.True(t, open)
+
+	// and a successful probe closes it
+	time.Sleep(25 * time.Millisecond)
+	require.NoError(t, cb.Do(func() error { return nil }))
+	open, _ = cb.Open()
+	assert.False(t, open)
+	assert.Equal(t, float64(circuitClosed), testutil.ToFloat64(cb.stateGauge))
+}
+
+func TestCircuitBreakerSingleProbe(t *testing.T) {
+	cb := newTestBreaker(1, time.Millisecond)
+	cb.attempts = 1
+	assert.Error(t, cb.Do(func() error { return errConnectionRefused }))
+	time.Sleep(2 * time.Millisecond)
+
+	// Only one operation probes the database while half-open
+	probing := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- cb.Do(func() error {
+			close(probing)
+			<-release
+			return nil
+		})
+	}()
+	<-probing
+	assert.ErrorIs(t, cb.Do(func() error { return nil }), errDatabaseUnavailable)
+	close(release)
+	assert.NoError(t, <-done)
+}
+
+func TestConnectionError(t *testing.T) {
+	assert.True(t, connectionError(errConnectionRefused))
+	assert.True(t, connectionError(&pq.Error{Code: "08006"}))
+	assert.True(t, connectionError(&pq.Error{Code: "57P01"}))
+	assert.True(t, connectionError(fmt.Errorf("listing builds: %w", errConnectionRefused)))
+	assert.False(t, connectionError(&pq.Error{Code: "23505"}))
+	assert.False(t, connectionError(sql.ErrNoRows))
+}
+
+func TestCircuitBreakerMiddleware(t *testing.T) {
+	cb := newTestBreaker(1, time.Minute)
+	cb.attempts = 1
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/builds", func(w http.ResponseWriter, r *http.Request) {})
+	router.HandleFunc("/api/v1/health", func(w http.ResponseWriter, r *http.Request) {})
+	router.Use(cb.Middleware)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		return rr
+	}
+
+	assert.Equal(t, http.StatusOK, get("/api/v1/builds").Code)
+
+	cb.Do(func() error { return errConnectionRefused })
+	rr := get("/api/v1/builds")
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Equal(t, "60", rr.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusOK, get("/api/v1/health").Code)
+}
+
+func TestHealthHandlerDegraded(t *testing.T) {
+	service, mockDB := setupTestService()
+	service.dbBreaker.attempts = 1
+	for i := 0; i < service.dbBreaker.threshold; i++ {
+		service.dbBreaker.Do(func() error { return errConnectionRefused })
+	}
+
+	rr := httptest.NewRecorder()
+	service.healthHandler(rr, httptest.NewRequest("GET", "/api/v1/health", nil))
+
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"status":"degraded"`)
+	assert.NotEmpty(t, rr.Header().Get("Retry-After"))
+	mockDB.AssertNotCalled(t, "Ping")
+}
+
+func TestTimedDBFailsFastWhenOpen(t *testing.T) {
+	pool, err := sql.Open("postgres", "postgres://localhost:1/unused?sslmode=disable")
+	require.NoError(t, err)
+	defer pool.Close()
+
+	cb := newTestBreaker(1, time.Minute)
+	cb.attempts = 1
+	cb.Do(func() error { return errConnectionRefused })
+	db := &timedDB{DB: pool, breaker: cb}
+
+	_, err = db.Exec("SELECT 1")
+	assert.ErrorIs(t, err, errDatabaseUnavailable)
+	_, err = db.Query("SELECT 1")
+	assert.ErrorIs(t, err, errDatabaseUnavailable)
+	_, err = db.Begin()
+	assert.ErrorIs(t, err, errDatabaseUnavailable)
+
+	var n int
+	assert.ErrorIs(t, db.QueryRow("SELECT 1").Scan(&n), errDatabaseUnavailable)
+}
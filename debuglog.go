@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// debugPrefix marks the lines written to the log of builds with debug logging
+const debugPrefix = "--- debug: "
+
+// debugf writes a line to the build's log when it has debug logging
+func (tb *tailBuffer) debugf(format string, args ...interface{}) {
+	if tb.debug {
+		fmt.Fprintf(tb, debugPrefix+format+"\n", args...)
+	}
+}
+
+// debugNotes describes how a build was scheduled and configured, for the log
+// of builds with debug logging
+func (bs *BuildService) debugNotes(ctx context.Context, build *BuildRequest, project *Project, timeout time.Duration) []string {
+	var notes []string
+	if q, ok := ctx.Value(buildLeaseKey{}).(*BuildQueue); ok {
+		claim := fmt.Sprintf("claimed by worker %s", q.workerID)
+		if build.StartedAt != nil {
+			claim += fmt.Sprintf(" after %s queued", build.StartedAt.Sub(build.CreatedAt).Round(time.Millisecond))
+		}
+		notes = append(notes, claim)
+		notes = append(notes, fmt.Sprintf("lease of %s renewed every %s", q.leaseDuration, q.heartbeatInterval))
+		if q.fairShare > 0 {
+			notes = append(notes, fmt.Sprintf("default fair share of %d running builds per user", q.fairShare))
+		}
+	}
+	if len(build.DependsOn) > 0 {
+		notes = append(notes, fmt.Sprintf("started once upstream builds %v succeeded", build.DependsOn))
+	}
+	if project == nil {
+		notes = append(notes, "project not found, running with the service defaults")
+	} else if project.CPULimit > 0 || project.MemoryLimitMB > 0 {
+		notes = append(notes, fmt.Sprintf("project limits of %g CPUs and %d MB memory", project.CPULimit, project.MemoryLimitMB))
+	}
+	notes = append(notes, fmt.Sprintf("timeout of %s", timeout))
+
+	switch {
+	case build.PullRequestFork:
+		notes = append(notes, "secrets withheld from a fork's pull request")
+	case len(build.Secrets) > 0:
+		names := make([]string, 0, len(build.Secrets))
+		for name := range build.Secrets {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		notes = append(notes, "secrets injected: "+strings.Join(names, ", "))
+	}
+	if build.ImagePolicy != nil {
+		notes = append(notes, fmt.Sprintf("image policy of org %q applies", build.ImagePolicy.Org))
+	}
+	return notes
+}
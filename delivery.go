@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Delivery modes for integrations
+const (
+	// deliveryBestEffort delivers events straight from the in-process bus;
+	// events are lost if the integration is down or the process exits
+	deliveryBestEffort = "best-effort"
+	// deliveryDurable writes events to the outbox table and retries until
+	// they are delivered or run out of attempts
+	deliveryDurable = "durable"
+)
+
+// errIntegrationDisabled is returned by sinks whose integration has been
+// disabled after repeated failures
+var errIntegrationDisabled = errors.New("integration disabled")
+
+// EventSink delivers build events to an external integration
+type EventSink interface {
+	Name() string
+	Deliver(ctx context.Context, event BuildEvent) error
+}
+
+// OutboxEvent is a build event waiting to be delivered durably to an integration
+type OutboxEvent struct {
+	ID          int64      `json:"id" db:"id"`
+	Integration string     `json:"integration" db:"integration"`
+	Event       BuildEvent `json:"event" db:"payload"`
+	Attempts    int        `json:"attempts" db:"attempts"`
+	LastError   string     `json:"last_error,omitempty" db:"last_error"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+}
+
+// OutboxBacklog summarises the undelivered outbox events of an integration
+type OutboxBacklog struct {
+	Integration   string
+	Pending       int
+	OldestCreated time.Time
+}
+
+// EventDelivery routes build events to integrations in the delivery mode
+// configured for each of them by INTEGRATION_DELIVERY
+type EventDelivery struct {
+	db           DatabaseInterface
+	events       *EventBus
+	errors       *ErrorTracker
+	lag          *prometheus.HistogramVec
+	outboxLag    *prometheus.GaugeVec
+	outboxSize   *prometheus.GaugeVec
+	modes        map[string]string
+	sinks        map[string]EventSink
+	pollInterval time.Duration
+	batchSize    int
+	maxAttempts  int
+	retention    time.Duration
+}
+
+// NewEventDeliveryFromEnv creates an event delivery configured from the environment
+func NewEventDeliveryFromEnv(db DatabaseInterface, events *EventBus, errors *ErrorTracker, lag *prometheus.HistogramVec, outboxLag, outboxSize *prometheus.GaugeVec) *EventDelivery {
+	return &EventDelivery{
+		db:           db,
+		events:       events,
+		errors:       errors,
+		lag:          lag,
+		outboxLag:    outboxLag,
+		outboxSize:   outboxSize,
+		modes:        parseDeliveryModes(os.Getenv("INTEGRATION_DELIVERY")),
+		sinks:        make(map[string]EventSink),
+		pollInterval: getEnvDuration("OUTBOX_POLL_INTERVAL", 5*time.Second),
+		batchSize:    getEnvInt("OUTBOX_BATCH_SIZE", 50),
+		maxAttempts:  getEnvInt("OUTBOX_MAX_ATTEMPTS", 10),
+		retention:    getEnvDuration("OUTBOX_RETENTION", 24*time.Hour),
+	}
+}
+
+// parseDeliveryModes parses a list like "jira=durable,slack=best-effort".
+// Unknown modes fall back to best-effort.
+func parseDeliveryModes(spec string) map[string]string {
+	modes := make(map[string]string)
+	for _, entry := range strings.Split(spec, ",") {
+		name, mode, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			continue
+		}
+		name, mode = strings.TrimSpace(name), strings.TrimSpace(mode)
+		if mode != deliveryBestEffort && mode != deliveryDurable {
+			log.Printf("Unknown delivery mode %q for integration %s, using %s", mode, name, deliveryBestEffort)
+			continue
+		}
+		modes[name] = mode
+	}
+	return modes
+}
+
+// parseOrgTargets parses a list like "acme=bus-a,*=default" mapping
+// organizations to the destination their build events are published to.
+// "*" is the destination of organizations that aren't listed.
+func parseOrgTargets(spec string) map[string]string {
+	targets := make(map[string]string)
+	for _, entry := range strings.Split(spec, ",") {
+		org, target, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || strings.TrimSpace(target) == "" {
+			continue
+		}
+		targets[strings.ToLower(strings.TrimSpace(org))] = strings.TrimSpace(target)
+	}
+	return targets
+}
+
+// orgTarget returns the destination for a build's organization, if any
+func orgTarget(targets map[string]string, build *BuildRequest) (string, bool) {
+	if target, ok := targets[repositoryOrg(build.GitURL)]; ok {
+		return target, true
+	}
+	target, ok := targets["*"]
+	return target, ok
+}
+
+// Mode returns the delivery mode of the named integration
+func (ed *EventDelivery) Mode(name string) string {
+	if mode, ok := ed.modes[name]; ok {
+		return mode
+	}
+	return deliveryBestEffort
+}
+
+// Register adds an integration. Events for durable integrations are written
+// to the outbox as they are published, so none are lost to a slow subscriber.
+func (ed *EventDelivery) Register(sink EventSink) {
+	ed.sinks[sink.Name()] = sink
+	if ed.Mode(sink.Name()) != deliveryDurable {
+		return
+	}
+
+	ed.events.OnPublish(func(event BuildEvent) {
+		outboxEvent := &OutboxEvent{Integration: sink.Name(), Event: event}
+		if err := ed.db.CreateOutboxEvent(outboxEvent); err != nil {
+			ed.errors.Capture("outbox", fmt.Errorf("queueing %s event: %w", sink.Name(), err), &event.Build)
+		}
+	})
+}
+
+// Start delivers events until ctx is cancelled
+func (ed *EventDelivery) Start(ctx context.Context) {
+	durable := false
+	for name, sink := range ed.sinks {
+		if ed.Mode(name) == deliveryDurable {
+			durable = true
+			continue
+		}
+		ed.startBestEffort(ctx, sink)
+	}
+
+	if durable {
+		go ed.runOutbox(ctx)
+	}
+}
+
+// startBestEffort delivers events to sink straight from the event bus
+func (ed *EventDelivery) startBestEffort(ctx context.Context, sink EventSink) {
+	events, unsubscribe := ed.events.Subscribe(100)
+
+	go func() {
+		defer unsubscribe()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event := <-events:
+				// Failures are recorded by the sink's integration health
+				if err := sink.Deliver(ctx, event); err == nil {
+					ed.lag.WithLabelValues(sink.Name(), deliveryBestEffort).Observe(time.Since(event.Time).Seconds())
+				}
+			}
+		}
+	}()
+}
+
+// runOutbox polls the outbox until ctx is cancelled
+func (ed *EventDelivery) runOutbox(ctx context.Context) {
+	poll := time.NewTicker(ed.pollInterval)
+	defer poll.Stop()
+	prune := time.NewTicker(time.Hour)
+	defer prune.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-poll.C:
+			ed.deliverOutbox(ctx)
+			ed.updateBacklog()
+		case <-prune.C:
+			if n, err := ed.db.DeleteDeliveredOutboxEvents(time.Now().Add(-ed.retention)); err != nil {
+				ed.errors.Capture("outbox", fmt.Errorf("pruning delivered events: %w", err), nil)
+			} else if n > 0 {
+				log.Printf("Pruned %d delivered outbox events", n)
+			}
+		}
+	}
+}
+
+// deliverOutbox claims a batch of due outbox events and delivers them
+func (ed *EventDelivery) deliverOutbox(ctx context.Context) {
+	// Claimed events are hidden from other instances until the lease expires
+	events, err := ed.db.ClaimOutboxEvents(ed.batchSize, time.Minute)
+	if err != nil {
+		ed.errors.Capture("outbox", fmt.Errorf("claiming events: %w", err), nil)
+		return
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].ID < events[j].ID })
+
+	for _, event := range events {
+		if ctx.Err() != nil {
+			return
+		}
+		ed.deliverOutboxEvent(ctx, event)
+	}
+}
+
+func (ed *EventDelivery) deliverOutboxEvent(ctx context.Context, event *OutboxEvent) {
+	sink, ok := ed.sinks[event.Integration]
+	if !ok {
+		// Not configured on this instance; leave it for one that is
+		return
+	}
+
+	err := sink.Deliver(ctx, event.Event)
+	switch {
+	case err == nil:
+		if err := ed.db.MarkOutboxEventDelivered(event.ID); err != nil {
+			ed.errors.Capture("outbox", fmt.Errorf("marking event %d delivered: %w", event.ID, err), &event.Event.Build)
+		}
+		ed.lag.WithLabelValues(event.Integration, deliveryDurable).Observe(time.Since(event.Event.Time).Seconds())
+	case errors.Is(err, errIntegrationDisabled):
+		// Hold events until an admin re-enables the integration
+		if err := ed.db.DeferOutboxEvent(event.ID, time.Now().Add(ed.pollInterval)); err != nil {
+			ed.errors.Capture("outbox", fmt.Errorf("deferring event %d: %w", event.ID, err), &event.Event.Build)
+		}
+	case event.Attempts+1 >= ed.maxAttempts:
+		log.Printf("Giving up on %s outbox event %d after %d attempts: %v", event.Integration, event.ID, event.Attempts+1, err)
+		if err := ed.db.FailOutboxEvent(event.ID, err.Error()); err != nil {
+			ed.errors.Capture("outbox", fmt.Errorf("failing event %d: %w", event.ID, err), &event.Event.Build)
+		}
+	default:
+		if err := ed.db.RetryOutboxEvent(event.ID, err.Error(), time.Now().Add(outboxBackoff(event.Attempts+1))); err != nil {
+			ed.errors.Capture("outbox", fmt.Errorf("rescheduling event %d: %w", event.ID, err), &event.Event.Build)
+		}
+	}
+}
+
+// updateBacklog publishes the number and age of undelivered outbox events
+func (ed *EventDelivery) updateBacklog() {
+	backlogs, err := ed.db.OutboxBacklog()
+	if err != nil {
+		ed.errors.Capture("outbox", fmt.Errorf("measuring backlog: %w", err), nil)
+		return
+	}
+
+	for name := range ed.sinks {
+		if ed.Mode(name) == deliveryDurable {
+			ed.outboxLag.WithLabelValues(name).Set(0)
+			ed.outboxSize.WithLabelValues(name).Set(0)
+		}
+	}
+	for _, backlog := range backlogs {
+		ed.outboxLag.WithLabelValues(backlog.Integration).Set(time.Since(backlog.OldestCreated).Seconds())
+		ed.outboxSize.WithLabelValues(backlog.Integration).Set(float64(backlog.Pending))
+	}
+}
+
+// outboxBackoff is the delay before the given retry attempt: 10s doubling up to an hour
+func outboxBackoff(attempt int) time.Duration {
+	delay := 10 * time.Second
+	for i := 1; i < attempt && delay < time.Hour; i++ {
+		delay *= 2
+	}
+	return min(delay, time.Hour)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// fakeSink records delivered events and fails with err when set
+type fakeSink struct {
+	name      string
+	err       error
+	delivered []BuildEvent
+}
+
+func (fs *fakeSink) Name() string {
+	return fs.name
+}
+
+func (fs *fakeSink) Deliver(ctx context.Context, event BuildEvent) error {
+	if fs.err != nil {
+		return fs.err
+	}
+	fs.delivered = append(fs.delivered, event)
+	return nil
+}
+
+func TestParseDeliveryModes(t *testing.T) {
+	modes := parseDeliveryModes(" jira=durable, slack=best-effort,kafka=sometimes,broken")
+	assert.Equal(t, map[string]string{"jira": deliveryDurable, "slack": deliveryBestEffort}, modes)
+}
+
+func TestOrgTarget(t *testing.T) {
+	targets := parseOrgTargets(" Acme=bus-acme, *=default,broken,empty=")
+	assert.Equal(t, map[string]string{"acme": "bus-acme", "*": "default"}, targets)
+
+	target, ok := orgTarget(targets, &BuildRequest{GitURL: "git@github.com:acme/api.git"})
+	assert.True(t, ok)
+	assert.Equal(t, "bus-acme", target)
+
+	target, ok = orgTarget(targets, &BuildRequest{GitURL: "https://gitlab.com/other/group/api"})
+	assert.True(t, ok)
+	assert.Equal(t, "default", target)
+
+	_, ok = orgTarget(parseOrgTargets("acme=bus-acme"), &BuildRequest{GitURL: "https://github.com/other/api"})
+	assert.False(t, ok)
+}
+
+func TestOutboxBackoff(t *testing.T) {
+	assert.Equal(t, 10*time.Second, outboxBackoff(1))
+	assert.Equal(t, 20*time.Second, outboxBackoff(2))
+	assert.Equal(t, 80*time.Second, outboxBackoff(4))
+	assert.Equal(t, time.Hour, outboxBackoff(30))
+}
+
+func TestDurableDeliveryWritesOutbox(t *testing.T) {
+	t.Setenv("INTEGRATION_DELIVERY", "jira=durable")
+	service, mockDB := setupTestService()
+	service.delivery.Register(&fakeSink{name: "jira"})
+	service.delivery.Register(&fakeSink{name: "slack"})
+
+	mockDB.On("CreateOutboxEvent", mock.MatchedBy(func(e *OutboxEvent) bool {
+		return e.Integration == "jira" && e.Event.Build.ID == 7 && e.Event.Build.Status == "failed"
+	})).Return(nil).Once()
+
+	service.events.Publish(&BuildRequest{ID: 7, Status: "failed"})
+
+	assert.Equal(t, deliveryDurable, service.delivery.Mode("jira"))
+	assert.Equal(t, deliveryBestEffort, service.delivery.Mode("slack"))
+	mockDB.AssertExpectations(t)
+}
+
+func TestDeliverOutboxEvent(t *testing.T) {
+	t.Setenv("OUTBOX_MAX_ATTEMPTS", "3")
+	event := func(attempts int) *OutboxEvent {
+		return &OutboxEvent{ID: 5, Integration: "jira", Attempts: attempts, Event: BuildEvent{Build: BuildRequest{ID: 7}, Time: time.Now()}}
+	}
+
+	t.Run("delivered", func(t *testing.T) {
+		service, mockDB := setupTestService()
+		sink := &fakeSink{name: "jira"}
+		service.delivery.Register(sink)
+		mockDB.On("MarkOutboxEventDelivered", int64(5)).Return(nil).Once()
+
+		service.delivery.deliverOutboxEvent(context.Background(), event(0))
+
+		assert.Len(t, sink.delivered, 1)
+		assert.Equal(t, 1, testutil.CollectAndCount(&service.metrics.DeliveryLag))
+		mockDB.AssertExpectations(t)
+	})
+
+	t.Run("failure is retried", func(t *testing.T) {
+		service, mockDB := setupTestService()
+		service.delivery.Register(&fakeSink{name: "jira", err: fmt.Errorf("503")})
+		mockDB.On("RetryOutboxEvent", int64(5), "503", mock.AnythingOfType("time.Time")).Return(nil).Once()
+
+		service.delivery.deliverOutboxEvent(context.Background(), event(1))
+
+		mockDB.AssertExpectations(t)
+	})
+
+	t.Run("final failure gives up", func(t *testing.T) {
+		service, mockDB := setupTestService()
+		service.delivery.Register(&fakeSink{name: "jira", err: fmt.Errorf("503")})
+		mockDB.On("FailOutboxEvent", int64(5), "503").Return(nil).Once()
+
+		service.delivery.deliverOutboxEvent(context.Background(), event(2))
+
+		mockDB.AssertExpectations(t)
+	})
+
+	t.Run("disabled integration is deferred", func(t *testing.T) {
+		service, mockDB := setupTestService()
+		service.delivery.Register(&fakeSink{name: "jira", err: errIntegrationDisabled})
+		mockDB.On("DeferOutboxEvent", int64(5), mock.AnythingOfType("time.Time")).Return(nil).Once()
+
+		service.delivery.deliverOutboxEvent(context.Background(), event(2))
+
+		mockDB.AssertExpectations(t)
+	})
+
+	t.Run("unknown integration is left for other instances", func(t *testing.T) {
+		service, mockDB := setupTestService()
+
+		service.delivery.deliverOutboxEvent(context.Background(), event(0))
+
+		mockDB.AssertExpectations(t)
+	})
+}
+
+func TestUpdateOutboxBacklog(t *testing.T) {
+	t.Setenv("INTEGRATION_DELIVERY", "jira=durable,slack=durable")
+	service, mockDB := setupTestService()
+	service.delivery.Register(&fakeSink{name: "jira"})
+	service.delivery.Register(&fakeSink{name: "slack"})
+
+	mockDB.On("OutboxBacklog").Return([]*OutboxBacklog{
+		{Integration: "jira", Pending: 4, OldestCreated: time.Now().Add(-time.Minute)},
+	}, nil).Once()
+
+	service.delivery.updateBacklog()
+
+	assert.Equal(t, float64(4), testutil.ToFloat64(service.metrics.OutboxPending.WithLabelValues("jira")))
+	assert.InDelta(t, 60, testutil.ToFloat64(service.metrics.OutboxLag.WithLabelValues("jira")), 5)
+	assert.Equal(t, float64(0), testutil.ToFloat64(service.metrics.OutboxPending.WithLabelValues("slack")))
+	mockDB.AssertExpectations(t)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// environmentPattern restricts environment names to short slugs such as
+// "staging" or "prod-eu"
+var environmentPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,62}$`)
+
+// deploymentTransitions lists the statuses a deployment can move to from
+// each status. Deployment tooling reports progress by moving a deployment
+// from pending through deploying to live; a deployment that failed or was
+// reverted ends up rolled_back.
+var deploymentTransitions = map[string][]string{
+	"pending":     {"deploying", "rolled_back"},
+	"deploying":   {"live", "rolled_back"},
+	"live":        {"rolled_back"},
+	"rolled_back": {},
+}
+
+// Deployment records the rollout of a successful build to an environment
+type Deployment struct {
+	ID           int        `json:"id" db:"id"`
+	BuildID      int        `json:"build_id" db:"build_id"`
+	ProjectName  string     `json:"project_name" db:"project_name"`
+	Environment  string     `json:"environment" db:"environment"`
+	Status       string     `json:"status" db:"status"`
+	Description  string     `json:"description,omitempty" db:"description"`
+	TriggeredBy  string     `json:"triggered_by,omitempty" db:"triggered_by"`
+	LiveAt       *time.Time `json:"live_at,omitempty" db:"live_at"`
+	RolledBackAt *time.Time `json:"rolled_back_at,omitempty" db:"rolled_back_at"`
+	CreatedAt    time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at" db:"updated_at"`
+}
+
+// DeploymentRequest is the body of a create deployment request
+type DeploymentRequest struct {
+	BuildID     int    `json:"build_id"`
+	Environment string `json:"environment"`
+	Description string `json:"description,omitempty"`
+	TriggeredBy string `json:"triggered_by,omitempty"`
+}
+
+// DeploymentStatusUpdate is the body of an update deployment request
+type DeploymentStatusUpdate struct {
+	Status string `json:"status"`
+}
+
+// canTransition reports whether a deployment may move from one status to another
+func canTransition(from, to string) bool {
+	for _, next := range deploymentTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Create deployment endpoint
+func (bs *BuildService) createDeploymentHandler(w http.ResponseWriter, r *http.Request) {
+	var req DeploymentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	req.Environment = strings.ToLower(strings.TrimSpace(req.Environment))
+	if req.BuildID <= 0 || req.Environment == "" {
+		http.Error(w, "build_id and environment are required", http.StatusBadRequest)
+		return
+	}
+	if !environmentPattern.MatchString(req.Environment) {
+		http.Error(w, "environment must be a lowercase name of letters, digits, '.', '_' and '-'", http.StatusBadRequest)
+		return
+	}
+
+	build, err := bs.db.GetBuild(req.BuildID)
+	if err == nil && !requestTenant(r).Sees(build.Org) {
+		err = fmt.Errorf("build not found")
+	}
+	if err != nil {
+		if err.Error() == "build not found" {
+			http.Error(w, fmt.Sprintf("Build %d not found", req.BuildID), http.StatusNotFound)
+			return
+		}
+		log.Printf("Error getting build: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if build.Status != "success" {
+		http.Error(w, fmt.Sprintf("Only successful builds can be deployed, build is %s", build.Status), http.StatusConflict)
+		return
+	}
+	gate, err := bs.deploymentBlockedBy(build)
+	if err != nil {
+		log.Printf("Error checking quality gates: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if gate != nil {
+		http.Error(w, fmt.Sprintf("Quality gate %s of %s failed", gate.Name, gate.Tool), http.StatusConflict)
+		return
+	}
+
+	deployment := &Deployment{
+		BuildID:     build.ID,
+		ProjectName: build.ProjectName,
+		Environment: req.Environment,
+		Status:      "pending",
+		Description: req.Description,
+		TriggeredBy: req.TriggeredBy,
+	}
+	if err := bs.db.CreateDeployment(deployment); err != nil {
+		log.Printf("Error creating deployment: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	bs.deploymentChanged(deployment)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(deployment)
+}
+
+// deploymentChanged hands a deployment status change to the escalator and
+// to Jira in the background, so slow incident providers and issue trackers
+// don't hold up deploy tooling
+func (bs *BuildService) deploymentChanged(deployment *Deployment) {
+	if bs.escalations == nil && bs.jira == nil {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if bs.escalations != nil {
+			if err := bs.escalations.DeploymentChanged(ctx, deployment); err != nil && err != errIntegrationDisabled {
+				bs.errors.Capture("escalations", fmt.Errorf("escalating deployment %d: %w", deployment.ID, err), nil)
+			}
+		}
+		if bs.jira != nil {
+			if err := bs.jira.DeploymentChanged(ctx, deployment); err != nil && err != errIntegrationDisabled {
+				bs.errors.Capture("jira", fmt.Errorf("commenting on deployment %d: %w", deployment.ID, err), nil)
+			}
+		}
+	}()
+}
+
+// List deployments endpoint
+func (bs *BuildService) listDeploymentsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	deployments, err := bs.db.ListDeployments(query.Get("project"), strings.ToLower(query.Get("environment")), listOrg(r))
+	if err != nil {
+		log.Printf("Error listing deployments: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deployments)
+}
+
+// deployment loads the deployment named in the request path, writing an
+// error response when it can't
+func (bs *BuildService) deployment(w http.ResponseWriter, r *http.Request) (*Deployment, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid deployment ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	deployment, err := bs.db.GetDeployment(id)
+	if err != nil {
+		if err.Error() == "deployment not found" {
+			http.Error(w, "Deployment not found", http.StatusNotFound)
+			return nil, false
+		}
+		log.Printf("Error getting deployment: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return nil, false
+	}
+	return deployment, true
+}
+
+// Get deployment endpoint
+func (bs *BuildService) getDeploymentHandler(w http.ResponseWriter, r *http.Request) {
+	deployment, ok := bs.deployment(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deployment)
+}
+
+// Update deployment status endpoint
+func (bs *BuildService) updateDeploymentHandler(w http.ResponseWriter, r *http.Request) {
+	var update DeploymentStatusUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if _, ok := deploymentTransitions[update.Status]; !ok {
+		http.Error(w, "status must be one of pending, deploying, live or rolled_back", http.StatusBadRequest)
+		return
+	}
+
+	deployment, ok := bs.deployment(w, r)
+	if !ok {
+		return
+	}
+	if !canTransition(deployment.Status, update.Status) {
+		http.Error(w, fmt.Sprintf("Deployment cannot move from %s to %s", deployment.Status, update.Status), http.StatusConflict)
+		return
+	}
+
+	// The update only applies if no one else moved the deployment meanwhile
+	updated, err := bs.db.UpdateDeploymentStatus(deployment.ID, deployment.Status, update.Status)
+	if err != nil {
+		if err.Error() == "deployment status changed" {
+			http.Error(w, "Deployment status changed concurrently, reload and retry", http.StatusConflict)
+			return
+		}
+		log.Printf("Error updating deployment: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	bs.deploymentChanged(updated)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCanTransition(t *testing.T) {
+	assert.True(t, canTransition("pending", "deploying"))
+	assert.True(t, canTransition("deploying", "live"))
+	assert.True(t, canTransition("live", "rolled_back"))
+	assert.True(t, canTransition("pending", "rolled_back"))
+	assert.False(t, canTransition("pending", "live"))
+	assert.False(t, canTransition("live", "deploying"))
+	assert.False(t, canTransition("rolled_back", "live"))
+}
+
+func TestCreateDeploymentHandler(t *testing.T) {
+	tests := []struct {
+		name           string
+		body           string
+		build          *BuildRequest
+		expectedStatus int
+	}{
+		{"successful build", `{"build_id": 1, "environment": " Staging "}`, &BuildRequest{ID: 1, ProjectName: "api", Status: "success"}, http.StatusCreated},
+		{"failed build", `{"build_id": 1, "environment": "staging"}`, &BuildRequest{ID: 1, ProjectName: "api", Status: "failed"}, http.StatusConflict},
+		{"failed quality gate", `{"build_id": 1, "environment": "staging"}`, &BuildRequest{ID: 1, ProjectName: "gated", Status: "success", CommitSHA: "abc123"}, http.StatusConflict},
+		{"unknown build", `{"build_id": 1, "environment": "staging"}`, nil, http.StatusNotFound},
+		{"missing environment", `{"build_id": 1}`, nil, http.StatusBadRequest},
+		{"invalid environment", `{"build_id": 1, "environment": "prod/eu"}`, nil, http.StatusBadRequest},
+		{"invalid body", `{`, nil, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service, mockDB := setupTestService()
+			if tt.build != nil {
+				mockDB.On("GetBuild", 1).Return(tt.build, nil).Once()
+			} else if tt.expectedStatus == http.StatusNotFound {
+				mockDB.On("GetBuild", 1).Return(nil, fmt.Errorf("build not found")).Once()
+			}
+			mockDB.On("GetProjectByName", "api").Return(&Project{Name: "api"}, nil).Maybe()
+			mockDB.On("GetProjectByName", "gated").Return(&Project{Name: "gated", QualityGatePolicy: qualityGateBlockDeploy}, nil).Maybe()
+			mockDB.On("ListQualityGates", "gated", "abc123").Return([]*QualityGate{{Tool: "sonarqube", Name: "gated", Status: qualityGateFailed}}, nil).Maybe()
+			if tt.expectedStatus == http.StatusCreated {
+				mockDB.On("CreateDeployment", mock.MatchedBy(func(d *Deployment) bool {
+					return d.BuildID == 1 && d.ProjectName == "api" && d.Environment == "staging" && d.Status == "pending"
+				})).Run(func(args mock.Arguments) {
+					args.Get(0).(*Deployment).ID = 7
+				}).Return(nil).Once()
+			}
+
+			rr := httptest.NewRecorder()
+			service.createDeploymentHandler(rr, httptest.NewRequest("POST", "/api/v1/deployments", bytes.NewBufferString(tt.body)))
+
+			assert.Equal(t, tt.expectedStatus, rr.Code)
+			if tt.expectedStatus == http.StatusCreated {
+				var deployment Deployment
+				require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &deployment))
+				assert.Equal(t, 7, deployment.ID)
+				assert.Equal(t, "pending", deployment.Status)
+			}
+			mockDB.AssertExpectations(t)
+		})
+	}
+}
+
+func TestListDeploymentsHandler(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.On("ListDeployments", "api", "prod", "").Return([]*Deployment{{ID: 2, ProjectName: "api", Environment: "prod", Status: "live"}}, nil).Once()
+
+	rr := httptest.NewRecorder()
+	service.listDeploymentsHandler(rr, httptest.NewRequest("GET", "/api/v1/deployments?project=api&environment=PROD", nil))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var deployments []Deployment
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &deployments))
+	assert.Len(t, deployments, 1)
+	mockDB.AssertExpectations(t)
+}
+
+func TestUpdateDeploymentHandler(t *testing.T) {
+	liveAt := time.Now()
+	service, mockDB := setupTestService()
+	mockDB.On("GetDeployment", 1).Return(&Deployment{ID: 1, Status: "deploying"}, nil).Times(3)
+	mockDB.On("GetDeployment", 2).Return(nil, fmt.Errorf("deployment not found")).Once()
+	mockDB.On("UpdateDeploymentStatus", 1, "deploying", "live").Return(&Deployment{ID: 1, Status: "live", LiveAt: &liveAt}, nil).Once()
+	mockDB.On("UpdateDeploymentStatus", 1, "deploying", "rolled_back").Return(nil, fmt.Errorf("deployment status changed")).Once()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/deployments/{id}", service.getDeploymentHandler).Methods("GET")
+	router.HandleFunc("/api/v1/deployments/{id}", service.updateDeploymentHandler).Methods("PATCH")
+
+	for _, tc := range []struct {
+		path, body string
+		expected   int
+	}{
+		{"/api/v1/deployments/1", `{"status": "live"}`, http.StatusOK},
+		{"/api/v1/deployments/1", `{"status": "pending"}`, http.StatusConflict},
+		{"/api/v1/deployments/1", `{"status": "rolled_back"}`, http.StatusConflict},
+		{"/api/v1/deployments/1", `{"status": "done"}`, http.StatusBadRequest},
+		{"/api/v1/deployments/2", `{"status": "live"}`, http.StatusNotFound},
+		{"/api/v1/deployments/x", `{"status": "live"}`, http.StatusBadRequest},
+	} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("PATCH", tc.path, bytes.NewBufferString(tc.body)))
+		assert.Equal(t, tc.expected, rr.Code, tc.body)
+	}
+
+	mockDB.AssertExpectations(t)
+}
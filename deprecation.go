@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ClientInfo identifies the API client that sent a request
+type ClientInfo struct {
+	Name    string `json:"client"`
+	Version string `json:"version"`
+}
+
+type clientContextKey struct{}
+
+// clientFromContext returns the client identified by DeprecationTracker.Middleware
+func clientFromContext(ctx context.Context) ClientInfo {
+	if client, ok := ctx.Value(clientContextKey{}).(ClientInfo); ok {
+		return client
+	}
+	return ClientInfo{Name: "unknown"}
+}
+
+// parseClient identifies the client from the X-Client-Version header (as
+// sent by our SDKs, e.g. "buildctl/1.4.0") or the first User-Agent product
+func parseClient(r *http.Request) ClientInfo {
+	product := r.Header.Get("X-Client-Version")
+	if fields := strings.Fields(r.Header.Get("User-Agent")); product == "" && len(fields) > 0 {
+		product = fields[0]
+	}
+	if product == "" {
+		return ClientInfo{Name: "unknown"}
+	}
+
+	name, version, _ := strings.Cut(product, "/")
+	return ClientInfo{Name: strings.ToLower(name), Version: version}
+}
+
+// Deprecation describes an endpoint slated for removal
+type Deprecation struct {
+	Method    string    `json:"method"`
+	Route     string    `json:"route"`
+	Since     time.Time `json:"since"`
+	Sunset    time.Time `json:"sunset,omitzero"`
+	Successor string    `json:"successor,omitempty"`
+}
+
+// ClientUsage summarises how one client version calls a deprecated endpoint
+type ClientUsage struct {
+	ClientInfo
+	Requests int64     `json:"requests"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// DeprecationReport lists the clients still calling a deprecated endpoint
+type DeprecationReport struct {
+	Deprecation
+	Clients []ClientUsage `json:"clients"`
+}
+
+// DeprecationTracker emits Deprecation/Sunset headers on deprecated endpoints
+// and records which clients still call them
+type DeprecationTracker struct {
+	mu           sync.Mutex
+	deprecations map[string]Deprecation
+	usage        map[string]map[ClientInfo]*ClientUsage
+	counter      *prometheus.CounterVec
+}
+
+// NewDeprecationTracker creates a tracker counting deprecated calls into counter
+func NewDeprecationTracker(counter *prometheus.CounterVec) *DeprecationTracker {
+	return &DeprecationTracker{
+		deprecations: make(map[string]Deprecation),
+		usage:        make(map[string]map[ClientInfo]*ClientUsage),
+		counter:      counter,
+	}
+}
+
+func deprecationKey(method, route string) string {
+	return method + " " + route
+}
+
+// Deprecate marks an endpoint as deprecated
+func (dt *DeprecationTracker) Deprecate(d Deprecation) {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+
+	key := deprecationKey(d.Method, d.Route)
+	dt.deprecations[key] = d
+	if dt.usage[key] == nil {
+		dt.usage[key] = make(map[ClientInfo]*ClientUsage)
+	}
+}
+
+// Middleware identifies the client of every request and, for deprecated
+// endpoints, sets the deprecation headers and records the call
+func (dt *DeprecationTracker) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := parseClient(r)
+		r = r.WithContext(context.WithValue(r.Context(), clientContextKey{}, client))
+
+		route := routeTemplate(r)
+		if d, ok := dt.record(r.Method, route, client); ok {
+			w.Header().Set("Deprecation", fmt.Sprintf("@%d", d.Since.Unix()))
+			if !d.Sunset.IsZero() {
+				w.Header().Set("Sunset", d.Sunset.UTC().Format(http.TimeFormat))
+			}
+			if d.Successor != "" {
+				w.Header().Add("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", expandRoute(d.Successor, mux.Vars(r))))
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// expandRoute fills the {name} variables of a route template, such as a
+// successor's, with those of the matched route
+func expandRoute(template string, vars map[string]string) string {
+	for name, value := range vars {
+		template = strings.ReplaceAll(template, "{"+name+"}", url.PathEscape(value))
+	}
+	return template
+}
+
+func (dt *DeprecationTracker) record(method, route string, client ClientInfo) (Deprecation, bool) {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+
+	key := deprecationKey(method, route)
+	d, ok := dt.deprecations[key]
+	if !ok {
+		return d, false
+	}
+
+	usage := dt.usage[key][client]
+	if usage == nil {
+		usage = &ClientUsage{ClientInfo: client}
+		dt.usage[key][client] = usage
+	}
+	usage.Requests++
+	usage.LastSeen = time.Now().UTC()
+
+	dt.counter.WithLabelValues(method, route, client.Name).Inc()
+	return d, true
+}
+
+// Report returns every deprecated endpoint with the clients that called it
+func (dt *DeprecationTracker) Report() []DeprecationReport {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+
+	reports := make([]DeprecationReport, 0, len(dt.deprecations))
+	for key, d := range dt.deprecations {
+		clients := make([]ClientUsage, 0, len(dt.usage[key]))
+		for _, usage := range dt.usage[key] {
+			clients = append(clients, *usage)
+		}
+		sort.Slice(clients, func(i, j int) bool { return clients[i].Requests > clients[j].Requests })
+
+		reports = append(reports, DeprecationReport{Deprecation: d, Clients: clients})
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		return deprecationKey(reports[i].Method, reports[i].Route) < deprecationKey(reports[j].Method, reports[j].Route)
+	})
+	return reports
+}
+
+// Deprecation report endpoint
+func (bs *BuildService) deprecationReportHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bs.deprecations.Report())
+}
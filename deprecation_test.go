@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseClient(t *testing.T) {
+	tests := []struct {
+		name          string
+		userAgent     string
+		clientVersion string
+		expected      ClientInfo
+	}{
+		{name: "sdk header wins", userAgent: "Go-http-client/1.1", clientVersion: "buildctl/1.4.0", expected: ClientInfo{Name: "buildctl", Version: "1.4.0"}},
+		{name: "user agent product", userAgent: "curl/8.4.0", expected: ClientInfo{Name: "curl", Version: "8.4.0"}},
+		{name: "browser user agent", userAgent: "Mozilla/5.0 (X11; Linux x86_64)", expected: ClientInfo{Name: "mozilla", Version: "5.0"}},
+		{name: "no version", userAgent: "jenkins", expected: ClientInfo{Name: "jenkins"}},
+		{name: "anonymous", expected: ClientInfo{Name: "unknown"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("User-Agent", tt.userAgent)
+			if tt.clientVersion != "" {
+				req.Header.Set("X-Client-Version", tt.clientVersion)
+			}
+			assert.Equal(t, tt.expected, parseClient(req))
+		})
+	}
+}
+
+func TestDeprecationMiddleware(t *testing.T) {
+	service, _ := setupTestService()
+
+	since := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	sunset := time.Date(2026, 12, 31, 0, 0, 0, 0, time.UTC)
+	service.deprecations.Deprecate(Deprecation{
+		Method:    "GET",
+		Route:     "/api/v1/legacy/{id}",
+		Since:     since,
+		Sunset:    sunset,
+		Successor: "/api/v2/items/{id}",
+	})
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/legacy/{id}", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "buildctl", clientFromContext(r.Context()).Name)
+	}).Methods("GET")
+	router.HandleFunc("/api/v1/current", func(w http.ResponseWriter, r *http.Request) {}).Methods("GET")
+	router.Use(service.deprecations.Middleware)
+
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("GET", "/api/v1/legacy/1", nil)
+		req.Header.Set("User-Agent", "buildctl/1.2.0")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		assert.Equal(t, "@1767225600", rr.Header().Get("Deprecation"))
+		assert.Equal(t, "Thu, 31 Dec 2026 00:00:00 GMT", rr.Header().Get("Sunset"))
+		assert.Contains(t, rr.Header().Get("Link"), `rel="successor-version"`)
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/current", nil))
+	assert.Empty(t, rr.Header().Get("Deprecation"))
+
+	assert.Equal(t, 3.0, testutil.ToFloat64(service.metrics.DeprecatedCalls.WithLabelValues("GET", "/api/v1/legacy/{id}", "buildctl")))
+
+	rr = httptest.NewRecorder()
+	service.deprecationReportHandler(rr, httptest.NewRequest("GET", "/api/v1/admin/deprecations", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var report []DeprecationReport
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &report))
+	require.Len(t, report, 1)
+	require.Len(t, report[0].Clients, 1)
+	assert.Equal(t, "1.2.0", report[0].Clients[0].Version)
+	assert.Equal(t, int64(3), report[0].Clients[0].Requests)
+}
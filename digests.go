@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Digest channels and the notifier that sends each
+const (
+	digestEmail = "email"
+	digestSlack = "slack"
+)
+
+var digestNotifiers = map[string]string{digestEmail: "email", digestSlack: "slack-webhook"}
+
+// Bounds of a digest's interval, and the most builds listed in one digest
+const (
+	minDigestInterval = 5 * time.Minute
+	maxDigestInterval = 7 * 24 * time.Hour
+	maxDigestBuilds   = 500
+)
+
+// NotificationDigest sends one email address or Slack channel a periodic
+// summary of finished builds instead of a message per build
+type NotificationDigest struct {
+	ID      int    `json:"id" db:"id"`
+	Channel string `json:"channel" db:"channel"`
+	// Target is the email address or Slack webhook URL the digest is sent to
+	Target string `json:"target" db:"target"`
+	// Projects and Statuses limit the builds in the digest; no projects
+	// means every project, and statuses default to failed and timeout
+	Projects        []string   `json:"projects" db:"projects"`
+	Statuses        []string   `json:"statuses" db:"statuses"`
+	IntervalSeconds int        `json:"interval_seconds" db:"interval_seconds"`
+	NextRunAt       time.Time  `json:"next_run_at" db:"next_run_at"`
+	LastRunAt       *time.Time `json:"last_run_at,omitempty" db:"last_run_at"`
+	CreatedAt       time.Time  `json:"created_at" db:"created_at"`
+	// WindowStart is the end of the previous digest, set when a due digest
+	// is claimed
+	WindowStart time.Time `json:"-"`
+}
+
+// Validate checks the digest's channel, target, statuses and interval,
+// filling in defaults, and sets when it first runs
+func (nd *NotificationDigest) Validate(now time.Time) error {
+	switch nd.Channel {
+	case digestEmail:
+		address, err := mail.ParseAddress(nd.Target)
+		if err != nil {
+			return fmt.Errorf("target must be an email address")
+		}
+		nd.Target = strings.ToLower(address.Address)
+	case digestSlack:
+		u, err := url.Parse(nd.Target)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return errors.New("target must be a Slack webhook URL")
+		}
+	default:
+		return fmt.Errorf("channel must be %s or %s", digestEmail, digestSlack)
+	}
+
+	if len(nd.Statuses) == 0 {
+		nd.Statuses = []string{"failed", "timeout"}
+	}
+	for _, status := range nd.Statuses {
+		if !notificationStatuses[status] {
+			return fmt.Errorf("invalid status %q: digests cover success, failed and timeout builds", status)
+		}
+	}
+	if nd.Projects == nil {
+		nd.Projects = []string{}
+	}
+
+	if nd.IntervalSeconds == 0 {
+		nd.IntervalSeconds = int(time.Hour / time.Second)
+	}
+	interval := time.Duration(nd.IntervalSeconds) * time.Second
+	if interval < minDigestInterval || interval > maxDigestInterval {
+		return fmt.Errorf("interval_seconds must be between %d and %d", int(minDigestInterval/time.Second), int(maxDigestInterval/time.Second))
+	}
+	nd.NextRunAt = now.Add(interval).UTC()
+	return nil
+}
+
+// Covers reports whether the digest includes a finished build
+func (nd *NotificationDigest) Covers(build *BuildRequest) bool {
+	if len(nd.Projects) > 0 && !containsString(nd.Projects, build.ProjectName) {
+		return false
+	}
+	return containsString(nd.Statuses, build.Status)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// digestKey identifies a recipient of digests in Notification.Digested
+func digestKey(channel, target string) string {
+	if channel == digestEmail {
+		target = strings.ToLower(target)
+	}
+	return channel + ":" + target
+}
+
+// digestNotification summarises builds grouped by project, in name order,
+// in the locale
+func digestNotification(links *PublicURLs, catalog *Catalog, locale string, builds []*BuildRequest, since, until time.Time, truncated bool) *Notification {
+	byProject := map[string][]*BuildRequest{}
+	var projects []string
+	for _, build := range builds {
+		if _, ok := byProject[build.ProjectName]; !ok {
+			projects = append(projects, build.ProjectName)
+		}
+		byProject[build.ProjectName] = append(byProject[build.ProjectName], build)
+	}
+	sort.Strings(projects)
+
+	var text strings.Builder
+	fmt.Fprintln(&text, catalog.Sprintf(locale, "Builds finished between %s and %s UTC:", since.UTC().Format("2006-01-02 15:04"), until.UTC().Format("2006-01-02 15:04")))
+	for _, project := range projects {
+		fmt.Fprintf(&text, "\n%s (%d)\n", project, len(byProject[project]))
+		for _, build := range byProject[project] {
+			fmt.Fprintf(&text, "  #%d %s on %s", build.ID, build.Status, build.Branch)
+			if build.CommitSHA != "" {
+				fmt.Fprintf(&text, " (%s)", (&Notification{Build: *build}).ShortSHA())
+			}
+			fmt.Fprintf(&text, " %s\n", links.BuildURL(build))
+		}
+	}
+	if truncated {
+		fmt.Fprintf(&text, "\n%s\n", catalog.Sprintf(locale, "Only the first %d builds are listed.", maxDigestBuilds))
+	}
+
+	return &Notification{
+		Subject: catalog.Sprintf(locale, "Build digest: %s in %s", plural(catalog, locale, len(builds), "build"), plural(catalog, locale, len(projects), "project")),
+		Text:    text.String(),
+	}
+}
+
+// plural formats a count of things in the locale, e.g. "1 build" or "3 builds"
+func plural(catalog *Catalog, locale string, n int, thing string) string {
+	if n == 1 {
+		return catalog.Translate(locale, "1 "+thing)
+	}
+	return catalog.Sprintf(locale, "%d "+thing+"s", n)
+}
+
+// DigestScheduler sends the notification digests that are due
+type DigestScheduler struct {
+	db        DatabaseInterface
+	health    *IntegrationHealth
+	errors    *ErrorTracker
+	links     *PublicURLs
+	catalog   *Catalog
+	locale    string
+	notifiers map[string]Notifier
+	interval  time.Duration
+}
+
+// NewDigestSchedulerFromEnv creates a scheduler checking for due digests
+// every DIGEST_CHECK_INTERVAL, sending them with the notification sink's
+// providers
+func NewDigestSchedulerFromEnv(db DatabaseInterface, sink *NotificationSink, errors *ErrorTracker) *DigestScheduler {
+	notifiers := map[string]Notifier{}
+	for _, notifier := range sink.notifiers {
+		notifiers[notifier.Name()] = notifier
+	}
+
+	return &DigestScheduler{
+		db:        db,
+		health:    sink.health,
+		errors:    errors,
+		links:     sink.links,
+		catalog:   sink.catalog,
+		locale:    sink.locale,
+		notifiers: notifiers,
+		interval:  getEnvDuration("DIGEST_CHECK_INTERVAL", time.Minute),
+	}
+}
+
+// Supports reports whether the provider of a digest channel is configured
+func (ds *DigestScheduler) Supports(channel string) bool {
+	_, ok := ds.notifiers[digestNotifiers[channel]]
+	return ok
+}
+
+// Start sends due digests every interval until ctx is cancelled
+func (ds *DigestScheduler) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(ds.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				ds.SendDue(ctx, now)
+			}
+		}
+	}()
+}
+
+// SendDue claims every digest due at now and sends it. Claiming moves the
+// digest's window forward, so each window is sent at most once across
+// instances.
+func (ds *DigestScheduler) SendDue(ctx context.Context, now time.Time) {
+	digests, err := ds.db.ClaimDueNotificationDigests(now)
+	if err != nil {
+		ds.errors.Capture("digests", fmt.Errorf("claiming due digests: %w", err), nil)
+		return
+	}
+
+	for _, digest := range digests {
+		if err := ds.send(ctx, digest, now); err != nil {
+			ds.errors.Capture("digests", fmt.Errorf("digest %d: %w", digest.ID, err), nil)
+		}
+	}
+}
+
+// send delivers one digest of the builds finished in its window. Nothing is
+// sent for a window without builds.
+func (ds *DigestScheduler) send(ctx context.Context, digest *NotificationDigest, now time.Time) error {
+	notifier, ok := ds.notifiers[digestNotifiers[digest.Channel]]
+	if !ok {
+		return fmt.Errorf("%s notifications are not configured", digest.Channel)
+	}
+	if !ds.health.Allow(notifier.Name()) {
+		return nil
+	}
+
+	builds, err := ds.db.ListBuildsFinishedBetween(digest.WindowStart, now, digest.Projects, digest.Statuses, maxDigestBuilds+1)
+	if err != nil {
+		return fmt.Errorf("listing builds: %w", err)
+	}
+	if len(builds) == 0 {
+		return nil
+	}
+	truncated := len(builds) > maxDigestBuilds
+	if truncated {
+		builds = builds[:maxDigestBuilds]
+	}
+
+	notification := digestNotification(ds.links, ds.catalog, ds.locale, builds, digest.WindowStart, now, truncated)
+	notification.Project = &Project{}
+	if digest.Channel == digestEmail {
+		notification.Project.NotifyEmails = []string{digest.Target}
+	} else {
+		notification.Project.NotifySlackWebhookURL = digest.Target
+	}
+
+	// Delivery failures are captured as failures of the provider
+	err = notifier.Notify(ctx, notification)
+	ds.health.Record(notifier.Name(), err, nil)
+	if err == nil {
+		log.Printf("Sent digest %d of %d builds to %s", digest.ID, len(builds), digest.Channel)
+	}
+	return nil
+}
+
+// digestRecipients returns the recipients who get the build in a digest
+// instead of a message of its own
+func (ns *NotificationSink) digestRecipients(build *BuildRequest) (map[string]bool, error) {
+	digests, err := ns.db.ListNotificationDigests()
+	if err != nil {
+		return nil, err
+	}
+
+	recipients := map[string]bool{}
+	for _, digest := range digests {
+		if digest.Covers(build) {
+			recipients[digestKey(digest.Channel, digest.Target)] = true
+		}
+	}
+	return recipients, nil
+}
+
+// Create notification digest endpoint
+func (bs *BuildService) createNotificationDigestHandler(w http.ResponseWriter, r *http.Request) {
+	var digest NotificationDigest
+	if err := json.NewDecoder(r.Body).Decode(&digest); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := digest.Validate(time.Now()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !bs.digests.Supports(digest.Channel) {
+		http.Error(w, fmt.Sprintf("%s notifications are not configured", digest.Channel), http.StatusBadRequest)
+		return
+	}
+
+	if err := bs.db.CreateNotificationDigest(&digest); err != nil {
+		log.Printf("Error creating notification digest: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(digest)
+}
+
+// List notification digests endpoint
+func (bs *BuildService) listNotificationDigestsHandler(w http.ResponseWriter, r *http.Request) {
+	digests, err := bs.db.ListNotificationDigests()
+	if err != nil {
+		log.Printf("Error listing notification digests: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(digests)
+}
+
+// Delete notification digest endpoint. The recipient gets a message per
+// build again.
+func (bs *BuildService) deleteNotificationDigestHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid notification digest ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := bs.db.DeleteNotificationDigest(id); err != nil {
+		if err.Error() == "notification digest not found" {
+			http.Error(w, "Notification digest not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error deleting notification digest: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNotificationDigestValidate(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	digest := NotificationDigest{Channel: digestEmail, Target: "Jane Doe <Jane@Example.com>"}
+	require.NoError(t, digest.Validate(now))
+	assert.Equal(t, "jane@example.com", digest.Target)
+	assert.Equal(t, []string{"failed", "timeout"}, digest.Statuses)
+	assert.Equal(t, []string{}, digest.Projects)
+	assert.Equal(t, 3600, digest.IntervalSeconds)
+	assert.Equal(t, now.Add(time.Hour), digest.NextRunAt)
+
+	for _, invalid := range []NotificationDigest{
+		{Channel: "sms", Target: "+15550100"},
+		{Channel: digestEmail, Target: "not an address"},
+		{Channel: digestSlack, Target: "ftp://hooks.example.com"},
+		{Channel: digestSlack, Target: "https://hooks.example.com", Statuses: []string{"running"}},
+		{Channel: digestSlack, Target: "https://hooks.example.com", IntervalSeconds: 60},
+		{Channel: digestSlack, Target: "https://hooks.example.com", IntervalSeconds: 30 * 24 * 3600},
+	} {
+		assert.Error(t, invalid.Validate(now), "%+v", invalid)
+	}
+}
+
+func TestNotificationDigestCovers(t *testing.T) {
+	all := NotificationDigest{Statuses: []string{"failed"}}
+	assert.True(t, all.Covers(&BuildRequest{ProjectName: "api", Status: "failed"}))
+	assert.False(t, all.Covers(&BuildRequest{ProjectName: "api", Status: "success"}))
+
+	api := NotificationDigest{Projects: []string{"api"}, Statuses: []string{"failed"}}
+	assert.True(t, api.Covers(&BuildRequest{ProjectName: "api", Status: "failed"}))
+	assert.False(t, api.Covers(&BuildRequest{ProjectName: "web", Status: "failed"}))
+}
+
+func TestDigestNotificationGroupsByProject(t *testing.T) {
+	since := time.Date(2024, 5, 1, 11, 0, 0, 0, time.UTC)
+	notification := digestNotification(nil, nil, defaultLocale, []*BuildRequest{
+		{ID: 3, ProjectName: "web", Branch: "main", Status: "failed"},
+		{ID: 1, ProjectName: "api", Branch: "main", Status: "failed", CommitSHA: "0123456789abcdef0123"},
+		{ID: 2, ProjectName: "api", Branch: "dev", Status: "timeout"},
+	}, since, since.Add(time.Hour), false)
+
+	assert.Equal(t, "Build digest: 3 builds in 2 projects", notification.Subject)
+	assert.Equal(t, "Builds finished between 2024-05-01 11:00 and 2024-05-01 12:00 UTC:\n"+
+		"\napi (2)\n"+
+		"  #1 failed on main (0123456789ab) "+buildURL(1)+"\n"+
+		"  #2 timeout on dev "+buildURL(2)+"\n"+
+		"\nweb (1)\n"+
+		"  #3 failed on main "+buildURL(3)+"\n", notification.Text)
+
+	single := digestNotification(nil, nil, defaultLocale, []*BuildRequest{{ID: 1, ProjectName: "api", Status: "failed"}}, since, since, true)
+	assert.Equal(t, "Build digest: 1 build in 1 project", single.Subject)
+	assert.Contains(t, single.Text, "Only the first 500 builds are listed.")
+}
+
+func newTestDigestScheduler(notifiers ...Notifier) (*DigestScheduler, *MockDatabase) {
+	sink, mockDB := newTestNotificationSink(notifiers...)
+	service, _ := setupTestService()
+	return NewDigestSchedulerFromEnv(mockDB, sink, service.errors), mockDB
+}
+
+func TestDigestSchedulerSendDue(t *testing.T) {
+	email := &fakeNotifier{name: "email", enabled: true}
+	scheduler, mockDB := newTestDigestScheduler(email, &fakeNotifier{name: "slack-webhook"})
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	windowStart := now.Add(-time.Hour)
+
+	mockDB.On("ClaimDueNotificationDigests", now).Return([]*NotificationDigest{
+		{ID: 1, Channel: digestEmail, Target: "jane@example.com", Projects: []string{}, Statuses: []string{"failed"}, WindowStart: windowStart},
+		{ID: 2, Channel: digestSlack, Target: "https://hooks.example.com/quiet", Projects: []string{"quiet"}, Statuses: []string{"failed"}, WindowStart: windowStart},
+	}, nil).Once()
+	mockDB.On("GetIntegration", mock.AnythingOfType("string")).Return(nil, fmt.Errorf("integration not found"))
+	mockDB.On("ListBuildsFinishedBetween", windowStart, now, []string{}, []string{"failed"}, maxDigestBuilds+1).
+		Return([]*BuildRequest{{ID: 7, ProjectName: "api", Branch: "main", Status: "failed"}}, nil).Once()
+	mockDB.On("ListBuildsFinishedBetween", windowStart, now, []string{"quiet"}, []string{"failed"}, maxDigestBuilds+1).
+		Return([]*BuildRequest{}, nil).Once()
+	mockDB.On("ResetIntegrationFailures", "email").Return(nil).Once()
+
+	scheduler.SendDue(context.Background(), now)
+
+	require.Len(t, email.notified, 1)
+	assert.Equal(t, "Build digest: 1 build in 1 project", email.notified[0].Subject)
+	assert.Equal(t, []string{"jane@example.com"}, email.notified[0].Project.NotifyEmails)
+	mockDB.AssertExpectations(t)
+}
+
+func TestNotificationSinkLeavesDigestedRecipients(t *testing.T) {
+	t.Setenv("SMTP_HOST", "smtp.example.com")
+	email := NewEmailNotifierFromEnv()
+	var sentTo []string
+	email.send = func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		sentTo = to
+		return nil
+	}
+
+	var slackPosts int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { slackPosts++ }))
+	defer server.Close()
+	slack := NewSlackWebhookNotifier("")
+
+	sink, mockDB := newTestNotificationSink(email, slack)
+	mockDB.On("GetProjectByName", "api").Return(&Project{
+		Name:                  "api",
+		NotifyOn:              notifyAlways,
+		NotifyEmails:          []string{"Jane@example.com", "ops@example.com"},
+		NotifySlackWebhookURL: server.URL,
+	}, nil)
+	mockDB.On("GetIntegration", mock.AnythingOfType("string")).Return(nil, fmt.Errorf("integration not found"))
+	mockDB.On("ResetIntegrationFailures", mock.AnythingOfType("string")).Return(nil)
+	mockDB.On("ListNotificationDigests").Return([]*NotificationDigest{
+		{Channel: digestEmail, Target: "jane@example.com", Projects: []string{}, Statuses: []string{"failed"}},
+		{Channel: digestSlack, Target: server.URL, Projects: []string{"api"}, Statuses: []string{"failed", "timeout"}},
+	}, nil)
+
+	// Failures go to the digests instead
+	require.NoError(t, sink.Deliver(context.Background(), BuildEvent{Build: BuildRequest{ID: 1, ProjectName: "api", Status: "failed"}}))
+	assert.Equal(t, []string{"ops@example.com"}, sentTo)
+	assert.Equal(t, 0, slackPosts)
+
+	// Successes aren't in any digest
+	require.NoError(t, sink.Deliver(context.Background(), BuildEvent{Build: BuildRequest{ID: 2, ProjectName: "api", Status: "success"}}))
+	assert.Equal(t, []string{"Jane@example.com", "ops@example.com"}, sentTo)
+	assert.Equal(t, 1, slackPosts)
+}
+
+func TestCreateNotificationDigestHandler(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.On("CreateNotificationDigest", mock.MatchedBy(func(d *NotificationDigest) bool {
+		return d.Channel == digestSlack && d.IntervalSeconds == 86400 && d.Projects[0] == "api"
+	})).Run(func(args mock.Arguments) {
+		args.Get(0).(*NotificationDigest).ID = 4
+	}).Return(nil).Once()
+
+	create := func(body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		service.createNotificationDigestHandler(rr, httptest.NewRequest("POST", "/api/v1/notifications/digests", bytes.NewBufferString(body)))
+		return rr
+	}
+
+	rr := create(`{"channel":"slack","target":"https://hooks.example.com/T1","projects":["api"],"interval_seconds":86400}`)
+	require.Equal(t, http.StatusCreated, rr.Code)
+	var digest NotificationDigest
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &digest))
+	assert.Equal(t, 4, digest.ID)
+	assert.Equal(t, []string{"failed", "timeout"}, digest.Statuses)
+
+	assert.Equal(t, http.StatusBadRequest, create(`{"channel":"pager","target":"x"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, create(`not json`).Code)
+
+	// Email digests need SMTP_HOST
+	rr = create(`{"channel":"email","target":"jane@example.com"}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "email notifications are not configured")
+	mockDB.AssertExpectations(t)
+}
+
+func TestDeleteNotificationDigestHandler(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.On("DeleteNotificationDigest", 1).Return(nil).Once()
+	mockDB.On("DeleteNotificationDigest", 2).Return(fmt.Errorf("notification digest not found")).Once()
+
+	remove := func(id string) *httptest.ResponseRecorder {
+		req := mux.SetURLVars(httptest.NewRequest("DELETE", "/api/v1/notifications/digests/"+id, nil), map[string]string{"id": id})
+		rr := httptest.NewRecorder()
+		service.deleteNotificationDigestHandler(rr, req)
+		return rr
+	}
+
+	assert.Equal(t, http.StatusNoContent, remove("1").Code)
+	assert.Equal(t, http.StatusNotFound, remove("2").Code)
+	assert.Equal(t, http.StatusBadRequest, remove("x").Code)
+	mockDB.AssertExpectations(t)
+}
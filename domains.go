@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// orgDomainsTTL is how long the organizations' domains are cached
+const orgDomainsTTL = 30 * time.Second
+
+var domainPattern = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z]{2,63}$`)
+
+// basePathFromEnv returns BASE_PATH, the path prefix the service is served
+// under, as "/prefix", or "" when it's served at the root
+func basePathFromEnv() string {
+	prefix := strings.Trim(os.Getenv("BASE_PATH"), "/")
+	if prefix == "" {
+		return ""
+	}
+	return "/" + prefix
+}
+
+// publicBaseURL returns the externally reachable URL of the service:
+// PUBLIC_URL followed by BASE_PATH, unless PUBLIC_URL already ends with it
+func publicBaseURL() string {
+	base := strings.TrimSuffix(os.Getenv("PUBLIC_URL"), "/")
+	if base == "" {
+		base = "http://localhost:8080"
+	}
+	if prefix := basePathFromEnv(); !strings.HasSuffix(base, prefix) {
+		base += prefix
+	}
+	return base
+}
+
+// withBasePath serves handler under prefix, for proxies that forward the
+// prefix rather than stripping it. Unprefixed paths are served too, so probes
+// and in-cluster clients can keep calling the service directly.
+func withBasePath(prefix string, handler http.Handler) http.Handler {
+	if prefix == "" {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if path, ok := strings.CutPrefix(r.URL.Path, prefix); ok && (path == "" || path[0] == '/') {
+			r2 := new(http.Request)
+			*r2 = *r
+			r2.URL = new(url.URL)
+			*r2.URL = *r.URL
+			r2.URL.Path = "/" + strings.TrimPrefix(path, "/")
+			r2.URL.RawPath = ""
+			r = r2
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// PublicURLs builds links to the service for notifications, webhooks and
+// badges. Links to an organization's builds use its vanity domain, when it
+// has one, and PUBLIC_URL otherwise; both are followed by BASE_PATH.
+type PublicURLs struct {
+	base     string
+	basePath string
+	db       DatabaseInterface
+	errors   *ErrorTracker
+
+	mu      sync.Mutex
+	loaded  time.Time
+	domains map[string]string // org to domain
+	orgs    map[string]string // domain to org
+}
+
+// NewPublicURLsFromEnv creates the link builder from PUBLIC_URL and BASE_PATH
+func NewPublicURLsFromEnv(db DatabaseInterface, errors *ErrorTracker) *PublicURLs {
+	return &PublicURLs{
+		base:     publicBaseURL(),
+		basePath: basePathFromEnv(),
+		db:       db,
+		errors:   errors,
+	}
+}
+
+// load refreshes the cached domains once they're older than orgDomainsTTL.
+// On errors the stale domains are kept until the next attempt. The caller
+// holds pu.mu.
+func (pu *PublicURLs) load() {
+	if time.Since(pu.loaded) < orgDomainsTTL {
+		return
+	}
+	pu.loaded = time.Now()
+
+	orgs, err := pu.db.ListOrganizations()
+	if err != nil {
+		pu.errors.Capture("domains", fmt.Errorf("loading organization domains: %w", err), nil)
+		return
+	}
+	pu.domains = make(map[string]string)
+	pu.orgs = make(map[string]string)
+	for _, org := range orgs {
+		if org.Domain != "" {
+			pu.domains[org.Name] = org.Domain
+			pu.orgs[org.Domain] = org.Name
+		}
+	}
+}
+
+// Invalidate drops the cached domains after an organization changed
+func (pu *PublicURLs) Invalidate() {
+	pu.mu.Lock()
+	defer pu.mu.Unlock()
+	pu.loaded = time.Time{}
+}
+
+// Base returns the base URL of links to an organization's resources. A nil
+// PublicURLs links to PUBLIC_URL.
+func (pu *PublicURLs) Base(org string) string {
+	if pu == nil {
+		return publicBaseURL()
+	}
+	if org == "" {
+		return pu.base
+	}
+	pu.mu.Lock()
+	pu.load()
+	domain := pu.domains[org]
+	pu.mu.Unlock()
+
+	if domain == "" {
+		return pu.base
+	}
+	return "https://" + domain + pu.basePath
+}
+
+// BuildURL returns the link to a build
+func (pu *PublicURLs) BuildURL(build *BuildRequest) string {
+	return fmt.Sprintf("%s/api/v1/builds/%d", pu.Base(build.Org), build.ID)
+}
+
+// HostOrg returns the organization whose vanity domain a request was sent
+// to, or "" for other hosts
+func (pu *PublicURLs) HostOrg(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if pu == nil || host == "" {
+		return ""
+	}
+
+	pu.mu.Lock()
+	defer pu.mu.Unlock()
+	pu.load()
+	return pu.orgs[host]
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublicBaseURL(t *testing.T) {
+	for _, tt := range []struct {
+		publicURL, basePath, want string
+	}{
+		{"", "", "http://localhost:8080"},
+		{"https://ci.example.com/", "", "https://ci.example.com"},
+		{"https://example.com", "ci/", "https://example.com/ci"},
+		{"https://example.com/ci", "/ci", "https://example.com/ci"},
+		{"https://example.com", "/", "https://example.com"},
+	} {
+		t.Setenv("PUBLIC_URL", tt.publicURL)
+		t.Setenv("BASE_PATH", tt.basePath)
+		assert.Equal(t, tt.want, publicBaseURL(), "%+v", tt)
+	}
+}
+
+func TestWithBasePath(t *testing.T) {
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/builds", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("builds")) })
+	handler := withBasePath("/ci", router)
+
+	for path, status := range map[string]int{
+		"/ci/api/v1/builds":   http.StatusOK,
+		"/api/v1/builds":      http.StatusOK, // probes skip the proxy
+		"/cicd/api/v1/builds": http.StatusNotFound,
+	} {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		assert.Equal(t, status, rr.Code, path)
+	}
+}
+
+func TestPublicURLsUseOrganizationDomains(t *testing.T) {
+	t.Setenv("PUBLIC_URL", "https://ci.example.com")
+	t.Setenv("BASE_PATH", "/builds")
+	service, _ := setupTestService()
+	mockDB := &MockDatabase{}
+	mockDB.On("ListOrganizations").Return([]*Organization{{Name: "acme", Domain: "ci.acme.dev"}, {Name: "globex"}}, nil).Once()
+	links := NewPublicURLsFromEnv(mockDB, service.errors)
+
+	assert.Equal(t, "https://ci.acme.dev/builds/api/v1/builds/3", links.BuildURL(&BuildRequest{ID: 3, Org: "acme"}))
+	assert.Equal(t, "https://ci.example.com/builds/api/v1/builds/4", links.BuildURL(&BuildRequest{ID: 4, Org: "globex"}))
+	assert.Equal(t, "https://ci.example.com/builds/api/v1/builds/5", links.BuildURL(&BuildRequest{ID: 5}))
+	assert.Equal(t, "acme", links.HostOrg("CI.acme.dev:443"))
+	assert.Equal(t, "", links.HostOrg("ci.example.com"))
+
+	// Changes are picked up once the cache is invalidated
+	mockDB.On("ListOrganizations").Return(nil, fmt.Errorf("connection refused")).Once()
+	links.Invalidate()
+	assert.Equal(t, "acme", links.HostOrg("ci.acme.dev"), "stale domains are kept on errors")
+	mockDB.AssertExpectations(t)
+}
+
+func TestVanityHostsScopeRequests(t *testing.T) {
+	service, mockDB := setupTestService()
+	orgsDB := &MockDatabase{}
+	orgsDB.On("ListOrganizations").Return([]*Organization{{Name: "acme", Domain: "ci.acme.dev"}}, nil)
+	service.tenancy.links = NewPublicURLsFromEnv(orgsDB, service.errors)
+	mockDB.On("GetAPIKeyByHash", hashAPIKey(testAPIKey)).Return(&APIKey{ID: 4, Org: "globex"}, nil)
+	mockDB.On("TouchAPIKey", 4).Return(nil).Maybe()
+	mockDB.On("ListBuilds", false, "acme", Labels(nil)).Return([]*BuildRequest{}, nil).Once()
+	router := tenancyRouter(service)
+
+	req := httptest.NewRequest("GET", "/api/v1/builds", nil)
+	req.Host = "ci.acme.dev"
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// Keys of other orgs can't be used on the org's domain
+	req = tenantRequest("GET", "/api/v1/builds", testAPIKey, "")
+	req.Host = "ci.acme.dev"
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	mockDB.AssertExpectations(t)
+}
+
+func TestUpdateOrganizationHandler(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.On("GetOrganization", "acme").Return(&Organization{Name: "acme", DisplayName: "Acme"}, nil)
+	mockDB.On("GetOrganization", "nope").Return(nil, fmt.Errorf("organization not found"))
+	mockDB.On("UpdateOrganization", mock.MatchedBy(func(org *Organization) bool { return org.Domain == "ci.acme.dev" })).Return(nil).Once()
+	mockDB.On("UpdateOrganization", mock.Anything).Return(fmt.Errorf("domain already in use")).Once()
+
+	for _, tt := range []struct {
+		org, body string
+		status    int
+	}{
+		{"acme", `{"domain": " CI.acme.dev "}`, http.StatusOK},
+		{"acme", `{"domain": "ci.globex.dev"}`, http.StatusConflict},
+		{"acme", `{"domain": "https://ci.acme.dev/"}`, http.StatusBadRequest},
+		{"nope", `{}`, http.StatusNotFound},
+	} {
+		req := mux.SetURLVars(httptest.NewRequest("PATCH", "/api/v1/admin/orgs/"+tt.org, bytes.NewBufferString(tt.body)), map[string]string{"org": tt.org})
+		rr := httptest.NewRecorder()
+		service.updateOrganizationHandler(rr, req)
+		assert.Equal(t, tt.status, rr.Code, tt.body)
+	}
+	mockDB.AssertExpectations(t)
+}
+
+func TestBadgeLinksToTheBuild(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.On("GetProjectByName", "api").Return(&Project{Name: "api", DefaultBranch: "main"}, nil)
+	mockDB.On("GetLatestFinishedBuild", "api", "main").Return(&BuildRequest{ID: 12, Status: "success"}, nil)
+
+	rr := httptest.NewRecorder()
+	service.badgeHandler(rr, mux.SetURLVars(httptest.NewRequest("GET", "/api/v1/projects/api/badge.svg", nil), map[string]string{"name": "api"}))
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `<a xlink:href="http://localhost:8080/api/v1/builds/12">`)
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// maxDownstreamProjects caps the projects a project's success may trigger
+const maxDownstreamProjects = 20
+
+// ProjectDependency is an edge of the project dependency graph: successful
+// default branch builds of the upstream project trigger builds of the
+// downstream project
+type ProjectDependency struct {
+	UpstreamID     int    `json:"upstream_project_id"`
+	UpstreamName   string `json:"upstream_project"`
+	DownstreamID   int    `json:"downstream_project_id"`
+	DownstreamName string `json:"downstream_project"`
+}
+
+// DownstreamProject identifies a downstream project, leaving out the rest of
+// its settings such as its tokens and notification webhooks
+type DownstreamProject struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// downstreamProjects identifies the projects a tenant may see
+func downstreamProjects(tenant Tenant, projects []*Project) []DownstreamProject {
+	downstream := []DownstreamProject{}
+	for _, project := range projects {
+		if tenant.Sees(project.Org) {
+			downstream = append(downstream, DownstreamProject{ID: project.ID, Name: project.Name})
+		}
+	}
+	return downstream
+}
+
+// DownstreamProjectsUpdate is the body of a set downstream projects request
+type DownstreamProjectsUpdate struct {
+	ProjectIDs []int `json:"project_ids"`
+}
+
+// BuildChain is the chain of builds a build belongs to through downstream
+// triggers
+type BuildChain struct {
+	BuildID int `json:"build_id"`
+	// Upstream are the builds whose success led to this build, starting
+	// from the first
+	Upstream []*BuildRequest `json:"upstream"`
+	// Downstream are the builds this build's success triggered, directly or
+	// through other downstream builds
+	Downstream []*BuildRequest `json:"downstream"`
+}
+
+// dependencyCycle returns the project names along a cycle the graph would
+// contain if projectID's downstream projects were replaced with downstream,
+// or nil when it would stay acyclic
+func dependencyCycle(dependencies []*ProjectDependency, projectID int, projectName string, downstream []*Project) []string {
+	edges := make(map[int][]int)
+	names := map[int]string{projectID: projectName}
+	for _, dependency := range dependencies {
+		names[dependency.UpstreamID] = dependency.UpstreamName
+		names[dependency.DownstreamID] = dependency.DownstreamName
+		if dependency.UpstreamID != projectID {
+			edges[dependency.UpstreamID] = append(edges[dependency.UpstreamID], dependency.DownstreamID)
+		}
+	}
+	for _, project := range downstream {
+		names[project.ID] = project.Name
+		edges[projectID] = append(edges[projectID], project.ID)
+	}
+
+	// Every cycle introduced by the update passes through projectID, so a
+	// search from it finds one if there is any
+	visited := make(map[int]bool)
+	var path []int
+	var search func(id int) bool
+	search = func(id int) bool {
+		path = append(path, id)
+		for _, next := range edges[id] {
+			if next == projectID {
+				path = append(path, next)
+				return true
+			}
+			if !visited[next] {
+				visited[next] = true
+				if search(next) {
+					return true
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		return false
+	}
+	if !search(projectID) {
+		return nil
+	}
+
+	cycle := make([]string, len(path))
+	for i, id := range path {
+		cycle[i] = names[id]
+	}
+	return cycle
+}
+
+// triggerDownstream queues builds of the downstream projects of a successful
+// default branch build. Projects already built earlier in the build's chain
+// are skipped, so a cycle that slipped past validation can't loop forever.
+func (bs *BuildService) triggerDownstream(ctx context.Context, build *BuildRequest, project *Project) {
+	if project == nil || build.Status != "success" || build.Branch != project.DefaultBranch {
+		return
+	}
+
+	downstream, err := bs.db.ListDownstreamProjects(project.ID)
+	if err != nil {
+		bs.errors.Capture("executor", fmt.Errorf("listing downstream projects: %w", err), build)
+		return
+	}
+	if len(downstream) == 0 {
+		return
+	}
+
+	upstream, err := bs.db.ListTriggeringBuilds(build.ID)
+	if err != nil {
+		bs.errors.Capture("executor", fmt.Errorf("listing upstream builds: %w", err), build)
+		return
+	}
+	chain := map[string]bool{build.ProjectName: true}
+	for _, previous := range upstream {
+		chain[previous.ProjectName] = true
+	}
+
+	for _, target := range downstream {
+		if chain[target.Name] {
+			log.Printf("Not triggering %s from build %d: it was already built in the chain", target.Name, build.ID)
+			continue
+		}
+		if target.Paused {
+			log.Printf("Not triggering %s from build %d: project is paused", target.Name, build.ID)
+			continue
+		}
+
+		triggered := &BuildRequest{
+			ProjectName:     target.Name,
+			GitURL:          target.GitURL,
+			Branch:          target.DefaultBranch,
+			AutoVersion:     target.AutoVersion,
+			TriggeredBy:     build.TriggeredBy,
+			TriggerSource:   triggerUpstream,
+			Org:             target.Org,
+			UpstreamBuildID: &build.ID,
+		}
+		if err := bs.enqueueBuild(ctx, triggered); err != nil {
+			bs.errors.Capture("executor", fmt.Errorf("triggering downstream project %s: %w", target.Name, err), build)
+			continue
+		}
+		log.Printf("Build %d of %s triggered build %d of %s", build.ID, build.ProjectName, triggered.ID, target.Name)
+	}
+}
+
+// List downstream projects endpoint
+func (bs *BuildService) listDownstreamProjectsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	tenant := requestTenant(r)
+	project, err := bs.db.GetProject(id)
+	if err == nil && !tenant.Sees(project.Org) {
+		err = fmt.Errorf("project not found")
+	}
+	if err != nil {
+		if err.Error() == "project not found" {
+			http.Error(w, "Project not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error getting project: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	projects, err := bs.db.ListDownstreamProjects(id)
+	if err != nil {
+		log.Printf("Error listing downstream projects: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(downstreamProjects(tenant, projects))
+}
+
+// Set downstream projects endpoint. Replaces the projects built after the
+// project's successful default branch builds, refusing updates that would
+// make the dependency graph cyclic.
+func (bs *BuildService) setDownstreamProjectsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	var update DownstreamProjectsUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(update.ProjectIDs) > maxDownstreamProjects {
+		http.Error(w, fmt.Sprintf("project_ids may list at most %d projects", maxDownstreamProjects), http.StatusBadRequest)
+		return
+	}
+
+	tenant := requestTenant(r)
+	project, err := bs.db.GetProject(id)
+	if err == nil && !tenant.Sees(project.Org) {
+		err = fmt.Errorf("project not found")
+	}
+	if err != nil {
+		if err.Error() == "project not found" {
+			http.Error(w, "Project not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error getting project: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	downstream := []*Project{}
+	seen := make(map[int]bool)
+	for _, downstreamID := range update.ProjectIDs {
+		if downstreamID == id {
+			http.Error(w, "A project can't be downstream of itself", http.StatusBadRequest)
+			return
+		}
+		if seen[downstreamID] {
+			http.Error(w, "project_ids must list distinct projects", http.StatusBadRequest)
+			return
+		}
+		seen[downstreamID] = true
+
+		// Projects of other orgs are as good as missing, so they can't be
+		// triggered or found out about
+		target, err := bs.db.GetProject(downstreamID)
+		if err == nil && !tenant.Sees(target.Org) {
+			err = fmt.Errorf("project not found")
+		}
+		if err != nil {
+			if err.Error() == "project not found" {
+				http.Error(w, fmt.Sprintf("Project %d in project_ids not found", downstreamID), http.StatusBadRequest)
+				return
+			}
+			log.Printf("Error getting downstream project: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		downstream = append(downstream, target)
+	}
+
+	// Cycles can run through projects of any org
+	dependencies, err := bs.db.ListProjectDependencies("")
+	if err != nil {
+		log.Printf("Error listing project dependencies: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if cycle := dependencyCycle(dependencies, project.ID, project.Name, downstream); cycle != nil {
+		http.Error(w, "Dependency cycle: "+strings.Join(cycle, " -> "), http.StatusConflict)
+		return
+	}
+
+	if err := bs.db.SetDownstreamProjects(id, update.ProjectIDs); err != nil {
+		log.Printf("Error setting downstream projects: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(downstreamProjects(tenant, downstream))
+}
+
+// List project dependencies endpoint. Returns the dependency graph as its
+// edges, for org-scoped requests only the edges between the org's projects.
+func (bs *BuildService) listProjectDependenciesHandler(w http.ResponseWriter, r *http.Request) {
+	dependencies, err := bs.db.ListProjectDependencies(listOrg(r))
+	if err != nil {
+		log.Printf("Error listing project dependencies: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(dependencies)
+}
+
+// Build chain endpoint
+func (bs *BuildService) buildChainHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid build ID", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := bs.db.GetBuild(id); err != nil {
+		if err.Error() == "build not found" {
+			http.Error(w, "Build not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error getting build: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	chain := &BuildChain{BuildID: id, Upstream: []*BuildRequest{}, Downstream: []*BuildRequest{}}
+	upstream, err := bs.db.ListTriggeringBuilds(id)
+	if err == nil {
+		chain.Upstream = append(chain.Upstream, upstream...)
+		var downstream []*BuildRequest
+		downstream, err = bs.db.ListTriggeredBuilds(id)
+		chain.Downstream = append(chain.Downstream, downstream...)
+	}
+	if err != nil {
+		log.Printf("Error listing build chain: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(chain)
+}
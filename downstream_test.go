@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDependencyCycle(t *testing.T) {
+	// api -> web -> docs
+	graph := []*ProjectDependency{
+		{UpstreamID: 1, UpstreamName: "api", DownstreamID: 2, DownstreamName: "web"},
+		{UpstreamID: 2, UpstreamName: "web", DownstreamID: 3, DownstreamName: "docs"},
+	}
+
+	assert.Nil(t, dependencyCycle(graph, 3, "docs", []*Project{{ID: 4, Name: "site"}}))
+	assert.Equal(t, []string{"docs", "api", "web", "docs"}, dependencyCycle(graph, 3, "docs", []*Project{{ID: 1, Name: "api"}}))
+	assert.Equal(t, []string{"web", "api", "web"}, dependencyCycle(graph, 2, "web", []*Project{{ID: 1, Name: "api"}}))
+	// Replacing api's downstream projects drops the edge to web
+	assert.Nil(t, dependencyCycle(graph, 1, "api", []*Project{{ID: 3, Name: "docs"}}))
+}
+
+func TestSetDownstreamProjectsHandler(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.On("GetProject", 1).Return(&Project{ID: 1, Name: "api"}, nil)
+	mockDB.On("GetProject", 2).Return(&Project{ID: 2, Name: "web"}, nil)
+	mockDB.On("GetProject", 3).Return(&Project{ID: 3, Name: "docs"}, nil)
+	mockDB.On("GetProject", 9).Return(nil, fmt.Errorf("project not found"))
+	mockDB.On("ListProjectDependencies", "").Return([]*ProjectDependency{
+		{UpstreamID: 2, UpstreamName: "web", DownstreamID: 1, DownstreamName: "api"},
+	}, nil)
+	mockDB.On("SetDownstreamProjects", 1, []int{3}).Return(nil).Once()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/projects/{id}/downstream", service.setDownstreamProjectsHandler).Methods("PUT")
+	put := func(path, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("PUT", path, bytes.NewBufferString(body)))
+		return rr
+	}
+
+	rr := put("/api/v1/projects/1/downstream", `{"project_ids": [3]}`)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.JSONEq(t, `[{"id": 3, "name": "docs"}]`, rr.Body.String())
+
+	rr = put("/api/v1/projects/1/downstream", `{"project_ids": [2]}`)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Contains(t, rr.Body.String(), "Dependency cycle: api -> web -> api")
+
+	for body, want := range map[string]int{
+		`{"project_ids": [1]}`:    http.StatusBadRequest,
+		`{"project_ids": [3, 3]}`: http.StatusBadRequest,
+		`{"project_ids": [9]}`:    http.StatusBadRequest,
+		`{`:                       http.StatusBadRequest,
+	} {
+		assert.Equal(t, want, put("/api/v1/projects/1/downstream", body).Code, body)
+	}
+	assert.Equal(t, http.StatusNotFound, put("/api/v1/projects/9/downstream", `{"project_ids": []}`).Code)
+	mockDB.AssertExpectations(t)
+}
+
+func TestTriggerDownstream(t *testing.T) {
+	service, mockDB := setupTestService()
+	project := &Project{ID: 1, Name: "api", DefaultBranch: "main"}
+	mockDB.On("ListDownstreamProjects", 1).Return([]*Project{
+		{ID: 2, Name: "web", GitURL: "https://github.com/acme/web", DefaultBranch: "trunk", Org: "acme"},
+		{ID: 3, Name: "docs", DefaultBranch: "main"},
+		{ID: 4, Name: "site", DefaultBranch: "main", Paused: true},
+	}, nil)
+	mockDB.On("ListTriggeringBuilds", 5).Return([]*BuildRequest{{ID: 4, ProjectName: "docs"}}, nil)
+	mockDB.On("CreateBuild", mock.MatchedBy(func(b *BuildRequest) bool {
+		return b.ProjectName == "web" && b.Branch == "trunk" && b.Org == "acme" && b.TriggerSource == triggerUpstream &&
+			b.TriggeredBy == "alice" && b.UpstreamBuildID != nil && *b.UpstreamBuildID == 5
+	})).Return(6, nil).Once()
+	mockDB.On("ListBuildIssues", mock.Anything).Return([]string{}, nil).Maybe()
+
+	// Only successful builds of the default branch trigger downstream projects
+	service.triggerDownstream(context.Background(), &BuildRequest{ID: 5, ProjectName: "api", Branch: "main", Status: "failed"}, project)
+	service.triggerDownstream(context.Background(), &BuildRequest{ID: 5, ProjectName: "api", Branch: "feature", Status: "success"}, project)
+	service.triggerDownstream(context.Background(), &BuildRequest{ID: 5, ProjectName: "api", Branch: "main", Status: "success"}, nil)
+	mockDB.AssertNotCalled(t, "ListDownstreamProjects", 1)
+
+	// docs was already built in the chain and site is paused
+	service.triggerDownstream(context.Background(), &BuildRequest{ID: 5, ProjectName: "api", Branch: "main", Status: "success", TriggeredBy: "alice"}, project)
+	mockDB.AssertExpectations(t)
+}
+
+func TestBuildChainHandler(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.On("GetBuild", 2).Return(&BuildRequest{ID: 2, ProjectName: "web"}, nil)
+	mockDB.On("GetBuild", 3).Return(nil, fmt.Errorf("build not found"))
+	mockDB.On("ListTriggeringBuilds", 2).Return([]*BuildRequest{{ID: 1, ProjectName: "api"}}, nil)
+	mockDB.On("ListTriggeredBuilds", 2).Return(nil, nil)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/builds/{id}/chain", service.buildChainHandler).Methods("GET")
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/builds/2/chain", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"upstream":[{"id":1`)
+	assert.Contains(t, rr.Body.String(), `"downstream":[]`)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/builds/3/chain", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestDownstreamProjectsHideOtherOrgs(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.On("GetProject", 1).Return(&Project{ID: 1, Name: "api", Org: "acme"}, nil)
+	mockDB.On("GetProject", 2).Return(&Project{ID: 2, Name: "billing", Org: "globex", SkipCIToken: "globex-token"}, nil)
+	mockDB.On("ListDownstreamProjects", 1).Return([]*Project{
+		{ID: 3, Name: "web", Org: "acme", NotifySlackWebhookURL: "https://hooks.slack.com/acme"},
+		{ID: 2, Name: "billing", Org: "globex"},
+	}, nil)
+	mockDB.On("ListProjectDependencies", "acme").Return([]*ProjectDependency{
+		{UpstreamID: 1, UpstreamName: "api", DownstreamID: 3, DownstreamName: "web"},
+	}, nil).Once()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/projects/{id}/downstream", service.listDownstreamProjectsHandler).Methods("GET")
+	router.HandleFunc("/api/v1/projects/{id}/downstream", service.setDownstreamProjectsHandler).Methods("PUT")
+	router.HandleFunc("/api/v1/project-dependencies", service.listProjectDependenciesHandler).Methods("GET")
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		req = req.WithContext(context.WithValue(req.Context(), tenantContextKey{}, Tenant{Org: "acme"}))
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Another org's project can't be linked, nor told apart from a missing one
+	rr := serve("PUT", "/api/v1/projects/1/downstream", `{"project_ids": [2]}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "Project 2 in project_ids not found")
+	assert.NotContains(t, rr.Body.String(), "globex-token")
+	assert.Equal(t, http.StatusNotFound, serve("PUT", "/api/v1/projects/2/downstream", `{"project_ids": []}`).Code)
+	assert.Equal(t, http.StatusNotFound, serve("GET", "/api/v1/projects/2/downstream", "").Code)
+	mockDB.AssertNotCalled(t, "SetDownstreamProjects", mock.Anything, mock.Anything)
+
+	// Downstream projects are listed by id and name only
+	rr = serve("GET", "/api/v1/projects/1/downstream", "")
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `[{"id": 3, "name": "web"}]`, rr.Body.String())
+
+	rr = serve("GET", "/api/v1/project-dependencies", "")
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"downstream_project":"web"`)
+	mockDB.AssertExpectations(t)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// DraftScheduler queues draft builds once their start_at time is reached
+type DraftScheduler struct {
+	db       DatabaseInterface
+	events   *EventBus
+	queue    *BuildQueue
+	errors   *ErrorTracker
+	interval time.Duration
+}
+
+// NewDraftScheduler creates a scheduler checking for due drafts every
+// DRAFT_CHECK_INTERVAL
+func NewDraftScheduler(db DatabaseInterface, events *EventBus, queue *BuildQueue, errors *ErrorTracker) *DraftScheduler {
+	return &DraftScheduler{
+		db:       db,
+		events:   events,
+		queue:    queue,
+		errors:   errors,
+		interval: getEnvDuration("DRAFT_CHECK_INTERVAL", 15*time.Second),
+	}
+}
+
+// Start queues due drafts every interval until ctx is cancelled
+func (ds *DraftScheduler) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(ds.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				ds.StartDue()
+			}
+		}
+	}()
+}
+
+// StartDue queues every draft build whose start_at has passed
+func (ds *DraftScheduler) StartDue() {
+	builds, err := ds.db.StartDueDraftBuilds()
+	if err != nil {
+		ds.errors.Capture("drafts", fmt.Errorf("starting due draft builds: %w", err), nil)
+		return
+	}
+
+	for _, build := range builds {
+		log.Printf("Draft build %d reached its start time, queueing it", build.ID)
+		ds.events.Publish(build)
+	}
+	if len(builds) > 0 {
+		ds.queue.Notify()
+	}
+}
+
+// Start build endpoint. Queues a draft build ahead of its start_at.
+func (bs *BuildService) startBuildHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid build ID", http.StatusBadRequest)
+		return
+	}
+
+	build, err := bs.db.StartDraftBuild(id)
+	if err != nil {
+		switch err.Error() {
+		case "build not found":
+			http.Error(w, "Build not found", http.StatusNotFound)
+		case "build is not a draft":
+			http.Error(w, "Only draft builds can be started", http.StatusConflict)
+		default:
+			log.Printf("Error starting build: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	bs.events.Publish(build)
+	bs.queue.Notify()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(build)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateDraftBuild(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.On("CreateBuild", mock.MatchedBy(func(b *BuildRequest) bool {
+		return b.Status == "draft" && b.StartAt != nil
+	})).Return(7, nil).Once()
+
+	body := `{"project_name":"api","git_url":"https://github.com/acme/api.git","start_at":"2030-01-02T15:00:00Z"}`
+	rr := httptest.NewRecorder()
+	service.createBuildHandler(rr, httptest.NewRequest("POST", "/api/v1/builds", bytes.NewBufferString(body)))
+
+	require.Equal(t, http.StatusCreated, rr.Code)
+	var build BuildRequest
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &build))
+	assert.Equal(t, "draft", build.Status)
+	assert.True(t, build.Draft)
+	assert.Equal(t, 1.0, testutil.ToFloat64(service.metrics.BuildsTotal.WithLabelValues("draft")))
+
+	// Drafts don't wake a worker
+	select {
+	case <-service.queue.wake:
+		t.Fatal("draft build woke a worker")
+	default:
+	}
+	mockDB.AssertExpectations(t)
+}
+
+func TestStartBuildHandler(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.On("StartDraftBuild", 1).Return(&BuildRequest{ID: 1, Status: "queued"}, nil)
+	mockDB.On("StartDraftBuild", 2).Return(nil, fmt.Errorf("build is not a draft"))
+	mockDB.On("StartDraftBuild", 3).Return(nil, fmt.Errorf("build not found"))
+
+	start := func(id string) *httptest.ResponseRecorder {
+		req := mux.SetURLVars(httptest.NewRequest("POST", "/api/v1/builds/"+id+"/start", nil), map[string]string{"id": id})
+		rr := httptest.NewRecorder()
+		service.startBuildHandler(rr, req)
+		return rr
+	}
+
+	rr := start("1")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"status":"queued"`)
+	assert.Len(t, service.queue.wake, 1)
+
+	assert.Equal(t, http.StatusConflict, start("2").Code)
+	assert.Equal(t, http.StatusNotFound, start("3").Code)
+	assert.Equal(t, http.StatusBadRequest, start("x").Code)
+}
+
+func TestDraftSchedulerStartDue(t *testing.T) {
+	service, mockDB := setupTestService()
+	events, unsubscribe := service.events.Subscribe(4)
+	defer unsubscribe()
+
+	mockDB.On("StartDueDraftBuilds").Return([]*BuildRequest{{ID: 4, ProjectName: "api", Status: "queued"}}, nil).Once()
+	service.drafts.StartDue()
+
+	select {
+	case event := <-events:
+		assert.Equal(t, 4, event.Build.ID)
+	case <-time.After(time.Second):
+		t.Fatal("no event published for the started draft")
+	}
+	assert.Len(t, service.queue.wake, 1)
+
+	mockDB.On("StartDueDraftBuilds").Return(nil, fmt.Errorf("connection refused")).Once()
+	service.drafts.StartDue()
+	assert.Equal(t, 1.0, testutil.ToFloat64(service.metrics.BackgroundErrors.WithLabelValues("drafts")))
+	mockDB.AssertExpectations(t)
+}
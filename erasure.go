@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// UserErasure identifies the person whose data a deletion request covers.
+// Builds record people by the username they were triggered or cancelled by
+// and by the name and email of the commit author.
+type UserErasure struct {
+	Username string   `json:"username,omitempty"`
+	Emails   []string `json:"emails,omitempty"`
+	// Names are the person's commit author names, e.g. "Jane Doe"
+	Names []string `json:"names,omitempty"`
+	// Reference identifies the deletion request, e.g. a ticket number
+	Reference string `json:"reference,omitempty"`
+}
+
+// DataErasure records a completed erasure. It keeps the pseudonym that
+// replaced the person's data and how many rows of each table were scrubbed,
+// never the erased data itself.
+type DataErasure struct {
+	ID        int              `json:"id"`
+	Pseudonym string           `json:"pseudonym"`
+	Reference string           `json:"reference,omitempty"`
+	Scrubbed  map[string]int64 `json:"scrubbed"`
+	CreatedAt time.Time        `json:"created_at"`
+}
+
+// Validate normalizes the identifiers and checks that at least one is given
+func (ue *UserErasure) Validate() error {
+	ue.Username = strings.TrimSpace(ue.Username)
+	ue.Reference = strings.TrimSpace(ue.Reference)
+
+	var emails []string
+	for _, email := range ue.Emails {
+		address, err := mail.ParseAddress(strings.TrimSpace(email))
+		if err != nil || address.Name != "" {
+			return fmt.Errorf("invalid email %q", email)
+		}
+		emails = append(emails, address.Address)
+	}
+	ue.Emails = emails
+
+	var names []string
+	for _, name := range ue.Names {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	ue.Names = names
+
+	if ue.Username == "" && len(ue.Emails) == 0 && len(ue.Names) == 0 {
+		return fmt.Errorf("username, emails or names is required")
+	}
+	return nil
+}
+
+// authors returns the commit author values that identify the person, in the
+// "Name <email>" form builds record them in
+func (ue *UserErasure) authors() []string {
+	var authors []string
+	for _, email := range ue.Emails {
+		authors = append(authors, commitAuthor("", email))
+		for _, name := range ue.Names {
+			authors = append(authors, commitAuthor(name, email))
+		}
+	}
+	authors = append(authors, ue.Names...)
+	for i, author := range authors {
+		authors[i] = strings.ToLower(author)
+	}
+	return authors
+}
+
+// replacements returns the substitutions that scrub the person from free text
+// and serialized builds: emails anywhere, the username where it makes up a
+// JSON string, and names where they do or precede an email as in "Name <email>"
+func (ue *UserErasure) replacements(pseudonym string) []string {
+	var pairs []string
+	for _, email := range ue.Emails {
+		pairs = append(pairs, email, pseudonym)
+		if lower := strings.ToLower(email); lower != email {
+			pairs = append(pairs, lower, pseudonym)
+		}
+	}
+	if ue.Username != "" {
+		pairs = append(pairs, jsonString(ue.Username), jsonString(pseudonym))
+	}
+	for _, name := range ue.Names {
+		pairs = append(pairs,
+			jsonString(name), jsonString(pseudonym),
+			name+" <", pseudonym+" <",
+			// Go escapes "<" when encoding JSON
+			name+` \u003c`, pseudonym+` \u003c`,
+		)
+	}
+	return pairs
+}
+
+func jsonString(s string) string {
+	encoded, _ := json.Marshal(s)
+	return string(encoded)
+}
+
+// newPseudonym returns a random stand-in for an erased person. One pseudonym
+// replaces all of a person's data, so per-user statistics stay consistent.
+func newPseudonym() (string, error) {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "erased-" + hex.EncodeToString(b), nil
+}
+
+// Erase user data endpoint. Replaces a person's usernames, emails and author
+// names with a pseudonym, keeping their builds and deployments for statistics.
+func (bs *BuildService) eraseUserDataHandler(w http.ResponseWriter, r *http.Request) {
+	var req UserErasure
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := req.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	pseudonym, err := newPseudonym()
+	if err != nil {
+		log.Printf("Error generating pseudonym: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	erasure, err := bs.db.EraseUserData(&req, pseudonym)
+	if err != nil {
+		log.Printf("Error erasing user data: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Erased user data as %s (reference %q): %v", erasure.Pseudonym, erasure.Reference, erasure.Scrubbed)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(erasure)
+}
+
+// List data erasures endpoint
+func (bs *BuildService) listDataErasuresHandler(w http.ResponseWriter, r *http.Request) {
+	erasures, err := bs.db.ListDataErasures()
+	if err != nil {
+		log.Printf("Error listing data erasures: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(erasures)
+}
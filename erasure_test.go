@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserErasureValidate(t *testing.T) {
+	erasure := &UserErasure{Username: " jdoe ", Emails: []string{" Jane@Example.com"}, Names: []string{"Jane Doe", " "}}
+	require.NoError(t, erasure.Validate())
+	assert.Equal(t, "jdoe", erasure.Username)
+	assert.Equal(t, []string{"Jane@Example.com"}, erasure.Emails)
+	assert.Equal(t, []string{"Jane Doe"}, erasure.Names)
+
+	assert.Error(t, (&UserErasure{Reference: "GDPR-1"}).Validate())
+	assert.Error(t, (&UserErasure{Emails: []string{"not an email"}}).Validate())
+	assert.Error(t, (&UserErasure{Emails: []string{"Jane <jane@example.com>"}}).Validate())
+}
+
+func TestUserErasureAuthors(t *testing.T) {
+	erasure := &UserErasure{Emails: []string{"Jane@Example.com"}, Names: []string{"Jane Doe"}}
+	assert.ElementsMatch(t, []string{"<jane@example.com>", "jane doe <jane@example.com>", "jane doe"}, erasure.authors())
+}
+
+// applyReplacements applies pairs the way the nested REPLACE calls do
+func applyReplacements(s string, pairs []string) string {
+	for i := 0; i < len(pairs); i += 2 {
+		s = strings.ReplaceAll(s, pairs[i], pairs[i+1])
+	}
+	return s
+}
+
+func TestUserErasureReplacements(t *testing.T) {
+	erasure := &UserErasure{Username: "jdoe", Emails: []string{"Jane@Example.com"}, Names: []string{"Jane Doe"}}
+	pairs := erasure.replacements("erased-1")
+	require.Zero(t, len(pairs)%2)
+
+	payload, _ := json.Marshal(BuildEvent{Build: BuildRequest{TriggeredBy: "jdoe", CommitAuthor: "Jane Doe <jane@example.com>", Branch: "jdoe-fix"}})
+	scrubbed := applyReplacements(string(payload), pairs)
+	assert.NotContains(t, scrubbed, "Jane")
+	assert.NotContains(t, scrubbed, "jane@")
+	assert.Contains(t, scrubbed, `"triggered_by":"erased-1"`)
+	assert.Contains(t, scrubbed, `"commit_author":"erased-1 \u003cerased-1\u003e"`)
+	// Only whole values are replaced, not text that contains the username
+	assert.Contains(t, scrubbed, `"branch":"jdoe-fix"`)
+
+	// JSONB renders "<" unescaped
+	assert.Equal(t, `{"author": "erased-1 <erased-1>"}`, applyReplacements(`{"author": "Jane Doe <Jane@Example.com>"}`, pairs))
+	assert.Equal(t, "Signed-off-by: erased-1 <erased-1>", applyReplacements("Signed-off-by: Jane Doe <jane@example.com>", pairs))
+}
+
+func TestReplaceSQL(t *testing.T) {
+	expr, cond := replaceSQL("log", 2, 2)
+	assert.Equal(t, "REPLACE(REPLACE(log, $2, $3), $4, $5)", expr)
+	assert.Equal(t, "(strpos(log, $2) > 0 OR strpos(log, $4) > 0)", cond)
+
+	expr, cond = replaceSQL("log", 1, 0)
+	assert.Equal(t, "log", expr)
+	assert.Equal(t, "FALSE", cond)
+}
+
+func TestEraseUserDataHandler(t *testing.T) {
+	erase := func(service *BuildService, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		service.eraseUserDataHandler(rr, httptest.NewRequest("POST", "/api/v1/admin/erasures", bytes.NewBufferString(body)))
+		return rr
+	}
+
+	t.Run("erases with a pseudonym", func(t *testing.T) {
+		service, mockDB := setupTestService()
+		mockDB.On("EraseUserData", mock.MatchedBy(func(e *UserErasure) bool {
+			return e.Username == "jdoe" && e.Reference == "GDPR-7"
+		}), mock.MatchedBy(func(pseudonym string) bool {
+			return strings.HasPrefix(pseudonym, "erased-") && len(pseudonym) == len("erased-")+12
+		})).Return(&DataErasure{ID: 1, Pseudonym: "erased-0a1b2c3d4e5f", Reference: "GDPR-7", Scrubbed: map[string]int64{"builds": 12}}, nil).Once()
+
+		rr := erase(service, `{"username": "jdoe", "emails": ["jane@example.com"], "reference": "GDPR-7"}`)
+		require.Equal(t, http.StatusCreated, rr.Code)
+		var erasure DataErasure
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &erasure))
+		assert.Equal(t, int64(12), erasure.Scrubbed["builds"])
+		assert.NotContains(t, rr.Body.String(), "jdoe")
+		mockDB.AssertExpectations(t)
+	})
+
+	t.Run("requires an identifier", func(t *testing.T) {
+		service, _ := setupTestService()
+		assert.Equal(t, http.StatusBadRequest, erase(service, `{"reference": "GDPR-7"}`).Code)
+		assert.Equal(t, http.StatusBadRequest, erase(service, `{`).Code)
+	})
+
+	t.Run("database error", func(t *testing.T) {
+		service, mockDB := setupTestService()
+		mockDB.On("EraseUserData", mock.Anything, mock.Anything).Return(nil, fmt.Errorf("connection refused")).Once()
+		assert.Equal(t, http.StatusInternalServerError, erase(service, `{"username": "jdoe"}`).Code)
+	})
+}
+
+func TestListDataErasuresHandler(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.On("ListDataErasures").Return([]*DataErasure{{ID: 2, Pseudonym: "erased-0a1b2c3d4e5f"}}, nil).Once()
+
+	rr := httptest.NewRecorder()
+	service.listDataErasuresHandler(rr, httptest.NewRequest("GET", "/api/v1/admin/erasures", nil))
+
+	require.Equal(t, http.StatusOK, rr.Code)
+	var erasures []*DataErasure
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &erasures))
+	assert.Len(t, erasures, 1)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ErrorEvent is a failure captured from a background subsystem
+type ErrorEvent struct {
+	Subsystem string
+	Err       error
+	Tags      map[string]string
+	Time      time.Time
+}
+
+// ErrorReporter forwards captured errors to an external error tracker
+type ErrorReporter interface {
+	Report(event ErrorEvent)
+	Close(ctx context.Context) error
+}
+
+// NewErrorReporterFromEnv returns a Sentry reporter when SENTRY_DSN is set,
+// otherwise a reporter that only logs
+func NewErrorReporterFromEnv() ErrorReporter {
+	dsn := os.Getenv("SENTRY_DSN")
+	if dsn == "" {
+		return &LogErrorReporter{}
+	}
+
+	reporter, err := NewSentryReporter(dsn, os.Getenv("SENTRY_ENVIRONMENT"))
+	if err != nil {
+		log.Printf("Invalid SENTRY_DSN, falling back to log reporting: %v", err)
+		return &LogErrorReporter{}
+	}
+	return reporter
+}
+
+// ErrorTracker counts background failures per subsystem and forwards them,
+// with build context, to an ErrorReporter
+type ErrorTracker struct {
+	reporter ErrorReporter
+	counter  *prometheus.CounterVec
+}
+
+// NewErrorTracker creates a tracker that reports through reporter and counts into counter
+func NewErrorTracker(reporter ErrorReporter, counter *prometheus.CounterVec) *ErrorTracker {
+	return &ErrorTracker{reporter: reporter, counter: counter}
+}
+
+// Capture records an error from a background subsystem. build may be nil when
+// the failure is not tied to a specific build.
+func (et *ErrorTracker) Capture(subsystem string, err error, build *BuildRequest) {
+	et.counter.WithLabelValues(subsystem).Inc()
+
+	tags := map[string]string{"subsystem": subsystem}
+	if build != nil {
+		tags["build_id"] = strconv.Itoa(build.ID)
+		tags["project"] = build.ProjectName
+		tags["branch"] = build.Branch
+	}
+
+	et.reporter.Report(ErrorEvent{
+		Subsystem: subsystem,
+		Err:       err,
+		Tags:      tags,
+		Time:      time.Now().UTC(),
+	})
+}
+
+// Close flushes any pending reports
+func (et *ErrorTracker) Close(ctx context.Context) error {
+	return et.reporter.Close(ctx)
+}
+
+// LogErrorReporter writes captured errors to the service log
+type LogErrorReporter struct{}
+
+func (lr *LogErrorReporter) Report(event ErrorEvent) {
+	log.Printf("[%s] %v %v", event.Subsystem, event.Err, event.Tags)
+}
+
+func (lr *LogErrorReporter) Close(ctx context.Context) error {
+	return nil
+}
+
+// SentryReporter sends captured errors to Sentry's store endpoint. Events are
+// delivered asynchronously so that background workers never block on the
+// tracker; events are dropped if the buffer is full.
+type SentryReporter struct {
+	endpoint    string
+	authHeader  string
+	environment string
+	client      *http.Client
+	events      chan ErrorEvent
+	done        chan struct{}
+	closeOnce   sync.Once
+}
+
+// NewSentryReporter creates a reporter from a DSN of the form
+// https://<key>@<host>/<project>
+func NewSentryReporter(dsn, environment string) (*SentryReporter, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if u.User == nil || u.User.Username() == "" {
+		return nil, fmt.Errorf("dsn is missing the public key")
+	}
+	projectID := strings.Trim(u.Path, "/")
+	if projectID == "" {
+		return nil, fmt.Errorf("dsn is missing the project id")
+	}
+
+	sr := &SentryReporter{
+		endpoint:    fmt.Sprintf("%s://%s/api/%s/store/", u.Scheme, u.Host, projectID),
+		authHeader:  fmt.Sprintf("Sentry sentry_version=7, sentry_key=%s, sentry_client=build-service/1.0", u.User.Username()),
+		environment: environment,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		events:      make(chan ErrorEvent, 100),
+		done:        make(chan struct{}),
+	}
+	go sr.run()
+	return sr, nil
+}
+
+// Report queues an event for delivery
+func (sr *SentryReporter) Report(event ErrorEvent) {
+	select {
+	case sr.events <- event:
+	default:
+		log.Printf("Error reporter buffer full, dropping event: %v", event.Err)
+	}
+}
+
+// Close stops accepting events and waits for queued events to be sent
+func (sr *SentryReporter) Close(ctx context.Context) error {
+	sr.closeOnce.Do(func() { close(sr.events) })
+
+	select {
+	case <-sr.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (sr *SentryReporter) run() {
+	defer close(sr.done)
+
+	for event := range sr.events {
+		if err := sr.send(event); err != nil {
+			log.Printf("Error sending event to Sentry: %v", err)
+		}
+	}
+}
+
+func (sr *SentryReporter) send(event ErrorEvent) error {
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	payload := map[string]interface{}{
+		"event_id":  hex.EncodeToString(id),
+		"timestamp": event.Time.Format(time.RFC3339),
+		"level":     "error",
+		"logger":    event.Subsystem,
+		"platform":  "go",
+		"message":   event.Err.Error(),
+		"tags":      event.Tags,
+		"exception": []map[string]string{
+			{"type": fmt.Sprintf("%T", event.Err), "value": event.Err.Error(), "module": event.Subsystem},
+		},
+	}
+	if sr.environment != "" {
+		payload["environment"] = sr.environment
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", sr.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", sr.authHeader)
+
+	resp, err := sr.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingReporter struct {
+	events []ErrorEvent
+}
+
+func (rr *recordingReporter) Report(event ErrorEvent) {
+	rr.events = append(rr.events, event)
+}
+
+func (rr *recordingReporter) Close(ctx context.Context) error {
+	return nil
+}
+
+func TestErrorTrackerCapture(t *testing.T) {
+	reporter := &recordingReporter{}
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_errors_total"}, []string{"subsystem"})
+	tracker := NewErrorTracker(reporter, counter)
+
+	build := &BuildRequest{ID: 7, ProjectName: "test-project", Branch: "main"}
+	tracker.Capture("executor", fmt.Errorf("boom"), build)
+	tracker.Capture("queue", fmt.Errorf("db down"), nil)
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(counter.WithLabelValues("executor")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(counter.WithLabelValues("queue")))
+
+	require.Len(t, reporter.events, 2)
+	assert.Equal(t, "7", reporter.events[0].Tags["build_id"])
+	assert.Equal(t, "test-project", reporter.events[0].Tags["project"])
+	assert.NotContains(t, reporter.events[1].Tags, "build_id")
+}
+
+func TestSentryReporter(t *testing.T) {
+	received := make(chan map[string]interface{}, 1)
+	var authHeader string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/42/store/", r.URL.Path)
+		authHeader = r.Header.Get("X-Sentry-Auth")
+
+		var payload map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&payload)
+		received <- payload
+	}))
+	defer server.Close()
+
+	dsn := strings.Replace(server.URL, "http://", "http://publickey@", 1) + "/42"
+	reporter, err := NewSentryReporter(dsn, "test")
+	require.NoError(t, err)
+
+	reporter.Report(ErrorEvent{
+		Subsystem: "executor",
+		Err:       fmt.Errorf("clone failed"),
+		Tags:      map[string]string{"build_id": "1"},
+		Time:      time.Now(),
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, reporter.Close(ctx))
+
+	payload := <-received
+	assert.Equal(t, "clone failed", payload["message"])
+	assert.Equal(t, "executor", payload["logger"])
+	assert.Equal(t, "test", payload["environment"])
+	assert.Contains(t, authHeader, "sentry_key=publickey")
+}
+
+func TestNewSentryReporterInvalidDSN(t *testing.T) {
+	for _, dsn := range []string{"https://sentry.example.com/1", "https://key@sentry.example.com/"} {
+		_, err := NewSentryReporter(dsn, "")
+		assert.Error(t, err, dsn)
+	}
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Escalation statuses, mirroring the incident lifecycle of the providers
+const (
+	escalationTriggered    = "triggered"
+	escalationAcknowledged = "acknowledged"
+	escalationResolved     = "resolved"
+)
+
+// Escalation is an incident opened with an incident provider, referenced
+// from the build (and deployment) that triggered it
+type Escalation struct {
+	ID           int        `json:"id" db:"id"`
+	DedupKey     string     `json:"dedup_key" db:"dedup_key"`
+	Provider     string     `json:"provider" db:"provider"`
+	Reference    string     `json:"reference" db:"reference"`
+	Status       string     `json:"status" db:"status"`
+	BuildID      int        `json:"build_id" db:"build_id"`
+	DeploymentID *int       `json:"deployment_id,omitempty" db:"deployment_id"`
+	Summary      string     `json:"summary" db:"summary"`
+	CreatedAt    time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at" db:"updated_at"`
+	ResolvedAt   *time.Time `json:"resolved_at,omitempty" db:"resolved_at"`
+}
+
+// IncidentProvider opens and updates incidents in an incident management
+// tool. Trigger returns the provider's reference for the incident, which
+// Acknowledge and Resolve take.
+type IncidentProvider interface {
+	Name() string
+	Trigger(ctx context.Context, dedupKey, summary, link string) (string, error)
+	Acknowledge(ctx context.Context, reference string) error
+	Resolve(ctx context.Context, reference string) error
+}
+
+// Escalator opens incidents when a project's default branch fails
+// ESCALATE_AFTER_FAILURES builds in a row or a deployment to one of
+// ESCALATE_ENVIRONMENTS is rolled back. Incidents are acknowledged once a new
+// build of the branch or deployment to the environment starts, and resolved
+// when it succeeds.
+type Escalator struct {
+	db           DatabaseInterface
+	errors       *ErrorTracker
+	health       *IntegrationHealth
+	links        *PublicURLs
+	providers    []IncidentProvider
+	threshold    int
+	environments map[string]bool
+}
+
+// NewEscalatorFromEnv returns an escalator for the incident providers
+// configured in the environment, or nil when there are none
+func NewEscalatorFromEnv(db DatabaseInterface, errors *ErrorTracker, health *IntegrationHealth, links *PublicURLs) *Escalator {
+	client := &http.Client{Timeout: 10 * time.Second}
+	var providers []IncidentProvider
+	if key := os.Getenv("PAGERDUTY_ROUTING_KEY"); key != "" {
+		eventsURL := os.Getenv("PAGERDUTY_EVENTS_URL")
+		if eventsURL == "" {
+			eventsURL = "https://events.pagerduty.com/v2/enqueue"
+		}
+		providers = append(providers, &PagerDutyProvider{routingKey: key, eventsURL: eventsURL, client: client})
+	}
+	if key := os.Getenv("OPSGENIE_API_KEY"); key != "" {
+		apiURL := os.Getenv("OPSGENIE_API_URL")
+		if apiURL == "" {
+			apiURL = "https://api.opsgenie.com"
+		}
+		providers = append(providers, &OpsgenieProvider{apiKey: key, apiURL: strings.TrimSuffix(apiURL, "/"), client: client})
+	}
+	if len(providers) == 0 {
+		return nil
+	}
+
+	environmentList, ok := os.LookupEnv("ESCALATE_ENVIRONMENTS")
+	if !ok {
+		environmentList = "production,prod"
+	}
+	environments := make(map[string]bool)
+	for _, env := range strings.Split(environmentList, ",") {
+		if env = strings.TrimSpace(env); env != "" {
+			environments[env] = true
+		}
+	}
+
+	return &Escalator{
+		db:           db,
+		errors:       errors,
+		health:       health,
+		links:        links,
+		providers:    providers,
+		threshold:    getEnvInt("ESCALATE_AFTER_FAILURES", 3),
+		environments: environments,
+	}
+}
+
+// Name identifies the integration
+func (es *Escalator) Name() string {
+	return "escalations"
+}
+
+// branchEscalationKey identifies the incident of a failing branch
+func branchEscalationKey(projectName, branch string) string {
+	return "build-service/" + projectName + "/" + branch
+}
+
+// deploymentEscalationKey identifies the incident of failed deployments to an environment
+func deploymentEscalationKey(projectName, environment string) string {
+	return "build-service/" + projectName + "/deploy/" + environment
+}
+
+// Deliver escalates failures of default branch builds, acknowledges their
+// incidents when a new build starts and resolves them when one succeeds
+func (es *Escalator) Deliver(ctx context.Context, event BuildEvent) error {
+	build := &event.Build
+	if es.threshold <= 0 || (build.Status != "running" && build.Status != "success" && build.Status != "failed" && build.Status != "timeout") {
+		return nil
+	}
+
+	project, err := es.db.GetProjectByName(build.ProjectName)
+	if err != nil {
+		if err.Error() == "project not found" {
+			return nil
+		}
+		return err
+	}
+	if build.Branch != project.DefaultBranch {
+		return nil
+	}
+
+	key := branchEscalationKey(build.ProjectName, build.Branch)
+	switch build.Status {
+	case "running":
+		return es.update(ctx, key, escalationAcknowledged, build)
+	case "success":
+		return es.update(ctx, key, escalationResolved, build)
+	}
+
+	streak, err := es.failureStreak(build)
+	if err != nil || streak < es.threshold {
+		return err
+	}
+	summary := fmt.Sprintf("%s@%s has failed %d builds in a row, latest build #%d", build.ProjectName, build.Branch, streak, build.ID)
+	return es.trigger(ctx, &Escalation{DedupKey: key, BuildID: build.ID, Summary: summary}, build)
+}
+
+// failureStreak counts the consecutive failed builds of a branch ending with
+// build, stopping once the threshold is reached
+func (es *Escalator) failureStreak(build *BuildRequest) (int, error) {
+	streak := 1
+	for previous := build; streak < es.threshold; streak++ {
+		var err error
+		previous, err = es.db.GetPreviousFinishedBuild(build.ProjectName, build.Branch, previous.ID)
+		if err != nil {
+			if err.Error() == "build not found" {
+				break
+			}
+			return 0, err
+		}
+		if previous.Status == "success" {
+			break
+		}
+	}
+	return streak, nil
+}
+
+// DeploymentChanged escalates rollbacks of deployments to the escalated
+// environments, and acknowledges and resolves their incidents as the next
+// deployment progresses
+func (es *Escalator) DeploymentChanged(ctx context.Context, deployment *Deployment) error {
+	if !es.environments[deployment.Environment] {
+		return nil
+	}
+
+	build, err := es.db.GetBuild(deployment.BuildID)
+	if err != nil {
+		return err
+	}
+
+	key := deploymentEscalationKey(deployment.ProjectName, deployment.Environment)
+	switch deployment.Status {
+	case "deploying":
+		return es.update(ctx, key, escalationAcknowledged, build)
+	case "live":
+		return es.update(ctx, key, escalationResolved, build)
+	case "rolled_back":
+		summary := fmt.Sprintf("Deployment #%d of %s build #%d to %s was rolled back",
+			deployment.ID, deployment.ProjectName, deployment.BuildID, deployment.Environment)
+		id := deployment.ID
+		return es.trigger(ctx, &Escalation{DedupKey: key, BuildID: build.ID, DeploymentID: &id, Summary: summary}, build)
+	}
+	return nil
+}
+
+// trigger opens an incident with each provider that doesn't already have
+// one open for the escalation's key
+func (es *Escalator) trigger(ctx context.Context, escalation *Escalation, build *BuildRequest) error {
+	open, err := es.db.ListOpenEscalations(escalation.DedupKey)
+	if err != nil {
+		return err
+	}
+	escalated := make(map[string]bool)
+	for _, existing := range open {
+		escalated[existing.Provider] = true
+	}
+
+	for _, provider := range es.providers {
+		if escalated[provider.Name()] {
+			continue
+		}
+		if !es.health.Allow(provider.Name()) {
+			return errIntegrationDisabled
+		}
+
+		reference, err := provider.Trigger(ctx, escalation.DedupKey, escalation.Summary, es.links.BuildURL(build))
+		if err != nil {
+			err = fmt.Errorf("triggering %s: %w", escalation.DedupKey, err)
+		}
+		es.health.Record(provider.Name(), err, build)
+		if err != nil {
+			return err
+		}
+
+		record := *escalation
+		record.Provider = provider.Name()
+		record.Reference = reference
+		record.Status = escalationTriggered
+		if err := es.db.CreateEscalation(&record); err != nil {
+			return err
+		}
+		log.Printf("Escalated %s to %s as %s", escalation.DedupKey, provider.Name(), reference)
+	}
+	return nil
+}
+
+// update acknowledges or resolves the open incidents of a key. Incidents that
+// were already acknowledged aren't acknowledged again.
+func (es *Escalator) update(ctx context.Context, key, status string, build *BuildRequest) error {
+	open, err := es.db.ListOpenEscalations(key)
+	if err != nil {
+		return err
+	}
+
+	for _, escalation := range open {
+		if escalation.Status == status {
+			continue
+		}
+		provider := es.provider(escalation.Provider)
+		if provider == nil {
+			// No longer configured; nothing can update it from here
+			continue
+		}
+		if !es.health.Allow(provider.Name()) {
+			return errIntegrationDisabled
+		}
+
+		if status == escalationResolved {
+			err = provider.Resolve(ctx, escalation.Reference)
+		} else {
+			err = provider.Acknowledge(ctx, escalation.Reference)
+		}
+		if err != nil {
+			err = fmt.Errorf("updating %s to %s: %w", escalation.Reference, status, err)
+		}
+		es.health.Record(provider.Name(), err, build)
+		if err != nil {
+			return err
+		}
+
+		if err := es.db.UpdateEscalationStatus(escalation.ID, status); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (es *Escalator) provider(name string) IncidentProvider {
+	for _, provider := range es.providers {
+		if provider.Name() == name {
+			return provider
+		}
+	}
+	return nil
+}
+
+// List build escalations endpoint
+func (bs *BuildService) listBuildEscalationsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid build ID", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := bs.db.GetBuild(id); err != nil {
+		if err.Error() == "build not found" {
+			http.Error(w, "Build not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error getting build: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	escalations, err := bs.db.ListBuildEscalations(id)
+	if err != nil {
+		log.Printf("Error listing escalations: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(escalations)
+}
+
+// PagerDutyProvider opens incidents through the PagerDuty Events API v2. The
+// dedup key is the incident's reference.
+type PagerDutyProvider struct {
+	routingKey string
+	eventsURL  string
+	client     *http.Client
+}
+
+// Name identifies the integration
+func (pd *PagerDutyProvider) Name() string {
+	return "pagerduty"
+}
+
+// Trigger opens an incident
+func (pd *PagerDutyProvider) Trigger(ctx context.Context, dedupKey, summary, link string) (string, error) {
+	event := map[string]interface{}{
+		"routing_key":  pd.routingKey,
+		"event_action": "trigger",
+		"dedup_key":    dedupKey,
+		"payload": map[string]string{
+			"summary":   summary,
+			"source":    "build-service",
+			"severity":  "error",
+			"component": strings.Split(strings.TrimPrefix(dedupKey, "build-service/"), "/")[0],
+		},
+		"links": []map[string]string{{"href": link, "text": "Build"}},
+	}
+	if err := pd.send(ctx, event); err != nil {
+		return "", err
+	}
+	return dedupKey, nil
+}
+
+// Acknowledge acknowledges an incident
+func (pd *PagerDutyProvider) Acknowledge(ctx context.Context, reference string) error {
+	return pd.send(ctx, map[string]interface{}{"routing_key": pd.routingKey, "event_action": "acknowledge", "dedup_key": reference})
+}
+
+// Resolve resolves an incident
+func (pd *PagerDutyProvider) Resolve(ctx context.Context, reference string) error {
+	return pd.send(ctx, map[string]interface{}{"routing_key": pd.routingKey, "event_action": "resolve", "dedup_key": reference})
+}
+
+func (pd *PagerDutyProvider) send(ctx context.Context, event map[string]interface{}) error {
+	body, _ := json.Marshal(event)
+	req, err := http.NewRequestWithContext(ctx, "POST", pd.eventsURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return doIncidentRequest(pd.client, req)
+}
+
+// OpsgenieProvider opens alerts through the Opsgenie Alert API. The dedup
+// key is used as the alert's alias, which is its reference.
+type OpsgenieProvider struct {
+	apiKey string
+	apiURL string
+	client *http.Client
+}
+
+// Name identifies the integration
+func (og *OpsgenieProvider) Name() string {
+	return "opsgenie"
+}
+
+// Trigger creates an alert
+func (og *OpsgenieProvider) Trigger(ctx context.Context, dedupKey, summary, link string) (string, error) {
+	alert := map[string]interface{}{
+		"message":     summary,
+		"alias":       dedupKey,
+		"description": summary + "\n" + link,
+		"source":      "build-service",
+		"tags":        []string{"build-service"},
+	}
+	if err := og.send(ctx, "/v2/alerts", alert); err != nil {
+		return "", err
+	}
+	return dedupKey, nil
+}
+
+// Acknowledge acknowledges an alert
+func (og *OpsgenieProvider) Acknowledge(ctx context.Context, reference string) error {
+	return og.send(ctx, "/v2/alerts/"+url.PathEscape(reference)+"/acknowledge?identifierType=alias", map[string]string{"source": "build-service"})
+}
+
+// Resolve closes an alert
+func (og *OpsgenieProvider) Resolve(ctx context.Context, reference string) error {
+	return og.send(ctx, "/v2/alerts/"+url.PathEscape(reference)+"/close?identifierType=alias", map[string]string{"source": "build-service"})
+}
+
+func (og *OpsgenieProvider) send(ctx context.Context, path string, payload interface{}) error {
+	body, _ := json.Marshal(payload)
+	req, err := http.NewRequestWithContext(ctx, "POST", og.apiURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "GenieKey "+og.apiKey)
+	return doIncidentRequest(og.client, req)
+}
+
+// doIncidentRequest sends a request to an incident provider, failing on
+// non-2xx responses
+func doIncidentRequest(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// incidentServer records the requests made to a fake incident provider
+type incidentServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []string
+	bodies   []map[string]interface{}
+}
+
+func newIncidentServer(t *testing.T) *incidentServer {
+	server := &incidentServer{}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		decoded := map[string]interface{}{}
+		json.Unmarshal(body, &decoded)
+		server.mu.Lock()
+		server.requests = append(server.requests, r.Method+" "+r.URL.RequestURI()+" "+r.Header.Get("Authorization"))
+		server.bodies = append(server.bodies, decoded)
+		server.mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// setupEscalator configures PagerDuty and Opsgenie against fake servers
+func setupEscalator(t *testing.T) (*Escalator, *MockDatabase, *incidentServer, *incidentServer) {
+	pagerDuty, opsgenie := newIncidentServer(t), newIncidentServer(t)
+	t.Setenv("PAGERDUTY_ROUTING_KEY", "routing-key")
+	t.Setenv("PAGERDUTY_EVENTS_URL", pagerDuty.URL+"/v2/enqueue")
+	t.Setenv("OPSGENIE_API_KEY", "genie-key")
+	t.Setenv("OPSGENIE_API_URL", opsgenie.URL)
+	service, mockDB := setupTestService()
+	require.NotNil(t, service.escalations)
+	mockDB.On("GetIntegration", mock.AnythingOfType("string")).Return(nil, fmt.Errorf("integration not found"))
+	mockDB.On("ResetIntegrationFailures", mock.AnythingOfType("string")).Return(nil)
+	return service.escalations, mockDB, pagerDuty, opsgenie
+}
+
+func TestEscalatorBranchFailures(t *testing.T) {
+	escalator, mockDB, pagerDuty, opsgenie := setupEscalator(t)
+	ctx := context.Background()
+	key := "build-service/api/main"
+	mockDB.On("GetProjectByName", "api").Return(&Project{ID: 1, Name: "api", DefaultBranch: "main"}, nil)
+	mockDB.On("GetPreviousFinishedBuild", "api", "main", 5).Return(&BuildRequest{ID: 4, Status: "failed"}, nil)
+	mockDB.On("GetPreviousFinishedBuild", "api", "main", 4).Return(&BuildRequest{ID: 3, Status: "timeout"}, nil)
+	mockDB.On("GetPreviousFinishedBuild", "api", "main", 2).Return(&BuildRequest{ID: 1, Status: "success"}, nil)
+	mockDB.On("ListOpenEscalations", key).Return([]*Escalation{}, nil).Once()
+	for _, provider := range []string{"pagerduty", "opsgenie"} {
+		provider := provider
+		mockDB.On("CreateEscalation", mock.MatchedBy(func(e *Escalation) bool {
+			return e.Provider == provider && e.Reference == key && e.BuildID == 5 && e.Status == escalationTriggered
+		})).Return(nil).Once()
+	}
+
+	// Two failures in a row aren't enough
+	require.NoError(t, escalator.Deliver(ctx, BuildEvent{Build: BuildRequest{ID: 2, ProjectName: "api", Branch: "main", Status: "failed"}}))
+	// Neither are failures of other branches
+	require.NoError(t, escalator.Deliver(ctx, BuildEvent{Build: BuildRequest{ID: 6, ProjectName: "api", Branch: "feature", Status: "failed"}}))
+
+	require.NoError(t, escalator.Deliver(ctx, BuildEvent{Build: BuildRequest{ID: 5, ProjectName: "api", Branch: "main", Status: "failed"}}))
+	require.Len(t, pagerDuty.requests, 1)
+	assert.Equal(t, "trigger", pagerDuty.bodies[0]["event_action"])
+	assert.Equal(t, key, pagerDuty.bodies[0]["dedup_key"])
+	assert.Equal(t, "api@main has failed 3 builds in a row, latest build #5", pagerDuty.bodies[0]["payload"].(map[string]interface{})["summary"])
+	require.Len(t, opsgenie.requests, 1)
+	assert.Equal(t, "POST /v2/alerts GenieKey genie-key", opsgenie.requests[0])
+	assert.Equal(t, key, opsgenie.bodies[0]["alias"])
+
+	// Later failures don't open another incident
+	mockDB.On("GetPreviousFinishedBuild", "api", "main", 7).Return(&BuildRequest{ID: 5, Status: "failed"}, nil)
+	mockDB.On("ListOpenEscalations", key).Return([]*Escalation{
+		{ID: 1, Provider: "pagerduty", Reference: key, Status: escalationTriggered},
+		{ID: 2, Provider: "opsgenie", Reference: key, Status: escalationTriggered},
+	}, nil).Twice()
+	require.NoError(t, escalator.Deliver(ctx, BuildEvent{Build: BuildRequest{ID: 7, ProjectName: "api", Branch: "main", Status: "failed"}}))
+	assert.Len(t, pagerDuty.requests, 1)
+
+	// A new build acknowledges the incidents
+	mockDB.On("UpdateEscalationStatus", 1, escalationAcknowledged).Return(nil).Once()
+	mockDB.On("UpdateEscalationStatus", 2, escalationAcknowledged).Return(nil).Once()
+	require.NoError(t, escalator.Deliver(ctx, BuildEvent{Build: BuildRequest{ID: 8, ProjectName: "api", Branch: "main", Status: "running"}}))
+	assert.Equal(t, "acknowledge", pagerDuty.bodies[1]["event_action"])
+	assert.Equal(t, "POST /v2/alerts/build-service%2Fapi%2Fmain/acknowledge?identifierType=alias GenieKey genie-key", opsgenie.requests[1])
+
+	// and its success resolves them
+	mockDB.On("ListOpenEscalations", key).Return([]*Escalation{
+		{ID: 1, Provider: "pagerduty", Reference: key, Status: escalationAcknowledged},
+		{ID: 2, Provider: "opsgenie", Reference: key, Status: escalationAcknowledged},
+	}, nil).Once()
+	mockDB.On("UpdateEscalationStatus", 1, escalationResolved).Return(nil).Once()
+	mockDB.On("UpdateEscalationStatus", 2, escalationResolved).Return(nil).Once()
+	require.NoError(t, escalator.Deliver(ctx, BuildEvent{Build: BuildRequest{ID: 8, ProjectName: "api", Branch: "main", Status: "success"}}))
+	assert.Equal(t, "resolve", pagerDuty.bodies[2]["event_action"])
+	assert.Equal(t, "POST /v2/alerts/build-service%2Fapi%2Fmain/close?identifierType=alias GenieKey genie-key", opsgenie.requests[2])
+	mockDB.AssertExpectations(t)
+}
+
+func TestEscalatorDeployments(t *testing.T) {
+	escalator, mockDB, pagerDuty, _ := setupEscalator(t)
+	ctx := context.Background()
+	key := "build-service/api/deploy/production"
+	mockDB.On("GetBuild", 5).Return(&BuildRequest{ID: 5, ProjectName: "api", Branch: "main", Status: "success"}, nil)
+	mockDB.On("ListOpenEscalations", key).Return([]*Escalation{}, nil).Once()
+	mockDB.On("CreateEscalation", mock.MatchedBy(func(e *Escalation) bool {
+		return e.DedupKey == key && e.BuildID == 5 && e.DeploymentID != nil && *e.DeploymentID == 9
+	})).Return(nil).Twice()
+
+	require.NoError(t, escalator.DeploymentChanged(ctx, &Deployment{ID: 8, BuildID: 5, ProjectName: "api", Environment: "staging", Status: "rolled_back"}))
+	assert.Empty(t, pagerDuty.requests, "only escalated environments open incidents")
+
+	require.NoError(t, escalator.DeploymentChanged(ctx, &Deployment{ID: 9, BuildID: 5, ProjectName: "api", Environment: "production", Status: "rolled_back"}))
+	require.Len(t, pagerDuty.requests, 1)
+	assert.Equal(t, "Deployment #9 of api build #5 to production was rolled back", pagerDuty.bodies[0]["payload"].(map[string]interface{})["summary"])
+
+	mockDB.On("ListOpenEscalations", key).Return([]*Escalation{{ID: 3, Provider: "pagerduty", Reference: key, Status: escalationTriggered}}, nil).Once()
+	mockDB.On("UpdateEscalationStatus", 3, escalationResolved).Return(nil).Once()
+	require.NoError(t, escalator.DeploymentChanged(ctx, &Deployment{ID: 10, BuildID: 5, ProjectName: "api", Environment: "production", Status: "live"}))
+	assert.Equal(t, "resolve", pagerDuty.bodies[1]["event_action"])
+	mockDB.AssertExpectations(t)
+}
+
+func TestEscalatorProviderErrors(t *testing.T) {
+	t.Setenv("PAGERDUTY_ROUTING_KEY", "routing-key")
+	t.Setenv("PAGERDUTY_EVENTS_URL", "http://127.0.0.1:1/v2/enqueue")
+	service, mockDB := setupTestService()
+	mockDB.On("GetIntegration", "pagerduty").Return(nil, fmt.Errorf("integration not found"))
+	mockDB.On("RecordIntegrationFailure", "pagerduty", mock.Anything, mock.Anything).Return(&IntegrationState{Name: "pagerduty", ConsecutiveFailures: 1}, nil).Once()
+	mockDB.On("GetBuild", 5).Return(&BuildRequest{ID: 5, ProjectName: "api"}, nil)
+	mockDB.On("ListOpenEscalations", "build-service/api/deploy/prod").Return([]*Escalation{}, nil)
+
+	err := service.escalations.DeploymentChanged(context.Background(), &Deployment{ID: 9, BuildID: 5, ProjectName: "api", Environment: "prod", Status: "rolled_back"})
+	assert.Error(t, err, "failed triggers are retried rather than recorded")
+	mockDB.AssertNotCalled(t, "CreateEscalation", mock.Anything)
+	mockDB.AssertExpectations(t)
+
+	t.Setenv("PAGERDUTY_ROUTING_KEY", "")
+	service, _ = setupTestService()
+	assert.Nil(t, service.escalations)
+}
+
+func TestListBuildEscalationsHandler(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.On("GetBuild", 1).Return(&BuildRequest{ID: 1}, nil)
+	mockDB.On("GetBuild", 2).Return(nil, fmt.Errorf("build not found"))
+	mockDB.On("ListBuildEscalations", 1).Return([]*Escalation{{ID: 1, Provider: "pagerduty", Reference: "build-service/api/main", Status: escalationTriggered, BuildID: 1}}, nil)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/builds/{id}/escalations", service.listBuildEscalationsHandler).Methods("GET")
+	for path, want := range map[string]int{
+		"/api/v1/builds/1/escalations": http.StatusOK,
+		"/api/v1/builds/2/escalations": http.StatusNotFound,
+		"/api/v1/builds/x/escalations": http.StatusBadRequest,
+	} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		assert.Equal(t, want, rr.Code, path)
+		if want == http.StatusOK {
+			assert.Contains(t, rr.Body.String(), `"provider":"pagerduty"`)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	// durationWindow is how many of the latest successful builds of a branch
+	// or project its duration estimate is based on
+	durationWindow = 20
+	// minDurationSamples is how many durations a branch needs for its own
+	// estimate; branches with fewer use their project's
+	minDurationSamples = 3
+)
+
+// recordDuration adds the duration of a successful build to the rolling
+// estimates of its branch and project. Failed builds often stop early and
+// would skew the estimates.
+func (bs *BuildService) recordDuration(build *BuildRequest, duration time.Duration) {
+	if build.Status != "success" {
+		return
+	}
+	if err := bs.db.RecordBuildDuration(build.ProjectName, build.Branch, duration.Seconds(), durationWindow); err != nil {
+		bs.errors.Capture("executor", fmt.Errorf("recording build duration: %w", err), build)
+	}
+}
+
+// buildDurations returns the recent durations a build's duration is
+// estimated from, sorted: those of its branch, or of its project when the
+// branch has too few. It's nil when neither has enough.
+func (bs *BuildService) buildDurations(build *BuildRequest) ([]float64, error) {
+	for _, branch := range []string{build.Branch, ""} {
+		durations, err := bs.db.GetBuildDurations(build.ProjectName, branch)
+		if err != nil {
+			return nil, err
+		}
+		if len(durations) >= minDurationSamples {
+			sort.Float64s(durations)
+			return durations, nil
+		}
+		if branch == "" {
+			break
+		}
+	}
+	return nil, nil
+}
+
+// setBuildETA estimates when a running build will finish: when it has run
+// for the median duration of its branch's recent successful builds, or once
+// that has passed, for their 90th percentile. Builds running for longer, or
+// without enough history, get no estimate.
+func (bs *BuildService) setBuildETA(build *BuildRequest, now time.Time) {
+	build.ETA = nil
+	if build.Status != "running" || build.StartedAt == nil {
+		return
+	}
+	durations, err := bs.buildDurations(build)
+	if err != nil {
+		bs.errors.Capture("eta", fmt.Errorf("getting build durations: %w", err), build)
+		return
+	}
+	if durations == nil {
+		return
+	}
+
+	for _, p := range []float64{50, 90} {
+		eta := build.StartedAt.Add(time.Duration(percentile(durations, p) * float64(time.Second))).Truncate(time.Second)
+		if eta.After(now) {
+			build.ETA = &eta
+			return
+		}
+	}
+}
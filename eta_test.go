@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetBuildETA(t *testing.T) {
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	started := now.Add(-2 * time.Minute)
+
+	service, mockDB := setupTestService()
+	// api/main has its own history, api/feature too little of it
+	mockDB.On("GetBuildDurations", "api", "main").Return([]float64{600, 180, 240, 300}, nil)
+	mockDB.On("GetBuildDurations", "api", "feature").Return([]float64{60}, nil)
+	mockDB.On("GetBuildDurations", "api", "").Return([]float64{90, 150, 400}, nil)
+	mockDB.On("GetBuildDurations", "web", "main").Return([]float64{}, nil)
+	mockDB.On("GetBuildDurations", "web", "").Return([]float64{120}, nil)
+	mockDB.On("GetBuildDurations", "cli", "main").Return(nil, fmt.Errorf("connection reset"))
+
+	eta := func(project, branch, status string, startedAt time.Time) *time.Time {
+		build := &BuildRequest{ProjectName: project, Branch: branch, Status: status, StartedAt: &startedAt}
+		service.setBuildETA(build, now)
+		return build.ETA
+	}
+
+	// The median of the branch's builds
+	assert.Equal(t, started.Add(240*time.Second), *eta("api", "main", "running", started))
+	// Then their 90th percentile
+	assert.Equal(t, now.Add(5*time.Minute), *eta("api", "main", "running", now.Add(-5*time.Minute)))
+	assert.Nil(t, eta("api", "main", "running", now.Add(-15*time.Minute)))
+	// Branches with little history use their project's
+	assert.Equal(t, started.Add(150*time.Second), *eta("api", "feature", "running", started))
+	assert.Nil(t, eta("web", "main", "running", started))
+	assert.Nil(t, eta("cli", "main", "running", started))
+	// Only running builds finish
+	assert.Nil(t, eta("api", "main", "queued", started))
+	assert.Nil(t, eta("api", "main", "success", started))
+}
+
+func TestRecordDuration(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.ExpectedCalls = nil
+	mockDB.On("RecordBuildDuration", "api", "main", 90.0, durationWindow).Return(nil).Once()
+
+	service.recordDuration(&BuildRequest{ProjectName: "api", Branch: "main", Status: "success"}, 90*time.Second)
+	// Failed builds often stop early
+	service.recordDuration(&BuildRequest{ProjectName: "api", Branch: "main", Status: "failed"}, 10*time.Second)
+
+	mockDB.AssertExpectations(t)
+}
+
+func TestGetBuildETA(t *testing.T) {
+	service, mockDB := setupTestService()
+	started := time.Now().UTC().Add(-time.Minute)
+	mockDB.On("GetBuild", 9).Return(&BuildRequest{ID: 9, ProjectName: "api", Branch: "main", Status: "running", StartedAt: &started}, nil)
+	mockDB.On("GetBuildDurations", "api", "main").Return([]float64{300, 300, 300}, nil)
+
+	req := httptest.NewRequest("GET", "/api/v1/builds/9", nil)
+	req = mux.SetURLVars(req, map[string]string{"id": "9"})
+	rr := httptest.NewRecorder()
+	service.getBuildHandler(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Code)
+	var build BuildRequest
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &build))
+	require.NotNil(t, build.ETA)
+	assert.WithinDuration(t, started.Add(5*time.Minute), *build.ETA, time.Second)
+}
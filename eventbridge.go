@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// EventBridgeSink publishes build events to Amazon EventBridge event buses,
+// choosing the bus by the organization owning the build's repository
+type EventBridgeSink struct {
+	buses       map[string]string
+	region      string
+	endpoint    string
+	source      string
+	credentials *AWSCredentialProvider
+	health      *IntegrationHealth
+	client      *http.Client
+	now         func() time.Time
+}
+
+// NewEventBridgeSinkFromEnv creates an EventBridge sink when EVENTBRIDGE_BUSES
+// is set, or returns nil
+func NewEventBridgeSinkFromEnv(health *IntegrationHealth) *EventBridgeSink {
+	buses := parseOrgTargets(os.Getenv("EVENTBRIDGE_BUSES"))
+	if len(buses) == 0 {
+		return nil
+	}
+
+	region := os.Getenv("EVENTBRIDGE_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	source := os.Getenv("EVENTBRIDGE_SOURCE")
+	if source == "" {
+		source = "build-service"
+	}
+
+	return &EventBridgeSink{
+		buses:       buses,
+		region:      region,
+		endpoint:    fmt.Sprintf("https://events.%s.amazonaws.com", region),
+		source:      source,
+		credentials: NewAWSCredentialProviderFromEnv(region),
+		health:      health,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		now:         time.Now,
+	}
+}
+
+// Name identifies the integration
+func (eb *EventBridgeSink) Name() string {
+	return "eventbridge"
+}
+
+// eventBridgeEntry is a single PutEvents request entry
+type eventBridgeEntry struct {
+	Source       string `json:"Source"`
+	DetailType   string `json:"DetailType"`
+	Detail       string `json:"Detail"`
+	EventBusName string `json:"EventBusName"`
+	Time         int64  `json:"Time"`
+}
+
+// eventBridgeResponse is the subset of a PutEvents response we use
+type eventBridgeResponse struct {
+	FailedEntryCount int `json:"FailedEntryCount"`
+	Entries          []struct {
+		ErrorCode    string `json:"ErrorCode"`
+		ErrorMessage string `json:"ErrorMessage"`
+	} `json:"Entries"`
+}
+
+// Deliver puts the event on the bus of the build's organization. Rules can
+// match on the "Build Status Change" detail type and the build fields in the
+// detail, e.g. {"detail": {"build": {"status": ["failed"]}}}.
+func (eb *EventBridgeSink) Deliver(ctx context.Context, event BuildEvent) error {
+	bus, ok := orgTarget(eb.buses, &event.Build)
+	if !ok {
+		return nil
+	}
+	if !eb.health.Allow(eb.Name()) {
+		return errIntegrationDisabled
+	}
+
+	err := eb.putEvent(ctx, bus, event)
+	eb.health.Record(eb.Name(), err, &event.Build)
+	return err
+}
+
+func (eb *EventBridgeSink) putEvent(ctx context.Context, bus string, event BuildEvent) error {
+	detail, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(map[string][]eventBridgeEntry{
+		"Entries": {{
+			Source:       eb.source,
+			DetailType:   "Build Status Change",
+			Detail:       string(detail),
+			EventBusName: bus,
+			Time:         event.Time.Unix(),
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	credentials, err := eb.credentials.Credentials(ctx)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", eb.endpoint+"/", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "AWSEvents.PutEvents")
+	hash := sha256.Sum256(payload)
+	signAWSRequest(req, credentials, "events", eb.region, hex.EncodeToString(hash[:]), eb.now().UTC())
+
+	resp, err := eb.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("eventbridge: status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var result eventBridgeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("decoding eventbridge response: %w", err)
+	}
+	if result.FailedEntryCount > 0 {
+		for _, entry := range result.Entries {
+			if entry.ErrorCode != "" {
+				return fmt.Errorf("eventbridge: putting event on %s: %s: %s", bus, entry.ErrorCode, entry.ErrorMessage)
+			}
+		}
+		return fmt.Errorf("eventbridge: putting event on %s failed", bus)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewEventBridgeSinkFromEnv(t *testing.T) {
+	t.Setenv("EVENTBRIDGE_BUSES", "")
+	assert.Nil(t, NewEventBridgeSinkFromEnv(nil))
+
+	t.Setenv("EVENTBRIDGE_BUSES", "*=default")
+	t.Setenv("EVENTBRIDGE_REGION", "")
+	t.Setenv("AWS_REGION", "eu-central-1")
+	sink := NewEventBridgeSinkFromEnv(nil)
+	require.NotNil(t, sink)
+	assert.Equal(t, "https://events.eu-central-1.amazonaws.com", sink.endpoint)
+	assert.Equal(t, "build-service", sink.source)
+}
+
+func TestEventBridgeSinkDeliver(t *testing.T) {
+	var entries []eventBridgeEntry
+	failed := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "AWSEvents.PutEvents", r.Header.Get("X-Amz-Target"))
+		assert.Contains(t, r.Header.Get("Authorization"), "/eu-west-1/events/aws4_request")
+
+		var body struct{ Entries []eventBridgeEntry }
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		entries = append(entries, body.Entries...)
+		if failed {
+			w.Write([]byte(`{"FailedEntryCount": 1, "Entries": [{"ErrorCode": "AccessDeniedException", "ErrorMessage": "not authorized"}]}`))
+			return
+		}
+		w.Write([]byte(`{"FailedEntryCount": 0, "Entries": [{"EventId": "1"}]}`))
+	}))
+	defer server.Close()
+
+	t.Setenv("EVENTBRIDGE_BUSES", "acme=arn:aws:events:eu-west-1:123456789012:event-bus/acme")
+	t.Setenv("EVENTBRIDGE_REGION", "eu-west-1")
+	t.Setenv("AWS_ROLE_ARN", "")
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	service, mockDB := setupTestService()
+	sink := NewEventBridgeSinkFromEnv(service.integrations)
+	require.NotNil(t, sink)
+	sink.endpoint = server.URL
+
+	mockDB.On("GetIntegration", "eventbridge").Return(nil, fmt.Errorf("integration not found"))
+	mockDB.On("ResetIntegrationFailures", "eventbridge").Return(nil).Once()
+	mockDB.On("RecordIntegrationFailure", "eventbridge", "eventbridge: putting event on arn:aws:events:eu-west-1:123456789012:event-bus/acme: AccessDeniedException: not authorized", 10).
+		Return(&IntegrationState{Name: "eventbridge", ConsecutiveFailures: 1}, nil).Once()
+
+	event := BuildEvent{Build: BuildRequest{ID: 42, ProjectName: "api", GitURL: "https://github.com/acme/api.git", Status: "failed"}, Time: time.Unix(1700000000, 0)}
+	require.NoError(t, sink.Deliver(context.Background(), event))
+
+	// Builds of other organizations aren't published
+	other := event
+	other.Build.GitURL = "https://github.com/other/api.git"
+	require.NoError(t, sink.Deliver(context.Background(), other))
+
+	require.Len(t, entries, 1)
+	assert.Equal(t, "build-service", entries[0].Source)
+	assert.Equal(t, "Build Status Change", entries[0].DetailType)
+	assert.Equal(t, "arn:aws:events:eu-west-1:123456789012:event-bus/acme", entries[0].EventBusName)
+	assert.Equal(t, int64(1700000000), entries[0].Time)
+	var detail BuildEvent
+	require.NoError(t, json.Unmarshal([]byte(entries[0].Detail), &detail))
+	assert.Equal(t, 42, detail.Build.ID)
+
+	failed = true
+	assert.Error(t, sink.Deliver(context.Background(), event))
+	mockDB.AssertExpectations(t)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxLogLineBytes bounds how much of an unterminated line is buffered before
+// it is published anyway
+const maxLogLineBytes = 16 * 1024
+
+// BuildEvent describes a build status transition
+type BuildEvent struct {
+	Build BuildRequest `json:"build"`
+	URL   string       `json:"url,omitempty"`
+	Time  time.Time    `json:"time"`
+}
+
+// EventBus fans build events out to in-process subscribers. Publishing never
+// blocks: events are dropped for subscribers that fall behind.
+type EventBus struct {
+	mu          sync.RWMutex
+	subscribers map[chan BuildEvent]struct{}
+	hooks       []func(BuildEvent)
+	links       *PublicURLs
+}
+
+// NewEventBus creates an empty event bus
+func NewEventBus() *EventBus {
+	return &EventBus{subscribers: make(map[chan BuildEvent]struct{})}
+}
+
+// Subscribe registers a subscriber with the given buffer size. The returned
+// function unsubscribes and closes the channel.
+func (eb *EventBus) Subscribe(buffer int) (<-chan BuildEvent, func()) {
+	ch := make(chan BuildEvent, buffer)
+
+	eb.mu.Lock()
+	eb.subscribers[ch] = struct{}{}
+	eb.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			eb.mu.Lock()
+			delete(eb.subscribers, ch)
+			eb.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// OnPublish registers a hook that Publish calls synchronously with every
+// event. Unlike subscribers, hooks never miss events, so they must be quick.
+func (eb *EventBus) OnPublish(hook func(BuildEvent)) {
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+	eb.hooks = append(eb.hooks, hook)
+}
+
+// Publish sends a snapshot of the build to every subscriber
+func (eb *EventBus) Publish(build *BuildRequest) {
+	event := BuildEvent{Build: *build, Time: time.Now().UTC()}
+	if eb.links != nil {
+		event.URL = eb.links.BuildURL(build)
+	}
+
+	eb.mu.RLock()
+	defer eb.mu.RUnlock()
+
+	for _, hook := range eb.hooks {
+		hook(event)
+	}
+
+	for ch := range eb.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// LogLine is a single line of build output
+type LogLine struct {
+	BuildID int       `json:"build_id"`
+	Line    string    `json:"line"`
+	Time    time.Time `json:"time"`
+}
+
+// LogBus fans live build output out to in-process subscribers. Like the
+// EventBus, lines are dropped for subscribers that fall behind.
+type LogBus struct {
+	mu          sync.RWMutex
+	subscribers map[chan LogLine]struct{}
+}
+
+// NewLogBus creates an empty log bus
+func NewLogBus() *LogBus {
+	return &LogBus{subscribers: make(map[chan LogLine]struct{})}
+}
+
+// Subscribe registers a subscriber with the given buffer size. The returned
+// function unsubscribes and closes the channel.
+func (lb *LogBus) Subscribe(buffer int) (<-chan LogLine, func()) {
+	ch := make(chan LogLine, buffer)
+
+	lb.mu.Lock()
+	lb.subscribers[ch] = struct{}{}
+	lb.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			lb.mu.Lock()
+			delete(lb.subscribers, ch)
+			lb.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// Publish sends a line of a build's output to every subscriber
+func (lb *LogBus) Publish(buildID int, line string) {
+	logLine := LogLine{BuildID: buildID, Line: line, Time: time.Now().UTC()}
+
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	for ch := range lb.subscribers {
+		select {
+		case ch <- logLine:
+		default:
+		}
+	}
+}
+
+// Writer returns an io.Writer that publishes each complete line written to
+// it. Close publishes any trailing partial line.
+func (lb *LogBus) Writer(buildID int) *logWriter {
+	return &logWriter{bus: lb, buildID: buildID}
+}
+
+// logWriter splits a build's output stream into lines for a LogBus
+type logWriter struct {
+	bus     *LogBus
+	buildID int
+	partial []byte
+}
+
+func (lw *logWriter) Write(p []byte) (int, error) {
+	lw.partial = append(lw.partial, p...)
+	for {
+		i := bytes.IndexByte(lw.partial, '\n')
+		if i < 0 {
+			break
+		}
+		lw.bus.Publish(lw.buildID, strings.TrimSuffix(string(lw.partial[:i]), "\r"))
+		lw.partial = lw.partial[i+1:]
+	}
+	if len(lw.partial) > maxLogLineBytes {
+		lw.bus.Publish(lw.buildID, string(lw.partial))
+		lw.partial = nil
+	}
+	return len(p), nil
+}
+
+func (lw *logWriter) Close() error {
+	if len(lw.partial) > 0 {
+		lw.bus.Publish(lw.buildID, string(lw.partial))
+		lw.partial = nil
+	}
+	return nil
+}
@@ -0,0 +1,625 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Executor runs a build to completion and reports its outcome
+type Executor interface {
+	Execute(ctx context.Context, build *BuildRequest) (*BuildResult, error)
+}
+
+// BuildResult is the outcome of an executed build
+type BuildResult struct {
+	Status   string
+	ExitCode int
+	Tool     string
+	// Steps are the commands the build tool was run with
+	Steps   []string
+	Version string
+	// Commit is the commit that was checked out, nil when the checkout failed
+	Commit *CommitInfo
+	// Image is the container image the steps ran in, for container executors
+	Image  string
+	Output []byte
+	// Stages are the phases of the build, in the order they ran
+	Stages []*BuildStage
+	// Usage is what the build's steps consumed, nil when nothing ran
+	Usage *ResourceUsage
+	// Matrix lists the combinations a matrix build expands into instead of
+	// running its steps
+	Matrix []map[string]string
+	// LogTruncation is the limit the build's log was truncated at, if any
+	LogTruncation string
+}
+
+// ResourceUsage is the CPU time and memory a build's steps used
+type ResourceUsage struct {
+	CPUSeconds float64
+	// PeakMemoryBytes is the largest resident memory of any step
+	PeakMemoryBytes int64
+}
+
+// addProcess adds the usage of a finished step process
+func (ru *ResourceUsage) addProcess(state *os.ProcessState) {
+	ru.CPUSeconds += (state.UserTime() + state.SystemTime()).Seconds()
+	ru.PeakMemoryBytes = max(ru.PeakMemoryBytes, processPeakMemory(state))
+}
+
+// NewExecutorFromEnv returns the executor selected by the EXECUTOR
+// environment variable, publishing pipeline artifacts to artifacts, checking
+// repositories out of mirrors and keeping complete logs in logStore when they
+// aren't nil
+func NewExecutorFromEnv(logs *LogBus, artifacts ArtifactPublisher, mirrors *GitMirrorCache, logStore LogStore) Executor {
+	executor := newExecutor(os.Getenv("EXECUTOR"), logs)
+
+	var local *LocalExecutor
+	switch e := executor.(type) {
+	case *LocalExecutor:
+		local = e
+	case *DockerExecutor:
+		local = e.Local
+	}
+	if local != nil {
+		local.TagUsername = os.Getenv("VERSION_TAG_USERNAME")
+		local.TagToken = os.Getenv("VERSION_TAG_TOKEN")
+		local.Artifacts = artifacts
+		local.Mirrors = mirrors
+		local.LogStore = logStore
+		local.LogLimits = LogLimitsFromEnv()
+	}
+	return executor
+}
+
+// newExecutor creates the named executor, streaming output to logs when set
+func newExecutor(name string, logs *LogBus) Executor {
+	switch name {
+	case "simulated":
+		return &SimulatedExecutor{}
+	case "docker":
+		executor := NewDockerExecutorFromEnv()
+		executor.Local.Logs = logs
+		return executor
+	default:
+		executor := NewLocalExecutor(os.Getenv("WORKSPACE_DIR"))
+		executor.Logs = logs
+		return executor
+	}
+}
+
+// SimulatedExecutor fakes a build by sleeping, useful for demos and tests
+type SimulatedExecutor struct{}
+
+// Execute simulates a build taking 2-5 seconds with a 90% success rate
+func (se *SimulatedExecutor) Execute(ctx context.Context, build *BuildRequest) (*BuildResult, error) {
+	select {
+	case <-time.After(time.Duration(2+len(build.ProjectName)%4) * time.Second):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if len(build.ProjectName)%10 == 0 {
+		return &BuildResult{Status: "failed", ExitCode: 1, Tool: "simulated"}, nil
+	}
+	return &BuildResult{Status: "success", ExitCode: 0, Tool: "simulated"}, nil
+}
+
+// maxOutputBytes caps how much build output is retained in memory
+const maxOutputBytes = 64 * 1024
+
+// LocalExecutor clones the repository into a scratch workspace and runs the
+// detected build tool as a child process
+type LocalExecutor struct {
+	WorkspaceRoot    string
+	AllowedProtocols []string
+	// TagUsername and TagToken authenticate pushes of version tags over HTTP(S)
+	TagUsername string
+	TagToken    string
+	// Logs receives build output line by line as it is produced
+	Logs *LogBus
+	// Artifacts receives the artifacts declared in a repository's pipeline
+	// file. Declared artifacts are not published when it is nil.
+	Artifacts ArtifactPublisher
+	// Mirrors keeps local mirrors of frequently built repositories to clone
+	// from; repositories are cloned from their git host when it is nil
+	Mirrors *GitMirrorCache
+	// LogStore keeps the complete output of builds; only the tails kept with
+	// their stages remain when it is nil
+	LogStore LogStore
+	// LogLimits caps the output reaching the log, stages and LogStore
+	LogLimits LogLimits
+}
+
+// NewLocalExecutor creates a local executor rooted at the given workspace directory
+func NewLocalExecutor(workspaceRoot string) *LocalExecutor {
+	if workspaceRoot == "" {
+		workspaceRoot = filepath.Join(os.TempDir(), "build-service-workspaces")
+	}
+
+	return &LocalExecutor{
+		WorkspaceRoot:    workspaceRoot,
+		AllowedProtocols: []string{"https", "http", "ssh", "git"},
+	}
+}
+
+// stepRunner runs a build tool's steps in a checked out workspace, returning
+// the exit code of the first failing step and adding what they used to usage
+type stepRunner func(ctx context.Context, workspace, srcDir string, output *tailBuffer, steps [][]string, env []string, usage *ResourceUsage) (int, error)
+
+// Execute clones the build's repository, detects the build tool and runs it
+func (le *LocalExecutor) Execute(ctx context.Context, build *BuildRequest) (*BuildResult, error) {
+	return le.execute(ctx, build, le.runSteps)
+}
+
+// execute checks out and versions the build, then hands the steps of the
+// repository's pipeline file, or of the detected build tool when it has none,
+// to runSteps one stage at a time
+func (le *LocalExecutor) execute(ctx context.Context, build *BuildRequest, runSteps stepRunner) (result *BuildResult, err error) {
+	stages := &stageRecorder{}
+	var commit *CommitInfo
+	var usage *ResourceUsage
+	var limiter *logLimiter
+	defer func() {
+		if result != nil {
+			result.Stages = stages.stages
+			result.Commit = commit
+			result.Usage = usage
+			if limiter != nil {
+				result.LogTruncation = limiter.truncation
+			}
+		}
+	}()
+
+	if err := le.validateSource(build); err != nil {
+		return &BuildResult{Status: "failed", ExitCode: -1, Output: []byte(err.Error())}, nil
+	}
+
+	if err := os.MkdirAll(le.WorkspaceRoot, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create workspace root: %w", err)
+	}
+	workspace, err := os.MkdirTemp(le.WorkspaceRoot, fmt.Sprintf("build-%d-", build.ID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create workspace: %w", err)
+	}
+	defer os.RemoveAll(workspace)
+
+	output := &tailBuffer{limit: maxOutputBytes, live: stages, mask: secretMasker(build.Secrets), debug: build.DebugLogging}
+	if le.Logs != nil {
+		logs := le.Logs.Writer(build.ID)
+		defer logs.Close()
+		output.live = io.MultiWriter(stages, logs)
+	}
+	if le.LogStore != nil {
+		// The upload completes after the build is cancelled or times out
+		stored, err := le.LogStore.Create(context.WithoutCancel(ctx), buildLogKey(build.ID))
+		if err != nil {
+			log.Printf("Error storing log of build %d: %v", build.ID, err)
+		} else {
+			defer func() {
+				if err := stored.Close(); err != nil {
+					log.Printf("Error storing log of build %d: %v", build.ID, err)
+				}
+			}()
+			output.live = io.MultiWriter(output.live, stored)
+		}
+	}
+	limiter = newLogLimiter(output.live, le.LogLimits, workspace)
+	output.live = limiter
+	// Runs before the log is stored, so it ends with where the rest went
+	defer func() { limiter.finish(context.WithoutCancel(ctx), le.Artifacts, build, stages.current()) }()
+	srcDir := filepath.Join(workspace, "src")
+
+	stages.begin("clone")
+	for _, note := range build.DebugNotes {
+		output.debugf("%s", note)
+	}
+	output.debugf("workspace %s", workspace)
+	if exitCode, err := le.checkout(ctx, workspace, srcDir, output, build); err != nil || exitCode != 0 {
+		stages.finish(exitCode, err)
+		return le.result("", exitCode, output), err
+	}
+	commit = le.describeCommit(ctx, workspace, srcDir, output)
+
+	version := build.Version
+	var releaseTag string
+	if build.AutoVersion && build.Tag == "" {
+		var exitCode int
+		if version, releaseTag, exitCode, err = le.calculateVersion(ctx, workspace, srcDir, output); err != nil || exitCode != 0 {
+			stages.finish(exitCode, err)
+			return le.result("", exitCode, output), err
+		}
+	}
+	stages.finish(0, nil)
+
+	// Secrets and matrix values come first so the service's own variables
+	// take precedence
+	env := append(secretEnv(build.Secrets), envList(build.Matrix)...)
+	// Expose the version to the build steps for packaging
+	if version != "" {
+		env = append(env, "BUILD_VERSION="+version)
+	}
+	// Let OpenTelemetry-instrumented tooling join the build's trace
+	if build.TraceParent != "" {
+		env = append(env,
+			"TRACEPARENT="+build.TraceParent,
+			"OTEL_EXPORTER_OTLP_ENDPOINT="+buildURL(build.ID)+"/otlp",
+			"OTEL_EXPORTER_OTLP_PROTOCOL=http/json",
+		)
+	}
+
+	pipeline, err := loadPipeline(srcDir)
+	if err != nil {
+		fmt.Fprintln(output, err)
+		return le.result("", -1, output), nil
+	}
+
+	// A matrix build runs as one build per combination of its matrix, the
+	// pipeline file's or else the project's, instead of running steps
+	matrix := build.ProjectMatrix
+	if pipeline != nil && len(pipeline.Matrix) > 0 {
+		matrix = pipeline.Matrix
+	}
+	if len(matrix) > 0 && len(build.Matrix) == 0 {
+		combinations := matrix.combinations()
+		fmt.Fprintf(output, "--- expanding into %d matrix builds\n", len(combinations))
+		result := le.result("", 0, output)
+		result.Matrix = combinations
+		result.Version = version
+		return result, nil
+	}
+
+	var tool string
+	var commands []string
+	var groups []stageGroup
+	if pipeline != nil {
+		tool, commands, groups = "pipeline", pipeline.commands(), pipeline.stageGroups()
+	} else {
+		var steps [][]string
+		if tool, steps = detectBuildTool(srcDir); tool == "" {
+			fmt.Fprintf(output, "no supported build tool detected (expected %s, go.mod, build.gradle, package.json or Makefile)\n", pipelineFile)
+			return le.result("", -1, output), nil
+		}
+		for _, step := range steps {
+			commands = append(commands, strings.Join(step, " "))
+		}
+		groups = groupStages(steps)
+	}
+
+	for i, group := range groups {
+		stageEnv := env
+		if pipeline != nil {
+			// The service's own variables take precedence over the pipeline's
+			stageEnv = append(pipeline.stageEnv(group.name), env...)
+		}
+
+		stages.begin(group.name)
+		if usage == nil {
+			usage = &ResourceUsage{}
+		}
+		exitCode, err := runSteps(ctx, workspace, srcDir, output, group.steps, stageEnv, usage)
+		stages.finish(exitCode, err)
+		if err != nil || exitCode != 0 {
+			for _, skipped := range groups[i+1:] {
+				stages.skip(skipped.name)
+			}
+			result := le.result(tool, exitCode, output)
+			result.Steps = commands
+			return result, err
+		}
+	}
+
+	if pipeline != nil && len(pipeline.Artifacts) > 0 {
+		if le.Artifacts == nil {
+			fmt.Fprintln(output, "artifact publishing is not available, skipping declared artifacts")
+		} else {
+			stages.begin("artifacts")
+			if err := le.publishArtifacts(ctx, srcDir, output, build, stages.current(), pipeline.Artifacts); err != nil {
+				fmt.Fprintln(output, err)
+				stages.finish(-1, nil)
+				result := le.result(tool, -1, output)
+				result.Steps = commands
+				return result, ctx.Err()
+			}
+			stages.finish(0, nil)
+		}
+	}
+
+	// Only builds that passed every step are released
+	if releaseTag != "" {
+		stages.begin("release")
+		exitCode, err := le.pushVersionTag(ctx, workspace, srcDir, output, build, releaseTag)
+		stages.finish(exitCode, err)
+		if err != nil || exitCode != 0 {
+			result := le.result(tool, exitCode, output)
+			result.Steps = commands
+			return result, err
+		}
+	}
+
+	result = le.result(tool, 0, output)
+	result.Steps = commands
+	result.Version = version
+	return result, nil
+}
+
+// runSteps runs each step as a child process, stopping at the first failure
+func (le *LocalExecutor) runSteps(ctx context.Context, workspace, srcDir string, output *tailBuffer, steps [][]string, env []string, usage *ResourceUsage) (int, error) {
+	for _, step := range steps {
+		if exitCode, err := le.runCommand(ctx, workspace, srcDir, output, output, usage, step, env...); err != nil || exitCode != 0 {
+			return exitCode, err
+		}
+	}
+	return 0, nil
+}
+
+// checkout clones the build's branch or tag into srcDir and, when the build
+// pins a commit, checks that commit out
+func (le *LocalExecutor) checkout(ctx context.Context, workspace, srcDir string, output *tailBuffer, build *BuildRequest) (int, error) {
+	if build.PullRequest != 0 {
+		return le.checkoutMergeRef(ctx, workspace, srcDir, output, build)
+	}
+
+	ref := build.Branch
+	if build.Tag != "" {
+		ref = build.Tag
+	}
+
+	if le.Mirrors != nil {
+		if mirror := le.Mirrors.Source(ctx, build.GitURL); mirror != "" {
+			exitCode, err := le.checkoutMirror(ctx, workspace, srcDir, output, build, ref, mirror)
+			if err != nil || exitCode == 0 {
+				le.Mirrors.RecordClone("mirror")
+				return exitCode, err
+			}
+			// The mirror may not have the ref or commit yet
+			fmt.Fprintln(output, "checkout from mirror failed, cloning from the git host")
+			if err := os.RemoveAll(srcDir); err != nil {
+				return -1, err
+			}
+		}
+		le.Mirrors.RecordClone("upstream")
+	}
+
+	clone := []string{"git", "clone", "--depth", "1", "--single-branch", "--branch", ref, "--", build.GitURL, srcDir}
+	if exitCode, err := le.run(ctx, workspace, workspace, output, clone); err != nil || exitCode != 0 {
+		return exitCode, err
+	}
+	if build.CommitSHA == "" {
+		return 0, nil
+	}
+
+	fetch := []string{"git", "fetch", "--depth", "1", "origin", build.CommitSHA}
+	if exitCode, err := le.run(ctx, workspace, srcDir, output, fetch); err != nil || exitCode != 0 {
+		return exitCode, err
+	}
+	return le.run(ctx, workspace, srcDir, output, []string{"git", "checkout", "--detach", "FETCH_HEAD"})
+}
+
+// checkoutMergeRef checks out the merge ref of a pull request build. Merge
+// refs live outside refs/heads, so they can't be cloned directly, and mirrors
+// don't fetch them.
+func (le *LocalExecutor) checkoutMergeRef(ctx context.Context, workspace, srcDir string, output *tailBuffer, build *BuildRequest) (int, error) {
+	for _, args := range [][]string{
+		{"git", "init", "--quiet", srcDir},
+		{"git", "-C", srcDir, "remote", "add", "origin", build.GitURL},
+		{"git", "-C", srcDir, "fetch", "--depth", "1", "origin", "refs/" + build.Branch},
+		{"git", "-C", srcDir, "checkout", "--detach", "FETCH_HEAD"},
+	} {
+		if exitCode, err := le.run(ctx, workspace, workspace, output, args); err != nil || exitCode != 0 {
+			return exitCode, err
+		}
+	}
+	return 0, nil
+}
+
+// checkoutMirror clones ref from a repository's mirror, then points origin
+// back at the git host for later fetches and pushes
+func (le *LocalExecutor) checkoutMirror(ctx context.Context, workspace, srcDir string, output *tailBuffer, build *BuildRequest, ref, mirror string) (int, error) {
+	// Shallow clones need a file:// URL, which the sandbox otherwise forbids
+	allow := "GIT_ALLOW_PROTOCOL=" + strings.Join(append(le.AllowedProtocols[:len(le.AllowedProtocols):len(le.AllowedProtocols)], "file"), ":")
+	source := "file://" + mirror
+
+	clone := []string{"git", "clone", "--depth", "1", "--single-branch", "--branch", ref, "--", source, srcDir}
+	if exitCode, err := le.run(ctx, workspace, workspace, output, clone, allow); err != nil || exitCode != 0 {
+		return exitCode, err
+	}
+	if build.CommitSHA != "" {
+		fetch := []string{"git", "fetch", "--depth", "1", source, build.CommitSHA}
+		if exitCode, err := le.run(ctx, workspace, srcDir, output, fetch, allow); err != nil || exitCode != 0 {
+			return exitCode, err
+		}
+		if exitCode, err := le.run(ctx, workspace, srcDir, output, []string{"git", "checkout", "--detach", "FETCH_HEAD"}); err != nil || exitCode != 0 {
+			return exitCode, err
+		}
+	}
+	return le.run(ctx, workspace, srcDir, output, []string{"git", "remote", "set-url", "origin", build.GitURL})
+}
+
+// validateSource rejects git URLs and branches that could escape the sandbox
+func (le *LocalExecutor) validateSource(build *BuildRequest) error {
+	if strings.HasPrefix(build.Branch, "-") {
+		return fmt.Errorf("invalid branch name %q", build.Branch)
+	}
+	if strings.HasPrefix(build.Tag, "-") {
+		return fmt.Errorf("invalid tag name %q", build.Tag)
+	}
+	if build.CommitSHA != "" && !commitSHAPattern.MatchString(build.CommitSHA) {
+		return fmt.Errorf("invalid commit sha %q", build.CommitSHA)
+	}
+
+	scheme := "ssh"
+	if u, err := url.Parse(build.GitURL); err == nil && u.Scheme != "" {
+		scheme = u.Scheme
+	} else if !strings.Contains(build.GitURL, "@") {
+		return fmt.Errorf("unsupported git url %q", build.GitURL)
+	}
+
+	for _, allowed := range le.AllowedProtocols {
+		if scheme == allowed {
+			return nil
+		}
+	}
+	return fmt.Errorf("git protocol %q is not allowed", scheme)
+}
+
+// run executes a single command inside the workspace, returning its exit code.
+// A non-nil error means the command could not be run at all. env is added to
+// the sandbox environment.
+func (le *LocalExecutor) run(ctx context.Context, workspace, dir string, output *tailBuffer, args []string, env ...string) (int, error) {
+	return le.runCapture(ctx, workspace, dir, output, output, args, env...)
+}
+
+// runCapture is run with the command's standard output sent to stdout
+func (le *LocalExecutor) runCapture(ctx context.Context, workspace, dir string, stdout io.Writer, output *tailBuffer, args []string, env ...string) (int, error) {
+	return le.runCommand(ctx, workspace, dir, stdout, output, nil, args, env...)
+}
+
+// runCommand is runCapture adding the command's resource usage to usage when
+// it is set
+func (le *LocalExecutor) runCommand(ctx context.Context, workspace, dir string, stdout io.Writer, output *tailBuffer, usage *ResourceUsage, args []string, env ...string) (int, error) {
+	fmt.Fprintf(output, "$ %s\n", strings.Join(args, " "))
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Dir = dir
+	cmd.Stdout = stdout
+	cmd.Stderr = output
+	cmd.Env = append(sandboxEnv(workspace, le.AllowedProtocols), env...)
+	if output.debug && args[0] == "git" {
+		// Git traces the commands and requests it runs to stderr
+		cmd.Env = append(cmd.Env, "GIT_TRACE=1")
+	}
+	cmd.WaitDelay = 10 * time.Second
+	configureProcessGroup(cmd)
+
+	start := time.Now()
+	err := cmd.Run()
+	if usage != nil && cmd.ProcessState != nil {
+		usage.addProcess(cmd.ProcessState)
+	}
+	if cmd.ProcessState != nil {
+		output.debugf("%s exited with %d after %s in %s", args[0], cmd.ProcessState.ExitCode(), time.Since(start).Round(time.Millisecond), dir)
+	}
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return 0, nil
+	case ctx.Err() != nil:
+		return -1, ctx.Err()
+	case errors.As(err, &exitErr):
+		return exitErr.ExitCode(), nil
+	default:
+		log.Printf("Error running %s: %v", args[0], err)
+		fmt.Fprintf(output, "%v\n", err)
+		return -1, nil
+	}
+}
+
+func (le *LocalExecutor) result(tool string, exitCode int, output *tailBuffer) *BuildResult {
+	status := "success"
+	if exitCode != 0 {
+		status = "failed"
+	}
+
+	return &BuildResult{
+		Status:   status,
+		ExitCode: exitCode,
+		Tool:     tool,
+		Output:   output.Bytes(),
+	}
+}
+
+// sandboxEnv builds a minimal environment for build processes so that the
+// service's own configuration (database credentials etc.) is not leaked
+func sandboxEnv(workspace string, allowedProtocols []string) []string {
+	return []string{
+		"PATH=" + os.Getenv("PATH"),
+		"HOME=" + workspace,
+		"TMPDIR=" + workspace,
+		"GOPATH=" + filepath.Join(workspace, ".go"),
+		"GOCACHE=" + filepath.Join(workspace, ".cache", "go-build"),
+		"GOFLAGS=-mod=mod",
+		"npm_config_cache=" + filepath.Join(workspace, ".npm"),
+		"GRADLE_USER_HOME=" + filepath.Join(workspace, ".gradle"),
+		"GIT_TERMINAL_PROMPT=0",
+		"GIT_ALLOW_PROTOCOL=" + strings.Join(allowedProtocols, ":"),
+		"CI=true",
+	}
+}
+
+// detectBuildTool inspects a checkout and returns the build tool name along
+// with the commands needed to build it
+func detectBuildTool(dir string) (string, [][]string) {
+	return buildToolSteps(func(name string) bool {
+		_, err := os.Stat(filepath.Join(dir, name))
+		return err == nil
+	})
+}
+
+// buildToolSteps picks the build tool and steps for a repository from which
+// files exist at its root
+func buildToolSteps(exists func(name string) bool) (string, [][]string) {
+	switch {
+	case exists("go.mod"):
+		return "go", [][]string{{"go", "build", "./..."}, {"go", "test", "./..."}}
+	case exists("gradlew"):
+		return "gradle", [][]string{{"sh", "./gradlew", "build", "--no-daemon"}}
+	case exists("build.gradle") || exists("build.gradle.kts"):
+		return "gradle", [][]string{{"gradle", "build", "--no-daemon"}}
+	case exists("package.json"):
+		install := []string{"npm", "install"}
+		if exists("package-lock.json") {
+			install = []string{"npm", "ci"}
+		}
+		return "npm", [][]string{install, {"npm", "run", "build", "--if-present"}, {"npm", "run", "test", "--if-present"}}
+	case exists("Makefile"):
+		return "make", [][]string{{"make"}}
+	default:
+		return "", nil
+	}
+}
+
+// tailBuffer is an io.Writer that keeps only the last limit bytes written
+type tailBuffer struct {
+	buf   bytes.Buffer
+	limit int
+	// live, when set, also receives everything written
+	live io.Writer
+	// mask, when set, replaces secrets in everything written
+	mask *strings.Replacer
+	// debug adds the lines written with debugf
+	debug bool
+}
+
+func (tb *tailBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if tb.mask != nil {
+		p = []byte(tb.mask.Replace(string(p)))
+	}
+	if tb.live != nil {
+		tb.live.Write(p)
+	}
+
+	if len(p) > tb.limit {
+		p = p[len(p)-tb.limit:]
+	}
+	if overflow := tb.buf.Len() + len(p) - tb.limit; overflow > 0 {
+		tb.buf.Next(overflow)
+	}
+	tb.buf.Write(p)
+	return n, nil
+}
+
+func (tb *tailBuffer) Bytes() []byte {
+	return tb.buf.Bytes()
+}
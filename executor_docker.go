@@ -0,0 +1,510 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dockerAPIVersion is the Docker Engine API version requests are made against
+const dockerAPIVersion = "v1.41"
+
+// dockerWorkspace is where the build workspace is mounted inside the container
+const dockerWorkspace = "/workspace"
+
+// dockerToolImages are the images builds run in when their project does not
+// set build_image, by detected build tool
+var dockerToolImages = map[string]string{
+	"go":     "golang:1.24",
+	"gradle": "gradle:8-jdk17",
+	"npm":    "node:20",
+	"make":   "buildpack-deps:bookworm",
+	// Pipelines without an image of their own
+	"pipeline": "buildpack-deps:bookworm",
+}
+
+// DockerExecutor checks builds out like LocalExecutor, then runs the build
+// tool inside a container with the workspace mounted, talking to the Docker
+// Engine API directly
+type DockerExecutor struct {
+	// Local performs the checkout and versioning on the host
+	Local *LocalExecutor
+	// DefaultImage, when set, replaces the per-tool default images
+	DefaultImage string
+	// NanoCPUs, MemoryBytes and PidsLimit limit each build container; zero
+	// means unlimited
+	NanoCPUs    int64
+	MemoryBytes int64
+	PidsLimit   int64
+	// Network is the network mode containers run with, Docker's default when empty
+	Network string
+
+	endpoint string
+	client   *http.Client
+}
+
+// NewDockerExecutor creates a Docker executor talking to the daemon at host,
+// a unix:// socket or tcp:// address as in DOCKER_HOST
+func NewDockerExecutor(host, workspaceRoot string) (*DockerExecutor, error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid docker host %q: %w", host, err)
+	}
+
+	de := &DockerExecutor{Local: NewLocalExecutor(workspaceRoot)}
+	switch u.Scheme {
+	case "unix":
+		socket := u.Path
+		de.endpoint = "http://docker"
+		de.client = &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+		}}
+	case "tcp", "http":
+		de.endpoint = "http://" + u.Host
+		de.client = &http.Client{}
+	default:
+		return nil, fmt.Errorf("unsupported docker host scheme %q", u.Scheme)
+	}
+	return de, nil
+}
+
+// NewDockerExecutorFromEnv configures a Docker executor from DOCKER_HOST and
+// the DOCKER_* resource limits. It exits when DOCKER_HOST is malformed, as
+// builds could never run.
+func NewDockerExecutorFromEnv() *DockerExecutor {
+	host := os.Getenv("DOCKER_HOST")
+	if host == "" {
+		host = "unix:///var/run/docker.sock"
+	}
+
+	de, err := NewDockerExecutor(host, os.Getenv("WORKSPACE_DIR"))
+	if err != nil {
+		log.Fatalf("Invalid DOCKER_HOST: %v", err)
+	}
+	de.DefaultImage = os.Getenv("DOCKER_IMAGE")
+	de.Network = os.Getenv("DOCKER_NETWORK")
+	de.MemoryBytes = int64(getEnvInt("DOCKER_MEMORY_MB", 0)) << 20
+	de.PidsLimit = int64(getEnvInt("DOCKER_PIDS_LIMIT", 1024))
+	if value := os.Getenv("DOCKER_CPUS"); value != "" {
+		cpus, err := strconv.ParseFloat(value, 64)
+		if err != nil || cpus < 0 {
+			log.Printf("Invalid value %q for DOCKER_CPUS, not limiting CPU", value)
+		} else {
+			de.NanoCPUs = int64(cpus * 1e9)
+		}
+	}
+	return de
+}
+
+// Execute checks the build out on the host and runs its steps in a container
+func (de *DockerExecutor) Execute(ctx context.Context, build *BuildRequest) (*BuildResult, error) {
+	var image string
+	result, err := de.Local.execute(ctx, build, func(ctx context.Context, workspace, srcDir string, output *tailBuffer, steps [][]string, env []string, usage *ResourceUsage) (int, error) {
+		tool, _ := detectBuildTool(srcDir)
+		var pipelineImage string
+		pipeline, _ := loadPipeline(srcDir)
+		if pipeline != nil {
+			tool, pipelineImage = "pipeline", expandMatrixValues(pipeline.Image, build.Matrix)
+		}
+		image = de.image(build, tool, pipelineImage)
+		if err := build.ImagePolicy.Check(image, pipeline); err != nil {
+			fmt.Fprintf(output, "--- %v\n", err)
+			return -1, nil
+		}
+		return de.run(ctx, build, image, workspace, output, steps, env, usage)
+	})
+	if result != nil {
+		result.Image = image
+	}
+	return result, err
+}
+
+// image picks the container image for a build: its project's build_image,
+// then the image of its pipeline file, then DOCKER_IMAGE, then the default
+// for the detected tool
+func (de *DockerExecutor) image(build *BuildRequest, tool, pipelineImage string) string {
+	switch {
+	case build.BuildImage != "":
+		return build.BuildImage
+	case pipelineImage != "":
+		return pipelineImage
+	case de.DefaultImage != "":
+		return de.DefaultImage
+	default:
+		return dockerToolImages[tool]
+	}
+}
+
+// run executes the steps as a single shell script in a new container, pulling
+// the image first if the daemon does not have it. The container is removed
+// whatever the outcome, which also kills it when ctx is cancelled. The
+// container's resource usage is added to usage.
+func (de *DockerExecutor) run(ctx context.Context, build *BuildRequest, image, workspace string, output *tailBuffer, steps [][]string, env []string, usage *ResourceUsage) (int, error) {
+	fmt.Fprintf(output, "--- running in %s\n", image)
+
+	if err := de.ensureImage(ctx, image, output); err != nil {
+		if ctx.Err() != nil {
+			return -1, ctx.Err()
+		}
+		fmt.Fprintf(output, "%v\n", err)
+		return -1, nil
+	}
+
+	id, err := de.createContainer(ctx, build, image, workspace, steps, env, output)
+	if err != nil {
+		if ctx.Err() != nil {
+			return -1, ctx.Err()
+		}
+		return -1, err
+	}
+	defer func() {
+		de.removeContainer(id)
+		output.debugf("container %s removed", shortContainerID(id))
+	}()
+
+	if err := de.call(ctx, "POST", "/containers/"+id+"/start", nil, nil, nil); err != nil {
+		return -1, fmt.Errorf("starting container: %w", err)
+	}
+	started := time.Now()
+	output.debugf("container %s started", shortContainerID(id))
+
+	sampleCtx, stopSampling := context.WithCancel(ctx)
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		de.sampleUsage(sampleCtx, id, usage)
+	}()
+	defer func() {
+		// The stats stream ends with the container; give its last samples
+		// a moment to arrive
+		select {
+		case <-sampled:
+		case <-time.After(time.Second):
+		}
+		stopSampling()
+		<-sampled
+	}()
+
+	resp, err := de.do(ctx, "GET", "/containers/"+id+"/logs", url.Values{"follow": {"1"}, "stdout": {"1"}, "stderr": {"1"}}, nil)
+	if err != nil {
+		if ctx.Err() != nil {
+			return -1, ctx.Err()
+		}
+		return -1, fmt.Errorf("attaching to container logs: %w", err)
+	}
+	err = demuxDockerStream(output, resp.Body)
+	resp.Body.Close()
+	if ctx.Err() != nil {
+		return -1, ctx.Err()
+	}
+	if err != nil {
+		return -1, fmt.Errorf("reading container logs: %w", err)
+	}
+
+	var wait struct {
+		StatusCode int
+		Error      *struct{ Message string }
+	}
+	if err := de.call(ctx, "POST", "/containers/"+id+"/wait", nil, nil, &wait); err != nil {
+		if ctx.Err() != nil {
+			return -1, ctx.Err()
+		}
+		return -1, fmt.Errorf("waiting for container: %w", err)
+	}
+	if wait.Error != nil && wait.Error.Message != "" {
+		fmt.Fprintln(output, wait.Error.Message)
+	}
+	output.debugf("container %s exited with %d after %s", shortContainerID(id), wait.StatusCode, time.Since(started).Round(time.Millisecond))
+	return wait.StatusCode, nil
+}
+
+// createContainer creates the build container, with the workspace bind
+// mounted and the configured resource limits applied
+func (de *DockerExecutor) createContainer(ctx context.Context, build *BuildRequest, image, workspace string, steps [][]string, env []string, output *tailBuffer) (string, error) {
+	hostConfig := map[string]interface{}{
+		"Binds": []string{workspace + ":" + dockerWorkspace},
+	}
+	// The project's own limits take precedence over the executor's
+	nanoCPUs, memoryBytes := de.NanoCPUs, de.MemoryBytes
+	if build.CPULimit > 0 {
+		nanoCPUs = int64(build.CPULimit * 1e9)
+	}
+	if build.MemoryLimitMB > 0 {
+		memoryBytes = int64(build.MemoryLimitMB) << 20
+	}
+	if nanoCPUs > 0 {
+		hostConfig["NanoCpus"] = nanoCPUs
+	}
+	if memoryBytes > 0 {
+		hostConfig["Memory"] = memoryBytes
+		hostConfig["MemorySwap"] = memoryBytes
+	}
+	if de.PidsLimit > 0 {
+		hostConfig["PidsLimit"] = de.PidsLimit
+	}
+	if de.Network != "" {
+		hostConfig["NetworkMode"] = de.Network
+	}
+
+	config := map[string]interface{}{
+		"Image":      image,
+		"Cmd":        []string{"sh", "-c", dockerScript(steps)},
+		"WorkingDir": dockerWorkspace + "/src",
+		"Env":        append(containerEnv(de.Local.AllowedProtocols), env...),
+		// Run as the service's user so the workspace stays removable
+		"User": fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid()),
+		"Labels": map[string]string{
+			"build-service.build-id": strconv.Itoa(build.ID),
+			"build-service.project":  build.ProjectName,
+		},
+		"HostConfig": hostConfig,
+	}
+
+	var created struct {
+		ID       string `json:"Id"`
+		Warnings []string
+	}
+	if err := de.call(ctx, "POST", "/containers/create", nil, config, &created); err != nil {
+		return "", fmt.Errorf("creating container: %w", err)
+	}
+	for _, warning := range created.Warnings {
+		log.Printf("Docker warning for build %d: %s", build.ID, warning)
+		output.debugf("docker warning: %s", warning)
+	}
+	output.debugf("container %s created with nano CPUs %d, memory %d bytes, pids limit %d, network %q", shortContainerID(created.ID), nanoCPUs, memoryBytes, de.PidsLimit, de.Network)
+	return created.ID, nil
+}
+
+// dockerStats is the subset of a container stats sample we use
+type dockerStats struct {
+	CPUStats struct {
+		CPUUsage struct {
+			TotalUsage int64 `json:"total_usage"`
+		} `json:"cpu_usage"`
+	} `json:"cpu_stats"`
+	MemoryStats struct {
+		Usage int64            `json:"usage"`
+		Stats map[string]int64 `json:"stats"`
+	} `json:"memory_stats"`
+}
+
+// sampleUsage follows a container's stats until they end or ctx is done,
+// adding its CPU time and peak memory to usage. Memory excludes the
+// reclaimable page cache, as docker stats does.
+func (de *DockerExecutor) sampleUsage(ctx context.Context, id string, usage *ResourceUsage) {
+	resp, err := de.do(ctx, "GET", "/containers/"+id+"/stats", url.Values{"stream": {"1"}}, nil)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	var cpuNanos, peak int64
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var stats dockerStats
+		if err := decoder.Decode(&stats); err != nil {
+			break
+		}
+		cpuNanos = max(cpuNanos, stats.CPUStats.CPUUsage.TotalUsage)
+		memory := stats.MemoryStats.Usage
+		if cache, ok := stats.MemoryStats.Stats["inactive_file"]; ok && cache < memory {
+			memory -= cache
+		} else if cache, ok := stats.MemoryStats.Stats["total_inactive_file"]; ok && cache < memory {
+			memory -= cache
+		}
+		peak = max(peak, memory)
+	}
+
+	usage.CPUSeconds += float64(cpuNanos) / 1e9
+	usage.PeakMemoryBytes = max(usage.PeakMemoryBytes, peak)
+}
+
+// shortContainerID abbreviates a container ID as docker ps does
+func shortContainerID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+// removeContainer force-removes a container, killing it if still running
+func (de *DockerExecutor) removeContainer(id string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := de.call(ctx, "DELETE", "/containers/"+id, url.Values{"force": {"1"}}, nil, nil); err != nil {
+		log.Printf("Error removing container %s: %v", id, err)
+	}
+}
+
+// ensureImage pulls image unless the daemon already has it
+func (de *DockerExecutor) ensureImage(ctx context.Context, image string, output *tailBuffer) error {
+	var inspect struct {
+		ID string `json:"Id"`
+	}
+	err := de.call(ctx, "GET", "/images/"+image+"/json", nil, nil, &inspect)
+	if err == nil {
+		output.debugf("image %s present as %s", image, inspect.ID)
+		return nil
+	}
+	var apiErr *dockerAPIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("inspecting image %s: %w", image, err)
+	}
+
+	fmt.Fprintf(output, "--- pulling %s\n", image)
+	start := time.Now()
+	resp, err := de.do(ctx, "POST", "/images/create", url.Values{"fromImage": {image}}, nil)
+	if err != nil {
+		return fmt.Errorf("pulling image %s: %w", image, err)
+	}
+	defer resp.Body.Close()
+
+	// The pull reports progress, and failures, as a stream of JSON messages
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var message struct {
+			Error string `json:"error"`
+		}
+		if err := decoder.Decode(&message); err == io.EOF {
+			output.debugf("pulled %s in %s", image, time.Since(start).Round(time.Millisecond))
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("pulling image %s: %w", image, err)
+		}
+		if message.Error != "" {
+			return fmt.Errorf("pulling image %s: %s", image, message.Error)
+		}
+	}
+}
+
+// dockerAPIError is an error response from the Docker Engine API
+type dockerAPIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *dockerAPIError) Error() string {
+	return fmt.Sprintf("docker API returned %d: %s", e.StatusCode, e.Message)
+}
+
+// call makes a Docker API request with an optional JSON body, decoding the
+// JSON response into out when set
+func (de *DockerExecutor) call(ctx context.Context, method, path string, query url.Values, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		payload, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(payload)
+	}
+
+	resp, err := de.do(ctx, method, path, query, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// do sends a Docker API request, turning error statuses into a dockerAPIError
+func (de *DockerExecutor) do(ctx context.Context, method, path string, query url.Values, body io.Reader) (*http.Response, error) {
+	target := de.endpoint + "/" + dockerAPIVersion + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := de.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var apiErr struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&apiErr)
+		return nil, &dockerAPIError{StatusCode: resp.StatusCode, Message: apiErr.Message}
+	}
+	return resp, nil
+}
+
+// dockerScript joins the build steps into a shell script that echoes each
+// command before running it and stops at the first failure
+func dockerScript(steps [][]string) string {
+	var script strings.Builder
+	script.WriteString("set -e\n")
+	for _, step := range steps {
+		quoted := make([]string, len(step))
+		for i, arg := range step {
+			quoted[i] = shellQuote(arg)
+		}
+		fmt.Fprintf(&script, "echo %s\n%s\n", shellQuote("$ "+strings.Join(step, " ")), strings.Join(quoted, " "))
+	}
+	return script.String()
+}
+
+// shellQuote single-quotes s for sh
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// containerEnv is sandboxEnv for the container's mounted workspace. PATH is
+// left to the image.
+func containerEnv(allowedProtocols []string) []string {
+	var env []string
+	for _, kv := range sandboxEnv(dockerWorkspace, allowedProtocols) {
+		if !strings.HasPrefix(kv, "PATH=") {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
+// demuxDockerStream copies a multiplexed container log stream to w. Each
+// frame is an 8 byte header, holding the stream type and a big-endian
+// payload length, followed by the payload.
+func demuxDockerStream(w io.Writer, r io.Reader) error {
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		size := int64(binary.BigEndian.Uint32(header[4:]))
+		if _, err := io.CopyN(w, r, size); err != nil {
+			return err
+		}
+	}
+}
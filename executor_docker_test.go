@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// dockerFrame encodes payload as a multiplexed log stream frame
+func dockerFrame(stream byte, payload string) []byte {
+	header := make([]byte, 8)
+	header[0] = stream
+	binary.BigEndian.PutUint32(header[4:], uint32(len(payload)))
+	return append(header, payload...)
+}
+
+func TestDemuxDockerStream(t *testing.T) {
+	stream := append(dockerFrame(1, "hello\n"), dockerFrame(2, "oops\n")...)
+
+	var out bytes.Buffer
+	require.NoError(t, demuxDockerStream(&out, bytes.NewReader(stream)))
+	assert.Equal(t, "hello\noops\n", out.String())
+
+	assert.Error(t, demuxDockerStream(&out, bytes.NewReader(stream[:10])))
+}
+
+func TestDockerScript(t *testing.T) {
+	script := dockerScript([][]string{{"go", "build", "./..."}, {"echo", "it's"}})
+	assert.Equal(t, "set -e\necho '$ go build ./...'\n'go' 'build' './...'\necho '$ echo it'\\''s'\n'echo' 'it'\\''s'\n", script)
+
+	out, err := exec.Command("sh", "-c", dockerScript([][]string{{"echo", "it's"}, {"false"}, {"echo", "unreached"}})).CombinedOutput()
+	assert.Error(t, err)
+	assert.Equal(t, "$ echo it's\nit's\n$ false\n", string(out))
+}
+
+func TestDockerExecutorImage(t *testing.T) {
+	de := &DockerExecutor{}
+	assert.Equal(t, "golang:1.24", de.image(&BuildRequest{}, "go", ""))
+	assert.Equal(t, "custom:1", de.image(&BuildRequest{BuildImage: "custom:1"}, "go", ""))
+
+	de.DefaultImage = "ci:latest"
+	assert.Equal(t, "ci:latest", de.image(&BuildRequest{}, "npm", ""))
+	assert.Equal(t, "custom:1", de.image(&BuildRequest{BuildImage: "custom:1"}, "npm", ""))
+
+	assert.Equal(t, "alpine:3", de.image(&BuildRequest{}, "pipeline", "alpine:3"))
+	assert.Equal(t, "custom:1", de.image(&BuildRequest{BuildImage: "custom:1"}, "pipeline", "alpine:3"))
+	de.DefaultImage = ""
+	assert.Equal(t, "buildpack-deps:bookworm", de.image(&BuildRequest{}, "pipeline", ""))
+}
+
+func TestNewDockerExecutor(t *testing.T) {
+	for host, endpoint := range map[string]string{
+		"unix:///var/run/docker.sock": "http://docker",
+		"tcp://127.0.0.1:2375":        "http://127.0.0.1:2375",
+	} {
+		de, err := NewDockerExecutor(host, t.TempDir())
+		require.NoError(t, err, host)
+		assert.Equal(t, endpoint, de.endpoint, host)
+	}
+
+	_, err := NewDockerExecutor("ssh://docker", t.TempDir())
+	assert.Error(t, err)
+}
+
+func TestDockerExecutorExecute(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	repo := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(repo, "Makefile"), []byte("all:\n\t@echo ok\n"), 0o644))
+	for _, args := range [][]string{
+		{"init", "-q", "-b", "main"},
+		{"add", "Makefile"},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "init"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repo
+		require.NoError(t, cmd.Run())
+	}
+
+	var (
+		mu      sync.Mutex
+		calls   []string
+		created map[string]interface{}
+	)
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Stats are sampled alongside the logs, in no particular order
+		if r.URL.Path != "/"+dockerAPIVersion+"/containers/abc123/stats" {
+			mu.Lock()
+			calls = append(calls, r.Method+" "+strings.TrimPrefix(r.URL.Path, "/"+dockerAPIVersion))
+			mu.Unlock()
+		}
+
+		switch r.Method + " " + strings.TrimPrefix(r.URL.Path, "/"+dockerAPIVersion) {
+		case "GET /images/builder:1/json":
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message": "No such image: builder:1"}`))
+		case "POST /images/create":
+			assert.Equal(t, "builder:1", r.URL.Query().Get("fromImage"))
+			w.Write([]byte(`{"status": "Pulling"}` + "\n" + `{"status": "Done"}`))
+		case "POST /containers/create":
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&created))
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"Id": "abc123", "Warnings": []}`))
+		case "POST /containers/abc123/start":
+			w.WriteHeader(http.StatusNoContent)
+		case "GET /containers/abc123/logs":
+			w.Write(dockerFrame(1, "$ make\n"))
+			w.Write(dockerFrame(2, "make: *** failed\n"))
+		case "GET /containers/abc123/stats":
+			w.Write([]byte(`{"cpu_stats": {"cpu_usage": {"total_usage": 1000000000}}, "memory_stats": {"usage": 300000000, "stats": {"inactive_file": 100000000}}}` + "\n"))
+			w.Write([]byte(`{"cpu_stats": {"cpu_usage": {"total_usage": 2500000000}}, "memory_stats": {"usage": 150000000, "stats": {"inactive_file": 0}}}` + "\n"))
+		case "POST /containers/abc123/wait":
+			w.Write([]byte(`{"StatusCode": 2}`))
+		case "DELETE /containers/abc123":
+			assert.Equal(t, "1", r.URL.Query().Get("force"))
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			t.Errorf("unexpected docker API call %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer daemon.Close()
+
+	executor, err := NewDockerExecutor("tcp://"+strings.TrimPrefix(daemon.URL, "http://"), t.TempDir())
+	require.NoError(t, err)
+	executor.Local.AllowedProtocols = append(executor.Local.AllowedProtocols, "file")
+	executor.MemoryBytes = 512 << 20
+	executor.NanoCPUs = 1500000000
+
+	result, err := executor.Execute(context.Background(), &BuildRequest{
+		ID:          7,
+		ProjectName: "test-project",
+		GitURL:      "file://" + repo,
+		Branch:      "main",
+		BuildImage:  "builder:1",
+		// The project's memory limit replaces the executor's
+		MemoryLimitMB: 256,
+		DebugLogging:  true,
+		DebugNotes:    []string{"claimed by worker host-1"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "failed", result.Status)
+	assert.Equal(t, 2, result.ExitCode)
+	assert.Equal(t, "make", result.Tool)
+	assert.Equal(t, "builder:1", result.Image)
+	assert.Contains(t, string(result.Output), "make: *** failed")
+	for _, line := range []string{
+		"claimed by worker host-1",
+		"pulled builder:1 in",
+		"container abc123 created with nano CPUs 1500000000, memory 268435456 bytes",
+		"container abc123 started",
+		"container abc123 exited with 2 after",
+		"container abc123 removed",
+	} {
+		assert.Contains(t, string(result.Output), debugPrefix+line)
+	}
+	require.NotNil(t, result.Usage)
+	assert.InDelta(t, 2.5, result.Usage.CPUSeconds, 0.5)
+	assert.GreaterOrEqual(t, result.Usage.PeakMemoryBytes, int64(200000000))
+
+	assert.Equal(t, []string{
+		"GET /images/builder:1/json",
+		"POST /images/create",
+		"POST /containers/create",
+		"POST /containers/abc123/start",
+		"GET /containers/abc123/logs",
+		"POST /containers/abc123/wait",
+		"DELETE /containers/abc123",
+	}, calls)
+
+	assert.Equal(t, "builder:1", created["Image"])
+	assert.Equal(t, "/workspace/src", created["WorkingDir"])
+	hostConfig := created["HostConfig"].(map[string]interface{})
+	assert.Equal(t, float64(256<<20), hostConfig["Memory"])
+	assert.Equal(t, float64(1500000000), hostConfig["NanoCpus"])
+	binds := hostConfig["Binds"].([]interface{})
+	require.Len(t, binds, 1)
+	assert.True(t, strings.HasSuffix(binds[0].(string), ":/workspace"))
+}
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// configureProcessGroup is a no-op on platforms without process groups
+func configureProcessGroup(cmd *exec.Cmd) {}
+
+// processPeakMemory is not measured on platforms without rusage
+func processPeakMemory(state *os.ProcessState) int64 {
+	return 0
+}
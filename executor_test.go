@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetectBuildTool(t *testing.T) {
+	tests := []struct {
+		name         string
+		files        []string
+		expectedTool string
+	}{
+		{name: "go module", files: []string{"go.mod", "Makefile"}, expectedTool: "go"},
+		{name: "gradle wrapper", files: []string{"gradlew", "build.gradle"}, expectedTool: "gradle"},
+		{name: "gradle kotlin dsl", files: []string{"build.gradle.kts"}, expectedTool: "gradle"},
+		{name: "npm package", files: []string{"package.json"}, expectedTool: "npm"},
+		{name: "makefile", files: []string{"Makefile"}, expectedTool: "make"},
+		{name: "unknown", files: []string{"README.md"}, expectedTool: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, f := range tt.files {
+				require.NoError(t, os.WriteFile(filepath.Join(dir, f), nil, 0o644))
+			}
+
+			tool, steps := detectBuildTool(dir)
+			assert.Equal(t, tt.expectedTool, tool)
+			assert.Equal(t, tt.expectedTool != "", len(steps) > 0)
+		})
+	}
+}
+
+func TestLocalExecutorValidateSource(t *testing.T) {
+	executor := NewLocalExecutor(t.TempDir())
+
+	tests := []struct {
+		name    string
+		gitURL  string
+		branch  string
+		wantErr bool
+	}{
+		{name: "https url", gitURL: "https://github.com/test/repo.git", branch: "main"},
+		{name: "scp-style ssh url", gitURL: "git@github.com:test/repo.git", branch: "main"},
+		{name: "file url", gitURL: "file:///etc", branch: "main", wantErr: true},
+		{name: "ext transport", gitURL: "ext::sh -c touch% /tmp/pwned", branch: "main", wantErr: true},
+		{name: "local path", gitURL: "/var/lib/repo", branch: "main", wantErr: true},
+		{name: "option-like branch", gitURL: "https://github.com/test/repo.git", branch: "--upload-pack=evil", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := executor.validateSource(&BuildRequest{GitURL: tt.gitURL, Branch: tt.branch})
+			assert.Equal(t, tt.wantErr, err != nil)
+		})
+	}
+}
+
+func TestLocalExecutorExecute(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	if _, err := exec.LookPath("make"); err != nil {
+		t.Skip("make not installed")
+	}
+
+	tests := []struct {
+		name             string
+		makefile         string
+		expectedStatus   string
+		expectedExitCode int
+	}{
+		{name: "passing build", makefile: "all:\n\t@echo ok\n", expectedStatus: "success", expectedExitCode: 0},
+		{name: "failing build", makefile: "all:\n\t@exit 3\n", expectedStatus: "failed", expectedExitCode: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := t.TempDir()
+			require.NoError(t, os.WriteFile(filepath.Join(repo, "Makefile"), []byte(tt.makefile), 0o644))
+			for _, args := range [][]string{
+				{"init", "-q", "-b", "main"},
+				{"add", "Makefile"},
+				{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "init"},
+			} {
+				cmd := exec.Command("git", args...)
+				cmd.Dir = repo
+				require.NoError(t, cmd.Run())
+			}
+
+			executor := NewLocalExecutor(t.TempDir())
+			executor.AllowedProtocols = append(executor.AllowedProtocols, "file")
+			logs := NewLocalLogStore(t.TempDir())
+			executor.LogStore = logs
+
+			result, err := executor.Execute(context.Background(), &BuildRequest{
+				ID:          1,
+				ProjectName: "test-project",
+				GitURL:      "file://" + repo,
+				Branch:      "main",
+			})
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedStatus, result.Status)
+			assert.Equal(t, tt.expectedExitCode, result.ExitCode)
+			assert.Equal(t, "make", result.Tool)
+
+			require.Len(t, result.Stages, 2)
+			assert.Equal(t, "clone", result.Stages[0].Name)
+			assert.Equal(t, "success", result.Stages[0].Status)
+			assert.Contains(t, result.Stages[0].Log, "$ git clone")
+			assert.Equal(t, "build", result.Stages[1].Name)
+			assert.Equal(t, tt.expectedStatus, result.Stages[1].Status)
+			assert.Equal(t, tt.expectedExitCode, *result.Stages[1].ExitCode)
+			assert.Contains(t, result.Stages[1].Log, "$ make")
+			assert.NotContains(t, result.Stages[1].Log, "git clone")
+
+			// The stored log has every stage's output
+			size, err := logs.Size(context.Background(), buildLogKey(1))
+			require.NoError(t, err)
+			stored := readLog(t, logs, buildLogKey(1), 0, size)
+			assert.Contains(t, stored, "$ git clone")
+			assert.Contains(t, stored, "$ make")
+			assert.NotContains(t, stored, debugPrefix)
+		})
+	}
+}
+
+func TestLocalExecutorDebugLogging(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	executor := NewLocalExecutor(t.TempDir())
+	output := &tailBuffer{limit: maxOutputBytes, debug: true}
+	output.debugf("claimed by worker %s", "host-1")
+	exitCode, err := executor.run(context.Background(), t.TempDir(), t.TempDir(), output, []string{"git", "--version"})
+	require.NoError(t, err)
+	assert.Equal(t, 0, exitCode)
+
+	log := string(output.Bytes())
+	assert.Contains(t, log, debugPrefix+"claimed by worker host-1\n")
+	assert.Contains(t, log, "trace:", "git commands are traced")
+	assert.Contains(t, log, debugPrefix+"git exited with 0 after")
+
+	// Builds without debug logging get none of it
+	output = &tailBuffer{limit: maxOutputBytes}
+	output.debugf("claimed by worker %s", "host-1")
+	_, err = executor.run(context.Background(), t.TempDir(), t.TempDir(), output, []string{"git", "--version"})
+	require.NoError(t, err)
+	assert.NotContains(t, string(output.Bytes()), debugPrefix)
+	assert.NotContains(t, string(output.Bytes()), "trace:")
+}
+
+func TestTailBuffer(t *testing.T) {
+	tb := &tailBuffer{limit: 8}
+	tb.Write([]byte("hello "))
+	tb.Write([]byte("world"))
+	assert.Equal(t, "lo world", string(tb.Bytes()))
+
+	tb.Write([]byte("0123456789"))
+	assert.Equal(t, "23456789", string(tb.Bytes()))
+}
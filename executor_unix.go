@@ -0,0 +1,33 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+)
+
+// configureProcessGroup runs the command in its own process group so that
+// cancelling a build also kills any processes the build tool spawned
+func configureProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
+
+// processPeakMemory returns the peak resident memory of a finished process
+// and the descendants it waited for
+func processPeakMemory(state *os.ProcessState) int64 {
+	rusage, ok := state.SysUsage().(*syscall.Rusage)
+	if !ok {
+		return 0
+	}
+	// macOS reports bytes, the others kilobytes
+	if runtime.GOOS == "darwin" {
+		return int64(rusage.Maxrss)
+	}
+	return int64(rusage.Maxrss) << 10
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// FairShareLimit caps how many builds each user of an org runs at once while
+// builds of other users are waiting
+type FairShareLimit struct {
+	Org string `json:"org"`
+	// MaxRunningPerUser of 0 turns fair share off for the org
+	MaxRunningPerUser int       `json:"max_running_per_user"`
+	UpdatedAt         time.Time `json:"updated_at"`
+}
+
+// FairShareSettings are the default fair share and the limits of orgs that
+// override it
+type FairShareSettings struct {
+	DefaultMaxRunningPerUser int               `json:"default_max_running_per_user"`
+	Limits                   []*FairShareLimit `json:"limits"`
+}
+
+// UserQueueUsage is the share of the queue taken by one user of an org
+type UserQueueUsage struct {
+	Org        string `json:"org"`
+	User       string `json:"user"`
+	Queued     int    `json:"queued"`
+	Running    int    `json:"running"`
+	MaxRunning int    `json:"max_running"`
+	// OverShare is set while the user's queued builds yield to other users
+	OverShare bool `json:"over_share"`
+}
+
+// QueueUsageReport lists the users with queued or running builds
+type QueueUsageReport struct {
+	Org   string            `json:"org,omitempty"`
+	Users []*UserQueueUsage `json:"users"`
+}
+
+// buildOrg returns the org whose fair share builds requested by r count
+// against, or "" when the gateway named none
+func buildOrg(r *http.Request) string {
+	if strings.TrimSpace(r.Header.Get("X-Organization")) == "" {
+		return ""
+	}
+	return requestOrg(r)
+}
+
+// requestUser returns the user whose fair share builds requested by r count
+// against, as authenticated rather than as claimed by the request, so that
+// every caller has a share
+func requestUser(r *http.Request) string {
+	if identity := requestTenant(r).identity(); identity != "" {
+		return identity
+	}
+	return "caller:" + callerID(r)
+}
+
+// Queue endpoint. Shows each user's queued and running builds against their
+// fair share, for the org in ?org= or X-Organization, or for all orgs.
+// Requests scoped to an org only see the org's.
+func (bs *BuildService) queueHandler(w http.ResponseWriter, r *http.Request) {
+	org := listOrg(r)
+	if org == "" {
+		org = buildOrg(r)
+	}
+
+	users, err := bs.db.ListUserQueueUsage(org, bs.queue.fairShare)
+	if err != nil {
+		log.Printf("Error getting queue usage: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	for _, user := range users {
+		user.OverShare = user.User != "" && user.MaxRunning > 0 && user.Running >= user.MaxRunning
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(QueueUsageReport{Org: org, Users: users})
+}
+
+// List fair share limits endpoint
+func (bs *BuildService) listFairShareLimitsHandler(w http.ResponseWriter, r *http.Request) {
+	limits, err := bs.db.ListFairShareLimits()
+	if err != nil {
+		log.Printf("Error listing fair share limits: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(FairShareSettings{DefaultMaxRunningPerUser: bs.queue.fairShare, Limits: limits})
+}
+
+// Set fair share limit endpoint
+func (bs *BuildService) setFairShareLimitHandler(w http.ResponseWriter, r *http.Request) {
+	var limit FairShareLimit
+	if err := json.NewDecoder(r.Body).Decode(&limit); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if limit.MaxRunningPerUser < 0 {
+		http.Error(w, "max_running_per_user must not be negative", http.StatusBadRequest)
+		return
+	}
+	limit.Org = strings.ToLower(mux.Vars(r)["org"])
+
+	if err := bs.db.SetFairShareLimit(&limit); err != nil {
+		log.Printf("Error setting fair share limit: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Fair share of org %q set to %d running builds per user", limit.Org, limit.MaxRunningPerUser)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(limit)
+}
+
+// Delete fair share limit endpoint. The org falls back to FAIR_SHARE_MAX_RUNNING.
+func (bs *BuildService) deleteFairShareLimitHandler(w http.ResponseWriter, r *http.Request) {
+	if err := bs.db.DeleteFairShareLimit(strings.ToLower(mux.Vars(r)["org"])); err != nil {
+		if err.Error() == "fair share limit not found" {
+			http.Error(w, "Fair share limit not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error deleting fair share limit: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
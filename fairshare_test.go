@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueueHandler(t *testing.T) {
+	service, mockDB := setupTestService()
+	service.queue.fairShare = 2
+	mockDB.On("ListUserQueueUsage", "acme", 2).Return([]*UserQueueUsage{
+		{Org: "acme", User: "alice", Queued: 198, Running: 2, MaxRunning: 2},
+		{Org: "acme", User: "bob", Queued: 1, Running: 1, MaxRunning: 2},
+		{Org: "acme", User: "", Queued: 3, Running: 4, MaxRunning: 2},
+	}, nil).Once()
+
+	req := httptest.NewRequest("GET", "/api/v1/queue", nil)
+	req.Header.Set("X-Organization", "Acme")
+	rr := httptest.NewRecorder()
+	service.queueHandler(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Code)
+	var report QueueUsageReport
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &report))
+	assert.Equal(t, "acme", report.Org)
+	require.Len(t, report.Users, 3)
+	assert.True(t, report.Users[0].OverShare)
+	assert.False(t, report.Users[1].OverShare)
+	assert.False(t, report.Users[2].OverShare, "builds without a user are not subject to fair share")
+
+	mockDB.On("ListUserQueueUsage", "", 2).Return(nil, fmt.Errorf("connection refused")).Once()
+	rr = httptest.NewRecorder()
+	service.queueHandler(rr, httptest.NewRequest("GET", "/api/v1/queue", nil))
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+	mockDB.AssertExpectations(t)
+}
+
+func TestFairShareLimitHandlers(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.On("SetFairShareLimit", mock.MatchedBy(func(l *FairShareLimit) bool {
+		return l.Org == "acme" && l.MaxRunningPerUser == 3
+	})).Return(nil).Once()
+	mockDB.On("DeleteFairShareLimit", "acme").Return(nil).Once()
+	mockDB.On("DeleteFairShareLimit", "other").Return(fmt.Errorf("fair share limit not found")).Once()
+	mockDB.On("ListFairShareLimits").Return([]*FairShareLimit{{Org: "acme", MaxRunningPerUser: 3}}, nil).Once()
+
+	call := func(handler http.HandlerFunc, method, org, body string) *httptest.ResponseRecorder {
+		req := mux.SetURLVars(httptest.NewRequest(method, "/api/v1/admin/fair-share/"+org, bytes.NewBufferString(body)), map[string]string{"org": org})
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr
+	}
+
+	rr := call(service.setFairShareLimitHandler, "PUT", "Acme", `{"max_running_per_user": 3}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"org":"acme"`)
+	assert.Equal(t, http.StatusBadRequest, call(service.setFairShareLimitHandler, "PUT", "acme", `{"max_running_per_user": -1}`).Code)
+	assert.Equal(t, http.StatusBadRequest, call(service.setFairShareLimitHandler, "PUT", "acme", `{`).Code)
+
+	rr = httptest.NewRecorder()
+	service.listFairShareLimitsHandler(rr, httptest.NewRequest("GET", "/api/v1/admin/fair-share", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"default_max_running_per_user":0`)
+
+	assert.Equal(t, http.StatusNoContent, call(service.deleteFairShareLimitHandler, "DELETE", "acme", "").Code)
+	assert.Equal(t, http.StatusNotFound, call(service.deleteFairShareLimitHandler, "DELETE", "other", "").Code)
+	mockDB.AssertExpectations(t)
+}
+
+func TestCreateBuildRecordsOrg(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.On("GetProjectByName", "api").Return(nil, fmt.Errorf("project not found"))
+	mockDB.On("CreateBuild", mock.MatchedBy(func(b *BuildRequest) bool {
+		return b.Org == "acme" && b.TriggeredBy == "alice"
+	})).Return(1, nil).Once()
+
+	// The org comes from the gateway, not from the request body
+	req := httptest.NewRequest("POST", "/api/v1/builds", bytes.NewBufferString(`{"project_name":"api","git_url":"https://github.com/acme/api.git","triggered_by":"alice","org":"other"}`))
+	req.Header.Set("X-Organization", "acme")
+	req = req.WithContext(context.WithValue(req.Context(), tenantContextKey{}, Tenant{Org: "acme", User: "alice"}))
+	rr := httptest.NewRecorder()
+	service.createBuildHandler(rr, req)
+
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	mockDB.AssertExpectations(t)
+}
+
+func TestCreateBuildIgnoresClaimedUser(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.On("GetProjectByName", "api").Return(nil, fmt.Errorf("project not found"))
+	mockDB.On("CreateBuild", mock.MatchedBy(func(b *BuildRequest) bool {
+		return b.TriggeredBy == "api-key:7"
+	})).Return(1, nil).Once()
+
+	// An empty or made-up triggered_by must not escape the caller's share
+	req := httptest.NewRequest("POST", "/api/v1/builds", bytes.NewBufferString(`{"project_name":"api","git_url":"https://github.com/acme/api.git","triggered_by":""}`))
+	req = req.WithContext(context.WithValue(req.Context(), tenantContextKey{}, Tenant{Org: "acme", KeyID: 7}))
+	rr := httptest.NewRecorder()
+	service.createBuildHandler(rr, req)
+
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	mockDB.AssertExpectations(t)
+}
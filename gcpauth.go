@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gcpMetadataServiceAccountURL serves tokens and the identity of the
+// instance's service account, which on GKE with Workload Identity is the
+// Google service account bound to the pod's Kubernetes service account
+const gcpMetadataServiceAccountURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default"
+
+// GCPTokenSource fetches and caches OAuth access tokens from the metadata server
+type GCPTokenSource struct {
+	metadata string
+	client   *http.Client
+	now      func() time.Time
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// NewGCPTokenSource creates a token source backed by the metadata server
+func NewGCPTokenSource() *GCPTokenSource {
+	return &GCPTokenSource{
+		metadata: gcpMetadataServiceAccountURL,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		now:      time.Now,
+	}
+}
+
+// Token returns a valid access token, fetching a new one shortly before the
+// cached one expires
+func (ts *GCPTokenSource) Token(ctx context.Context) (string, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.token != "" && ts.now().Add(time.Minute).Before(ts.expires) {
+		return ts.token, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", ts.metadata+"/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	resp, err := ts.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("fetching access token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("fetching access token: status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("decoding access token: %w", err)
+	}
+
+	ts.token = result.AccessToken
+	ts.expires = ts.now().Add(time.Duration(result.ExpiresIn) * time.Second)
+	return ts.token, nil
+}
+
+// Email returns the email of the service account tokens are issued for
+func (ts *GCPTokenSource) Email(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", ts.metadata+"/email", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	resp, err := ts.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("fetching service account email: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetching service account email: status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// gcpIAMCredentialsEndpoint is the IAM Service Account Credentials API
+const gcpIAMCredentialsEndpoint = "https://iamcredentials.googleapis.com"
+
+// SignBlob signs payload with the Google-managed key of a service account
+// through the IAM credentials API, so signed URLs work with Workload Identity
+// where no private key is available. The caller's service account needs the
+// Service Account Token Creator role on the signing account.
+func (ts *GCPTokenSource) SignBlob(ctx context.Context, endpoint, email string, payload []byte) ([]byte, error) {
+	token, err := ts.Token(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := json.Marshal(map[string][]byte{"payload": payload})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/v1/projects/-/serviceAccounts/%s:signBlob", endpoint, email), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := ts.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("signing blob: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("signing blob: status %d: %s", resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+
+	var result struct {
+		SignedBlob string `json:"signedBlob"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("decoding signed blob: %w", err)
+	}
+	return base64.StdEncoding.DecodeString(result.SignedBlob)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGCPTokenSource(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 0, 0, 0, time.UTC)
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		assert.Equal(t, "Google", r.Header.Get("Metadata-Flavor"))
+		fmt.Fprintf(w, `{"access_token": "token-%d", "expires_in": 3600, "token_type": "Bearer"}`, calls)
+	}))
+	defer server.Close()
+
+	tokens := NewGCPTokenSource()
+	tokens.metadata = server.URL
+	tokens.now = func() time.Time { return now }
+
+	token, err := tokens.Token(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "token-1", token)
+
+	now = now.Add(30 * time.Minute)
+	token, _ = tokens.Token(context.Background())
+	assert.Equal(t, "token-1", token)
+
+	now = now.Add(30 * time.Minute)
+	token, _ = tokens.Token(context.Background())
+	assert.Equal(t, "token-2", token)
+}
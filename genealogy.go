@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// GenealogyNode is a build in a family tree together with the builds derived
+// from it
+type GenealogyNode struct {
+	Build *BuildRequest `json:"build"`
+	// Relation is how the build derives from its parent, empty for the root
+	Relation string           `json:"relation,omitempty"`
+	Children []*GenealogyNode `json:"children"`
+}
+
+// BuildGenealogy is the family tree of builds a build belongs to
+type BuildGenealogy struct {
+	BuildID int            `json:"build_id"`
+	Size    int            `json:"size"`
+	Root    *GenealogyNode `json:"root"`
+}
+
+// buildParent returns the build a build was derived from and how, or nil for
+// an original build
+func buildParent(build *BuildRequest) (*int, string) {
+	if build.RetriedFrom != nil {
+		return build.RetriedFrom, "retry"
+	}
+	return nil, ""
+}
+
+// buildGenealogy arranges a build family, oldest first, into a tree rooted at
+// its original build
+func buildGenealogy(id int, builds []*BuildRequest) *BuildGenealogy {
+	nodes := make(map[int]*GenealogyNode, len(builds))
+	for _, build := range builds {
+		nodes[build.ID] = &GenealogyNode{Build: build, Children: []*GenealogyNode{}}
+	}
+
+	genealogy := &BuildGenealogy{BuildID: id, Size: len(builds)}
+	for _, build := range builds {
+		node := nodes[build.ID]
+		parentID, relation := buildParent(build)
+		if parentID == nil || nodes[*parentID] == nil {
+			if genealogy.Root == nil {
+				genealogy.Root = node
+			}
+			continue
+		}
+		node.Relation = relation
+		nodes[*parentID].Children = append(nodes[*parentID].Children, node)
+	}
+	return genealogy
+}
+
+// Build genealogy endpoint. Returns the build's whole family tree in one
+// response: the original build and every build derived from it.
+func (bs *BuildService) buildGenealogyHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid build ID", http.StatusBadRequest)
+		return
+	}
+
+	builds, err := bs.db.ListBuildFamily(id)
+	if err != nil {
+		if err.Error() == "build not found" {
+			http.Error(w, "Build not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error getting build family: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(buildGenealogy(id, builds))
+}
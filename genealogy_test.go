@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildGenealogyHandler(t *testing.T) {
+	service, mockDB := setupTestService()
+	one, three := 1, 3
+	mockDB.On("ListBuildFamily", 3).Return([]*BuildRequest{
+		{ID: 1, ProjectName: "api", Status: "failed"},
+		{ID: 3, ProjectName: "api", Status: "failed", RetriedFrom: &one},
+		{ID: 4, ProjectName: "api", Status: "success", RetriedFrom: &three},
+		{ID: 5, ProjectName: "api", Status: "queued", RetriedFrom: &one},
+	}, nil)
+	mockDB.On("ListBuildFamily", 9).Return(nil, assert.AnError)
+	mockDB.On("ListBuildFamily", 10).Return(nil, fmt.Errorf("build not found"))
+
+	get := func(id string) *httptest.ResponseRecorder {
+		req := mux.SetURLVars(httptest.NewRequest("GET", "/api/v1/builds/"+id+"/genealogy", nil), map[string]string{"id": id})
+		rr := httptest.NewRecorder()
+		service.buildGenealogyHandler(rr, req)
+		return rr
+	}
+
+	rr := get("3")
+	require.Equal(t, http.StatusOK, rr.Code)
+	var genealogy BuildGenealogy
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &genealogy))
+	assert.Equal(t, 3, genealogy.BuildID)
+	assert.Equal(t, 4, genealogy.Size)
+	assert.Equal(t, 1, genealogy.Root.Build.ID)
+	assert.Empty(t, genealogy.Root.Relation)
+	require.Len(t, genealogy.Root.Children, 2)
+	assert.Equal(t, 3, genealogy.Root.Children[0].Build.ID)
+	assert.Equal(t, "retry", genealogy.Root.Children[0].Relation)
+	require.Len(t, genealogy.Root.Children[0].Children, 1)
+	assert.Equal(t, 4, genealogy.Root.Children[0].Children[0].Build.ID)
+	assert.Equal(t, 5, genealogy.Root.Children[1].Build.ID)
+
+	assert.Equal(t, http.StatusNotFound, get("10").Code)
+	assert.Equal(t, http.StatusInternalServerError, get("9").Code)
+	assert.Equal(t, http.StatusBadRequest, get("x").Code)
+}
@@ -0,0 +1,825 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// This file implements the subset of GraphQL the API needs: queries and
+// subscriptions with variables, aliases, arguments, fragments and
+// __typename, executed against resolvers. Mutations, directives, interfaces
+// and introspection queries are not supported; the schema is published as
+// SDL instead.
+
+// maxGraphQLDepth bounds how deeply selections may nest
+const maxGraphQLDepth = 8
+
+// gqlOperation is a parsed query or subscription
+type gqlOperation struct {
+	Kind       string
+	Name       string
+	Variables  map[string]gqlVariableDefinition
+	Selections []*gqlSelection
+}
+
+type gqlVariableDefinition struct {
+	Type    string
+	Default interface{}
+}
+
+// gqlSelection is a field, or a fragment spread when Fragment is set
+type gqlSelection struct {
+	Alias      string
+	Name       string
+	Args       map[string]interface{}
+	Selections []*gqlSelection
+	Fragment   string
+}
+
+// ResponseKey is the name a field appears under in the result
+func (s *gqlSelection) ResponseKey() string {
+	if s.Alias != "" {
+		return s.Alias
+	}
+	return s.Name
+}
+
+// gqlVariable is a $variable reference in an argument value
+type gqlVariable string
+
+// gqlDocument is a parsed request: its operations and fragments
+type gqlDocument struct {
+	Operations []*gqlOperation
+	Fragments  map[string][]*gqlSelection
+}
+
+// Operation selects the operation to run, by name when the document has
+// more than one
+func (d *gqlDocument) Operation(name string) (*gqlOperation, error) {
+	if name == "" {
+		if len(d.Operations) != 1 {
+			return nil, fmt.Errorf("operationName is required for documents with %d operations", len(d.Operations))
+		}
+		return d.Operations[0], nil
+	}
+	for _, op := range d.Operations {
+		if op.Name == name {
+			return op, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown operation %q", name)
+}
+
+// gqlToken is a lexical token: punctuation, a name, or a literal
+type gqlToken struct {
+	kind  byte // 'p' punctuation, 'n' name, 's' string, 'i' int, 'f' float, 0 end
+	value string
+	pos   int
+}
+
+func lexGraphQL(src string) ([]gqlToken, error) {
+	var tokens []gqlToken
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			i++
+		case c == '#':
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(src[i:], "..."):
+			tokens = append(tokens, gqlToken{'p', "...", i})
+			i += 3
+		case strings.ContainsRune("{}()[]:=!$@", rune(c)):
+			tokens = append(tokens, gqlToken{'p', string(c), i})
+			i++
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			start := i
+			for i < len(src) && (src[i] == '_' || src[i] >= 'a' && src[i] <= 'z' || src[i] >= 'A' && src[i] <= 'Z' || src[i] >= '0' && src[i] <= '9') {
+				i++
+			}
+			tokens = append(tokens, gqlToken{'n', src[start:i], start})
+		case c == '-' || c >= '0' && c <= '9':
+			start := i
+			i++
+			kind := byte('i')
+			for i < len(src) && (src[i] >= '0' && src[i] <= '9' || strings.IndexByte(".eE+-", src[i]) >= 0) {
+				if strings.IndexByte(".eE", src[i]) >= 0 {
+					kind = 'f'
+				}
+				i++
+			}
+			tokens = append(tokens, gqlToken{kind, src[start:i], start})
+		case c == '"':
+			start := i
+			if strings.HasPrefix(src[i:], `"""`) {
+				end := strings.Index(src[i+3:], `"""`)
+				if end < 0 {
+					return nil, fmt.Errorf("unterminated block string at %d", start)
+				}
+				tokens = append(tokens, gqlToken{'s', strings.TrimSpace(src[i+3 : i+3+end]), start})
+				i += end + 6
+				continue
+			}
+			i++
+			for i < len(src) && src[i] != '"' && src[i] != '\n' {
+				if src[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			if i >= len(src) || src[i] != '"' {
+				return nil, fmt.Errorf("unterminated string at %d", start)
+			}
+			value, err := strconv.Unquote(src[start : i+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string at %d", start)
+			}
+			tokens = append(tokens, gqlToken{'s', value, start})
+			i++
+		default:
+			return nil, fmt.Errorf("unexpected character %q at %d", c, i)
+		}
+	}
+	return append(tokens, gqlToken{pos: len(src)}), nil
+}
+
+// gqlParser is a recursive descent parser over the tokens of a document
+type gqlParser struct {
+	tokens []gqlToken
+	pos    int
+}
+
+// parseGraphQL parses a request document
+func parseGraphQL(src string) (*gqlDocument, error) {
+	tokens, err := lexGraphQL(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &gqlParser{tokens: tokens}
+	doc := &gqlDocument{Fragments: map[string][]*gqlSelection{}}
+
+	for p.peek().kind != 0 {
+		switch {
+		case p.peekPunct("{"):
+			selections, err := p.selectionSet(0)
+			if err != nil {
+				return nil, err
+			}
+			doc.Operations = append(doc.Operations, &gqlOperation{Kind: "query", Selections: selections})
+		case p.peekName("fragment"):
+			p.next()
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.typeCondition(); err != nil {
+				return nil, err
+			}
+			selections, err := p.selectionSet(0)
+			if err != nil {
+				return nil, err
+			}
+			doc.Fragments[name] = selections
+		case p.peekName("query") || p.peekName("mutation") || p.peekName("subscription"):
+			op, err := p.operation()
+			if err != nil {
+				return nil, err
+			}
+			doc.Operations = append(doc.Operations, op)
+		default:
+			return nil, p.unexpected()
+		}
+	}
+	if len(doc.Operations) == 0 {
+		return nil, fmt.Errorf("document has no operations")
+	}
+	return doc, nil
+}
+
+func (p *gqlParser) peek() gqlToken { return p.tokens[p.pos] }
+
+func (p *gqlParser) next() gqlToken {
+	t := p.tokens[p.pos]
+	if t.kind != 0 {
+		p.pos++
+	}
+	return t
+}
+
+func (p *gqlParser) peekPunct(value string) bool {
+	t := p.peek()
+	return t.kind == 'p' && t.value == value
+}
+
+func (p *gqlParser) peekName(value string) bool {
+	t := p.peek()
+	return t.kind == 'n' && t.value == value
+}
+
+func (p *gqlParser) unexpected() error {
+	t := p.peek()
+	if t.kind == 0 {
+		return fmt.Errorf("unexpected end of document")
+	}
+	return fmt.Errorf("unexpected %q at %d", t.value, t.pos)
+}
+
+func (p *gqlParser) expect(punct string) error {
+	if !p.peekPunct(punct) {
+		return p.unexpected()
+	}
+	p.next()
+	return nil
+}
+
+func (p *gqlParser) name() (string, error) {
+	if p.peek().kind != 'n' {
+		return "", p.unexpected()
+	}
+	return p.next().value, nil
+}
+
+// typeCondition parses "on Type"; with a single type per field there is
+// nothing to check it against
+func (p *gqlParser) typeCondition() error {
+	if !p.peekName("on") {
+		return p.unexpected()
+	}
+	p.next()
+	_, err := p.name()
+	return err
+}
+
+func (p *gqlParser) operation() (*gqlOperation, error) {
+	op := &gqlOperation{Kind: p.next().value, Variables: map[string]gqlVariableDefinition{}}
+	if p.peek().kind == 'n' {
+		op.Name = p.next().value
+	}
+
+	if p.peekPunct("(") {
+		p.next()
+		for !p.peekPunct(")") {
+			if err := p.expect("$"); err != nil {
+				return nil, err
+			}
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			typ, err := p.typeRef()
+			if err != nil {
+				return nil, err
+			}
+			def := gqlVariableDefinition{Type: typ}
+			if p.peekPunct("=") {
+				p.next()
+				if def.Default, err = p.value(true); err != nil {
+					return nil, err
+				}
+			}
+			op.Variables[name] = def
+		}
+		p.next()
+	}
+
+	var err error
+	op.Selections, err = p.selectionSet(0)
+	return op, err
+}
+
+// typeRef parses a variable's type, such as Int! or [String]
+func (p *gqlParser) typeRef() (string, error) {
+	var typ string
+	if p.peekPunct("[") {
+		p.next()
+		inner, err := p.typeRef()
+		if err != nil {
+			return "", err
+		}
+		if err := p.expect("]"); err != nil {
+			return "", err
+		}
+		typ = "[" + inner + "]"
+	} else {
+		name, err := p.name()
+		if err != nil {
+			return "", err
+		}
+		typ = name
+	}
+	if p.peekPunct("!") {
+		p.next()
+		typ += "!"
+	}
+	return typ, nil
+}
+
+func (p *gqlParser) selectionSet(depth int) ([]*gqlSelection, error) {
+	if depth > maxGraphQLDepth {
+		return nil, fmt.Errorf("selections are nested more than %d deep", maxGraphQLDepth)
+	}
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+
+	var selections []*gqlSelection
+	for !p.peekPunct("}") {
+		if p.peekPunct("@") {
+			return nil, fmt.Errorf("directives are not supported")
+		}
+		if p.peekPunct("...") {
+			p.next()
+			if p.peekName("on") || p.peekPunct("{") {
+				// Inline fragment: its fields belong to the enclosing selection
+				if p.peekName("on") {
+					if err := p.typeCondition(); err != nil {
+						return nil, err
+					}
+				}
+				inline, err := p.selectionSet(depth)
+				if err != nil {
+					return nil, err
+				}
+				selections = append(selections, inline...)
+				continue
+			}
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			selections = append(selections, &gqlSelection{Fragment: name})
+			continue
+		}
+
+		field, err := p.field(depth)
+		if err != nil {
+			return nil, err
+		}
+		selections = append(selections, field)
+	}
+	p.next()
+	if len(selections) == 0 {
+		return nil, fmt.Errorf("empty selection set")
+	}
+	return selections, nil
+}
+
+func (p *gqlParser) field(depth int) (*gqlSelection, error) {
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	field := &gqlSelection{Name: name}
+	if p.peekPunct(":") {
+		p.next()
+		field.Alias = name
+		if field.Name, err = p.name(); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.peekPunct("(") {
+		p.next()
+		field.Args = map[string]interface{}{}
+		for !p.peekPunct(")") {
+			arg, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			if field.Args[arg], err = p.value(false); err != nil {
+				return nil, err
+			}
+		}
+		p.next()
+	}
+
+	if p.peekPunct("{") {
+		if field.Selections, err = p.selectionSet(depth + 1); err != nil {
+			return nil, err
+		}
+	}
+	return field, nil
+}
+
+// value parses an argument value; constant values can't use variables
+func (p *gqlParser) value(constant bool) (interface{}, error) {
+	t := p.next()
+	switch t.kind {
+	case 's':
+		return t.value, nil
+	case 'i':
+		n, err := strconv.Atoi(t.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid integer %s", t.value)
+		}
+		return n, nil
+	case 'f':
+		f, err := strconv.ParseFloat(t.value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %s", t.value)
+		}
+		return f, nil
+	case 'n':
+		switch t.value {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+		// Enum values are passed as strings
+		return t.value, nil
+	case 'p':
+		switch t.value {
+		case "$":
+			if constant {
+				return nil, fmt.Errorf("variables can't be used in default values")
+			}
+			name, err := p.name()
+			return gqlVariable(name), err
+		case "[":
+			list := []interface{}{}
+			for !p.peekPunct("]") {
+				item, err := p.value(constant)
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, item)
+			}
+			p.next()
+			return list, nil
+		case "{":
+			object := map[string]interface{}{}
+			for !p.peekPunct("}") {
+				key, err := p.name()
+				if err != nil {
+					return nil, err
+				}
+				if err := p.expect(":"); err != nil {
+					return nil, err
+				}
+				if object[key], err = p.value(constant); err != nil {
+					return nil, err
+				}
+			}
+			p.next()
+			return object, nil
+		}
+	}
+	if t.kind != 0 {
+		p.pos--
+	}
+	return nil, p.unexpected()
+}
+
+// gqlResolver resolves a field of source
+type gqlResolver func(ctx context.Context, source interface{}, args map[string]interface{}) (interface{}, error)
+
+// gqlField defines a field of an object type. Type is in SDL notation, such
+// as [Build!]!; fields of object types are resolved further with the
+// selections made on them.
+type gqlField struct {
+	Type        string
+	Args        map[string]string
+	Description string
+	Resolve     gqlResolver
+}
+
+// gqlObject is an object type of the schema
+type gqlObject struct {
+	Name   string
+	Fields map[string]*gqlField
+}
+
+// gqlSchema holds the object types, keyed by name
+type gqlSchema struct {
+	Types map[string]*gqlObject
+}
+
+// namedType strips list and non-null markers from an SDL type
+func namedType(typ string) string {
+	return strings.Trim(typ, "[]!")
+}
+
+// gqlError is an error in the response, with the path of the field it
+// occurred at
+type gqlError struct {
+	Message string        `json:"message"`
+	Path    []interface{} `json:"path,omitempty"`
+}
+
+// gqlResult is an object in the response. Fields keep the order they were
+// selected in.
+type gqlResult struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func (r *gqlResult) set(key string, value interface{}) {
+	if _, ok := r.values[key]; !ok {
+		r.keys = append(r.keys, key)
+	}
+	r.values[key] = value
+}
+
+func (r *gqlResult) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range r.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, _ := json.Marshal(key)
+		buf.Write(name)
+		buf.WriteByte(':')
+		value, err := json.Marshal(r.values[key])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// gqlExecution runs one operation against the schema
+type gqlExecution struct {
+	schema    *gqlSchema
+	fragments map[string][]*gqlSelection
+	variables map[string]interface{}
+	errors    []gqlError
+}
+
+// newGraphQLExecution checks the variables of an operation, applying
+// defaults and requiring non-null ones
+func newGraphQLExecution(schema *gqlSchema, doc *gqlDocument, op *gqlOperation, variables map[string]interface{}) (*gqlExecution, error) {
+	values := map[string]interface{}{}
+	for name, def := range op.Variables {
+		value, ok := variables[name]
+		if !ok || value == nil {
+			value = def.Default
+		}
+		if value == nil && strings.HasSuffix(def.Type, "!") {
+			return nil, fmt.Errorf("variable $%s of type %s is required", name, def.Type)
+		}
+		values[name] = value
+	}
+	return &gqlExecution{schema: schema, fragments: doc.Fragments, variables: values}, nil
+}
+
+// execute resolves selections on an object of the given type
+func (e *gqlExecution) execute(ctx context.Context, object *gqlObject, source interface{}, selections []*gqlSelection, path []interface{}) *gqlResult {
+	result := &gqlResult{values: map[string]interface{}{}}
+	for _, selection := range e.expand(selections, 0) {
+		key := selection.ResponseKey()
+		fieldPath := append(append([]interface{}{}, path...), key)
+		if selection.Name == "__typename" {
+			result.set(key, object.Name)
+			continue
+		}
+
+		field, ok := object.Fields[selection.Name]
+		if !ok {
+			e.fail(fieldPath, fmt.Errorf("cannot query field %q on type %s", selection.Name, object.Name))
+			result.set(key, nil)
+			continue
+		}
+		args, err := e.arguments(selection, field)
+		if err != nil {
+			e.fail(fieldPath, err)
+			result.set(key, nil)
+			continue
+		}
+		value, err := field.Resolve(ctx, source, args)
+		if err != nil {
+			e.fail(fieldPath, err)
+			result.set(key, nil)
+			continue
+		}
+		result.set(key, e.complete(ctx, field.Type, value, selection, fieldPath))
+	}
+	return result
+}
+
+// expand replaces fragment spreads with the fields of the fragments
+func (e *gqlExecution) expand(selections []*gqlSelection, depth int) []*gqlSelection {
+	var fields []*gqlSelection
+	for _, selection := range selections {
+		if selection.Fragment == "" {
+			fields = append(fields, selection)
+			continue
+		}
+		fragment, ok := e.fragments[selection.Fragment]
+		if !ok || depth > maxGraphQLDepth {
+			e.fail(nil, fmt.Errorf("unknown fragment %q", selection.Fragment))
+			continue
+		}
+		fields = append(fields, e.expand(fragment, depth+1)...)
+	}
+	return fields
+}
+
+// complete turns a resolved value into its response: leaves as they are,
+// objects by resolving the selections made on them
+func (e *gqlExecution) complete(ctx context.Context, typ string, value interface{}, selection *gqlSelection, path []interface{}) interface{} {
+	object, isObject := e.schema.Types[namedType(typ)]
+	switch {
+	case isObject && selection.Selections == nil:
+		e.fail(path, fmt.Errorf("field %q of type %s must have a selection of subfields", selection.Name, typ))
+		return nil
+	case !isObject && selection.Selections != nil:
+		e.fail(path, fmt.Errorf("field %q of type %s can't have a selection of subfields", selection.Name, typ))
+		return nil
+	}
+
+	v := reflect.ValueOf(value)
+	if !v.IsValid() || (v.Kind() == reflect.Ptr || v.Kind() == reflect.Slice || v.Kind() == reflect.Map) && v.IsNil() {
+		return nil
+	}
+	if !isObject {
+		return value
+	}
+	if strings.HasPrefix(typ, "[") {
+		list := make([]interface{}, v.Len())
+		for i := range list {
+			list[i] = e.execute(ctx, object, v.Index(i).Interface(), selection.Selections, append(append([]interface{}{}, path...), i))
+		}
+		return list
+	}
+	return e.execute(ctx, object, value, selection.Selections, path)
+}
+
+// arguments resolves a field's arguments, substituting variables and
+// checking them against the field's definition
+func (e *gqlExecution) arguments(selection *gqlSelection, field *gqlField) (map[string]interface{}, error) {
+	args := map[string]interface{}{}
+	for name, raw := range selection.Args {
+		typ, ok := field.Args[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown argument %q on field %q", name, selection.Name)
+		}
+		value := raw
+		if variable, isVariable := raw.(gqlVariable); isVariable {
+			value = e.variables[string(variable)]
+		}
+		coerced, err := coerceGraphQLValue(typ, value)
+		if err != nil {
+			return nil, fmt.Errorf("argument %q: %w", name, err)
+		}
+		if coerced != nil {
+			args[name] = coerced
+		}
+	}
+	for name, typ := range field.Args {
+		if _, ok := args[name]; !ok && strings.HasSuffix(typ, "!") {
+			return nil, fmt.Errorf("argument %q of type %s is required", name, typ)
+		}
+	}
+	return args, nil
+}
+
+// coerceGraphQLValue checks a scalar argument against its type. Variables
+// arrive decoded from JSON, so integers may be float64.
+func coerceGraphQLValue(typ string, value interface{}) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	switch namedType(typ) {
+	case "Int":
+		switch n := value.(type) {
+		case int:
+			return n, nil
+		case float64:
+			if n == float64(int(n)) {
+				return int(n), nil
+			}
+		}
+		return nil, fmt.Errorf("expected Int, got %v", value)
+	case "String":
+		if s, ok := value.(string); ok {
+			return s, nil
+		}
+		return nil, fmt.Errorf("expected String, got %v", value)
+	case "Boolean":
+		if b, ok := value.(bool); ok {
+			return b, nil
+		}
+		return nil, fmt.Errorf("expected Boolean, got %v", value)
+	}
+	return value, nil
+}
+
+func (e *gqlExecution) fail(path []interface{}, err error) {
+	e.errors = append(e.errors, gqlError{Message: err.Error(), Path: path})
+}
+
+// jsonFields adds a field for every JSON encoded field of a struct, named
+// as in the REST API and resolved by reading the struct field
+func jsonFields(object *gqlObject, sample interface{}) {
+	t := reflect.TypeOf(sample)
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("json")
+		name, options, _ := strings.Cut(tag, ",")
+		if name == "" || name == "-" || !sf.IsExported() {
+			continue
+		}
+		index := i
+		object.Fields[name] = &gqlField{
+			Type: sdlType(sf.Type, strings.Contains(options, "omitempty")),
+			Resolve: func(ctx context.Context, source interface{}, args map[string]interface{}) (interface{}, error) {
+				v := reflect.ValueOf(source)
+				if v.Kind() == reflect.Ptr {
+					v = v.Elem()
+				}
+				return v.Field(index).Interface(), nil
+			},
+		}
+	}
+}
+
+// sdlType describes a Go type in SDL. Pointers and omitted empty values are
+// nullable.
+func sdlType(t reflect.Type, omitempty bool) string {
+	nullable := omitempty
+	if t.Kind() == reflect.Ptr {
+		t, nullable = t.Elem(), true
+	}
+
+	var typ string
+	switch {
+	case t == timeType:
+		typ = "String"
+	case t.Kind() == reflect.Slice:
+		typ = "[" + sdlType(t.Elem(), false) + "]"
+	case t.Kind() == reflect.Map:
+		typ = "JSON"
+	case t.Kind() == reflect.Bool:
+		typ = "Boolean"
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		typ = "Int"
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		typ = "Float"
+	default:
+		typ = "String"
+	}
+	if !nullable {
+		typ += "!"
+	}
+	return typ
+}
+
+// SDL renders the schema in the GraphQL schema definition language
+func (s *gqlSchema) SDL() string {
+	var names []string
+	for name := range s.Types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sdl strings.Builder
+	sdl.WriteString("scalar JSON\n")
+	for _, name := range names {
+		object := s.Types[name]
+		var fields []string
+		for field := range object.Fields {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+
+		fmt.Fprintf(&sdl, "\ntype %s {\n", name)
+		for _, fieldName := range fields {
+			field := object.Fields[fieldName]
+			if field.Description != "" {
+				fmt.Fprintf(&sdl, "  \"%s\"\n", field.Description)
+			}
+			fmt.Fprintf(&sdl, "  %s", fieldName)
+			if len(field.Args) > 0 {
+				var args []string
+				for arg, typ := range field.Args {
+					args = append(args, arg+": "+typ)
+				}
+				sort.Strings(args)
+				fmt.Fprintf(&sdl, "(%s)", strings.Join(args, ", "))
+			}
+			fmt.Fprintf(&sdl, ": %s\n", field.Type)
+		}
+		sdl.WriteString("}\n")
+	}
+	return sdl.String()
+}
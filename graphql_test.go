@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testBook struct {
+	Title  string  `json:"title"`
+	Pages  int     `json:"pages"`
+	Author *string `json:"author,omitempty"`
+	secret string
+}
+
+func testLibrarySchema() *gqlSchema {
+	book := &gqlObject{Name: "Book", Fields: map[string]*gqlField{}}
+	jsonFields(book, testBook{})
+	author := "Ada"
+	books := []*testBook{{Title: "Go", Pages: 300, Author: &author}, {Title: "SQL", Pages: 120}}
+
+	query := &gqlObject{Name: "Query", Fields: map[string]*gqlField{
+		"books": {
+			Type: "[Book!]!",
+			Args: map[string]string{"limit": "Int"},
+			Resolve: func(ctx context.Context, source interface{}, args map[string]interface{}) (interface{}, error) {
+				if limit, ok := args["limit"].(int); ok && limit < len(books) {
+					return books[:limit], nil
+				}
+				return books, nil
+			},
+		},
+		"book": {
+			Type: "Book",
+			Args: map[string]string{"title": "String!"},
+			Resolve: func(ctx context.Context, source interface{}, args map[string]interface{}) (interface{}, error) {
+				for _, b := range books {
+					if b.Title == args["title"] {
+						return b, nil
+					}
+				}
+				return (*testBook)(nil), nil
+			},
+		},
+	}}
+	return &gqlSchema{Types: map[string]*gqlObject{"Query": query, "Book": book}}
+}
+
+func runTestQuery(t *testing.T, query string, variables map[string]interface{}) (string, []gqlError) {
+	t.Helper()
+	doc, err := parseGraphQL(query)
+	require.NoError(t, err)
+	op, err := doc.Operation("")
+	require.NoError(t, err)
+
+	schema := testLibrarySchema()
+	exec, err := newGraphQLExecution(schema, doc, op, variables)
+	require.NoError(t, err)
+	data, err := json.Marshal(exec.execute(context.Background(), schema.Types["Query"], nil, op.Selections, nil))
+	require.NoError(t, err)
+	return string(data), exec.errors
+}
+
+func TestGraphQLExecute(t *testing.T) {
+	data, errs := runTestQuery(t, `
+		# Fields come back in the order they were selected
+		query Library($n: Int = 1) {
+			first: books(limit: $n) { pages title __typename }
+			all: books { ...bookFields }
+			missing: book(title: "Rust") { title }
+		}
+		fragment bookFields on Book { title author }`, nil)
+	assert.Empty(t, errs)
+	assert.Equal(t, `{"first":[{"pages":300,"title":"Go","__typename":"Book"}],`+
+		`"all":[{"title":"Go","author":"Ada"},{"title":"SQL","author":null}],"missing":null}`, data)
+
+	data, errs = runTestQuery(t, `query ($title: String!) { book(title: $title) { ... on Book { pages } } }`,
+		map[string]interface{}{"title": "SQL"})
+	assert.Empty(t, errs)
+	assert.Equal(t, `{"book":{"pages":120}}`, data)
+}
+
+func TestGraphQLFieldErrors(t *testing.T) {
+	data, errs := runTestQuery(t, `{ books(limit: "two") { title } book { title } shelf short: books(limit: 1) { secret } }`, nil)
+	assert.Equal(t, `{"books":null,"book":null,"shelf":null,"short":[{"secret":null}]}`, data)
+	require.Len(t, errs, 4)
+	assert.Equal(t, `argument "limit": expected Int, got two`, errs[0].Message)
+	assert.Equal(t, []interface{}{"books"}, errs[0].Path)
+	assert.Equal(t, `argument "title" of type String! is required`, errs[1].Message)
+	assert.Equal(t, `cannot query field "shelf" on type Query`, errs[2].Message)
+	assert.Equal(t, `cannot query field "secret" on type Book`, errs[3].Message)
+	assert.Equal(t, []interface{}{"short", 0, "secret"}, errs[3].Path)
+
+	_, errs = runTestQuery(t, `{ books }`, nil)
+	require.Len(t, errs, 1)
+	assert.Contains(t, errs[0].Message, "must have a selection of subfields")
+}
+
+func TestGraphQLVariables(t *testing.T) {
+	doc, err := parseGraphQL(`query ($limit: Int!) { books(limit: $limit) { title } }`)
+	require.NoError(t, err)
+	_, err = newGraphQLExecution(testLibrarySchema(), doc, doc.Operations[0], nil)
+	assert.EqualError(t, err, "variable $limit of type Int! is required")
+
+	// Variables decoded from JSON are float64
+	data, errs := runTestQuery(t, `query ($limit: Int!) { books(limit: $limit) { title } }`, map[string]interface{}{"limit": float64(1)})
+	assert.Empty(t, errs)
+	assert.Equal(t, `{"books":[{"title":"Go"}]}`, data)
+}
+
+func TestParseGraphQLErrors(t *testing.T) {
+	for query, message := range map[string]string{
+		``:                             "document has no operations",
+		`{ books { title }`:            "unexpected end of document",
+		`{ books(limit: [1, 2 }`:       `unexpected "}" at 21`,
+		`{ books @include(if: true) }`: "directives are not supported",
+		`{ title: "x" }`:               `unexpected "x" at 9`,
+		`{ }`:                          "empty selection set",
+		`{ a { b { c { d { e { f { g { h { i { j } } } } } } } } } }`: "selections are nested more than 8 deep",
+	} {
+		_, err := parseGraphQL(query)
+		assert.EqualError(t, err, message, query)
+	}
+
+	doc, err := parseGraphQL(`query A { books { title } } query B { books { pages } }`)
+	require.NoError(t, err)
+	_, err = doc.Operation("")
+	assert.Error(t, err)
+	op, err := doc.Operation("B")
+	require.NoError(t, err)
+	assert.Equal(t, "pages", op.Selections[0].Selections[0].Name)
+}
+
+func TestGraphQLSchemaSDL(t *testing.T) {
+	sdl := testLibrarySchema().SDL()
+	assert.Contains(t, sdl, "type Book {\n  author: String\n  pages: Int!\n  title: String!\n}\n")
+	assert.Contains(t, sdl, "  book(title: String!): Book\n  books(limit: Int): [Book!]!\n")
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxGraphQLLimit bounds the limit argument of list fields
+const maxGraphQLLimit = 100
+
+// graphQLRequest is a GraphQL request, POSTed as JSON or sent as query
+// parameters
+type graphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// graphQLResponse is the result of an operation
+type graphQLResponse struct {
+	Data   interface{} `json:"data,omitempty"`
+	Errors []gqlError  `json:"errors,omitempty"`
+}
+
+// errGraphQLInternal hides database errors from clients; they're logged
+// instead
+var errGraphQLInternal = fmt.Errorf("internal server error")
+
+// graphQLSchema defines the GraphQL types over the REST API's resources.
+// Fields have the names of the REST API's JSON fields, and relations between
+// resources are resolved with the same database queries the REST handlers
+// use.
+func (bs *BuildService) graphQLSchema() *gqlSchema {
+	project := &gqlObject{Name: "Project", Fields: map[string]*gqlField{}}
+	build := &gqlObject{Name: "Build", Fields: map[string]*gqlField{}}
+	stage := &gqlObject{Name: "Stage", Fields: map[string]*gqlField{}}
+	problem := &gqlObject{Name: "Problem", Fields: map[string]*gqlField{}}
+	deployment := &gqlObject{Name: "Deployment", Fields: map[string]*gqlField{}}
+	jsonFields(project, Project{})
+	jsonFields(build, BuildRequest{})
+	jsonFields(stage, BuildStage{})
+	jsonFields(problem, BuildProblem{})
+	jsonFields(deployment, Deployment{})
+
+	project.Fields["builds"] = &gqlField{
+		Type:        "[Build!]!",
+		Args:        map[string]string{"status": "String", "limit": "Int"},
+		Description: "Newest builds of the project, 20 unless limited",
+		Resolve: func(ctx context.Context, source interface{}, args map[string]interface{}) (interface{}, error) {
+			return bs.graphQLBuilds(ctx, source.(*Project).Name, args)
+		},
+	}
+	project.Fields["deployments"] = &gqlField{
+		Type:        "[Deployment!]!",
+		Args:        map[string]string{"environment": "String", "limit": "Int"},
+		Description: "Newest deployments of the project, 20 unless limited",
+		Resolve: func(ctx context.Context, source interface{}, args map[string]interface{}) (interface{}, error) {
+			return bs.graphQLDeployments(ctx, source.(*Project).Name, args)
+		},
+	}
+
+	build.Fields["project"] = &gqlField{
+		Type:        "Project",
+		Description: "Registered project of the build, null for unregistered projects",
+		Resolve: func(ctx context.Context, source interface{}, args map[string]interface{}) (interface{}, error) {
+			return bs.graphQLProjectByName(ctx, source.(*BuildRequest).ProjectName)
+		},
+	}
+	build.Fields["stages"] = &gqlField{
+		Type:        "[Stage!]!",
+		Description: "Stages of the build in the order they ran",
+		Resolve: func(ctx context.Context, source interface{}, args map[string]interface{}) (interface{}, error) {
+			stages, err := bs.db.ListBuildStages(source.(*BuildRequest).ID)
+			return stages, graphQLError("listing build stages", err)
+		},
+	}
+	build.Fields["problems"] = &gqlField{
+		Type:        "[Problem!]!",
+		Description: "Errors and warnings found in the build's stage logs",
+		Resolve: func(ctx context.Context, source interface{}, args map[string]interface{}) (interface{}, error) {
+			problems, err := bs.db.ListBuildProblems(source.(*BuildRequest).ID)
+			return problems, graphQLError("listing build problems", err)
+		},
+	}
+
+	deployment.Fields["build"] = &gqlField{
+		Type:        "Build",
+		Description: "Build that was deployed",
+		Resolve: func(ctx context.Context, source interface{}, args map[string]interface{}) (interface{}, error) {
+			return bs.graphQLBuild(ctx, source.(*Deployment).BuildID)
+		},
+	}
+
+	query := &gqlObject{Name: "Query", Fields: map[string]*gqlField{
+		"project": {
+			Type:        "Project",
+			Args:        map[string]string{"id": "Int", "name": "String"},
+			Description: "Project by id or name",
+			Resolve: func(ctx context.Context, source interface{}, args map[string]interface{}) (interface{}, error) {
+				if id, ok := args["id"].(int); ok {
+					project, err := bs.db.GetProject(id)
+					if err != nil && err.Error() == "project not found" || err == nil && !tenantFromContext(ctx).Sees(project.Org) {
+						return nil, nil
+					}
+					return project, graphQLError("getting project", err)
+				}
+				if name, ok := args["name"].(string); ok {
+					return bs.graphQLProjectByName(ctx, name)
+				}
+				return nil, fmt.Errorf("id or name is required")
+			},
+		},
+		"projects": {
+			Type: "[Project!]!",
+			Resolve: func(ctx context.Context, source interface{}, args map[string]interface{}) (interface{}, error) {
+				projects, err := bs.db.ListProjects(tenantFromContext(ctx).Org, nil)
+				return projects, graphQLError("listing projects", err)
+			},
+		},
+		"build": {
+			Type: "Build",
+			Args: map[string]string{"id": "Int!"},
+			Resolve: func(ctx context.Context, source interface{}, args map[string]interface{}) (interface{}, error) {
+				return bs.graphQLBuild(ctx, args["id"].(int))
+			},
+		},
+		"builds": {
+			Type:        "[Build!]!",
+			Args:        map[string]string{"project": "String", "status": "String", "limit": "Int"},
+			Description: "Newest builds, 20 unless limited",
+			Resolve: func(ctx context.Context, source interface{}, args map[string]interface{}) (interface{}, error) {
+				project, _ := args["project"].(string)
+				return bs.graphQLBuilds(ctx, project, args)
+			},
+		},
+		"deployments": {
+			Type:        "[Deployment!]!",
+			Args:        map[string]string{"project": "String", "environment": "String", "limit": "Int"},
+			Description: "Newest deployments, 20 unless limited",
+			Resolve: func(ctx context.Context, source interface{}, args map[string]interface{}) (interface{}, error) {
+				project, _ := args["project"].(string)
+				return bs.graphQLDeployments(ctx, project, args)
+			},
+		},
+	}}
+
+	subscription := &gqlObject{Name: "Subscription", Fields: map[string]*gqlField{
+		"build_status": {
+			Type:        "Build",
+			Args:        map[string]string{"project": "String", "id": "Int"},
+			Description: "Builds as their status changes, of one project or build when given",
+			Resolve: func(ctx context.Context, source interface{}, args map[string]interface{}) (interface{}, error) {
+				event := source.(*BuildEvent)
+				if !tenantFromContext(ctx).Sees(event.Build.Org) {
+					return nil, nil
+				}
+				if project, ok := args["project"].(string); ok && event.Build.ProjectName != project {
+					return nil, nil
+				}
+				if id, ok := args["id"].(int); ok && event.Build.ID != id {
+					return nil, nil
+				}
+				return &event.Build, nil
+			},
+		},
+	}}
+
+	schema := &gqlSchema{Types: map[string]*gqlObject{}}
+	for _, object := range []*gqlObject{query, subscription, project, build, stage, problem, deployment} {
+		schema.Types[object.Name] = object
+	}
+	return schema
+}
+
+// graphQLError logs a database error and replaces it with a generic one
+func graphQLError(action string, err error) error {
+	if err == nil {
+		return nil
+	}
+	log.Printf("Error %s for GraphQL: %v", action, err)
+	return errGraphQLInternal
+}
+
+// graphQLLimit returns the limit argument, 20 when it isn't given
+func graphQLLimit(args map[string]interface{}) (int, error) {
+	limit, ok := args["limit"].(int)
+	if !ok {
+		return 20, nil
+	}
+	if limit < 1 || limit > maxGraphQLLimit {
+		return 0, fmt.Errorf("limit must be between 1 and %d", maxGraphQLLimit)
+	}
+	return limit, nil
+}
+
+func (bs *BuildService) graphQLBuild(ctx context.Context, id int) (*BuildRequest, error) {
+	build, err := bs.db.GetBuild(id)
+	if err != nil && err.Error() == "build not found" || err == nil && !tenantFromContext(ctx).Sees(build.Org) {
+		return nil, nil
+	}
+	return build, graphQLError("getting build", err)
+}
+
+func (bs *BuildService) graphQLProjectByName(ctx context.Context, name string) (*Project, error) {
+	project, err := bs.db.GetProjectByName(name)
+	if err != nil && err.Error() == "project not found" || err == nil && !tenantFromContext(ctx).Sees(project.Org) {
+		return nil, nil
+	}
+	return project, graphQLError("getting project", err)
+}
+
+func (bs *BuildService) graphQLBuilds(ctx context.Context, project string, args map[string]interface{}) ([]*BuildRequest, error) {
+	limit, err := graphQLLimit(args)
+	if err != nil {
+		return nil, err
+	}
+	status, _ := args["status"].(string)
+	builds, err := bs.db.ListRecentBuilds(project, status, tenantFromContext(ctx).Org, limit)
+	return builds, graphQLError("listing builds", err)
+}
+
+func (bs *BuildService) graphQLDeployments(ctx context.Context, project string, args map[string]interface{}) ([]*Deployment, error) {
+	limit, err := graphQLLimit(args)
+	if err != nil {
+		return nil, err
+	}
+	environment, _ := args["environment"].(string)
+	deployments, err := bs.db.ListDeployments(project, strings.ToLower(environment), tenantFromContext(ctx).Org)
+	if err != nil {
+		return nil, graphQLError("listing deployments", err)
+	}
+	if len(deployments) > limit {
+		deployments = deployments[:limit]
+	}
+	return deployments, nil
+}
+
+// writeGraphQLErrors writes a request that can't be executed at all
+func writeGraphQLErrors(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(graphQLResponse{Errors: []gqlError{{Message: err.Error()}}})
+}
+
+// GraphQL endpoint. Queries are POSTed as JSON or sent as query, variables
+// and operationName parameters; subscriptions stream a result per build event
+// as server-sent events.
+func (bs *BuildService) graphQLHandler(w http.ResponseWriter, r *http.Request) {
+	var req graphQLRequest
+	if r.Method == http.MethodGet {
+		query := r.URL.Query()
+		req.Query = query.Get("query")
+		req.OperationName = query.Get("operationName")
+		if variables := query.Get("variables"); variables != "" {
+			if err := json.Unmarshal([]byte(variables), &req.Variables); err != nil {
+				writeGraphQLErrors(w, http.StatusBadRequest, fmt.Errorf("invalid variables: %v", err))
+				return
+			}
+		}
+	} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeGraphQLErrors(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %v", err))
+		return
+	}
+
+	doc, err := parseGraphQL(req.Query)
+	if err != nil {
+		writeGraphQLErrors(w, http.StatusBadRequest, err)
+		return
+	}
+	op, err := doc.Operation(req.OperationName)
+	if err != nil {
+		writeGraphQLErrors(w, http.StatusBadRequest, err)
+		return
+	}
+	schema := bs.graphQLSchema()
+	exec, err := newGraphQLExecution(schema, doc, op, req.Variables)
+	if err != nil {
+		writeGraphQLErrors(w, http.StatusBadRequest, err)
+		return
+	}
+
+	switch op.Kind {
+	case "query":
+		data := exec.execute(r.Context(), schema.Types["Query"], nil, op.Selections, nil)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(graphQLResponse{Data: data, Errors: exec.errors})
+	case "subscription":
+		if len(op.Selections) != 1 || op.Selections[0].Fragment != "" {
+			writeGraphQLErrors(w, http.StatusBadRequest, fmt.Errorf("subscriptions must select exactly one field"))
+			return
+		}
+		bs.graphQLSubscription(w, r, schema, exec, op.Selections)
+	default:
+		writeGraphQLErrors(w, http.StatusBadRequest, fmt.Errorf("%s operations are not supported; use the REST API", op.Kind))
+	}
+}
+
+// graphQLSubscription executes a subscription against each build event,
+// streaming the results as "next" server-sent events. Events the
+// subscription's field resolves to null for are skipped.
+func (bs *BuildService) graphQLSubscription(w http.ResponseWriter, r *http.Request, schema *gqlSchema, exec *gqlExecution, selections []*gqlSelection) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	// Streams outlive the server's write timeout
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		log.Printf("Error clearing write deadline for GraphQL subscription: %v", err)
+	}
+
+	events, unsubscribe := bs.events.Subscribe(64)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "retry: 5000\n\n")
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	key := selections[0].ResponseKey()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-bs.streamsDone:
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case event := <-events:
+			exec.errors = nil
+			data := exec.execute(r.Context(), schema.Types["Subscription"], &event, selections, nil)
+			if data.values[key] == nil && len(exec.errors) == 0 {
+				continue
+			}
+
+			body, err := json.Marshal(graphQLResponse{Data: data, Errors: exec.errors})
+			if err != nil {
+				log.Printf("Error encoding GraphQL subscription result: %v", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: next\ndata: %s\n\n", body)
+			flusher.Flush()
+		}
+	}
+}
+
+// GraphQL schema endpoint
+func (bs *BuildService) graphQLSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, bs.graphQLSchema().SDL())
+}
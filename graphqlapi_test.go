@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func postGraphQL(service *BuildService, body string) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	service.graphQLHandler(rr, httptest.NewRequest("POST", "/api/v1/graphql", bytes.NewBufferString(body)))
+	return rr
+}
+
+func TestGraphQLNestedQuery(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.On("GetProjectByName", "api").Return(&Project{ID: 1, Name: "api", DefaultBranch: "main"}, nil)
+	mockDB.On("ListRecentBuilds", "api", "failed", "", 2).Return([]*BuildRequest{
+		{ID: 7, ProjectName: "api", Status: "failed"},
+		{ID: 5, ProjectName: "api", Status: "failed"},
+	}, nil)
+	mockDB.On("ListBuildStages", 7).Return([]*BuildStage{{Name: "build", Status: "success"}, {Name: "test", Status: "failed"}}, nil)
+	mockDB.On("ListBuildStages", 5).Return([]*BuildStage{}, nil)
+
+	rr := postGraphQL(service, `{
+		"query": "query Failures($project: String!) { project(name: $project) { name recent: builds(status: \"failed\", limit: 2) { id stages { name status } } } }",
+		"variables": {"project": "api"}
+	}`)
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"data": {"project": {"name": "api", "recent": [
+		{"id": 7, "stages": [{"name": "build", "status": "success"}, {"name": "test", "status": "failed"}]},
+		{"id": 5, "stages": []}
+	]}}}`, rr.Body.String())
+	mockDB.AssertExpectations(t)
+}
+
+func TestGraphQLQueryErrors(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.On("GetBuild", 1).Return(nil, fmt.Errorf("connection refused"))
+	mockDB.On("GetBuild", 2).Return(nil, fmt.Errorf("build not found"))
+
+	// Database errors are hidden; missing resources are null
+	rr := postGraphQL(service, `{"query": "{ a: build(id: 1) { id } b: build(id: 2) { id } builds(limit: 500) { id } }"}`)
+	require.Equal(t, http.StatusOK, rr.Code)
+	var resp struct {
+		Data   map[string]interface{} `json:"data"`
+		Errors []gqlError             `json:"errors"`
+	}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+	assert.Equal(t, map[string]interface{}{"a": nil, "b": nil, "builds": nil}, resp.Data)
+	require.Len(t, resp.Errors, 2)
+	assert.Equal(t, "internal server error", resp.Errors[0].Message)
+	assert.Equal(t, "limit must be between 1 and 100", resp.Errors[1].Message)
+
+	for body, message := range map[string]string{
+		`not json`:                                      "invalid request body",
+		`{"query": "{ build(id: 1) { id }"}`:            "unexpected end of document",
+		`{"query": "mutation { build(id: 1) { id } }"}`: "mutation operations are not supported",
+		`{"query": "subscription { a: build_status { id } b: build_status { id } }"}`: "exactly one field",
+	} {
+		rr := postGraphQL(service, body)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, body)
+		assert.Contains(t, rr.Body.String(), message, body)
+	}
+}
+
+func TestGraphQLGetQuery(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.On("ListDeployments", "api", "production", "").Return([]*Deployment{
+		{ID: 3, BuildID: 9, Environment: "production"},
+		{ID: 2, BuildID: 8, Environment: "production"},
+	}, nil)
+	mockDB.On("GetBuild", 9).Return(&BuildRequest{ID: 9, CommitSHA: "abc1234"}, nil)
+
+	query := url.Values{
+		"query":     {`query ($env: String) { deployments(project: "api", environment: $env, limit: 1) { id build { commit_sha } } }`},
+		"variables": {`{"env": "Production"}`},
+	}
+	rr := httptest.NewRecorder()
+	service.graphQLHandler(rr, httptest.NewRequest("GET", "/api/v1/graphql?"+query.Encode(), nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"data": {"deployments": [{"id": 3, "build": {"commit_sha": "abc1234"}}]}}`, rr.Body.String())
+}
+
+func TestGraphQLSubscription(t *testing.T) {
+	service, _ := setupTestService()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/graphql", service.graphQLHandler)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	body := `{"query": "subscription { build: build_status(project: \"api\") { id status } }"}`
+	resp, err := http.Post(server.URL+"/api/v1/graphql", "application/json", strings.NewReader(body))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	// Wait for the subscription before publishing
+	reader := bufio.NewReader(resp.Body)
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "retry: 5000\n", line)
+	_, err = reader.ReadString('\n')
+	require.NoError(t, err)
+
+	service.events.Publish(&BuildRequest{ID: 1, ProjectName: "web", Status: "queued"})
+	service.events.Publish(&BuildRequest{ID: 2, ProjectName: "api", Status: "running"})
+
+	line, err = reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "event: next\n", line)
+	line, err = reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, `data: {"data":{"build":{"id":2,"status":"running"}}}`+"\n", line)
+}
+
+func TestGraphQLSchemaHandler(t *testing.T) {
+	service, _ := setupTestService()
+	rr := httptest.NewRecorder()
+	service.graphQLSchemaHandler(rr, httptest.NewRequest("GET", "/api/v1/graphql/schema", nil))
+
+	require.Equal(t, http.StatusOK, rr.Code)
+	sdl := rr.Body.String()
+	assert.Contains(t, sdl, "type Query {")
+	assert.Contains(t, sdl, "  builds(limit: Int, status: String): [Build!]!\n")
+	assert.Contains(t, sdl, "  build_status(id: Int, project: String): Build\n")
+	assert.Contains(t, sdl, "  stages: [Stage!]!\n")
+	assert.Contains(t, sdl, "  project_name: String!\n")
+}
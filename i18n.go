@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed locales/*.json
+var localeFiles embed.FS
+
+// defaultLocale is the language messages are written in
+const defaultLocale = "en"
+
+// localeContextKey is the context key of the request's negotiated locale
+type localeContextKey struct{}
+
+// Catalog translates user-facing messages. Each locale maps the English
+// messages, or the IDs of longer texts such as notification templates, to
+// their translation. Messages without a translation are shown in English.
+type Catalog struct {
+	fallback string
+	messages map[string]map[string]string
+}
+
+// NewCatalogFromEnv loads the built-in catalogs from locales/ and then the
+// <locale>.json files in I18N_CATALOG_DIR, whose messages replace or extend
+// the built-in ones. DEFAULT_LOCALE is used for requests without an
+// Accept-Language the catalog can serve.
+func NewCatalogFromEnv() (*Catalog, error) {
+	catalog := &Catalog{
+		fallback: normalizeLocale(os.Getenv("DEFAULT_LOCALE")),
+		messages: map[string]map[string]string{defaultLocale: {}},
+	}
+	if catalog.fallback == "" {
+		catalog.fallback = defaultLocale
+	}
+
+	if err := catalog.load(localeFiles, "locales"); err != nil {
+		return nil, err
+	}
+	if dir := os.Getenv("I18N_CATALOG_DIR"); dir != "" {
+		if err := catalog.load(os.DirFS(dir), "."); err != nil {
+			return nil, fmt.Errorf("loading I18N_CATALOG_DIR: %w", err)
+		}
+	}
+
+	if _, ok := catalog.messages[catalog.fallback]; !ok {
+		return nil, fmt.Errorf("DEFAULT_LOCALE %q has no catalog", catalog.fallback)
+	}
+	return catalog, nil
+}
+
+// load merges the <locale>.json files of a directory into the catalog
+func (c *Catalog) load(fsys fs.FS, dir string) error {
+	files, err := fs.Glob(fsys, path.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		data, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return err
+		}
+		var messages map[string]string
+		if err := json.Unmarshal(data, &messages); err != nil {
+			return fmt.Errorf("parsing %s: %w", file, err)
+		}
+
+		locale := normalizeLocale(strings.TrimSuffix(path.Base(file), ".json"))
+		if c.messages[locale] == nil {
+			c.messages[locale] = make(map[string]string)
+		}
+		for message, translation := range messages {
+			c.messages[locale][message] = translation
+		}
+	}
+	return nil
+}
+
+// normalizeLocale lowercases a language tag and separates its parts with
+// dashes, e.g. "pt_BR" becomes "pt-br"
+func normalizeLocale(tag string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(tag), "_", "-"))
+}
+
+// Locales returns the locales the catalog has messages for, sorted
+func (c *Catalog) Locales() []string {
+	locales := make([]string, 0, len(c.messages))
+	for locale := range c.messages {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+// Negotiate picks the locale for an Accept-Language header: the acceptable
+// language with the highest quality the catalog has, matching "de-CH" to
+// "de" when there's no catalog for the region, or the default locale
+func (c *Catalog) Negotiate(acceptLanguage string) string {
+	if c == nil {
+		return defaultLocale
+	}
+	best, bestQuality := c.fallback, 0.0
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		quality := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			q, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			quality = q
+		}
+		if quality <= bestQuality {
+			continue
+		}
+
+		tag = normalizeLocale(tag)
+		if base, _, ok := strings.Cut(tag, "-"); ok && c.messages[tag] == nil {
+			tag = base
+		}
+		if c.messages[tag] != nil {
+			best, bestQuality = tag, quality
+		}
+	}
+	return best
+}
+
+// Translate returns a message in the locale, or as given when the locale
+// has no translation for it. A nil catalog leaves every message in English.
+func (c *Catalog) Translate(locale, message string) string {
+	if c == nil {
+		return message
+	}
+	if translation, ok := c.messages[locale][message]; ok && translation != "" {
+		return translation
+	}
+	return message
+}
+
+// Text returns the translation of a longer text by its ID, or the English
+// text when the locale has none
+func (c *Catalog) Text(locale, id, english string) string {
+	if translation := c.Translate(locale, id); translation != id {
+		return translation
+	}
+	return english
+}
+
+// Sprintf formats the translation of a format string
+func (c *Catalog) Sprintf(locale, format string, args ...interface{}) string {
+	return fmt.Sprintf(c.Translate(locale, format), args...)
+}
+
+// requestLocale returns the locale negotiated for a request by the
+// catalog's middleware
+func requestLocale(r *http.Request) string {
+	if locale, ok := r.Context().Value(localeContextKey{}).(string); ok {
+		return locale
+	}
+	return defaultLocale
+}
+
+// Middleware negotiates each request's locale from Accept-Language, making
+// it available to handlers, and translates the plain text error messages
+// written with http.Error
+func (c *Catalog) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		locale := c.Negotiate(r.Header.Get("Accept-Language"))
+		w.Header().Add("Vary", "Accept-Language")
+		w.Header().Set("Content-Language", locale)
+		r = r.WithContext(context.WithValue(r.Context(), localeContextKey{}, locale))
+
+		if locale == defaultLocale {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(&localizingWriter{ResponseWriter: w, translate: func(message string) string {
+			return c.Translate(locale, message)
+		}}, r)
+	})
+}
+
+// localizingWriter translates the bodies of error responses written by
+// http.Error, which are a single line of plain text
+type localizingWriter struct {
+	http.ResponseWriter
+	translate func(string) string
+	errorBody bool
+}
+
+func (lw *localizingWriter) WriteHeader(status int) {
+	header := lw.Header()
+	lw.errorBody = status >= http.StatusBadRequest &&
+		header.Get("X-Content-Type-Options") == "nosniff" &&
+		strings.HasPrefix(header.Get("Content-Type"), "text/plain")
+	lw.ResponseWriter.WriteHeader(status)
+}
+
+func (lw *localizingWriter) Write(p []byte) (int, error) {
+	if !lw.errorBody {
+		return lw.ResponseWriter.Write(p)
+	}
+	message := strings.TrimSuffix(string(p), "\n")
+	if _, err := lw.ResponseWriter.Write([]byte(lw.translate(message) + "\n")); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush lets streaming handlers flush through the wrapper
+func (lw *localizingWriter) Flush() {
+	if f, ok := lw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (lw *localizingWriter) Unwrap() http.ResponseWriter {
+	return lw.ResponseWriter
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCatalogNegotiate(t *testing.T) {
+	t.Setenv("DEFAULT_LOCALE", "")
+	t.Setenv("I18N_CATALOG_DIR", "")
+	catalog, err := NewCatalogFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"de", "en", "es", "fr"}, catalog.Locales())
+
+	for header, want := range map[string]string{
+		"":                              "en",
+		"de":                            "de",
+		"de-CH, fr;q=0.8":               "de",
+		"ja, fr;q=0.5, en;q=0.4":        "fr",
+		"en-US,en;q=0.9,de;q=0.8":       "en",
+		"es;q=0.2, FR;q=0.9":            "fr",
+		"ja, *;q=0.1":                   "en",
+		"de;q=bogus, es":                "es",
+		"pt_BR":                         "en",
+		"de;q=0.5, de-AT;q=0.6, fr;q=0": "de",
+	} {
+		assert.Equal(t, want, catalog.Negotiate(header), header)
+	}
+
+	assert.Equal(t, "Build nicht gefunden", catalog.Translate("de", "Build not found"))
+	assert.Equal(t, "Something new", catalog.Translate("de", "Something new"), "untranslated messages stay in English")
+	assert.Equal(t, "Seit 2026-01-02", catalog.Sprintf("de", "Since %s", "2026-01-02"))
+
+	var none *Catalog
+	assert.Equal(t, "en", none.Negotiate("de"))
+	assert.Equal(t, "Build not found", none.Translate("de", "Build not found"))
+}
+
+func TestCatalogFromEnvLoadsCatalogDir(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "de.json"), []byte(`{"Build not found": "Kein Build"}`), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "pt_BR.json"), []byte(`{"Build not found": "Build não encontrado"}`), 0o600))
+	t.Setenv("I18N_CATALOG_DIR", dir)
+	t.Setenv("DEFAULT_LOCALE", "pt-BR")
+
+	catalog, err := NewCatalogFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, "Kein Build", catalog.Translate("de", "Build not found"))
+	assert.Equal(t, "Projekt nicht gefunden", catalog.Translate("de", "Project not found"), "built-in messages are kept")
+	assert.Equal(t, "pt-br", catalog.Negotiate(""))
+	assert.Equal(t, "pt-br", catalog.Negotiate("pt-BR"))
+
+	t.Setenv("DEFAULT_LOCALE", "ja")
+	_, err = NewCatalogFromEnv()
+	assert.Error(t, err, "the default locale needs a catalog")
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "it.json"), []byte(`{"Build not found"`), 0o600))
+	t.Setenv("DEFAULT_LOCALE", "")
+	_, err = NewCatalogFromEnv()
+	assert.Error(t, err)
+}
+
+func TestCatalogMiddlewareTranslatesErrors(t *testing.T) {
+	service, _ := setupTestService()
+	handler := service.catalog.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.Error(w, "Build not found", http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(requestLocale(r)))
+	}))
+
+	request := func(path, acceptLanguage string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Accept-Language", acceptLanguage)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := request("/missing", "fr-CA, en;q=0.5")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	assert.Equal(t, "Build introuvable\n", rr.Body.String())
+	assert.Equal(t, "fr", rr.Header().Get("Content-Language"))
+	assert.Equal(t, "Accept-Language", rr.Header().Get("Vary"))
+
+	rr = request("/missing", "")
+	assert.Equal(t, "Build not found\n", rr.Body.String())
+	assert.Equal(t, "en", rr.Header().Get("Content-Language"))
+
+	// Successful responses are left alone
+	rr = request("/builds", "es")
+	assert.Equal(t, "es", rr.Body.String())
+}
+
+func TestStatusPageIsLocalized(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.On("Ping").Return(nil).Once()
+	mockDB.On("GetQueueStats", mock.AnythingOfType("time.Time")).Return(&QueueStats{Queued: 3, Running: 1, WaitP50: 90 * time.Second}, nil).Once()
+	mockDB.On("ListIncidents", false).Return([]*Incident{}, nil).Once()
+	handler := service.catalog.Middleware(http.HandlerFunc(service.statusPageHandler))
+
+	req := httptest.NewRequest("GET", "/status", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `<html lang="en">`)
+	assert.Contains(t, rr.Body.String(), "All systems operational")
+	assert.Contains(t, rr.Body.String(), "Queue: 3 waiting, 1 running. Typical wait 1.5 min")
+	english := rr.Header().Get("ETag")
+
+	req = httptest.NewRequest("GET", "/status", nil)
+	req.Header.Set("Accept-Language", "de-DE")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `<html lang="de">`)
+	assert.Contains(t, rr.Body.String(), "Alle Systeme betriebsbereit")
+	assert.Contains(t, rr.Body.String(), "Warteschlange: 3 wartend, 1 laufend. Typische Wartezeit 1.5 Min.")
+	assert.NotEqual(t, english, rr.Header().Get("ETag"), "each locale is cached separately")
+
+	req = httptest.NewRequest("GET", "/api/v1/status", nil)
+	req.Header.Set("Accept-Language", "es")
+	rr = httptest.NewRecorder()
+	service.catalog.Middleware(http.HandlerFunc(service.statusHandler)).ServeHTTP(rr, req)
+	assert.Contains(t, rr.Body.String(), `"status":"operational"`)
+	assert.Contains(t, rr.Body.String(), `"description":"Todos los sistemas operativos"`)
+	mockDB.AssertExpectations(t)
+}
+
+func TestNotificationSinkNotifyLocale(t *testing.T) {
+	t.Setenv("NOTIFY_LOCALE", "de")
+	notifier := &fakeNotifier{name: "slack-webhook", enabled: true}
+	sink, mockDB := newTestNotificationSink(notifier)
+
+	mockDB.On("GetProjectByName", "api").Return(&Project{Name: "api", NotifyOn: notifyAlways}, nil)
+	mockDB.On("GetIntegration", "slack-webhook").Return(nil, fmt.Errorf("integration not found"))
+	mockDB.On("ResetIntegrationFailures", "slack-webhook").Return(nil)
+	mockDB.On("ListNotificationDigests").Return([]*NotificationDigest{}, nil)
+
+	require.NoError(t, sink.Deliver(context.Background(), BuildEvent{Build: BuildRequest{ID: 5, ProjectName: "api", Branch: "main", Status: "failed"}}))
+
+	require.Len(t, notifier.notified, 1)
+	assert.Equal(t, "[api] Build #5 fehlgeschlagen", notifier.notified[0].Subject)
+	assert.Contains(t, notifier.notified[0].Text, "Build #5 von api auf main: fehlgeschlagen.")
+	assert.Contains(t, notifier.notified[0].Text, "Commit: Stand des Branches")
+
+	digest := digestNotification(nil, sink.catalog, sink.locale, []*BuildRequest{{ID: 5, ProjectName: "api", Status: "failed"}}, time.Now(), time.Now(), false)
+	assert.Equal(t, "Build-Zusammenfassung: 1 Build in 1 Projekt", digest.Subject)
+	assert.Contains(t, digest.Text, "Zwischen ")
+}
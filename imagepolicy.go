@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// imageDigestPattern matches an image reference pinned to a content digest
+var imageDigestPattern = regexp.MustCompile(`@sha256:[0-9a-f]{64}$`)
+
+// ImagePolicy restricts the container images the builds of an org's
+// repositories run in. The policy of org "*" applies to orgs without one.
+type ImagePolicy struct {
+	Org string `json:"org"`
+	// AllowedImages are patterns of the images builds may use, where "*"
+	// matches any characters, e.g. "ghcr.io/acme/*" or "golang:1.*". Docker
+	// Hub images also match by their full name, e.g. "docker.io/library/*".
+	// Empty allows every image.
+	AllowedImages []string `json:"allowed_images"`
+	// DigestRequiredStages are patterns of pipeline stage names, such as
+	// "deploy-prod*", whose pipelines must pin their image by digest
+	DigestRequiredStages []string  `json:"digest_required_stages"`
+	UpdatedAt            time.Time `json:"updated_at"`
+
+	// err is why the policy that applies couldn't be loaded; checks fail
+	// with it rather than run builds unrestricted
+	err error
+}
+
+// Validate checks the policy's patterns
+func (ip *ImagePolicy) Validate() error {
+	for _, pattern := range ip.AllowedImages {
+		if strings.TrimSpace(pattern) == "" {
+			return fmt.Errorf("allowed_images must not contain empty patterns")
+		}
+	}
+	for _, pattern := range ip.DigestRequiredStages {
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			return fmt.Errorf("invalid stage pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+// imagePatternMatch reports whether image matches pattern, "*" matching any
+// run of characters including "/"
+func imagePatternMatch(pattern, image string) bool {
+	expr := "^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*") + "$"
+	matched, _ := regexp.MatchString(expr, image)
+	return matched
+}
+
+// qualifiedImageName expands a Docker Hub shorthand such as "golang:1.24" to
+// "docker.io/library/golang:1.24"
+func qualifiedImageName(image string) string {
+	first, rest, found := strings.Cut(image, "/")
+	switch {
+	case !found:
+		return "docker.io/library/" + image
+	case strings.ContainsAny(first, ".:") || first == "localhost":
+		return image
+	default:
+		return "docker.io/" + first + "/" + rest
+	}
+}
+
+// Allows reports whether the policy allows builds to run in image
+func (ip *ImagePolicy) Allows(image string) bool {
+	if len(ip.AllowedImages) == 0 {
+		return true
+	}
+	qualified := qualifiedImageName(image)
+	for _, pattern := range ip.AllowedImages {
+		if imagePatternMatch(pattern, image) || imagePatternMatch(pattern, qualified) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check reports why a pipeline may not run in image, or nil when it may. A
+// nil policy allows everything, and pipeline is nil for builds without a
+// pipeline file.
+func (ip *ImagePolicy) Check(image string, pipeline *PipelineConfig) error {
+	if ip == nil {
+		return nil
+	}
+	if ip.err != nil {
+		return fmt.Errorf("image policy of %s could not be loaded: %w", ip.Org, ip.err)
+	}
+	if image != "" && !ip.Allows(image) {
+		return fmt.Errorf("image %s is not allowed by the image policy of %s (allowed: %s)", image, ip.Org, strings.Join(ip.AllowedImages, ", "))
+	}
+	if pipeline == nil || imageDigestPattern.MatchString(image) {
+		return nil
+	}
+	for _, stage := range pipeline.Stages {
+		for _, pattern := range ip.DigestRequiredStages {
+			if matched, _ := path.Match(pattern, stage.Name); matched {
+				return fmt.Errorf("stage %q requires an image pinned by digest (name@sha256:...), got %q", stage.Name, image)
+			}
+		}
+	}
+	return nil
+}
+
+// imagePolicy returns the image policy of the org owning a repository, nil
+// when none applies. A policy that can't be loaded fails every check.
+func (bs *BuildService) imagePolicy(gitURL string) *ImagePolicy {
+	org := repositoryOrg(gitURL)
+	policy, err := bs.db.GetImagePolicy(org)
+	if err != nil {
+		if err.Error() == "image policy not found" {
+			return nil
+		}
+		bs.errors.Capture("image-policy", fmt.Errorf("loading image policy of %q: %w", org, err), nil)
+		return &ImagePolicy{Org: org, err: err}
+	}
+	return policy
+}
+
+// List image policies endpoint
+func (bs *BuildService) listImagePoliciesHandler(w http.ResponseWriter, r *http.Request) {
+	policies, err := bs.db.ListImagePolicies()
+	if err != nil {
+		log.Printf("Error listing image policies: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(policies)
+}
+
+// Set image policy endpoint
+func (bs *BuildService) setImagePolicyHandler(w http.ResponseWriter, r *http.Request) {
+	var policy ImagePolicy
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := policy.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	policy.Org = strings.ToLower(mux.Vars(r)["org"])
+	policy.AllowedImages = nonNilStrings(policy.AllowedImages)
+	policy.DigestRequiredStages = nonNilStrings(policy.DigestRequiredStages)
+
+	if err := bs.db.SetImagePolicy(&policy); err != nil {
+		log.Printf("Error setting image policy: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Image policy of org %q set to allow %v", policy.Org, policy.AllowedImages)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(policy)
+}
+
+// Delete image policy endpoint. The org falls back to the "*" policy.
+func (bs *BuildService) deleteImagePolicyHandler(w http.ResponseWriter, r *http.Request) {
+	if err := bs.db.DeleteImagePolicy(strings.ToLower(mux.Vars(r)["org"])); err != nil {
+		if err.Error() == "image policy not found" {
+			http.Error(w, "Image policy not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error deleting image policy: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
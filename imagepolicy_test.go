@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImagePolicyAllows(t *testing.T) {
+	policy := &ImagePolicy{Org: "acme", AllowedImages: []string{"ghcr.io/acme/*", "golang:1.*", "docker.io/library/alpine:*"}}
+
+	for image, allowed := range map[string]bool{
+		"ghcr.io/acme/builder:2":               true,
+		"ghcr.io/acme/team/builder@sha256:abc": true,
+		"golang:1.24":                          true,
+		"alpine:3":                             true,
+		"docker.io/library/alpine:3":           true,
+		"ghcr.io/evil/acme/builder:1":          false,
+		"golang:latest":                        false,
+		"evil.io/golang:1.24":                  false,
+		"node:20":                              false,
+	} {
+		assert.Equal(t, allowed, policy.Allows(image), image)
+	}
+
+	assert.True(t, (&ImagePolicy{}).Allows("anything:1"))
+}
+
+func TestImagePolicyCheck(t *testing.T) {
+	pinned := "ghcr.io/acme/deployer@sha256:" + strings.Repeat("a", 64)
+	policy := &ImagePolicy{Org: "acme", AllowedImages: []string{"ghcr.io/acme/*"}, DigestRequiredStages: []string{"deploy-prod*"}}
+	pipeline := &PipelineConfig{Stages: []PipelineStage{{Name: "build"}, {Name: "deploy-prod-eu"}}}
+
+	assert.NoError(t, policy.Check(pinned, pipeline))
+	assert.NoError(t, policy.Check("ghcr.io/acme/builder:1", &PipelineConfig{Stages: []PipelineStage{{Name: "build"}}}))
+	assert.NoError(t, policy.Check("ghcr.io/acme/builder:1", nil))
+
+	err := policy.Check("ghcr.io/acme/deployer:1", pipeline)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `stage "deploy-prod-eu" requires an image pinned by digest`)
+
+	err = policy.Check("node:20", pipeline)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "image node:20 is not allowed by the image policy of acme")
+
+	var none *ImagePolicy
+	assert.NoError(t, none.Check("node:20", pipeline))
+
+	broken := &ImagePolicy{Org: "acme", err: fmt.Errorf("connection refused")}
+	assert.ErrorContains(t, broken.Check("ghcr.io/acme/builder:1", nil), "could not be loaded")
+}
+
+func TestImagePolicyLookup(t *testing.T) {
+	mockDB := new(MockDatabase)
+	service := NewBuildServiceWithRegistry(mockDB, prometheus.NewRegistry())
+	policy := &ImagePolicy{Org: "*", AllowedImages: []string{"golang:*"}}
+	mockDB.On("GetImagePolicy", "acme").Return(policy, nil)
+	mockDB.On("GetImagePolicy", "globex").Return(nil, fmt.Errorf("image policy not found"))
+	mockDB.On("GetImagePolicy", "initech").Return(nil, fmt.Errorf("connection refused"))
+
+	assert.Same(t, policy, service.imagePolicy("git@github.com:acme/api.git"))
+	assert.Nil(t, service.imagePolicy("https://github.com/globex/api.git"))
+
+	// Builds don't run unrestricted when the policy can't be loaded
+	broken := service.imagePolicy("https://github.com/initech/api.git")
+	require.NotNil(t, broken)
+	assert.Error(t, broken.Check("golang:1.24", nil))
+}
+
+func TestSetImagePolicyHandler(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.On("SetImagePolicy", mock.MatchedBy(func(p *ImagePolicy) bool {
+		return p.Org == "acme" && len(p.AllowedImages) == 1 && p.DigestRequiredStages != nil
+	})).Return(nil).Once()
+
+	set := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PUT", "/api/v1/admin/image-policies/ACME", bytes.NewBufferString(body))
+		req = mux.SetURLVars(req, map[string]string{"org": "ACME"})
+		rr := httptest.NewRecorder()
+		service.setImagePolicyHandler(rr, req)
+		return rr
+	}
+
+	rr := set(`{"allowed_images": ["ghcr.io/acme/*"]}`)
+	require.Equal(t, http.StatusOK, rr.Code)
+	var policy ImagePolicy
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &policy))
+	assert.Equal(t, "acme", policy.Org)
+	assert.Equal(t, []string{}, policy.DigestRequiredStages)
+
+	assert.Equal(t, http.StatusBadRequest, set(`{"allowed_images": [" "]}`).Code)
+	assert.Equal(t, http.StatusBadRequest, set(`{"digest_required_stages": ["deploy-["]}`).Code)
+	mockDB.AssertExpectations(t)
+}
+
+func TestDeleteImagePolicyHandler(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.On("DeleteImagePolicy", "acme").Return(nil)
+	mockDB.On("DeleteImagePolicy", "globex").Return(fmt.Errorf("image policy not found"))
+
+	remove := func(org string) int {
+		req := mux.SetURLVars(httptest.NewRequest("DELETE", "/api/v1/admin/image-policies/"+org, nil), map[string]string{"org": org})
+		rr := httptest.NewRecorder()
+		service.deleteImagePolicyHandler(rr, req)
+		return rr.Code
+	}
+
+	assert.Equal(t, http.StatusNoContent, remove("acme"))
+	assert.Equal(t, http.StatusNotFound, remove("globex"))
+}
+
+func TestValidatePipelineHandlerImagePolicy(t *testing.T) {
+	mockDB := new(MockDatabase)
+	service := NewBuildServiceWithRegistry(mockDB, prometheus.NewRegistry())
+	mockDB.On("GetProjectByName", "api").Return(&Project{Name: "api", GitURL: "https://github.com/acme/api.git"}, nil)
+	mockDB.On("GetProjectByName", "web").Return(&Project{Name: "web", GitURL: "https://github.com/acme/web.git", BuildImage: "ghcr.io/acme/web-builder:3"}, nil)
+	mockDB.On("GetProjectByName", "missing").Return(nil, fmt.Errorf("project not found"))
+	mockDB.On("GetImagePolicy", "acme").Return(&ImagePolicy{Org: "acme", AllowedImages: []string{"ghcr.io/acme/*"}}, nil)
+
+	validate := func(project, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		service.validatePipelineHandler(rr, httptest.NewRequest("POST", "/api/v1/pipelines/validate?project="+project, strings.NewReader(body)))
+		return rr
+	}
+
+	pipeline := "image: node:20\nstages:\n  - name: build\n    steps: [npm test]\n"
+	rr := validate("api", pipeline)
+	require.Equal(t, http.StatusOK, rr.Code)
+	var result PipelineValidation
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &result))
+	assert.False(t, result.Valid)
+	assert.Contains(t, result.Errors[0], "image node:20 is not allowed")
+
+	// The project's build_image replaces the pipeline's image
+	rr = validate("web", pipeline)
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &result))
+	assert.True(t, result.Valid)
+
+	assert.Equal(t, http.StatusNotFound, validate("missing", pipeline).Code)
+}
+
+func TestDockerExecutorEnforcesImagePolicy(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	repo := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(repo, "Makefile"), []byte("all:\n\t@echo ok\n"), 0o644))
+	for _, args := range [][]string{
+		{"init", "-q", "-b", "main"},
+		{"add", "Makefile"},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "init"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repo
+		require.NoError(t, cmd.Run())
+	}
+
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected docker API call %s %s", r.Method, r.URL.Path)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer daemon.Close()
+
+	executor, err := NewDockerExecutor("tcp://"+strings.TrimPrefix(daemon.URL, "http://"), t.TempDir())
+	require.NoError(t, err)
+	executor.Local.AllowedProtocols = append(executor.Local.AllowedProtocols, "file")
+
+	result, err := executor.Execute(context.Background(), &BuildRequest{
+		ID:          7,
+		ProjectName: "test-project",
+		GitURL:      "file://" + repo,
+		Branch:      "main",
+		BuildImage:  "builder:1",
+		ImagePolicy: &ImagePolicy{Org: "acme", AllowedImages: []string{"ghcr.io/acme/*"}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "failed", result.Status)
+	assert.Equal(t, -1, result.ExitCode)
+	assert.Contains(t, string(result.Output), "image builder:1 is not allowed by the image policy of acme")
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// maxDependsOn caps the number of upstream builds a build may wait for
+const maxDependsOn = 20
+
+// BuildImpact lists the waiting builds that would be blocked if a build never
+// succeeded
+type BuildImpact struct {
+	BuildID int `json:"build_id"`
+	// Blocked holds the draft and queued builds that depend on the build,
+	// directly or through other blocked builds
+	Blocked []*BuildRequest `json:"blocked"`
+	// Projects are the projects of the blocked builds
+	Projects []string `json:"projects"`
+}
+
+// downstreamImpact computes what a build's cancellation would block
+func (bs *BuildService) downstreamImpact(id int) (*BuildImpact, error) {
+	blocked, err := bs.db.ListDownstreamBuilds(id)
+	if err != nil {
+		return nil, err
+	}
+
+	impact := &BuildImpact{BuildID: id, Blocked: blocked, Projects: []string{}}
+	if impact.Blocked == nil {
+		impact.Blocked = []*BuildRequest{}
+	}
+	seen := make(map[string]bool)
+	for _, build := range blocked {
+		if !seen[build.ProjectName] {
+			seen[build.ProjectName] = true
+			impact.Projects = append(impact.Projects, build.ProjectName)
+		}
+	}
+	return impact, nil
+}
+
+// checkUpstreamBuilds validates the depends_on of a new build, responding with
+// an error and reporting false when an upstream build is missing or can no
+// longer succeed
+func (bs *BuildService) checkUpstreamBuilds(w http.ResponseWriter, r *http.Request, ids []int) bool {
+	status, err := bs.upstreamBuildsError(requestTenant(r), ids)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return false
+	}
+	return true
+}
+
+// upstreamBuildsError returns why the depends_on of a new build is invalid,
+// with the status to respond with, or nil when it's valid. Builds of orgs the
+// tenant doesn't see are reported as not found.
+func (bs *BuildService) upstreamBuildsError(tenant Tenant, ids []int) (int, error) {
+	if len(ids) > maxDependsOn {
+		return http.StatusBadRequest, fmt.Errorf("depends_on may list at most %d builds", maxDependsOn)
+	}
+
+	seen := make(map[int]bool)
+	for _, id := range ids {
+		if id <= 0 || seen[id] {
+			return http.StatusBadRequest, fmt.Errorf("depends_on must list distinct build IDs")
+		}
+		seen[id] = true
+
+		upstream, err := bs.db.GetBuild(id)
+		if err == nil && !tenant.Sees(upstream.Org) {
+			err = fmt.Errorf("build not found")
+		}
+		if err != nil {
+			if err.Error() == "build not found" {
+				return http.StatusBadRequest, fmt.Errorf("Build %d in depends_on not found", id)
+			}
+			log.Printf("Error getting upstream build: %v", err)
+			return http.StatusInternalServerError, fmt.Errorf("Internal server error")
+		}
+		switch upstream.Status {
+		case "draft", "queued", "running", "success":
+		default:
+			return http.StatusConflict, fmt.Errorf("Build %d in depends_on is %s and will never succeed", id, upstream.Status)
+		}
+	}
+	return 0, nil
+}
+
+// Build impact endpoint
+func (bs *BuildService) buildImpactHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid build ID", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := bs.db.GetBuild(id); err != nil {
+		if err.Error() == "build not found" {
+			http.Error(w, "Build not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error getting build: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	impact, err := bs.downstreamImpact(id)
+	if err != nil {
+		log.Printf("Error listing downstream builds: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(impact)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildImpactHandler(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.On("GetBuild", 1).Return(&BuildRequest{ID: 1, Status: "running"}, nil)
+	mockDB.On("GetBuild", 2).Return(nil, fmt.Errorf("build not found"))
+	mockDB.On("ListDownstreamBuilds", 1).Return([]*BuildRequest{
+		{ID: 4, ProjectName: "web", Status: "queued", DependsOn: []int{1}},
+		{ID: 5, ProjectName: "deploy", Status: "draft", DependsOn: []int{4}},
+		{ID: 6, ProjectName: "web", Status: "queued", DependsOn: []int{1}},
+	}, nil)
+
+	impact := func(id string) *httptest.ResponseRecorder {
+		req := mux.SetURLVars(httptest.NewRequest("GET", "/api/v1/builds/"+id+"/impact", nil), map[string]string{"id": id})
+		rr := httptest.NewRecorder()
+		service.buildImpactHandler(rr, req)
+		return rr
+	}
+
+	rr := impact("1")
+	require.Equal(t, http.StatusOK, rr.Code)
+	var report BuildImpact
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &report))
+	assert.Equal(t, 1, report.BuildID)
+	assert.Len(t, report.Blocked, 3)
+	assert.Equal(t, []string{"web", "deploy"}, report.Projects)
+
+	assert.Equal(t, http.StatusNotFound, impact("2").Code)
+	assert.Equal(t, http.StatusBadRequest, impact("x").Code)
+}
+
+func TestCancelBuildWithDownstreamBuildsRequiresForce(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.On("ListDownstreamBuilds", 1).Return([]*BuildRequest{{ID: 2, ProjectName: "web", Status: "queued", DependsOn: []int{1}}}, nil)
+	mockDB.On("CancelBuild", 1, "superseded", "api").Return(&BuildRequest{ID: 1, Status: "cancelled", CancelReason: "superseded", CancelledBy: "api"}, nil).Once()
+
+	cancel := func(body string) *httptest.ResponseRecorder {
+		req := mux.SetURLVars(httptest.NewRequest("POST", "/api/v1/builds/1/cancel", bytes.NewBufferString(body)), map[string]string{"id": "1"})
+		rr := httptest.NewRecorder()
+		service.cancelBuildHandler(rr, req)
+		return rr
+	}
+
+	rr := cancel(`{"reason":"superseded"}`)
+	require.Equal(t, http.StatusConflict, rr.Code)
+	var report BuildImpact
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &report))
+	require.Len(t, report.Blocked, 1)
+	assert.Equal(t, 2, report.Blocked[0].ID)
+	mockDB.AssertNotCalled(t, "CancelBuild", mock.Anything, mock.Anything, mock.Anything)
+
+	assert.Equal(t, http.StatusOK, cancel(`{"reason":"superseded","force":true}`).Code)
+	mockDB.AssertExpectations(t)
+}
+
+func TestCreateBuildChecksUpstreamBuilds(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.On("GetBuild", 1).Return(&BuildRequest{ID: 1, Status: "running"}, nil)
+	mockDB.On("GetBuild", 2).Return(&BuildRequest{ID: 2, Status: "failed"}, nil)
+	mockDB.On("GetBuild", 3).Return(nil, fmt.Errorf("build not found"))
+	mockDB.On("CreateBuild", mock.MatchedBy(func(b *BuildRequest) bool {
+		return len(b.DependsOn) == 1 && b.DependsOn[0] == 1
+	})).Return(9, nil).Once()
+
+	create := func(dependsOn string) int {
+		body := `{"project_name":"web","git_url":"https://github.com/acme/web.git","depends_on":` + dependsOn + `}`
+		rr := httptest.NewRecorder()
+		service.createBuildHandler(rr, httptest.NewRequest("POST", "/api/v1/builds", bytes.NewBufferString(body)))
+		return rr.Code
+	}
+
+	assert.Equal(t, http.StatusCreated, create("[1]"))
+	assert.Equal(t, http.StatusConflict, create("[2]"))
+	assert.Equal(t, http.StatusBadRequest, create("[3]"))
+	assert.Equal(t, http.StatusBadRequest, create("[1, 1]"))
+	assert.Equal(t, http.StatusBadRequest, create("[0]"))
+	mockDB.AssertExpectations(t)
+}
+
+func TestCreateBuildHidesOtherOrgsUpstreamBuilds(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.On("GetProjectByName", "web").Return(nil, fmt.Errorf("project not found"))
+	mockDB.On("GetBuild", 1).Return(&BuildRequest{ID: 1, Status: "running", Org: "acme"}, nil)
+	mockDB.On("GetBuild", 2).Return(&BuildRequest{ID: 2, Status: "failed", Org: "globex"}, nil)
+	mockDB.On("GetBuild", 3).Return(&BuildRequest{ID: 3, Status: "running", Org: "globex"}, nil)
+
+	create := func(dependsOn string) *httptest.ResponseRecorder {
+		body := `{"project_name":"web","git_url":"https://github.com/acme/web.git","depends_on":` + dependsOn + `}`
+		req := httptest.NewRequest("POST", "/api/v1/builds", bytes.NewBufferString(body))
+		req = req.WithContext(context.WithValue(req.Context(), tenantContextKey{}, Tenant{Org: "acme"}))
+		rr := httptest.NewRecorder()
+		service.createBuildHandler(rr, req)
+		return rr
+	}
+
+	// Neither the existence nor the status of another org's build is revealed
+	for _, dependsOn := range []string{"[2]", "[3]", "[1, 3]"} {
+		rr := create(dependsOn)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, dependsOn)
+		assert.Contains(t, rr.Body.String(), "in depends_on not found", dependsOn)
+	}
+	mockDB.AssertNotCalled(t, "CreateBuild", mock.Anything)
+}
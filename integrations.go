@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// IntegrationState tracks the health of an outbound integration such as a
+// notification provider
+type IntegrationState struct {
+	Name                string     `json:"name" db:"name"`
+	ConsecutiveFailures int        `json:"consecutive_failures" db:"consecutive_failures"`
+	LastError           string     `json:"last_error,omitempty" db:"last_error"`
+	LastFailureAt       *time.Time `json:"last_failure_at,omitempty" db:"last_failure_at"`
+	DisabledAt          *time.Time `json:"disabled_at,omitempty" db:"disabled_at"`
+}
+
+// Enabled reports whether deliveries to the integration are allowed
+func (is *IntegrationState) Enabled() bool {
+	return is.DisabledAt == nil
+}
+
+// IntegrationHealth disables integrations that keep failing so that workers
+// stop spending time on dead endpoints. State lives in the database so that
+// every instance sees the same failures and re-enables.
+type IntegrationHealth struct {
+	db        DatabaseInterface
+	errors    *ErrorTracker
+	disabled  *prometheus.CounterVec
+	threshold int
+}
+
+// NewIntegrationHealth creates a tracker that disables an integration after
+// INTEGRATION_FAILURE_THRESHOLD consecutive failures
+func NewIntegrationHealth(db DatabaseInterface, errors *ErrorTracker, disabled *prometheus.CounterVec) *IntegrationHealth {
+	return &IntegrationHealth{
+		db:        db,
+		errors:    errors,
+		disabled:  disabled,
+		threshold: getEnvInt("INTEGRATION_FAILURE_THRESHOLD", 10),
+	}
+}
+
+// Allow reports whether a delivery to the named integration should be attempted
+func (ih *IntegrationHealth) Allow(name string) bool {
+	state, err := ih.db.GetIntegration(name)
+	if err != nil {
+		if err.Error() != "integration not found" {
+			// Fail open: a database hiccup shouldn't silence notifications
+			log.Printf("Error loading integration %s: %v", name, err)
+		}
+		return true
+	}
+	return state.Enabled()
+}
+
+// Record notes the outcome of a delivery. Once an integration has failed
+// threshold times in a row it is disabled and an alert is raised.
+func (ih *IntegrationHealth) Record(name string, deliveryErr error, build *BuildRequest) {
+	if deliveryErr == nil {
+		if err := ih.db.ResetIntegrationFailures(name); err != nil {
+			log.Printf("Error resetting failures of integration %s: %v", name, err)
+		}
+		return
+	}
+
+	ih.errors.Capture(name, deliveryErr, build)
+
+	state, err := ih.db.RecordIntegrationFailure(name, deliveryErr.Error(), ih.threshold)
+	if err != nil {
+		log.Printf("Error recording failure of integration %s: %v", name, err)
+		return
+	}
+
+	if state.ConsecutiveFailures == ih.threshold {
+		ih.disabled.WithLabelValues(name).Inc()
+		ih.errors.Capture("integrations", fmt.Errorf("integration %s disabled after %d consecutive failures, last error: %s",
+			name, state.ConsecutiveFailures, state.LastError), nil)
+	}
+}
+
+// List integrations endpoint
+func (bs *BuildService) listIntegrationsHandler(w http.ResponseWriter, r *http.Request) {
+	integrations, err := bs.db.ListIntegrations()
+	if err != nil {
+		log.Printf("Error listing integrations: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(integrations)
+}
+
+// Enable integration endpoint
+func (bs *BuildService) enableIntegrationHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	if err := bs.db.EnableIntegration(name); err != nil {
+		if err.Error() == "integration not found" {
+			http.Error(w, "Integration not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error enabling integration: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Integration %s re-enabled", name)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIntegrationHealthAllow(t *testing.T) {
+	service, mockDB := setupTestService()
+	disabledAt := time.Now()
+
+	mockDB.On("GetIntegration", "slack").Return(nil, fmt.Errorf("integration not found")).Once()
+	mockDB.On("GetIntegration", "jira").Return(&IntegrationState{Name: "jira", DisabledAt: &disabledAt}, nil).Once()
+	mockDB.On("GetIntegration", "pagerduty").Return(nil, fmt.Errorf("connection refused")).Once()
+
+	assert.True(t, service.integrations.Allow("slack"))
+	assert.False(t, service.integrations.Allow("jira"))
+	assert.True(t, service.integrations.Allow("pagerduty"), "database errors should fail open")
+	mockDB.AssertExpectations(t)
+}
+
+func TestIntegrationHealthRecord(t *testing.T) {
+	t.Setenv("INTEGRATION_FAILURE_THRESHOLD", "3")
+	service, mockDB := setupTestService()
+	service.integrations = NewIntegrationHealth(mockDB, service.errors, &service.metrics.Integrations)
+
+	mockDB.On("ResetIntegrationFailures", "slack").Return(nil).Once()
+	service.integrations.Record("slack", nil, nil)
+
+	mockDB.On("RecordIntegrationFailure", "slack", "timeout", 3).Return(&IntegrationState{Name: "slack", ConsecutiveFailures: 2, LastError: "timeout"}, nil).Once()
+	service.integrations.Record("slack", fmt.Errorf("timeout"), nil)
+	assert.Equal(t, float64(0), testutil.ToFloat64(service.metrics.Integrations.WithLabelValues("slack")))
+
+	disabledAt := time.Now()
+	mockDB.On("RecordIntegrationFailure", "slack", "timeout", 3).Return(&IntegrationState{Name: "slack", ConsecutiveFailures: 3, LastError: "timeout", DisabledAt: &disabledAt}, nil).Once()
+	service.integrations.Record("slack", fmt.Errorf("timeout"), nil)
+	assert.Equal(t, float64(1), testutil.ToFloat64(service.metrics.Integrations.WithLabelValues("slack")))
+
+	// Later failures while disabled don't raise the alert again
+	mockDB.On("RecordIntegrationFailure", "slack", "timeout", 3).Return(&IntegrationState{Name: "slack", ConsecutiveFailures: 4, LastError: "timeout", DisabledAt: &disabledAt}, nil).Once()
+	service.integrations.Record("slack", fmt.Errorf("timeout"), nil)
+	assert.Equal(t, float64(1), testutil.ToFloat64(service.metrics.Integrations.WithLabelValues("slack")))
+
+	mockDB.AssertExpectations(t)
+}
+
+func TestEnableIntegrationHandler(t *testing.T) {
+	tests := []struct {
+		name           string
+		dbError        error
+		expectedStatus int
+	}{
+		{name: "re-enabled", expectedStatus: http.StatusNoContent},
+		{name: "unknown integration", dbError: fmt.Errorf("integration not found"), expectedStatus: http.StatusNotFound},
+		{name: "database error", dbError: fmt.Errorf("connection refused"), expectedStatus: http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service, mockDB := setupTestService()
+			mockDB.On("EnableIntegration", "slack").Return(tt.dbError).Once()
+
+			req := httptest.NewRequest("POST", "/api/v1/admin/integrations/slack/enable", nil)
+			req = mux.SetURLVars(req, map[string]string{"name": "slack"})
+			rr := httptest.NewRecorder()
+
+			service.enableIntegrationHandler(rr, req)
+
+			assert.Equal(t, tt.expectedStatus, rr.Code)
+			mockDB.AssertExpectations(t)
+		})
+	}
+}
+
+func TestListIntegrationsHandler(t *testing.T) {
+	service, mockDB := setupTestService()
+	disabledAt := time.Now()
+	mockDB.On("ListIntegrations").Return([]*IntegrationState{
+		{Name: "jira", ConsecutiveFailures: 10, LastError: "401 Unauthorized", DisabledAt: &disabledAt},
+	}, nil).Once()
+
+	req := httptest.NewRequest("GET", "/api/v1/admin/integrations", nil)
+	rr := httptest.NewRecorder()
+
+	service.listIntegrationsHandler(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var integrations []IntegrationState
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &integrations))
+	assert.Len(t, integrations, 1)
+	assert.False(t, integrations[0].Enabled())
+	mockDB.AssertExpectations(t)
+}
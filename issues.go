@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// issueKeyPattern matches Jira-style issue keys such as PROJ-123
+var issueKeyPattern = regexp.MustCompile(`\b[A-Z][A-Z0-9_]+-[1-9][0-9]*\b`)
+
+// extractIssueKeys returns the unique issue keys mentioned in texts. When
+// projectKeys is non-empty only keys of those Jira projects are returned,
+// which avoids false positives such as "UTF-8".
+func extractIssueKeys(projectKeys []string, texts ...string) []string {
+	allowed := make(map[string]bool)
+	for _, key := range projectKeys {
+		allowed[strings.ToUpper(strings.TrimSpace(key))] = true
+	}
+
+	seen := make(map[string]bool)
+	var keys []string
+	for _, text := range texts {
+		for _, key := range issueKeyPattern.FindAllString(text, -1) {
+			prefix := key[:strings.LastIndex(key, "-")]
+			if seen[key] || (len(allowed) > 0 && !allowed[prefix]) {
+				continue
+			}
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// jiraProjectKeys returns the Jira project keys configured in JIRA_PROJECT_KEYS
+func jiraProjectKeys() []string {
+	value := os.Getenv("JIRA_PROJECT_KEYS")
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+// linkIssues records the issue keys mentioned in texts as references of the build
+func (bs *BuildService) linkIssues(build *BuildRequest, texts ...string) {
+	keys := extractIssueKeys(jiraProjectKeys(), texts...)
+	if len(keys) == 0 {
+		return
+	}
+
+	if err := bs.db.AddBuildIssues(build.ID, keys); err != nil {
+		log.Printf("Error linking issues %v to build %d: %v", keys, build.ID, err)
+	}
+}
+
+// List builds by issue endpoint
+func (bs *BuildService) listIssueBuildsHandler(w http.ResponseWriter, r *http.Request) {
+	key := strings.ToUpper(mux.Vars(r)["key"])
+	if !issueKeyPattern.MatchString(key) {
+		http.Error(w, "Invalid issue key", http.StatusBadRequest)
+		return
+	}
+
+	builds, err := bs.db.ListBuildsByIssue(key, listOrg(r))
+	if err != nil {
+		log.Printf("Error listing builds for issue: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(builds)
+}
+
+// JiraNotifier comments on linked Jira issues when builds finish and when
+// their deployments change status
+type JiraNotifier struct {
+	db      DatabaseInterface
+	errors  *ErrorTracker
+	health  *IntegrationHealth
+	links   *PublicURLs
+	baseURL string
+	email   string
+	token   string
+	client  *http.Client
+}
+
+// NewJiraNotifierFromEnv returns a notifier when JIRA_BASE_URL and
+// credentials are configured, otherwise nil
+func NewJiraNotifierFromEnv(db DatabaseInterface, errors *ErrorTracker, health *IntegrationHealth, links *PublicURLs) *JiraNotifier {
+	baseURL := os.Getenv("JIRA_BASE_URL")
+	token := os.Getenv("JIRA_API_TOKEN")
+	if baseURL == "" || token == "" {
+		return nil
+	}
+
+	return &JiraNotifier{
+		db:      db,
+		errors:  errors,
+		health:  health,
+		links:   links,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		email:   os.Getenv("JIRA_USER_EMAIL"),
+		token:   token,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Name identifies the integration
+func (jn *JiraNotifier) Name() string {
+	return "jira"
+}
+
+// Deliver comments on the linked issues of finished builds
+func (jn *JiraNotifier) Deliver(ctx context.Context, event BuildEvent) error {
+	if event.Build.Status != "success" && event.Build.Status != "failed" && event.Build.Status != "timeout" {
+		return nil
+	}
+	return jn.notify(&event.Build)
+}
+
+func (jn *JiraNotifier) notify(build *BuildRequest) error {
+	comment := fmt.Sprintf("Build #%d of %s@%s finished with status *%s*: %s",
+		build.ID, build.ProjectName, build.Branch, build.Status, jn.links.BuildURL(build))
+	return jn.commentOnIssues(build, comment)
+}
+
+// DeploymentChanged comments on the linked issues of a deployment's build
+func (jn *JiraNotifier) DeploymentChanged(ctx context.Context, deployment *Deployment) error {
+	build, err := jn.db.GetBuild(deployment.BuildID)
+	if err != nil {
+		return err
+	}
+
+	comment := fmt.Sprintf("Deployment #%d of %s build #%d to %s is now *%s*: %s",
+		deployment.ID, deployment.ProjectName, deployment.BuildID, deployment.Environment, deployment.Status, jn.links.BuildURL(build))
+	return jn.commentOnIssues(build, comment)
+}
+
+// commentOnIssues posts a comment on every issue linked to a build
+func (jn *JiraNotifier) commentOnIssues(build *BuildRequest, comment string) error {
+	keys, err := jn.db.ListBuildIssues(build.ID)
+	if err != nil {
+		jn.errors.Capture("jira", fmt.Errorf("listing linked issues: %w", err), build)
+		return err
+	}
+
+	for _, key := range keys {
+		if !jn.health.Allow("jira") {
+			return errIntegrationDisabled
+		}
+
+		err := jn.comment(key, comment)
+		if err != nil {
+			err = fmt.Errorf("commenting on %s: %w", key, err)
+		}
+		jn.health.Record("jira", err, build)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// comment adds a comment to an issue via the Jira REST API
+func (jn *JiraNotifier) comment(key, body string) error {
+	payload, _ := json.Marshal(map[string]string{"body": body})
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/rest/api/2/issue/%s/comment", jn.baseURL, key), bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if jn.email != "" {
+		// Jira Cloud: basic auth with account email and API token
+		req.SetBasicAuth(jn.email, jn.token)
+	} else {
+		// Jira Data Center: personal access token
+		req.Header.Set("Authorization", "Bearer "+jn.token)
+	}
+
+	resp, err := jn.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
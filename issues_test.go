@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtractIssueKeys(t *testing.T) {
+	tests := []struct {
+		name        string
+		projectKeys []string
+		texts       []string
+		expected    []string
+	}{
+		{"branch", nil, []string{"feature/PROJ-123-login"}, []string{"PROJ-123"}},
+		{"message and branch deduplicated", nil, []string{"PROJ-1", "Fix PROJ-1 and OPS-42"}, []string{"PROJ-1", "OPS-42"}},
+		{"lowercase ignored", nil, []string{"proj-123"}, nil},
+		{"zero issue number", nil, []string{"PROJ-0"}, nil},
+		{"project filter", []string{"proj"}, []string{"Handle UTF-8 in PROJ-7"}, []string{"PROJ-7"}},
+		{"none", nil, []string{"main"}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, extractIssueKeys(tt.projectKeys, tt.texts...))
+		})
+	}
+}
+
+func TestEnqueueBuildLinksIssues(t *testing.T) {
+	service, mockDB := setupTestService()
+
+	build := &BuildRequest{ProjectName: "api", GitURL: "https://github.com/test/api.git", Branch: "bugfix/API-9", CommitMessage: "Fix login (API-10)"}
+	mockDB.On("CreateBuild", build).Return(5, nil)
+	mockDB.On("AddBuildIssues", 5, []string{"API-9", "API-10"}).Return(nil)
+
+	require.NoError(t, service.enqueueBuild(context.Background(), build))
+	mockDB.AssertExpectations(t)
+}
+
+func TestListIssueBuildsHandler(t *testing.T) {
+	service, mockDB := setupTestService()
+
+	builds := []*BuildRequest{{ID: 1, ProjectName: "api", Branch: "PROJ-12", Status: "success"}}
+	mockDB.On("ListBuildsByIssue", "PROJ-12", "").Return(builds, nil)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/issues/{key}/builds", service.listIssueBuildsHandler)
+
+	req := httptest.NewRequest("GET", "/api/v1/issues/proj-12/builds", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var response []*BuildRequest
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+	assert.Len(t, response, 1)
+
+	req = httptest.NewRequest("GET", "/api/v1/issues/not-a-key/builds", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	mockDB.AssertExpectations(t)
+}
+
+func TestJiraNotifierCommentsOnLinkedIssues(t *testing.T) {
+	commented := make(chan string, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, token, ok := r.BasicAuth()
+		assert.True(t, ok)
+		assert.Equal(t, "ci@example.com", user)
+		assert.Equal(t, "jira-token", token)
+
+		var payload map[string]string
+		json.NewDecoder(r.Body).Decode(&payload)
+		assert.Contains(t, payload["body"], "failed")
+
+		commented <- r.URL.Path
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	t.Setenv("JIRA_BASE_URL", server.URL+"/")
+	t.Setenv("JIRA_USER_EMAIL", "ci@example.com")
+	t.Setenv("JIRA_API_TOKEN", "jira-token")
+	service, mockDB := setupTestService()
+	service.jira = NewJiraNotifierFromEnv(mockDB, service.errors, service.integrations, service.links)
+	require.NotNil(t, service.jira)
+
+	mockDB.On("ListBuildIssues", 42).Return([]string{"PROJ-1"}, nil).Once()
+	mockDB.On("GetIntegration", "jira").Return(nil, fmt.Errorf("integration not found")).Once()
+	mockDB.On("ResetIntegrationFailures", "jira").Return(nil).Maybe()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	service.delivery.Register(service.jira)
+	service.delivery.Start(ctx)
+
+	service.events.Publish(&BuildRequest{ID: 42, Status: "running"})
+	service.events.Publish(&BuildRequest{ID: 42, Status: "failed"})
+
+	select {
+	case path := <-commented:
+		assert.Equal(t, "/rest/api/2/issue/PROJ-1/comment", path)
+	case <-time.After(2 * time.Second):
+		t.Fatal("no comment posted")
+	}
+	mockDB.AssertExpectations(t)
+}
+
+func TestJiraNotifierCommentsOnDeployments(t *testing.T) {
+	commented := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]string
+		json.NewDecoder(r.Body).Decode(&payload)
+		commented <- r.URL.Path + " " + payload["body"]
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	t.Setenv("JIRA_BASE_URL", server.URL)
+	t.Setenv("JIRA_API_TOKEN", "jira-token")
+	service, mockDB := setupTestService()
+	service.jira = NewJiraNotifierFromEnv(mockDB, service.errors, service.integrations, service.links)
+
+	mockDB.On("GetBuild", 42).Return(&BuildRequest{ID: 42, ProjectName: "api", Status: "success"}, nil)
+	mockDB.On("ListBuildIssues", 42).Return([]string{"PROJ-1"}, nil).Once()
+	mockDB.On("GetIntegration", "jira").Return(nil, fmt.Errorf("integration not found")).Maybe()
+	mockDB.On("ResetIntegrationFailures", "jira").Return(nil).Maybe()
+
+	service.deploymentChanged(&Deployment{ID: 7, BuildID: 42, ProjectName: "api", Environment: "prod", Status: "live"})
+
+	select {
+	case comment := <-commented:
+		assert.Equal(t, "/rest/api/2/issue/PROJ-1/comment Deployment #7 of api build #42 to prod is now *live*: http://localhost:8080/api/v1/builds/42", comment)
+	case <-time.After(2 * time.Second):
+		t.Fatal("no comment posted")
+	}
+}
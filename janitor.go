@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// StoreReport lists the inconsistencies found between one object store and
+// the database records that reference it
+type StoreReport struct {
+	Store string `json:"store"`
+	// OrphanedObjects are stored objects no database record refers to
+	OrphanedObjects []ObjectInfo `json:"orphaned_objects"`
+	// MissingObjects are database records whose object no longer exists
+	MissingObjects []string `json:"missing_objects"`
+	Deleted        int      `json:"deleted"`
+}
+
+// JanitorReport is the outcome of a janitor run
+type JanitorReport struct {
+	DryRun     bool          `json:"dry_run"`
+	StartedAt  time.Time     `json:"started_at"`
+	FinishedAt time.Time     `json:"finished_at"`
+	Stores     []StoreReport `json:"stores"`
+}
+
+// Janitor finds objects in the artifact store without a database record and
+// records whose object is gone, and optionally removes both
+type Janitor struct {
+	db          DatabaseInterface
+	artifacts   ArtifactStore
+	errors      *ErrorTracker
+	interval    time.Duration
+	gracePeriod time.Duration
+	reconcile   bool
+
+	mu   sync.Mutex
+	last *JanitorReport
+}
+
+// NewJanitor creates a janitor configured from the environment
+func NewJanitor(db DatabaseInterface, artifacts ArtifactStore, errors *ErrorTracker) *Janitor {
+	return &Janitor{
+		db:          db,
+		artifacts:   artifacts,
+		errors:      errors,
+		interval:    getEnvDuration("JANITOR_INTERVAL", 24*time.Hour),
+		gracePeriod: getEnvDuration("JANITOR_GRACE_PERIOD", time.Hour),
+		reconcile:   getEnvInt("JANITOR_RECONCILE", 0) == 1,
+	}
+}
+
+// Start runs the janitor on its interval until ctx is cancelled. Scheduled
+// runs only report unless JANITOR_RECONCILE=1.
+func (j *Janitor) Start(ctx context.Context) {
+	if j.interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(j.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if _, err := j.Run(ctx, !j.reconcile); err != nil {
+					j.errors.Capture("janitor", err, nil)
+				}
+			}
+		}
+	}()
+}
+
+// Run compares the stores with the database. Unless dryRun is set, orphaned
+// objects and records of missing objects are deleted.
+func (j *Janitor) Run(ctx context.Context, dryRun bool) (*JanitorReport, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	report := &JanitorReport{DryRun: dryRun, StartedAt: time.Now().UTC()}
+
+	artifacts, err := j.checkArtifacts(ctx, dryRun)
+	if err != nil {
+		return nil, fmt.Errorf("checking artifact store: %w", err)
+	}
+	report.Stores = append(report.Stores, *artifacts)
+
+	report.FinishedAt = time.Now().UTC()
+	j.last = report
+
+	for _, store := range report.Stores {
+		if len(store.OrphanedObjects) > 0 || len(store.MissingObjects) > 0 {
+			log.Printf("Janitor found %d orphaned and %d missing objects in the %s store (dry run: %t, deleted: %d)",
+				len(store.OrphanedObjects), len(store.MissingObjects), store.Store, dryRun, store.Deleted)
+		}
+	}
+	return report, nil
+}
+
+// Last returns the report of the most recent run, or nil
+func (j *Janitor) Last() *JanitorReport {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.last
+}
+
+func (j *Janitor) checkArtifacts(ctx context.Context, dryRun bool) (*StoreReport, error) {
+	report := &StoreReport{Store: "artifacts", OrphanedObjects: []ObjectInfo{}, MissingObjects: []string{}}
+
+	// List records before objects: an upload finishing in between then shows
+	// up as an object without a record, which the grace period protects
+	records, err := j.db.ListAllArtifacts()
+	if err != nil {
+		return nil, err
+	}
+	objects, err := j.artifacts.List(ctx, "builds/")
+	if err != nil {
+		return nil, err
+	}
+
+	stored := make(map[string]bool, len(objects))
+	for _, object := range objects {
+		stored[object.Key] = true
+	}
+	referenced := make(map[string]bool, len(records))
+	for _, record := range records {
+		referenced[record.StorageKey] = true
+	}
+
+	cutoff := time.Now().Add(-j.gracePeriod)
+	for _, object := range objects {
+		if !referenced[object.Key] && object.ModTime.Before(cutoff) {
+			report.OrphanedObjects = append(report.OrphanedObjects, object)
+		}
+	}
+	var missing []*Artifact
+	for _, record := range records {
+		if !stored[record.StorageKey] && record.CreatedAt.Before(cutoff) {
+			report.MissingObjects = append(report.MissingObjects, record.StorageKey)
+			missing = append(missing, record)
+		}
+	}
+
+	if dryRun {
+		return report, nil
+	}
+
+	for _, object := range report.OrphanedObjects {
+		if err := j.artifacts.Delete(ctx, object.Key); err != nil {
+			j.errors.Capture("janitor", fmt.Errorf("deleting orphaned object %s: %w", object.Key, err), nil)
+			continue
+		}
+		report.Deleted++
+	}
+	for _, record := range missing {
+		if err := j.db.DeleteArtifact(record.ID); err != nil {
+			j.errors.Capture("janitor", fmt.Errorf("deleting artifact %d: %w", record.ID, err), nil)
+			continue
+		}
+		report.Deleted++
+	}
+
+	return report, nil
+}
+
+// Janitor report endpoint
+func (bs *BuildService) janitorReportHandler(w http.ResponseWriter, r *http.Request) {
+	report := bs.janitor.Last()
+	if report == nil {
+		http.Error(w, "Janitor has not run yet", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// Run janitor endpoint. Runs are dry runs unless dry_run=false is given.
+func (bs *BuildService) runJanitorHandler(w http.ResponseWriter, r *http.Request) {
+	dryRun := true
+	if value := r.URL.Query().Get("dry_run"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			http.Error(w, "dry_run must be a boolean", http.StatusBadRequest)
+			return
+		}
+		dryRun = parsed
+	}
+
+	report, err := bs.janitor.Run(r.Context(), dryRun)
+	if err != nil {
+		bs.errors.Capture("janitor", err, nil)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJanitorRun(t *testing.T) {
+	service, mockDB := setupTestService()
+	store := NewLocalArtifactStore(t.TempDir())
+	service.janitor = NewJanitor(mockDB, store, service.errors)
+
+	ctx := context.Background()
+	old := time.Now().Add(-2 * time.Hour)
+	for _, key := range []string{"builds/1/kept.txt", "builds/1/orphan.txt", "builds/2/fresh.txt"} {
+		require.NoError(t, store.Put(ctx, key, strings.NewReader("x"), 1, "text/plain"))
+	}
+	for _, key := range []string{"builds/1/kept.txt", "builds/1/orphan.txt"} {
+		require.NoError(t, os.Chtimes(filepath.Join(store.Root, key), old, old))
+	}
+
+	mockDB.On("ListAllArtifacts").Return([]*Artifact{
+		{ID: 1, StorageKey: "builds/1/kept.txt", CreatedAt: old},
+		{ID: 2, StorageKey: "builds/1/gone.txt", CreatedAt: old},
+	}, nil)
+
+	report, err := service.janitor.Run(ctx, true)
+	require.NoError(t, err)
+	require.Len(t, report.Stores, 1)
+	artifacts := report.Stores[0]
+	require.Len(t, artifacts.OrphanedObjects, 1)
+	assert.Equal(t, "builds/1/orphan.txt", artifacts.OrphanedObjects[0].Key)
+	assert.Equal(t, []string{"builds/1/gone.txt"}, artifacts.MissingObjects)
+	assert.Zero(t, artifacts.Deleted)
+	assert.Equal(t, report, service.janitor.Last())
+
+	// Dry runs leave the store untouched
+	_, err = store.Get(ctx, "builds/1/orphan.txt")
+	require.NoError(t, err)
+
+	mockDB.On("DeleteArtifact", 2).Return(nil).Once()
+
+	report, err = service.janitor.Run(ctx, false)
+	require.NoError(t, err)
+	assert.Equal(t, 2, report.Stores[0].Deleted)
+
+	_, err = store.Get(ctx, "builds/1/orphan.txt")
+	assert.ErrorIs(t, err, errArtifactNotFound)
+	_, err = store.Get(ctx, "builds/2/fresh.txt")
+	assert.NoError(t, err, "objects within the grace period are kept")
+	mockDB.AssertExpectations(t)
+}
+
+func TestJanitorHandlers(t *testing.T) {
+	service, mockDB := setupTestService()
+	service.janitor = NewJanitor(mockDB, NewLocalArtifactStore(t.TempDir()), service.errors)
+
+	rr := httptest.NewRecorder()
+	service.janitorReportHandler(rr, httptest.NewRequest("GET", "/api/v1/admin/janitor", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	rr = httptest.NewRecorder()
+	service.runJanitorHandler(rr, httptest.NewRequest("POST", "/api/v1/admin/janitor/run?dry_run=maybe", nil))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	mockDB.On("ListAllArtifacts").Return([]*Artifact{}, nil)
+
+	rr = httptest.NewRecorder()
+	service.runJanitorHandler(rr, httptest.NewRequest("POST", "/api/v1/admin/janitor/run", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	var report JanitorReport
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&report))
+	assert.True(t, report.DryRun)
+
+	rr = httptest.NewRecorder()
+	service.janitorReportHandler(rr, httptest.NewRequest("GET", "/api/v1/admin/janitor", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// jsonPathSegment is one step of a JSONPath: a member name, an array index
+// or a wildcard over all members or elements
+type jsonPathSegment struct {
+	key      string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+// jsonPath is a compiled JSONPath expression. The supported subset is the
+// root $, dotted and bracketed member names ($.build.id, $['build']), array
+// indices ($.items[0]) and wildcards ($.items[*].name, $.build.*).
+type jsonPath []jsonPathSegment
+
+// compileJSONPath parses a JSONPath expression
+func compileJSONPath(expr string) (jsonPath, error) {
+	if !strings.HasPrefix(expr, "$") {
+		return nil, fmt.Errorf("JSONPath %q must start with $", expr)
+	}
+
+	var path jsonPath
+	rest := expr[1:]
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			if strings.HasPrefix(rest, "*") {
+				path = append(path, jsonPathSegment{wildcard: true})
+				rest = rest[1:]
+				continue
+			}
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("JSONPath %q has an empty member name", expr)
+			}
+			path = append(path, jsonPathSegment{key: rest[:end]})
+			rest = rest[end:]
+		case '[':
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("JSONPath %q has an unclosed [", expr)
+			}
+			inner := rest[1:end]
+			rest = rest[end+1:]
+
+			switch {
+			case inner == "*":
+				path = append(path, jsonPathSegment{wildcard: true})
+			case len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0]:
+				path = append(path, jsonPathSegment{key: inner[1 : len(inner)-1]})
+			default:
+				index, err := strconv.Atoi(inner)
+				if err != nil || index < 0 {
+					return nil, fmt.Errorf("JSONPath %q has an invalid index [%s]", expr, inner)
+				}
+				path = append(path, jsonPathSegment{index: index, isIndex: true})
+			}
+		default:
+			return nil, fmt.Errorf("JSONPath %q has an unexpected %q", expr, rest[0])
+		}
+	}
+	return path, nil
+}
+
+// Evaluate applies the path to a document decoded with encoding/json. Paths
+// with wildcards return a list of all matches; other paths return the single
+// match, or false when there is none.
+func (p jsonPath) Evaluate(doc interface{}) (interface{}, bool) {
+	current := []interface{}{doc}
+	multiple := false
+
+	for _, segment := range p {
+		var next []interface{}
+		for _, value := range current {
+			switch v := value.(type) {
+			case map[string]interface{}:
+				if segment.wildcard {
+					for _, member := range v {
+						next = append(next, member)
+					}
+				} else if member, ok := v[segment.key]; ok && !segment.isIndex {
+					next = append(next, member)
+				}
+			case []interface{}:
+				if segment.wildcard {
+					next = append(next, v...)
+				} else if segment.isIndex && segment.index < len(v) {
+					next = append(next, v[segment.index])
+				}
+			}
+		}
+		multiple = multiple || segment.wildcard
+		current = next
+	}
+
+	if multiple {
+		if current == nil {
+			current = []interface{}{}
+		}
+		return current, true
+	}
+	if len(current) == 0 {
+		return nil, false
+	}
+	return current[0], true
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSONPath(t *testing.T) {
+	var doc interface{}
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"build": {"id": 42, "status": "failed", "project_name": "api"},
+		"steps": [{"name": "build"}, {"name": "test"}]
+	}`), &doc))
+
+	tests := []struct {
+		expr     string
+		expected interface{}
+		found    bool
+	}{
+		{"$", doc, true},
+		{"$.build.id", float64(42), true},
+		{"$['build']['status']", "failed", true},
+		{"$.steps[1].name", "test", true},
+		{"$.steps[*].name", []interface{}{"build", "test"}, true},
+		{"$.missing[*]", []interface{}{}, true},
+		{"$.build.missing", nil, false},
+		{"$.steps[5]", nil, false},
+		{"$.build[0]", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			path, err := compileJSONPath(tt.expr)
+			require.NoError(t, err)
+
+			value, found := path.Evaluate(doc)
+			assert.Equal(t, tt.found, found)
+			assert.Equal(t, tt.expected, value)
+		})
+	}
+}
+
+func TestCompileJSONPathErrors(t *testing.T) {
+	for _, expr := range []string{"build.id", "$..id", "$.steps[", "$.steps[-1]", "$.steps[x]", "$build"} {
+		_, err := compileJSONPath(expr)
+		assert.Error(t, err, expr)
+	}
+}
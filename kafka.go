@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// KafkaSink publishes build events to Kafka topics through a Kafka REST Proxy,
+// choosing the topic by the organization owning the build's repository
+type KafkaSink struct {
+	topics   map[string]string
+	endpoint string
+	username string
+	password string
+	health   *IntegrationHealth
+	client   *http.Client
+}
+
+// NewKafkaSinkFromEnv creates a Kafka sink when KAFKA_REST_URL and
+// KAFKA_TOPICS are set, or returns nil
+func NewKafkaSinkFromEnv(health *IntegrationHealth) *KafkaSink {
+	endpoint := strings.TrimSuffix(os.Getenv("KAFKA_REST_URL"), "/")
+	topics := parseOrgTargets(os.Getenv("KAFKA_TOPICS"))
+	if endpoint == "" || len(topics) == 0 {
+		return nil
+	}
+
+	return &KafkaSink{
+		topics:   topics,
+		endpoint: endpoint,
+		username: os.Getenv("KAFKA_USERNAME"),
+		password: os.Getenv("KAFKA_PASSWORD"),
+		health:   health,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Name identifies the integration
+func (ks *KafkaSink) Name() string {
+	return "kafka"
+}
+
+// kafkaRecord is a single record of a REST Proxy produce request
+type kafkaRecord struct {
+	Key   string     `json:"key"`
+	Value BuildEvent `json:"value"`
+}
+
+// Deliver produces the event to the topic of the build's organization. The
+// record is keyed by project, so each project's events stay in order on one
+// partition.
+func (ks *KafkaSink) Deliver(ctx context.Context, event BuildEvent) error {
+	topic, ok := orgTarget(ks.topics, &event.Build)
+	if !ok {
+		return nil
+	}
+	if !ks.health.Allow(ks.Name()) {
+		return errIntegrationDisabled
+	}
+
+	err := ks.produce(ctx, topic, event)
+	ks.health.Record(ks.Name(), err, &event.Build)
+	return err
+}
+
+func (ks *KafkaSink) produce(ctx context.Context, topic string, event BuildEvent) error {
+	payload, err := json.Marshal(map[string][]kafkaRecord{
+		"records": {{Key: event.Build.ProjectName, Value: event}},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", ks.endpoint+"/topics/"+url.PathEscape(topic), bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+	if ks.username != "" {
+		req.SetBasicAuth(ks.username, ks.password)
+	}
+
+	resp, err := ks.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("kafka: producing to %s: status %d: %s", topic, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	// The proxy reports per-record failures in an otherwise successful response
+	var result struct {
+		Offsets []struct {
+			ErrorCode *int   `json:"error_code"`
+			Error     string `json:"error"`
+		} `json:"offsets"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("kafka: decoding produce response: %w", err)
+	}
+	for _, offset := range result.Offsets {
+		if offset.ErrorCode != nil || offset.Error != "" {
+			return fmt.Errorf("kafka: producing to %s: %s", topic, offset.Error)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKafkaSinkDeliver(t *testing.T) {
+	type produced struct {
+		path     string
+		user     string
+		records  []kafkaRecord
+		contents string
+	}
+	var requests []produced
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct{ Records []kafkaRecord }
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		user, _, _ := r.BasicAuth()
+		requests = append(requests, produced{r.URL.Path, user, body.Records, r.Header.Get("Content-Type")})
+		switch r.URL.Path {
+		case "/topics/missing":
+			http.Error(w, `{"error_code": 40401, "message": "Topic not found"}`, http.StatusNotFound)
+		case "/topics/rejected":
+			w.Write([]byte(`{"offsets": [{"partition": null, "offset": null, "error_code": 50003, "error": "Record too large"}]}`))
+		default:
+			w.Write([]byte(`{"offsets": [{"partition": 2, "offset": 17}]}`))
+		}
+	}))
+	defer server.Close()
+
+	t.Setenv("KAFKA_REST_URL", server.URL+"/")
+	t.Setenv("KAFKA_TOPICS", "acme=build-events,globex=rejected,*=missing")
+	t.Setenv("KAFKA_USERNAME", "producer")
+	t.Setenv("KAFKA_PASSWORD", "secret")
+	service, mockDB := setupTestService()
+	sink := NewKafkaSinkFromEnv(service.integrations)
+	require.NotNil(t, sink)
+
+	mockDB.On("GetIntegration", "kafka").Return(nil, fmt.Errorf("integration not found"))
+	mockDB.On("ResetIntegrationFailures", "kafka").Return(nil).Once()
+	mockDB.On("RecordIntegrationFailure", "kafka", mock.AnythingOfType("string"), 10).
+		Return(&IntegrationState{Name: "kafka", ConsecutiveFailures: 1}, nil).Twice()
+
+	event := BuildEvent{Build: BuildRequest{ID: 42, ProjectName: "api", GitURL: "git@github.com:acme/api.git", Status: "success"}, Time: time.Now()}
+	require.NoError(t, sink.Deliver(context.Background(), event))
+
+	require.Len(t, requests, 1)
+	assert.Equal(t, "/topics/build-events", requests[0].path)
+	assert.Equal(t, "producer", requests[0].user)
+	assert.Equal(t, "application/vnd.kafka.json.v2+json", requests[0].contents)
+	require.Len(t, requests[0].records, 1)
+	assert.Equal(t, "api", requests[0].records[0].Key)
+	assert.Equal(t, 42, requests[0].records[0].Value.Build.ID)
+
+	event.Build.GitURL = "https://github.com/globex/api.git"
+	err := sink.Deliver(context.Background(), event)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Record too large")
+
+	event.Build.GitURL = "https://github.com/initech/api.git"
+	err = sink.Deliver(context.Background(), event)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "status 404")
+	mockDB.AssertExpectations(t)
+}
+
+func TestNewKafkaSinkFromEnvRequiresTopics(t *testing.T) {
+	t.Setenv("KAFKA_REST_URL", "http://kafka-rest:8082")
+	t.Setenv("KAFKA_TOPICS", "")
+	assert.Nil(t, NewKafkaSinkFromEnv(nil))
+}
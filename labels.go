@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Labels are arbitrary key/value pairs on builds and projects, such as
+// team=payments, for slicing large installations. Builds start with the
+// labels of their project; their own labels take precedence.
+type Labels map[string]string
+
+const (
+	maxLabels           = 32
+	maxLabelValueLength = 255
+)
+
+// labelKeyPattern allows keys such as "team", "release-train" or
+// "example.com/service"
+var labelKeyPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._/-]{0,62}$`)
+
+// validate checks the number of labels and their keys and values
+func (l Labels) validate() error {
+	if len(l) > maxLabels {
+		return fmt.Errorf("at most %d labels are allowed", maxLabels)
+	}
+	for key, value := range l {
+		if !labelKeyPattern.MatchString(key) {
+			return fmt.Errorf("label key %q must be 1-63 letters, digits, '.', '_', '/' or '-', starting with a letter or digit", key)
+		}
+		if len(value) > maxLabelValueLength {
+			return fmt.Errorf("label %q must be at most %d characters", key, maxLabelValueLength)
+		}
+	}
+	return nil
+}
+
+// jsonb encodes the labels for a JSONB column, an empty object when there
+// are none
+func (l Labels) jsonb() []byte {
+	if l == nil {
+		l = Labels{}
+	}
+	encoded, _ := json.Marshal(l)
+	return encoded
+}
+
+// labelFilter reads the ?label=key:value parameters of a list request, each
+// of which a listed build or project must have. It responds with 400 and
+// reports false when one is malformed.
+func labelFilter(w http.ResponseWriter, r *http.Request) (Labels, bool) {
+	params := r.URL.Query()["label"]
+	if len(params) == 0 {
+		return nil, true
+	}
+
+	filter := make(Labels, len(params))
+	for _, param := range params {
+		key, value, ok := strings.Cut(param, ":")
+		if !ok || !labelKeyPattern.MatchString(key) {
+			http.Error(w, "label must be key:value, e.g. label=team:payments", http.StatusBadRequest)
+			return nil, false
+		}
+		if existing, seen := filter[key]; seen && existing != value {
+			// No build has two values for a key
+			http.Error(w, fmt.Sprintf("label %q is given more than once", key), http.StatusBadRequest)
+			return nil, false
+		}
+		filter[key] = value
+	}
+	return filter, true
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLabelsValidate(t *testing.T) {
+	assert.NoError(t, Labels(nil).validate())
+	assert.NoError(t, Labels{"team": "payments", "example.com/release-train": "2026.10", "empty": ""}.validate())
+	assert.Error(t, Labels{"": "payments"}.validate())
+	assert.Error(t, Labels{"-team": "payments"}.validate())
+	assert.Error(t, Labels{"team name": "payments"}.validate())
+	assert.Error(t, Labels{strings.Repeat("k", 64): "v"}.validate())
+	assert.Error(t, Labels{"team": strings.Repeat("v", maxLabelValueLength+1)}.validate())
+
+	many := Labels{}
+	for i := 0; i <= maxLabels; i++ {
+		many[fmt.Sprintf("key-%d", i)] = "v"
+	}
+	assert.Error(t, many.validate())
+
+	assert.JSONEq(t, `{}`, string(Labels(nil).jsonb()))
+	assert.JSONEq(t, `{"team": "payments"}`, string(Labels{"team": "payments"}.jsonb()))
+}
+
+func TestLabelFilter(t *testing.T) {
+	filter := func(query string) (Labels, int) {
+		rr := httptest.NewRecorder()
+		labels, ok := labelFilter(rr, httptest.NewRequest("GET", "/api/v1/builds"+query, nil))
+		assert.Equal(t, ok, rr.Code == http.StatusOK)
+		return labels, rr.Code
+	}
+
+	labels, code := filter("")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Nil(t, labels)
+
+	labels, _ = filter("?label=team:payments&label=train:2026.10:rc1")
+	assert.Equal(t, Labels{"team": "payments", "train": "2026.10:rc1"}, labels)
+
+	labels, _ = filter("?label=team:&label=team:")
+	assert.Equal(t, Labels{"team": ""}, labels)
+
+	_, code = filter("?label=team")
+	assert.Equal(t, http.StatusBadRequest, code)
+	_, code = filter("?label=:payments")
+	assert.Equal(t, http.StatusBadRequest, code)
+	_, code = filter("?label=team:payments&label=team:search")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestListBuildsAndProjectsByLabel(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.On("ListBuilds", false, "", Labels{"team": "payments", "service": "api"}).
+		Return([]*BuildRequest{{ID: 1, Labels: Labels{"team": "payments", "service": "api"}}}, nil).Once()
+	mockDB.On("ListProjects", "", Labels{"team": "payments"}).
+		Return([]*Project{{ID: 2, Name: "checkout", Labels: Labels{"team": "payments"}}}, nil).Once()
+
+	rr := httptest.NewRecorder()
+	service.listBuildsHandler(rr, httptest.NewRequest("GET", "/api/v1/builds?label=team:payments&label=service:api", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"labels":{"service":"api","team":"payments"}`)
+
+	rr = httptest.NewRecorder()
+	service.listProjectsHandler(rr, httptest.NewRequest("GET", "/api/v1/projects?label=team:payments", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"name":"checkout"`)
+
+	rr = httptest.NewRecorder()
+	service.listBuildsHandler(rr, httptest.NewRequest("GET", "/api/v1/builds?label=payments", nil))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	mockDB.AssertExpectations(t)
+}
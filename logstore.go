@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// errLogNotFound is returned by log stores for builds without a stored log
+var errLogNotFound = errors.New("log not found")
+
+// LogStore keeps the complete output of builds, which can be far larger than
+// the tails kept with their stages in Postgres
+type LogStore interface {
+	// Create starts storing a log. Output written to it is uploaded while the
+	// build runs, and the log becomes readable once Close completes the
+	// upload. Writes never fail: after an error further output is discarded
+	// and Close reports the error.
+	Create(ctx context.Context, key string) (io.WriteCloser, error)
+	// Size returns the length of a stored log
+	Size(ctx context.Context, key string) (int64, error)
+	// ReadRange reads length bytes of a stored log from offset
+	ReadRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+}
+
+// NewLogStoreFromEnv returns the store selected by the LOG_STORE environment
+// variable, or nil for LOG_STORE=none
+func NewLogStoreFromEnv() LogStore {
+	switch os.Getenv("LOG_STORE") {
+	case "none":
+		return nil
+	case "s3":
+		return NewS3LogStore(NewS3ArtifactStoreFromEnv())
+	case "gcs":
+		return NewGCSLogStore(NewGCSArtifactStoreFromEnv())
+	default:
+		return NewLocalLogStore(os.Getenv("LOG_DIR"))
+	}
+}
+
+// buildLogKey is the key of a build's log
+func buildLogKey(buildID int) string {
+	return fmt.Sprintf("logs/%d.log", buildID)
+}
+
+// LocalLogStore keeps logs on the local filesystem
+type LocalLogStore struct {
+	Root string
+}
+
+// NewLocalLogStore creates a store rooted at the given directory
+func NewLocalLogStore(root string) *LocalLogStore {
+	if root == "" {
+		root = filepath.Join(os.TempDir(), "build-service-logs")
+	}
+	return &LocalLogStore{Root: root}
+}
+
+func (ls *LocalLogStore) path(key string) string {
+	return filepath.Join(ls.Root, filepath.FromSlash(key))
+}
+
+// Create writes the log to a temporary file that Close renames into place
+func (ls *LocalLogStore) Create(ctx context.Context, key string) (io.WriteCloser, error) {
+	dest := ls.path(key)
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dest), ".log-*")
+	if err != nil {
+		return nil, err
+	}
+	return &localLogWriter{file: tmp, dest: dest}, nil
+}
+
+// Size returns the length of a stored log
+func (ls *LocalLogStore) Size(ctx context.Context, key string) (int64, error) {
+	info, err := os.Stat(ls.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, errLogNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// ReadRange reads part of a stored log
+func (ls *LocalLogStore) ReadRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	f, err := os.Open(ls.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errLogNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(f, offset, length), f}, nil
+}
+
+// localLogWriter writes a log to a temporary file
+type localLogWriter struct {
+	file *os.File
+	dest string
+	err  error
+}
+
+func (lw *localLogWriter) Write(p []byte) (int, error) {
+	if lw.err == nil {
+		_, lw.err = lw.file.Write(p)
+	}
+	return len(p), nil
+}
+
+func (lw *localLogWriter) Close() error {
+	defer os.Remove(lw.file.Name())
+	if err := lw.file.Close(); lw.err == nil {
+		lw.err = err
+	}
+	if lw.err != nil {
+		return lw.err
+	}
+	return os.Rename(lw.file.Name(), lw.dest)
+}
+
+// partUpload is a log upload made of parts of a fixed size
+type partUpload interface {
+	uploadPart(part []byte) error
+	// complete uploads the output left over after the last full part
+	complete(rest []byte) error
+	abort()
+}
+
+// partUploader buffers output into parts, which a background goroutine
+// uploads so a slow store doesn't hold up the build writing to it
+type partUploader struct {
+	upload   partUpload
+	partSize int
+	buf      []byte
+	parts    chan []byte
+	done     chan struct{}
+
+	mu  sync.Mutex
+	err error
+}
+
+func newPartUploader(partSize int, upload partUpload) *partUploader {
+	pu := &partUploader{
+		upload:   upload,
+		partSize: partSize,
+		parts:    make(chan []byte, 1),
+		done:     make(chan struct{}),
+	}
+	go pu.run()
+	return pu
+}
+
+func (pu *partUploader) run() {
+	defer close(pu.done)
+	for part := range pu.parts {
+		if pu.failed() != nil {
+			continue
+		}
+		if err := pu.upload.uploadPart(part); err != nil {
+			pu.mu.Lock()
+			pu.err = err
+			pu.mu.Unlock()
+		}
+	}
+}
+
+func (pu *partUploader) failed() error {
+	pu.mu.Lock()
+	defer pu.mu.Unlock()
+	return pu.err
+}
+
+func (pu *partUploader) Write(p []byte) (int, error) {
+	if pu.failed() != nil {
+		return len(p), nil
+	}
+	pu.buf = append(pu.buf, p...)
+	for len(pu.buf) >= pu.partSize {
+		part := make([]byte, pu.partSize)
+		copy(part, pu.buf)
+		pu.buf = pu.buf[pu.partSize:]
+		pu.parts <- part
+	}
+	return len(p), nil
+}
+
+// Close waits for the uploaded parts and completes the upload, or aborts it
+// when a part failed
+func (pu *partUploader) Close() error {
+	close(pu.parts)
+	<-pu.done
+	if err := pu.failed(); err != nil {
+		pu.upload.abort()
+		return err
+	}
+	if err := pu.upload.complete(pu.buf); err != nil {
+		pu.upload.abort()
+		return err
+	}
+	return nil
+}
+
+// parseByteRange parses a Range header asking for a single range of a log of
+// the given size, returning its offset and length. ok is false when the
+// header asks for something else, such as several ranges, in which case the
+// whole log is served; err is set for ranges outside the log.
+func parseByteRange(header string, size int64) (offset, length int64, ok bool, err error) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false, nil
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, 0, false, nil
+	}
+
+	if first == "" {
+		// The last n bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 || size == 0 {
+			return 0, 0, false, fmt.Errorf("invalid range")
+		}
+		n = min(n, size)
+		return size - n, n, true, nil
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false, fmt.Errorf("invalid range")
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return 0, 0, false, fmt.Errorf("invalid range")
+		}
+		end = min(end, size-1)
+	}
+	return start, end - start + 1, true, nil
+}
+
+// Build logs endpoint. Serves a finished build's complete output as plain
+// text, or the single byte range asked for with a Range header.
+func (bs *BuildService) buildLogsHandler(w http.ResponseWriter, r *http.Request) {
+	build, ok := bs.artifactBuild(w, r)
+	if !ok {
+		return
+	}
+	if bs.logStore == nil {
+		http.Error(w, "Log not found", http.StatusNotFound)
+		return
+	}
+
+	key := buildLogKey(build.ID)
+	size, err := bs.logStore.Size(r.Context(), key)
+	if err != nil {
+		if errors.Is(err, errLogNotFound) {
+			http.Error(w, "Log not found", http.StatusNotFound)
+			return
+		}
+		bs.errors.Capture("logs", fmt.Errorf("reading %s: %w", key, err), build)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Accept-Ranges", "bytes")
+	offset, length, partial, err := parseByteRange(r.Header.Get("Range"), size)
+	if err != nil {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		http.Error(w, "Range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	if !partial {
+		offset, length = 0, size
+	}
+	if length == 0 {
+		return
+	}
+
+	content, err := bs.logStore.ReadRange(r.Context(), key, offset, length)
+	if err != nil {
+		bs.errors.Capture("logs", fmt.Errorf("reading %s: %w", key, err), build)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer content.Close()
+
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	if partial {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, size))
+		w.WriteHeader(http.StatusPartialContent)
+	}
+	if _, err := io.CopyN(w, content, length); err != nil {
+		log.Printf("Error serving log of build %d: %v", build.ID, err)
+	}
+}
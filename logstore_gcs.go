@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// gcsChunkSize is the size of the chunks logs are uploaded in; resumable
+// uploads need chunks in multiples of 256 KiB
+const gcsChunkSize = 8 << 20
+
+// GCSLogStore keeps logs in the bucket configured for GCS artifacts. Logs are
+// streamed with a resumable upload as the build runs.
+type GCSLogStore struct {
+	gcs *GCSArtifactStore
+	// chunkSize is the size of the chunks output is uploaded in
+	chunkSize int
+}
+
+// NewGCSLogStore creates a log store using the given GCS client settings
+func NewGCSLogStore(gcs *GCSArtifactStore) *GCSLogStore {
+	return &GCSLogStore{gcs: gcs, chunkSize: gcsChunkSize}
+}
+
+// Create starts uploading a log. Output small enough for a single chunk is
+// uploaded with one media upload on Close.
+func (ls *GCSLogStore) Create(ctx context.Context, key string) (io.WriteCloser, error) {
+	return newPartUploader(ls.chunkSize, &gcsLogUpload{ctx: ctx, gcs: ls.gcs, key: key}), nil
+}
+
+// Size returns the length of a stored log from its metadata
+func (ls *GCSLogStore) Size(ctx context.Context, key string) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", ls.gcs.objectPath(key), nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := ls.gcs.do(req)
+	if errors.Is(err, errArtifactNotFound) {
+		return 0, errLogNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	var object struct {
+		Size string `json:"size"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&object); err != nil {
+		return 0, fmt.Errorf("decoding object metadata: %w", err)
+	}
+	return strconv.ParseInt(object.Size, 10, 64)
+}
+
+// ReadRange reads part of a stored log with a ranged download
+func (ls *GCSLogStore) ReadRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", ls.gcs.objectPath(key)+"?alt=media", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	resp, err := ls.gcs.do(req)
+	if errors.Is(err, errArtifactNotFound) {
+		return nil, errLogNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// gcsLogUpload uploads one log, as a resumable upload once it outgrows a chunk
+type gcsLogUpload struct {
+	ctx     context.Context
+	gcs     *GCSArtifactStore
+	key     string
+	session string
+	offset  int64
+}
+
+// uploadPart uploads the next chunk, starting the resumable upload first
+func (lu *gcsLogUpload) uploadPart(chunk []byte) error {
+	if lu.session == "" {
+		query := url.Values{"uploadType": {"resumable"}, "name": {lu.gcs.Prefix + lu.key}}
+		target := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?%s", lu.gcs.Endpoint, url.PathEscape(lu.gcs.Bucket), canonicalQuery(query))
+		req, err := http.NewRequestWithContext(lu.ctx, "POST", target, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("X-Upload-Content-Type", "text/plain; charset=utf-8")
+		resp, err := lu.gcs.do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if lu.session = resp.Header.Get("Location"); lu.session == "" {
+			return fmt.Errorf("gcs resumable upload of %s returned no session", lu.key)
+		}
+	}
+	return lu.put(chunk, "*")
+}
+
+// complete uploads the remaining output, finishing the resumable upload if
+// one was started
+func (lu *gcsLogUpload) complete(rest []byte) error {
+	if lu.session == "" {
+		return lu.gcs.Put(lu.ctx, lu.key, bytes.NewReader(rest), int64(len(rest)), "text/plain; charset=utf-8")
+	}
+	return lu.put(rest, strconv.FormatInt(lu.offset+int64(len(rest)), 10))
+}
+
+// put uploads a chunk of the resumable upload. GCS answers 308 to every
+// chunk but the last, which gives the total size.
+func (lu *gcsLogUpload) put(chunk []byte, total string) error {
+	req, err := http.NewRequestWithContext(lu.ctx, "PUT", lu.session, bytes.NewReader(chunk))
+	if err != nil {
+		return err
+	}
+	if len(chunk) == 0 {
+		req.Header.Set("Content-Range", "bytes */"+total)
+	} else {
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%s", lu.offset, lu.offset+int64(len(chunk))-1, total))
+	}
+	if err := lu.gcs.authorize(req); err != nil {
+		return err
+	}
+
+	resp, err := lu.gcs.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	final := total != "*"
+	if (final && resp.StatusCode >= 300) || (!final && resp.StatusCode != http.StatusPermanentRedirect) {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("gcs upload of %s: status %d: %s", lu.key, resp.StatusCode, body)
+	}
+	lu.offset += int64(len(chunk))
+	return nil
+}
+
+// abort cancels a failed resumable upload
+func (lu *gcsLogUpload) abort() {
+	if lu.session == "" {
+		return
+	}
+	req, err := http.NewRequestWithContext(lu.ctx, "DELETE", lu.session, nil)
+	if err != nil || lu.gcs.authorize(req) != nil {
+		return
+	}
+	if resp, err := lu.gcs.client.Do(req); err == nil {
+		resp.Body.Close()
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// s3MinPartSize is the smallest part S3 accepts in a multipart upload, other
+// than the last
+const s3MinPartSize = 5 << 20
+
+// S3LogStore keeps logs in the bucket configured for S3 artifacts. Logs are
+// streamed with a multipart upload as the build runs, so a long build's
+// output is never held in memory.
+type S3LogStore struct {
+	s3 *S3ArtifactStore
+	// partSize is the size of the parts output is uploaded in
+	partSize int
+}
+
+// NewS3LogStore creates a log store using the given S3 client settings
+func NewS3LogStore(s3 *S3ArtifactStore) *S3LogStore {
+	return &S3LogStore{s3: s3, partSize: s3MinPartSize}
+}
+
+// Create starts uploading a log. Output small enough for a single part is
+// uploaded with one PUT on Close.
+func (ls *S3LogStore) Create(ctx context.Context, key string) (io.WriteCloser, error) {
+	return newPartUploader(ls.partSize, &s3LogUpload{ctx: ctx, s3: ls.s3, key: key}), nil
+}
+
+// Size returns the length of a stored log
+func (ls *S3LogStore) Size(ctx context.Context, key string) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", ls.s3.objectURL(key), nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := ls.s3.do(req)
+	if errors.Is(err, errArtifactNotFound) {
+		return 0, errLogNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.ContentLength, nil
+}
+
+// ReadRange reads part of a stored log with a ranged GET
+func (ls *S3LogStore) ReadRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", ls.s3.objectURL(key), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	resp, err := ls.s3.do(req)
+	if errors.Is(err, errArtifactNotFound) {
+		return nil, errLogNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// s3LogUpload uploads one log, as a multipart upload once it outgrows a part
+type s3LogUpload struct {
+	ctx      context.Context
+	s3       *S3ArtifactStore
+	key      string
+	uploadID string
+	etags    []string
+}
+
+// uploadPart uploads the next part, starting the multipart upload first
+func (lu *s3LogUpload) uploadPart(part []byte) error {
+	if lu.uploadID == "" {
+		resp, err := lu.request("POST", url.Values{"uploads": {""}}, nil)
+		if err != nil {
+			return err
+		}
+		var result struct {
+			UploadID string `xml:"UploadId"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("decoding multipart upload: %w", err)
+		}
+		lu.uploadID = result.UploadID
+	}
+
+	number := strconv.Itoa(len(lu.etags) + 1)
+	resp, err := lu.request("PUT", url.Values{"partNumber": {number}, "uploadId": {lu.uploadID}}, part)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	lu.etags = append(lu.etags, resp.Header.Get("ETag"))
+	return nil
+}
+
+// complete uploads the remaining output, finishing the multipart upload if
+// one was started
+func (lu *s3LogUpload) complete(rest []byte) error {
+	if lu.uploadID == "" {
+		resp, err := lu.request("PUT", nil, rest)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+	if len(rest) > 0 {
+		if err := lu.uploadPart(rest); err != nil {
+			return err
+		}
+	}
+
+	type part struct {
+		PartNumber int
+		ETag       string
+	}
+	upload := struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}{}
+	for i, etag := range lu.etags {
+		upload.Parts = append(upload.Parts, part{PartNumber: i + 1, ETag: etag})
+	}
+	body, err := xml.Marshal(upload)
+	if err != nil {
+		return err
+	}
+	resp, err := lu.request("POST", url.Values{"uploadId": {lu.uploadID}}, body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// abort discards the parts of a failed multipart upload
+func (lu *s3LogUpload) abort() {
+	if lu.uploadID == "" {
+		return
+	}
+	if resp, err := lu.request("DELETE", url.Values{"uploadId": {lu.uploadID}}, nil); err == nil {
+		resp.Body.Close()
+	}
+}
+
+func (lu *s3LogUpload) request(method string, query url.Values, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(lu.ctx, method, lu.s3.objectURL(lu.key), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.URL.RawQuery = canonicalQuery(query)
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	return lu.s3.do(req)
+}
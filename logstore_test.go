@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readLog reads a range of a stored log
+func readLog(t *testing.T, store LogStore, key string, offset, length int64) string {
+	content, err := store.ReadRange(context.Background(), key, offset, length)
+	require.NoError(t, err)
+	defer content.Close()
+	data, err := io.ReadAll(content)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestLocalLogStore(t *testing.T) {
+	store := NewLocalLogStore(t.TempDir())
+	ctx := context.Background()
+
+	_, err := store.Size(ctx, buildLogKey(1))
+	assert.ErrorIs(t, err, errLogNotFound)
+
+	w, err := store.Create(ctx, buildLogKey(1))
+	require.NoError(t, err)
+	fmt.Fprintln(w, "cloning")
+	// Logs aren't readable until they're complete
+	_, err = store.Size(ctx, buildLogKey(1))
+	assert.ErrorIs(t, err, errLogNotFound)
+	fmt.Fprintln(w, "building")
+	require.NoError(t, w.Close())
+
+	size, err := store.Size(ctx, buildLogKey(1))
+	require.NoError(t, err)
+	assert.Equal(t, int64(17), size)
+	assert.Equal(t, "cloning\nbuilding\n", readLog(t, store, buildLogKey(1), 0, size))
+	assert.Equal(t, "building", readLog(t, store, buildLogKey(1), 8, 8))
+
+	_, err = store.ReadRange(ctx, buildLogKey(2), 0, 1)
+	assert.ErrorIs(t, err, errLogNotFound)
+}
+
+func TestParseByteRange(t *testing.T) {
+	tests := []struct {
+		header         string
+		offset, length int64
+		ok, invalid    bool
+	}{
+		{header: ""},
+		{header: "bytes=0-99", offset: 0, length: 100, ok: true},
+		{header: "bytes=10-", offset: 10, length: 990, ok: true},
+		{header: "bytes=990-5000", offset: 990, length: 10, ok: true},
+		{header: "bytes=-100", offset: 900, length: 100, ok: true},
+		{header: "bytes=-5000", offset: 0, length: 1000, ok: true},
+		{header: "bytes=0-9,20-29"},
+		{header: "items=0-9"},
+		{header: "bytes=1000-", invalid: true},
+		{header: "bytes=20-10", invalid: true},
+		{header: "bytes=-0", invalid: true},
+		{header: "bytes=x-", invalid: true},
+	}
+	for _, tt := range tests {
+		offset, length, ok, err := parseByteRange(tt.header, 1000)
+		if tt.invalid {
+			assert.Error(t, err, tt.header)
+			continue
+		}
+		require.NoError(t, err, tt.header)
+		assert.Equal(t, tt.ok, ok, tt.header)
+		assert.Equal(t, tt.offset, offset, tt.header)
+		assert.Equal(t, tt.length, length, tt.header)
+	}
+
+	_, _, _, err := parseByteRange("bytes=-10", 0)
+	assert.Error(t, err)
+}
+
+func TestBuildLogsHandler(t *testing.T) {
+	service, mockDB := setupTestService()
+	store := NewLocalLogStore(t.TempDir())
+	service.logStore = store
+	w, err := store.Create(context.Background(), buildLogKey(1))
+	require.NoError(t, err)
+	io.WriteString(w, "cloning\nbuilding\nok\n")
+	require.NoError(t, w.Close())
+
+	mockDB.On("GetBuild", 1).Return(&BuildRequest{ID: 1, Status: "success"}, nil)
+	mockDB.On("GetBuild", 2).Return(&BuildRequest{ID: 2, Status: "running"}, nil)
+	mockDB.On("GetBuild", 3).Return(nil, fmt.Errorf("build not found"))
+
+	get := func(id, byteRange string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/v1/builds/"+id+"/logs", nil)
+		req = mux.SetURLVars(req, map[string]string{"id": id})
+		if byteRange != "" {
+			req.Header.Set("Range", byteRange)
+		}
+		rr := httptest.NewRecorder()
+		service.buildLogsHandler(rr, req)
+		return rr
+	}
+
+	rr := get("1", "")
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "cloning\nbuilding\nok\n", rr.Body.String())
+	assert.Equal(t, "bytes", rr.Header().Get("Accept-Ranges"))
+	assert.Equal(t, "text/plain; charset=utf-8", rr.Header().Get("Content-Type"))
+
+	// Clients tailing a log ask for what they haven't read yet
+	rr = get("1", "bytes=8-")
+	require.Equal(t, http.StatusPartialContent, rr.Code)
+	assert.Equal(t, "building\nok\n", rr.Body.String())
+	assert.Equal(t, "bytes 8-19/20", rr.Header().Get("Content-Range"))
+
+	rr = get("1", "bytes=20-")
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, rr.Code)
+	assert.Equal(t, "bytes */20", rr.Header().Get("Content-Range"))
+
+	// Logs are stored once the build finishes
+	assert.Equal(t, http.StatusNotFound, get("2", "").Code)
+	assert.Equal(t, http.StatusNotFound, get("3", "").Code)
+	assert.Equal(t, http.StatusBadRequest, get("x", "").Code)
+
+	service.logStore = nil
+	assert.Equal(t, http.StatusNotFound, get("1", "").Code)
+}
+
+func TestNewLogStoreFromEnv(t *testing.T) {
+	t.Setenv("LOG_STORE", "none")
+	assert.Nil(t, NewLogStoreFromEnv())
+	t.Setenv("LOG_STORE", "s3")
+	assert.IsType(t, &S3LogStore{}, NewLogStoreFromEnv())
+	t.Setenv("LOG_STORE", "gcs")
+	assert.IsType(t, &GCSLogStore{}, NewLogStoreFromEnv())
+	t.Setenv("LOG_STORE", "")
+	t.Setenv("LOG_DIR", "/var/log/builds")
+	assert.Equal(t, &LocalLogStore{Root: "/var/log/builds"}, NewLogStoreFromEnv())
+}
+
+func TestS3LogStore(t *testing.T) {
+	var mu sync.Mutex
+	objects := make(map[string]string)
+	uploads := make(map[string][]string)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		assert.True(t, strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 "))
+		query := r.URL.Query()
+		body, _ := io.ReadAll(r.Body)
+
+		switch {
+		case r.Method == "POST" && query.Has("uploads"):
+			uploads["upload-1"] = nil
+			w.Write([]byte(`<InitiateMultipartUploadResult><UploadId>upload-1</UploadId></InitiateMultipartUploadResult>`))
+		case r.Method == "PUT" && query.Has("partNumber"):
+			number, _ := strconv.Atoi(query.Get("partNumber"))
+			parts := uploads[query.Get("uploadId")]
+			assert.Equal(t, len(parts)+1, number)
+			uploads[query.Get("uploadId")] = append(parts, string(body))
+			w.Header().Set("ETag", fmt.Sprintf(`"etag-%d"`, number))
+		case r.Method == "POST" && query.Has("uploadId"):
+			var completed struct {
+				Parts []struct {
+					PartNumber int
+					ETag       string
+				} `xml:"Part"`
+			}
+			assert.NoError(t, xml.Unmarshal(body, &completed))
+			parts := uploads[query.Get("uploadId")]
+			assert.Len(t, completed.Parts, len(parts))
+			for i, part := range completed.Parts {
+				assert.Equal(t, fmt.Sprintf(`"etag-%d"`, i+1), part.ETag)
+			}
+			objects[r.URL.Path] = strings.Join(parts, "")
+			delete(uploads, query.Get("uploadId"))
+		case r.Method == "DELETE" && query.Has("uploadId"):
+			delete(uploads, query.Get("uploadId"))
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == "PUT":
+			objects[r.URL.Path] = string(body)
+		case r.Method == "HEAD" || r.Method == "GET":
+			object, ok := objects[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if r.Method == "HEAD" {
+				w.Header().Set("Content-Length", strconv.Itoa(len(object)))
+				return
+			}
+			var first, last int
+			fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &first, &last)
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write([]byte(object[first : last+1]))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		}
+	}))
+	defer server.Close()
+
+	t.Setenv("S3_ENDPOINT", server.URL)
+	t.Setenv("S3_BUCKET", "logs")
+	t.Setenv("S3_REGION", "eu-west-1")
+	t.Setenv("S3_ACCESS_KEY_ID", "AKID")
+	t.Setenv("S3_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("S3_PREFIX", "ci/")
+	s3 := NewS3ArtifactStoreFromEnv()
+	s3.now = func() time.Time { return time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC) }
+	store := NewS3LogStore(s3)
+	store.partSize = 8
+	ctx := context.Background()
+
+	// Small logs are uploaded in one go
+	w, err := store.Create(ctx, buildLogKey(1))
+	require.NoError(t, err)
+	io.WriteString(w, "ok\n")
+	require.NoError(t, w.Close())
+	assert.Equal(t, "ok\n", objects["/logs/ci/logs/1.log"])
+
+	// Larger ones part by part as they're written
+	w, err = store.Create(ctx, buildLogKey(2))
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		fmt.Fprintf(w, "line %d\n", i)
+	}
+	require.NoError(t, w.Close())
+	assert.Empty(t, uploads)
+	content := "line 0\nline 1\nline 2\nline 3\nline 4\n"
+	assert.Equal(t, content, objects["/logs/ci/logs/2.log"])
+
+	size, err := store.Size(ctx, buildLogKey(2))
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), size)
+	assert.Equal(t, "line 3\n", readLog(t, store, buildLogKey(2), 21, 7))
+
+	_, err = store.Size(ctx, buildLogKey(3))
+	assert.ErrorIs(t, err, errLogNotFound)
+	_, err = store.ReadRange(ctx, buildLogKey(3), 0, 1)
+	assert.ErrorIs(t, err, errLogNotFound)
+}
+
+func TestS3LogStoreAbortsFailedUploads(t *testing.T) {
+	aborted := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		switch {
+		case r.Method == "POST" && query.Has("uploads"):
+			w.Write([]byte(`<InitiateMultipartUploadResult><UploadId>upload-1</UploadId></InitiateMultipartUploadResult>`))
+		case r.Method == "PUT":
+			w.WriteHeader(http.StatusInternalServerError)
+		case r.Method == "DELETE":
+			aborted <- query.Get("uploadId")
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		}
+	}))
+	defer server.Close()
+
+	t.Setenv("S3_ENDPOINT", server.URL)
+	t.Setenv("S3_BUCKET", "logs")
+	store := NewS3LogStore(NewS3ArtifactStoreFromEnv())
+	store.partSize = 4
+
+	w, err := store.Create(context.Background(), buildLogKey(1))
+	require.NoError(t, err)
+	// Writes carry on after the failure so the build isn't affected
+	for i := 0; i < 4; i++ {
+		n, err := io.WriteString(w, "line\n")
+		assert.NoError(t, err)
+		assert.Equal(t, 5, n)
+	}
+	assert.Error(t, w.Close())
+	assert.Equal(t, "upload-1", <-aborted)
+}
+
+func TestGCSLogStore(t *testing.T) {
+	var mu sync.Mutex
+	objects := make(map[string]string)
+	var session string
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		body, _ := io.ReadAll(r.Body)
+
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/upload/storage/v1/b/logs/o":
+			name := r.URL.Query().Get("name")
+			switch r.URL.Query().Get("uploadType") {
+			case "media":
+				objects[name] = string(body)
+			case "resumable":
+				session = ""
+				w.Header().Set("Location", server.URL+"/upload/session?name="+name)
+			}
+			w.Write([]byte(`{}`))
+		case r.Method == "PUT" && r.URL.Path == "/upload/session":
+			var first, last int
+			var total string
+			contentRange := r.Header.Get("Content-Range")
+			if _, err := fmt.Sscanf(contentRange, "bytes %d-%d/%s", &first, &last, &total); err != nil {
+				fmt.Sscanf(contentRange, "bytes */%s", &total)
+			} else {
+				assert.Equal(t, len(session), first, contentRange)
+				assert.Equal(t, len(body), last-first+1, contentRange)
+			}
+			session += string(body)
+			if total == "*" {
+				w.WriteHeader(http.StatusPermanentRedirect)
+				return
+			}
+			assert.Equal(t, strconv.Itoa(len(session)), total)
+			objects[r.URL.Query().Get("name")] = session
+			w.Write([]byte(`{}`))
+		case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/storage/v1/b/logs/o/"):
+			object, ok := objects[strings.TrimPrefix(r.URL.Path, "/storage/v1/b/logs/o/")]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if r.URL.Query().Get("alt") != "media" {
+				fmt.Fprintf(w, `{"size": "%d"}`, len(object))
+				return
+			}
+			var first, last int
+			fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &first, &last)
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write([]byte(object[first : last+1]))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		}
+	}))
+	defer server.Close()
+
+	t.Setenv("STORAGE_EMULATOR_HOST", strings.TrimPrefix(server.URL, "http://"))
+	t.Setenv("GCS_BUCKET", "logs")
+	t.Setenv("GCS_PREFIX", "ci/")
+	store := NewGCSLogStore(NewGCSArtifactStoreFromEnv())
+	store.chunkSize = 7
+	ctx := context.Background()
+
+	w, err := store.Create(ctx, buildLogKey(1))
+	require.NoError(t, err)
+	io.WriteString(w, "ok\n")
+	require.NoError(t, w.Close())
+	assert.Equal(t, "ok\n", objects["ci/logs/1.log"])
+
+	for id, lines := range map[int]int{2: 5, 3: 4} {
+		w, err := store.Create(ctx, buildLogKey(id))
+		require.NoError(t, err)
+		var content string
+		for i := 0; i < lines; i++ {
+			line := fmt.Sprintf("line %d\n", i)
+			io.WriteString(w, line)
+			content += line
+		}
+		require.NoError(t, w.Close())
+		// Logs ending on a chunk boundary finish with an empty chunk
+		assert.Equal(t, content, objects[fmt.Sprintf("ci/logs/%d.log", id)])
+
+		size, err := store.Size(ctx, buildLogKey(id))
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(content)), size)
+		assert.Equal(t, "line 1\n", readLog(t, store, buildLogKey(id), 7, 7))
+	}
+
+	_, err = store.Size(ctx, buildLogKey(4))
+	assert.ErrorIs(t, err, errLogNotFound)
+}
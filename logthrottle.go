@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Why a build's log was truncated, recorded as its log_truncation
+const (
+	// logTruncatedSize is for logs that reached MAX_LOG_BYTES
+	logTruncatedSize = "size"
+	// logTruncatedRate is for logs with lines dropped over LOG_LINE_RATE
+	logTruncatedRate = "rate"
+)
+
+// logOverflowArtifact is the artifact holding the output left out of a
+// truncated log
+const logOverflowArtifact = "build-log-overflow.txt"
+
+// LogLimits caps the output of a build that reaches its live log, stages and
+// stored log, protecting the service from builds that print gigabytes
+type LogLimits struct {
+	// MaxBytes is the size a log is truncated at; zero for no limit
+	MaxBytes int64
+	// LinesPerSecond is how many lines a second reach the log before the
+	// rest are dropped; zero for no limit
+	LinesPerSecond int
+	// MaxOverflowBytes caps the output kept in the overflow artifact
+	MaxOverflowBytes int64
+}
+
+// LogLimitsFromEnv reads the log limits from MAX_LOG_BYTES, LOG_LINE_RATE and
+// MAX_LOG_OVERFLOW_BYTES
+func LogLimitsFromEnv() LogLimits {
+	return LogLimits{
+		MaxBytes:         int64(getEnvInt("MAX_LOG_BYTES", 100<<20)),
+		LinesPerSecond:   getEnvInt("LOG_LINE_RATE", 0),
+		MaxOverflowBytes: int64(getEnvInt("MAX_LOG_OVERFLOW_BYTES", 1<<30)),
+	}
+}
+
+// logLimiter passes a build's output on to out until it exceeds the limits,
+// saying so in the log, and diverts the rest to an overflow file in the
+// workspace to be published as an artifact
+type logLimiter struct {
+	out    io.Writer
+	limits LogLimits
+	dir    string
+	now    func() time.Time
+
+	written int64
+	// truncation is the first limit the log reached
+	truncation string
+	// window is the second lines are being counted in
+	window  time.Time
+	lines   int
+	dropped int
+	// dropping is set while the rest of a dropped line is being written
+	dropping bool
+	midLine  bool
+
+	overflow      *os.File
+	overflowBytes int64
+}
+
+func newLogLimiter(out io.Writer, limits LogLimits, dir string) *logLimiter {
+	return &logLimiter{out: out, limits: limits, dir: dir, now: time.Now}
+}
+
+func (ll *logLimiter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		line := p
+		if i := bytes.IndexByte(p, '\n'); i >= 0 {
+			line = p[:i+1]
+		}
+		p = p[len(line):]
+
+		continued := ll.midLine
+		if !continued {
+			ll.startLine()
+		}
+		ll.midLine = line[len(line)-1] != '\n'
+		ll.writeLine(line, continued)
+	}
+	return n, nil
+}
+
+// startLine counts a line against the rate limit, reporting the lines dropped
+// in the previous second once a new one starts
+func (ll *logLimiter) startLine() {
+	if ll.limits.LinesPerSecond <= 0 || ll.truncation == logTruncatedSize {
+		return
+	}
+	if now := ll.now(); now.Sub(ll.window) >= time.Second {
+		ll.reportDropped()
+		ll.window, ll.lines = now, 0
+	}
+	ll.lines++
+	ll.dropping = ll.lines > ll.limits.LinesPerSecond
+	if ll.dropping {
+		ll.dropped++
+		if ll.truncation == "" {
+			ll.truncation = logTruncatedRate
+		}
+	}
+}
+
+func (ll *logLimiter) writeLine(line []byte, continued bool) {
+	if ll.dropping || ll.truncation == logTruncatedSize {
+		ll.divert(line)
+		return
+	}
+	if ll.limits.MaxBytes > 0 && ll.written+int64(len(line)) > ll.limits.MaxBytes {
+		ll.truncation = logTruncatedSize
+		if continued {
+			ll.out.Write([]byte("\n"))
+		}
+		ll.reportDropped()
+		fmt.Fprintf(ll.out, "--- log truncated at %d bytes (MAX_LOG_BYTES), the rest is kept in the %s artifact\n", ll.limits.MaxBytes, logOverflowArtifact)
+		ll.divert(line)
+		return
+	}
+	ll.written += int64(len(line))
+	ll.out.Write(line)
+}
+
+// reportDropped notes the lines dropped over the rate limit in the log
+func (ll *logLimiter) reportDropped() {
+	if ll.dropped > 0 {
+		fmt.Fprintf(ll.out, "--- %d lines dropped over the limit of %d lines per second (LOG_LINE_RATE), kept in the %s artifact\n", ll.dropped, ll.limits.LinesPerSecond, logOverflowArtifact)
+		ll.dropped = 0
+	}
+}
+
+// divert keeps output left out of the log in the overflow file, up to
+// MaxOverflowBytes
+func (ll *logLimiter) divert(p []byte) {
+	if ll.overflowBytes >= ll.limits.MaxOverflowBytes {
+		return
+	}
+	if ll.overflow == nil {
+		f, err := os.Create(filepath.Join(ll.dir, "log-overflow"))
+		if err != nil {
+			// Still keep the log within its limits
+			log.Printf("Error creating log overflow file: %v", err)
+			ll.overflowBytes = ll.limits.MaxOverflowBytes
+			return
+		}
+		ll.overflow = f
+	}
+	if remaining := ll.limits.MaxOverflowBytes - ll.overflowBytes; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	ll.overflow.Write(p)
+	ll.overflowBytes += int64(len(p))
+}
+
+// finish reports lines still unreported as dropped and publishes the
+// overflow, if any, as an artifact of the given stage
+func (ll *logLimiter) finish(ctx context.Context, artifacts ArtifactPublisher, build *BuildRequest, step int) {
+	ll.reportDropped()
+	if ll.overflow == nil {
+		return
+	}
+	defer ll.overflow.Close()
+	if artifacts == nil {
+		fmt.Fprintln(ll.out, "--- artifact publishing is not available, the rest of the log was discarded")
+		return
+	}
+	if _, err := ll.overflow.Seek(0, io.SeekStart); err != nil {
+		log.Printf("Error publishing log overflow of build %d: %v", build.ID, err)
+		return
+	}
+	if _, err := artifacts.Publish(ctx, build, step, logOverflowArtifact, ll.overflow, ll.overflowBytes); err != nil {
+		log.Printf("Error publishing log overflow of build %d: %v", build.ID, err)
+		fmt.Fprintf(ll.out, "--- publishing %s failed: %v\n", logOverflowArtifact, err)
+		return
+	}
+	fmt.Fprintf(ll.out, "--- published %s (%d bytes)\n", logOverflowArtifact, ll.overflowBytes)
+}
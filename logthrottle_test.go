@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogLimiterTruncatesAtMaxBytes(t *testing.T) {
+	var out bytes.Buffer
+	limiter := newLogLimiter(&out, LogLimits{MaxBytes: 12, MaxOverflowBytes: 1 << 20}, t.TempDir())
+	limiter.Write([]byte("line 1\nline 2\nli"))
+	limiter.Write([]byte("ne 3\nline 4\n"))
+
+	assert.Equal(t, "line 1\n--- log truncated at 12 bytes (MAX_LOG_BYTES), the rest is kept in the build-log-overflow.txt artifact\n", out.String())
+	assert.Equal(t, logTruncatedSize, limiter.truncation)
+
+	publisher := &recordingPublisher{artifacts: map[string]string{}}
+	limiter.finish(context.Background(), publisher, &BuildRequest{ID: 1}, 2)
+	assert.Equal(t, "line 2\nline 3\nline 4\n", publisher.artifacts[logOverflowArtifact])
+	assert.Equal(t, 2, publisher.step)
+	assert.Contains(t, out.String(), "--- published build-log-overflow.txt (21 bytes)\n")
+}
+
+func TestLogLimiterTruncatesLongLines(t *testing.T) {
+	var out bytes.Buffer
+	limiter := newLogLimiter(&out, LogLimits{MaxBytes: 10, MaxOverflowBytes: 4}, t.TempDir())
+	limiter.Write([]byte("progress"))
+	limiter.Write([]byte("......"))
+	limiter.Write([]byte("done\n"))
+
+	assert.True(t, strings.HasPrefix(out.String(), "progress\n--- log truncated at 10 bytes"), out.String())
+	publisher := &recordingPublisher{artifacts: map[string]string{}}
+	limiter.finish(context.Background(), publisher, &BuildRequest{ID: 1}, 0)
+	// The overflow is capped too
+	assert.Equal(t, "....", publisher.artifacts[logOverflowArtifact])
+}
+
+func TestLogLimiterThrottlesLineRate(t *testing.T) {
+	var out bytes.Buffer
+	limiter := newLogLimiter(&out, LogLimits{LinesPerSecond: 2, MaxOverflowBytes: 1 << 20}, t.TempDir())
+	now := time.Now()
+	limiter.now = func() time.Time { return now }
+
+	for i := 1; i <= 5; i++ {
+		fmt.Fprintf(limiter, "line %d\n", i)
+	}
+	now = now.Add(time.Second)
+	limiter.Write([]byte("line 6\n"))
+
+	assert.Equal(t, "line 1\nline 2\n"+
+		"--- 3 lines dropped over the limit of 2 lines per second (LOG_LINE_RATE), kept in the build-log-overflow.txt artifact\n"+
+		"line 6\n", out.String())
+	assert.Equal(t, logTruncatedRate, limiter.truncation)
+
+	// Without artifact publishing the dropped lines are gone
+	limiter.finish(context.Background(), nil, &BuildRequest{ID: 1}, 0)
+	assert.Contains(t, out.String(), "the rest of the log was discarded")
+}
+
+func TestLogLimiterWithinLimits(t *testing.T) {
+	var out bytes.Buffer
+	limiter := newLogLimiter(&out, LogLimits{MaxBytes: 100, LinesPerSecond: 10, MaxOverflowBytes: 1 << 20}, t.TempDir())
+	limiter.Write([]byte("hello\nworld\n"))
+	limiter.finish(context.Background(), nil, &BuildRequest{ID: 1}, 0)
+
+	assert.Equal(t, "hello\nworld\n", out.String())
+	assert.Empty(t, limiter.truncation)
+	assert.Nil(t, limiter.overflow)
+}
+
+func TestLocalExecutorLimitsLogs(t *testing.T) {
+	if _, err := exec.LookPath("seq"); err != nil {
+		t.Skip("seq not installed")
+	}
+	repo := newPipelineRepo(t, map[string]string{
+		pipelineFile: "stages:\n  - name: build\n    steps: ['seq 1 5000']\n",
+	})
+	executor := NewLocalExecutor(t.TempDir())
+	executor.AllowedProtocols = append(executor.AllowedProtocols, "file")
+	publisher := &recordingPublisher{artifacts: map[string]string{}}
+	executor.Artifacts = publisher
+	logs := NewLocalLogStore(t.TempDir())
+	executor.LogStore = logs
+	executor.LogLimits = LogLimits{MaxBytes: 4096, MaxOverflowBytes: 1 << 20}
+
+	result, err := executor.Execute(context.Background(), &BuildRequest{ID: 1, ProjectName: "test-project", GitURL: "file://" + repo, Branch: "main"})
+	require.NoError(t, err)
+	assert.Equal(t, "success", result.Status)
+	assert.Equal(t, logTruncatedSize, result.LogTruncation)
+
+	size, err := logs.Size(context.Background(), buildLogKey(1))
+	require.NoError(t, err)
+	stored := readLog(t, logs, buildLogKey(1), 0, size)
+	assert.Less(t, size, int64(5000))
+	assert.Contains(t, stored, "--- log truncated at 4096 bytes")
+	assert.True(t, strings.HasSuffix(stored, "--- published build-log-overflow.txt ("+fmt.Sprint(len(publisher.artifacts[logOverflowArtifact]))+" bytes)\n"), stored)
+	assert.True(t, strings.HasSuffix(publisher.artifacts[logOverflowArtifact], "4999\n5000\n"))
+}
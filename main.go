@@ -3,11 +3,15 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"os"
 	"os/signal"
+	"regexp"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -18,27 +22,200 @@ import (
 
 // BuildService represents our microservice
 type BuildService struct {
-	db      DatabaseInterface
-	metrics *Metrics
+	db            DatabaseInterface
+	metrics       *Metrics
+	executor      Executor
+	shadow        *ShadowExecutor
+	queue         *BuildQueue
+	queueSLA      *QueueSLAMonitor
+	errors        *ErrorTracker
+	accessLog     *AccessLogger
+	deprecations  *DeprecationTracker
+	usage         *UsageTracker
+	tenancy       *Tenancy
+	links         *PublicURLs
+	catalog       *Catalog
+	watchdog      *RequestWatchdog
+	rateLimiter   *RateLimiter
+	dbBreaker     *CircuitBreaker
+	events        *EventBus
+	logs          *LogBus
+	slack         *SlackNotifier
+	jira          *JiraNotifier
+	escalations   *Escalator
+	webhooks      *WebhookSink
+	github        *GitHubClient
+	gitlab        *GitLabClient
+	artifacts     *ArtifactManager
+	provenance    *ProvenanceSigner
+	logStore      LogStore
+	mirrors       *GitMirrorCache
+	janitor       *Janitor
+	drafts        *DraftScheduler
+	digests       *DigestScheduler
+	archiver      *BuildArchiver
+	staleBranches *StaleBranchSweeper
+	schedules     *BuildScheduler
+	credentials   *CredentialRotator
+	worker        *WorkerMetrics
+	tracer        *Tracer
+	integrations  *IntegrationHealth
+	delivery      *EventDelivery
+	running       *runningBuilds
+	streamsDone   chan struct{}
+	openAPI       []byte
+	statusCache   *StatusPageCache
+	stats         *StatsCache
+	cache         *ReadCache
+	// defaultTimeout bounds builds of projects without their own timeout
+	defaultTimeout time.Duration
+	// recommendationMinBuilds is how many builds must record their usage
+	// before resource limits are recommended for a project
+	recommendationMinBuilds int
+	// cancelCheckInterval is how often workers check whether their builds
+	// were cancelled through another instance
+	cancelCheckInterval time.Duration
 }
 
 // BuildRequest represents a build request
 type BuildRequest struct {
-	ID          int       `json:"id" db:"id"`
-	ProjectName string    `json:"project_name" db:"project_name"`
-	GitURL      string    `json:"git_url" db:"git_url"`
-	Branch      string    `json:"branch" db:"branch"`
-	Status      string    `json:"status" db:"status"`
-	CreatedAt   time.Time `json:"created_at" db:"created_at"`
-	UpdatedAt   time.Time `json:"updated_at" db:"updated_at"`
+	ID          int    `json:"id" db:"id"`
+	ProjectName string `json:"project_name" db:"project_name"`
+	GitURL      string `json:"git_url" db:"git_url"`
+	Branch      string `json:"branch" db:"branch"`
+	CommitSHA   string `json:"commit_sha,omitempty" db:"commit_sha"`
+	// CommitMessage and CommitAuthor describe the built commit, taken from
+	// the push that triggered the build or read from git once it's cloned
+	CommitMessage string `json:"commit_message,omitempty" db:"commit_message"`
+	CommitAuthor  string `json:"commit_author,omitempty" db:"commit_author"`
+	// Description is a free-form note on the build, set with PATCH
+	Description string `json:"description,omitempty" db:"description"`
+	// TriggerSource is what created the build: manual, webhook, schedule,
+	// retry, upstream, bootstrap, pull-request or matrix
+	TriggerSource string `json:"trigger_source" db:"trigger_source"`
+	Tag           string `json:"tag,omitempty" db:"tag"`
+	Version       string `json:"version,omitempty" db:"version"`
+	AutoVersion   bool   `json:"auto_version,omitempty" db:"auto_version"`
+	TriggeredBy   string `json:"triggered_by,omitempty" db:"triggered_by"`
+	Org           string `json:"org,omitempty" db:"org"`
+	Status        string `json:"status" db:"status"`
+	ExitCode      *int   `json:"exit_code,omitempty" db:"exit_code"`
+	RetriedFrom   *int   `json:"retried_from,omitempty" db:"retried_from"`
+	// CancelReason is why a cancelled, timed out or expired build ended
+	// without finishing, and CancelledBy the user or system that ended it
+	CancelReason string `json:"cancel_reason,omitempty" db:"cancel_reason"`
+	CancelledBy  string `json:"cancelled_by,omitempty" db:"cancelled_by"`
+	// DependsOn lists the upstream builds that must succeed before this
+	// build is started
+	DependsOn []int `json:"depends_on,omitempty" db:"depends_on"`
+	// ScheduleID is the build schedule that enqueued the build
+	ScheduleID *int `json:"schedule_id,omitempty" db:"schedule_id"`
+	// UpstreamBuildID is the build of an upstream project whose success
+	// triggered this build
+	UpstreamBuildID *int `json:"upstream_build_id,omitempty" db:"upstream_build_id"`
+	// PullRequest is the number of the pull or merge request a build checks
+	// out the merge ref of; Branch is then that ref below refs/ and CommitSHA
+	// the request's head commit, which its status is reported on
+	PullRequest int `json:"pull_request,omitempty" db:"pull_request"`
+	// PullRequestFork marks pull requests from forks, whose builds run
+	// without the project's secrets
+	PullRequestFork bool `json:"pull_request_fork,omitempty" db:"pull_request_fork"`
+	// ParentBuildID is the matrix build a build runs one combination of, with
+	// Matrix its values by dimension
+	ParentBuildID *int              `json:"parent_build_id,omitempty" db:"parent_build_id"`
+	Matrix        map[string]string `json:"matrix,omitempty" db:"matrix"`
+	// Draft builds wait in the draft status until started or until StartAt
+	Draft     bool       `json:"draft,omitempty"`
+	StartAt   *time.Time `json:"start_at,omitempty" db:"start_at"`
+	StartedAt *time.Time `json:"started_at,omitempty" db:"started_at"`
+	CreatedAt time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at" db:"updated_at"`
+	// DeletedAt is set once the build is soft deleted
+	DeletedAt *time.Time `json:"deleted_at,omitempty" db:"deleted_at"`
+	// FailureCategory is the classified cause of a failed or timed out build
+	FailureCategory string `json:"failure_category,omitempty" db:"failure_category"`
+	// SkipReason is why a skipped or blocked build was never run
+	SkipReason string `json:"skip_reason,omitempty" db:"skip_reason"`
+	// LogTruncation is the limit the build's log was truncated at, if any
+	LogTruncation string `json:"log_truncation,omitempty" db:"log_truncation"`
+	// DebugLogging adds the scheduler's decisions, git tracing and container
+	// lifecycle to the build's log. It can be changed until the build starts.
+	DebugLogging bool `json:"debug_logging,omitempty" db:"debug_logging"`
+	// Labels are the build's key/value labels, merged over its project's
+	Labels Labels `json:"labels,omitempty" db:"labels"`
+	// ETA is when a running build is expected to finish, estimated from
+	// recent builds of its branch when it's read
+	ETA *time.Time `json:"eta,omitempty"`
+	// IdempotencyKey is the Idempotency-Key header the build was created with
+	IdempotencyKey string `json:"-" db:"idempotency_key"`
+	// BuildImage is the project's container image, set when the build is run
+	BuildImage string `json:"-"`
+	// ProjectMatrix is the project's build matrix, set when the build is run
+	ProjectMatrix BuildMatrix `json:"-"`
+	// CPULimit and MemoryLimitMB are the project's resource limits, set when
+	// the build is run
+	CPULimit      float64 `json:"-"`
+	MemoryLimitMB int     `json:"-"`
+	// Secrets are the project's secrets by name, injected into the build's
+	// environment and masked in its output, set when the build is run
+	Secrets map[string]string `json:"-"`
+	// ImagePolicy restricts the images the build may run in, set when the
+	// build is run
+	ImagePolicy *ImagePolicy `json:"-"`
+	// DebugNotes are the scheduling decisions written to the log of a build
+	// with DebugLogging, set when the build is run
+	DebugNotes []string `json:"-"`
+	// TraceParent is the W3C traceparent of the span that created the build,
+	// and of the execution span while it runs
+	TraceParent string `json:"-" db:"trace_parent"`
 }
 
+// maxIdempotencyKeyLength is the longest Idempotency-Key accepted
+const maxIdempotencyKeyLength = 255
+
 // Metrics holds prometheus metrics
 type Metrics struct {
-	BuildsTotal   prometheus.CounterVec
-	BuildDuration prometheus.HistogramVec
-	ActiveBuilds  prometheus.Gauge
-	HealthCheck   prometheus.Gauge
+	BuildsTotal      prometheus.CounterVec
+	BuildDuration    prometheus.HistogramVec
+	ActiveBuilds     prometheus.Gauge
+	HealthCheck      prometheus.Gauge
+	BackgroundErrors prometheus.CounterVec
+	DeprecatedCalls  prometheus.CounterVec
+	Integrations     prometheus.CounterVec
+	DeliveryLag      prometheus.HistogramVec
+	OutboxLag        prometheus.GaugeVec
+	OutboxPending    prometheus.GaugeVec
+	BuildTimeouts    prometheus.CounterVec
+	BuildFailures    prometheus.CounterVec
+	AutoRetries      prometheus.CounterVec
+	GitMirrorClones  prometheus.CounterVec
+	QueueWait        prometheus.GaugeVec
+	QueueSLABreached prometheus.GaugeVec
+	QueueSLABreaches prometheus.CounterVec
+	ShadowBuilds     prometheus.CounterVec
+	ShadowDuration   prometheus.Histogram
+	QueueDepth       prometheus.Gauge
+	DBDuration       prometheus.HistogramVec
+	HTTPRequests     prometheus.CounterVec
+	HTTPDuration     prometheus.HistogramVec
+	// BuildCancellations counts builds that ended without finishing
+	BuildCancellations prometheus.CounterVec
+	// BuildsNotRun counts skipped and blocked builds
+	BuildsNotRun prometheus.CounterVec
+	// BuildLogsTruncated counts builds whose logs reached a log limit
+	BuildLogsTruncated prometheus.CounterVec
+	// SchedulerLeader is 1 on the instance running build schedules
+	SchedulerLeader prometheus.Gauge
+	// HTTPInFlight and HTTPSlowRequests are kept by the request watchdog
+	HTTPInFlight     prometheus.GaugeVec
+	HTTPSlowRequests prometheus.CounterVec
+	// HTTPThrottled counts requests refused by the rate limiter
+	HTTPThrottled prometheus.CounterVec
+	// DBCircuitState and DBRetries are kept by the database circuit breaker
+	DBCircuitState prometheus.Gauge
+	DBRetries      prometheus.Counter
+	// CacheRequests counts read cache lookups by cache and result
+	CacheRequests prometheus.CounterVec
 }
 
 // NewMetrics creates new metrics instance
@@ -70,6 +247,208 @@ func NewMetrics() *Metrics {
 				Help: "Health status of the service (1 = healthy, 0 = unhealthy)",
 			},
 		),
+		BackgroundErrors: *prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "background_errors_total",
+				Help: "Total number of errors captured from background subsystems",
+			},
+			[]string{"subsystem"},
+		),
+		DeprecatedCalls: *prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "deprecated_endpoint_requests_total",
+				Help: "Total number of requests to deprecated endpoints",
+			},
+			[]string{"method", "route", "client"},
+		),
+		Integrations: *prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "integrations_disabled_total",
+				Help: "Total number of times an integration was disabled after repeated failures",
+			},
+			[]string{"integration"},
+		),
+		DeliveryLag: *prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "event_delivery_lag_seconds",
+				Help:    "Time from a build event being published to its delivery to an integration",
+				Buckets: []float64{0.1, 0.5, 1, 5, 15, 60, 300, 900, 3600},
+			},
+			[]string{"integration", "mode"},
+		),
+		OutboxLag: *prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "event_outbox_lag_seconds",
+				Help: "Age of the oldest undelivered outbox event",
+			},
+			[]string{"integration"},
+		),
+		OutboxPending: *prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "event_outbox_pending",
+				Help: "Number of undelivered outbox events",
+			},
+			[]string{"integration"},
+		),
+		BuildCancellations: *prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "build_cancellations_total",
+				Help: "Total number of builds cancelled, timed out or expired before finishing, by reason",
+			},
+			[]string{"reason"},
+		),
+		BuildsNotRun: *prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "builds_not_run_total",
+				Help: "Total number of builds skipped or blocked without running, by status and reason",
+			},
+			[]string{"status", "reason"},
+		),
+		BuildLogsTruncated: *prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "build_logs_truncated_total",
+				Help: "Total number of builds whose logs were truncated, by the limit reached",
+			},
+			[]string{"reason"},
+		),
+		SchedulerLeader: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "build_scheduler_leader",
+				Help: "Whether this instance holds the scheduler lock and enqueues scheduled builds",
+			},
+		),
+		BuildTimeouts: *prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "build_timeouts_total",
+				Help: "Total number of builds stopped for exceeding their timeout",
+			},
+			[]string{"project"},
+		),
+		BuildFailures: *prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "build_failures_total",
+				Help: "Total number of failed and timed out builds by classified cause",
+			},
+			[]string{"project", "category"},
+		),
+		AutoRetries: *prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "build_auto_retries_total",
+				Help: "Total number of failed builds retried automatically by their project's retry policy",
+			},
+			[]string{"project", "category"},
+		),
+		GitMirrorClones: *prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "git_mirror_clones_total",
+				Help: "Total number of checkouts by whether they were cloned from a local mirror or the git host",
+			},
+			[]string{"source"},
+		),
+		QueueWait: *prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "project_queue_wait_seconds",
+				Help: "Wait of the oldest queued build of projects with a queue wait SLA",
+			},
+			[]string{"project"},
+		),
+		QueueSLABreached: *prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "project_queue_sla_breached",
+				Help: "Whether a project's oldest queued build has waited longer than its SLA (1 = breached)",
+			},
+			[]string{"project"},
+		),
+		QueueSLABreaches: *prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "project_queue_sla_breaches_total",
+				Help: "Total number of times a project's queue wait exceeded its SLA",
+			},
+			[]string{"project"},
+		),
+		ShadowBuilds: *prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "shadow_builds_total",
+				Help: "Total number of builds run by the shadow executor, by outcome compared with the primary executor",
+			},
+			[]string{"outcome"},
+		),
+		ShadowDuration: prometheus.NewHistogram(
+			prometheus.HistogramOpts{
+				Name:    "shadow_duration_ratio",
+				Help:    "Duration of shadow runs relative to the primary run of the same build",
+				Buckets: []float64{0.25, 0.5, 0.75, 0.9, 1, 1.1, 1.25, 1.5, 2, 4},
+			},
+		),
+		QueueDepth: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "queue_depth",
+				Help: "Number of queued builds waiting for a worker, excluding builds of paused projects",
+			},
+		),
+		DBDuration: *prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "database_operation_duration_seconds",
+				Help:    "Latency of database statements, by operation",
+				Buckets: []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5},
+			},
+			[]string{"operation"},
+		),
+		HTTPRequests: *prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "http_requests_total",
+				Help: "Total number of HTTP requests, by method, route and status code",
+			},
+			[]string{"method", "route", "status"},
+		),
+		HTTPDuration: *prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "http_request_duration_seconds",
+				Help:    "Duration of HTTP requests, by method and route",
+				Buckets: prometheus.DefBuckets,
+			},
+			[]string{"method", "route"},
+		),
+		HTTPInFlight: *prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "http_requests_in_flight",
+				Help: "Number of HTTP requests being served, by method and route",
+			},
+			[]string{"method", "route"},
+		),
+		HTTPSlowRequests: *prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "http_slow_requests_total",
+				Help: "Total number of HTTP requests exceeding SLOW_REQUEST_THRESHOLD, by method and route",
+			},
+			[]string{"method", "route"},
+		),
+		HTTPThrottled: *prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "http_throttled_requests_total",
+				Help: "Total number of HTTP requests refused by the rate limiter, by client kind (api_key or ip) and route",
+			},
+			[]string{"client", "route"},
+		),
+		DBCircuitState: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "db_circuit_state",
+				Help: "State of the database circuit breaker (0=closed, 1=open, 2=half-open)",
+			},
+		),
+		DBRetries: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "db_retries_total",
+				Help: "Total number of database statements retried after a transient error",
+			},
+		),
+		CacheRequests: *prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "cache_requests_total",
+				Help: "Total number of Redis read cache lookups by cache (build, project or latest) and result (hit, miss or error)",
+			},
+			[]string{"cache", "result"},
+		),
 	}
 }
 
@@ -78,18 +457,40 @@ func (m *Metrics) Register(registry prometheus.Registerer) {
 	registry.MustRegister(&m.BuildDuration)
 	registry.MustRegister(m.ActiveBuilds)
 	registry.MustRegister(m.HealthCheck)
+	registry.MustRegister(&m.BackgroundErrors)
+	registry.MustRegister(&m.DeprecatedCalls)
+	registry.MustRegister(&m.Integrations)
+	registry.MustRegister(&m.DeliveryLag)
+	registry.MustRegister(&m.OutboxLag)
+	registry.MustRegister(&m.OutboxPending)
+	registry.MustRegister(&m.BuildTimeouts)
+	registry.MustRegister(&m.BuildFailures)
+	registry.MustRegister(&m.AutoRetries)
+	registry.MustRegister(&m.GitMirrorClones)
+	registry.MustRegister(&m.QueueWait)
+	registry.MustRegister(&m.QueueSLABreached)
+	registry.MustRegister(&m.QueueSLABreaches)
+	registry.MustRegister(&m.ShadowBuilds)
+	registry.MustRegister(m.ShadowDuration)
+	registry.MustRegister(m.QueueDepth)
+	registry.MustRegister(&m.DBDuration)
+	registry.MustRegister(&m.HTTPRequests)
+	registry.MustRegister(&m.HTTPDuration)
+	registry.MustRegister(&m.BuildCancellations)
+	registry.MustRegister(&m.BuildsNotRun)
+	registry.MustRegister(&m.BuildLogsTruncated)
+	registry.MustRegister(m.SchedulerLeader)
+	registry.MustRegister(&m.HTTPInFlight)
+	registry.MustRegister(&m.HTTPSlowRequests)
+	registry.MustRegister(&m.HTTPThrottled)
+	registry.MustRegister(m.DBCircuitState)
+	registry.MustRegister(m.DBRetries)
+	registry.MustRegister(&m.CacheRequests)
 }
 
 // NewBuildService creates a new build service instance
 func NewBuildService(db DatabaseInterface) *BuildService {
-	metrics := NewMetrics()
-	metrics.Register(prometheus.DefaultRegisterer)
-	metrics.HealthCheck.Set(1) // Set initial health status to healthy
-
-	return &BuildService{
-		db:      db,
-		metrics: metrics,
-	}
+	return NewBuildServiceWithRegistry(db, prometheus.DefaultRegisterer)
 }
 
 // NewBuildServiceWithRegistry creates a new build service instance with custom registry
@@ -97,11 +498,102 @@ func NewBuildServiceWithRegistry(db DatabaseInterface, registry prometheus.Regis
 	metrics := NewMetrics()
 	metrics.Register(registry)
 	metrics.HealthCheck.Set(1) // Set initial health status to healthy
+	logs := NewLogBus()
 
-	return &BuildService{
-		db:      db,
-		metrics: metrics,
+	bs := &BuildService{
+		db:                      db,
+		metrics:                 metrics,
+		errors:                  NewErrorTracker(NewErrorReporterFromEnv(), &metrics.BackgroundErrors),
+		accessLog:               NewAccessLogger(getEnvInt("ACCESS_LOG_MAX_BODY", 4096)),
+		deprecations:            NewDeprecationTracker(&metrics.DeprecatedCalls),
+		events:                  NewEventBus(),
+		logs:                    logs,
+		streamsDone:             make(chan struct{}),
+		statusCache:             NewStatusPageCache(),
+		stats:                   NewStatsCacheFromEnv(),
+		running:                 newRunningBuilds(),
+		defaultTimeout:          getEnvDuration("BUILD_TIMEOUT", 30*time.Minute),
+		recommendationMinBuilds: getEnvInt("RECOMMENDATION_MIN_BUILDS", 20),
+		cancelCheckInterval:     getEnvDuration("CANCEL_CHECK_INTERVAL", 5*time.Second),
+	}
+	bs.artifacts = NewArtifactManager(db, NewArtifactStoreFromEnv(), bs.errors)
+	provenance, err := NewProvenanceSignerFromEnv()
+	if err != nil {
+		log.Printf("Error loading provenance signing key, provenance is unsigned: %v", err)
+	}
+	bs.provenance = provenance
+	bs.logStore = NewLogStoreFromEnv()
+	bs.mirrors = NewGitMirrorCacheFromEnv(bs.errors, &metrics.GitMirrorClones)
+	bs.executor = NewExecutorFromEnv(logs, bs.artifacts, bs.mirrors, bs.logStore)
+	bs.shadow = NewShadowExecutorFromEnv(bs.executor, bs.errors, &metrics.ShadowBuilds, metrics.ShadowDuration)
+	if bs.shadow != nil {
+		bs.executor = bs.shadow
+	}
+	bs.queue = NewBuildQueue(db, bs.processBuild, bs.errors)
+	bs.queue.expired = bs.buildExpired
+	bs.queueSLA = NewQueueSLAMonitor(db, bs.errors, metrics.QueueDepth, &metrics.QueueWait, &metrics.QueueSLABreached, &metrics.QueueSLABreaches)
+	bs.usage = NewUsageTrackerFromEnv(db, bs.errors)
+	bs.links = NewPublicURLsFromEnv(db, bs.errors)
+	catalog, err := NewCatalogFromEnv()
+	if err != nil {
+		log.Printf("Error loading message catalog, responding in English: %v", err)
+	}
+	bs.catalog = catalog
+	bs.events.links = bs.links
+	bs.cache = NewReadCacheFromEnv(&metrics.CacheRequests)
+	if bs.cache != nil {
+		bs.events.OnPublish(func(event BuildEvent) { bs.cache.InvalidateBuild(&event.Build) })
+	}
+	bs.events.OnPublish(bs.matrixChildChanged)
+	bs.tenancy = NewTenancyFromEnv(db, bs.links)
+	bs.watchdog = NewRequestWatchdogFromEnv(&metrics.HTTPInFlight, &metrics.HTTPSlowRequests)
+	bs.rateLimiter = NewRateLimiterFromEnv(&metrics.HTTPThrottled)
+	bs.dbBreaker = NewCircuitBreakerFromEnv(metrics.DBCircuitState, metrics.DBRetries)
+	bs.integrations = NewIntegrationHealth(db, bs.errors, &metrics.Integrations)
+	bs.delivery = NewEventDeliveryFromEnv(db, bs.events, bs.errors, &metrics.DeliveryLag, &metrics.OutboxLag, &metrics.OutboxPending)
+	bs.slack = NewSlackNotifierFromEnv(db, bs.errors, bs.integrations)
+	if bs.slack != nil {
+		bs.delivery.Register(bs.slack)
 	}
+	bs.jira = NewJiraNotifierFromEnv(db, bs.errors, bs.integrations, bs.links)
+	if bs.jira != nil {
+		bs.delivery.Register(bs.jira)
+	}
+	bs.escalations = NewEscalatorFromEnv(db, bs.errors, bs.integrations, bs.links)
+	if bs.escalations != nil {
+		bs.delivery.Register(bs.escalations)
+	}
+	if eventBridge := NewEventBridgeSinkFromEnv(bs.integrations); eventBridge != nil {
+		bs.delivery.Register(eventBridge)
+	}
+	if pubsub := NewPubSubSinkFromEnv(bs.integrations); pubsub != nil {
+		bs.delivery.Register(pubsub)
+	}
+	if kafka := NewKafkaSinkFromEnv(bs.integrations); kafka != nil {
+		bs.delivery.Register(kafka)
+	}
+	if nats := NewNATSSinkFromEnv(bs.integrations); nats != nil {
+		bs.delivery.Register(nats)
+	}
+	bs.github = NewGitHubClientFromEnv()
+	bs.gitlab = NewGitLabClientFromEnv()
+	bs.delivery.Register(NewCommitStatusReporterFromEnv(db, bs.integrations))
+	bs.webhooks = NewWebhookSinkFromEnv(db, bs.integrations)
+	bs.delivery.Register(bs.webhooks)
+	notifications := NewNotificationSinkFromEnv(db, bs.integrations, bs.links, bs.catalog)
+	bs.delivery.Register(notifications)
+	bs.digests = NewDigestSchedulerFromEnv(db, notifications, bs.errors)
+	bs.janitor = NewJanitor(db, bs.artifacts.store, bs.errors)
+	bs.drafts = NewDraftScheduler(db, bs.events, bs.queue, bs.errors)
+	bs.archiver = NewBuildArchiverFromEnv(db, bs.errors)
+	bs.staleBranches = NewStaleBranchSweeperFromEnv(db, bs.errors)
+	bs.schedules = NewBuildScheduler(db, bs.enqueueBuild, bs.errors, metrics.SchedulerLeader)
+	// CREDENTIAL_KEYS was validated when the database was opened
+	keyring, _ := NewCredentialKeyringFromEnv()
+	bs.credentials = NewCredentialRotator(db, keyring, bs.errors)
+	bs.worker = NewWorkerMetricsFromEnv(bs.errors)
+	bs.tracer = NewTracerFromEnv(bs.errors)
+	return bs
 }
 
 // Health check endpoint
@@ -112,8 +604,15 @@ func (bs *BuildService) healthHandler(w http.ResponseWriter, r *http.Request) {
 		"service":   "build-service",
 	}
 
-	// Check database connection
-	if err := bs.db.Ping(); err != nil {
+	// Check database connection, unless the circuit breaker has already
+	// found it down
+	if open, remaining := bs.dbBreaker.Open(); open {
+		health["status"] = "degraded"
+		health["database"] = "circuit open"
+		bs.metrics.HealthCheck.Set(0)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(remaining.Seconds()))))
+		w.WriteHeader(http.StatusServiceUnavailable)
+	} else if err := bs.db.Ping(); err != nil {
 		health["status"] = "unhealthy"
 		health["database"] = "disconnected"
 		bs.metrics.HealthCheck.Set(0)
@@ -128,6 +627,87 @@ func (bs *BuildService) healthHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(health)
 }
 
+// commitSHAPattern matches abbreviated and full SHA-1/SHA-256 commit hashes
+var commitSHAPattern = regexp.MustCompile(`^[0-9a-f]{7,64}$`)
+
+// enqueueBuild stores a new build in the queued state and wakes a worker. The
+// build joins the trace of the request span in ctx.
+func (bs *BuildService) enqueueBuild(ctx context.Context, build *BuildRequest) error {
+	prepareBuild(ctx, build)
+	id, err := bs.db.CreateBuild(build)
+	if err != nil {
+		return err
+	}
+	bs.buildQueued(build, id)
+	return nil
+}
+
+// enqueueBuildUnlessActive enqueues a build like enqueueBuild unless a build
+// of the same commit is already queued or running, which it returns instead
+func (bs *BuildService) enqueueBuildUnlessActive(ctx context.Context, build *BuildRequest) (*BuildRequest, error) {
+	prepareBuild(ctx, build)
+	id, active, err := bs.db.CreateBuildUnlessActive(build)
+	if err != nil || active != nil {
+		return active, err
+	}
+	bs.buildQueued(build, id)
+	return nil, nil
+}
+
+// prepareBuild sets the status, version and timestamps of a new build
+func prepareBuild(ctx context.Context, build *BuildRequest) {
+	build.TraceParent = spanFromContext(ctx).TraceParent()
+	build.Status = "queued"
+	if build.Draft || build.StartAt != nil {
+		build.Status, build.Draft = "draft", true
+	}
+	// Matrix combinations are built as the version of their matrix build
+	if build.ParentBuildID == nil {
+		build.Version = tagVersion(build.Tag)
+	}
+	build.CreatedAt = time.Now().UTC()
+	build.UpdatedAt = time.Now().UTC()
+}
+
+// buildQueued announces a newly stored build
+func (bs *BuildService) buildQueued(build *BuildRequest, id int) {
+	build.ID = id
+	bs.metrics.BuildsTotal.WithLabelValues(build.Status).Inc()
+	bs.linkIssues(build, build.Branch, build.Tag, build.CommitMessage)
+	bs.events.Publish(build)
+
+	// Wake a worker to pick up the new build
+	if !build.Draft {
+		bs.queue.Notify()
+	}
+}
+
+// validate checks the fields of a requested build, defaulting the branch of
+// builds of neither a branch nor a tag
+func (req *BuildRequest) validate() error {
+	if req.ProjectName == "" || req.GitURL == "" {
+		return fmt.Errorf("project_name and git_url are required")
+	}
+
+	if req.CommitSHA != "" && !commitSHAPattern.MatchString(req.CommitSHA) {
+		return fmt.Errorf("commit_sha must be a hexadecimal commit hash")
+	}
+
+	if strings.HasPrefix(req.Tag, "-") || strings.HasPrefix(req.Branch, "-") {
+		return fmt.Errorf("branch and tag must not start with '-'")
+	}
+
+	if err := req.Labels.validate(); err != nil {
+		return err
+	}
+
+	// Tag builds check out the tag instead of a branch
+	if req.Branch == "" && req.Tag == "" {
+		req.Branch = "main"
+	}
+	return nil
+}
+
 // Create build endpoint
 func (bs *BuildService) createBuildHandler(w http.ResponseWriter, r *http.Request) {
 	var req BuildRequest
@@ -136,38 +716,126 @@ func (bs *BuildService) createBuildHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	// Validate required fields
-	if req.ProjectName == "" || req.GitURL == "" {
-		http.Error(w, "project_name and git_url are required", http.StatusBadRequest)
+	key := strings.TrimSpace(r.Header.Get("Idempotency-Key"))
+	if len(key) > maxIdempotencyKeyLength {
+		http.Error(w, fmt.Sprintf("Idempotency-Key must be at most %d characters", maxIdempotencyKeyLength), http.StatusBadRequest)
 		return
 	}
 
-	if req.Branch == "" {
-		req.Branch = "main"
+	// ?if_not_building=true returns the queued or running build of the same
+	// commit, if any, instead of creating another
+	ifNotBuilding := false
+	if value := r.URL.Query().Get("if_not_building"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			http.Error(w, "if_not_building must be true or false", http.StatusBadRequest)
+			return
+		}
+		ifNotBuilding = parsed
+	}
+
+	if err := req.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	req.Status = "queued"
-	req.CreatedAt = time.Now().UTC()
-	req.UpdatedAt = time.Now().UTC()
+	if bs.projectOfOtherOrg(r, req.ProjectName) {
+		http.Error(w, "Project not found", http.StatusNotFound)
+		return
+	}
+
+	// A retried request returns the build created by the first attempt
+	if key != "" && bs.replayIdempotentBuild(w, buildOrg(r), key) {
+		return
+	}
+	if !bs.checkUpstreamBuilds(w, r, req.DependsOn) {
+		return
+	}
+	req.IdempotencyKey = key
+	req.requestedBy(r)
 
 	// Store in database
-	id, err := bs.db.CreateBuild(&req)
+	var active *BuildRequest
+	var err error
+	if ifNotBuilding {
+		active, err = bs.enqueueBuildUnlessActive(r.Context(), &req)
+	} else {
+		err = bs.enqueueBuild(r.Context(), &req)
+	}
 	if err != nil {
+		// A concurrent request with the same key won the race
+		if err.Error() == "build already exists" && bs.replayIdempotentBuild(w, req.Org, key) {
+			return
+		}
 		log.Printf("Error creating build: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
-
-	req.ID = id
-	bs.metrics.BuildsTotal.WithLabelValues("queued").Inc()
-	bs.metrics.ActiveBuilds.Inc()
+	if active != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Build-Existing", "true")
+		json.NewEncoder(w).Encode(active)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(req)
+}
+
+// projectOfOtherOrg reports whether the named project is registered to an
+// org the caller doesn't see. Builds of another org's project would run with
+// its settings, so they're rejected as if the project didn't exist.
+// Unregistered projects belong to no org.
+func (bs *BuildService) projectOfOtherOrg(r *http.Request, projectName string) bool {
+	tenant := requestTenant(r)
+	if tenant.Org == "" {
+		return false
+	}
+	project, err := bs.db.GetProjectByName(projectName)
+	return err == nil && !tenant.Sees(project.Org)
+}
 
-	// Simulate async build processing
-	go bs.processBuild(&req)
+// requestedBy sets the fields of a build requested through the API that the
+// caller doesn't choose
+func (req *BuildRequest) requestedBy(r *http.Request) {
+	// Only the scheduler records a triggering schedule, and only matrix
+	// builds create builds of a combination
+	req.ScheduleID = nil
+	req.ParentBuildID, req.Matrix = nil, nil
+	// Retries, upstream triggers and pull request webhooks link builds
+	// together; a build requested directly belongs to none of them
+	req.RetriedFrom, req.UpstreamBuildID = nil, nil
+	req.PullRequest, req.PullRequestFork = 0, false
+	req.SkipReason = ""
+	// Versioning is a project setting
+	req.AutoVersion = false
+	req.TriggerSource = triggerManual
+	req.CommitMessage = truncateCommitMessage(req.CommitMessage)
+	// Fair share is enforced per org as identified by the gateway, and per
+	// user as authenticated
+	req.Org = buildOrg(r)
+	req.TriggeredBy = requestUser(r)
+}
+
+// replayIdempotentBuild responds with the build the org created with the
+// given Idempotency-Key, reporting false without writing anything when there
+// is none
+func (bs *BuildService) replayIdempotentBuild(w http.ResponseWriter, org, key string) bool {
+	build, err := bs.db.GetBuildByIdempotencyKey(org, key)
+	if err != nil {
+		if err.Error() == "build not found" {
+			return false
+		}
+		log.Printf("Error getting build by idempotency key: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return true
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Idempotent-Replayed", "true")
+	json.NewEncoder(w).Encode(build)
+	return true
 }
 
 // Get build endpoint
@@ -185,7 +853,25 @@ func (bs *BuildService) getBuildHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	build, err := bs.db.GetBuild(id)
+	// ?wait=true blocks like GET /builds/{id}/wait
+	if value := r.URL.Query().Get("wait"); value != "" {
+		wait, err := strconv.ParseBool(value)
+		if err != nil {
+			http.Error(w, "wait must be true or false", http.StatusBadRequest)
+			return
+		}
+		if wait {
+			timeout, ok := parseWaitTimeout(r.URL.Query().Get("timeout"))
+			if !ok {
+				http.Error(w, "timeout must be a duration of at most 10m", http.StatusBadRequest)
+				return
+			}
+			bs.waitForBuild(w, r, id, timeout)
+			return
+		}
+	}
+
+	build, err := bs.cachedBuild(id)
 	if err != nil {
 		if err.Error() == "build not found" {
 			http.Error(w, "Build not found", http.StatusNotFound)
@@ -196,13 +882,124 @@ func (bs *BuildService) getBuildHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	bs.setBuildETA(build, time.Now())
+
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", buildETag(build))
 	json.NewEncoder(w).Encode(build)
 }
 
-// List builds endpoint
+// retryableStatuses are the final states a build can be retried from
+var retryableStatuses = map[string]bool{
+	"failed":    true,
+	"timeout":   true,
+	"cancelled": true,
+	"expired":   true,
+}
+
+// Retry build endpoint
+func (bs *BuildService) retryBuildHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid build ID", http.StatusBadRequest)
+		return
+	}
+
+	original, err := bs.db.GetBuild(id)
+	if err != nil {
+		if err.Error() == "build not found" {
+			http.Error(w, "Build not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error getting build: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if !retryableStatuses[original.Status] {
+		http.Error(w, fmt.Sprintf("Only failed, timed out, cancelled or expired builds can be retried, build is %s", original.Status), http.StatusConflict)
+		return
+	}
+
+	build, err := bs.retryBuild(r.Context(), original, triggerRetry)
+	if err != nil {
+		log.Printf("Error creating build: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(build)
+}
+
+// retryBuild queues a new build of the same commit as original, created by
+// the given trigger source
+func (bs *BuildService) retryBuild(ctx context.Context, original *BuildRequest, source string) (*BuildRequest, error) {
+	build := &BuildRequest{
+		ProjectName:   original.ProjectName,
+		GitURL:        original.GitURL,
+		Branch:        original.Branch,
+		CommitSHA:     original.CommitSHA,
+		CommitMessage: original.CommitMessage,
+		CommitAuthor:  original.CommitAuthor,
+		TriggerSource: source,
+		Tag:           original.Tag,
+		AutoVersion:   original.AutoVersion,
+		TriggeredBy:   original.TriggeredBy,
+		Org:           original.Org,
+		RetriedFrom:   &original.ID,
+		// Retries of pull request builds check out the same merge ref
+		PullRequest:     original.PullRequest,
+		PullRequestFork: original.PullRequestFork,
+		DebugLogging:    original.DebugLogging,
+		Labels:          original.Labels,
+		// Retries of matrix builds run the same combination, on their own
+		Matrix: original.Matrix,
+	}
+
+	if err := bs.enqueueBuild(ctx, build); err != nil {
+		return nil, err
+	}
+
+	// Carry over issue links that came from the original commit message
+	if keys, err := bs.db.ListBuildIssues(original.ID); err != nil {
+		log.Printf("Error listing issues of build %d: %v", original.ID, err)
+	} else if len(keys) > 0 {
+		if err := bs.db.AddBuildIssues(build.ID, keys); err != nil {
+			log.Printf("Error linking issues %v to build %d: %v", keys, build.ID, err)
+		}
+	}
+
+	log.Printf("Queued build %d as a retry of build %d", build.ID, original.ID)
+	return build, nil
+}
+
+// List builds endpoint. ?commit_sha= lists the builds of commits starting
+// with the given, possibly abbreviated, hash, ?org= the builds of an org
+// when the request isn't scoped to one, and ?label=key:value, repeated for
+// several labels, the builds having them.
 func (bs *BuildService) listBuildsHandler(w http.ResponseWriter, r *http.Request) {
-	builds, err := bs.db.ListBuilds()
+	deleted, ok := includeDeleted(w, r)
+	if !ok {
+		return
+	}
+	labels, ok := labelFilter(w, r)
+	if !ok {
+		return
+	}
+
+	var builds []*BuildRequest
+	var err error
+	if sha := strings.ToLower(r.URL.Query().Get("commit_sha")); sha != "" {
+		if !commitSHAPattern.MatchString(sha) {
+			http.Error(w, "commit_sha must be a hexadecimal commit hash of at least 7 characters", http.StatusBadRequest)
+			return
+		}
+		builds, err = bs.db.ListBuildsByCommit(sha, deleted, listOrg(r), labels)
+	} else {
+		builds, err = bs.db.ListBuilds(deleted, listOrg(r), labels)
+	}
 	if err != nil {
 		log.Printf("Error listing builds: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -213,43 +1010,372 @@ func (bs *BuildService) listBuildsHandler(w http.ResponseWriter, r *http.Request
 	json.NewEncoder(w).Encode(builds)
 }
 
-// Simulate build processing
-func (bs *BuildService) processBuild(build *BuildRequest) {
+// Run a claimed build through the configured executor and record its outcome
+func (bs *BuildService) processBuild(ctx context.Context, build *BuildRequest) {
 	start := time.Now()
-	defer func() {
-		duration := time.Since(start).Seconds()
-		bs.metrics.BuildDuration.WithLabelValues(build.ProjectName).Observe(duration)
-		bs.metrics.ActiveBuilds.Dec()
-	}()
+	bs.metrics.ActiveBuilds.Inc()
+	defer bs.metrics.ActiveBuilds.Dec()
+	bs.events.Publish(build)
 
-	// Update status to running
-	build.Status = "running"
-	build.UpdatedAt = time.Now().UTC()
-	if err := bs.db.UpdateBuildStatus(build.ID, "running"); err != nil {
-		log.Printf("Error updating build status to running: %v", err)
+	// The build's spans continue the trace of the request that created it
+	ctx, span := bs.tracer.Start(ctx, fmt.Sprintf("build %d", build.ID), spanKindConsumer, build.TraceParent)
+	span.SetAttribute("build.id", build.ID)
+	span.SetAttribute("build.project", build.ProjectName)
+	defer span.End()
+	if build.StartedAt != nil {
+		bs.tracer.Record(ctx, "build.queued", build.CreatedAt, *build.StartedAt)
+	}
+
+	project := bs.buildProject(build)
+	if project != nil {
+		build.BuildImage = project.BuildImage
+		build.CPULimit, build.MemoryLimitMB = project.CPULimit, project.MemoryLimitMB
+		build.ProjectMatrix = project.Matrix
+		// Code from forks, or from a repository other than the project's that
+		// the build was pointed at, could leak the project's secrets
+		if !build.PullRequestFork && repositoryKey(build.GitURL) == repositoryKey(project.GitURL) {
+			secrets, err := bs.buildSecrets(project)
+			if err != nil {
+				bs.errors.Capture("executor", fmt.Errorf("loading secrets: %w", err), build)
+			}
+			build.Secrets = secrets
+		}
+	}
+	build.ImagePolicy = bs.imagePolicy(build.GitURL)
+	build.AutoVersion = autoVersions(build, project)
+	timeout := bs.buildTimeout(project)
+	if build.DebugLogging {
+		build.DebugNotes = bs.debugNotes(ctx, build, project, timeout)
+	}
+	cancelCtx, cancelBuild := context.WithCancelCause(ctx)
+	defer cancelBuild(nil)
+	bs.running.add(build.ID, cancelBuild)
+	defer bs.running.remove(build.ID)
+	execCtx, cancel := context.WithTimeout(cancelCtx, timeout)
+	go bs.watchCancellation(execCtx, build.ID, cancelBuild)
+	execCtx, execSpan := bs.tracer.Start(execCtx, "build.execute", spanKindInternal, "")
+	// Build tooling reports its spans as children of the execution span
+	build.TraceParent = execSpan.TraceParent()
+	result, err := bs.executor.Execute(execCtx, build)
+	timedOut := execCtx.Err() == context.DeadlineExceeded
+	cancel()
+	if result != nil {
+		execSpan.SetAttribute("build.tool", result.Tool)
+		execSpan.SetAttribute("build.exit_code", result.ExitCode)
+	}
+	execSpan.SetError(err)
+	execSpan.End()
+	if context.Cause(cancelCtx) == errBuildCancelled {
+		// The cancellation was recorded and published when it was requested
+		log.Printf("Build %d stopped after being cancelled", build.ID)
+		span.SetError(errBuildCancelled)
+		return
+	}
+	if context.Cause(cancelCtx) == errLeaseLost || !holdsLease(ctx, build) {
+		span.SetError(errLeaseLost)
 		return
 	}
+	if err != nil && ctx.Err() != nil {
+		// Shutting down: hand the build back so another worker can run it
+		log.Printf("Build %d interrupted, returning it to the queue", build.ID)
+		if err := bs.db.ReleaseBuild(build.ID); err != nil {
+			bs.errors.Capture("queue", fmt.Errorf("releasing build: %w", err), build)
+		}
+		build.Status = "queued"
+		bs.events.Publish(build)
+		return
+	}
+	duration := time.Since(start)
+	bs.metrics.BuildDuration.WithLabelValues(build.ProjectName).Observe(duration.Seconds())
 
-	// Simulate build time (2-5 seconds)
-	time.Sleep(time.Duration(2+len(build.ProjectName)%4) * time.Second)
+	switch {
+	case timedOut:
+		log.Printf("Build %d exceeded its timeout of %s", build.ID, timeout)
+		bs.metrics.BuildTimeouts.WithLabelValues(build.ProjectName).Inc()
+		if result == nil {
+			result = &BuildResult{}
+		}
+		result.Status, result.ExitCode = "timeout", -1
+		build.CancelReason, build.CancelledBy = cancelTimeout, actorExecutor
+	case err != nil:
+		bs.errors.Capture("executor", err, build)
+		result = &BuildResult{Status: "failed", ExitCode: -1}
+		build.FailureCategory = failureInfra
+	}
 
-	// Simulate success/failure (90% success rate)
-	success := len(build.ProjectName)%10 != 0
+	config := bs.configSnapshot(build, project, timeout, result)
+	if err := bs.db.SaveBuildConfig(build.ID, config); err != nil {
+		bs.errors.Capture("executor", fmt.Errorf("saving config snapshot: %w", err), build)
+	}
+	if len(result.Stages) > 0 {
+		if err := bs.db.SaveBuildStages(build.ID, result.Stages); err != nil {
+			bs.errors.Capture("executor", fmt.Errorf("saving stages: %w", err), build)
+		}
+		problems := extractProblems(result.Stages, problemPatterns(project))
+		if err := bs.db.SaveBuildProblems(build.ID, problems); err != nil {
+			bs.errors.Capture("executor", fmt.Errorf("saving problems: %w", err), build)
+		}
+	}
+	if len(result.Matrix) > 0 {
+		bs.expandMatrix(ctx, build, result)
+		return
+	}
 
-	if success {
-		build.Status = "success"
-		bs.metrics.BuildsTotal.WithLabelValues("success").Inc()
+	build.Status = result.Status
+	build.ExitCode = &result.ExitCode
+	if build.Status == "success" {
+		bs.enforceQualityGates(build, project, result.Commit)
+	}
+	if build.FailureCategory == "" {
+		build.FailureCategory = classifyFailure(result.Status, result.ExitCode, result.Stages, result.Output)
+	}
+	if build.FailureCategory != "" {
+		bs.metrics.BuildFailures.WithLabelValues(build.ProjectName, build.FailureCategory).Inc()
+	}
+	if build.CancelReason != "" {
+		bs.recordCancellation(build)
 	} else {
-		build.Status = "failed"
-		bs.metrics.BuildsTotal.WithLabelValues("failed").Inc()
+		bs.metrics.BuildsTotal.WithLabelValues(build.Status).Inc()
+	}
+	bs.worker.Observe(build, build.Status, result.ExitCode, time.Since(start))
+
+	bs.recordCommit(build, result.Commit)
+	if result.Version != "" && result.Version != build.Version {
+		build.Version = result.Version
+		if err := bs.db.UpdateBuildVersion(build.ID, build.Version); err != nil {
+			bs.errors.Capture("executor", fmt.Errorf("recording version %s: %w", build.Version, err), build)
+		}
+	}
+
+	span.SetAttribute("build.status", build.Status)
+	if build.Status != "success" {
+		span.SetError(fmt.Errorf("build %s", build.Status))
 	}
 
 	build.UpdatedAt = time.Now().UTC()
-	if err := bs.db.UpdateBuildStatus(build.ID, build.Status); err != nil {
-		log.Printf("Error updating build status to %s: %v", build.Status, err)
+	if err := bs.db.UpdateBuildResult(build.ID, build.Status, result.ExitCode); err != nil {
+		bs.errors.Capture("executor", fmt.Errorf("updating build status to %s: %w", build.Status, err), build)
+	}
+	if result.Usage != nil {
+		if err := bs.db.RecordBuildUsage(build.ID, result.Usage); err != nil {
+			bs.errors.Capture("executor", fmt.Errorf("recording resource usage: %w", err), build)
+		}
 	}
+	if build.CancelReason != "" {
+		if err := bs.db.SetBuildCancellation(build.ID, build.CancelReason, build.CancelledBy); err != nil {
+			bs.errors.Capture("executor", fmt.Errorf("recording cancellation: %w", err), build)
+		}
+	}
+	if build.FailureCategory != "" {
+		if err := bs.db.SetBuildFailureCategory(build.ID, build.FailureCategory); err != nil {
+			bs.errors.Capture("executor", fmt.Errorf("recording failure category: %w", err), build)
+		}
+	}
+	if result.LogTruncation != "" {
+		build.LogTruncation = result.LogTruncation
+		bs.metrics.BuildLogsTruncated.WithLabelValues(build.LogTruncation).Inc()
+		if err := bs.db.SetBuildLogTruncation(build.ID, build.LogTruncation); err != nil {
+			bs.errors.Capture("executor", fmt.Errorf("recording log truncation: %w", err), build)
+		}
+	}
+	bs.recordProvenance(ctx, build, config)
+	bs.recordDuration(build, duration)
+	bs.events.Publish(build)
+
+	log.Printf("Build %d completed with status: %s (exit code %d)", build.ID, build.Status, result.ExitCode)
+	bs.autoRetry(ctx, build, project)
+	bs.triggerDownstream(ctx, build, project)
+	bs.blockDownstream(build)
+	bs.applyRecommendations(build, project)
+}
+
+// buildExpired notifies subscribers and integrations of a build that expired
+// in the queue
+func (bs *BuildService) buildExpired(build *BuildRequest) {
+	bs.recordCancellation(build)
+	bs.events.Publish(build)
+	bs.blockDownstream(build)
+}
 
-	log.Printf("Build %d completed with status: %s", build.ID, build.Status)
+// buildProject returns the registered project of a build, or nil for builds
+// of unregistered projects
+func (bs *BuildService) buildProject(build *BuildRequest) *Project {
+	project, err := bs.db.GetProjectByName(build.ProjectName)
+	if err != nil {
+		if err.Error() != "project not found" {
+			bs.errors.Capture("executor", fmt.Errorf("loading project: %w", err), build)
+		}
+		return nil
+	}
+	return project
+}
+
+// buildTimeout returns how long a build may run: its project's timeout when
+// set, otherwise BUILD_TIMEOUT
+func (bs *BuildService) buildTimeout(project *Project) time.Duration {
+	if project != nil && project.BuildTimeout > 0 {
+		return time.Duration(project.BuildTimeout) * time.Second
+	}
+	return bs.defaultTimeout
+}
+
+// Router registers the service's routes and middleware
+func (bs *BuildService) Router() (*mux.Router, error) {
+	router := mux.NewRouter()
+
+	// API routes
+	api := router.PathPrefix("/api/v1").Subrouter()
+	api.HandleFunc("/health", bs.healthHandler).Methods("GET")
+	api.HandleFunc("/status", bs.statusHandler).Methods("GET")
+	api.HandleFunc("/status.txt", bs.statusTextHandler).Methods("GET")
+	api.HandleFunc("/builds", bs.createBuildHandler).Methods("POST")
+	api.HandleFunc("/builds", bs.listBuildsHandler).Methods("GET")
+	api.HandleFunc("/builds/batch", bs.createBuildBatchHandler).Methods("POST")
+	api.HandleFunc("/builds/events", bs.buildEventsHandler).Methods("GET")
+	api.HandleFunc("/queue", bs.queueHandler).Methods("GET")
+	api.HandleFunc("/stats/projects", bs.projectStatsHandler).Methods("GET")
+	api.HandleFunc("/stats/durations", bs.durationStatsHandler).Methods("GET")
+	api.HandleFunc("/stats/daily", bs.dailyBuildStatsHandler).Methods("GET")
+	api.HandleFunc("/stats/flaky", bs.flakyProjectsHandler).Methods("GET")
+	api.HandleFunc("/ws", bs.webSocketHandler).Methods("GET")
+	api.HandleFunc("/graphql", bs.graphQLHandler).Methods("GET", "POST")
+	api.HandleFunc("/graphql/schema", bs.graphQLSchemaHandler).Methods("GET")
+	api.HandleFunc("/builds/{id}", bs.getBuildHandler).Methods("GET")
+	api.HandleFunc("/builds/{id}/status.txt", bs.buildStatusTextHandler).Methods("GET")
+	api.HandleFunc("/builds/{id}", bs.updateBuildHandler).Methods("PATCH")
+	api.HandleFunc("/builds/{id}", bs.deleteBuildHandler).Methods("DELETE")
+	api.HandleFunc("/builds/{id}/retry", bs.retryBuildHandler).Methods("POST")
+	api.HandleFunc("/builds/{id}/cancel", bs.cancelBuildHandler).Methods("POST")
+	api.HandleFunc("/builds/{id}/impact", bs.buildImpactHandler).Methods("GET")
+	api.HandleFunc("/builds/{id}/start", bs.startBuildHandler).Methods("POST")
+	api.HandleFunc("/builds/{id}/config", bs.buildConfigHandler).Methods("GET")
+	api.HandleFunc("/builds/{id}/genealogy", bs.buildGenealogyHandler).Methods("GET")
+	api.HandleFunc("/builds/{id}/stages", bs.buildStagesHandler).Methods("GET")
+	api.HandleFunc("/builds/{id}/problems", bs.buildProblemsHandler).Methods("GET")
+	api.HandleFunc("/builds/{id}/quality-gates", bs.buildQualityGatesHandler).Methods("GET")
+	api.HandleFunc("/builds/{id}/escalations", bs.listBuildEscalationsHandler).Methods("GET")
+	api.HandleFunc("/builds/{id}/chain", bs.buildChainHandler).Methods("GET")
+	api.HandleFunc("/builds/{id}/matrix", bs.matrixBuildsHandler).Methods("GET")
+	api.HandleFunc("/builds/{id}/wait", bs.waitBuildHandler).Methods("GET")
+	bs.deprecations.Deprecate(waitRouteDeprecation)
+	api.HandleFunc("/builds/{id}/queue-position", bs.queuePositionHandler).Methods("GET")
+	api.HandleFunc("/builds/{id}/logs", bs.buildLogsHandler).Methods("GET")
+	api.HandleFunc("/builds/{id}/steps/{n}/logs", bs.buildStepLogsHandler).Methods("GET")
+	api.HandleFunc("/builds/{id}/steps/{n}/artifacts", bs.buildStepArtifactsHandler).Methods("GET")
+	api.HandleFunc("/builds/{id}/config/diff", bs.buildConfigDiffHandler).Methods("GET")
+	api.HandleFunc("/builds/{id}/artifacts", bs.listArtifactsHandler).Methods("GET")
+	api.HandleFunc("/builds/{id}/artifacts/{name:.+}", bs.uploadArtifactHandler).Methods("PUT")
+	api.HandleFunc("/builds/{id}/artifacts/{name:.+}", bs.downloadArtifactHandler).Methods("GET")
+	api.HandleFunc("/builds/{id}/provenance", bs.provenanceHandler).Methods("GET")
+	api.HandleFunc("/provenance/public-key", bs.provenanceKeyHandler).Methods("GET")
+	api.HandleFunc("/builds/{id}/otlp/v1/traces", bs.buildTracesHandler).Methods("POST")
+	api.HandleFunc("/projects", bs.createProjectHandler).Methods("POST")
+	api.HandleFunc("/projects", bs.listProjectsHandler).Methods("GET")
+	api.HandleFunc("/projects/bootstrap", bs.bootstrapProjectHandler).Methods("POST")
+	api.HandleFunc("/projects/{id}", bs.getProjectHandler).Methods("GET")
+	api.HandleFunc("/projects/{id}", bs.updateProjectHandler).Methods("PATCH")
+	api.HandleFunc("/projects/{id}/release-notes", bs.releaseNotesHandler).Methods("POST")
+	api.HandleFunc("/projects/{id}/pause", bs.pauseProjectHandler).Methods("POST")
+	api.HandleFunc("/projects/{id}/resume", bs.resumeProjectHandler).Methods("POST")
+	api.HandleFunc("/projects/{id}/failure-causes", bs.failureCausesHandler).Methods("GET")
+	api.HandleFunc("/projects/{id}/stale-branches", bs.staleBranchesHandler).Methods("GET")
+	api.HandleFunc("/projects/{id}/recommendations", bs.recommendationsHandler).Methods("GET")
+	api.HandleFunc("/projects/{id}/downstream", bs.listDownstreamProjectsHandler).Methods("GET")
+	api.HandleFunc("/projects/{id}/downstream", bs.setDownstreamProjectsHandler).Methods("PUT")
+	api.HandleFunc("/project-dependencies", bs.listProjectDependenciesHandler).Methods("GET")
+	api.HandleFunc("/projects/{id}/schedules", bs.createBuildScheduleHandler).Methods("POST")
+	api.HandleFunc("/projects/{id}/schedules", bs.listBuildSchedulesHandler).Methods("GET")
+	api.HandleFunc("/projects/{id}/secrets", bs.listProjectSecretsHandler).Methods("GET")
+	api.HandleFunc("/projects/{id}/secrets/{name}", bs.setProjectSecretHandler).Methods("PUT")
+	api.HandleFunc("/projects/{id}/secrets/{name}", bs.deleteProjectSecretHandler).Methods("DELETE")
+	api.HandleFunc("/schedules/{id}", bs.getBuildScheduleHandler).Methods("GET")
+	api.HandleFunc("/schedules/{id}", bs.updateBuildScheduleHandler).Methods("PATCH")
+	api.HandleFunc("/schedules/{id}", bs.deleteBuildScheduleHandler).Methods("DELETE")
+	api.HandleFunc("/projects/{name}/badge.svg", bs.badgeHandler).Methods("GET")
+	api.HandleFunc("/projects/{name}/status.txt", bs.projectStatusTextHandler).Methods("GET")
+	api.HandleFunc("/deployments", bs.createDeploymentHandler).Methods("POST")
+	api.HandleFunc("/deployments", bs.listDeploymentsHandler).Methods("GET")
+	api.HandleFunc("/deployments/{id}", bs.getDeploymentHandler).Methods("GET")
+	api.HandleFunc("/deployments/{id}", bs.updateDeploymentHandler).Methods("PATCH")
+	api.HandleFunc("/webhooks/github", bs.githubWebhookHandler).Methods("POST")
+	api.HandleFunc("/webhooks/gitlab", bs.gitlabWebhookHandler).Methods("POST")
+	api.HandleFunc("/webhooks/sonarqube", bs.sonarQubeWebhookHandler).Methods("POST")
+	api.HandleFunc("/quality-gates", bs.createQualityGateHandler).Methods("POST")
+	api.HandleFunc("/pipelines/validate", bs.validatePipelineHandler).Methods("POST")
+	api.HandleFunc("/webhooks/subscriptions", bs.createWebhookSubscriptionHandler).Methods("POST")
+	api.HandleFunc("/webhooks/subscriptions", bs.listWebhookSubscriptionsHandler).Methods("GET")
+	api.HandleFunc("/webhooks/subscriptions/{id}", bs.getWebhookSubscriptionHandler).Methods("GET")
+	api.HandleFunc("/webhooks/subscriptions/{id}", bs.updateWebhookSubscriptionHandler).Methods("PATCH")
+	api.HandleFunc("/webhooks/subscriptions/{id}", bs.deleteWebhookSubscriptionHandler).Methods("DELETE")
+	api.HandleFunc("/webhooks/subscriptions/{id}/deliveries", bs.listWebhookDeliveriesHandler).Methods("GET")
+	api.HandleFunc("/webhooks/deliveries/{id}", bs.getWebhookDeliveryHandler).Methods("GET")
+	api.HandleFunc("/webhooks/deliveries/{id}/replay", bs.replayWebhookDeliveryHandler).Methods("POST")
+	api.HandleFunc("/notifications/digests", bs.createNotificationDigestHandler).Methods("POST")
+	api.HandleFunc("/notifications/digests", bs.listNotificationDigestsHandler).Methods("GET")
+	api.HandleFunc("/notifications/digests/{id}", bs.deleteNotificationDigestHandler).Methods("DELETE")
+	api.HandleFunc("/slack/commands", bs.slackCommandHandler).Methods("POST")
+	api.HandleFunc("/issues/{key}/builds", bs.listIssueBuildsHandler).Methods("GET")
+	api.Handle("/audit", requireAdmin(http.HandlerFunc(bs.listAuditLogHandler))).Methods("GET")
+
+	// Admin routes
+	admin := api.PathPrefix("/admin").Subrouter()
+	admin.Use(requireAdmin)
+	admin.HandleFunc("/access-log", bs.listAccessLogRulesHandler).Methods("GET")
+	admin.HandleFunc("/access-log", bs.updateAccessLogRuleHandler).Methods("PUT")
+	admin.HandleFunc("/deprecations", bs.deprecationReportHandler).Methods("GET")
+	admin.HandleFunc("/usage", bs.usageReportHandler).Methods("GET")
+	admin.HandleFunc("/requests", bs.requestWatchdogHandler).Methods("GET")
+	admin.HandleFunc("/janitor", bs.janitorReportHandler).Methods("GET")
+	admin.HandleFunc("/workers", bs.listWorkersHandler).Methods("GET")
+	admin.HandleFunc("/workers/{id}/drain", bs.drainWorkerHandler).Methods("POST")
+	admin.HandleFunc("/workers/{id}/undrain", bs.undrainWorkerHandler).Methods("POST")
+	admin.HandleFunc("/queue", bs.queueOverviewHandler).Methods("GET")
+	admin.HandleFunc("/queue/pause", bs.pauseQueueHandler).Methods("POST")
+	admin.HandleFunc("/queue/resume", bs.resumeQueueHandler).Methods("POST")
+	admin.HandleFunc("/shadow", bs.shadowReportHandler).Methods("GET")
+	admin.HandleFunc("/fair-share", bs.listFairShareLimitsHandler).Methods("GET")
+	admin.HandleFunc("/fair-share/{org}", bs.setFairShareLimitHandler).Methods("PUT")
+	admin.HandleFunc("/fair-share/{org}", bs.deleteFairShareLimitHandler).Methods("DELETE")
+	admin.HandleFunc("/image-policies", bs.listImagePoliciesHandler).Methods("GET")
+	admin.HandleFunc("/image-policies/{org}", bs.setImagePolicyHandler).Methods("PUT")
+	admin.HandleFunc("/image-policies/{org}", bs.deleteImagePolicyHandler).Methods("DELETE")
+	admin.HandleFunc("/erasures", bs.listDataErasuresHandler).Methods("GET")
+	admin.HandleFunc("/erasures", bs.eraseUserDataHandler).Methods("POST")
+	admin.HandleFunc("/janitor/run", bs.runJanitorHandler).Methods("POST")
+	admin.HandleFunc("/credentials/rotation", bs.credentialRotationHandler).Methods("GET")
+	admin.HandleFunc("/credentials/rotate", bs.rotateCredentialsHandler).Methods("POST")
+	admin.HandleFunc("/integrations", bs.listIntegrationsHandler).Methods("GET")
+	admin.HandleFunc("/integrations/{name}/enable", bs.enableIntegrationHandler).Methods("POST")
+	admin.HandleFunc("/incidents", bs.listIncidentsHandler).Methods("GET")
+	admin.HandleFunc("/incidents", bs.createIncidentHandler).Methods("POST")
+	admin.HandleFunc("/incidents/{id}", bs.updateIncidentHandler).Methods("PATCH")
+	admin.HandleFunc("/orgs", bs.listOrganizationsHandler).Methods("GET")
+	admin.HandleFunc("/orgs", bs.createOrganizationHandler).Methods("POST")
+	admin.HandleFunc("/orgs/{org}", bs.updateOrganizationHandler).Methods("PATCH")
+	admin.HandleFunc("/orgs/{org}/api-keys", bs.listAPIKeysHandler).Methods("GET")
+	admin.HandleFunc("/orgs/{org}/api-keys", bs.createAPIKeyHandler).Methods("POST")
+	admin.HandleFunc("/api-keys/{id}", bs.revokeAPIKeyHandler).Methods("DELETE")
+
+	// API documentation
+	api.HandleFunc("/openapi.json", bs.openAPIHandler).Methods("GET")
+	router.HandleFunc("/docs", bs.docsHandler).Methods("GET")
+
+	// Public status page
+	router.HandleFunc("/status", bs.statusPageHandler).Methods("GET")
+
+	// Metrics endpoint
+	router.Handle("/metrics", promhttp.Handler())
+
+	router.Use(bs.tracer.Middleware, bs.metrics.Middleware, bs.catalog.Middleware, bs.watchdog.Middleware, bs.dbBreaker.Middleware, bs.tenancy.Middleware, bs.rateLimiter.Middleware, bs.deprecations.Middleware, bs.usage.Middleware, bs.AuditMiddleware, bs.accessLog.Middleware)
+
+	// The document is generated from the registered routes so it can't drift
+	spec, err := generateOpenAPI(router)
+	if err != nil {
+		return nil, fmt.Errorf("generating OpenAPI document: %w", err)
+	}
+	bs.openAPI = spec
+
+	return router, nil
 }
 
 func main() {
@@ -260,26 +1386,58 @@ func main() {
 	}
 	defer db.Close()
 
-	// Initialize tables
-	if err := db.InitTables(); err != nil {
-		log.Fatalf("Failed to initialize database tables: %v", err)
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		migrator, err := NewMigrator(db.db.DB)
+		if err != nil {
+			log.Fatalf("Failed to load migrations: %v", err)
+		}
+		if err := runMigrateCommand(migrator, os.Args[2:], os.Stdout); err != nil {
+			log.Fatalf("Migration failed: %v", err)
+		}
+		return
+	}
+
+	// Apply pending migrations unless they're run separately with `migrate up`
+	if getEnvInt("AUTO_MIGRATE", 1) == 1 {
+		if err := db.InitTables(); err != nil {
+			log.Fatalf("Failed to initialize database tables: %v", err)
+		}
 	}
 
-	// Create build service
+	// Create build service and start the worker pool
 	service := NewBuildService(db)
+	db.Instrument(&service.metrics.DBDuration)
+	db.Protect(service.dbBreaker)
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+	service.queue.Start(workerCtx)
+	service.queueSLA.Start(workerCtx)
+	service.delivery.Start(workerCtx)
+	service.webhooks.Start(workerCtx)
+	service.artifacts.Start(workerCtx)
+	service.janitor.Start(workerCtx)
+	service.drafts.Start(workerCtx)
+	service.digests.Start(workerCtx)
+	service.archiver.Start(workerCtx)
+	service.staleBranches.Start(workerCtx)
+	service.schedules.Start(workerCtx)
+	service.usage.Start(workerCtx)
+	service.watchdog.Start(workerCtx)
+	service.rateLimiter.Start(workerCtx)
+	service.worker.Start(workerCtx)
 
-	// Setup router
-	router := mux.NewRouter()
+	if service.tenancy.oidc, err = NewOIDCVerifierFromEnv(); err != nil {
+		log.Fatalf("Failed to configure OIDC: %v", err)
+	}
 
-	// API routes
-	api := router.PathPrefix("/api/v1").Subrouter()
-	api.HandleFunc("/health", service.healthHandler).Methods("GET")
-	api.HandleFunc("/builds", service.createBuildHandler).Methods("POST")
-	api.HandleFunc("/builds", service.listBuildsHandler).Methods("GET")
-	api.HandleFunc("/builds/{id}", service.getBuildHandler).Methods("GET")
+	router, err := service.Router()
+	if err != nil {
+		log.Fatalf("Failed to set up routes: %v", err)
+	}
 
-	// Metrics endpoint
-	router.Handle("/metrics", promhttp.Handler())
+	certs, err := NewHostCertificatesFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to load TLS certificates: %v", err)
+	}
 
 	// Setup server
 	port := os.Getenv("PORT")
@@ -289,16 +1447,46 @@ func main() {
 
 	srv := &http.Server{
 		Addr:         ":" + port,
-		Handler:      router,
+		Handler:      withBasePath(basePathFromEnv(), router),
 		ReadTimeout:  15 * time.Second,
 		WriteTimeout: 15 * time.Second,
 		IdleTimeout:  60 * time.Second,
 	}
+	if certs != nil {
+		srv.TLSConfig = certs.TLSConfig()
+	}
+	// Shutdown waits for active requests; end event streams so it doesn't hang
+	srv.RegisterOnShutdown(func() { close(service.streamsDone) })
+
+	// Plain HTTP requests can be redirected to HTTPS on another port
+	var redirect *http.Server
+	if redirectPort := os.Getenv("TLS_REDIRECT_PORT"); redirectPort != "" {
+		if certs == nil {
+			log.Fatalf("TLS_REDIRECT_PORT is set without a TLS certificate")
+		}
+		redirect = &http.Server{
+			Addr:         ":" + redirectPort,
+			Handler:      httpsRedirect(port),
+			ReadTimeout:  15 * time.Second,
+			WriteTimeout: 15 * time.Second,
+			IdleTimeout:  60 * time.Second,
+		}
+		go func() {
+			log.Printf("Redirecting HTTP on port %s to HTTPS", redirectPort)
+			if err := redirect.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("Redirect server failed to start: %v", err)
+			}
+		}()
+	}
 
 	// Start server in goroutine
 	go func() {
 		log.Printf("Starting build service on port %s", port)
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		serve := srv.ListenAndServe
+		if certs != nil {
+			serve = func() error { return srv.ListenAndServeTLS("", "") }
+		}
+		if err := serve(); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Server failed to start: %v", err)
 		}
 	}()
@@ -315,9 +1503,25 @@ func main() {
 	defer cancel()
 
 	// Shutdown server
+	if redirect != nil {
+		redirect.Shutdown(ctx)
+	}
 	if err := srv.Shutdown(ctx); err != nil {
 		log.Fatalf("Server forced to shutdown: %v", err)
 	}
 
+	// Stop workers; interrupted builds are returned to the queue
+	stopWorkers()
+	service.queue.Wait()
+	service.usage.Flush()
+	service.worker.Flush(ctx)
+
+	if err := service.tracer.Close(ctx); err != nil {
+		log.Printf("Error flushing trace spans: %v", err)
+	}
+	if err := service.errors.Close(ctx); err != nil {
+		log.Printf("Error flushing error reports: %v", err)
+	}
+
 	log.Println("Server exited")
 }
@@ -2,17 +2,21 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 )
 
 // MockDatabase is a mock implementation of DatabaseInterface
@@ -20,32 +24,1135 @@ type MockDatabase struct {
 	mock.Mock
 }
 
+func (m *MockDatabase) ListUserQueueUsage(org string, fairShare int) ([]*UserQueueUsage, error) {
+	args := m.Called(org, fairShare)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*UserQueueUsage), args.Error(1)
+}
+
+func (m *MockDatabase) CreateBuildUnlessActive(build *BuildRequest) (int, *BuildRequest, error) {
+	args := m.Called(build)
+	if args.Get(1) == nil {
+		return args.Int(0), nil, args.Error(2)
+	}
+	return args.Int(0), args.Get(1).(*BuildRequest), args.Error(2)
+}
+
+func (m *MockDatabase) CreateBuilds(builds []*BuildRequest) ([]int, error) {
+	args := m.Called(builds)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]int), args.Error(1)
+}
+
+func (m *MockDatabase) RecordBuildDuration(projectName, branch string, seconds float64, window int) error {
+	args := m.Called(projectName, branch, seconds, window)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) GetBuildDurations(projectName, branch string) ([]float64, error) {
+	args := m.Called(projectName, branch)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]float64), args.Error(1)
+}
+
+func (m *MockDatabase) GetQueueState(id int, fairShare int) (*QueueState, error) {
+	args := m.Called(id, fairShare)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*QueueState), args.Error(1)
+}
+
+func (m *MockDatabase) GetQueueDepth() (*QueueDepth, error) {
+	args := m.Called()
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*QueueDepth), args.Error(1)
+}
+
+func (m *MockDatabase) GetQueueControl() (*QueueControl, error) {
+	args := m.Called()
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*QueueControl), args.Error(1)
+}
+
+func (m *MockDatabase) SetQueuePaused(paused bool, reason string) (*QueueControl, error) {
+	args := m.Called(paused, reason)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*QueueControl), args.Error(1)
+}
+
+func (m *MockDatabase) RegisterWorker(worker *Worker) error {
+	args := m.Called(worker)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) ListWorkers(since time.Time) ([]*Worker, error) {
+	args := m.Called(since)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*Worker), args.Error(1)
+}
+
+func (m *MockDatabase) SetWorkerDraining(id string, draining bool) (*Worker, error) {
+	args := m.Called(id, draining)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*Worker), args.Error(1)
+}
+
+func (m *MockDatabase) ListInFlightBuilds() ([]*InFlightBuild, error) {
+	args := m.Called()
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*InFlightBuild), args.Error(1)
+}
+
+func (m *MockDatabase) ListFairShareLimits() ([]*FairShareLimit, error) {
+	args := m.Called()
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*FairShareLimit), args.Error(1)
+}
+
+func (m *MockDatabase) SetFairShareLimit(limit *FairShareLimit) error {
+	args := m.Called(limit)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) DeleteFairShareLimit(org string) error {
+	args := m.Called(org)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) SaveBuildStages(buildID int, stages []*BuildStage) error {
+	args := m.Called(buildID, stages)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) SaveBuildProblems(buildID int, problems []*BuildProblem) error {
+	args := m.Called(buildID, problems)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) ListBuildProblems(buildID int) ([]*BuildProblem, error) {
+	args := m.Called(buildID)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*BuildProblem), args.Error(1)
+}
+
+func (m *MockDatabase) ListBuildStages(buildID int) ([]*BuildStage, error) {
+	args := m.Called(buildID)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*BuildStage), args.Error(1)
+}
+
+func (m *MockDatabase) StartDraftBuild(id int) (*BuildRequest, error) {
+	args := m.Called(id)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*BuildRequest), args.Error(1)
+}
+
+func (m *MockDatabase) StartDueDraftBuilds() ([]*BuildRequest, error) {
+	args := m.Called()
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*BuildRequest), args.Error(1)
+}
+
+func (m *MockDatabase) ListBuildFamily(id int) ([]*BuildRequest, error) {
+	args := m.Called(id)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*BuildRequest), args.Error(1)
+}
+
+func (m *MockDatabase) CancelBuild(id int, reason, actor string) (*BuildRequest, error) {
+	args := m.Called(id, reason, actor)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*BuildRequest), args.Error(1)
+}
+
+func (m *MockDatabase) ListImagePolicies() ([]*ImagePolicy, error) {
+	args := m.Called()
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*ImagePolicy), args.Error(1)
+}
+
+func (m *MockDatabase) GetImagePolicy(org string) (*ImagePolicy, error) {
+	args := m.Called(org)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*ImagePolicy), args.Error(1)
+}
+
+func (m *MockDatabase) SetImagePolicy(policy *ImagePolicy) error {
+	args := m.Called(policy)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) DeleteImagePolicy(org string) error {
+	args := m.Called(org)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) EraseUserData(erasure *UserErasure, pseudonym string) (*DataErasure, error) {
+	args := m.Called(erasure, pseudonym)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*DataErasure), args.Error(1)
+}
+
+func (m *MockDatabase) ListDataErasures() ([]*DataErasure, error) {
+	args := m.Called()
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*DataErasure), args.Error(1)
+}
+
+func (m *MockDatabase) DeleteBuild(id int) (*BuildRequest, error) {
+	args := m.Called(id)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*BuildRequest), args.Error(1)
+}
+
+func (m *MockDatabase) ArchiveBuilds(before time.Time, limit int) (int64, error) {
+	args := m.Called(before, limit)
+	return args.Get(0).(int64), args.Error(1)
+}
+
+func (m *MockDatabase) CreateNotificationDigest(digest *NotificationDigest) error {
+	args := m.Called(digest)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) ListNotificationDigests() ([]*NotificationDigest, error) {
+	args := m.Called()
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*NotificationDigest), args.Error(1)
+}
+
+func (m *MockDatabase) DeleteNotificationDigest(id int) error {
+	args := m.Called(id)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) ClaimDueNotificationDigests(now time.Time) ([]*NotificationDigest, error) {
+	args := m.Called(now)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*NotificationDigest), args.Error(1)
+}
+
+func (m *MockDatabase) ListBuildsFinishedBetween(since, until time.Time, projects, statuses []string, limit int) ([]*BuildRequest, error) {
+	args := m.Called(since, until, projects, statuses, limit)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*BuildRequest), args.Error(1)
+}
+
+func (m *MockDatabase) CreateBuildSchedule(schedule *BuildSchedule) error {
+	args := m.Called(schedule)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) GetBuildSchedule(id int) (*BuildSchedule, error) {
+	args := m.Called(id)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*BuildSchedule), args.Error(1)
+}
+
+func (m *MockDatabase) ListBuildSchedules(projectID int) ([]*BuildSchedule, error) {
+	args := m.Called(projectID)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*BuildSchedule), args.Error(1)
+}
+
+func (m *MockDatabase) UpdateBuildSchedule(schedule *BuildSchedule) error {
+	args := m.Called(schedule)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) DeleteBuildSchedule(id int) error {
+	args := m.Called(id)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) ListDueBuildSchedules(now time.Time) ([]*BuildSchedule, error) {
+	args := m.Called(now)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*BuildSchedule), args.Error(1)
+}
+
+func (m *MockDatabase) DisableBuildSchedules(ids []int) (int64, error) {
+	args := m.Called(ids)
+	return args.Get(0).(int64), args.Error(1)
+}
+
+func (m *MockDatabase) ListStaleBranches(project *Project, before time.Time, activity []string) ([]*StaleBranch, error) {
+	args := m.Called(project, before, activity)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*StaleBranch), args.Error(1)
+}
+
+func (m *MockDatabase) RecordBuildScheduleRun(id int, ranAt time.Time, buildID *int, next *time.Time) error {
+	args := m.Called(id, ranAt, buildID, next)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) TryAdvisoryLock(key int64) (AdvisoryLock, error) {
+	args := m.Called(key)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(AdvisoryLock), args.Error(1)
+}
+
+func (m *MockDatabase) CreateWebhookDelivery(delivery *WebhookDelivery) error {
+	args := m.Called(delivery)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) GetWebhookDelivery(id int) (*WebhookDelivery, error) {
+	args := m.Called(id)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*WebhookDelivery), args.Error(1)
+}
+
+func (m *MockDatabase) UpdateWebhookDelivery(delivery *WebhookDelivery) error {
+	args := m.Called(delivery)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) ListWebhookDeliveries(subscriptionID int, status string, limit int) ([]*WebhookDelivery, error) {
+	args := m.Called(subscriptionID, status, limit)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*WebhookDelivery), args.Error(1)
+}
+
+func (m *MockDatabase) ClaimWebhookDeliveries(limit int, lease time.Duration) ([]*WebhookDelivery, error) {
+	args := m.Called(limit, lease)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*WebhookDelivery), args.Error(1)
+}
+
+func (m *MockDatabase) DeleteWebhookDeliveriesBefore(cutoff time.Time) (int64, error) {
+	args := m.Called(cutoff)
+	return args.Get(0).(int64), args.Error(1)
+}
+
+func (m *MockDatabase) ListDownstreamBuilds(id int) ([]*BuildRequest, error) {
+	args := m.Called(id)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*BuildRequest), args.Error(1)
+}
+
+func (m *MockDatabase) BlockDownstreamBuilds(id int) ([]*BuildRequest, error) {
+	args := m.Called(id)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*BuildRequest), args.Error(1)
+}
+
+func (m *MockDatabase) SetBuildCancellation(id int, reason, actor string) error {
+	args := m.Called(id, reason, actor)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) SetBuildFailureCategory(id int, category string) error {
+	args := m.Called(id, category)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) SetBuildLogTruncation(id int, reason string) error {
+	args := m.Called(id, reason)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) CountAutoRetries(id int) (int, error) {
+	args := m.Called(id)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockDatabase) GetProjectStats(since time.Time, org string) ([]*ProjectStats, error) {
+	args := m.Called(since, org)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*ProjectStats), args.Error(1)
+}
+
+func (m *MockDatabase) GetDurationStats(since time.Time, interval, projectName, org string) ([]*DurationStats, error) {
+	args := m.Called(since, interval, projectName, org)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*DurationStats), args.Error(1)
+}
+
+func (m *MockDatabase) GetDailyBuildCounts(since time.Time, projectName, org string) ([]*DailyBuildCount, error) {
+	args := m.Called(since, projectName, org)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*DailyBuildCount), args.Error(1)
+}
+
+func (m *MockDatabase) GetFlakyProjects(since time.Time, org string, limit int) ([]*FlakyProject, error) {
+	args := m.Called(since, org, limit)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*FlakyProject), args.Error(1)
+}
+
+func (m *MockDatabase) CountFailureCategories(projectName string, since time.Time) (map[string]int, error) {
+	args := m.Called(projectName, since)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(map[string]int), args.Error(1)
+}
+
+func (m *MockDatabase) GetPreviousFinishedBuild(projectName, branch string, beforeID int) (*BuildRequest, error) {
+	args := m.Called(projectName, branch, beforeID)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*BuildRequest), args.Error(1)
+}
+
+func (m *MockDatabase) GetTagBuild(projectName, tag string) (*BuildRequest, error) {
+	args := m.Called(projectName, tag)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*BuildRequest), args.Error(1)
+}
+
+func (m *MockDatabase) GetLatestFinishedBuild(projectName, branch string) (*BuildRequest, error) {
+	args := m.Called(projectName, branch)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*BuildRequest), args.Error(1)
+}
+
+func (m *MockDatabase) GetBuildByIdempotencyKey(org, key string) (*BuildRequest, error) {
+	args := m.Called(org, key)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*BuildRequest), args.Error(1)
+}
+
 func (m *MockDatabase) CreateBuild(build *BuildRequest) (int, error) {
 	args := m.Called(build)
 	return args.Int(0), args.Error(1)
 }
 
-func (m *MockDatabase) GetBuild(id int) (*BuildRequest, error) {
-	args := m.Called(id)
+func (m *MockDatabase) GetBuild(id int) (*BuildRequest, error) {
+	args := m.Called(id)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*BuildRequest), args.Error(1)
+}
+
+func (m *MockDatabase) ListBuilds(includeDeleted bool, org string, labels Labels) ([]*BuildRequest, error) {
+	args := m.Called(includeDeleted, org, labels)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*BuildRequest), args.Error(1)
+}
+
+func (m *MockDatabase) ListRecentBuilds(projectName, status, org string, limit int) ([]*BuildRequest, error) {
+	args := m.Called(projectName, status, org, limit)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*BuildRequest), args.Error(1)
+}
+
+func (m *MockDatabase) UpdateBuildStatus(id int, status string) error {
+	args := m.Called(id, status)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) UpdateBuildResult(id int, status string, exitCode int) error {
+	args := m.Called(id, status, exitCode)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) ClaimNextBuild(workerID string, lease time.Duration, fairShare int) (*BuildRequest, error) {
+	args := m.Called(workerID, lease, fairShare)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*BuildRequest), args.Error(1)
+}
+
+func (m *MockDatabase) ExpireQueuedBuilds(maxAge time.Duration) ([]*BuildRequest, error) {
+	args := m.Called(maxAge)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*BuildRequest), args.Error(1)
+}
+
+func (m *MockDatabase) RenewBuildLease(id int, workerID string, lease time.Duration) (bool, error) {
+	args := m.Called(id, workerID, lease)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *MockDatabase) ReleaseBuild(id int) error {
+	args := m.Called(id)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) RequeueExpiredBuilds() (int64, error) {
+	args := m.Called()
+	return args.Get(0).(int64), args.Error(1)
+}
+
+func (m *MockDatabase) CreateProject(project *Project) (int, error) {
+	args := m.Called(project)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockDatabase) GetProject(id int) (*Project, error) {
+	args := m.Called(id)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*Project), args.Error(1)
+}
+
+func (m *MockDatabase) GetProjectByRepository(repoKey string) (*Project, error) {
+	args := m.Called(repoKey)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*Project), args.Error(1)
+}
+
+func (m *MockDatabase) UpdateProject(project *Project) error {
+	args := m.Called(project)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) GetProjectByName(name string) (*Project, error) {
+	args := m.Called(name)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*Project), args.Error(1)
+}
+
+func (m *MockDatabase) CreateSlackThread(thread *SlackThread) error {
+	args := m.Called(thread)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) GetSlackThread(buildID int) (*SlackThread, error) {
+	args := m.Called(buildID)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*SlackThread), args.Error(1)
+}
+
+func (m *MockDatabase) AddBuildIssues(buildID int, keys []string) error {
+	args := m.Called(buildID, keys)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) ListBuildIssues(buildID int) ([]string, error) {
+	args := m.Called(buildID)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]string), args.Error(1)
+}
+
+func (m *MockDatabase) ListBuildsByIssue(key, org string) ([]*BuildRequest, error) {
+	args := m.Called(key, org)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*BuildRequest), args.Error(1)
+}
+
+func (m *MockDatabase) ListBuildsByCommit(sha string, includeDeleted bool, org string, labels Labels) ([]*BuildRequest, error) {
+	args := m.Called(sha, includeDeleted, org, labels)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*BuildRequest), args.Error(1)
+}
+
+func (m *MockDatabase) UpdateBuildCommit(id int, commit *CommitInfo) error {
+	args := m.Called(id, commit)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) UpdateBuild(id int, update *BuildUpdate, updatedAt time.Time) (*BuildRequest, error) {
+	args := m.Called(id, update, updatedAt)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*BuildRequest), args.Error(1)
+}
+
+func (m *MockDatabase) ListProjectBuildsBetween(projectName string, afterID, throughID int) ([]*BuildRequest, error) {
+	args := m.Called(projectName, afterID, throughID)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*BuildRequest), args.Error(1)
+}
+
+func (m *MockDatabase) CreateArtifact(artifact *Artifact) (int, error) {
+	args := m.Called(artifact)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockDatabase) GetArtifact(buildID int, name string) (*Artifact, error) {
+	args := m.Called(buildID, name)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*Artifact), args.Error(1)
+}
+
+func (m *MockDatabase) ListArtifacts(buildID int) ([]*Artifact, error) {
+	args := m.Called(buildID)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*Artifact), args.Error(1)
+}
+
+func (m *MockDatabase) ListStepArtifacts(buildID, step int) ([]*Artifact, error) {
+	args := m.Called(buildID, step)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*Artifact), args.Error(1)
+}
+
+func (m *MockDatabase) ListArtifactsCreatedBefore(cutoff time.Time, limit int) ([]*Artifact, error) {
+	args := m.Called(cutoff, limit)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*Artifact), args.Error(1)
+}
+
+func (m *MockDatabase) ListAllArtifacts() ([]*Artifact, error) {
+	args := m.Called()
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*Artifact), args.Error(1)
+}
+
+func (m *MockDatabase) DeleteArtifact(id int) error {
+	args := m.Called(id)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) UpdateBuildVersion(id int, version string) error {
+	args := m.Called(id, version)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) GetIntegration(name string) (*IntegrationState, error) {
+	args := m.Called(name)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*IntegrationState), args.Error(1)
+}
+
+func (m *MockDatabase) ListIntegrations() ([]*IntegrationState, error) {
+	args := m.Called()
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*IntegrationState), args.Error(1)
+}
+
+func (m *MockDatabase) RecordIntegrationFailure(name, lastError string, threshold int) (*IntegrationState, error) {
+	args := m.Called(name, lastError, threshold)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*IntegrationState), args.Error(1)
+}
+
+func (m *MockDatabase) ResetIntegrationFailures(name string) error {
+	args := m.Called(name)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) EnableIntegration(name string) error {
+	args := m.Called(name)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) CreateOutboxEvent(event *OutboxEvent) error {
+	args := m.Called(event)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) ClaimOutboxEvents(limit int, lease time.Duration) ([]*OutboxEvent, error) {
+	args := m.Called(limit, lease)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*OutboxEvent), args.Error(1)
+}
+
+func (m *MockDatabase) MarkOutboxEventDelivered(id int64) error {
+	args := m.Called(id)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) RetryOutboxEvent(id int64, lastError string, nextAttemptAt time.Time) error {
+	args := m.Called(id, lastError, nextAttemptAt)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) DeferOutboxEvent(id int64, nextAttemptAt time.Time) error {
+	args := m.Called(id, nextAttemptAt)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) FailOutboxEvent(id int64, lastError string) error {
+	args := m.Called(id, lastError)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) OutboxBacklog() ([]*OutboxBacklog, error) {
+	args := m.Called()
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*OutboxBacklog), args.Error(1)
+}
+
+func (m *MockDatabase) DeleteDeliveredOutboxEvents(before time.Time) (int64, error) {
+	args := m.Called(before)
+	return args.Get(0).(int64), args.Error(1)
+}
+
+func (m *MockDatabase) SetProjectPaused(id int, paused bool, reason string) (*Project, error) {
+	args := m.Called(id, paused, reason)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*Project), args.Error(1)
+}
+
+func (m *MockDatabase) GetQueueStats(since time.Time) (*QueueStats, error) {
+	args := m.Called(since)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*QueueStats), args.Error(1)
+}
+
+func (m *MockDatabase) CreateIncident(incident *Incident) error {
+	args := m.Called(incident)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) GetIncident(id int) (*Incident, error) {
+	args := m.Called(id)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*Incident), args.Error(1)
+}
+
+func (m *MockDatabase) UpdateIncident(incident *Incident) error {
+	args := m.Called(incident)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) ListIncidents(includeResolved bool) ([]*Incident, error) {
+	args := m.Called(includeResolved)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*Incident), args.Error(1)
+}
+
+func (m *MockDatabase) CreateDeployment(deployment *Deployment) error {
+	args := m.Called(deployment)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) GetDeployment(id int) (*Deployment, error) {
+	args := m.Called(id)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*Deployment), args.Error(1)
+}
+
+func (m *MockDatabase) UpdateDeploymentStatus(id int, from, to string) (*Deployment, error) {
+	args := m.Called(id, from, to)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*Deployment), args.Error(1)
+}
+
+func (m *MockDatabase) ListDeployments(projectName, environment, org string) ([]*Deployment, error) {
+	args := m.Called(projectName, environment, org)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*Deployment), args.Error(1)
+}
+
+func (m *MockDatabase) CreateWebhookSubscription(subscription *WebhookSubscription) error {
+	args := m.Called(subscription)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) GetWebhookSubscription(id int) (*WebhookSubscription, error) {
+	args := m.Called(id)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*WebhookSubscription), args.Error(1)
+}
+
+func (m *MockDatabase) UpdateWebhookSubscription(subscription *WebhookSubscription) error {
+	args := m.Called(subscription)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) DeleteWebhookSubscription(id int) error {
+	args := m.Called(id)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) ListWebhookSubscriptions() ([]*WebhookSubscription, error) {
+	args := m.Called()
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*WebhookSubscription), args.Error(1)
+}
+
+func (m *MockDatabase) ProjectQueueWaits() ([]*ProjectQueueWait, error) {
+	args := m.Called()
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*ProjectQueueWait), args.Error(1)
+}
+
+func (m *MockDatabase) SaveBuildConfig(buildID int, config ConfigSnapshot) error {
+	args := m.Called(buildID, config)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) GetBuildConfig(buildID int) (ConfigSnapshot, error) {
+	args := m.Called(buildID)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(ConfigSnapshot), args.Error(1)
+}
+
+func (m *MockDatabase) RecordAPIUsage(records []*APIUsage) error {
+	args := m.Called(records)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) GetUsageReport(since time.Time, org string) (*UsageReport, error) {
+	args := m.Called(since, org)
 	if args.Get(0) == nil {
 		return nil, args.Error(1)
 	}
-	return args.Get(0).(*BuildRequest), args.Error(1)
+	return args.Get(0).(*UsageReport), args.Error(1)
+}
+
+func (m *MockDatabase) DeleteAPIUsageBefore(before time.Time) (int64, error) {
+	args := m.Called(before)
+	return args.Get(0).(int64), args.Error(1)
+}
+
+func (m *MockDatabase) ListProjects(org string, labels Labels) ([]*Project, error) {
+	args := m.Called(org, labels)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*Project), args.Error(1)
 }
 
-func (m *MockDatabase) ListBuilds() ([]*BuildRequest, error) {
+func (m *MockDatabase) CreateOrganization(org *Organization) error {
+	args := m.Called(org)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) GetOrganization(name string) (*Organization, error) {
+	args := m.Called(name)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*Organization), args.Error(1)
+}
+
+func (m *MockDatabase) UpdateOrganization(org *Organization) error {
+	args := m.Called(org)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) ListOrganizations() ([]*Organization, error) {
 	args := m.Called()
 	if args.Get(0) == nil {
 		return nil, args.Error(1)
 	}
+	return args.Get(0).([]*Organization), args.Error(1)
+}
+
+func (m *MockDatabase) CreateAPIKey(key *APIKey, hash string) error {
+	args := m.Called(key, hash)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) GetAPIKeyByHash(hash string) (*APIKey, error) {
+	args := m.Called(hash)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*APIKey), args.Error(1)
+}
+
+func (m *MockDatabase) ListAPIKeys(org string) ([]*APIKey, error) {
+	args := m.Called(org)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*APIKey), args.Error(1)
+}
+
+func (m *MockDatabase) RevokeAPIKey(id int) (*APIKey, error) {
+	args := m.Called(id)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*APIKey), args.Error(1)
+}
+
+func (m *MockDatabase) TouchAPIKey(id int) error {
+	args := m.Called(id)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) CreateAuditEntry(entry *AuditEntry) error {
+	args := m.Called(entry)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) ListAuditEntries(filter AuditFilter) ([]*AuditEntry, error) {
+	args := m.Called(filter)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*AuditEntry), args.Error(1)
+}
+
+func (m *MockDatabase) ListProjectSecrets(projectID int) ([]*ProjectSecret, error) {
+	args := m.Called(projectID)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*ProjectSecret), args.Error(1)
+}
+
+func (m *MockDatabase) SetProjectSecret(secret *ProjectSecret) error {
+	args := m.Called(secret)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) ResealProjectSecret(secret *ProjectSecret) error {
+	args := m.Called(secret)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) DeleteProjectSecret(projectID int, name string) error {
+	args := m.Called(projectID, name)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) SaveQualityGate(gate *QualityGate) error {
+	args := m.Called(gate)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) ListQualityGates(projectName, commitSHA string) ([]*QualityGate, error) {
+	args := m.Called(projectName, commitSHA)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*QualityGate), args.Error(1)
+}
+
+func (m *MockDatabase) ListProjectDependencies(org string) ([]*ProjectDependency, error) {
+	args := m.Called(org)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*ProjectDependency), args.Error(1)
+}
+
+func (m *MockDatabase) SetDownstreamProjects(projectID int, downstreamIDs []int) error {
+	args := m.Called(projectID, downstreamIDs)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) ListDownstreamProjects(projectID int) ([]*Project, error) {
+	args := m.Called(projectID)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*Project), args.Error(1)
+}
+
+func (m *MockDatabase) ListTriggeringBuilds(id int) ([]*BuildRequest, error) {
+	args := m.Called(id)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
 	return args.Get(0).([]*BuildRequest), args.Error(1)
 }
 
-func (m *MockDatabase) UpdateBuildStatus(id int, status string) error {
+func (m *MockDatabase) ListTriggeredBuilds(id int) ([]*BuildRequest, error) {
+	args := m.Called(id)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*BuildRequest), args.Error(1)
+}
+
+func (m *MockDatabase) RecordBuildUsage(id int, usage *ResourceUsage) error {
+	args := m.Called(id, usage)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) ListBuildUsage(projectName string, limit int) ([]*BuildUsage, error) {
+	args := m.Called(projectName, limit)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*BuildUsage), args.Error(1)
+}
+
+func (m *MockDatabase) ListMatrixBuilds(parentID int) ([]*BuildRequest, error) {
+	args := m.Called(parentID)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*BuildRequest), args.Error(1)
+}
+
+func (m *MockDatabase) DetachMatrixBuild(id int) error {
+	args := m.Called(id)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) FinishMatrixBuild(id int, status string, exitCode int) (bool, error) {
+	args := m.Called(id, status, exitCode)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *MockDatabase) CreateEscalation(escalation *Escalation) error {
+	args := m.Called(escalation)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) ListOpenEscalations(dedupKey string) ([]*Escalation, error) {
+	args := m.Called(dedupKey)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*Escalation), args.Error(1)
+}
+
+func (m *MockDatabase) UpdateEscalationStatus(id int, status string) error {
 	args := m.Called(id, status)
 	return args.Error(0)
 }
 
+func (m *MockDatabase) ListBuildEscalations(buildID int) ([]*Escalation, error) {
+	args := m.Called(buildID)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*Escalation), args.Error(1)
+}
+
 func (m *MockDatabase) Ping() error {
 	args := m.Called()
 	return args.Error(0)
@@ -66,9 +1173,36 @@ func setupTestService() (*BuildService, *MockDatabase) {
 	// Create a new registry for each test to avoid conflicts
 	registry := prometheus.NewRegistry()
 	service := NewBuildServiceWithRegistry(mockDB, registry)
+	service.executor = &SimulatedExecutor{}
+	// Cancellation is checked through the registry of running builds only,
+	// so processing doesn't poll the mock for the build's status
+	service.cancelCheckInterval = 0
+	// The webhook and notification sinks are always registered, checking for
+	// subscriptions on every build event and for the project's notification
+	// settings when a build finishes
+	mockDB.On("ListWebhookSubscriptions").Return([]*WebhookSubscription{}, nil).Maybe()
+	mockDB.On("ListOrganizations").Return([]*Organization{}, nil).Maybe()
+	mockDB.On("CreateAuditEntry", mock.Anything).Return(nil).Maybe()
+	mockDB.On("ListProjectSecrets", mock.Anything).Return([]*ProjectSecret{}, nil).Maybe()
+	mockDB.On("GetProjectByName", "").Return(nil, fmt.Errorf("project not found")).Maybe()
+	// Builds run without an image policy unless a test sets one
+	mockDB.On("GetImagePolicy", mock.Anything).Return(nil, fmt.Errorf("image policy not found")).Maybe()
+	// Cancelled builds are checked for matrix builds to cancel with them
+	mockDB.On("ListMatrixBuilds", mock.Anything).Return([]*BuildRequest{}, nil).Maybe()
+	// Builds that don't succeed block the builds waiting on them
+	mockDB.On("BlockDownstreamBuilds", mock.Anything).Return([]*BuildRequest{}, nil).Maybe()
+	// Successful builds add their duration to the estimates of their branch
+	mockDB.On("RecordBuildDuration", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil).Maybe()
 	return service, mockDB
 }
 
+// expectProvenance lets processed builds record provenance for an empty set
+// of artifacts
+func expectProvenance(mockDB *MockDatabase) {
+	mockDB.On("ListArtifacts", mock.Anything).Return([]*Artifact{}, nil).Maybe()
+	mockDB.On("CreateArtifact", mock.AnythingOfType("*main.Artifact")).Return(1, nil).Maybe()
+}
+
 func TestHealthHandler(t *testing.T) {
 	service, mockDB := setupTestService()
 
@@ -130,11 +1264,38 @@ func TestCreateBuildHandler(t *testing.T) {
 				"project_name": "test-project",
 				"git_url":      "https://github.com/test/repo.git",
 				"branch":       "main",
+				// Versioning is a project setting, and lineage is recorded by
+				// the service
+				"auto_version":      true,
+				"retried_from":      1,
+				"upstream_build_id": 1,
+				"pull_request":      7,
+				"pull_request_fork": true,
+				"skip_reason":       "dependency_failed",
 			},
 			expectedStatus: http.StatusCreated,
 			dbError:        nil,
 			expectedID:     1,
 		},
+		{
+			name: "tag build",
+			requestBody: map[string]interface{}{
+				"project_name": "test-project",
+				"git_url":      "https://github.com/test/repo.git",
+				"tag":          "v1.4.0",
+			},
+			expectedStatus: http.StatusCreated,
+			expectedID:     2,
+		},
+		{
+			name: "tag starting with dash",
+			requestBody: map[string]interface{}{
+				"project_name": "test-project",
+				"git_url":      "https://github.com/test/repo.git",
+				"tag":          "--upload-pack=evil",
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
 		{
 			name: "missing project name",
 			requestBody: map[string]interface{}{
@@ -169,7 +1330,8 @@ func TestCreateBuildHandler(t *testing.T) {
 				// Mock the UpdateBuildStatus calls for the background processing
 				if tt.dbError == nil && tt.expectedStatus == http.StatusCreated {
 					mockDB.On("UpdateBuildStatus", tt.expectedID, "running").Return(nil).Maybe()
-					mockDB.On("UpdateBuildStatus", tt.expectedID, mock.AnythingOfType("string")).Return(nil).Maybe()
+					mockDB.On("UpdateBuildResult", tt.expectedID, mock.AnythingOfType("string"), mock.AnythingOfType("int")).Return(nil).Maybe()
+					mockDB.On("SetBuildFailureCategory", tt.expectedID, mock.AnythingOfType("string")).Return(nil).Maybe()
 				}
 			}
 
@@ -189,6 +1351,17 @@ func TestCreateBuildHandler(t *testing.T) {
 				assert.Equal(t, tt.expectedID, build.ID)
 				assert.Equal(t, tt.requestBody["project_name"], build.ProjectName)
 				assert.Equal(t, "queued", build.Status)
+				assert.False(t, build.AutoVersion)
+				assert.Nil(t, build.RetriedFrom)
+				assert.Nil(t, build.UpstreamBuildID)
+				assert.Zero(t, build.PullRequest)
+				assert.False(t, build.PullRequestFork)
+				assert.Empty(t, build.SkipReason)
+				if tag, ok := tt.requestBody["tag"]; ok {
+					assert.Equal(t, tag, build.Tag)
+					assert.Equal(t, "1.4.0", build.Version)
+					assert.Empty(t, build.Branch)
+				}
 
 				// Wait a moment for the goroutine to start
 				time.Sleep(10 * time.Millisecond)
@@ -199,6 +1372,130 @@ func TestCreateBuildHandler(t *testing.T) {
 	}
 }
 
+func TestCreateBuildIdempotencyKey(t *testing.T) {
+	original := &BuildRequest{ID: 5, ProjectName: "test-project", GitURL: "https://github.com/test/repo.git", Branch: "main", Status: "running"}
+	body := `{"project_name": "test-project", "git_url": "https://github.com/test/repo.git"}`
+
+	create := func(service *BuildService, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/v1/builds", bytes.NewBufferString(body))
+		req.Header.Set("Idempotency-Key", key)
+		rr := httptest.NewRecorder()
+		service.createBuildHandler(rr, req)
+		return rr
+	}
+
+	t.Run("first request creates the build", func(t *testing.T) {
+		service, mockDB := setupTestService()
+		mockDB.On("GetBuildByIdempotencyKey", "", "key-1").Return(nil, fmt.Errorf("build not found")).Once()
+		mockDB.On("CreateBuild", mock.MatchedBy(func(b *BuildRequest) bool {
+			return b.IdempotencyKey == "key-1"
+		})).Return(5, nil).Once()
+
+		rr := create(service, "key-1")
+		assert.Equal(t, http.StatusCreated, rr.Code)
+		assert.Empty(t, rr.Header().Get("Idempotent-Replayed"))
+		assert.NotContains(t, rr.Body.String(), "key-1")
+		mockDB.AssertExpectations(t)
+	})
+
+	t.Run("repeated request returns the original", func(t *testing.T) {
+		service, mockDB := setupTestService()
+		mockDB.On("GetBuildByIdempotencyKey", "", "key-1").Return(original, nil).Once()
+
+		rr := create(service, "key-1")
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, "true", rr.Header().Get("Idempotent-Replayed"))
+		var build BuildRequest
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &build))
+		assert.Equal(t, 5, build.ID)
+		assert.Equal(t, "running", build.Status)
+		mockDB.AssertExpectations(t)
+	})
+
+	t.Run("concurrent request wins the race", func(t *testing.T) {
+		service, mockDB := setupTestService()
+		mockDB.On("GetBuildByIdempotencyKey", "", "key-1").Return(nil, fmt.Errorf("build not found")).Once()
+		mockDB.On("CreateBuild", mock.AnythingOfType("*main.BuildRequest")).Return(0, fmt.Errorf("build already exists")).Once()
+		mockDB.On("GetBuildByIdempotencyKey", "", "key-1").Return(original, nil).Once()
+
+		rr := create(service, "key-1")
+		assert.Equal(t, http.StatusOK, rr.Code)
+		mockDB.AssertExpectations(t)
+	})
+
+	t.Run("keys of other orgs aren't replayed", func(t *testing.T) {
+		service, mockDB := setupTestService()
+		mockDB.On("GetBuildByIdempotencyKey", "acme", "key-1").Return(nil, fmt.Errorf("build not found")).Once()
+		mockDB.On("CreateBuild", mock.MatchedBy(func(b *BuildRequest) bool {
+			return b.Org == "acme" && b.IdempotencyKey == "key-1"
+		})).Return(6, nil).Once()
+
+		req := httptest.NewRequest("POST", "/api/v1/builds", bytes.NewBufferString(body))
+		req.Header.Set("Idempotency-Key", "key-1")
+		req.Header.Set("X-Organization", "acme")
+		rr := httptest.NewRecorder()
+		service.createBuildHandler(rr, req)
+		assert.Equal(t, http.StatusCreated, rr.Code)
+		mockDB.AssertExpectations(t)
+	})
+
+	t.Run("key too long", func(t *testing.T) {
+		service, mockDB := setupTestService()
+		rr := create(service, strings.Repeat("k", maxIdempotencyKeyLength+1))
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+		mockDB.AssertExpectations(t)
+	})
+}
+
+func TestCreateBuildIfNotBuilding(t *testing.T) {
+	body := `{"project_name": "test-project", "git_url": "https://github.com/test/repo.git", "commit_sha": "` + testCommitSHA + `"}`
+	create := func(service *BuildService, query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/v1/builds"+query, bytes.NewBufferString(body))
+		rr := httptest.NewRecorder()
+		service.createBuildHandler(rr, req)
+		return rr
+	}
+	sameCommit := mock.MatchedBy(func(b *BuildRequest) bool {
+		return b.ProjectName == "test-project" && b.Branch == "main" && b.CommitSHA == testCommitSHA
+	})
+
+	t.Run("returns the active build", func(t *testing.T) {
+		service, mockDB := setupTestService()
+		active := &BuildRequest{ID: 5, ProjectName: "test-project", Branch: "main", CommitSHA: testCommitSHA, Status: "running"}
+		mockDB.On("CreateBuildUnlessActive", sameCommit).Return(0, active, nil).Once()
+
+		rr := create(service, "?if_not_building=true")
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, "true", rr.Header().Get("X-Build-Existing"))
+		var build BuildRequest
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &build))
+		assert.Equal(t, 5, build.ID)
+		mockDB.AssertNotCalled(t, "CreateBuild", mock.Anything)
+		mockDB.AssertExpectations(t)
+	})
+
+	t.Run("creates a build when none is active", func(t *testing.T) {
+		service, mockDB := setupTestService()
+		mockDB.On("CreateBuildUnlessActive", sameCommit).Return(6, nil, nil).Once()
+
+		rr := create(service, "?if_not_building=true")
+		assert.Equal(t, http.StatusCreated, rr.Code)
+		assert.Empty(t, rr.Header().Get("X-Build-Existing"))
+		var build BuildRequest
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &build))
+		assert.Equal(t, 6, build.ID)
+		assert.Equal(t, "queued", build.Status)
+		mockDB.AssertExpectations(t)
+	})
+
+	t.Run("invalid option", func(t *testing.T) {
+		service, mockDB := setupTestService()
+		rr := create(service, "?if_not_building=maybe")
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+		mockDB.AssertExpectations(t)
+	})
+}
+
 func TestGetBuildHandler(t *testing.T) {
 	service, mockDB := setupTestService()
 
@@ -277,6 +1574,87 @@ func TestGetBuildHandler(t *testing.T) {
 	}
 }
 
+func TestRetryBuildHandler(t *testing.T) {
+	failedBuild := &BuildRequest{
+		ID:           7,
+		ProjectName:  "test-project",
+		GitURL:       "https://github.com/test/repo.git",
+		Branch:       "main",
+		CommitSHA:    "abc1234",
+		CommitAuthor: "Jane Doe <jane@example.com>",
+		Status:       "failed",
+	}
+
+	tests := []struct {
+		name           string
+		buildID        string
+		setupMock      func(*MockDatabase)
+		expectedStatus int
+	}{
+		{
+			name:    "retry failed build",
+			buildID: "7",
+			setupMock: func(m *MockDatabase) {
+				m.On("GetBuild", 7).Return(failedBuild, nil)
+				m.On("CreateBuild", mock.MatchedBy(func(b *BuildRequest) bool {
+					return b.RetriedFrom != nil && *b.RetriedFrom == 7 && b.CommitSHA == "abc1234" && b.Status == "queued" &&
+						b.CommitAuthor == "Jane Doe <jane@example.com>" && b.TriggerSource == triggerRetry
+				})).Return(8, nil)
+				m.On("ListBuildIssues", 7).Return([]string{"PROJ-1"}, nil)
+				m.On("AddBuildIssues", 8, []string{"PROJ-1"}).Return(nil)
+			},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:    "successful build cannot be retried",
+			buildID: "7",
+			setupMock: func(m *MockDatabase) {
+				m.On("GetBuild", 7).Return(&BuildRequest{ID: 7, Status: "success"}, nil)
+			},
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name:    "build not found",
+			buildID: "999",
+			setupMock: func(m *MockDatabase) {
+				m.On("GetBuild", 999).Return(nil, fmt.Errorf("build not found"))
+			},
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "invalid build ID",
+			buildID:        "invalid",
+			setupMock:      func(m *MockDatabase) {},
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service, mockDB := setupTestService()
+			tt.setupMock(mockDB)
+
+			req, _ := http.NewRequest("POST", "/api/v1/builds/"+tt.buildID+"/retry", nil)
+			rr := httptest.NewRecorder()
+
+			router := mux.NewRouter()
+			router.HandleFunc("/api/v1/builds/{id}/retry", service.retryBuildHandler).Methods("POST")
+			router.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.expectedStatus, rr.Code)
+
+			if tt.expectedStatus == http.StatusCreated {
+				var build BuildRequest
+				assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &build))
+				assert.Equal(t, 8, build.ID)
+				assert.Equal(t, 7, *build.RetriedFrom)
+			}
+
+			mockDB.AssertExpectations(t)
+		})
+	}
+}
+
 func TestListBuildsHandler(t *testing.T) {
 	service, mockDB := setupTestService()
 
@@ -326,7 +1704,7 @@ func TestListBuildsHandler(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			mockDB.On("ListBuilds").Return(tt.dbResponse, tt.dbError).Once()
+			mockDB.On("ListBuilds", false, "", Labels(nil)).Return(tt.dbResponse, tt.dbError).Once()
 
 			req, _ := http.NewRequest("GET", "/api/v1/builds", nil)
 			rr := httptest.NewRecorder()
@@ -353,25 +1731,87 @@ func TestListBuildsHandler(t *testing.T) {
 
 func TestBuildProcessing(t *testing.T) {
 	service, mockDB := setupTestService()
+	expectProvenance(mockDB)
 
 	build := &BuildRequest{
 		ID:          1,
 		ProjectName: "test-project",
-		Status:      "queued",
+		Status:      "running",
 	}
 
-	mockDB.On("UpdateBuildStatus", 1, "running").Return(nil).Once()
-	mockDB.On("UpdateBuildStatus", 1, mock.MatchedBy(func(status string) bool {
+	mockDB.On("GetProjectByName", "test-project").Return(nil, fmt.Errorf("project not found")).Once()
+	mockDB.On("UpdateBuildResult", 1, mock.MatchedBy(func(status string) bool {
 		return status == "success" || status == "failed"
-	})).Return(nil).Once()
+	}), mock.AnythingOfType("int")).Return(nil).Once()
+	mockDB.On("SetBuildFailureCategory", 1, mock.AnythingOfType("string")).Return(nil).Maybe()
+	mockDB.On("SaveBuildConfig", 1, mock.AnythingOfType("main.ConfigSnapshot")).Return(nil).Once()
+
+	service.processBuild(context.Background(), build)
+
+	assert.Contains(t, []string{"success", "failed"}, build.Status)
+	assert.NotNil(t, build.ExitCode)
+	mockDB.AssertExpectations(t)
+}
 
-	// Process build in background
-	go service.processBuild(build)
+func TestBuildProcessingInterrupted(t *testing.T) {
+	service, mockDB := setupTestService()
+
+	build := &BuildRequest{
+		ID:          1,
+		ProjectName: "test-project",
+		Status:      "running",
+	}
 
-	// Wait for processing to complete
-	time.Sleep(3 * time.Second)
+	mockDB.On("GetProjectByName", "test-project").Return(nil, fmt.Errorf("project not found")).Once()
+	mockDB.On("ReleaseBuild", 1).Return(nil).Once()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	service.processBuild(ctx, build)
 
 	mockDB.AssertExpectations(t)
+	mockDB.AssertNotCalled(t, "UpdateBuildResult", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestBuildProcessingTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		project *Project
+		timeout time.Duration
+	}{
+		{"global timeout", nil, 20 * time.Millisecond},
+		{"project timeout", &Project{Name: "test-project", BuildTimeout: 1}, time.Hour},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service, mockDB := setupTestService()
+			expectProvenance(mockDB)
+			service.defaultTimeout = tt.timeout
+
+			build := &BuildRequest{ID: 1, ProjectName: "test-project", Status: "running"}
+			if tt.project != nil {
+				mockDB.On("GetProjectByName", "test-project").Return(tt.project, nil).Once()
+			} else {
+				mockDB.On("GetProjectByName", "test-project").Return(nil, fmt.Errorf("project not found")).Once()
+			}
+			mockDB.On("UpdateBuildResult", 1, "timeout", -1).Return(nil).Once()
+			mockDB.On("SetBuildCancellation", 1, "timeout", "system:executor").Return(nil).Once()
+			mockDB.On("SetBuildFailureCategory", 1, failureTimeout).Return(nil).Once()
+			mockDB.On("SaveBuildConfig", 1, mock.MatchedBy(func(config ConfigSnapshot) bool {
+				return config["build.timeout"] == service.buildTimeout(tt.project).String()
+			})).Return(nil).Once()
+
+			service.processBuild(context.Background(), build)
+
+			assert.Equal(t, "timeout", build.Status)
+			assert.Equal(t, float64(1), testutil.ToFloat64(service.metrics.BuildTimeouts.WithLabelValues("test-project")))
+			assert.Equal(t, failureTimeout, build.FailureCategory)
+			assert.Equal(t, float64(1), testutil.ToFloat64(service.metrics.BuildCancellations.WithLabelValues("timeout")))
+			assert.Equal(t, "system:executor", build.CancelledBy)
+			mockDB.AssertExpectations(t)
+		})
+	}
 }
 
 func BenchmarkCreateBuild(b *testing.B) {
@@ -383,6 +1823,10 @@ func BenchmarkCreateBuild(b *testing.B) {
 	// Mock the background processing calls
 	mockDB.On("UpdateBuildStatus", mock.AnythingOfType("int"), mock.AnythingOfType("string")).
 		Return(nil).Maybe()
+	mockDB.On("UpdateBuildResult", mock.AnythingOfType("int"), mock.AnythingOfType("string"), mock.AnythingOfType("int")).
+		Return(nil).Maybe()
+	mockDB.On("SetBuildFailureCategory", mock.AnythingOfType("int"), mock.AnythingOfType("string")).
+		Return(nil).Maybe()
 
 	requestBody := map[string]interface{}{
 		"project_name": "benchmark-project",
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxMatrixBuilds caps the combinations a matrix expands into
+const maxMatrixBuilds = 32
+
+// finishedStatuses are the statuses builds end in
+var finishedStatuses = map[string]bool{
+	"success":   true,
+	"failed":    true,
+	"timeout":   true,
+	"cancelled": true,
+	"expired":   true,
+	"skipped":   true,
+	"blocked":   true,
+}
+
+// BuildMatrix is a set of dimensions, each with the values a build is run
+// with. A matrix build runs once per combination of values, each combination
+// exposed to the build as environment variables named after the dimensions.
+type BuildMatrix map[string][]string
+
+// validate checks dimension names are environment variable names and that
+// every dimension has distinct, non-empty values
+func (bm BuildMatrix) validate() error {
+	for name, values := range bm {
+		if !envNamePattern.MatchString(name) {
+			return fmt.Errorf("matrix dimension %q must be a valid environment variable name", name)
+		}
+		if len(values) == 0 {
+			return fmt.Errorf("matrix dimension %q has no values", name)
+		}
+		seen := make(map[string]bool)
+		for _, value := range values {
+			if value == "" || seen[value] {
+				return fmt.Errorf("matrix dimension %q has an empty or duplicate value", name)
+			}
+			seen[value] = true
+		}
+	}
+	if n := len(bm.combinations()); n > maxMatrixBuilds {
+		return fmt.Errorf("matrix expands into %d builds, more than %d", n, maxMatrixBuilds)
+	}
+	return nil
+}
+
+// combinations returns every combination of the matrix's values, varying
+// the last dimension (by name) fastest
+func (bm BuildMatrix) combinations() []map[string]string {
+	if len(bm) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(bm))
+	for name := range bm {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	combinations := []map[string]string{{}}
+	for _, name := range names {
+		var next []map[string]string
+		for _, combination := range combinations {
+			for _, value := range bm[name] {
+				expanded := make(map[string]string, len(combination)+1)
+				for k, v := range combination {
+					expanded[k] = v
+				}
+				expanded[name] = value
+				next = append(next, expanded)
+			}
+		}
+		combinations = next
+	}
+	return combinations
+}
+
+// matrixStatus aggregates the statuses of a matrix build's children: running
+// until they have all finished, then success when they all succeeded, failed
+// when any failed or timed out, and cancelled otherwise
+func matrixStatus(children []*BuildRequest) string {
+	status := "success"
+	for _, child := range children {
+		switch child.Status {
+		case "success":
+		case "failed", "timeout":
+			status = "failed"
+		case "cancelled", "expired":
+			if status == "success" {
+				status = "cancelled"
+			}
+		default:
+			return "running"
+		}
+	}
+	return status
+}
+
+// expandMatrix queues a child build of a matrix build for each combination
+// of its matrix. The matrix build stays running, without a lease, until its
+// children have finished.
+func (bs *BuildService) expandMatrix(ctx context.Context, build *BuildRequest, result *BuildResult) {
+	if result.Version != "" && result.Version != build.Version {
+		build.Version = result.Version
+		if err := bs.db.UpdateBuildVersion(build.ID, build.Version); err != nil {
+			bs.errors.Capture("executor", fmt.Errorf("recording version %s: %w", build.Version, err), build)
+		}
+	}
+
+	for _, values := range result.Matrix {
+		parentID := build.ID
+		child := &BuildRequest{
+			ProjectName:     build.ProjectName,
+			GitURL:          build.GitURL,
+			Branch:          build.Branch,
+			Tag:             build.Tag,
+			CommitSHA:       build.CommitSHA,
+			CommitMessage:   build.CommitMessage,
+			CommitAuthor:    build.CommitAuthor,
+			TriggerSource:   triggerMatrix,
+			TriggeredBy:     build.TriggeredBy,
+			Org:             build.Org,
+			PullRequest:     build.PullRequest,
+			PullRequestFork: build.PullRequestFork,
+			DebugLogging:    build.DebugLogging,
+			Labels:          build.Labels,
+			// Every child is built as the version of the matrix build
+			Version:       build.Version,
+			ParentBuildID: &parentID,
+			Matrix:        values,
+		}
+		if result.Commit != nil && child.CommitSHA == "" {
+			child.CommitSHA = result.Commit.SHA
+		}
+		if err := bs.enqueueBuild(ctx, child); err != nil {
+			bs.errors.Capture("executor", fmt.Errorf("queueing matrix build: %w", err), build)
+			bs.finishMatrixBuild(build, "failed", -1)
+			return
+		}
+	}
+
+	if err := bs.db.DetachMatrixBuild(build.ID); err != nil {
+		bs.errors.Capture("executor", fmt.Errorf("releasing matrix build: %w", err), build)
+	}
+	log.Printf("Build %d expanded into %d matrix builds", build.ID, len(result.Matrix))
+}
+
+// matrixChildChanged updates the status of a matrix build when one of its
+// children finishes. It runs outside the event hook, since it publishes the
+// matrix build's own event.
+func (bs *BuildService) matrixChildChanged(event BuildEvent) {
+	if event.Build.ParentBuildID == nil || !finishedStatuses[event.Build.Status] {
+		return
+	}
+	go bs.updateMatrixBuild(*event.Build.ParentBuildID)
+}
+
+// updateMatrixBuild finishes a matrix build once all its children have
+func (bs *BuildService) updateMatrixBuild(id int) {
+	build, err := bs.db.GetBuild(id)
+	if err != nil {
+		bs.errors.Capture("executor", fmt.Errorf("loading matrix build %d: %w", id, err), nil)
+		return
+	}
+	children, err := bs.db.ListMatrixBuilds(id)
+	if err != nil {
+		bs.errors.Capture("executor", fmt.Errorf("listing matrix builds: %w", err), build)
+		return
+	}
+
+	status := matrixStatus(children)
+	if status == "running" {
+		return
+	}
+	exitCode := 0
+	for _, child := range children {
+		if child.Status != "success" {
+			exitCode = -1
+			if child.ExitCode != nil && *child.ExitCode != 0 {
+				exitCode = *child.ExitCode
+				break
+			}
+		}
+	}
+	bs.finishMatrixBuild(build, status, exitCode)
+}
+
+// finishMatrixBuild records the final status of a matrix build, unless it
+// already finished
+func (bs *BuildService) finishMatrixBuild(build *BuildRequest, status string, exitCode int) {
+	finished, err := bs.db.FinishMatrixBuild(build.ID, status, exitCode)
+	if err != nil {
+		bs.errors.Capture("executor", fmt.Errorf("finishing matrix build: %w", err), build)
+		return
+	}
+	if !finished {
+		return
+	}
+
+	build.Status, build.ExitCode = status, &exitCode
+	build.UpdatedAt = time.Now().UTC()
+	bs.metrics.BuildsTotal.WithLabelValues(status).Inc()
+	bs.events.Publish(build)
+	log.Printf("Matrix build %d completed with status: %s", build.ID, status)
+	bs.blockDownstream(build)
+}
+
+// cancelMatrixBuilds cancels the unfinished children of a cancelled matrix
+// build
+func (bs *BuildService) cancelMatrixBuilds(build *BuildRequest) {
+	children, err := bs.db.ListMatrixBuilds(build.ID)
+	if err != nil {
+		bs.errors.Capture("executor", fmt.Errorf("listing matrix builds: %w", err), build)
+		return
+	}
+	for _, child := range children {
+		if finishedStatuses[child.Status] {
+			continue
+		}
+		cancelled, err := bs.db.CancelBuild(child.ID, build.CancelReason, build.CancelledBy)
+		if err != nil {
+			if err.Error() != "build already finished" {
+				bs.errors.Capture("executor", fmt.Errorf("cancelling matrix build %d: %w", child.ID, err), build)
+			}
+			continue
+		}
+		bs.running.cancel(cancelled.ID)
+		bs.recordCancellation(cancelled)
+		bs.events.Publish(cancelled)
+		bs.blockDownstream(cancelled)
+	}
+}
+
+// MatrixBuilds is a matrix build's children
+type MatrixBuilds struct {
+	BuildID int             `json:"build_id"`
+	Status  string          `json:"status"`
+	Builds  []*BuildRequest `json:"builds"`
+}
+
+// Matrix builds endpoint
+func (bs *BuildService) matrixBuildsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid build ID", http.StatusBadRequest)
+		return
+	}
+
+	build, err := bs.db.GetBuild(id)
+	if err != nil {
+		if err.Error() == "build not found" {
+			http.Error(w, "Build not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error getting build: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	children, err := bs.db.ListMatrixBuilds(id)
+	if err != nil {
+		log.Printf("Error listing matrix builds: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&MatrixBuilds{BuildID: id, Status: build.Status, Builds: children})
+}
+
+// expandMatrixValues substitutes a matrix build's values for ${NAME}
+// references in s
+func expandMatrixValues(s string, values map[string]string) string {
+	if len(values) == 0 {
+		return s
+	}
+	return os.Expand(s, func(name string) string { return values[name] })
+}
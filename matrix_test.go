@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildMatrixCombinations(t *testing.T) {
+	matrix := BuildMatrix{"GO": {"1.21", "1.22"}, "OS": {"linux", "darwin"}}
+	require.NoError(t, matrix.validate())
+	assert.Equal(t, []map[string]string{
+		{"GO": "1.21", "OS": "linux"},
+		{"GO": "1.21", "OS": "darwin"},
+		{"GO": "1.22", "OS": "linux"},
+		{"GO": "1.22", "OS": "darwin"},
+	}, matrix.combinations())
+	assert.Nil(t, BuildMatrix{}.combinations())
+
+	for _, invalid := range []BuildMatrix{
+		{"go-version": {"1.22"}},
+		{"GO": {}},
+		{"GO": {"1.22", "1.22"}},
+		{"GO": {""}},
+		{"A": {"1", "2", "3", "4"}, "B": {"1", "2", "3", "4"}, "C": {"1", "2", "3"}},
+	} {
+		assert.Error(t, invalid.validate(), "%v", invalid)
+	}
+}
+
+func TestMatrixStatus(t *testing.T) {
+	builds := func(statuses ...string) []*BuildRequest {
+		var children []*BuildRequest
+		for _, status := range statuses {
+			children = append(children, &BuildRequest{Status: status})
+		}
+		return children
+	}
+	assert.Equal(t, "running", matrixStatus(builds("success", "queued")))
+	assert.Equal(t, "running", matrixStatus(builds("failed", "running")))
+	assert.Equal(t, "success", matrixStatus(builds("success", "success")))
+	assert.Equal(t, "failed", matrixStatus(builds("success", "timeout", "cancelled")))
+	assert.Equal(t, "cancelled", matrixStatus(builds("success", "expired")))
+}
+
+func TestLocalExecutorRunsPipelineMatrix(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	repo := t.TempDir()
+	pipeline := "matrix:\n  GO: [\"1.21\", \"1.22\"]\nstages:\n  - name: build\n    steps:\n      - echo building with go$GO\n"
+	require.NoError(t, os.WriteFile(filepath.Join(repo, pipelineFile), []byte(pipeline), 0o644))
+	for _, args := range [][]string{
+		{"init", "-q", "-b", "main"},
+		{"add", pipelineFile},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "init"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repo
+		require.NoError(t, cmd.Run())
+	}
+
+	executor := NewLocalExecutor(t.TempDir())
+	executor.AllowedProtocols = append(executor.AllowedProtocols, "file")
+	build := &BuildRequest{ID: 1, ProjectName: "test-project", GitURL: "file://" + repo, Branch: "main",
+		// The pipeline file's matrix replaces the project's
+		ProjectMatrix: BuildMatrix{"NODE": {"20"}}}
+
+	// The matrix build expands without running any steps
+	result, err := executor.Execute(context.Background(), build)
+	require.NoError(t, err)
+	assert.Equal(t, "success", result.Status)
+	assert.Equal(t, []map[string]string{{"GO": "1.21"}, {"GO": "1.22"}}, result.Matrix)
+	require.Len(t, result.Stages, 1)
+	assert.Equal(t, "clone", result.Stages[0].Name)
+
+	// Its combinations run with their values in the environment
+	build.ID, build.Matrix = 2, map[string]string{"GO": "1.22"}
+	result, err = executor.Execute(context.Background(), build)
+	require.NoError(t, err)
+	assert.Equal(t, "success", result.Status)
+	assert.Nil(t, result.Matrix)
+	assert.Contains(t, string(result.Output), "building with go1.22")
+}
+
+func TestProcessBuildExpandsMatrix(t *testing.T) {
+	service, mockDB := setupTestService()
+	service.executor = &fixedExecutor{result: &BuildResult{
+		Status:  "success",
+		Version: "1.4.0",
+		Matrix:  []map[string]string{{"GO": "1.21"}, {"GO": "1.22"}},
+	}}
+	build := &BuildRequest{ID: 5, ProjectName: "test-project", Branch: "main", CommitSHA: testCommitSHA, Status: "running"}
+
+	mockDB.On("GetProjectByName", "test-project").Return(nil, fmt.Errorf("project not found"))
+	mockDB.On("SaveBuildConfig", 5, mock.AnythingOfType("main.ConfigSnapshot")).Return(nil)
+	mockDB.On("UpdateBuildVersion", 5, "1.4.0").Return(nil)
+	var children []*BuildRequest
+	mockDB.On("CreateBuild", mock.AnythingOfType("*main.BuildRequest")).Run(func(args mock.Arguments) {
+		children = append(children, args.Get(0).(*BuildRequest))
+	}).Return(6, nil).Twice()
+	mockDB.On("DetachMatrixBuild", 5).Return(nil)
+
+	service.processBuild(context.Background(), build)
+	mockDB.AssertExpectations(t)
+	mockDB.AssertNotCalled(t, "UpdateBuildResult", 5, mock.Anything, mock.Anything)
+	require.Len(t, children, 2)
+	for i, child := range children {
+		assert.Equal(t, 5, *child.ParentBuildID)
+		assert.Equal(t, triggerMatrix, child.TriggerSource)
+		assert.Equal(t, "1.4.0", child.Version)
+		assert.Equal(t, testCommitSHA, child.CommitSHA)
+		assert.Equal(t, []string{"1.21", "1.22"}[i], child.Matrix["GO"])
+	}
+}
+
+func TestUpdateMatrixBuild(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.ExpectedCalls = nil
+	mockDB.On("ListWebhookSubscriptions").Return([]*WebhookSubscription{}, nil).Maybe()
+	failed := 2
+	mockDB.On("GetBuild", 5).Return(&BuildRequest{ID: 5, ProjectName: "test-project", Status: "running"}, nil)
+	mockDB.On("ListMatrixBuilds", 5).Return([]*BuildRequest{
+		{ID: 6, Status: "success"},
+		{ID: 7, Status: "running"},
+	}, nil).Once()
+	mockDB.On("ListMatrixBuilds", 5).Return([]*BuildRequest{
+		{ID: 6, Status: "success"},
+		{ID: 7, Status: "failed", ExitCode: &failed},
+	}, nil)
+	mockDB.On("FinishMatrixBuild", 5, "failed", 2).Return(true, nil).Once()
+	mockDB.On("FinishMatrixBuild", 5, "failed", 2).Return(false, nil).Once()
+	// Builds waiting on the failed matrix build are blocked
+	mockDB.On("BlockDownstreamBuilds", 5).Return([]*BuildRequest{}, nil).Once()
+
+	events, unsubscribe := service.events.Subscribe(10)
+	defer unsubscribe()
+
+	// Nothing changes while a combination is still running
+	service.updateMatrixBuild(5)
+	mockDB.AssertNotCalled(t, "FinishMatrixBuild", mock.Anything, mock.Anything, mock.Anything)
+
+	service.updateMatrixBuild(5)
+	event := <-events
+	assert.Equal(t, 5, event.Build.ID)
+	assert.Equal(t, "failed", event.Build.Status)
+
+	// A concurrent update that lost the race doesn't publish again
+	service.updateMatrixBuild(5)
+	assert.Empty(t, events)
+	mockDB.AssertExpectations(t)
+}
+
+func TestMatrixBuildsHandler(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.ExpectedCalls = nil
+	parent := 5
+	mockDB.On("GetBuild", 5).Return(&BuildRequest{ID: 5, Status: "running"}, nil)
+	mockDB.On("GetBuild", 9).Return(nil, fmt.Errorf("build not found"))
+	mockDB.On("ListMatrixBuilds", 5).Return([]*BuildRequest{
+		{ID: 6, Status: "success", ParentBuildID: &parent, Matrix: map[string]string{"GO": "1.21"}},
+	}, nil)
+
+	get := func(id string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/v1/builds/"+id+"/matrix", nil)
+		req = mux.SetURLVars(req, map[string]string{"id": id})
+		rr := httptest.NewRecorder()
+		service.matrixBuildsHandler(rr, req)
+		return rr
+	}
+
+	rr := get("5")
+	require.Equal(t, http.StatusOK, rr.Code)
+	var matrix MatrixBuilds
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &matrix))
+	assert.Equal(t, "running", matrix.Status)
+	require.Len(t, matrix.Builds, 1)
+	assert.Equal(t, map[string]string{"GO": "1.21"}, matrix.Builds[0].Matrix)
+
+	assert.Equal(t, http.StatusNotFound, get("9").Code)
+	assert.Equal(t, http.StatusBadRequest, get("x").Code)
+}
+
+func TestCancelMatrixBuild(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.ExpectedCalls = nil
+	mockDB.On("ListWebhookSubscriptions").Return([]*WebhookSubscription{}, nil).Maybe()
+	mockDB.On("ListDownstreamBuilds", 5).Return([]*BuildRequest{}, nil)
+	mockDB.On("CancelBuild", 5, cancelUserRequested, "api").
+		Return(&BuildRequest{ID: 5, Status: "cancelled", CancelReason: cancelUserRequested, CancelledBy: "api"}, nil)
+	mockDB.On("ListMatrixBuilds", 5).Return([]*BuildRequest{
+		{ID: 6, Status: "success"},
+		{ID: 7, Status: "queued"},
+	}, nil)
+	mockDB.On("CancelBuild", 7, cancelUserRequested, "api").Return(&BuildRequest{ID: 7, Status: "cancelled"}, nil).Once()
+	// The matrix build already finished when its combination's event arrives
+	mockDB.On("GetBuild", 5).Return(&BuildRequest{ID: 5, Status: "cancelled"}, nil).Maybe()
+	mockDB.On("FinishMatrixBuild", 5, mock.Anything, mock.Anything).Return(false, nil).Maybe()
+	mockDB.On("BlockDownstreamBuilds", mock.Anything).Return([]*BuildRequest{}, nil)
+
+	req := httptest.NewRequest("POST", "/api/v1/builds/5/cancel", nil)
+	req = mux.SetURLVars(req, map[string]string{"id": "5"})
+	rr := httptest.NewRecorder()
+	service.cancelBuildHandler(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	mockDB.AssertCalled(t, "CancelBuild", 7, cancelUserRequested, "api")
+	mockDB.AssertNotCalled(t, "CancelBuild", 6, mock.Anything, mock.Anything)
+}
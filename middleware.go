@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// responseWriter wraps http.ResponseWriter to record the status code and,
+// when capture is set, the first captureLimit bytes of the body
+type responseWriter struct {
+	http.ResponseWriter
+	status       int
+	written      int64
+	capture      *bytes.Buffer
+	captureLimit int
+}
+
+func newResponseWriter(w http.ResponseWriter) *responseWriter {
+	return &responseWriter{ResponseWriter: w, status: http.StatusOK}
+}
+
+func (rw *responseWriter) WriteHeader(status int) {
+	rw.status = status
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *responseWriter) Write(p []byte) (int, error) {
+	if rw.capture != nil {
+		if remaining := rw.captureLimit - rw.capture.Len(); remaining > 0 {
+			if len(p) < remaining {
+				remaining = len(p)
+			}
+			rw.capture.Write(p[:remaining])
+		}
+	}
+
+	n, err := rw.ResponseWriter.Write(p)
+	rw.written += int64(n)
+	return n, err
+}
+
+// Flush lets streaming handlers flush through the wrapper
+func (rw *responseWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// routeTemplate returns the mux path template matched by the request, or the
+// raw path when no route matched
+func routeTemplate(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if tmpl, err := route.GetPathTemplate(); err == nil {
+			return tmpl
+		}
+	}
+	return r.URL.Path
+}
+
+// Middleware counts requests by route and status code and observes their
+// duration
+func (m *Metrics) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rw := newResponseWriter(w)
+		next.ServeHTTP(rw, r)
+
+		route := routeTemplate(r)
+		m.HTTPRequests.WithLabelValues(r.Method, route, strconv.Itoa(rw.status)).Inc()
+		m.HTTPDuration.WithLabelValues(r.Method, route).Observe(time.Since(start).Seconds())
+	})
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsMiddleware(t *testing.T) {
+	metrics := NewMetrics()
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/builds/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if mux.Vars(r)["id"] == "0" {
+			http.Error(w, "Build not found", http.StatusNotFound)
+		}
+	}).Methods("GET")
+	router.Use(metrics.Middleware)
+
+	for _, path := range []string{"/api/v1/builds/1", "/api/v1/builds/2", "/api/v1/builds/0"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	// Requests are labeled by route, not by path
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics.HTTPRequests.WithLabelValues("GET", "/api/v1/builds/{id}", "200")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.HTTPRequests.WithLabelValues("GET", "/api/v1/builds/{id}", "404")))
+	assert.Equal(t, 1, testutil.CollectAndCount(&metrics.HTTPDuration))
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockID is the advisory lock key that serialises migrations when
+// several instances start at once
+const migrationLockID = 7_061_322_945
+
+// migrationFilePattern matches e.g. 0002_add_build_labels.up.sql
+var migrationFilePattern = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+// Migration is a versioned schema change with the SQL to apply and revert it
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus reports whether a migration has been applied
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+}
+
+// loadMigrations reads NNNN_name.up.sql/NNNN_name.down.sql pairs from the
+// root of fsys, ordered by version
+func loadMigrations(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		match := migrationFilePattern.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || match == nil {
+			return nil, fmt.Errorf("unexpected file %s in migrations", entry.Name())
+		}
+		version, _ := strconv.Atoi(match[1])
+
+		contents, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		migration := byVersion[version]
+		if migration == nil {
+			migration = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = migration
+		}
+		if migration.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has conflicting names %s and %s", version, migration.Name, match[2])
+		}
+		if match[3] == "up" {
+			migration.Up = string(contents)
+		} else {
+			migration.Down = string(contents)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" || migration.Down == "" {
+			return nil, fmt.Errorf("migration %04d_%s needs both an up and a down file", migration.Version, migration.Name)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	return migrations, nil
+}
+
+// Migrator applies and reverts the embedded migrations, recording applied
+// versions in the schema_migrations table
+type Migrator struct {
+	db         *sql.DB
+	migrations []Migration
+}
+
+// NewMigrator creates a migrator for the embedded migrations
+func NewMigrator(db *sql.DB) (*Migrator, error) {
+	sub, err := fs.Sub(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	migrations, err := loadMigrations(sub)
+	if err != nil {
+		return nil, fmt.Errorf("loading migrations: %w", err)
+	}
+
+	return &Migrator{db: db, migrations: migrations}, nil
+}
+
+// Up applies all pending migrations in order, each in its own transaction
+func (m *Migrator) Up() ([]Migration, error) {
+	var applied []Migration
+
+	err := m.locked(func(conn *sql.Conn, current map[int]time.Time) error {
+		for _, migration := range m.migrations {
+			if _, ok := current[migration.Version]; ok {
+				continue
+			}
+			if err := m.run(conn, migration.Up, `INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, migration.Version, migration.Name); err != nil {
+				return fmt.Errorf("applying migration %04d_%s: %w", migration.Version, migration.Name, err)
+			}
+			applied = append(applied, migration)
+		}
+		return nil
+	})
+
+	return applied, err
+}
+
+// Down reverts the most recently applied steps migrations
+func (m *Migrator) Down(steps int) ([]Migration, error) {
+	var reverted []Migration
+
+	err := m.locked(func(conn *sql.Conn, current map[int]time.Time) error {
+		for i := len(m.migrations) - 1; i >= 0 && len(reverted) < steps; i-- {
+			migration := m.migrations[i]
+			if _, ok := current[migration.Version]; !ok {
+				continue
+			}
+			if err := m.run(conn, migration.Down, `DELETE FROM schema_migrations WHERE version = $1`, migration.Version); err != nil {
+				return fmt.Errorf("reverting migration %04d_%s: %w", migration.Version, migration.Name, err)
+			}
+			reverted = append(reverted, migration)
+		}
+		return nil
+	})
+
+	return reverted, err
+}
+
+// Status lists every known migration and when it was applied
+func (m *Migrator) Status() ([]MigrationStatus, error) {
+	var statuses []MigrationStatus
+
+	err := m.locked(func(conn *sql.Conn, current map[int]time.Time) error {
+		for _, migration := range m.migrations {
+			status := MigrationStatus{Version: migration.Version, Name: migration.Name}
+			if appliedAt, ok := current[migration.Version]; ok {
+				status.AppliedAt = &appliedAt
+			}
+			statuses = append(statuses, status)
+		}
+		return nil
+	})
+
+	return statuses, err
+}
+
+// locked runs fn holding the migration advisory lock, passing the applied
+// versions from schema_migrations
+func (m *Migrator) locked(fn func(conn *sql.Conn, current map[int]time.Time) error) error {
+	ctx := context.Background()
+
+	// Advisory locks belong to a session, so everything runs on one connection
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockID); err != nil {
+		return fmt.Errorf("acquiring migration lock: %w", err)
+	}
+	defer conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, migrationLockID)
+
+	_, err = conn.ExecContext(ctx, `
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		applied_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+	)`)
+	if err != nil {
+		return fmt.Errorf("creating schema_migrations: %w", err)
+	}
+
+	rows, err := conn.QueryContext(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return err
+	}
+	current := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			rows.Close()
+			return err
+		}
+		current[version] = appliedAt
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	return fn(conn, current)
+}
+
+// run executes a migration script and its bookkeeping statement in one transaction
+func (m *Migrator) run(conn *sql.Conn, script, record string, args ...interface{}) error {
+	ctx := context.Background()
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// runMigrateCommand implements `build-service migrate [up|down [n]|status]`
+func runMigrateCommand(m *Migrator, args []string, out io.Writer) error {
+	command := "up"
+	if len(args) > 0 {
+		command = args[0]
+	}
+
+	switch {
+	case command == "up" && len(args) <= 1:
+		applied, err := m.Up()
+		for _, migration := range applied {
+			fmt.Fprintf(out, "applied %04d_%s\n", migration.Version, migration.Name)
+		}
+		if err == nil && len(applied) == 0 {
+			fmt.Fprintln(out, "schema is up to date")
+		}
+		return err
+	case command == "down" && len(args) <= 2:
+		steps := 1
+		if len(args) == 2 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				return fmt.Errorf("down takes a positive number of migrations to revert")
+			}
+			steps = n
+		}
+		reverted, err := m.Down(steps)
+		for _, migration := range reverted {
+			fmt.Fprintf(out, "reverted %04d_%s\n", migration.Version, migration.Name)
+		}
+		return err
+	case command == "status" && len(args) <= 1:
+		statuses, err := m.Status()
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED")
+		for _, status := range statuses {
+			applied := "pending"
+			if status.AppliedAt != nil {
+				applied = status.AppliedAt.UTC().Format(time.RFC3339)
+			}
+			fmt.Fprintf(tw, "%04d\t%s\t%s\n", status.Version, status.Name, applied)
+		}
+		return tw.Flush()
+	default:
+		return fmt.Errorf("usage: build-service migrate [up | down [n] | status]")
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := loadMigrations(fstest.MapFS{
+		"0002_add_labels.up.sql":   {Data: []byte("ALTER TABLE builds ADD COLUMN labels JSONB;")},
+		"0002_add_labels.down.sql": {Data: []byte("ALTER TABLE builds DROP COLUMN labels;")},
+		"0001_initial.up.sql":      {Data: []byte("CREATE TABLE builds (id SERIAL);")},
+		"0001_initial.down.sql":    {Data: []byte("DROP TABLE builds;")},
+	})
+	require.NoError(t, err)
+	require.Len(t, migrations, 2)
+	assert.Equal(t, Migration{Version: 1, Name: "initial", Up: "CREATE TABLE builds (id SERIAL);", Down: "DROP TABLE builds;"}, migrations[0])
+	assert.Equal(t, 2, migrations[1].Version)
+	assert.Equal(t, "add_labels", migrations[1].Name)
+}
+
+func TestLoadMigrationsRejectsBrokenSets(t *testing.T) {
+	for name, files := range map[string]fstest.MapFS{
+		"missing down": {
+			"0001_initial.up.sql": {Data: []byte("SELECT 1;")},
+		},
+		"unexpected file": {
+			"0001_initial.up.sql":   {Data: []byte("SELECT 1;")},
+			"0001_initial.down.sql": {Data: []byte("SELECT 1;")},
+			"README.md":             {Data: []byte("notes")},
+		},
+		"conflicting names": {
+			"0001_initial.up.sql": {Data: []byte("SELECT 1;")},
+			"0001_other.down.sql": {Data: []byte("SELECT 1;")},
+		},
+	} {
+		_, err := loadMigrations(files)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestEmbeddedMigrations(t *testing.T) {
+	sub, err := fs.Sub(migrationFiles, "migrations")
+	require.NoError(t, err)
+
+	migrations, err := loadMigrations(sub)
+	require.NoError(t, err)
+	require.NotEmpty(t, migrations)
+
+	// Versions are contiguous so that a gap always means a missing file
+	for i, migration := range migrations {
+		assert.Equal(t, i+1, migration.Version, migration.Name)
+	}
+}
+
+func TestRunMigrateCommandUsage(t *testing.T) {
+	var out bytes.Buffer
+	migrator := &Migrator{}
+
+	for _, args := range [][]string{{"sideways"}, {"down", "zero"}, {"down", "-1"}, {"up", "2"}, {"status", "now"}} {
+		assert.Error(t, runMigrateCommand(migrator, args, &out), args)
+	}
+}
@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS event_outbox;
+DROP TABLE IF EXISTS integrations;
+DROP TABLE IF EXISTS artifacts;
+DROP TABLE IF EXISTS build_issues;
+DROP TABLE IF EXISTS slack_threads;
+DROP TABLE IF EXISTS projects;
+DROP TABLE IF EXISTS builds;
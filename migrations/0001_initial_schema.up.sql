@@ -0,0 +1,100 @@
+-- Initial schema. Statements are idempotent so that databases created before
+-- migrations were introduced are brought up to date rather than rejected.
+
+CREATE TABLE IF NOT EXISTS builds (
+    id SERIAL PRIMARY KEY,
+    project_name VARCHAR(255) NOT NULL,
+    git_url VARCHAR(500) NOT NULL,
+    branch VARCHAR(100) NOT NULL DEFAULT 'main',
+    status VARCHAR(50) NOT NULL DEFAULT 'queued',
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+ALTER TABLE builds ADD COLUMN IF NOT EXISTS exit_code INTEGER;
+ALTER TABLE builds ADD COLUMN IF NOT EXISTS claimed_by VARCHAR(255);
+ALTER TABLE builds ADD COLUMN IF NOT EXISTS lease_expires_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE builds ADD COLUMN IF NOT EXISTS commit_sha VARCHAR(64) NOT NULL DEFAULT '';
+
+CREATE TABLE IF NOT EXISTS projects (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(255) NOT NULL UNIQUE,
+    git_url VARCHAR(500) NOT NULL,
+    repository_key VARCHAR(500) NOT NULL,
+    default_branch VARCHAR(100) NOT NULL DEFAULT 'main',
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_projects_repository_key ON projects(repository_key);
+
+ALTER TABLE projects ADD COLUMN IF NOT EXISTS skip_ci_enabled BOOLEAN NOT NULL DEFAULT TRUE;
+ALTER TABLE projects ADD COLUMN IF NOT EXISTS skip_ci_token VARCHAR(100) NOT NULL DEFAULT '';
+
+ALTER TABLE builds ADD COLUMN IF NOT EXISTS triggered_by VARCHAR(255) NOT NULL DEFAULT '';
+
+CREATE TABLE IF NOT EXISTS slack_threads (
+    build_id INTEGER PRIMARY KEY REFERENCES builds(id) ON DELETE CASCADE,
+    channel_id VARCHAR(50) NOT NULL,
+    thread_ts VARCHAR(50) NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS build_issues (
+    build_id INTEGER NOT NULL REFERENCES builds(id) ON DELETE CASCADE,
+    issue_key VARCHAR(50) NOT NULL,
+    PRIMARY KEY (build_id, issue_key)
+);
+
+CREATE INDEX IF NOT EXISTS idx_build_issues_issue_key ON build_issues(issue_key);
+
+ALTER TABLE builds ADD COLUMN IF NOT EXISTS retried_from INTEGER REFERENCES builds(id) ON DELETE SET NULL;
+
+CREATE TABLE IF NOT EXISTS artifacts (
+    id SERIAL PRIMARY KEY,
+    build_id INTEGER NOT NULL REFERENCES builds(id) ON DELETE CASCADE,
+    name VARCHAR(255) NOT NULL,
+    size BIGINT NOT NULL,
+    sha256 CHAR(64) NOT NULL,
+    content_type VARCHAR(255) NOT NULL,
+    storage_key VARCHAR(500) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    UNIQUE (build_id, name)
+);
+
+CREATE INDEX IF NOT EXISTS idx_artifacts_created_at ON artifacts(created_at);
+
+ALTER TABLE builds ADD COLUMN IF NOT EXISTS tag VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE builds ADD COLUMN IF NOT EXISTS version VARCHAR(100) NOT NULL DEFAULT '';
+ALTER TABLE projects ADD COLUMN IF NOT EXISTS tag_pattern VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE projects ADD COLUMN IF NOT EXISTS artifact_tag_pattern VARCHAR(255) NOT NULL DEFAULT '';
+
+ALTER TABLE builds ADD COLUMN IF NOT EXISTS auto_version BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE projects ADD COLUMN IF NOT EXISTS auto_version BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE projects ADD COLUMN IF NOT EXISTS paused_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE projects ADD COLUMN IF NOT EXISTS pause_reason TEXT NOT NULL DEFAULT '';
+
+CREATE TABLE IF NOT EXISTS integrations (
+    name VARCHAR(255) PRIMARY KEY,
+    consecutive_failures INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT NOT NULL DEFAULT '',
+    last_failure_at TIMESTAMP WITH TIME ZONE,
+    disabled_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE TABLE IF NOT EXISTS event_outbox (
+    id BIGSERIAL PRIMARY KEY,
+    integration VARCHAR(255) NOT NULL,
+    payload JSONB NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT NOT NULL DEFAULT '',
+    next_attempt_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    delivered_at TIMESTAMP WITH TIME ZONE,
+    failed_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS idx_event_outbox_pending ON event_outbox(next_attempt_at) WHERE delivered_at IS NULL AND failed_at IS NULL;
+
+CREATE INDEX IF NOT EXISTS idx_builds_status ON builds(status);
+CREATE INDEX IF NOT EXISTS idx_builds_project ON builds(project_name);
+CREATE INDEX IF NOT EXISTS idx_builds_created_at ON builds(created_at);
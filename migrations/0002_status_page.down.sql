@@ -0,0 +1,5 @@
+DROP TABLE status_incidents;
+
+DROP INDEX idx_builds_started_at;
+
+ALTER TABLE builds DROP COLUMN started_at;
@@ -0,0 +1,18 @@
+ALTER TABLE builds ADD COLUMN started_at TIMESTAMP WITH TIME ZONE;
+
+CREATE INDEX idx_builds_started_at ON builds(started_at);
+
+CREATE TABLE status_incidents (
+    id SERIAL PRIMARY KEY,
+    kind VARCHAR(20) NOT NULL,
+    impact VARCHAR(20) NOT NULL,
+    title VARCHAR(255) NOT NULL,
+    message TEXT NOT NULL DEFAULT '',
+    starts_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    ends_at TIMESTAMP WITH TIME ZONE,
+    resolved_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX idx_status_incidents_open ON status_incidents(starts_at) WHERE resolved_at IS NULL;
@@ -0,0 +1,13 @@
+CREATE TABLE api_usage (
+    day DATE NOT NULL,
+    org VARCHAR(255) NOT NULL,
+    method VARCHAR(10) NOT NULL,
+    route VARCHAR(500) NOT NULL,
+    client VARCHAR(255) NOT NULL,
+    client_version VARCHAR(100) NOT NULL,
+    caller CHAR(16) NOT NULL,
+    requests BIGINT NOT NULL DEFAULT 0,
+    errors BIGINT NOT NULL DEFAULT 0,
+    last_seen TIMESTAMP WITH TIME ZONE NOT NULL,
+    PRIMARY KEY (day, org, method, route, client, client_version, caller)
+);
@@ -0,0 +1 @@
+ALTER TABLE projects ADD COLUMN build_timeout_seconds INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1 @@
+ALTER TABLE projects ADD COLUMN max_queue_wait_seconds INTEGER NOT NULL DEFAULT 0;
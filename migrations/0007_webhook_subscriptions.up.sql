@@ -0,0 +1,11 @@
+CREATE TABLE webhook_subscriptions (
+    id SERIAL PRIMARY KEY,
+    url VARCHAR(2000) NOT NULL,
+    secret VARCHAR(255) NOT NULL DEFAULT '',
+    statuses TEXT[] NOT NULL DEFAULT '{}',
+    projects TEXT[] NOT NULL DEFAULT '{}',
+    fields JSONB NOT NULL DEFAULT '{}',
+    enabled BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
@@ -0,0 +1 @@
+ALTER TABLE builds DROP COLUMN IF EXISTS idempotency_key;
@@ -0,0 +1 @@
+ALTER TABLE builds ADD COLUMN idempotency_key VARCHAR(255) UNIQUE;
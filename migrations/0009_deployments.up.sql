@@ -0,0 +1,15 @@
+CREATE TABLE deployments (
+    id SERIAL PRIMARY KEY,
+    build_id INTEGER NOT NULL REFERENCES builds(id),
+    project_name VARCHAR(255) NOT NULL,
+    environment VARCHAR(63) NOT NULL,
+    status VARCHAR(50) NOT NULL DEFAULT 'pending',
+    description TEXT NOT NULL DEFAULT '',
+    triggered_by VARCHAR(255) NOT NULL DEFAULT '',
+    live_at TIMESTAMP WITH TIME ZONE,
+    rolled_back_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX idx_deployments_project_environment ON deployments(project_name, environment, created_at DESC);
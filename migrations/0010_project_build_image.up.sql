@@ -0,0 +1 @@
+ALTER TABLE projects ADD COLUMN build_image TEXT NOT NULL DEFAULT '';
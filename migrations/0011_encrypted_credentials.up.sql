@@ -0,0 +1 @@
+ALTER TABLE webhook_subscriptions ALTER COLUMN secret TYPE TEXT;
@@ -0,0 +1 @@
+ALTER TABLE builds DROP COLUMN trace_parent;
@@ -0,0 +1 @@
+ALTER TABLE builds ADD COLUMN trace_parent VARCHAR(55) NOT NULL DEFAULT '';
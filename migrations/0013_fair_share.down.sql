@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS fair_share_limits;
+DROP INDEX IF EXISTS idx_builds_org_user_status;
+ALTER TABLE builds DROP COLUMN org;
@@ -0,0 +1,9 @@
+ALTER TABLE builds ADD COLUMN org VARCHAR(255) NOT NULL DEFAULT '';
+
+CREATE INDEX idx_builds_org_user_status ON builds(org, triggered_by, status);
+
+CREATE TABLE fair_share_limits (
+    org VARCHAR(255) PRIMARY KEY,
+    max_running_per_user INTEGER NOT NULL,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
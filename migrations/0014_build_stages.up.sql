@@ -0,0 +1,11 @@
+CREATE TABLE build_stages (
+    build_id INTEGER NOT NULL REFERENCES builds(id) ON DELETE CASCADE,
+    position INTEGER NOT NULL,
+    name VARCHAR(50) NOT NULL,
+    status VARCHAR(50) NOT NULL,
+    exit_code INTEGER,
+    started_at TIMESTAMP WITH TIME ZONE,
+    finished_at TIMESTAMP WITH TIME ZONE,
+    log TEXT NOT NULL DEFAULT '',
+    PRIMARY KEY (build_id, position)
+);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_builds_draft_start_at;
+ALTER TABLE builds DROP COLUMN start_at;
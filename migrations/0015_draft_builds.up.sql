@@ -0,0 +1,3 @@
+ALTER TABLE builds ADD COLUMN start_at TIMESTAMP WITH TIME ZONE;
+
+CREATE INDEX idx_builds_draft_start_at ON builds(start_at) WHERE status = 'draft';
@@ -0,0 +1,3 @@
+ALTER TABLE projects DROP COLUMN IF EXISTS notify_emails;
+ALTER TABLE projects DROP COLUMN IF EXISTS notify_slack_webhook_url;
+ALTER TABLE projects DROP COLUMN IF EXISTS notify_on;
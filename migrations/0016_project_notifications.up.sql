@@ -0,0 +1,3 @@
+ALTER TABLE projects ADD COLUMN notify_on VARCHAR(20) NOT NULL DEFAULT '';
+ALTER TABLE projects ADD COLUMN notify_slack_webhook_url TEXT NOT NULL DEFAULT '';
+ALTER TABLE projects ADD COLUMN notify_emails TEXT[] NOT NULL DEFAULT '{}';
@@ -0,0 +1,2 @@
+ALTER TABLE builds DROP COLUMN IF EXISTS cancelled_by;
+ALTER TABLE builds DROP COLUMN IF EXISTS cancel_reason;
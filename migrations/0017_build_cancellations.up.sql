@@ -0,0 +1,2 @@
+ALTER TABLE builds ADD COLUMN cancel_reason VARCHAR(50) NOT NULL DEFAULT '';
+ALTER TABLE builds ADD COLUMN cancelled_by TEXT NOT NULL DEFAULT '';
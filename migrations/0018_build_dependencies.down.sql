@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_builds_depends_on;
+ALTER TABLE builds DROP COLUMN IF EXISTS depends_on;
@@ -0,0 +1,2 @@
+ALTER TABLE builds ADD COLUMN depends_on INTEGER[] NOT NULL DEFAULT '{}';
+CREATE INDEX idx_builds_depends_on ON builds USING GIN (depends_on);
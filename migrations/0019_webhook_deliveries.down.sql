@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS webhook_deliveries;
+ALTER TABLE webhook_subscriptions DROP COLUMN IF EXISTS events;
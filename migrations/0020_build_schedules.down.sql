@@ -0,0 +1,2 @@
+ALTER TABLE builds DROP COLUMN IF EXISTS schedule_id;
+DROP TABLE IF EXISTS build_schedules;
@@ -0,0 +1,18 @@
+CREATE TABLE build_schedules (
+    id SERIAL PRIMARY KEY,
+    project_id INTEGER NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+    cron VARCHAR(255) NOT NULL,
+    timezone VARCHAR(64) NOT NULL DEFAULT 'UTC',
+    branch VARCHAR(255) NOT NULL,
+    enabled BOOLEAN NOT NULL DEFAULT TRUE,
+    next_run_at TIMESTAMP WITH TIME ZONE,
+    last_run_at TIMESTAMP WITH TIME ZONE,
+    last_build_id INTEGER,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX idx_build_schedules_project ON build_schedules(project_id);
+CREATE INDEX idx_build_schedules_due ON build_schedules(next_run_at) WHERE enabled;
+
+ALTER TABLE builds ADD COLUMN schedule_id INTEGER REFERENCES build_schedules(id) ON DELETE SET NULL;
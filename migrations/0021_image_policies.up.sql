@@ -0,0 +1,6 @@
+CREATE TABLE image_policies (
+    org VARCHAR(255) PRIMARY KEY,
+    allowed_images TEXT[] NOT NULL DEFAULT '{}',
+    digest_required_stages TEXT[] NOT NULL DEFAULT '{}',
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
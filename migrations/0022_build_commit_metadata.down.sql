@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_builds_commit_sha;
+ALTER TABLE builds DROP COLUMN IF EXISTS trigger_source;
+ALTER TABLE builds DROP COLUMN IF EXISTS commit_author;
+ALTER TABLE builds DROP COLUMN IF EXISTS commit_message;
@@ -0,0 +1,8 @@
+ALTER TABLE builds ADD COLUMN commit_message TEXT NOT NULL DEFAULT '';
+ALTER TABLE builds ADD COLUMN commit_author VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE builds ADD COLUMN trigger_source VARCHAR(20) NOT NULL DEFAULT 'manual';
+
+UPDATE builds SET trigger_source = 'retry' WHERE retried_from IS NOT NULL;
+UPDATE builds SET trigger_source = 'schedule' WHERE schedule_id IS NOT NULL;
+
+CREATE INDEX idx_builds_commit_sha ON builds(commit_sha text_pattern_ops) WHERE commit_sha <> '';
@@ -0,0 +1,7 @@
+CREATE TABLE data_erasures (
+    id SERIAL PRIMARY KEY,
+    pseudonym VARCHAR(64) NOT NULL,
+    reference VARCHAR(255) NOT NULL DEFAULT '',
+    scrubbed JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
@@ -0,0 +1 @@
+ALTER TABLE builds ADD COLUMN description TEXT NOT NULL DEFAULT '';
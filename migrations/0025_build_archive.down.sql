@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS builds_archive;
+ALTER TABLE builds DROP COLUMN IF EXISTS deleted_at;
@@ -0,0 +1,14 @@
+ALTER TABLE builds ADD COLUMN deleted_at TIMESTAMP WITH TIME ZONE;
+
+CREATE TABLE builds_archive (
+    id INTEGER PRIMARY KEY,
+    project_name VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    deleted_at TIMESTAMP WITH TIME ZONE,
+    archived_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    build JSONB NOT NULL,
+    stages JSONB,
+    config JSONB
+);
+
+CREATE INDEX idx_builds_archive_project_name ON builds_archive(project_name);
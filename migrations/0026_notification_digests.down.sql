@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_builds_status_updated_at;
+DROP TABLE IF EXISTS notification_digests;
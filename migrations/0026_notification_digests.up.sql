@@ -0,0 +1,14 @@
+CREATE TABLE notification_digests (
+    id SERIAL PRIMARY KEY,
+    channel VARCHAR(20) NOT NULL,
+    target VARCHAR(500) NOT NULL,
+    projects TEXT[] NOT NULL DEFAULT '{}',
+    statuses TEXT[] NOT NULL DEFAULT '{}',
+    interval_seconds INTEGER NOT NULL,
+    next_run_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    last_run_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX idx_notification_digests_next_run_at ON notification_digests(next_run_at);
+CREATE INDEX IF NOT EXISTS idx_builds_status_updated_at ON builds(status, updated_at);
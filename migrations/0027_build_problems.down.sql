@@ -0,0 +1,2 @@
+ALTER TABLE projects DROP COLUMN IF EXISTS problem_patterns;
+DROP TABLE IF EXISTS build_problems;
@@ -0,0 +1,15 @@
+CREATE TABLE build_problems (
+    build_id INTEGER NOT NULL REFERENCES builds(id) ON DELETE CASCADE,
+    position INTEGER NOT NULL,
+    stage_index INTEGER NOT NULL,
+    stage VARCHAR(50) NOT NULL,
+    line INTEGER NOT NULL,
+    log_offset INTEGER NOT NULL,
+    severity VARCHAR(20) NOT NULL,
+    message TEXT NOT NULL,
+    file TEXT NOT NULL DEFAULT '',
+    file_line INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (build_id, position)
+);
+
+ALTER TABLE projects ADD COLUMN problem_patterns TEXT[] NOT NULL DEFAULT '{}';
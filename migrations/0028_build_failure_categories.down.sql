@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_builds_project_failure_category;
+ALTER TABLE builds DROP COLUMN IF EXISTS failure_category;
@@ -0,0 +1,2 @@
+ALTER TABLE builds ADD COLUMN failure_category VARCHAR(50) NOT NULL DEFAULT '';
+CREATE INDEX idx_builds_project_failure_category ON builds(project_name, created_at) WHERE failure_category <> '';
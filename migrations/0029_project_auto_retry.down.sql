@@ -0,0 +1,2 @@
+ALTER TABLE projects DROP COLUMN IF EXISTS auto_retry_categories;
+ALTER TABLE projects DROP COLUMN IF EXISTS max_auto_retries;
@@ -0,0 +1,2 @@
+ALTER TABLE projects ADD COLUMN max_auto_retries INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE projects ADD COLUMN auto_retry_categories TEXT[] NOT NULL DEFAULT '{}';
@@ -0,0 +1 @@
+ALTER TABLE artifacts DROP COLUMN IF EXISTS step;
@@ -0,0 +1 @@
+ALTER TABLE artifacts ADD COLUMN step INTEGER;
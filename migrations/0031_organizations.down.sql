@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_builds_org_created_at;
+ALTER TABLE projects DROP COLUMN IF EXISTS org;
+DROP TABLE IF EXISTS api_keys;
+DROP TABLE IF EXISTS organizations;
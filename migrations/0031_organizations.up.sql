@@ -0,0 +1,22 @@
+CREATE TABLE organizations (
+    name VARCHAR(255) PRIMARY KEY,
+    display_name VARCHAR(255) NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE TABLE api_keys (
+    id SERIAL PRIMARY KEY,
+    org VARCHAR(255) NOT NULL REFERENCES organizations(name) ON DELETE CASCADE,
+    name VARCHAR(255) NOT NULL DEFAULT '',
+    prefix VARCHAR(20) NOT NULL,
+    key_hash CHAR(64) NOT NULL UNIQUE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    last_used_at TIMESTAMP WITH TIME ZONE,
+    revoked_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX idx_api_keys_org ON api_keys(org);
+
+ALTER TABLE projects ADD COLUMN org VARCHAR(255) NOT NULL DEFAULT '';
+CREATE INDEX idx_projects_org ON projects(org);
+CREATE INDEX idx_builds_org_created_at ON builds(org, created_at DESC);
@@ -0,0 +1 @@
+ALTER TABLE organizations ADD COLUMN domain VARCHAR(255) UNIQUE;
@@ -0,0 +1,19 @@
+CREATE TABLE audit_logs (
+    id BIGSERIAL PRIMARY KEY,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    actor VARCHAR(255) NOT NULL,
+    org VARCHAR(255) NOT NULL DEFAULT '',
+    ip VARCHAR(64) NOT NULL DEFAULT '',
+    method VARCHAR(10) NOT NULL,
+    route VARCHAR(255) NOT NULL,
+    path TEXT NOT NULL,
+    resource VARCHAR(64) NOT NULL DEFAULT '',
+    resource_id VARCHAR(255) NOT NULL DEFAULT '',
+    status INTEGER NOT NULL,
+    before JSONB,
+    after JSONB
+);
+
+CREATE INDEX idx_audit_logs_created_at ON audit_logs(created_at DESC);
+CREATE INDEX idx_audit_logs_actor ON audit_logs(actor, created_at DESC);
+CREATE INDEX idx_audit_logs_resource ON audit_logs(resource, resource_id);
@@ -0,0 +1,2 @@
+ALTER TABLE projects DROP COLUMN IF EXISTS quality_gate_policy;
+DROP TABLE IF EXISTS quality_gates;
@@ -0,0 +1,15 @@
+CREATE TABLE quality_gates (
+    id SERIAL PRIMARY KEY,
+    project_name VARCHAR(255) NOT NULL,
+    commit_sha VARCHAR(64) NOT NULL,
+    tool VARCHAR(64) NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    status VARCHAR(16) NOT NULL,
+    url TEXT NOT NULL DEFAULT '',
+    conditions JSONB NOT NULL DEFAULT '[]',
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    UNIQUE (project_name, commit_sha, tool, name)
+);
+
+ALTER TABLE projects ADD COLUMN quality_gate_policy VARCHAR(32) NOT NULL DEFAULT '';
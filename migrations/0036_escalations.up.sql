@@ -0,0 +1,16 @@
+CREATE TABLE escalations (
+    id SERIAL PRIMARY KEY,
+    dedup_key VARCHAR(512) NOT NULL,
+    provider VARCHAR(64) NOT NULL,
+    reference VARCHAR(512) NOT NULL,
+    status VARCHAR(16) NOT NULL DEFAULT 'triggered',
+    build_id INTEGER NOT NULL REFERENCES builds(id) ON DELETE CASCADE,
+    deployment_id INTEGER REFERENCES deployments(id) ON DELETE SET NULL,
+    summary TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    resolved_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX idx_escalations_dedup_key ON escalations(dedup_key) WHERE status <> 'resolved';
+CREATE INDEX idx_escalations_build_id ON escalations(build_id);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_builds_upstream_build_id;
+ALTER TABLE builds DROP COLUMN IF EXISTS upstream_build_id;
+DROP TABLE IF EXISTS project_dependencies;
@@ -0,0 +1,10 @@
+CREATE TABLE project_dependencies (
+    upstream_project_id INTEGER NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+    downstream_project_id INTEGER NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    PRIMARY KEY (upstream_project_id, downstream_project_id),
+    CHECK (upstream_project_id <> downstream_project_id)
+);
+
+ALTER TABLE builds ADD COLUMN upstream_build_id INTEGER REFERENCES builds(id) ON DELETE SET NULL;
+CREATE INDEX idx_builds_upstream_build_id ON builds(upstream_build_id) WHERE upstream_build_id IS NOT NULL;
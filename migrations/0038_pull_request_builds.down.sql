@@ -0,0 +1,2 @@
+ALTER TABLE builds DROP COLUMN IF EXISTS pull_request_fork;
+ALTER TABLE builds DROP COLUMN IF EXISTS pull_request;
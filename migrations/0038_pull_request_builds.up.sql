@@ -0,0 +1,2 @@
+ALTER TABLE builds ADD COLUMN pull_request INTEGER;
+ALTER TABLE builds ADD COLUMN pull_request_fork BOOLEAN NOT NULL DEFAULT FALSE;
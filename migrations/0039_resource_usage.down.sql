@@ -0,0 +1,5 @@
+ALTER TABLE projects DROP COLUMN IF EXISTS auto_apply_recommendations;
+ALTER TABLE projects DROP COLUMN IF EXISTS memory_limit_mb;
+ALTER TABLE projects DROP COLUMN IF EXISTS cpu_limit;
+ALTER TABLE builds DROP COLUMN IF EXISTS peak_memory_bytes;
+ALTER TABLE builds DROP COLUMN IF EXISTS cpu_seconds;
@@ -0,0 +1,5 @@
+ALTER TABLE builds ADD COLUMN cpu_seconds DOUBLE PRECISION;
+ALTER TABLE builds ADD COLUMN peak_memory_bytes BIGINT;
+ALTER TABLE projects ADD COLUMN cpu_limit DOUBLE PRECISION NOT NULL DEFAULT 0;
+ALTER TABLE projects ADD COLUMN memory_limit_mb INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE projects ADD COLUMN auto_apply_recommendations BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_builds_parent_build_id;
+ALTER TABLE projects DROP COLUMN IF EXISTS matrix;
+ALTER TABLE builds DROP COLUMN IF EXISTS matrix;
+ALTER TABLE builds DROP COLUMN IF EXISTS parent_build_id;
@@ -0,0 +1,4 @@
+ALTER TABLE builds ADD COLUMN parent_build_id INTEGER REFERENCES builds(id) ON DELETE SET NULL;
+ALTER TABLE builds ADD COLUMN matrix JSONB;
+ALTER TABLE projects ADD COLUMN matrix JSONB NOT NULL DEFAULT '{}';
+CREATE INDEX idx_builds_parent_build_id ON builds(parent_build_id) WHERE parent_build_id IS NOT NULL;
@@ -0,0 +1,2 @@
+ALTER TABLE builds ADD COLUMN skip_reason VARCHAR(50) NOT NULL DEFAULT '';
+UPDATE builds SET skip_reason = 'commit_directive' WHERE status = 'skipped';
@@ -0,0 +1 @@
+ALTER TABLE builds ADD COLUMN log_truncation VARCHAR(20) NOT NULL DEFAULT '';
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS queue_state;
+DROP TABLE IF EXISTS workers;
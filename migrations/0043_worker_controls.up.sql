@@ -0,0 +1,16 @@
+CREATE TABLE workers (
+    id VARCHAR(255) PRIMARY KEY,
+    hostname VARCHAR(255) NOT NULL,
+    slots INTEGER NOT NULL,
+    started_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    heartbeat_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    draining_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE TABLE queue_state (
+    id BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (id),
+    paused_at TIMESTAMP WITH TIME ZONE,
+    pause_reason TEXT NOT NULL DEFAULT ''
+);
+
+INSERT INTO queue_state DEFAULT VALUES;
@@ -0,0 +1 @@
+ALTER TABLE builds ADD COLUMN debug_logging BOOLEAN NOT NULL DEFAULT FALSE;
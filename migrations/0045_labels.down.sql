@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_projects_labels;
+DROP INDEX IF EXISTS idx_builds_labels;
+
+ALTER TABLE projects DROP COLUMN IF EXISTS labels;
+ALTER TABLE builds DROP COLUMN IF EXISTS labels;
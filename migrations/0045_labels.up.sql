@@ -0,0 +1,5 @@
+ALTER TABLE builds ADD COLUMN labels JSONB NOT NULL DEFAULT '{}';
+ALTER TABLE projects ADD COLUMN labels JSONB NOT NULL DEFAULT '{}';
+
+CREATE INDEX idx_builds_labels ON builds USING GIN (labels jsonb_path_ops);
+CREATE INDEX idx_projects_labels ON projects USING GIN (labels jsonb_path_ops);
@@ -0,0 +1,8 @@
+CREATE TABLE build_duration_estimates (
+    project_name VARCHAR(255) NOT NULL,
+    -- An empty branch holds the durations of all of the project's builds
+    branch VARCHAR(255) NOT NULL DEFAULT '',
+    durations DOUBLE PRECISION[] NOT NULL,
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (project_name, branch)
+);
@@ -0,0 +1,3 @@
+-- Artifacts published by the build's pipeline, as opposed to uploaded through
+-- the API; only these are attested in the build's provenance
+ALTER TABLE artifacts ADD COLUMN published BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,2 @@
+ALTER TABLE builds DROP CONSTRAINT IF EXISTS builds_org_idempotency_key_key;
+ALTER TABLE builds ADD CONSTRAINT builds_idempotency_key_key UNIQUE (idempotency_key);
@@ -0,0 +1,3 @@
+-- Idempotency keys are chosen by clients, so two orgs may pick the same one
+ALTER TABLE builds DROP CONSTRAINT IF EXISTS builds_idempotency_key_key;
+ALTER TABLE builds ADD CONSTRAINT builds_org_idempotency_key_key UNIQUE (org, idempotency_key);
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// gitMirrorTimeout bounds creating or updating a mirror
+const gitMirrorTimeout = 10 * time.Minute
+
+// GitMirrorCache keeps bare mirrors of frequently built repositories, so
+// checkouts fetch from local disk, or a volume shared by the service's
+// replicas, rather than from the git host. A repository is mirrored once it
+// has been built GIT_MIRROR_MIN_BUILDS times within GIT_MIRROR_WINDOW.
+// Mirrors are updated by push webhooks, and before a checkout when they are
+// older than GIT_MIRROR_MAX_AGE.
+type GitMirrorCache struct {
+	dir       string
+	minBuilds int
+	window    time.Duration
+	maxAge    time.Duration
+	errors    *ErrorTracker
+	clones    *prometheus.CounterVec
+
+	mu    sync.Mutex
+	repos map[string]*gitMirror
+}
+
+// gitMirror tracks a repository's builds and its mirror
+type gitMirror struct {
+	// mu serializes creating and updating the mirror
+	mu       sync.Mutex
+	builds   []time.Time
+	fetched  time.Time
+	creating bool
+}
+
+// NewGitMirrorCacheFromEnv creates a cache keeping mirrors in GIT_MIRROR_DIR,
+// or returns nil when it isn't set
+func NewGitMirrorCacheFromEnv(errors *ErrorTracker, clones *prometheus.CounterVec) *GitMirrorCache {
+	dir := os.Getenv("GIT_MIRROR_DIR")
+	if dir == "" {
+		return nil
+	}
+	return &GitMirrorCache{
+		dir:       dir,
+		minBuilds: getEnvInt("GIT_MIRROR_MIN_BUILDS", 3),
+		window:    getEnvDuration("GIT_MIRROR_WINDOW", 24*time.Hour),
+		maxAge:    getEnvDuration("GIT_MIRROR_MAX_AGE", time.Minute),
+		errors:    errors,
+		clones:    clones,
+		repos:     make(map[string]*gitMirror),
+	}
+}
+
+// path returns where a repository's mirror is kept
+func (gm *GitMirrorCache) path(gitURL string) string {
+	sum := sha256.Sum256([]byte(gitURL))
+	return filepath.Join(gm.dir, hex.EncodeToString(sum[:12])+".git")
+}
+
+func (gm *GitMirrorCache) repo(gitURL string) *gitMirror {
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+	repo, ok := gm.repos[gitURL]
+	if !ok {
+		repo = &gitMirror{}
+		gm.repos[gitURL] = repo
+	}
+	return repo
+}
+
+// Source records a build of a repository and returns the path of its mirror,
+// brought up to date, or "" when the repository isn't mirrored yet. Mirroring
+// starts in the background once the repository is built often enough.
+func (gm *GitMirrorCache) Source(ctx context.Context, gitURL string) string {
+	repo := gm.repo(gitURL)
+	path := gm.path(gitURL)
+	_, err := os.Stat(path)
+	mirrored := err == nil
+	now := time.Now()
+
+	gm.mu.Lock()
+	builds := repo.builds[:0]
+	for _, at := range repo.builds {
+		if now.Sub(at) < gm.window {
+			builds = append(builds, at)
+		}
+	}
+	repo.builds = append(builds, now)
+	create := !mirrored && !repo.creating && len(repo.builds) >= gm.minBuilds
+	if create {
+		repo.creating = true
+	}
+	gm.mu.Unlock()
+
+	if create {
+		go gm.create(gitURL, repo)
+	}
+	if !mirrored {
+		return ""
+	}
+
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	if now.Sub(repo.fetched) > gm.maxAge {
+		if err := gm.fetch(ctx, path, repo); err != nil {
+			gm.errors.Capture("git-mirror", fmt.Errorf("updating mirror of %s: %w", gitURL, err), nil)
+			return ""
+		}
+	}
+	return path
+}
+
+// Update fetches a mirrored repository after a push, so the builds it
+// triggers find the pushed commits in the mirror. Repositories without a
+// mirror are left alone.
+func (gm *GitMirrorCache) Update(ctx context.Context, gitURL string) {
+	path := gm.path(gitURL)
+	if _, err := os.Stat(path); err != nil {
+		return
+	}
+
+	repo := gm.repo(gitURL)
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	if err := gm.fetch(ctx, path, repo); err != nil {
+		gm.errors.Capture("git-mirror", fmt.Errorf("updating mirror of %s: %w", gitURL, err), nil)
+	}
+}
+
+// RecordClone counts a checkout by where it was cloned from
+func (gm *GitMirrorCache) RecordClone(source string) {
+	gm.clones.WithLabelValues(source).Inc()
+}
+
+// create mirrors a repository into a temporary directory, then moves it into
+// place so checkouts never see a partial mirror
+func (gm *GitMirrorCache) create(gitURL string, repo *gitMirror) {
+	defer func() {
+		gm.mu.Lock()
+		repo.creating = false
+		gm.mu.Unlock()
+	}()
+
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	err := func() error {
+		if err := os.MkdirAll(gm.dir, 0o755); err != nil {
+			return err
+		}
+		tmp, err := os.MkdirTemp(gm.dir, ".mirror-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+
+		ctx, cancel := context.WithTimeout(context.Background(), gitMirrorTimeout)
+		defer cancel()
+		if err := gm.git(ctx, "clone", "--mirror", "--quiet", "--", gitURL, tmp); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, gm.path(gitURL)); err != nil {
+			// Another replica sharing the directory mirrored it first
+			if _, statErr := os.Stat(gm.path(gitURL)); statErr == nil {
+				return nil
+			}
+			return err
+		}
+		repo.fetched = time.Now()
+		return nil
+	}()
+	if err != nil {
+		gm.errors.Capture("git-mirror", fmt.Errorf("mirroring %s: %w", gitURL, err), nil)
+		return
+	}
+	log.Printf("Mirrored %s for faster checkouts", gitURL)
+}
+
+// fetch updates a mirror from its git host. The caller holds repo.mu.
+func (gm *GitMirrorCache) fetch(ctx context.Context, path string, repo *gitMirror) error {
+	ctx, cancel := context.WithTimeout(ctx, gitMirrorTimeout)
+	defer cancel()
+	if err := gm.git(ctx, "-C", path, "fetch", "--prune", "--quiet", "origin"); err != nil {
+		return err
+	}
+	repo.fetched = time.Now()
+	return nil
+}
+
+// git runs a git command for the cache. Mirrors are only created for URLs the
+// executor has validated, and fetch from the URL they were created with.
+func (gm *GitMirrorCache) git(ctx context.Context, args ...string) error {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Env = []string{"PATH=" + os.Getenv("PATH"), "HOME=" + gm.dir, "GIT_TERMINAL_PROMPT=0"}
+	if output, err := cmd.CombinedOutput(); err != nil {
+		command := args[0]
+		if command == "-C" {
+			command = args[2]
+		}
+		return fmt.Errorf("git %s: %w: %s", command, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// gitCommit commits a Makefile to repo, returning the commit's hash
+func gitCommit(t *testing.T, repo, makefile string) string {
+	t.Helper()
+	require.NoError(t, os.WriteFile(filepath.Join(repo, "Makefile"), []byte(makefile), 0o644))
+	for _, args := range [][]string{
+		{"add", "Makefile"},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "change"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repo
+		require.NoError(t, cmd.Run())
+	}
+	out, err := exec.Command("git", "-C", repo, "rev-parse", "HEAD").Output()
+	require.NoError(t, err)
+	return strings.TrimSpace(string(out))
+}
+
+func newTestMirrorCache(t *testing.T, minBuilds int) *GitMirrorCache {
+	return &GitMirrorCache{
+		dir:       t.TempDir(),
+		minBuilds: minBuilds,
+		window:    time.Hour,
+		maxAge:    time.Hour,
+		errors:    NewErrorTracker(&LogErrorReporter{}, prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_errors_total"}, []string{"subsystem"})),
+		clones:    prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_git_mirror_clones_total"}, []string{"source"}),
+		repos:     make(map[string]*gitMirror),
+	}
+}
+
+func TestGitMirrorCacheMirrorsHotRepositories(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	repo := t.TempDir()
+	require.NoError(t, exec.Command("git", "init", "-q", "-b", "main", repo).Run())
+	gitCommit(t, repo, "all:\n\t@echo one\n")
+	gitURL := "file://" + repo
+
+	cache := newTestMirrorCache(t, 2)
+	assert.Empty(t, cache.Source(context.Background(), gitURL))
+	assert.Empty(t, cache.Source(context.Background(), gitURL))
+
+	// The second build starts mirroring in the background
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(cache.path(gitURL))
+		return err == nil
+	}, 10*time.Second, 10*time.Millisecond)
+	assert.Equal(t, cache.path(gitURL), cache.Source(context.Background(), gitURL))
+
+	// Pushes are fetched into the mirror
+	sha := gitCommit(t, repo, "all:\n\t@echo two\n")
+	cache.Update(context.Background(), gitURL)
+	out, err := exec.Command("git", "-C", cache.path(gitURL), "rev-parse", "refs/heads/main").Output()
+	require.NoError(t, err)
+	assert.Equal(t, sha, strings.TrimSpace(string(out)))
+
+	// Other repositories aren't mirrored until they're built often enough
+	cache.Update(context.Background(), "file:///elsewhere")
+	_, err = os.Stat(cache.path("file:///elsewhere"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestLocalExecutorChecksOutFromMirror(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	if _, err := exec.LookPath("make"); err != nil {
+		t.Skip("make not installed")
+	}
+
+	repo := t.TempDir()
+	require.NoError(t, exec.Command("git", "init", "-q", "-b", "main", repo).Run())
+	gitCommit(t, repo, "all:\n\t@echo one\n")
+	gitURL := "file://" + repo
+
+	cache := newTestMirrorCache(t, 1)
+	cache.Source(context.Background(), gitURL)
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(cache.path(gitURL))
+		return err == nil
+	}, 10*time.Second, 10*time.Millisecond)
+
+	executor := NewLocalExecutor(t.TempDir())
+	executor.AllowedProtocols = append(executor.AllowedProtocols, "file")
+	executor.Mirrors = cache
+
+	// A commit pushed after the mirror was updated falls back to the git host
+	sha := gitCommit(t, repo, "all:\n\t@echo two\n")
+	result, err := executor.Execute(context.Background(), &BuildRequest{ID: 1, GitURL: gitURL, Branch: "main", CommitSHA: sha})
+	require.NoError(t, err)
+	assert.Equal(t, "success", result.Status, string(result.Output))
+	assert.Contains(t, result.Stages[0].Log, "checkout from mirror failed, cloning from the git host")
+	assert.Contains(t, result.Stages[1].Log, "two")
+	assert.Equal(t, 1.0, testutil.ToFloat64(cache.clones.WithLabelValues("upstream")))
+
+	cache.Update(context.Background(), gitURL)
+	result, err = executor.Execute(context.Background(), &BuildRequest{ID: 2, GitURL: gitURL, Branch: "main", CommitSHA: sha})
+	require.NoError(t, err)
+	assert.Equal(t, "success", result.Status, string(result.Output))
+	assert.Contains(t, result.Stages[0].Log, "git clone --depth 1 --single-branch --branch main -- file://"+cache.path(gitURL))
+	assert.NotContains(t, result.Stages[0].Log, "cloning from the git host")
+	assert.Contains(t, result.Stages[1].Log, "two")
+	assert.Equal(t, 1.0, testutil.ToFloat64(cache.clones.WithLabelValues("mirror")))
+	assert.Equal(t, sha, result.Commit.SHA)
+}
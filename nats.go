@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NATSSink publishes build events to NATS subjects, choosing the subject by
+// the organization owning the build's repository. It speaks the core NATS
+// text protocol over a single connection, redialled after any error.
+type NATSSink struct {
+	subjects map[string]string
+	server   *url.URL
+	health   *IntegrationHealth
+	timeout  time.Duration
+
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// NewNATSSinkFromEnv creates a NATS sink when NATS_URL and NATS_SUBJECTS are
+// set, or returns nil
+func NewNATSSinkFromEnv(health *IntegrationHealth) *NATSSink {
+	subjects := parseOrgTargets(os.Getenv("NATS_SUBJECTS"))
+	server, err := url.Parse(os.Getenv("NATS_URL"))
+	if err != nil || server.Host == "" || len(subjects) == 0 {
+		return nil
+	}
+
+	return &NATSSink{
+		subjects: subjects,
+		server:   server,
+		health:   health,
+		timeout:  10 * time.Second,
+	}
+}
+
+// Name identifies the integration
+func (ns *NATSSink) Name() string {
+	return "nats"
+}
+
+// natsSubject is the subject an event is published on: the organization's
+// subject followed by the build status, so consumers can subscribe to e.g.
+// "builds.failed" or "builds.>"
+func natsSubject(subject string, build *BuildRequest) string {
+	return subject + "." + build.Status
+}
+
+// Deliver publishes the event JSON to the subject of the build's organization
+func (ns *NATSSink) Deliver(ctx context.Context, event BuildEvent) error {
+	subject, ok := orgTarget(ns.subjects, &event.Build)
+	if !ok {
+		return nil
+	}
+	if !ns.health.Allow(ns.Name()) {
+		return errIntegrationDisabled
+	}
+
+	err := ns.publish(ctx, natsSubject(subject, &event.Build), event)
+	ns.health.Record(ns.Name(), err, &event.Build)
+	return err
+}
+
+func (ns *NATSSink) publish(ctx context.Context, subject string, event BuildEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	if ns.conn == nil {
+		if err := ns.connect(ctx); err != nil {
+			return fmt.Errorf("nats: connecting to %s: %w", ns.server.Host, err)
+		}
+	}
+
+	ns.conn.SetDeadline(connDeadline(ctx, ns.timeout))
+	// The PING is answered once the server has processed the PUB, so a PONG
+	// confirms the publish and any -ERR is reported for it
+	if _, err := fmt.Fprintf(ns.conn, "PUB %s %d\r\n%s\r\nPING\r\n", subject, len(data), data); err != nil {
+		ns.close()
+		return fmt.Errorf("nats: publishing to %s: %w", subject, err)
+	}
+	if err := ns.awaitPong(); err != nil {
+		ns.close()
+		return fmt.Errorf("nats: publishing to %s: %w", subject, err)
+	}
+	return nil
+}
+
+// connect dials the server, upgrading to TLS when the server requires it or
+// the URL's scheme is tls, and authenticates with the URL's credentials
+func (ns *NATSSink) connect(ctx context.Context) error {
+	dialer := &net.Dialer{Timeout: ns.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", ns.server.Host)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(connDeadline(ctx, ns.timeout))
+	reader := bufio.NewReader(conn)
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	var info struct {
+		TLSRequired bool `json:"tls_required"`
+	}
+	if !strings.HasPrefix(line, "INFO ") || json.Unmarshal([]byte(strings.TrimPrefix(line, "INFO ")), &info) != nil {
+		conn.Close()
+		return fmt.Errorf("unexpected greeting %q", strings.TrimSpace(line))
+	}
+
+	if info.TLSRequired || ns.server.Scheme == "tls" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: ns.server.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return err
+		}
+		conn, reader = tlsConn, bufio.NewReader(tlsConn)
+	}
+
+	options := map[string]interface{}{
+		"verbose":  false,
+		"pedantic": false,
+		"name":     "build-service",
+		"lang":     "go",
+		"version":  "1.0.0",
+	}
+	if user := ns.server.User; user != nil {
+		if password, ok := user.Password(); ok {
+			options["user"], options["pass"] = user.Username(), password
+		} else {
+			options["auth_token"] = user.Username()
+		}
+	}
+	connect, _ := json.Marshal(options)
+
+	ns.conn, ns.reader = conn, reader
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\nPING\r\n", connect); err != nil {
+		ns.close()
+		return err
+	}
+	if err := ns.awaitPong(); err != nil {
+		ns.close()
+		return err
+	}
+	return nil
+}
+
+// awaitPong reads until the server's PONG, answering its PINGs on the way
+func (ns *NATSSink) awaitPong() error {
+	for {
+		line, err := ns.reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err := fmt.Fprint(ns.conn, "PONG\r\n"); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("server error: %s", strings.Trim(strings.TrimSpace(strings.TrimPrefix(line, "-ERR")), "'"))
+		}
+	}
+}
+
+func (ns *NATSSink) close() {
+	if ns.conn != nil {
+		ns.conn.Close()
+	}
+	ns.conn, ns.reader = nil, nil
+}
+
+// connDeadline is the earlier of ctx's deadline and timeout from now
+func connDeadline(ctx context.Context, timeout time.Duration) time.Time {
+	d := time.Now().Add(timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(d) {
+		return ctxDeadline
+	}
+	return d
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeNATSServer accepts NATS connections, recording CONNECT options and
+// published messages. Publishing to a subject containing "denied" fails.
+type fakeNATSServer struct {
+	listener net.Listener
+	mu       sync.Mutex
+	connects []string
+	messages map[string]string
+}
+
+func newFakeNATSServer(t *testing.T) *fakeNATSServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := &fakeNATSServer{listener: listener, messages: make(map[string]string)}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+func (fs *fakeNATSServer) serve(conn net.Conn) {
+	defer conn.Close()
+	fmt.Fprint(conn, "INFO {\"server_id\":\"test\",\"auth_required\":true}\r\n")
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		verb, args, _ := strings.Cut(strings.TrimSpace(line), " ")
+		switch verb {
+		case "CONNECT":
+			fs.mu.Lock()
+			fs.connects = append(fs.connects, args)
+			fs.mu.Unlock()
+			if !strings.Contains(args, `"auth_token":"s3cret"`) {
+				fmt.Fprint(conn, "-ERR 'Authorization Violation'\r\n")
+				return
+			}
+			// Servers ping clients too
+			fmt.Fprint(conn, "PING\r\n")
+		case "PUB":
+			fields := strings.Fields(args)
+			size, _ := strconv.Atoi(fields[len(fields)-1])
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(reader, payload); err != nil {
+				return
+			}
+			if strings.Contains(fields[0], "denied") {
+				fmt.Fprint(conn, "-ERR 'Permissions Violation for Publish to \""+fields[0]+"\"'\r\n")
+				return
+			}
+			fs.mu.Lock()
+			fs.messages[fields[0]] = string(payload[:size])
+			fs.mu.Unlock()
+		case "PING":
+			fmt.Fprint(conn, "PONG\r\n")
+		}
+	}
+}
+
+func TestNATSSinkDeliver(t *testing.T) {
+	server := newFakeNATSServer(t)
+	t.Setenv("NATS_URL", "nats://s3cret@"+server.listener.Addr().String())
+	t.Setenv("NATS_SUBJECTS", "acme=acme.builds,*=denied.builds")
+	service, mockDB := setupTestService()
+	sink := NewNATSSinkFromEnv(service.integrations)
+	require.NotNil(t, sink)
+
+	mockDB.On("GetIntegration", "nats").Return(nil, fmt.Errorf("integration not found"))
+	mockDB.On("ResetIntegrationFailures", "nats").Return(nil).Times(3)
+	mockDB.On("RecordIntegrationFailure", "nats", mock.AnythingOfType("string"), 10).
+		Return(&IntegrationState{Name: "nats", ConsecutiveFailures: 1}, nil).Once()
+
+	event := BuildEvent{Build: BuildRequest{ID: 42, ProjectName: "api", GitURL: "git@github.com:acme/api.git", Status: "running"}, Time: time.Now()}
+	require.NoError(t, sink.Deliver(context.Background(), event))
+	event.Build.Status = "success"
+	require.NoError(t, sink.Deliver(context.Background(), event))
+
+	event.Build.GitURL = "https://github.com/globex/api.git"
+	err := sink.Deliver(context.Background(), event)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Permissions Violation")
+
+	// The failed connection is replaced on the next delivery
+	event.Build.GitURL = "git@github.com:acme/api.git"
+	require.NoError(t, sink.Deliver(context.Background(), event))
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	assert.Len(t, server.connects, 2)
+	assert.Contains(t, server.connects[0], `"name":"build-service"`)
+	assert.Contains(t, server.messages["acme.builds.running"], `"status":"running"`)
+	assert.Contains(t, server.messages["acme.builds.success"], `"id":42`)
+	mockDB.AssertExpectations(t)
+}
+
+func TestNATSSinkReportsAuthorizationErrors(t *testing.T) {
+	server := newFakeNATSServer(t)
+	t.Setenv("NATS_URL", "nats://wrong@"+server.listener.Addr().String())
+	t.Setenv("NATS_SUBJECTS", "*=builds")
+	sink := NewNATSSinkFromEnv(nil)
+	require.NotNil(t, sink)
+
+	err := sink.publish(context.Background(), "builds.failed", BuildEvent{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Authorization Violation")
+	assert.Nil(t, sink.conn)
+}
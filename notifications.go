@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Notification policies a project can choose with notify_on
+const (
+	// notifyAlways notifies about every finished build
+	notifyAlways = "always"
+	// notifyOnFailure notifies about failed and timed out builds
+	notifyOnFailure = "on-failure"
+	// notifyOnRecovery notifies about failures and about the first
+	// successful build after one
+	notifyOnRecovery = "on-recovery"
+)
+
+// notificationStatuses are the final build statuses notifications are sent for
+var notificationStatuses = map[string]bool{"success": true, "failed": true, "timeout": true}
+
+const defaultNotificationSubject = `[{{.Build.ProjectName}}] Build #{{.Build.ID}} {{.Outcome}}`
+
+const defaultNotificationText = `Build #{{.Build.ID}} of {{.Build.ProjectName}} {{.Outcome}} on {{.Build.Branch}}{{with .Build.Tag}} ({{.}}){{end}}.
+
+Commit: {{if .Build.CommitSHA}}{{.ShortSHA}}{{else}}branch head{{end}}
+{{- with .Build.Version}}
+Version: {{.}}{{end}}
+{{- with .Build.TriggeredBy}}
+Triggered by: {{.}}{{end}}
+Duration: {{.Duration}}
+{{- if and .Build.ExitCode (ne .Build.Status "success")}}
+Exit code: {{.Build.ExitCode}}{{end}}
+
+{{.URL}}
+`
+
+// Notification describes a finished build to the people watching its project
+type Notification struct {
+	Build   BuildRequest
+	Project *Project
+	// Outcome is "passed", "failed", "timed out" or "recovered", translated
+	// to the sink's locale
+	Outcome  string
+	URL      string
+	Duration time.Duration
+	Subject  string
+	Text     string
+	// Digested holds the recipients that get the build in a digest instead,
+	// keyed by digestKey
+	Digested map[string]bool
+}
+
+// ShortSHA returns the abbreviated commit of the build
+func (n *Notification) ShortSHA() string {
+	if len(n.Build.CommitSHA) > 12 {
+		return n.Build.CommitSHA[:12]
+	}
+	return n.Build.CommitSHA
+}
+
+// Notifier sends notifications through one provider such as Slack or email
+type Notifier interface {
+	Name() string
+	// Enabled reports whether the project has recipients on the provider
+	Enabled(project *Project) bool
+	Notify(ctx context.Context, notification *Notification) error
+}
+
+// shouldNotify applies a project's notification policy to a finished build
+func shouldNotify(policy, status string, recovered bool) bool {
+	switch policy {
+	case notifyAlways:
+		return true
+	case notifyOnFailure:
+		return status != "success"
+	case notifyOnRecovery:
+		return status != "success" || recovered
+	default:
+		return false
+	}
+}
+
+// validateNotifications checks the notification settings of a project
+func validateNotifications(project *Project) error {
+	switch project.NotifyOn {
+	case "", notifyAlways, notifyOnFailure, notifyOnRecovery:
+	default:
+		return fmt.Errorf("notify_on must be one of %s, %s or %s", notifyAlways, notifyOnFailure, notifyOnRecovery)
+	}
+
+	if project.NotifySlackWebhookURL != "" {
+		u, err := url.Parse(project.NotifySlackWebhookURL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return errors.New("notify_slack_webhook_url must be an http(s) URL")
+		}
+	}
+	for _, address := range project.NotifyEmails {
+		if _, err := mail.ParseAddress(address); err != nil {
+			return fmt.Errorf("invalid notify_emails address %q", address)
+		}
+	}
+	return nil
+}
+
+// NotificationSink notifies the people watching a project when its builds
+// finish, through every provider the project has recipients on
+type NotificationSink struct {
+	db        DatabaseInterface
+	health    *IntegrationHealth
+	links     *PublicURLs
+	catalog   *Catalog
+	locale    string
+	notifiers []Notifier
+	subject   *template.Template
+	text      *template.Template
+}
+
+// NewNotificationSinkFromEnv creates the sink with the Slack provider and,
+// when SMTP_HOST is set, the email provider. NOTIFY_SUBJECT_TEMPLATE and
+// NOTIFY_TEXT_TEMPLATE replace the default message templates, which are
+// written in NOTIFY_LOCALE, or DEFAULT_LOCALE when it's unset.
+func NewNotificationSinkFromEnv(db DatabaseInterface, health *IntegrationHealth, links *PublicURLs, catalog *Catalog) *NotificationSink {
+	locale := normalizeLocale(os.Getenv("NOTIFY_LOCALE"))
+	if locale == "" {
+		locale = catalog.Negotiate("")
+	}
+	notifiers := []Notifier{NewSlackWebhookNotifier(os.Getenv("NOTIFY_SLACK_WEBHOOK_URL"))}
+	if email := NewEmailNotifierFromEnv(); email != nil {
+		notifiers = append(notifiers, email)
+	}
+
+	return &NotificationSink{
+		db:        db,
+		health:    health,
+		links:     links,
+		catalog:   catalog,
+		locale:    locale,
+		notifiers: notifiers,
+		subject:   notificationTemplate("subject", os.Getenv("NOTIFY_SUBJECT_TEMPLATE"), catalog.Text(locale, "notification.subject", defaultNotificationSubject)),
+		text:      notificationTemplate("text", os.Getenv("NOTIFY_TEXT_TEMPLATE"), catalog.Text(locale, "notification.text", defaultNotificationText)),
+	}
+}
+
+// notificationTemplate parses a configured template, falling back to the
+// default when it is unset or invalid
+func notificationTemplate(name, text, fallback string) *template.Template {
+	if text != "" {
+		tmpl, err := template.New(name).Parse(text)
+		if err == nil {
+			return tmpl
+		}
+		log.Printf("Invalid notification %s template, using the default: %v", name, err)
+	}
+	return template.Must(template.New(name).Parse(fallback))
+}
+
+// Name identifies the integration
+func (ns *NotificationSink) Name() string {
+	return "notifications"
+}
+
+// Deliver notifies about finished builds of projects whose notify_on policy
+// asks for it. Each provider is tracked as its own integration.
+func (ns *NotificationSink) Deliver(ctx context.Context, event BuildEvent) error {
+	build := event.Build
+	if !notificationStatuses[build.Status] {
+		return nil
+	}
+
+	project, err := ns.db.GetProjectByName(build.ProjectName)
+	if err != nil {
+		if err.Error() == "project not found" {
+			return nil
+		}
+		return fmt.Errorf("loading project: %w", err)
+	}
+	if project.NotifyOn == "" {
+		return nil
+	}
+
+	var notifiers []Notifier
+	for _, notifier := range ns.notifiers {
+		if notifier.Enabled(project) {
+			notifiers = append(notifiers, notifier)
+		}
+	}
+	if len(notifiers) == 0 {
+		return nil
+	}
+
+	recovered := false
+	if build.Status == "success" && project.NotifyOn == notifyOnRecovery {
+		previous, err := ns.db.GetPreviousFinishedBuild(build.ProjectName, build.Branch, build.ID)
+		if err != nil && err.Error() != "build not found" {
+			return fmt.Errorf("loading previous build: %w", err)
+		}
+		recovered = previous != nil && previous.Status != "success"
+	}
+	if !shouldNotify(project.NotifyOn, build.Status, recovered) {
+		return nil
+	}
+
+	notification, err := ns.render(&build, project, recovered)
+	if err != nil {
+		return err
+	}
+	if notification.Digested, err = ns.digestRecipients(&build); err != nil {
+		return fmt.Errorf("loading digests: %w", err)
+	}
+
+	var errs []error
+	for _, notifier := range notifiers {
+		if !ns.health.Allow(notifier.Name()) {
+			continue
+		}
+
+		err := notifier.Notify(ctx, notification)
+		if err != nil {
+			err = fmt.Errorf("%s: %w", notifier.Name(), err)
+			errs = append(errs, err)
+		}
+		ns.health.Record(notifier.Name(), err, &build)
+	}
+	return errors.Join(errs...)
+}
+
+// render fills in the notification's subject and text from the templates
+func (ns *NotificationSink) render(build *BuildRequest, project *Project, recovered bool) (*Notification, error) {
+	notification := &Notification{
+		Build:   *build,
+		Project: project,
+		URL:     ns.links.BuildURL(build),
+	}
+	switch {
+	case recovered:
+		notification.Outcome = "recovered"
+	case build.Status == "success":
+		notification.Outcome = "passed"
+	case build.Status == "timeout":
+		notification.Outcome = "timed out"
+	default:
+		notification.Outcome = "failed"
+	}
+	notification.Outcome = ns.catalog.Translate(ns.locale, notification.Outcome)
+	if build.StartedAt != nil {
+		notification.Duration = build.UpdatedAt.Sub(*build.StartedAt).Round(time.Second)
+	}
+
+	var subject, text bytes.Buffer
+	if err := ns.subject.Execute(&subject, notification); err != nil {
+		return nil, fmt.Errorf("rendering notification subject: %w", err)
+	}
+	if err := ns.text.Execute(&text, notification); err != nil {
+		return nil, fmt.Errorf("rendering notification text: %w", err)
+	}
+	// The subject becomes an email header, so it must be a single line
+	notification.Subject = strings.Join(strings.Fields(subject.String()), " ")
+	notification.Text = text.String()
+	return notification, nil
+}
+
+// SlackWebhookNotifier posts notifications to Slack incoming webhooks
+type SlackWebhookNotifier struct {
+	// DefaultURL is used for projects without a webhook of their own
+	DefaultURL string
+	client     *http.Client
+}
+
+// NewSlackWebhookNotifier creates a Slack notifier posting to defaultURL
+// unless a project sets notify_slack_webhook_url
+func NewSlackWebhookNotifier(defaultURL string) *SlackWebhookNotifier {
+	return &SlackWebhookNotifier{
+		DefaultURL: defaultURL,
+		client:     &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Name identifies the integration
+func (sw *SlackWebhookNotifier) Name() string {
+	return "slack-webhook"
+}
+
+// Enabled reports whether there is a webhook to post the project's
+// notifications to
+func (sw *SlackWebhookNotifier) Enabled(project *Project) bool {
+	return sw.webhookURL(project) != ""
+}
+
+func (sw *SlackWebhookNotifier) webhookURL(project *Project) string {
+	if project.NotifySlackWebhookURL != "" {
+		return project.NotifySlackWebhookURL
+	}
+	return sw.DefaultURL
+}
+
+// Notify posts the notification with its subject in bold, unless the
+// channel gets the build in a digest
+func (sw *SlackWebhookNotifier) Notify(ctx context.Context, notification *Notification) error {
+	webhookURL := sw.webhookURL(notification.Project)
+	if notification.Digested[digestKey(digestSlack, webhookURL)] {
+		return nil
+	}
+
+	body, _ := json.Marshal(map[string]string{
+		"text": fmt.Sprintf("*%s*\n%s", notification.Subject, notification.Text),
+	})
+
+	req, err := http.NewRequestWithContext(ctx, "POST", webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := sw.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// EmailNotifier sends notifications by email through an SMTP relay
+type EmailNotifier struct {
+	addr string
+	from string
+	auth smtp.Auth
+	// send is smtp.SendMail, replaced in tests
+	send func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+}
+
+// NewEmailNotifierFromEnv returns an email notifier when SMTP_HOST is set, otherwise nil
+func NewEmailNotifierFromEnv() *EmailNotifier {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		return nil
+	}
+
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+	from := os.Getenv("SMTP_FROM")
+	if from == "" {
+		from = "build-service@localhost"
+	}
+
+	notifier := &EmailNotifier{
+		addr: net.JoinHostPort(host, port),
+		from: from,
+		send: smtp.SendMail,
+	}
+	if username := os.Getenv("SMTP_USERNAME"); username != "" {
+		notifier.auth = smtp.PlainAuth("", username, os.Getenv("SMTP_PASSWORD"), host)
+	}
+	return notifier
+}
+
+// Name identifies the integration
+func (en *EmailNotifier) Name() string {
+	return "email"
+}
+
+// Enabled reports whether the project has email recipients
+func (en *EmailNotifier) Enabled(project *Project) bool {
+	return len(project.NotifyEmails) > 0
+}
+
+// Notify emails the notification to the project's recipients, except those
+// who get the build in a digest
+func (en *EmailNotifier) Notify(ctx context.Context, notification *Notification) error {
+	var to []string
+	for _, address := range notification.Project.NotifyEmails {
+		if !notification.Digested[digestKey(digestEmail, address)] {
+			to = append(to, address)
+		}
+	}
+	if len(to) == 0 {
+		return nil
+	}
+	return en.send(en.addr, en.auth, en.from, to, emailMessage(en.from, to, notification.Subject, notification.Text, time.Now()))
+}
+
+// emailMessage formats a plain text email
+func emailMessage(from string, to []string, subject, text string, date time.Time) []byte {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("\r\n")
+	msg.WriteString(strings.ReplaceAll(strings.ReplaceAll(text, "\r\n", "\n"), "\n", "\r\n"))
+	return msg.Bytes()
+}
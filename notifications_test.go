@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShouldNotify(t *testing.T) {
+	tests := []struct {
+		policy    string
+		status    string
+		recovered bool
+		expected  bool
+	}{
+		{policy: "", status: "failed", expected: false},
+		{policy: notifyAlways, status: "success", expected: true},
+		{policy: notifyAlways, status: "failed", expected: true},
+		{policy: notifyOnFailure, status: "success", recovered: true, expected: false},
+		{policy: notifyOnFailure, status: "failed", expected: true},
+		{policy: notifyOnFailure, status: "timeout", expected: true},
+		{policy: notifyOnRecovery, status: "success", expected: false},
+		{policy: notifyOnRecovery, status: "success", recovered: true, expected: true},
+		{policy: notifyOnRecovery, status: "failed", expected: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %s recovered=%v", tt.policy, tt.status, tt.recovered), func(t *testing.T) {
+			assert.Equal(t, tt.expected, shouldNotify(tt.policy, tt.status, tt.recovered))
+		})
+	}
+}
+
+func TestValidateNotifications(t *testing.T) {
+	assert.NoError(t, validateNotifications(&Project{}))
+	assert.NoError(t, validateNotifications(&Project{
+		NotifyOn:              notifyOnRecovery,
+		NotifySlackWebhookURL: "https://hooks.slack.com/services/T0/B0/x",
+		NotifyEmails:          []string{"team@example.com", "Jane <jane@example.com>"},
+	}))
+
+	assert.Error(t, validateNotifications(&Project{NotifyOn: "sometimes"}))
+	assert.Error(t, validateNotifications(&Project{NotifySlackWebhookURL: "ftp://hooks.example.com"}))
+	assert.Error(t, validateNotifications(&Project{NotifyEmails: []string{"not an address"}}))
+}
+
+// fakeNotifier records the notifications it is asked to send
+type fakeNotifier struct {
+	name     string
+	enabled  bool
+	err      error
+	notified []*Notification
+}
+
+func (fn *fakeNotifier) Name() string                  { return fn.name }
+func (fn *fakeNotifier) Enabled(project *Project) bool { return fn.enabled }
+
+func (fn *fakeNotifier) Notify(ctx context.Context, notification *Notification) error {
+	fn.notified = append(fn.notified, notification)
+	return fn.err
+}
+
+func newTestNotificationSink(notifiers ...Notifier) (*NotificationSink, *MockDatabase) {
+	service, _ := setupTestService()
+	mockDB := new(MockDatabase)
+	sink := NewNotificationSinkFromEnv(mockDB, NewIntegrationHealth(mockDB, service.errors, &service.metrics.Integrations), service.links, service.catalog)
+	sink.notifiers = notifiers
+	return sink, mockDB
+}
+
+func TestNotificationSinkDeliver(t *testing.T) {
+	slack := &fakeNotifier{name: "slack-webhook", enabled: true}
+	email := &fakeNotifier{name: "email", enabled: true, err: fmt.Errorf("relay unavailable")}
+	off := &fakeNotifier{name: "off"}
+	sink, mockDB := newTestNotificationSink(slack, email, off)
+
+	mockDB.On("GetProjectByName", "api").Return(&Project{Name: "api", NotifyOn: notifyOnRecovery}, nil)
+	mockDB.On("GetPreviousFinishedBuild", "api", "main", 12).Return(&BuildRequest{ID: 11, Status: "failed"}, nil).Once()
+	mockDB.On("GetIntegration", mock.AnythingOfType("string")).Return(nil, fmt.Errorf("integration not found"))
+	mockDB.On("ResetIntegrationFailures", "slack-webhook").Return(nil).Once()
+	mockDB.On("RecordIntegrationFailure", "email", mock.AnythingOfType("string"), 10).Return(&IntegrationState{Name: "email", ConsecutiveFailures: 1}, nil).Once()
+	mockDB.On("ListNotificationDigests").Return([]*NotificationDigest{}, nil).Once()
+
+	started := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	exitCode := 0
+	err := sink.Deliver(context.Background(), BuildEvent{Build: BuildRequest{
+		ID:          12,
+		ProjectName: "api",
+		Branch:      "main",
+		CommitSHA:   "0123456789abcdef0123456789abcdef01234567",
+		TriggeredBy: "jane",
+		Status:      "success",
+		ExitCode:    &exitCode,
+		StartedAt:   &started,
+		UpdatedAt:   started.Add(95 * time.Second),
+	}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "email: relay unavailable")
+
+	require.Len(t, slack.notified, 1)
+	assert.Empty(t, off.notified)
+	notification := slack.notified[0]
+	assert.Equal(t, "recovered", notification.Outcome)
+	assert.Equal(t, 95*time.Second, notification.Duration)
+	assert.Equal(t, "[api] Build #12 recovered", notification.Subject)
+	assert.Contains(t, notification.Text, "Build #12 of api recovered on main.")
+	assert.Contains(t, notification.Text, "Commit: 0123456789ab")
+	assert.Contains(t, notification.Text, "Triggered by: jane")
+	assert.Contains(t, notification.Text, "Duration: 1m35s")
+	assert.Contains(t, notification.Text, buildURL(12))
+	assert.NotContains(t, notification.Text, "Exit code")
+	mockDB.AssertExpectations(t)
+}
+
+func TestNotificationSinkSkipsUnwantedBuilds(t *testing.T) {
+	notifier := &fakeNotifier{name: "slack-webhook", enabled: true}
+	sink, mockDB := newTestNotificationSink(notifier)
+
+	mockDB.On("GetProjectByName", "quiet").Return(&Project{Name: "quiet"}, nil)
+	mockDB.On("GetProjectByName", "unregistered").Return(nil, fmt.Errorf("project not found"))
+	mockDB.On("GetProjectByName", "api").Return(&Project{Name: "api", NotifyOn: notifyOnFailure}, nil)
+
+	for _, build := range []BuildRequest{
+		{ID: 1, ProjectName: "api", Status: "running"},
+		{ID: 2, ProjectName: "quiet", Status: "failed"},
+		{ID: 3, ProjectName: "unregistered", Status: "failed"},
+		{ID: 4, ProjectName: "api", Status: "success"},
+	} {
+		require.NoError(t, sink.Deliver(context.Background(), BuildEvent{Build: build}))
+	}
+	assert.Empty(t, notifier.notified)
+	mockDB.AssertNotCalled(t, "GetPreviousFinishedBuild", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestNotificationSinkCustomTemplate(t *testing.T) {
+	t.Setenv("NOTIFY_SUBJECT_TEMPLATE", "{{.Build.ProjectName}}\n{{.Outcome}}")
+	t.Setenv("NOTIFY_TEXT_TEMPLATE", "{{.Outcome}} after {{.Duration}}: {{.URL}}")
+	notifier := &fakeNotifier{name: "slack-webhook", enabled: true}
+	sink, mockDB := newTestNotificationSink(notifier)
+
+	mockDB.On("GetProjectByName", "api").Return(&Project{Name: "api", NotifyOn: notifyAlways}, nil)
+	mockDB.On("GetIntegration", "slack-webhook").Return(nil, fmt.Errorf("integration not found"))
+	mockDB.On("ResetIntegrationFailures", "slack-webhook").Return(nil)
+	mockDB.On("ListNotificationDigests").Return([]*NotificationDigest{}, nil)
+
+	exitCode := -1
+	require.NoError(t, sink.Deliver(context.Background(), BuildEvent{Build: BuildRequest{ID: 5, ProjectName: "api", Status: "timeout", ExitCode: &exitCode}}))
+
+	require.Len(t, notifier.notified, 1)
+	assert.Equal(t, "api timed out", notifier.notified[0].Subject)
+	assert.Equal(t, "timed out after 0s: "+buildURL(5), notifier.notified[0].Text)
+}
+
+func TestNotificationTemplateFallsBackOnInvalidTemplate(t *testing.T) {
+	tmpl := notificationTemplate("subject", "{{.Build", defaultNotificationSubject)
+	var out strings.Builder
+	require.NoError(t, tmpl.Execute(&out, &Notification{Build: BuildRequest{ID: 1, ProjectName: "api"}, Outcome: "failed"}))
+	assert.Equal(t, "[api] Build #1 failed", out.String())
+}
+
+func TestSlackWebhookNotifier(t *testing.T) {
+	var received []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]string
+		json.NewDecoder(r.Body).Decode(&payload)
+		received = append(received, r.URL.Path+" "+payload["text"])
+		if r.URL.Path == "/broken" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer server.Close()
+
+	notifier := NewSlackWebhookNotifier(server.URL + "/default")
+	assert.True(t, notifier.Enabled(&Project{}))
+	assert.False(t, NewSlackWebhookNotifier("").Enabled(&Project{}))
+
+	notification := &Notification{Project: &Project{}, Subject: "[api] Build #1 failed", Text: "details"}
+	require.NoError(t, notifier.Notify(context.Background(), notification))
+
+	notification.Project = &Project{NotifySlackWebhookURL: server.URL + "/broken"}
+	err := notifier.Notify(context.Background(), notification)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unexpected status 403")
+
+	assert.Equal(t, []string{"/default *[api] Build #1 failed*\ndetails", "/broken *[api] Build #1 failed*\ndetails"}, received)
+}
+
+func TestEmailNotifier(t *testing.T) {
+	t.Setenv("SMTP_HOST", "smtp.example.com")
+	t.Setenv("SMTP_USERNAME", "ci")
+	t.Setenv("SMTP_FROM", "ci@example.com")
+	notifier := NewEmailNotifierFromEnv()
+	require.NotNil(t, notifier)
+	assert.Equal(t, "smtp.example.com:587", notifier.addr)
+	assert.NotNil(t, notifier.auth)
+
+	var sentTo []string
+	var sent string
+	notifier.send = func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		sentTo, sent = to, string(msg)
+		return nil
+	}
+
+	project := &Project{NotifyEmails: []string{"a@example.com", "b@example.com"}}
+	assert.True(t, notifier.Enabled(project))
+	assert.False(t, notifier.Enabled(&Project{}))
+
+	require.NoError(t, notifier.Notify(context.Background(), &Notification{Project: project, Subject: "[api] Build #1 failed", Text: "line 1\nline 2\n"}))
+	assert.Equal(t, project.NotifyEmails, sentTo)
+	assert.Contains(t, sent, "From: ci@example.com\r\n")
+	assert.Contains(t, sent, "To: a@example.com, b@example.com\r\n")
+	assert.Contains(t, sent, "Subject: [api] Build #1 failed\r\n")
+	assert.True(t, strings.HasSuffix(sent, "\r\n\r\nline 1\r\nline 2\r\n"))
+}
+
+func TestNewEmailNotifierFromEnvDisabled(t *testing.T) {
+	t.Setenv("SMTP_HOST", "")
+	assert.Nil(t, NewEmailNotifierFromEnv())
+}
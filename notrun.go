@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// Reasons a build was never run, recorded as its skip_reason
+const (
+	// skipCommitDirective is for skipped builds of commits asking not to be
+	// built
+	skipCommitDirective = "commit_directive"
+	// skipDependencyFailed is for blocked builds depending on a build that
+	// won't succeed
+	skipDependencyFailed = "dependency_failed"
+)
+
+// recordNotRun counts a skipped or blocked build
+func (bs *BuildService) recordNotRun(build *BuildRequest) {
+	bs.metrics.BuildsTotal.WithLabelValues(build.Status).Inc()
+	bs.metrics.BuildsNotRun.WithLabelValues(build.Status, build.SkipReason).Inc()
+}
+
+// blockDownstream blocks the builds waiting on a build that finished without
+// succeeding, which would otherwise stay queued until they expire
+func (bs *BuildService) blockDownstream(build *BuildRequest) {
+	if build.Status == "success" {
+		return
+	}
+	blocked, err := bs.db.BlockDownstreamBuilds(build.ID)
+	if err != nil {
+		bs.errors.Capture("queue", fmt.Errorf("blocking downstream builds: %w", err), build)
+		return
+	}
+	if len(blocked) > 0 {
+		log.Printf("Blocked %d build(s) waiting on build %d, which is %s", len(blocked), build.ID, build.Status)
+	}
+	for _, downstream := range blocked {
+		bs.recordNotRun(downstream)
+		bs.events.Publish(downstream)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestBlockDownstream(t *testing.T) {
+	service, mockDB := setupTestService()
+	// Replace the default that blocks nothing
+	mockDB.ExpectedCalls = nil
+	mockDB.On("ListWebhookSubscriptions").Return([]*WebhookSubscription{}, nil).Maybe()
+	mockDB.On("ListOrganizations").Return([]*Organization{}, nil).Maybe()
+	mockDB.On("GetProjectByName", mock.Anything).Return(nil, fmt.Errorf("project not found")).Maybe()
+	events, unsubscribe := service.events.Subscribe(4)
+	defer unsubscribe()
+
+	mockDB.On("BlockDownstreamBuilds", 1).Return([]*BuildRequest{
+		{ID: 2, ProjectName: "web", Status: "blocked", SkipReason: skipDependencyFailed, DependsOn: []int{1}},
+		{ID: 3, ProjectName: "e2e", Status: "blocked", SkipReason: skipDependencyFailed, DependsOn: []int{2}},
+	}, nil).Once()
+	service.blockDownstream(&BuildRequest{ID: 1, ProjectName: "api", Status: "failed"})
+
+	for _, id := range []int{2, 3} {
+		select {
+		case event := <-events:
+			assert.Equal(t, id, event.Build.ID)
+			assert.Equal(t, "blocked", event.Build.Status)
+		case <-time.After(time.Second):
+			t.Fatalf("no event published for blocked build %d", id)
+		}
+	}
+	assert.Equal(t, 2.0, testutil.ToFloat64(service.metrics.BuildsNotRun.WithLabelValues("blocked", skipDependencyFailed)))
+	assert.Equal(t, 2.0, testutil.ToFloat64(service.metrics.BuildsTotal.WithLabelValues("blocked")))
+
+	// Successful builds unblock their dependents instead
+	service.blockDownstream(&BuildRequest{ID: 4, Status: "success"})
+
+	mockDB.On("BlockDownstreamBuilds", 5).Return(nil, fmt.Errorf("connection refused")).Once()
+	service.blockDownstream(&BuildRequest{ID: 5, Status: "cancelled"})
+	assert.Equal(t, 1.0, testutil.ToFloat64(service.metrics.BackgroundErrors.WithLabelValues("queue")))
+	mockDB.AssertExpectations(t)
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errInvalidToken is wrapped by the errors of tokens that fail verification,
+// as opposed to failures fetching the issuer's keys
+var errInvalidToken = errors.New("invalid token")
+
+// oidcClockSkew is how far token timestamps may be off from the service's
+// clock
+const oidcClockSkew = time.Minute
+
+// oidcMinRefresh limits how often an unknown key ID makes the verifier fetch
+// the issuer's keys again
+const oidcMinRefresh = time.Minute
+
+// OIDCVerifier authenticates requests with bearer JWTs issued by an OpenID
+// Connect provider, so users can sign in through corporate SSO instead of
+// using API keys. The provider's signing keys are fetched from its JWKS and
+// cached; a token signed with a key that isn't cached yet fetches them again,
+// so rotated keys are picked up.
+type OIDCVerifier struct {
+	Issuer   string
+	Audience string
+	// JWKSURL is found through the issuer's discovery document when empty
+	JWKSURL string
+	// Claims mapped onto the tenant, as dotted paths into the token's claims
+	// such as realm_access.roles. Tokens need the org claim unless OrgClaim
+	// is empty, and grant admin access when their roles include AdminRole.
+	UserClaim  string
+	OrgClaim   string
+	RolesClaim string
+	AdminRole  string
+	cacheTTL   time.Duration
+	client     *http.Client
+	now        func() time.Time
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+// NewOIDCVerifierFromEnv creates a verifier from the OIDC_* environment
+// variables, or returns nil when OIDC_ISSUER is unset
+func NewOIDCVerifierFromEnv() (*OIDCVerifier, error) {
+	issuer := strings.TrimSuffix(os.Getenv("OIDC_ISSUER"), "/")
+	if issuer == "" {
+		return nil, nil
+	}
+	audience := os.Getenv("OIDC_AUDIENCE")
+	if audience == "" {
+		return nil, fmt.Errorf("OIDC_AUDIENCE is required with OIDC_ISSUER")
+	}
+
+	verifier := &OIDCVerifier{
+		Issuer:     issuer,
+		Audience:   audience,
+		JWKSURL:    os.Getenv("OIDC_JWKS_URL"),
+		UserClaim:  os.Getenv("OIDC_USER_CLAIM"),
+		OrgClaim:   os.Getenv("OIDC_ORG_CLAIM"),
+		RolesClaim: os.Getenv("OIDC_ROLES_CLAIM"),
+		AdminRole:  os.Getenv("OIDC_ADMIN_ROLE"),
+		cacheTTL:   getEnvDuration("OIDC_JWKS_CACHE_TTL", time.Hour),
+		client:     &http.Client{Timeout: 10 * time.Second},
+		now:        time.Now,
+	}
+	if verifier.UserClaim == "" {
+		verifier.UserClaim = "email"
+	}
+	// OIDC_ORG_CLAIM may be set empty on purpose, for tokens that see every org
+	if _, set := os.LookupEnv("OIDC_ORG_CLAIM"); !set {
+		verifier.OrgClaim = "org"
+	}
+	if verifier.RolesClaim == "" {
+		verifier.RolesClaim = "roles"
+	}
+	return verifier, nil
+}
+
+// looksLikeJWT reports whether a bearer token is a compact JWS rather than an
+// API key or the admin token
+func looksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2 && strings.HasPrefix(token, "eyJ")
+}
+
+// OIDCIdentity is who a verified token was issued to
+type OIDCIdentity struct {
+	User  string
+	Org   string
+	Admin bool
+}
+
+// jwtHeader is the part of a token's header used to verify it
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// Verify checks a token's signature, issuer, audience and lifetime and maps
+// its claims onto an identity
+func (ov *OIDCVerifier) Verify(ctx context.Context, token string) (*OIDCIdentity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed token", errInvalidToken)
+	}
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed signature", errInvalidToken)
+	}
+
+	key, err := ov.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyJWTSignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if err := ov.checkClaims(claims); err != nil {
+		return nil, err
+	}
+
+	identity := &OIDCIdentity{User: claimString(claims, ov.UserClaim)}
+	if identity.User == "" {
+		identity.User = claimString(claims, "sub")
+	}
+	if ov.AdminRole != "" {
+		for _, role := range claimStrings(claims, ov.RolesClaim) {
+			identity.Admin = identity.Admin || role == ov.AdminRole
+		}
+	}
+	if ov.OrgClaim != "" && !identity.Admin {
+		identity.Org = strings.ToLower(claimString(claims, ov.OrgClaim))
+		if identity.Org == "" {
+			return nil, fmt.Errorf("%w: no %s claim", errInvalidToken, ov.OrgClaim)
+		}
+	}
+	return identity, nil
+}
+
+// checkClaims checks the registered claims of a token
+func (ov *OIDCVerifier) checkClaims(claims map[string]interface{}) error {
+	if claimString(claims, "iss") != ov.Issuer {
+		return fmt.Errorf("%w: issued by %q", errInvalidToken, claimString(claims, "iss"))
+	}
+	audience := claimStrings(claims, "aud")
+	found := false
+	for _, aud := range audience {
+		found = found || aud == ov.Audience
+	}
+	if !found {
+		return fmt.Errorf("%w: not issued for %s", errInvalidToken, ov.Audience)
+	}
+
+	now := ov.now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return fmt.Errorf("%w: no expiry", errInvalidToken)
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(oidcClockSkew)) {
+		return fmt.Errorf("%w: expired", errInvalidToken)
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(oidcClockSkew).Before(time.Unix(int64(nbf), 0)) {
+		return fmt.Errorf("%w: not valid yet", errInvalidToken)
+	}
+	return nil
+}
+
+// claim looks up a dotted path into a token's claims
+func claim(claims map[string]interface{}, path string) interface{} {
+	var value interface{} = claims
+	for _, name := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[name]
+	}
+	return value
+}
+
+func claimString(claims map[string]interface{}, path string) string {
+	value, _ := claim(claims, path).(string)
+	return value
+}
+
+// claimStrings returns a claim that may be a single string or an array of
+// them, such as aud
+func claimStrings(claims map[string]interface{}, path string) []string {
+	switch value := claim(claims, path).(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		values := []string{}
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("%w: malformed token", errInvalidToken)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%w: malformed token", errInvalidToken)
+	}
+	return nil
+}
+
+// jwtHashes are the digests of the supported signature algorithms
+var jwtHashes = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+}
+
+// verifyJWTSignature checks a signature made with the asymmetric algorithm
+// the header names. Symmetric algorithms and "none" are refused, so a token
+// can't be signed with the public key or not at all.
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	hash, ok := jwtHashes[alg]
+	if !ok {
+		return fmt.Errorf("%w: unsupported algorithm %q", errInvalidToken, alg)
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if strings.HasPrefix(alg, "RS") && rsa.VerifyPKCS1v15(key, hash, digest, signature) == nil {
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if strings.HasPrefix(alg, "ES") && len(signature) == 2*size {
+			r := new(big.Int).SetBytes(signature[:size])
+			s := new(big.Int).SetBytes(signature[size:])
+			if ecdsa.Verify(key, digest, r, s) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%w: bad signature", errInvalidToken)
+}
+
+// key returns the issuer's signing key with the given ID, fetching the
+// issuer's keys when they're stale or don't include it
+func (ov *OIDCVerifier) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	ov.mu.Lock()
+	defer ov.mu.Unlock()
+
+	age := ov.now().Sub(ov.fetched)
+	key, found := ov.keys[kid]
+	if found && age < ov.cacheTTL {
+		return key, nil
+	}
+	if ov.keys != nil && !found && age < oidcMinRefresh {
+		return nil, fmt.Errorf("%w: unknown key %q", errInvalidToken, kid)
+	}
+
+	keys, err := ov.fetchKeys(ctx)
+	if err != nil {
+		if found {
+			// Keep using cached keys while the issuer is unreachable
+			log.Printf("Error refreshing OIDC signing keys, using cached keys: %v", err)
+			return key, nil
+		}
+		return nil, fmt.Errorf("fetching OIDC signing keys: %w", err)
+	}
+	ov.keys, ov.fetched = keys, ov.now()
+	if key, found = keys[kid]; !found {
+		return nil, fmt.Errorf("%w: unknown key %q", errInvalidToken, kid)
+	}
+	return key, nil
+}
+
+// jsonWebKey is a public key in a JWKS
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// fetchKeys downloads the issuer's signing keys by key ID, skipping keys of
+// unsupported types
+func (ov *OIDCVerifier) fetchKeys(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	if ov.JWKSURL == "" {
+		var discovery struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := ov.getJSON(ctx, ov.Issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+			return nil, err
+		}
+		if discovery.JWKSURI == "" {
+			return nil, fmt.Errorf("discovery document of %s has no jwks_uri", ov.Issuer)
+		}
+		ov.JWKSURL = discovery.JWKSURI
+	}
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := ov.getJSON(ctx, ov.JWKSURL, &jwks); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		if key := jwk.publicKey(); key != nil {
+			keys[jwk.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+func (ov *OIDCVerifier) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := ov.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("GET %s: status %d: %s", url, resp.StatusCode, body)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// publicKey decodes an RSA or NIST curve key, or returns nil
+func (jwk jsonWebKey) publicKey() crypto.PublicKey {
+	decode := func(s string) *big.Int {
+		data, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(data) == 0 {
+			return nil
+		}
+		return new(big.Int).SetBytes(data)
+	}
+
+	switch jwk.Kty {
+	case "RSA":
+		n, e := decode(jwk.N), decode(jwk.E)
+		if n == nil || e == nil || !e.IsInt64() {
+			return nil
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384()}
+		curve, x, y := curves[jwk.Crv], decode(jwk.X), decode(jwk.Y)
+		if curve == nil || x == nil || y == nil || !curve.IsOnCurve(x, y) {
+			return nil
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+	}
+	return nil
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testIssuer serves a discovery document and JWKS for the keys it signs with
+type testIssuer struct {
+	server  *httptest.Server
+	keys    map[string]crypto.Signer
+	fetches atomic.Int32
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	issuer := &testIssuer{keys: map[string]crypto.Signer{"rsa-1": rsaKey, "ec-1": ecKey}}
+
+	encode := func(n *big.Int) string { return base64.RawURLEncoding.EncodeToString(n.Bytes()) }
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"issuer": issuer.server.URL, "jwks_uri": issuer.server.URL + "/jwks"})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		issuer.fetches.Add(1)
+		keys := []map[string]string{}
+		for kid, key := range issuer.keys {
+			switch pub := key.Public().(type) {
+			case *rsa.PublicKey:
+				keys = append(keys, map[string]string{"kid": kid, "kty": "RSA", "use": "sig", "n": encode(pub.N), "e": encode(big.NewInt(int64(pub.E)))})
+			case *ecdsa.PublicKey:
+				keys = append(keys, map[string]string{"kid": kid, "kty": "EC", "crv": "P-256", "x": encode(pub.X), "y": encode(pub.Y)})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	})
+	issuer.server = httptest.NewServer(mux)
+	t.Cleanup(issuer.server.Close)
+	return issuer
+}
+
+// token signs claims with the named key, defaulting iss, aud and exp
+func (ti *testIssuer) token(t *testing.T, kid string, claims map[string]interface{}) string {
+	full := map[string]interface{}{"iss": ti.server.URL, "aud": "builds", "exp": time.Now().Add(time.Hour).Unix()}
+	for name, value := range claims {
+		full[name] = value
+	}
+	key := ti.keys[kid]
+	alg := "RS256"
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		alg = "ES256"
+	}
+	return signTestJWT(t, alg, kid, key, full)
+}
+
+func signTestJWT(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	part := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		require.NoError(t, err)
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := part(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"}) + "." + part(claims)
+	digest := crypto.SHA256.New()
+	digest.Write([]byte(signed))
+
+	var signature []byte
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest.Sum(nil))
+		require.NoError(t, err)
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest.Sum(nil))
+		require.NoError(t, err)
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func newTestVerifier(t *testing.T, issuer *testIssuer) *OIDCVerifier {
+	t.Setenv("OIDC_ISSUER", issuer.server.URL)
+	t.Setenv("OIDC_AUDIENCE", "builds")
+	t.Setenv("OIDC_ROLES_CLAIM", "realm_access.roles")
+	t.Setenv("OIDC_ADMIN_ROLE", "build-admin")
+	verifier, err := NewOIDCVerifierFromEnv()
+	require.NoError(t, err)
+	return verifier
+}
+
+func TestNewOIDCVerifierFromEnv(t *testing.T) {
+	verifier, err := NewOIDCVerifierFromEnv()
+	assert.NoError(t, err)
+	assert.Nil(t, verifier)
+
+	t.Setenv("OIDC_ISSUER", "https://sso.example.com/")
+	_, err = NewOIDCVerifierFromEnv()
+	assert.EqualError(t, err, "OIDC_AUDIENCE is required with OIDC_ISSUER")
+
+	t.Setenv("OIDC_AUDIENCE", "builds")
+	verifier, err = NewOIDCVerifierFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, "https://sso.example.com", verifier.Issuer)
+	assert.Equal(t, "email", verifier.UserClaim)
+	assert.Equal(t, "org", verifier.OrgClaim)
+	assert.Equal(t, "roles", verifier.RolesClaim)
+
+	t.Setenv("OIDC_ORG_CLAIM", "")
+	verifier, err = NewOIDCVerifierFromEnv()
+	require.NoError(t, err)
+	assert.Empty(t, verifier.OrgClaim)
+}
+
+func TestOIDCVerifierVerify(t *testing.T) {
+	issuer := newTestIssuer(t)
+	verifier := newTestVerifier(t, issuer)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	expired := time.Now().Add(-5 * time.Minute).Unix()
+
+	for _, tt := range []struct {
+		name     string
+		token    string
+		identity *OIDCIdentity
+		err      string
+	}{
+		{"rsa", issuer.token(t, "rsa-1", map[string]interface{}{"sub": "u1", "email": "ada@acme.com", "org": "Acme"}),
+			&OIDCIdentity{User: "ada@acme.com", Org: "acme"}, ""},
+		{"ecdsa with audience list", issuer.token(t, "ec-1", map[string]interface{}{"sub": "u2", "org": "acme", "aud": []string{"other", "builds"}}),
+			&OIDCIdentity{User: "u2", Org: "acme"}, ""},
+		{"admin role", issuer.token(t, "rsa-1", map[string]interface{}{"sub": "u3", "realm_access": map[string]interface{}{"roles": []string{"dev", "build-admin"}}}),
+			&OIDCIdentity{User: "u3", Admin: true}, ""},
+		{"no org", issuer.token(t, "rsa-1", map[string]interface{}{"sub": "u4"}), nil, "invalid token: no org claim"},
+		{"expired", issuer.token(t, "rsa-1", map[string]interface{}{"org": "acme", "exp": expired}), nil, "invalid token: expired"},
+		{"not yet valid", issuer.token(t, "rsa-1", map[string]interface{}{"org": "acme", "nbf": time.Now().Add(time.Hour).Unix()}), nil, "invalid token: not valid yet"},
+		{"other audience", issuer.token(t, "rsa-1", map[string]interface{}{"org": "acme", "aud": "other"}), nil, "invalid token: not issued for builds"},
+		{"other issuer", issuer.token(t, "rsa-1", map[string]interface{}{"org": "acme", "iss": "https://evil.example.com"}), nil, `invalid token: issued by "https://evil.example.com"`},
+		{"forged signature", signTestJWT(t, "RS256", "rsa-1", otherKey, map[string]interface{}{"iss": issuer.server.URL, "aud": "builds", "org": "acme"}), nil, "invalid token: bad signature"},
+		{"signature stripped", strings.Join(strings.Split(issuer.token(t, "rsa-1", map[string]interface{}{"org": "acme"}), ".")[:2], ".") + ".", nil, "invalid token: bad signature"},
+		{"malformed", "eyJ.x.y", nil, "invalid token: malformed token"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			identity, err := verifier.Verify(context.Background(), tt.token)
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				assert.ErrorIs(t, err, errInvalidToken)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.identity, identity)
+		})
+	}
+	// Keys are fetched once and cached
+	assert.EqualValues(t, 1, issuer.fetches.Load())
+}
+
+func TestOIDCVerifierRejectsUnsupportedAlgorithms(t *testing.T) {
+	issuer := newTestIssuer(t)
+	verifier := newTestVerifier(t, issuer)
+	token := issuer.token(t, "rsa-1", map[string]interface{}{"org": "acme"})
+	parts := strings.Split(token, ".")
+
+	for _, alg := range []string{"none", "HS256"} {
+		header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"` + alg + `","kid":"rsa-1"}`))
+		_, err := verifier.Verify(context.Background(), header+"."+parts[1]+"."+parts[2])
+		assert.ErrorIs(t, err, errInvalidToken, alg)
+	}
+}
+
+func TestOIDCVerifierRefetchesRotatedKeys(t *testing.T) {
+	issuer := newTestIssuer(t)
+	verifier := newTestVerifier(t, issuer)
+	now := time.Now()
+	verifier.now = func() time.Time { return now }
+
+	_, err := verifier.Verify(context.Background(), issuer.token(t, "rsa-1", map[string]interface{}{"org": "acme"}))
+	require.NoError(t, err)
+
+	// A token from a key the issuer rotated in fetches the keys again, at
+	// most once a minute
+	rotated, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	issuer.keys["rsa-2"] = rotated
+	token := signTestJWT(t, "RS256", "rsa-2", rotated, map[string]interface{}{"iss": issuer.server.URL, "aud": "builds", "org": "acme", "exp": now.Add(24 * time.Hour).Unix()})
+	_, err = verifier.Verify(context.Background(), token)
+	assert.EqualError(t, err, `invalid token: unknown key "rsa-2"`)
+	assert.EqualValues(t, 1, issuer.fetches.Load())
+
+	now = now.Add(oidcMinRefresh)
+	_, err = verifier.Verify(context.Background(), token)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, issuer.fetches.Load())
+
+	// Cached keys keep working while the issuer is unreachable
+	issuer.server.Close()
+	now = now.Add(2 * time.Hour)
+	_, err = verifier.Verify(context.Background(), token)
+	assert.NoError(t, err)
+	_, err = verifier.Verify(context.Background(), signTestJWT(t, "RS256", "rsa-3", rotated, map[string]interface{}{}))
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, errInvalidToken)
+}
+
+func TestTenancyAcceptsOIDCTokens(t *testing.T) {
+	t.Setenv("REQUIRE_API_KEY", "true")
+	issuer := newTestIssuer(t)
+	service, mockDB := setupTestService()
+	service.tenancy.oidc = newTestVerifier(t, issuer)
+	router := tenancyRouter(service)
+	mockDB.On("ListBuilds", false, "acme", Labels(nil)).Return([]*BuildRequest{{ID: 1, Org: "acme"}}, nil).Once()
+	mockDB.On("ListBuilds", false, "", Labels(nil)).Return([]*BuildRequest{}, nil).Once()
+
+	for _, tt := range []struct {
+		name, token string
+		status      int
+	}{
+		{"org member", issuer.token(t, "rsa-1", map[string]interface{}{"org": "acme"}), http.StatusOK},
+		{"admin", issuer.token(t, "ec-1", map[string]interface{}{"realm_access": map[string]interface{}{"roles": []string{"build-admin"}}}), http.StatusOK},
+		{"expired", issuer.token(t, "rsa-1", map[string]interface{}{"org": "acme", "exp": time.Now().Add(-time.Hour).Unix()}), http.StatusUnauthorized},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, tenantRequest("GET", "/api/v1/builds", tt.token, ""))
+			assert.Equal(t, tt.status, rr.Code)
+		})
+	}
+	mockDB.AssertExpectations(t)
+
+	// The admin role unlocks admin endpoints and the user is audited
+	req := tenantRequest("GET", "/", issuer.token(t, "rsa-1", map[string]interface{}{"email": "root@acme.com", "realm_access": map[string]interface{}{"roles": "build-admin"}}), "")
+	tenant, authenticated, err := service.tenancy.authenticate(req)
+	require.NoError(t, err)
+	assert.True(t, authenticated)
+	req = req.WithContext(context.WithValue(req.Context(), tenantContextKey{}, tenant))
+	assert.True(t, isAdminRequest(req))
+	assert.Equal(t, "root@acme.com", auditActor(req, ""))
+}
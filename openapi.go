@@ -0,0 +1,470 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// apiOperation describes a route for the generated OpenAPI document. Request
+// and Response are example values whose types are reflected into schemas.
+type apiOperation struct {
+	Summary  string
+	Tag      string
+	Request  interface{}
+	Response interface{}
+	// Status is the success status code, 200 when unset
+	Status int
+	// ContentType overrides application/json for non-JSON bodies
+	ContentType string
+	Query       []apiParameter
+}
+
+// apiParameter is a documented query parameter
+type apiParameter struct {
+	Name        string
+	Description string
+	Type        string
+}
+
+// apiOperations documents the routes registered in Router, keyed by method
+// and path template. Routes without an entry still appear in the document.
+var apiOperations = map[string]apiOperation{
+	"GET /api/v1/health": {Summary: "Service and database health", Tag: "health", Response: map[string]interface{}{}},
+	"GET /api/v1/queue": {Summary: "Queued and running builds per user against their fair share", Tag: "builds", Response: QueueUsageReport{}, Query: []apiParameter{
+		{Name: "org", Description: "Only report this organization; defaults to the X-Organization header", Type: "string"},
+	}},
+	"GET /api/v1/status":     {Summary: "Public status summary", Tag: "health", Response: StatusPage{}},
+	"GET /api/v1/status.txt": {Summary: "Overall service status as a single word", Tag: "health", ContentType: "text/plain"},
+
+	"GET /api/v1/stats/projects": {Summary: "Success rate and build durations of each project", Tag: "stats", Response: []ProjectStats{}, Query: []apiParameter{
+		{Name: "days", Description: "Number of days to report, including today; defaults to 30", Type: "integer"},
+	}},
+	"GET /api/v1/stats/durations": {Summary: "Average and percentile build durations per hour, day, week or month", Tag: "stats", Response: []DurationStats{}, Query: []apiParameter{
+		{Name: "days", Description: "Number of days to report, including today; defaults to 30", Type: "integer"},
+		{Name: "interval", Description: "hour, day, week or month; defaults to day", Type: "string"},
+		{Name: "project", Description: "Only builds of this project", Type: "string"},
+	}},
+	"GET /api/v1/stats/daily": {Summary: "Builds created per day", Tag: "stats", Response: []DailyBuildCount{}, Query: []apiParameter{
+		{Name: "days", Description: "Number of days to report, including today; defaults to 30", Type: "integer"},
+		{Name: "project", Description: "Only builds of this project", Type: "string"},
+	}},
+	"GET /api/v1/stats/flaky": {Summary: "Projects whose builds most often both fail and pass on the same commit", Tag: "stats", Response: []FlakyProject{}, Query: []apiParameter{
+		{Name: "days", Description: "Number of days to report, including today; defaults to 30", Type: "integer"},
+		{Name: "limit", Description: "Number of projects, at most 100; defaults to 10", Type: "integer"},
+	}},
+	"GET /status": {Summary: "Embeddable HTML status page", Tag: "health", ContentType: "text/html"},
+
+	"POST /api/v1/builds": {Summary: "Queue a build of a branch or tag", Tag: "builds", Request: BuildRequest{}, Response: BuildRequest{}, Status: http.StatusCreated, Query: []apiParameter{
+		{Name: "if_not_building", Description: "Return the queued or running build of the same project, branch or tag and commit, with 200 and X-Build-Existing, instead of creating another", Type: "boolean"},
+	}},
+	"GET /api/v1/builds":        {Summary: "List builds", Tag: "builds", Response: []BuildRequest{}, Query: []apiParameter{{Name: "commit_sha", Description: "Only builds of commits starting with this hash (at least 7 characters)", Type: "string"}, {Name: "include_deleted", Description: "Include soft deleted builds; requires the admin token", Type: "boolean"}, {Name: "label", Description: "Only builds with this key:value label; repeat for several", Type: "string"}}},
+	"POST /api/v1/builds/batch": {Summary: "Queue several builds at once; either all are created or, with 400 and the error of each rejected build, none", Tag: "builds", Request: []BuildRequest{}, Response: BatchBuildResponse{}, Status: http.StatusCreated},
+	"GET /api/v1/builds/events": {Summary: "Server-sent events stream of build status changes", Tag: "builds", ContentType: "text/event-stream", Query: []apiParameter{{Name: "project", Description: "Only stream events of this project", Type: "string"}}},
+	"GET /api/v1/graphql": {Summary: "Run a GraphQL query, or a subscription streamed as server-sent events", Tag: "graphql", Response: graphQLResponse{}, Query: []apiParameter{
+		{Name: "query", Description: "GraphQL document", Type: "string"},
+		{Name: "variables", Description: "JSON object of the operation's variables", Type: "string"},
+		{Name: "operationName", Description: "Operation to run when the document has several", Type: "string"},
+	}},
+	"POST /api/v1/graphql":       {Summary: "Run a GraphQL query, or a subscription streamed as server-sent events", Tag: "graphql", Request: graphQLRequest{}, Response: graphQLResponse{}},
+	"GET /api/v1/graphql/schema": {Summary: "GraphQL schema in SDL", Tag: "graphql", ContentType: "text/plain"},
+	"GET /api/v1/ws":             {Summary: "WebSocket stream of build events and logs", Tag: "builds", Status: http.StatusSwitchingProtocols},
+	"GET /api/v1/builds/{id}": {Summary: "Get a build, optionally blocking until it finishes; X-Build-Finished then tells whether it did", Tag: "builds", Response: BuildRequest{}, Query: []apiParameter{
+		{Name: "wait", Description: "Block until the build finishes or the timeout elapses", Type: "boolean"},
+		{Name: "timeout", Description: "How long to wait, as a duration such as 90s or a number of seconds; defaults to 60s, at most 10m", Type: "string"},
+	}},
+	"GET /api/v1/builds/{id}/status.txt":    {Summary: "The build's status as a single word", Tag: "builds", ContentType: "text/plain"},
+	"GET /api/v1/builds/{id}/quality-gates": {Summary: "Quality gates reported for the build's commit and their verdict", Tag: "builds", Response: BuildQualityGates{}},
+	"GET /api/v1/builds/{id}/escalations":   {Summary: "PagerDuty and Opsgenie incidents opened for the build", Tag: "builds", Response: []Escalation{}},
+	"GET /api/v1/builds/{id}/chain":         {Summary: "Upstream builds that triggered the build and downstream builds it triggered", Tag: "builds", Response: BuildChain{}},
+	"GET /api/v1/builds/{id}/matrix":        {Summary: "The builds a matrix build expanded into, one per combination of its matrix", Tag: "builds", Response: MatrixBuilds{}},
+	"GET /api/v1/builds/{id}/wait": {Summary: "Deprecated, use ?wait=true on GET /api/v1/builds/{id}: block until the build finishes or the timeout elapses, then return it; X-Build-Finished tells which", Tag: "builds", Response: BuildRequest{}, Query: []apiParameter{
+		{Name: "timeout", Description: "How long to wait, as a duration such as 90s or a number of seconds; defaults to 60s, at most 10m", Type: "string"},
+	}},
+	"GET /api/v1/builds/{id}/queue-position":      {Summary: "A queued build's position, what delays it and when it's expected to start", Tag: "builds", Response: QueuePosition{}},
+	"DELETE /api/v1/builds/{id}":                  {Summary: "Soft delete a finished build", Tag: "builds", Status: http.StatusNoContent},
+	"PATCH /api/v1/builds/{id}":                   {Summary: "Change a build's status, start_at or description; requires If-Match with the build's ETag", Tag: "builds", Request: BuildUpdate{}, Response: BuildRequest{}},
+	"POST /api/v1/builds/{id}/otlp/v1/traces":     {Summary: "Report OTLP/JSON spans from a running build's tooling", Tag: "builds", Response: map[string]interface{}{}},
+	"GET /api/v1/builds/{id}/stages":              {Summary: "Status, timing and output of each stage of the build", Tag: "builds", Response: BuildStages{}},
+	"GET /api/v1/builds/{id}/problems":            {Summary: "Errors and warnings found in the build's stage logs, with the log line of each", Tag: "builds", Response: BuildProblems{}},
+	"GET /api/v1/builds/{id}/logs":                {Summary: "Complete output of a finished build, or the single byte range asked for", Tag: "builds", ContentType: "text/plain"},
+	"GET /api/v1/builds/{id}/steps/{n}/logs":      {Summary: "Output of one stage of the build, numbered from 0 in the order of its stages", Tag: "builds", ContentType: "text/plain"},
+	"GET /api/v1/builds/{id}/steps/{n}/artifacts": {Summary: "Artifacts produced by one stage of the build", Tag: "builds", Response: []Artifact{}},
+	"GET /api/v1/builds/{id}/genealogy":           {Summary: "Family tree of the build's original and retries", Tag: "builds", Response: BuildGenealogy{}},
+	"POST /api/v1/builds/{id}/start":              {Summary: "Queue a draft build now", Tag: "builds", Response: BuildRequest{}},
+	"POST /api/v1/builds/{id}/cancel":             {Summary: "Cancel a draft, queued or running build", Tag: "builds", Request: CancelRequest{}, Response: BuildRequest{}},
+	"GET /api/v1/builds/{id}/impact":              {Summary: "Waiting builds that depend on a build", Tag: "builds", Response: BuildImpact{}},
+	"POST /api/v1/builds/{id}/retry":              {Summary: "Retry a failed or cancelled build", Tag: "builds", Response: BuildRequest{}, Status: http.StatusCreated},
+	"GET /api/v1/builds/{id}/config":              {Summary: "Effective configuration the build ran with", Tag: "builds", Response: ConfigSnapshot{}},
+	"GET /api/v1/builds/{id}/config/diff": {Summary: "Configuration changes from another build to this one", Tag: "builds", Response: ConfigDiff{}, Query: []apiParameter{
+		{Name: "against", Description: "ID of the build to compare with (required)", Type: "integer"},
+	}},
+	"GET /api/v1/builds/{id}/artifacts":        {Summary: "List a build's artifacts", Tag: "artifacts", Response: []Artifact{}},
+	"PUT /api/v1/builds/{id}/artifacts/{name}": {Summary: "Upload an artifact of a running build", Tag: "artifacts", Request: []byte{}, Response: Artifact{}, Status: http.StatusCreated, ContentType: "application/octet-stream"},
+	"GET /api/v1/builds/{id}/artifacts/{name}": {Summary: "Download an artifact", Tag: "artifacts", Response: []byte{}, ContentType: "application/octet-stream"},
+	"GET /api/v1/builds/{id}/provenance":       {Summary: "Signed SLSA provenance of a finished build's artifacts", Tag: "artifacts", Response: ProvenanceEnvelope{}},
+	"GET /api/v1/provenance/public-key":        {Summary: "Public key verifying build provenance signatures", Tag: "artifacts", ContentType: "application/x-pem-file"},
+
+	"POST /api/v1/projects":                    {Summary: "Register a project", Tag: "projects", Request: Project{}, Response: Project{}, Status: http.StatusCreated},
+	"GET /api/v1/projects":                     {Summary: "List projects", Tag: "projects", Response: []Project{}, Query: []apiParameter{{Name: "label", Description: "Only projects with this key:value label; repeat for several", Type: "string"}}},
+	"GET /api/v1/projects/{id}":                {Summary: "Get a project", Tag: "projects", Response: Project{}},
+	"PATCH /api/v1/projects/{id}":              {Summary: "Update a project", Tag: "projects", Request: ProjectUpdate{}, Response: Project{}},
+	"POST /api/v1/projects/{id}/release-notes": {Summary: "Compile release notes between two tags or builds", Tag: "projects", Request: ReleaseNotesRequest{}, Response: ReleaseNotes{}},
+	"POST /api/v1/projects/{id}/pause":         {Summary: "Pause scheduling of a project's builds", Tag: "projects", Request: PauseRequest{}, Response: Project{}},
+	"GET /api/v1/projects/{name}/badge.svg":    {Summary: "SVG badge of the default branch's latest build", Tag: "projects", ContentType: "image/svg+xml"},
+	"GET /api/v1/projects/{name}/status.txt": {Summary: "Status of a branch's latest finished build as a single word", Tag: "projects", ContentType: "text/plain", Query: []apiParameter{
+		{Name: "branch", Description: "Branch to report; defaults to the project's default branch", Type: "string"},
+	}},
+	"POST /api/v1/projects/{id}/resume":    {Summary: "Resume scheduling of a project's builds", Tag: "projects", Response: Project{}},
+	"POST /api/v1/projects/bootstrap":      {Summary: "Onboard a GitHub or GitLab repository: detect its toolchain, generate a starter pipeline, register the project and webhook and queue a first build", Tag: "projects", Request: ProjectBootstrapRequest{}, Response: ProjectBootstrap{}, Status: http.StatusCreated},
+	"GET /api/v1/projects/{id}/downstream": {Summary: "Projects built after the project's successful default branch builds", Tag: "projects", Response: []DownstreamProject{}},
+	"PUT /api/v1/projects/{id}/downstream": {Summary: "Replace the project's downstream projects; refused with 409 when it would create a cycle", Tag: "projects", Request: DownstreamProjectsUpdate{}, Response: []DownstreamProject{}},
+	"GET /api/v1/project-dependencies": {Summary: "Edges of the project dependency graph, between the projects of the caller's org when scoped to one", Tag: "projects", Response: []ProjectDependency{}, Query: []apiParameter{
+		{Name: "org", Description: "Only edges between projects of this organization", Type: "string"},
+	}},
+	"GET /api/v1/projects/{id}/failure-causes": {Summary: "Failed builds of the project counted by classified cause", Tag: "projects", Response: FailureCauses{}, Query: []apiParameter{
+		{Name: "days", Description: "Number of days to count, including today; defaults to 30", Type: "integer"},
+	}},
+	"GET /api/v1/projects/{id}/stale-branches": {Summary: "Branches of the project without pushes or manual builds for a number of days, with their enabled schedules", Tag: "projects", Response: StaleBranchReport{}, Query: []apiParameter{
+		{Name: "days", Description: "Days without activity after which a branch is stale; defaults to STALE_BRANCH_DAYS", Type: "integer"},
+	}},
+	"GET /api/v1/projects/{id}/recommendations": {Summary: "CPU, memory and timeout limits recommended from the usage of the project's latest successful builds", Tag: "projects", Response: ResourceRecommendations{}},
+
+	"POST /api/v1/projects/{id}/schedules":        {Summary: "Schedule builds of a project with a cron expression", Tag: "schedules", Request: BuildSchedule{}, Response: BuildSchedule{}, Status: http.StatusCreated},
+	"GET /api/v1/projects/{id}/schedules":         {Summary: "List the build schedules of a project", Tag: "schedules", Response: []BuildSchedule{}},
+	"GET /api/v1/projects/{id}/secrets":           {Summary: "List the names and versions of a project's secrets", Tag: "projects", Response: []ProjectSecret{}},
+	"PUT /api/v1/projects/{id}/secrets/{name}":    {Summary: "Create a secret, or rotate it to a new value", Tag: "projects", Request: ProjectSecretRequest{}, Response: ProjectSecret{}},
+	"DELETE /api/v1/projects/{id}/secrets/{name}": {Summary: "Delete a secret", Tag: "projects", Status: http.StatusNoContent},
+	"GET /api/v1/schedules/{id}":                  {Summary: "Get a build schedule", Tag: "schedules", Response: BuildSchedule{}},
+	"PATCH /api/v1/schedules/{id}":                {Summary: "Update a build schedule", Tag: "schedules", Request: BuildScheduleUpdate{}, Response: BuildSchedule{}},
+	"DELETE /api/v1/schedules/{id}":               {Summary: "Delete a build schedule", Tag: "schedules", Status: http.StatusNoContent},
+
+	"POST /api/v1/deployments":       {Summary: "Deploy a successful build to an environment", Tag: "deployments", Request: DeploymentRequest{}, Response: Deployment{}, Status: http.StatusCreated},
+	"GET /api/v1/deployments":        {Summary: "List recent deployments", Tag: "deployments", Response: []Deployment{}, Query: []apiParameter{{Name: "project", Description: "Only deployments of this project", Type: "string"}, {Name: "environment", Description: "Only deployments to this environment", Type: "string"}}},
+	"GET /api/v1/deployments/{id}":   {Summary: "Get a deployment", Tag: "deployments", Response: Deployment{}},
+	"PATCH /api/v1/deployments/{id}": {Summary: "Move a deployment to its next status", Tag: "deployments", Request: DeploymentStatusUpdate{}, Response: Deployment{}},
+
+	"POST /api/v1/pipelines/validate":                    {Summary: "Validate a proposed pipeline file", Tag: "builds", Request: []byte{}, Response: PipelineValidation{}, Query: []apiParameter{{Name: "project", Description: "Also check the image policy that applies to this project", Type: "string"}}},
+	"POST /api/v1/webhooks/github":                       {Summary: "GitHub push and pull request webhook", Tag: "webhooks", Response: BuildRequest{}, Status: http.StatusCreated},
+	"POST /api/v1/webhooks/gitlab":                       {Summary: "GitLab push webhook", Tag: "webhooks", Response: BuildRequest{}, Status: http.StatusCreated},
+	"POST /api/v1/webhooks/sonarqube":                    {Summary: "SonarQube analysis webhook recording the commit's quality gate", Tag: "webhooks", Request: sonarQubePayload{}, Response: QualityGate{}},
+	"POST /api/v1/quality-gates":                         {Summary: "Report a quality gate result for a commit, e.g. from Codacy", Tag: "builds", Request: QualityGate{}, Response: QualityGate{}, Status: http.StatusCreated},
+	"POST /api/v1/notifications/digests":                 {Summary: "Send an email address or Slack channel a periodic digest of finished builds instead of a message per build", Tag: "notifications", Request: NotificationDigest{}, Response: NotificationDigest{}, Status: http.StatusCreated},
+	"GET /api/v1/notifications/digests":                  {Summary: "List notification digests", Tag: "notifications", Response: []NotificationDigest{}},
+	"DELETE /api/v1/notifications/digests/{id}":          {Summary: "Delete a notification digest", Tag: "notifications", Status: http.StatusNoContent},
+	"POST /api/v1/webhooks/subscriptions":                {Summary: "Subscribe a URL to build events", Tag: "webhooks", Request: WebhookSubscription{}, Response: WebhookSubscription{}, Status: http.StatusCreated},
+	"GET /api/v1/webhooks/subscriptions":                 {Summary: "List webhook subscriptions", Tag: "webhooks", Response: []WebhookSubscription{}},
+	"GET /api/v1/webhooks/subscriptions/{id}":            {Summary: "Get a webhook subscription", Tag: "webhooks", Response: WebhookSubscription{}},
+	"PATCH /api/v1/webhooks/subscriptions/{id}":          {Summary: "Update a webhook subscription", Tag: "webhooks", Request: WebhookSubscriptionUpdate{}, Response: WebhookSubscription{}},
+	"DELETE /api/v1/webhooks/subscriptions/{id}":         {Summary: "Delete a webhook subscription", Tag: "webhooks", Status: http.StatusNoContent},
+	"GET /api/v1/webhooks/subscriptions/{id}/deliveries": {Summary: "Recent deliveries of a webhook subscription", Tag: "webhooks", Response: []WebhookDelivery{}},
+	"GET /api/v1/webhooks/deliveries/{id}":               {Summary: "Get a webhook delivery", Tag: "webhooks", Response: WebhookDelivery{}},
+	"POST /api/v1/webhooks/deliveries/{id}/replay":       {Summary: "Send a failed webhook delivery again", Tag: "webhooks", Response: WebhookDelivery{}},
+	"POST /api/v1/slack/commands":                        {Summary: "Slack slash command", Tag: "slack", Response: slackCommandResponse{}},
+	"GET /api/v1/issues/{key}/builds":                    {Summary: "List builds referencing an issue", Tag: "issues", Response: []BuildRequest{}},
+	"GET /api/v1/audit": {Summary: "Audit log of changes made through the API, newest first; requires the admin token", Tag: "admin", Response: []AuditEntry{}, Query: []apiParameter{
+		{Name: "actor", Description: "Only changes by this actor, e.g. admin or api-key:3", Type: "string"},
+		{Name: "org", Description: "Only changes in this organization", Type: "string"},
+		{Name: "resource", Description: "Only changes to this kind of resource, e.g. builds", Type: "string"},
+		{Name: "resource_id", Description: "Only changes to the resource with this ID", Type: "string"},
+		{Name: "method", Description: "Only POST, PUT, PATCH or DELETE requests", Type: "string"},
+		{Name: "since", Description: "Only changes at or after this RFC 3339 time", Type: "string"},
+		{Name: "until", Description: "Only changes before this RFC 3339 time", Type: "string"},
+		{Name: "before", Description: "Only entries older than this entry ID, to page through the log", Type: "integer"},
+		{Name: "limit", Description: "Number of entries, at most 1000; defaults to 100", Type: "integer"},
+	}},
+
+	"GET /api/v1/admin/access-log":   {Summary: "List access log rules", Tag: "admin", Response: []AccessLogRule{}},
+	"PUT /api/v1/admin/access-log":   {Summary: "Set an access log rule", Tag: "admin", Request: AccessLogRule{}, Response: AccessLogRule{}},
+	"GET /api/v1/admin/deprecations": {Summary: "Deprecated endpoints and their callers", Tag: "admin", Response: []DeprecationReport{}},
+	"GET /api/v1/admin/usage": {Summary: "API usage per endpoint, organization and client version", Tag: "admin", Response: UsageReport{}, Query: []apiParameter{
+		{Name: "days", Description: "Number of days to report, including today; defaults to 30", Type: "integer"},
+		{Name: "org", Description: "Only report usage of this organization", Type: "string"},
+	}},
+	"GET /api/v1/admin/fair-share":                  {Summary: "Default and per-org fair share limits", Tag: "admin", Response: FairShareSettings{}},
+	"PUT /api/v1/admin/fair-share/{org}":            {Summary: "Set an org's limit of running builds per user", Tag: "admin", Request: FairShareLimit{}, Response: FairShareLimit{}},
+	"DELETE /api/v1/admin/fair-share/{org}":         {Summary: "Return an org to the default fair share", Tag: "admin", Status: http.StatusNoContent},
+	"GET /api/v1/admin/image-policies":              {Summary: "List the container image policies of orgs", Tag: "admin", Response: []ImagePolicy{}},
+	"PUT /api/v1/admin/image-policies/{org}":        {Summary: "Set the images an org's builds may run in", Tag: "admin", Request: ImagePolicy{}, Response: ImagePolicy{}},
+	"DELETE /api/v1/admin/image-policies/{org}":     {Summary: "Remove an org's image policy", Tag: "admin", Status: http.StatusNoContent},
+	"GET /api/v1/admin/requests":                    {Summary: "Requests in flight and recent requests over the latency budget, with stacks", Tag: "admin", Response: WatchdogReport{}},
+	"GET /api/v1/admin/erasures":                    {Summary: "List completed personal data erasures", Tag: "admin", Response: []DataErasure{}},
+	"POST /api/v1/admin/erasures":                   {Summary: "Erase a person's data, replacing it with a pseudonym", Tag: "admin", Request: UserErasure{}, Response: DataErasure{}, Status: http.StatusCreated},
+	"GET /api/v1/admin/shadow":                      {Summary: "Outcomes of the shadow executor compared with the primary executor", Tag: "admin", Response: ShadowReport{}},
+	"GET /api/v1/admin/workers":                     {Summary: "Live workers with their running builds", Tag: "admin", Response: []Worker{}},
+	"POST /api/v1/admin/workers/{id}/drain":         {Summary: "Stop a worker claiming builds once its running builds finish", Tag: "admin", Response: Worker{}},
+	"POST /api/v1/admin/workers/{id}/undrain":       {Summary: "Let a drained worker claim builds again", Tag: "admin", Response: Worker{}},
+	"GET /api/v1/admin/queue":                       {Summary: "Whether the queue is paused, its depth and the running builds", Tag: "admin", Response: QueueOverview{}},
+	"POST /api/v1/admin/queue/pause":                {Summary: "Stop every worker claiming builds", Tag: "admin", Request: PauseRequest{}, Response: QueueControl{}},
+	"POST /api/v1/admin/queue/resume":               {Summary: "Resume claiming builds", Tag: "admin", Response: QueueControl{}},
+	"GET /api/v1/admin/janitor":                     {Summary: "Report of the last janitor run", Tag: "admin", Response: JanitorReport{}},
+	"GET /api/v1/admin/credentials/rotation":        {Summary: "Progress of the current or last credential rotation", Tag: "admin", Response: CredentialRotation{}},
+	"POST /api/v1/admin/credentials/rotate":         {Summary: "Re-encrypt all stored credentials with the primary key", Tag: "admin", Request: CredentialRotationRequest{}, Response: CredentialRotation{}, Status: http.StatusAccepted},
+	"POST /api/v1/admin/janitor/run":                {Summary: "Run the janitor", Tag: "admin", Response: JanitorReport{}, Query: []apiParameter{{Name: "dry_run", Description: "Only report; defaults to true", Type: "boolean"}}},
+	"GET /api/v1/admin/integrations":                {Summary: "Integration health", Tag: "admin", Response: []IntegrationState{}},
+	"POST /api/v1/admin/integrations/{name}/enable": {Summary: "Re-enable a disabled integration", Tag: "admin", Status: http.StatusNoContent},
+
+	"GET /api/v1/admin/incidents":            {Summary: "List open incidents, or all with ?all=true", Tag: "admin", Response: []Incident{}},
+	"POST /api/v1/admin/incidents":           {Summary: "Announce an incident or maintenance", Tag: "admin", Request: Incident{}, Response: Incident{}, Status: http.StatusCreated},
+	"PATCH /api/v1/admin/incidents/{id}":     {Summary: "Update or resolve an incident", Tag: "admin", Request: IncidentUpdate{}, Response: Incident{}},
+	"GET /api/v1/admin/orgs":                 {Summary: "List organizations", Tag: "admin", Response: []Organization{}},
+	"POST /api/v1/admin/orgs":                {Summary: "Create an organization", Tag: "admin", Request: Organization{}, Response: Organization{}, Status: http.StatusCreated},
+	"PATCH /api/v1/admin/orgs/{org}":         {Summary: "Change an organization's display name or vanity domain", Tag: "admin", Request: OrganizationUpdate{}, Response: Organization{}},
+	"GET /api/v1/admin/orgs/{org}/api-keys":  {Summary: "List an organization's API keys", Tag: "admin", Response: []APIKey{}},
+	"POST /api/v1/admin/orgs/{org}/api-keys": {Summary: "Issue an API key scoped to an organization; the key is only returned once", Tag: "admin", Request: APIKey{}, Response: APIKey{}, Status: http.StatusCreated},
+	"DELETE /api/v1/admin/api-keys/{id}":     {Summary: "Revoke an API key", Tag: "admin", Response: APIKey{}},
+
+	"GET /api/v1/openapi.json": {Summary: "This OpenAPI document", Tag: "docs", Response: map[string]interface{}{}},
+	"GET /docs":                {Summary: "Swagger UI for this API", Tag: "docs", ContentType: "text/html"},
+}
+
+// routeVariablePattern matches mux path variables, with or without a pattern
+var routeVariablePattern = regexp.MustCompile(`\{([^}:]+)(:[^}]+)?\}`)
+
+// generateOpenAPI builds an OpenAPI 3 document from the routes registered on
+// router and the Go types of their request and response bodies
+func generateOpenAPI(router *mux.Router) ([]byte, error) {
+	schemas := openAPISchemas{components: make(map[string]interface{})}
+	paths := make(map[string]map[string]interface{})
+
+	err := router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			// Subrouter prefixes and handlers without methods aren't operations
+			return nil
+		}
+
+		path := routeVariablePattern.ReplaceAllString(template, "{$1}")
+		if paths[path] == nil {
+			paths[path] = make(map[string]interface{})
+		}
+		for _, method := range methods {
+			paths[path][strings.ToLower(method)] = schemas.operation(method, path, apiOperations[method+" "+path])
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return json.MarshalIndent(map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "Build Service API",
+			"version": "1.0.0",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas.components,
+			"securitySchemes": map[string]interface{}{
+				"adminToken": map[string]interface{}{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}, "", "  ")
+}
+
+// openAPISchemas collects the component schemas referenced by operations
+type openAPISchemas struct {
+	components map[string]interface{}
+}
+
+// operation describes one method of a path
+func (s *openAPISchemas) operation(method, path string, op apiOperation) map[string]interface{} {
+	operation := map[string]interface{}{
+		"operationId": operationID(method, path),
+	}
+	if op.Summary != "" {
+		operation["summary"] = op.Summary
+	}
+	if op.Tag != "" {
+		operation["tags"] = []string{op.Tag}
+	}
+	if strings.HasPrefix(path, "/api/v1/admin/") {
+		operation["security"] = []map[string][]string{{"adminToken": {}}}
+	}
+
+	var parameters []map[string]interface{}
+	for _, match := range routeVariablePattern.FindAllStringSubmatch(path, -1) {
+		parameters = append(parameters, map[string]interface{}{
+			"name": match[1], "in": "path", "required": true, "schema": map[string]string{"type": "string"},
+		})
+	}
+	for _, param := range op.Query {
+		parameters = append(parameters, map[string]interface{}{
+			"name": param.Name, "in": "query", "description": param.Description, "schema": map[string]string{"type": param.Type},
+		})
+	}
+	if len(parameters) > 0 {
+		operation["parameters"] = parameters
+	}
+
+	if op.Request != nil {
+		operation["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content":  s.content(op.Request, op.ContentType),
+		}
+	}
+
+	status := op.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	response := map[string]interface{}{"description": http.StatusText(status)}
+	if op.Response != nil {
+		response["content"] = s.content(op.Response, op.ContentType)
+	} else if op.ContentType != "" {
+		response["content"] = map[string]interface{}{op.ContentType: map[string]interface{}{}}
+	}
+	operation["responses"] = map[string]interface{}{fmt.Sprint(status): response}
+
+	return operation
+}
+
+// content describes a request or response body
+func (s *openAPISchemas) content(body interface{}, contentType string) map[string]interface{} {
+	if _, raw := body.([]byte); raw {
+		return map[string]interface{}{contentType: map[string]interface{}{
+			"schema": map[string]string{"type": "string", "format": "binary"},
+		}}
+	}
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	return map[string]interface{}{contentType: map[string]interface{}{"schema": s.schema(reflect.TypeOf(body))}}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schema returns the JSON schema of t, registering named structs as components
+func (s *openAPISchemas) schema(t reflect.Type) map[string]interface{} {
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Pointer:
+		schema := s.schema(t.Elem())
+		if _, ref := schema["$ref"]; ref {
+			return schema
+		}
+		schema["nullable"] = true
+		return schema
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": s.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": s.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return s.structSchema(t)
+		}
+		if _, ok := s.components[t.Name()]; !ok {
+			// Reserve the name first so recursive types terminate
+			s.components[t.Name()] = map[string]interface{}{}
+			s.components[t.Name()] = s.structSchema(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+// structSchema describes the JSON encoding of a struct, flattening embedded structs
+func (s *openAPISchemas) structSchema(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	var required []string
+
+	var walk func(t reflect.Type)
+	walk = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			tag := field.Tag.Get("json")
+			if tag == "-" || (!field.IsExported() && !field.Anonymous) {
+				continue
+			}
+			name, options, _ := strings.Cut(tag, ",")
+			if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+				walk(field.Type)
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+
+			properties[name] = s.schema(field.Type)
+			if !strings.Contains(options, "omitempty") && !strings.Contains(options, "omitzero") && field.Type.Kind() != reflect.Pointer {
+				required = append(required, name)
+			}
+		}
+	}
+	walk(t)
+
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		sort.Strings(required)
+		schema["required"] = required
+	}
+	return schema
+}
+
+// operationID derives a stable identifier such as getBuildsId from a method and path
+func operationID(method, path string) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(method))
+	for _, part := range strings.FieldsFunc(strings.TrimPrefix(path, "/api/v1"), func(r rune) bool {
+		return r == '/' || r == '{' || r == '}' || r == '-'
+	}) {
+		b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+	}
+	return b.String()
+}
+
+// OpenAPI document endpoint
+func (bs *BuildService) openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bs.openAPI)
+}
+
+// swaggerUIPage loads Swagger UI and points it at the generated document
+const swaggerUIPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>Build Service API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5.17.14/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5.17.14/swagger-ui-bundle.js" crossorigin></script>
+  <script>
+    window.ui = SwaggerUIBundle({ url: "api/v1/openapi.json", dom_id: "#swagger-ui" });
+  </script>
+</body>
+</html>
+`
+
+// API docs endpoint
+func (bs *BuildService) docsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(swaggerUIPage))
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenAPIDocumentsEveryRoute(t *testing.T) {
+	service, _ := setupTestService()
+	router, err := service.Router()
+	require.NoError(t, err)
+
+	router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		template, _ := route.GetPathTemplate()
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		path := routeVariablePattern.ReplaceAllString(template, "{$1}")
+		for _, method := range methods {
+			op, ok := apiOperations[method+" "+path]
+			assert.True(t, ok && op.Summary != "", "%s %s is not documented in apiOperations", method, path)
+		}
+		return nil
+	})
+
+	for key := range apiOperations {
+		method, path, _ := strings.Cut(key, " ")
+		var match mux.RouteMatch
+		req := httptest.NewRequest(method, routeVariablePattern.ReplaceAllString(path, "x"), nil)
+		assert.True(t, router.Match(req, &match) && match.MatchErr == nil, "%s has no route", key)
+	}
+}
+
+func TestOpenAPIHandler(t *testing.T) {
+	service, _ := setupTestService()
+	router, err := service.Router()
+	require.NoError(t, err)
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/openapi.json", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var doc struct {
+		OpenAPI    string                                       `json:"openapi"`
+		Paths      map[string]map[string]map[string]interface{} `json:"paths"`
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]map[string]interface{} `json:"properties"`
+				Required   []string                          `json:"required"`
+			} `json:"schemas"`
+		} `json:"components"`
+	}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &doc))
+	assert.Equal(t, "3.0.3", doc.OpenAPI)
+
+	artifactPath := doc.Paths["/api/v1/builds/{id}/artifacts/{name}"]
+	require.Contains(t, artifactPath, "put")
+	assert.Equal(t, "putBuildsIdArtifactsName", artifactPath["put"]["operationId"])
+	assert.Contains(t, doc.Paths["/api/v1/admin/janitor"]["get"], "security")
+	assert.NotContains(t, doc.Paths["/api/v1/builds"]["get"], "security")
+
+	build := doc.Components.Schemas["BuildRequest"]
+	assert.Equal(t, "integer", build.Properties["id"]["type"])
+	assert.Equal(t, "date-time", build.Properties["created_at"]["format"])
+	assert.Equal(t, true, build.Properties["exit_code"]["nullable"])
+	assert.Contains(t, build.Required, "project_name")
+	assert.NotContains(t, build.Required, "tag")
+
+	// Embedded structs are flattened
+	assert.Contains(t, doc.Components.Schemas["DeprecationReport"].Properties, "route")
+	assert.Contains(t, doc.Components.Schemas["DeprecationReport"].Properties, "clients")
+}
+
+func TestDocsHandler(t *testing.T) {
+	service, _ := setupTestService()
+
+	rr := httptest.NewRecorder()
+	service.docsHandler(rr, httptest.NewRequest("GET", "/docs", nil))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `url: "api/v1/openapi.json"`)
+}
+
+func TestOperationID(t *testing.T) {
+	assert.Equal(t, "postProjectsIdReleaseNotes", operationID("POST", "/api/v1/projects/{id}/release-notes"))
+	assert.Equal(t, "getDocs", operationID("GET", "/docs"))
+}
@@ -0,0 +1,534 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// apiKeyPrefix starts every API key, telling them apart from other bearer
+// tokens such as ADMIN_TOKEN
+const apiKeyPrefix = "bsk_"
+
+// apiKeyTouchInterval is how often an API key's last use is recorded
+const apiKeyTouchInterval = time.Minute
+
+var orgNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,62}$`)
+
+// Organization is a tenant of the service. Requests made with one of its API
+// keys only see its projects, builds and deployments.
+type Organization struct {
+	Name        string    `json:"name"`
+	DisplayName string    `json:"display_name,omitempty"`
+	Domain      string    `json:"domain,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// APIKey authenticates requests on behalf of an organization. Only the
+// SHA-256 hash of the key is stored; the key itself is returned once, when
+// it's created.
+type APIKey struct {
+	ID     int    `json:"id"`
+	Org    string `json:"org"`
+	Name   string `json:"name,omitempty"`
+	Prefix string `json:"prefix"`
+	// Key is only set in the response creating the key
+	Key        string     `json:"key,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// hashAPIKey returns the hash an API key is stored and looked up by
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// generateAPIKey returns a new random API key
+func generateAPIKey() (string, error) {
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + hex.EncodeToString(secret), nil
+}
+
+// Tenant is who a request was made on behalf of
+type Tenant struct {
+	// Org scopes the request to an organization's data; empty for requests
+	// that see every org's
+	Org string
+	// Admin is set for requests with the ADMIN_TOKEN
+	Admin bool
+	// KeyID is the API key the request was authenticated with, if any
+	KeyID int
+	// User is who an OIDC token was issued to, if the request carried one
+	User string
+}
+
+// Sees reports whether the tenant may see data belonging to org
+func (t Tenant) Sees(org string) bool {
+	return t.Org == "" || t.Org == org
+}
+
+// identity names who the tenant's credentials were issued to, or is empty
+// when the request carried none that were verified
+func (t Tenant) identity() string {
+	switch {
+	case t.User != "":
+		return t.User
+	case t.Admin:
+		return "admin"
+	case t.KeyID != 0:
+		return fmt.Sprintf("api-key:%d", t.KeyID)
+	}
+	return ""
+}
+
+type tenantContextKey struct{}
+
+// tenantFromContext returns the tenant of the request a context belongs to
+func tenantFromContext(ctx context.Context) Tenant {
+	tenant, _ := ctx.Value(tenantContextKey{}).(Tenant)
+	return tenant
+}
+
+// requestTenant returns the tenant a request was made on behalf of
+func requestTenant(r *http.Request) Tenant {
+	return tenantFromContext(r.Context())
+}
+
+// listOrg returns the org a listing is limited to: the tenant's, or for
+// unscoped requests the one in ?org=, if any
+func listOrg(r *http.Request) string {
+	if tenant := requestTenant(r); tenant.Org != "" {
+		return tenant.Org
+	}
+	return strings.ToLower(r.URL.Query().Get("org"))
+}
+
+// tenancyExemptPaths are served without an API key when REQUIRE_API_KEY is
+// set, because they're public or authenticate requests themselves
+var tenancyExemptPaths = []string{
+	"/api/v1/health",
+	"/api/v1/status",
+	"/api/v1/status.txt",
+	"/api/v1/openapi.json",
+	"/api/v1/webhooks/github",
+	"/api/v1/webhooks/gitlab",
+	"/api/v1/webhooks/sonarqube",
+	"/api/v1/slack/commands",
+	"/api/v1/admin/",
+	"/docs",
+	"/status",
+	"/metrics",
+}
+
+// tenancyServiceWidePaths configure the service as a whole, so requests
+// scoped to an org can't use them
+var tenancyServiceWidePaths = []string{
+	"/api/v1/webhooks/subscriptions",
+	"/api/v1/webhooks/deliveries",
+	"/api/v1/notifications",
+}
+
+func tenancyExempt(path string) bool {
+	if strings.HasPrefix(path, "/api/v1/projects/") && (strings.HasSuffix(path, "/badge.svg") || strings.HasSuffix(path, "/status.txt")) {
+		return true
+	}
+	return hasPathPrefix(path, tenancyExemptPaths)
+}
+
+func hasPathPrefix(path string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if path == prefix || strings.HasPrefix(path, strings.TrimSuffix(prefix, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Tenancy authenticates requests as a tenant. Requests with an org's API key
+// are scoped to the org; requests with the ADMIN_TOKEN, or without a key
+// unless REQUIRE_API_KEY is set, see every org's data. Requests to an org's
+// vanity domain are scoped to that org unless they carry the ADMIN_TOKEN.
+type Tenancy struct {
+	db         DatabaseInterface
+	links      *PublicURLs
+	requireKey bool
+	// oidc verifies SSO tokens when OIDC_ISSUER is set
+	oidc *OIDCVerifier
+
+	mu      sync.Mutex
+	touched map[int]time.Time
+}
+
+// NewTenancyFromEnv creates the tenancy middleware, requiring API keys when
+// REQUIRE_API_KEY is set
+func NewTenancyFromEnv(db DatabaseInterface, links *PublicURLs) *Tenancy {
+	return &Tenancy{
+		db:         db,
+		links:      links,
+		requireKey: getEnvBool("REQUIRE_API_KEY", false),
+		touched:    make(map[int]time.Time),
+	}
+}
+
+// authenticate returns the tenant of a request and whether it carried valid
+// credentials
+func (tn *Tenancy) authenticate(r *http.Request) (Tenant, bool, error) {
+	if hasAdminToken(r) {
+		return Tenant{Admin: true}, true, nil
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if ok && tn.oidc != nil && looksLikeJWT(token) {
+		identity, err := tn.oidc.Verify(r.Context(), token)
+		if errors.Is(err, errInvalidToken) {
+			log.Printf("Rejected OIDC token: %v", err)
+			return Tenant{}, false, nil
+		}
+		if err != nil {
+			return Tenant{}, false, err
+		}
+		return Tenant{Org: identity.Org, Admin: identity.Admin, User: identity.User}, true, nil
+	}
+	if !ok || !strings.HasPrefix(token, apiKeyPrefix) {
+		return Tenant{}, false, nil
+	}
+	key, err := tn.db.GetAPIKeyByHash(hashAPIKey(token))
+	if err != nil {
+		if err.Error() == "api key not found" {
+			return Tenant{}, false, nil
+		}
+		return Tenant{}, false, err
+	}
+	tn.touch(key.ID)
+	return Tenant{Org: key.Org, KeyID: key.ID}, true, nil
+}
+
+// touch records the use of an API key, at most once per apiKeyTouchInterval
+func (tn *Tenancy) touch(id int) {
+	tn.mu.Lock()
+	due := time.Since(tn.touched[id]) >= apiKeyTouchInterval
+	if due {
+		tn.touched[id] = time.Now()
+	}
+	tn.mu.Unlock()
+
+	if due {
+		if err := tn.db.TouchAPIKey(id); err != nil {
+			log.Printf("Error recording use of API key %d: %v", id, err)
+		}
+	}
+}
+
+// Middleware attaches the request's tenant to its context, rejecting
+// requests with an invalid API key and requests an org may not make
+func (tn *Tenancy) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant, authenticated, err := tn.authenticate(r)
+		if err != nil {
+			log.Printf("Error authenticating request: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		presented := strings.HasPrefix(token, apiKeyPrefix) || (tn.oidc != nil && looksLikeJWT(token))
+		if !authenticated && !tenancyExempt(r.URL.Path) && (tn.requireKey || presented) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if hostOrg := tn.links.HostOrg(r.Host); hostOrg != "" && !tenant.Admin {
+			if tenant.Org != "" && tenant.Org != hostOrg {
+				http.Error(w, "API key is not valid for this host", http.StatusForbidden)
+				return
+			}
+			tenant.Org = hostOrg
+		}
+
+		if tenant.Org != "" {
+			if hasPathPrefix(r.URL.Path, tenancyServiceWidePaths) {
+				http.Error(w, "Not available to organization API keys", http.StatusForbidden)
+				return
+			}
+			// The key's org replaces any org named by the gateway, so fair
+			// share, image policies and usage are counted against it
+			r.Header.Set("X-Organization", tenant.Org)
+		}
+
+		r = r.WithContext(context.WithValue(r.Context(), tenantContextKey{}, tenant))
+		if tenant.Org != "" && !tn.owns(w, r, tenant) {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// owns checks that the build, project, deployment or schedule a request is
+// for belongs to the tenant's org, answering as though it doesn't exist when
+// it belongs to another. Lookup errors are left to the handler to report.
+func (tn *Tenancy) owns(w http.ResponseWriter, r *http.Request, tenant Tenant) bool {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return true
+	}
+	template, err := route.GetPathTemplate()
+	if err != nil {
+		return true
+	}
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return true
+	}
+
+	var kind, org string
+	switch {
+	case strings.HasPrefix(template, "/api/v1/builds/{id}"):
+		kind = "Build"
+		build, err := tn.db.GetBuild(id)
+		if err != nil {
+			return true
+		}
+		org = build.Org
+	case strings.HasPrefix(template, "/api/v1/projects/{id}"):
+		kind = "Project"
+		project, err := tn.db.GetProject(id)
+		if err != nil {
+			return true
+		}
+		org = project.Org
+	case strings.HasPrefix(template, "/api/v1/deployments/{id}"):
+		kind = "Deployment"
+		deployment, err := tn.db.GetDeployment(id)
+		if err != nil {
+			return true
+		}
+		build, err := tn.db.GetBuild(deployment.BuildID)
+		if err != nil {
+			return true
+		}
+		org = build.Org
+	case strings.HasPrefix(template, "/api/v1/schedules/{id}"):
+		kind = "Schedule"
+		schedule, err := tn.db.GetBuildSchedule(id)
+		if err != nil {
+			return true
+		}
+		project, err := tn.db.GetProject(schedule.ProjectID)
+		if err != nil {
+			return true
+		}
+		org = project.Org
+	default:
+		return true
+	}
+
+	if !tenant.Sees(org) {
+		http.Error(w, kind+" not found", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// tenantSeesBuild reports whether the tenant may see a build, for checks
+// outside the request's own route
+func (bs *BuildService) tenantSeesBuild(tenant Tenant, id int) bool {
+	if tenant.Org == "" {
+		return true
+	}
+	build, err := bs.db.GetBuild(id)
+	return err == nil && tenant.Sees(build.Org)
+}
+
+// Create organization endpoint
+func (bs *BuildService) createOrganizationHandler(w http.ResponseWriter, r *http.Request) {
+	var org Organization
+	if err := json.NewDecoder(r.Body).Decode(&org); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	org.Name = strings.ToLower(strings.TrimSpace(org.Name))
+	if !orgNamePattern.MatchString(org.Name) {
+		http.Error(w, "name must be 1-63 lowercase letters, digits, dots, dashes or underscores", http.StatusBadRequest)
+		return
+	}
+	org.Domain = strings.ToLower(strings.TrimSpace(org.Domain))
+	if org.Domain != "" && !domainPattern.MatchString(org.Domain) {
+		http.Error(w, "domain must be a fully qualified hostname", http.StatusBadRequest)
+		return
+	}
+
+	if err := bs.db.CreateOrganization(&org); err != nil {
+		if err.Error() == "organization already exists" {
+			http.Error(w, "Organization already exists", http.StatusConflict)
+			return
+		}
+		if err.Error() == "domain already in use" {
+			http.Error(w, "Domain already in use", http.StatusConflict)
+			return
+		}
+		log.Printf("Error creating organization: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Created organization %q", org.Name)
+	bs.links.Invalidate()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(org)
+}
+
+// OrganizationUpdate changes an organization's display name or vanity
+// domain. An empty domain removes it.
+type OrganizationUpdate struct {
+	DisplayName *string `json:"display_name"`
+	Domain      *string `json:"domain"`
+}
+
+// Update organization endpoint
+func (bs *BuildService) updateOrganizationHandler(w http.ResponseWriter, r *http.Request) {
+	var update OrganizationUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	org, err := bs.db.GetOrganization(strings.ToLower(mux.Vars(r)["org"]))
+	if err != nil {
+		if err.Error() == "organization not found" {
+			http.Error(w, "Organization not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error getting organization: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if update.DisplayName != nil {
+		org.DisplayName = *update.DisplayName
+	}
+	if update.Domain != nil {
+		org.Domain = strings.ToLower(strings.TrimSpace(*update.Domain))
+		if org.Domain != "" && !domainPattern.MatchString(org.Domain) {
+			http.Error(w, "domain must be a fully qualified hostname", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := bs.db.UpdateOrganization(org); err != nil {
+		if err.Error() == "domain already in use" {
+			http.Error(w, "Domain already in use", http.StatusConflict)
+			return
+		}
+		log.Printf("Error updating organization: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Updated organization %q", org.Name)
+	bs.links.Invalidate()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(org)
+}
+
+// List organizations endpoint
+func (bs *BuildService) listOrganizationsHandler(w http.ResponseWriter, r *http.Request) {
+	orgs, err := bs.db.ListOrganizations()
+	if err != nil {
+		log.Printf("Error listing organizations: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(orgs)
+}
+
+// Create API key endpoint. The key is only ever returned in this response.
+func (bs *BuildService) createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var key APIKey
+	if err := json.NewDecoder(r.Body).Decode(&key); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	key.Org = strings.ToLower(mux.Vars(r)["org"])
+
+	secret, err := generateAPIKey()
+	if err != nil {
+		log.Printf("Error generating API key: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	key.Prefix = secret[:len(apiKeyPrefix)+8]
+
+	if err := bs.db.CreateAPIKey(&key, hashAPIKey(secret)); err != nil {
+		if err.Error() == "organization not found" {
+			http.Error(w, "Organization not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error creating API key: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Created API key %d (%s) for organization %q", key.ID, key.Prefix, key.Org)
+	key.Key = secret
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(key)
+}
+
+// List API keys endpoint
+func (bs *BuildService) listAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	keys, err := bs.db.ListAPIKeys(strings.ToLower(mux.Vars(r)["org"]))
+	if err != nil {
+		log.Printf("Error listing API keys: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+// Revoke API key endpoint
+func (bs *BuildService) revokeAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid API key ID", http.StatusBadRequest)
+		return
+	}
+
+	key, err := bs.db.RevokeAPIKey(id)
+	if err != nil {
+		if err.Error() == "api key not found" {
+			http.Error(w, "API key not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error revoking API key: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Revoked API key %d (%s) of organization %q", key.ID, key.Prefix, key.Org)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(key)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+const testAPIKey = apiKeyPrefix + "0123456789abcdef"
+
+// tenancyRouter routes a few scoped endpoints through the tenancy middleware
+func tenancyRouter(service *BuildService) *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/builds", service.listBuildsHandler).Methods("GET")
+	router.HandleFunc("/api/v1/builds/{id}", service.getBuildHandler).Methods("GET")
+	router.HandleFunc("/api/v1/projects", service.createProjectHandler).Methods("POST")
+	router.HandleFunc("/api/v1/webhooks/subscriptions", service.listWebhookSubscriptionsHandler).Methods("GET")
+	router.HandleFunc("/api/v1/openapi.json", service.openAPIHandler).Methods("GET")
+	router.Use(service.tenancy.Middleware)
+	return router
+}
+
+func tenantRequest(method, url, token, body string) *http.Request {
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req
+}
+
+func TestTenancyScopesRequestsToTheKeysOrg(t *testing.T) {
+	service, mockDB := setupTestService()
+	router := tenancyRouter(service)
+	mockDB.On("GetAPIKeyByHash", hashAPIKey(testAPIKey)).Return(&APIKey{ID: 4, Org: "acme"}, nil)
+	mockDB.On("TouchAPIKey", 4).Return(nil).Once()
+	mockDB.On("ListBuilds", false, "acme", Labels(nil)).Return([]*BuildRequest{{ID: 1, Org: "acme"}}, nil).Twice()
+	mockDB.On("GetBuild", 1).Return(&BuildRequest{ID: 1, Org: "acme"}, nil)
+	mockDB.On("GetBuild", 2).Return(&BuildRequest{ID: 2, Org: "globex"}, nil)
+
+	// The key's org wins over ?org= and X-Organization
+	req := tenantRequest("GET", "/api/v1/builds?org=globex", testAPIKey, "")
+	req.Header.Set("X-Organization", "globex")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"org":"acme"`)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, tenantRequest("GET", "/api/v1/builds", testAPIKey, ""))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, tenantRequest("GET", "/api/v1/builds/1", testAPIKey, ""))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// Other orgs' builds look like they don't exist
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, tenantRequest("GET", "/api/v1/builds/2", testAPIKey, ""))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	assert.Equal(t, "Build not found\n", rr.Body.String())
+
+	// Service-wide settings are off limits
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, tenantRequest("GET", "/api/v1/webhooks/subscriptions", testAPIKey, ""))
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	// Projects are created in the key's org
+	mockDB.On("CreateProject", mock.MatchedBy(func(p *Project) bool { return p.Org == "acme" })).Return(9, nil).Once()
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, tenantRequest("POST", "/api/v1/projects", testAPIKey, `{"name": "api", "git_url": "https://github.com/acme/api", "org": "globex"}`))
+	require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	assert.Contains(t, rr.Body.String(), `"org":"acme"`)
+	mockDB.AssertExpectations(t)
+}
+
+func TestTenancyAuthentication(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "admin-secret")
+	t.Setenv("REQUIRE_API_KEY", "true")
+	service, mockDB := setupTestService()
+	router := tenancyRouter(service)
+	mockDB.On("GetAPIKeyByHash", hashAPIKey(testAPIKey)).Return(nil, fmt.Errorf("api key not found"))
+	mockDB.On("GetAPIKeyByHash", hashAPIKey(apiKeyPrefix+"broken")).Return(nil, fmt.Errorf("connection refused"))
+	mockDB.On("ListBuilds", false, "", Labels(nil)).Return([]*BuildRequest{}, nil).Once()
+
+	for _, tt := range []struct {
+		name, url, token string
+		status           int
+	}{
+		{"no key", "/api/v1/builds", "", http.StatusUnauthorized},
+		{"revoked key", "/api/v1/builds", testAPIKey, http.StatusUnauthorized},
+		{"lookup fails", "/api/v1/builds", apiKeyPrefix + "broken", http.StatusInternalServerError},
+		{"public endpoint", "/api/v1/openapi.json", "", http.StatusOK},
+		{"admins see every org", "/api/v1/builds", "admin-secret", http.StatusOK},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, tenantRequest("GET", tt.url, tt.token, ""))
+			assert.Equal(t, tt.status, rr.Code)
+		})
+	}
+	mockDB.AssertExpectations(t)
+}
+
+func TestOrganizationHandlers(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.On("CreateOrganization", mock.MatchedBy(func(org *Organization) bool { return org.Name == "acme" })).Return(nil).Once()
+	mockDB.On("CreateOrganization", mock.Anything).Return(fmt.Errorf("organization already exists")).Once()
+
+	rr := httptest.NewRecorder()
+	service.createOrganizationHandler(rr, httptest.NewRequest("POST", "/api/v1/admin/orgs", bytes.NewBufferString(`{"name": " Acme ", "display_name": "Acme Corp"}`)))
+	require.Equal(t, http.StatusCreated, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"display_name":"Acme Corp"`)
+
+	rr = httptest.NewRecorder()
+	service.createOrganizationHandler(rr, httptest.NewRequest("POST", "/api/v1/admin/orgs", bytes.NewBufferString(`{"name": "acme"}`)))
+	assert.Equal(t, http.StatusConflict, rr.Code)
+
+	rr = httptest.NewRecorder()
+	service.createOrganizationHandler(rr, httptest.NewRequest("POST", "/api/v1/admin/orgs", bytes.NewBufferString(`{"name": "no spaces"}`)))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	mockDB.AssertExpectations(t)
+}
+
+func TestAPIKeyHandlers(t *testing.T) {
+	service, mockDB := setupTestService()
+	var storedHash string
+	mockDB.On("CreateAPIKey", mock.MatchedBy(func(key *APIKey) bool { return key.Org == "acme" && key.Name == "ci" }), mock.AnythingOfType("string")).
+		Run(func(args mock.Arguments) {
+			args.Get(0).(*APIKey).ID = 3
+			storedHash = args.String(1)
+		}).Return(nil).Once()
+	mockDB.On("CreateAPIKey", mock.Anything, mock.Anything).Return(fmt.Errorf("organization not found")).Once()
+	mockDB.On("RevokeAPIKey", 3).Return(&APIKey{ID: 3, Org: "acme"}, nil).Once()
+	mockDB.On("RevokeAPIKey", 4).Return(nil, fmt.Errorf("api key not found")).Once()
+
+	req := mux.SetURLVars(httptest.NewRequest("POST", "/api/v1/admin/orgs/acme/api-keys", bytes.NewBufferString(`{"name": "ci"}`)), map[string]string{"org": "acme"})
+	rr := httptest.NewRecorder()
+	service.createAPIKeyHandler(rr, req)
+	require.Equal(t, http.StatusCreated, rr.Code)
+
+	// The key is returned once and stored by its hash
+	var key APIKey
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &key))
+	assert.True(t, strings.HasPrefix(key.Key, key.Prefix))
+	assert.Equal(t, hashAPIKey(key.Key), storedHash)
+
+	req = mux.SetURLVars(httptest.NewRequest("POST", "/api/v1/admin/orgs/nope/api-keys", bytes.NewBufferString(`{}`)), map[string]string{"org": "nope"})
+	rr = httptest.NewRecorder()
+	service.createAPIKeyHandler(rr, req)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	for id, status := range map[string]int{"3": http.StatusOK, "4": http.StatusNotFound, "x": http.StatusBadRequest} {
+		rr = httptest.NewRecorder()
+		service.revokeAPIKeyHandler(rr, mux.SetURLVars(httptest.NewRequest("DELETE", "/api/v1/admin/api-keys/"+id, nil), map[string]string{"id": id}))
+		assert.Equal(t, status, rr.Code, id)
+	}
+	mockDB.AssertExpectations(t)
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// webhookStatuses are the build statuses a webhook subscription can filter on
+var webhookStatuses = map[string]bool{
+	"queued":    true,
+	"running":   true,
+	"success":   true,
+	"failed":    true,
+	"timeout":   true,
+	"skipped":   true,
+	"blocked":   true,
+	"cancelled": true,
+}
+
+// WebhookSubscription sends build events to an external URL. Events can be
+// filtered by lifecycle event, status and project, and Fields projects the
+// event onto just the keys the receiver needs, each given as a JSONPath into
+// the event.
+type WebhookSubscription struct {
+	ID        int               `json:"id" db:"id"`
+	URL       string            `json:"url" db:"url"`
+	Secret    string            `json:"secret,omitempty" db:"secret"`
+	Events    []string          `json:"events" db:"events"`
+	Statuses  []string          `json:"statuses" db:"statuses"`
+	Projects  []string          `json:"projects" db:"projects"`
+	Fields    map[string]string `json:"fields,omitempty" db:"fields"`
+	Enabled   bool              `json:"enabled" db:"enabled"`
+	CreatedAt time.Time         `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time         `json:"updated_at" db:"updated_at"`
+}
+
+// WebhookSubscriptionUpdate holds the fields of a subscription that can be
+// changed; nil fields are left untouched
+type WebhookSubscriptionUpdate struct {
+	URL      *string            `json:"url"`
+	Secret   *string            `json:"secret"`
+	Events   *[]string          `json:"events"`
+	Statuses *[]string          `json:"statuses"`
+	Projects *[]string          `json:"projects"`
+	Fields   *map[string]string `json:"fields"`
+	Enabled  *bool              `json:"enabled"`
+}
+
+// Apply copies the set fields onto subscription
+func (wu *WebhookSubscriptionUpdate) Apply(subscription *WebhookSubscription) {
+	if wu.URL != nil {
+		subscription.URL = *wu.URL
+	}
+	if wu.Secret != nil {
+		subscription.Secret = *wu.Secret
+	}
+	if wu.Events != nil {
+		subscription.Events = *wu.Events
+	}
+	if wu.Statuses != nil {
+		subscription.Statuses = *wu.Statuses
+	}
+	if wu.Projects != nil {
+		subscription.Projects = *wu.Projects
+	}
+	if wu.Fields != nil {
+		subscription.Fields = *wu.Fields
+	}
+	if wu.Enabled != nil {
+		subscription.Enabled = *wu.Enabled
+	}
+}
+
+// Validate checks the URL, event and status filters and field paths of a
+// subscription
+func (ws *WebhookSubscription) Validate() error {
+	u, err := url.Parse(ws.URL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("url must be an absolute http or https URL")
+	}
+	for _, event := range ws.Events {
+		if !webhookEvents[event] {
+			return fmt.Errorf("unknown event %q", event)
+		}
+	}
+	for _, status := range ws.Statuses {
+		if !webhookStatuses[status] {
+			return fmt.Errorf("unknown status %q", status)
+		}
+	}
+	for key, expr := range ws.Fields {
+		if key == "" {
+			return fmt.Errorf("field names must not be empty")
+		}
+		if _, err := compileJSONPath(expr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Matches reports whether the subscription wants the event
+func (ws *WebhookSubscription) Matches(event BuildEvent) bool {
+	if !ws.Enabled {
+		return false
+	}
+	if len(ws.Events) > 0 && !slices.Contains(ws.Events, webhookEvent(event.Build.Status)) {
+		return false
+	}
+	if len(ws.Statuses) > 0 && !slices.Contains(ws.Statuses, event.Build.Status) {
+		return false
+	}
+	return len(ws.Projects) == 0 || slices.Contains(ws.Projects, event.Build.ProjectName)
+}
+
+// Payload renders the event for the subscription: the whole event, or only
+// the configured fields. Fields whose path matches nothing are null.
+func (ws *WebhookSubscription) Payload(event BuildEvent) ([]byte, error) {
+	body, err := json.Marshal(event)
+	if err != nil || len(ws.Fields) == 0 {
+		return body, err
+	}
+
+	var doc interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, err
+	}
+
+	projected := make(map[string]interface{}, len(ws.Fields))
+	for key, expr := range ws.Fields {
+		path, err := compileJSONPath(expr)
+		if err != nil {
+			return nil, err
+		}
+		projected[key], _ = path.Evaluate(doc)
+	}
+	return json.Marshal(projected)
+}
+
+// webhookIntegration is the integration health name of a subscription
+func webhookIntegration(id int) string {
+	return fmt.Sprintf("webhook:%d", id)
+}
+
+// WebhookSink delivers build events to the matching webhook subscriptions,
+// recording each delivery and retrying failed ones
+type WebhookSink struct {
+	db     DatabaseInterface
+	health *IntegrationHealth
+	client *http.Client
+	// maxAttempts is how many times a delivery is sent before it fails
+	maxAttempts   int
+	retryInterval time.Duration
+	// retention is how long the delivery history is kept
+	retention time.Duration
+}
+
+// NewWebhookSinkFromEnv creates the sink for webhook subscriptions
+func NewWebhookSinkFromEnv(db DatabaseInterface, health *IntegrationHealth) *WebhookSink {
+	return &WebhookSink{
+		db:            db,
+		health:        health,
+		client:        &http.Client{Timeout: 10 * time.Second},
+		maxAttempts:   max(getEnvInt("WEBHOOK_MAX_ATTEMPTS", 8), 1),
+		retryInterval: getEnvDuration("WEBHOOK_RETRY_INTERVAL", 10*time.Second),
+		retention:     getEnvDuration("WEBHOOK_DELIVERY_RETENTION", 30*24*time.Hour),
+	}
+}
+
+// Name identifies the integration
+func (ws *WebhookSink) Name() string {
+	return "webhooks"
+}
+
+// Deliver posts the event to every matching subscription. Each subscription
+// is tracked as its own integration, so one failing receiver is disabled
+// without affecting the others. Failed deliveries are retried in the
+// background; only those that can't be recorded or have run out of attempts
+// are reported.
+func (ws *WebhookSink) Deliver(ctx context.Context, event BuildEvent) error {
+	subscriptions, err := ws.db.ListWebhookSubscriptions()
+	if err != nil {
+		return fmt.Errorf("listing webhook subscriptions: %w", err)
+	}
+
+	var errs []error
+	for _, subscription := range subscriptions {
+		name := webhookIntegration(subscription.ID)
+		if !subscription.Matches(event) || !ws.health.Allow(name) {
+			continue
+		}
+
+		payload, err := subscription.Payload(event)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("webhook %d: %w", subscription.ID, err))
+			continue
+		}
+		delivery := &WebhookDelivery{
+			SubscriptionID: subscription.ID,
+			BuildID:        event.Build.ID,
+			Event:          webhookEvent(event.Build.Status),
+			BuildStatus:    event.Build.Status,
+			Payload:        payload,
+			Status:         deliveryPending,
+		}
+		if err := ws.db.CreateWebhookDelivery(delivery); err != nil {
+			errs = append(errs, fmt.Errorf("webhook %d: recording delivery: %w", subscription.ID, err))
+			continue
+		}
+
+		if err := ws.attempt(ctx, subscription, delivery, &event.Build); err != nil && delivery.Status == deliveryFailed {
+			errs = append(errs, fmt.Errorf("webhook %d: %w", subscription.ID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// post sends one delivery, signed with the subscription's secret when it has
+// one, returning the receiver's response status
+func (ws *WebhookSink) post(ctx context.Context, subscription *WebhookSubscription, delivery *WebhookDelivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", subscription.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Build-Event", delivery.BuildStatus)
+	req.Header.Set("X-Build-Lifecycle-Event", "build."+delivery.Event)
+	req.Header.Set("X-Build-Delivery", strconv.Itoa(delivery.ID))
+	if subscription.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(subscription.Secret))
+		mac.Write(delivery.Payload)
+		req.Header.Set("X-Build-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := ws.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	if resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// redactSecret hides the secret of a subscription in API responses
+func redactSecret(subscription *WebhookSubscription) {
+	if subscription.Secret != "" {
+		subscription.Secret = redactedValue
+	}
+}
+
+// Create webhook subscription endpoint
+func (bs *BuildService) createWebhookSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	subscription := WebhookSubscription{Enabled: true}
+	if err := json.NewDecoder(r.Body).Decode(&subscription); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := subscription.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := bs.db.CreateWebhookSubscription(&subscription); err != nil {
+		log.Printf("Error creating webhook subscription: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	redactSecret(&subscription)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(subscription)
+}
+
+// List webhook subscriptions endpoint
+func (bs *BuildService) listWebhookSubscriptionsHandler(w http.ResponseWriter, r *http.Request) {
+	subscriptions, err := bs.db.ListWebhookSubscriptions()
+	if err != nil {
+		log.Printf("Error listing webhook subscriptions: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	for _, subscription := range subscriptions {
+		redactSecret(subscription)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(subscriptions)
+}
+
+// webhookSubscription loads the subscription named in the request path,
+// writing an error response when it can't
+func (bs *BuildService) webhookSubscription(w http.ResponseWriter, r *http.Request) (*WebhookSubscription, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid webhook subscription ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	subscription, err := bs.db.GetWebhookSubscription(id)
+	if err != nil {
+		if err.Error() == "webhook subscription not found" {
+			http.Error(w, "Webhook subscription not found", http.StatusNotFound)
+			return nil, false
+		}
+		log.Printf("Error getting webhook subscription: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return nil, false
+	}
+	return subscription, true
+}
+
+// Get webhook subscription endpoint
+func (bs *BuildService) getWebhookSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	subscription, ok := bs.webhookSubscription(w, r)
+	if !ok {
+		return
+	}
+
+	redactSecret(subscription)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(subscription)
+}
+
+// Update webhook subscription endpoint
+func (bs *BuildService) updateWebhookSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	var update WebhookSubscriptionUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	subscription, ok := bs.webhookSubscription(w, r)
+	if !ok {
+		return
+	}
+
+	update.Apply(subscription)
+	if err := subscription.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	subscription.UpdatedAt = time.Now().UTC()
+
+	if err := bs.db.UpdateWebhookSubscription(subscription); err != nil {
+		log.Printf("Error updating webhook subscription: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	redactSecret(subscription)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(subscription)
+}
+
+// Delete webhook subscription endpoint
+func (bs *BuildService) deleteWebhookSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid webhook subscription ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := bs.db.DeleteWebhookSubscription(id); err != nil {
+		if err.Error() == "webhook subscription not found" {
+			http.Error(w, "Webhook subscription not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error deleting webhook subscription: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookSubscriptionValidate(t *testing.T) {
+	tests := []struct {
+		name         string
+		subscription WebhookSubscription
+		valid        bool
+	}{
+		{"minimal", WebhookSubscription{URL: "https://example.com/hook"}, true},
+		{"filters and fields", WebhookSubscription{URL: "http://example.com", Statuses: []string{"failed", "timeout"}, Fields: map[string]string{"id": "$.build.id"}}, true},
+		{"relative url", WebhookSubscription{URL: "/hook"}, false},
+		{"unsupported scheme", WebhookSubscription{URL: "ftp://example.com"}, false},
+		{"unknown status", WebhookSubscription{URL: "https://example.com", Statuses: []string{"done"}}, false},
+		{"lifecycle events", WebhookSubscription{URL: "https://example.com", Events: []string{"created", "completed"}}, true},
+		{"unknown event", WebhookSubscription{URL: "https://example.com", Events: []string{"finished"}}, false},
+		{"invalid path", WebhookSubscription{URL: "https://example.com", Fields: map[string]string{"id": "build.id"}}, false},
+		{"empty field name", WebhookSubscription{URL: "https://example.com", Fields: map[string]string{"": "$.build.id"}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.subscription.Validate()
+			assert.Equal(t, tt.valid, err == nil, "%v", err)
+		})
+	}
+}
+
+func TestWebhookSubscriptionMatches(t *testing.T) {
+	event := BuildEvent{Build: BuildRequest{ID: 1, ProjectName: "api", Status: "failed"}}
+
+	assert.True(t, (&WebhookSubscription{Enabled: true}).Matches(event))
+	assert.True(t, (&WebhookSubscription{Enabled: true, Statuses: []string{"failed"}, Projects: []string{"api"}}).Matches(event))
+	assert.False(t, (&WebhookSubscription{}).Matches(event))
+	assert.False(t, (&WebhookSubscription{Enabled: true, Statuses: []string{"success"}}).Matches(event))
+	assert.False(t, (&WebhookSubscription{Enabled: true, Projects: []string{"web"}}).Matches(event))
+	assert.True(t, (&WebhookSubscription{Enabled: true, Events: []string{"completed"}}).Matches(event))
+	assert.False(t, (&WebhookSubscription{Enabled: true, Events: []string{"created", "started"}}).Matches(event))
+}
+
+func TestWebhookSubscriptionPayload(t *testing.T) {
+	event := BuildEvent{Build: BuildRequest{ID: 7, ProjectName: "api", Status: "success"}, Time: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+
+	full, err := (&WebhookSubscription{}).Payload(event)
+	require.NoError(t, err)
+	var decoded BuildEvent
+	require.NoError(t, json.Unmarshal(full, &decoded))
+	assert.Equal(t, 7, decoded.Build.ID)
+
+	projected, err := (&WebhookSubscription{Fields: map[string]string{
+		"id":      "$.build.id",
+		"project": "$['build']['project_name']",
+		"missing": "$.build.nothing",
+	}}).Payload(event)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"id": 7, "project": "api", "missing": null}`, string(projected))
+}
+
+func TestWebhookSinkDeliver(t *testing.T) {
+	type received struct {
+		body      []byte
+		signature string
+		event     string
+	}
+	deliveries := make(chan received, 4)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		deliveries <- received{body, r.Header.Get("X-Build-Signature-256"), r.Header.Get("X-Build-Event")}
+		if r.URL.Path == "/broken" {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer server.Close()
+
+	service, _ := setupTestService()
+	mockDB := new(MockDatabase)
+	sink := NewWebhookSinkFromEnv(mockDB, NewIntegrationHealth(mockDB, service.errors, &service.metrics.Integrations))
+
+	mockDB.On("ListWebhookSubscriptions").Return([]*WebhookSubscription{
+		{ID: 1, URL: server.URL + "/signed", Secret: "s3cret", Enabled: true, Fields: map[string]string{"id": "$.build.id"}},
+		{ID: 2, URL: server.URL + "/other-project", Enabled: true, Projects: []string{"web"}},
+		{ID: 3, URL: server.URL + "/disabled", Enabled: false},
+		{ID: 4, URL: server.URL + "/broken", Enabled: true, Statuses: []string{"failed"}},
+		{ID: 5, URL: server.URL + "/unhealthy", Enabled: true},
+	}, nil).Once()
+	mockDB.On("GetIntegration", "webhook:1").Return(nil, fmt.Errorf("integration not found")).Once()
+	mockDB.On("GetIntegration", "webhook:4").Return(nil, fmt.Errorf("integration not found")).Once()
+	disabledAt := time.Now()
+	mockDB.On("GetIntegration", "webhook:5").Return(&IntegrationState{Name: "webhook:5", DisabledAt: &disabledAt}, nil).Once()
+	mockDB.On("ResetIntegrationFailures", "webhook:1").Return(nil).Once()
+	mockDB.On("RecordIntegrationFailure", "webhook:4", mock.AnythingOfType("string"), 10).Return(&IntegrationState{Name: "webhook:4", ConsecutiveFailures: 1}, nil).Once()
+	var recorded []*WebhookDelivery
+	mockDB.On("CreateWebhookDelivery", mock.AnythingOfType("*main.WebhookDelivery")).Run(func(args mock.Arguments) {
+		delivery := args.Get(0).(*WebhookDelivery)
+		delivery.ID = 100 + delivery.SubscriptionID
+		recorded = append(recorded, delivery)
+	}).Return(nil).Twice()
+	mockDB.On("UpdateWebhookDelivery", mock.AnythingOfType("*main.WebhookDelivery")).Return(nil).Twice()
+	// Give up on the first failure
+	sink.maxAttempts = 1
+
+	err := sink.Deliver(context.Background(), BuildEvent{Build: BuildRequest{ID: 9, ProjectName: "api", Status: "failed"}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "webhook 4: unexpected status 502")
+
+	close(deliveries)
+	var got []received
+	for d := range deliveries {
+		got = append(got, d)
+	}
+	require.Len(t, got, 2)
+
+	signed := got[0]
+	if signed.signature == "" {
+		signed = got[1]
+	}
+	assert.JSONEq(t, `{"id": 9}`, string(signed.body))
+	assert.Equal(t, "failed", signed.event)
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(signed.body)
+	assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), signed.signature)
+
+	require.Len(t, recorded, 2)
+	assert.Equal(t, deliveryDelivered, recorded[0].Status)
+	assert.Equal(t, "completed", recorded[0].Event)
+	assert.Equal(t, deliveryFailed, recorded[1].Status)
+	assert.Equal(t, http.StatusBadGateway, recorded[1].ResponseStatus)
+	assert.Equal(t, 1, recorded[1].Attempts)
+
+	mockDB.AssertExpectations(t)
+}
+
+func TestCreateWebhookSubscriptionHandler(t *testing.T) {
+	tests := []struct {
+		name           string
+		body           string
+		expectedStatus int
+	}{
+		{"valid", `{"url": "https://example.com/hook", "secret": "s3cret", "statuses": ["failed"], "fields": {"id": "$.build.id"}}`, http.StatusCreated},
+		{"invalid body", `{`, http.StatusBadRequest},
+		{"invalid path", `{"url": "https://example.com/hook", "fields": {"id": "$.build[x]"}}`, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service, mockDB := setupTestService()
+			if tt.expectedStatus == http.StatusCreated {
+				mockDB.On("CreateWebhookSubscription", mock.MatchedBy(func(s *WebhookSubscription) bool {
+					return s.Enabled && s.Secret == "s3cret" && s.Fields["id"] == "$.build.id"
+				})).Run(func(args mock.Arguments) {
+					args.Get(0).(*WebhookSubscription).ID = 3
+				}).Return(nil).Once()
+			}
+
+			rr := httptest.NewRecorder()
+			service.createWebhookSubscriptionHandler(rr, httptest.NewRequest("POST", "/api/v1/webhooks/subscriptions", bytes.NewBufferString(tt.body)))
+
+			assert.Equal(t, tt.expectedStatus, rr.Code)
+			if tt.expectedStatus == http.StatusCreated {
+				var subscription WebhookSubscription
+				require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &subscription))
+				assert.Equal(t, 3, subscription.ID)
+				assert.Equal(t, redactedValue, subscription.Secret)
+			}
+			mockDB.AssertExpectations(t)
+		})
+	}
+}
+
+func TestWebhookSubscriptionHandlers(t *testing.T) {
+	service, _ := setupTestService()
+	mockDB := new(MockDatabase)
+	service.db = mockDB
+
+	mockDB.On("ListWebhookSubscriptions").Return([]*WebhookSubscription{{ID: 1, URL: "https://example.com", Secret: "s3cret", Enabled: true}}, nil).Once()
+	mockDB.On("GetWebhookSubscription", 1).Return(&WebhookSubscription{ID: 1, URL: "https://example.com", Enabled: true}, nil).Twice()
+	mockDB.On("GetWebhookSubscription", 2).Return(nil, fmt.Errorf("webhook subscription not found")).Once()
+	mockDB.On("UpdateWebhookSubscription", mock.MatchedBy(func(s *WebhookSubscription) bool {
+		return !s.Enabled && s.URL == "https://example.com"
+	})).Return(nil).Once()
+	mockDB.On("DeleteWebhookSubscription", 1).Return(nil).Once()
+	mockDB.On("DeleteWebhookSubscription", 2).Return(fmt.Errorf("webhook subscription not found")).Once()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/webhooks/subscriptions", service.listWebhookSubscriptionsHandler).Methods("GET")
+	router.HandleFunc("/api/v1/webhooks/subscriptions/{id}", service.getWebhookSubscriptionHandler).Methods("GET")
+	router.HandleFunc("/api/v1/webhooks/subscriptions/{id}", service.updateWebhookSubscriptionHandler).Methods("PATCH")
+	router.HandleFunc("/api/v1/webhooks/subscriptions/{id}", service.deleteWebhookSubscriptionHandler).Methods("DELETE")
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/webhooks/subscriptions", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var subscriptions []WebhookSubscription
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &subscriptions))
+	require.Len(t, subscriptions, 1)
+	assert.Equal(t, redactedValue, subscriptions[0].Secret)
+
+	for _, tc := range []struct {
+		method, path, body string
+		expected           int
+	}{
+		{"GET", "/api/v1/webhooks/subscriptions/1", "", http.StatusOK},
+		{"GET", "/api/v1/webhooks/subscriptions/2", "", http.StatusNotFound},
+		{"GET", "/api/v1/webhooks/subscriptions/x", "", http.StatusBadRequest},
+		{"PATCH", "/api/v1/webhooks/subscriptions/1", `{"enabled": false}`, http.StatusOK},
+		{"DELETE", "/api/v1/webhooks/subscriptions/1", "", http.StatusNoContent},
+		{"DELETE", "/api/v1/webhooks/subscriptions/2", "", http.StatusNotFound},
+	} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(tc.method, tc.path, bytes.NewBufferString(tc.body)))
+		assert.Equal(t, tc.expected, rr.Code, tc.method+" "+tc.path)
+	}
+
+	mockDB.AssertExpectations(t)
+}
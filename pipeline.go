@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// pipelineFile is the repository file that declares a build's pipeline
+const pipelineFile = ".buildservice.yml"
+
+// maxPipelineBytes caps the size of a pipeline file
+const maxPipelineBytes = 256 * 1024
+
+var (
+	stageNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+	envNamePattern   = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// PipelineConfig is a build pipeline declared by a repository, replacing the
+// detected build tool's steps
+type PipelineConfig struct {
+	// Image is the container image the docker executor runs the steps in
+	Image string `yaml:"image"`
+	// Env is added to the environment of every step
+	Env map[string]string `yaml:"env"`
+	// Matrix runs the pipeline once per combination of its values, replacing
+	// the project's matrix
+	Matrix BuildMatrix     `yaml:"matrix"`
+	Stages []PipelineStage `yaml:"stages"`
+	// Artifacts are glob patterns, relative to the repository root, of the
+	// files published as the build's artifacts once every stage has passed
+	Artifacts []string `yaml:"artifacts"`
+}
+
+// PipelineStage is a named group of shell commands run in order
+type PipelineStage struct {
+	Name string `yaml:"name"`
+	// Env is added to the environment of the stage's steps, overriding the
+	// pipeline's
+	Env   map[string]string `yaml:"env"`
+	Steps []string          `yaml:"steps"`
+}
+
+// ArtifactPublisher stores the artifacts a pipeline produces
+type ArtifactPublisher interface {
+	Publish(ctx context.Context, build *BuildRequest, step int, name string, r io.Reader, size int64) (*Artifact, error)
+}
+
+// loadPipeline reads the pipeline file of a checkout, returning nil when the
+// repository doesn't have one
+func loadPipeline(dir string) (*PipelineConfig, error) {
+	data, err := os.ReadFile(filepath.Join(dir, pipelineFile))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("reading %s: %w", pipelineFile, err)
+	}
+	if len(data) > maxPipelineBytes {
+		return nil, fmt.Errorf("%s is larger than %d bytes", pipelineFile, maxPipelineBytes)
+	}
+	return parsePipeline(data)
+}
+
+// parsePipeline decodes and validates a pipeline file. Unknown keys are
+// rejected so that typos don't silently change what a build runs.
+func parsePipeline(data []byte) (*PipelineConfig, error) {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+
+	var config PipelineConfig
+	if err := decoder.Decode(&config); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("%s is empty", pipelineFile)
+		}
+		return nil, fmt.Errorf("parsing %s: %w", pipelineFile, err)
+	}
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", pipelineFile, err)
+	}
+	return &config, nil
+}
+
+func (pc *PipelineConfig) validate() error {
+	if len(pc.Stages) == 0 {
+		return errors.New("at least one stage is required")
+	}
+	if err := validateEnv(pc.Env); err != nil {
+		return err
+	}
+	if err := pc.Matrix.validate(); err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	for i, stage := range pc.Stages {
+		switch {
+		case stage.Name == "":
+			return fmt.Errorf("stage %d has no name", i+1)
+		case !stageNamePattern.MatchString(stage.Name):
+			return fmt.Errorf("stage name %q must be lowercase letters, digits, '-' or '_'", stage.Name)
+		case stage.Name == "clone" || stage.Name == "artifacts" || stage.Name == "release":
+			return fmt.Errorf("stage name %q is reserved", stage.Name)
+		case seen[stage.Name]:
+			return fmt.Errorf("duplicate stage %q", stage.Name)
+		case len(stage.Steps) == 0:
+			return fmt.Errorf("stage %q has no steps", stage.Name)
+		}
+		seen[stage.Name] = true
+
+		for j, step := range stage.Steps {
+			if step == "" {
+				return fmt.Errorf("stage %q step %d is empty", stage.Name, j+1)
+			}
+		}
+		if err := validateEnv(stage.Env); err != nil {
+			return fmt.Errorf("stage %q: %w", stage.Name, err)
+		}
+	}
+
+	for _, pattern := range pc.Artifacts {
+		if !validArtifactName(pattern) {
+			return fmt.Errorf("artifact pattern %q must be a relative path inside the repository", pattern)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("artifact pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+func validateEnv(env map[string]string) error {
+	for name := range env {
+		if !envNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid environment variable name %q", name)
+		}
+	}
+	return nil
+}
+
+// stageGroups returns the pipeline's stages as shell commands
+func (pc *PipelineConfig) stageGroups() []stageGroup {
+	groups := make([]stageGroup, len(pc.Stages))
+	for i, stage := range pc.Stages {
+		groups[i].name = stage.Name
+		for _, step := range stage.Steps {
+			groups[i].steps = append(groups[i].steps, []string{"sh", "-c", step})
+		}
+	}
+	return groups
+}
+
+// commands lists every step of the pipeline in the order they run
+func (pc *PipelineConfig) commands() []string {
+	var commands []string
+	for _, stage := range pc.Stages {
+		commands = append(commands, stage.Steps...)
+	}
+	return commands
+}
+
+// stageEnv returns the environment the pipeline adds to a stage's steps
+func (pc *PipelineConfig) stageEnv(name string) []string {
+	env := envList(pc.Env)
+	for _, stage := range pc.Stages {
+		if stage.Name == name {
+			env = append(env, envList(stage.Env)...)
+		}
+	}
+	return env
+}
+
+// envList formats environment variables as sorted NAME=value pairs
+func envList(env map[string]string) []string {
+	list := make([]string, 0, len(env))
+	for name, value := range env {
+		list = append(list, name+"="+value)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// publishArtifacts uploads the files matching the pipeline's artifact
+// patterns as artifacts of the given stage, returning an error when one of
+// them can't be published. Patterns matching nothing are reported in the build
+// output but don't fail the build.
+func (le *LocalExecutor) publishArtifacts(ctx context.Context, srcDir string, output io.Writer, build *BuildRequest, step int, patterns []string) error {
+	published := make(map[string]bool)
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(filepath.Join(srcDir, filepath.FromSlash(pattern)))
+		if err != nil {
+			return fmt.Errorf("artifact pattern %q: %w", pattern, err)
+		}
+
+		found := false
+		for _, match := range matches {
+			info, err := os.Lstat(match)
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			rel, err := filepath.Rel(srcDir, match)
+			if err != nil {
+				return err
+			}
+			name := filepath.ToSlash(rel)
+			found = true
+			if published[name] {
+				continue
+			}
+
+			if err := le.publishArtifact(ctx, build, step, name, match, info.Size()); err != nil {
+				return fmt.Errorf("publishing %s: %w", name, err)
+			}
+			published[name] = true
+			fmt.Fprintf(output, "published artifact %s (%d bytes)\n", name, info.Size())
+		}
+		if !found {
+			fmt.Fprintf(output, "no files match artifact pattern %s\n", pattern)
+		}
+	}
+	return nil
+}
+
+func (le *LocalExecutor) publishArtifact(ctx context.Context, build *BuildRequest, step int, name, file string, size int64) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = le.Artifacts.Publish(ctx, build, step, name, f, size)
+	return err
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePipeline(t *testing.T) {
+	config, err := parsePipeline([]byte(`
+env:
+  GOFLAGS: -mod=vendor
+stages:
+  - name: build
+    steps:
+      - go build ./...
+  - name: test
+    env:
+      GOFLAGS: -race
+    steps:
+      - go test ./...
+artifacts:
+  - dist/*.tar.gz
+`))
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"go build ./...", "go test ./..."}, config.commands())
+	assert.Equal(t, []string{"dist/*.tar.gz"}, config.Artifacts)
+	assert.Equal(t, []stageGroup{
+		{name: "build", steps: [][]string{{"sh", "-c", "go build ./..."}}},
+		{name: "test", steps: [][]string{{"sh", "-c", "go test ./..."}}},
+	}, config.stageGroups())
+	assert.Equal(t, []string{"GOFLAGS=-mod=vendor"}, config.stageEnv("build"))
+	assert.Equal(t, []string{"GOFLAGS=-mod=vendor", "GOFLAGS=-race"}, config.stageEnv("test"))
+}
+
+func TestParsePipelineRejectsInvalidConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr string
+	}{
+		{name: "empty", config: "", wantErr: "is empty"},
+		{name: "no stages", config: "env:\n  A: b\n", wantErr: "at least one stage"},
+		{name: "unknown key", config: "stages:\n  - name: build\n    script: [make]\n", wantErr: "field script not found"},
+		{name: "unnamed stage", config: "stages:\n  - steps: [make]\n", wantErr: "stage 1 has no name"},
+		{name: "bad stage name", config: "stages:\n  - name: Build Step\n    steps: [make]\n", wantErr: "must be lowercase"},
+		{name: "reserved stage name", config: "stages:\n  - name: clone\n    steps: [make]\n", wantErr: "reserved"},
+		{name: "reserved release stage", config: "stages:\n  - name: release\n    steps: [make]\n", wantErr: "reserved"},
+		{name: "duplicate stage", config: "stages:\n  - name: build\n    steps: [make]\n  - name: build\n    steps: [make]\n", wantErr: "duplicate stage"},
+		{name: "no steps", config: "stages:\n  - name: build\n", wantErr: "has no steps"},
+		{name: "empty step", config: "stages:\n  - name: build\n    steps: ['']\n", wantErr: "step 1 is empty"},
+		{name: "bad env name", config: "env:\n  BAD-NAME: x\nstages:\n  - name: build\n    steps: [make]\n", wantErr: "invalid environment variable"},
+		{name: "escaping artifact", config: "stages:\n  - name: build\n    steps: [make]\nartifacts: [../secret]\n", wantErr: "relative path"},
+		{name: "absolute artifact", config: "stages:\n  - name: build\n    steps: [make]\nartifacts: [/etc/passwd]\n", wantErr: "relative path"},
+		{name: "bad artifact pattern", config: "stages:\n  - name: build\n    steps: [make]\nartifacts: ['dist/[']\n", wantErr: "syntax error in pattern"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parsePipeline([]byte(tt.config))
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
+
+func TestLoadPipelineWithoutFile(t *testing.T) {
+	config, err := loadPipeline(t.TempDir())
+	require.NoError(t, err)
+	assert.Nil(t, config)
+}
+
+// recordingPublisher keeps published artifacts in memory
+type recordingPublisher struct {
+	artifacts map[string]string
+	step      int
+	err       error
+}
+
+func (rp *recordingPublisher) Publish(ctx context.Context, build *BuildRequest, step int, name string, r io.Reader, size int64) (*Artifact, error) {
+	if rp.err != nil {
+		return nil, rp.err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	rp.artifacts[name] = string(data)
+	rp.step = step
+	return &Artifact{BuildID: build.ID, Name: name, Size: size}, nil
+}
+
+// newPipelineRepo creates a git repository containing the given files
+func newPipelineRepo(t *testing.T, files map[string]string) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	repo := t.TempDir()
+	for name, content := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(repo, name), []byte(content), 0o644))
+	}
+	for _, args := range [][]string{
+		{"init", "-q", "-b", "main"},
+		{"add", "."},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "init"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repo
+		require.NoError(t, cmd.Run())
+	}
+	return repo
+}
+
+func executePipeline(t *testing.T, repo string, publisher ArtifactPublisher) *BuildResult {
+	t.Helper()
+	executor := NewLocalExecutor(t.TempDir())
+	executor.AllowedProtocols = append(executor.AllowedProtocols, "file")
+	executor.Artifacts = publisher
+
+	result, err := executor.Execute(context.Background(), &BuildRequest{
+		ID:          1,
+		ProjectName: "test-project",
+		GitURL:      "file://" + repo,
+		Branch:      "main",
+	})
+	require.NoError(t, err)
+	return result
+}
+
+func TestLocalExecutorRunsPipeline(t *testing.T) {
+	repo := newPipelineRepo(t, map[string]string{
+		// A Makefile that would fail shows the pipeline replaces detection
+		"Makefile": "all:\n\t@exit 1\n",
+		pipelineFile: `
+env:
+  GREETING: hello
+stages:
+  - name: compile
+    steps:
+      - mkdir -p dist
+      - echo "$GREETING $TARGET" > dist/out.txt
+    env:
+      TARGET: world
+  - name: verify
+    steps:
+      - grep -q "hello world" dist/out.txt
+artifacts:
+  - dist/*.txt
+  - missing/*
+`,
+	})
+
+	publisher := &recordingPublisher{artifacts: map[string]string{}}
+	result := executePipeline(t, repo, publisher)
+
+	assert.Equal(t, "success", result.Status, string(result.Output))
+	assert.Equal(t, "pipeline", result.Tool)
+	assert.Equal(t, []string{"mkdir -p dist", `echo "$GREETING $TARGET" > dist/out.txt`, `grep -q "hello world" dist/out.txt`}, result.Steps)
+	assert.Equal(t, map[string]string{"dist/out.txt": "hello world\n"}, publisher.artifacts)
+
+	var names []string
+	for _, stage := range result.Stages {
+		names = append(names, stage.Name)
+		assert.Equal(t, "success", stage.Status)
+	}
+	assert.Equal(t, []string{"clone", "compile", "verify", "artifacts"}, names)
+	assert.Equal(t, 3, publisher.step)
+	assert.Contains(t, result.Stages[3].Log, "no files match artifact pattern missing/*")
+}
+
+func TestLocalExecutorPipelineFailures(t *testing.T) {
+	t.Run("failing stage skips the rest", func(t *testing.T) {
+		repo := newPipelineRepo(t, map[string]string{
+			pipelineFile: "stages:\n  - name: build\n    steps: ['exit 4']\n  - name: test\n    steps: ['true']\nartifacts: ['*']\n",
+		})
+
+		publisher := &recordingPublisher{artifacts: map[string]string{}}
+		result := executePipeline(t, repo, publisher)
+
+		assert.Equal(t, "failed", result.Status)
+		assert.Equal(t, 4, result.ExitCode)
+		require.Len(t, result.Stages, 3)
+		assert.Equal(t, "failed", result.Stages[1].Status)
+		assert.Equal(t, "skipped", result.Stages[2].Status)
+		assert.Empty(t, publisher.artifacts)
+	})
+
+	t.Run("invalid config", func(t *testing.T) {
+		repo := newPipelineRepo(t, map[string]string{
+			pipelineFile: "stages: []\n",
+		})
+
+		result := executePipeline(t, repo, nil)
+
+		assert.Equal(t, "failed", result.Status)
+		assert.Equal(t, -1, result.ExitCode)
+		assert.Contains(t, string(result.Output), "invalid .buildservice.yml: at least one stage is required")
+		require.Len(t, result.Stages, 1)
+	})
+
+	t.Run("artifact publishing error", func(t *testing.T) {
+		repo := newPipelineRepo(t, map[string]string{
+			pipelineFile: "stages:\n  - name: build\n    steps: ['echo ok > out.txt']\nartifacts: [out.txt]\n",
+		})
+
+		result := executePipeline(t, repo, &recordingPublisher{err: fmt.Errorf("store unavailable")})
+
+		assert.Equal(t, "failed", result.Status)
+		assert.Equal(t, -1, result.ExitCode)
+		require.Len(t, result.Stages, 3)
+		assert.Equal(t, "artifacts", result.Stages[2].Name)
+		assert.Equal(t, "failed", result.Stages[2].Status)
+		assert.Contains(t, result.Stages[2].Log, "publishing out.txt: store unavailable")
+	})
+}
+
+func TestArtifactManagerPublish(t *testing.T) {
+	mockDB := new(MockDatabase)
+	store := NewLocalArtifactStore(t.TempDir())
+	manager := NewArtifactManager(mockDB, store, nil)
+
+	mockDB.On("GetProjectByName", "api").Return(nil, fmt.Errorf("project not found"))
+	mockDB.On("CreateArtifact", mock.AnythingOfType("*main.Artifact")).Return(7, nil)
+
+	build := &BuildRequest{ID: 3, ProjectName: "api"}
+	artifact, err := manager.Publish(context.Background(), build, 4, "dist/app.txt", bytes.NewReader([]byte("app")), 3)
+	require.NoError(t, err)
+
+	assert.Equal(t, 7, artifact.ID)
+	assert.Equal(t, 4, *artifact.Step)
+	assert.True(t, artifact.Published)
+	assert.Equal(t, "builds/3/dist/app.txt", artifact.StorageKey)
+	assert.Equal(t, "text/plain; charset=utf-8", artifact.ContentType)
+	assert.Len(t, artifact.SHA256, 64)
+
+	r, err := store.Get(context.Background(), artifact.StorageKey)
+	require.NoError(t, err)
+	defer r.Close()
+	data, _ := io.ReadAll(r)
+	assert.Equal(t, "app", string(data))
+}
+
+func TestArtifactManagerPublishRespectsTagPattern(t *testing.T) {
+	mockDB := new(MockDatabase)
+	manager := NewArtifactManager(mockDB, NewLocalArtifactStore(t.TempDir()), nil)
+
+	mockDB.On("GetProjectByName", "api").Return(&Project{Name: "api", ArtifactTagPattern: "v*"}, nil)
+
+	_, err := manager.Publish(context.Background(), &BuildRequest{ID: 3, ProjectName: "api", Branch: "main"}, 2, "app", bytes.NewReader(nil), 0)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "only publishes artifacts for tags matching v*")
+	mockDB.AssertNotCalled(t, "CreateArtifact", mock.Anything)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// pipelineStatusContext names the commit status reporting pipeline validation
+const pipelineStatusContext = "buildservice/pipeline"
+
+// PipelineValidation is the result of validating a pipeline file
+type PipelineValidation struct {
+	Valid  bool     `json:"valid"`
+	Errors []string `json:"errors"`
+	// Stages lists the stages a valid pipeline runs, in order
+	Stages []string `json:"stages,omitempty"`
+}
+
+// validatePipelineFile checks a proposed pipeline file the same way builds load
+// it, and its image against policy. buildImage is the project's build_image,
+// which builds run in instead of the pipeline's image.
+func validatePipelineFile(data []byte, policy *ImagePolicy, buildImage string) *PipelineValidation {
+	result := &PipelineValidation{Errors: []string{}}
+	if len(data) > maxPipelineBytes {
+		result.Errors = append(result.Errors, fmt.Sprintf("%s is larger than %d bytes", pipelineFile, maxPipelineBytes))
+		return result
+	}
+
+	config, err := parsePipeline(data)
+	if err != nil {
+		result.Errors = append(result.Errors, err.Error())
+		return result
+	}
+
+	image := config.Image
+	if buildImage != "" {
+		image = buildImage
+	}
+	if err := policy.Check(image, config); err != nil {
+		result.Errors = append(result.Errors, err.Error())
+		return result
+	}
+
+	result.Valid = true
+	for _, stage := range config.Stages {
+		result.Stages = append(result.Stages, stage.Name)
+	}
+	return result
+}
+
+// Validate pipeline endpoint. The request body is the proposed pipeline file,
+// checked against the image policy of the project named in ?project= if any.
+func (bs *BuildService) validatePipelineHandler(w http.ResponseWriter, r *http.Request) {
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxPipelineBytes+1))
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var policy *ImagePolicy
+	var buildImage string
+	if name := r.URL.Query().Get("project"); name != "" {
+		project, err := bs.db.GetProjectByName(name)
+		if err != nil {
+			if err.Error() == "project not found" {
+				http.Error(w, "Project not found", http.StatusNotFound)
+				return
+			}
+			log.Printf("Error getting project: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		policy, buildImage = bs.imagePolicy(project.GitURL), project.BuildImage
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(validatePipelineFile(data, policy, buildImage))
+}
+
+// GitHubClient reads repository files and reports commit statuses through
+// the GitHub REST API
+type GitHubClient struct {
+	token   string
+	baseURL string
+	client  *http.Client
+}
+
+// NewGitHubClientFromEnv creates a GitHub client, or returns nil when
+// GITHUB_TOKEN is not set
+func NewGitHubClientFromEnv() *GitHubClient {
+	token := os.Getenv("GITHUB_TOKEN")
+	if token == "" {
+		return nil
+	}
+	return newGitHubClient(token)
+}
+
+// newGitHubClient creates a client of the GitHub API at GITHUB_API_URL
+// authenticating with token
+func newGitHubClient(token string) *GitHubClient {
+	baseURL := os.Getenv("GITHUB_API_URL")
+	if baseURL == "" {
+		baseURL = "https://api.github.com"
+	}
+
+	return &GitHubClient{
+		token:   token,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (gc *GitHubClient) do(ctx context.Context, method, path string, body io.Reader, accept string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, gc.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+gc.token)
+	req.Header.Set("Accept", accept)
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return gc.client.Do(req)
+}
+
+// FetchFile returns the contents of a file at a commit, or nil when the
+// repository has no such file
+func (gc *GitHubClient) FetchFile(ctx context.Context, repo, name, ref string) ([]byte, error) {
+	path := fmt.Sprintf("/repos/%s/contents/%s?ref=%s", repo, name, url.QueryEscape(ref))
+	resp, err := gc.do(ctx, "GET", path, nil, "application/vnd.github.raw+json")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("github api: unexpected status %d fetching %s", resp.StatusCode, name)
+	}
+	// One byte over the limit is enough to report the file as too large
+	return io.ReadAll(io.LimitReader(resp.Body, maxPipelineBytes+1))
+}
+
+// SetStatus reports a commit status, linking to targetURL when it is set
+func (gc *GitHubClient) SetStatus(ctx context.Context, repo, sha, state, description, statusContext, targetURL string) error {
+	// GitHub rejects descriptions longer than 140 characters
+	if len(description) > 140 {
+		description = description[:137] + "..."
+	}
+	status := map[string]string{"state": state, "description": description, "context": statusContext}
+	if targetURL != "" {
+		status["target_url"] = targetURL
+	}
+	body, _ := json.Marshal(status)
+
+	resp, err := gc.do(ctx, "POST", fmt.Sprintf("/repos/%s/statuses/%s", repo, sha), bytes.NewReader(body), "application/vnd.github+json")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("github api: unexpected status %d setting commit status", resp.StatusCode)
+	}
+	return nil
+}
+
+// validatePullRequestPipeline validates the pipeline file proposed by a pull
+// request and reports the result as a commit status on its head commit. It
+// returns nil when there is no GitHub token to read the file and report the
+// result with, or the pull request has no pipeline file.
+func (bs *BuildService) validatePullRequestPipeline(ctx context.Context, project *Project, payload *githubPullRequestPayload) (*PipelineValidation, error) {
+	if bs.github == nil {
+		return nil, nil
+	}
+
+	// The file is read from the head repository, which differs from the
+	// base repository for pull requests from forks
+	head := payload.PullRequest.Head
+	data, err := bs.github.FetchFile(ctx, head.Repo.FullName, pipelineFile, head.SHA)
+	if err != nil || data == nil {
+		return nil, err
+	}
+
+	result := validatePipelineFile(data, bs.imagePolicy(project.GitURL), project.BuildImage)
+	state, description := "success", fmt.Sprintf("%s is valid", pipelineFile)
+	if !result.Valid {
+		state, description = "failure", result.Errors[0]
+	}
+	if err := bs.github.SetStatus(ctx, payload.Repository.FullName, head.SHA, state, description, pipelineStatusContext, ""); err != nil {
+		return nil, fmt.Errorf("reporting commit status: %w", err)
+	}
+	return result, nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidatePipelineHandler(t *testing.T) {
+	service, _ := setupTestService()
+
+	validate := func(body string) PipelineValidation {
+		rr := httptest.NewRecorder()
+		service.validatePipelineHandler(rr, httptest.NewRequest("POST", "/api/v1/pipelines/validate", strings.NewReader(body)))
+		require.Equal(t, http.StatusOK, rr.Code)
+		var result PipelineValidation
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &result))
+		return result
+	}
+
+	result := validate("stages:\n  - name: build\n    steps: [make]\n  - name: test\n    steps: [make test]\n")
+	assert.True(t, result.Valid)
+	assert.Empty(t, result.Errors)
+	assert.Equal(t, []string{"build", "test"}, result.Stages)
+
+	result = validate("stages:\n  - name: build\n    script: [make]\n")
+	assert.False(t, result.Valid)
+	require.Len(t, result.Errors, 1)
+	assert.Contains(t, result.Errors[0], "field script not found")
+
+	result = validate(strings.Repeat("#", maxPipelineBytes+1))
+	assert.False(t, result.Valid)
+	assert.Contains(t, result.Errors[0], "larger than")
+}
+
+// fakeGitHub serves pipeline files and records commit statuses
+type fakeGitHub struct {
+	files    map[string]string
+	statuses []map[string]string
+}
+
+func (fg *fakeGitHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer gh-token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	switch {
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/repos/"):
+		content, ok := fg.files[r.URL.Path+"@"+r.URL.Query().Get("ref")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(content))
+	case r.Method == "POST" && strings.Contains(r.URL.Path, "/statuses/"):
+		var status map[string]string
+		json.NewDecoder(r.Body).Decode(&status)
+		status["path"] = r.URL.Path
+		fg.statuses = append(fg.statuses, status)
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestGitHubPullRequestPipelineValidation(t *testing.T) {
+	t.Setenv("GITHUB_WEBHOOK_SECRET", "gh-secret")
+	t.Setenv("GITHUB_TOKEN", "gh-token")
+	github := &fakeGitHub{files: map[string]string{
+		"/repos/fork/repo/contents/.buildservice.yml@aaaaaaa": "stages:\n  - name: build\n    steps: [make]\n",
+		"/repos/fork/repo/contents/.buildservice.yml@bbbbbbb": "stages: []\n",
+	}}
+	server := httptest.NewServer(github)
+	defer server.Close()
+	t.Setenv("GITHUB_API_URL", server.URL)
+
+	service, mockDB := setupTestService()
+	service.github = NewGitHubClientFromEnv()
+	mockDB.On("GetProjectByRepository", "github.com/test/repo").Return(&Project{Name: "repo"}, nil)
+	mockDB.On("CreateBuild", mock.MatchedBy(func(b *BuildRequest) bool {
+		return b.Branch == "pull/7/merge" && b.PullRequest == 7 && b.PullRequestFork
+	})).Return(1, nil).Twice()
+
+	send := func(action, sha string) *httptest.ResponseRecorder {
+		payload := map[string]interface{}{
+			"action": action,
+			"pull_request": map[string]interface{}{
+				"number": 7,
+				"head":   map[string]interface{}{"sha": sha, "repo": map[string]string{"full_name": "fork/repo"}},
+			},
+			"repository": map[string]string{"full_name": "test/repo", "clone_url": "https://github.com/test/repo.git"},
+		}
+		body, _ := json.Marshal(payload)
+		req := httptest.NewRequest("POST", "/api/v1/webhooks/github", bytes.NewReader(body))
+		req.Header.Set("X-GitHub-Event", "pull_request")
+		req.Header.Set("X-Hub-Signature-256", signGitHubPayload("gh-secret", body))
+		rr := httptest.NewRecorder()
+		service.githubWebhookHandler(rr, req)
+		return rr
+	}
+
+	assert.Equal(t, http.StatusCreated, send("opened", "aaaaaaa").Code)
+	// Pull requests with an invalid pipeline file aren't built
+	rr := send("synchronize", "bbbbbbb")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"valid":false`)
+	// Without a pipeline file there is nothing to validate, and closing
+	// doesn't change the code
+	assert.Equal(t, http.StatusCreated, send("opened", "ccccccc").Code)
+	assert.Equal(t, http.StatusAccepted, send("closed", "aaaaaaa").Code)
+	mockDB.AssertExpectations(t)
+
+	require.Len(t, github.statuses, 2)
+	assert.Equal(t, map[string]string{
+		"path":        "/repos/test/repo/statuses/aaaaaaa",
+		"state":       "success",
+		"description": ".buildservice.yml is valid",
+		"context":     "buildservice/pipeline",
+	}, github.statuses[0])
+	assert.Equal(t, "failure", github.statuses[1]["state"])
+	assert.Equal(t, "invalid .buildservice.yml: at least one stage is required", github.statuses[1]["description"])
+}
+
+func TestGitHubClientSetStatusTruncatesDescription(t *testing.T) {
+	t.Setenv("GITHUB_TOKEN", "gh-token")
+	github := &fakeGitHub{}
+	server := httptest.NewServer(github)
+	defer server.Close()
+	t.Setenv("GITHUB_API_URL", server.URL+"/")
+
+	client := NewGitHubClientFromEnv()
+	require.NoError(t, client.SetStatus(t.Context(), "test/repo", "abc", "failure", strings.Repeat("x", 200), "ctx", ""))
+	require.Len(t, github.statuses, 1)
+	assert.Len(t, github.statuses[0]["description"], 140)
+
+	t.Setenv("GITHUB_TOKEN", "")
+	assert.Nil(t, NewGitHubClientFromEnv())
+}
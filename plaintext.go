@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// writePlainText writes a single word or line for scripts and screen
+// readers, terminated by a newline so it prints cleanly in a terminal
+func writePlainText(w http.ResponseWriter, text string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprintln(w, text)
+}
+
+// Build status endpoint. Responds with just the build's status, e.g. "success".
+func (bs *BuildService) buildStatusTextHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid build ID", http.StatusBadRequest)
+		return
+	}
+
+	build, err := bs.cachedBuild(id)
+	if err != nil {
+		if err.Error() == "build not found" {
+			http.Error(w, "Build not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error getting build: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	writePlainText(w, build.Status)
+}
+
+// Project status endpoint. Responds with the status of the latest finished
+// build of ?branch=, by default the project's default branch, or "unknown"
+// before the first one.
+func (bs *BuildService) projectStatusTextHandler(w http.ResponseWriter, r *http.Request) {
+	project, err := bs.cachedProject(mux.Vars(r)["name"])
+	if err == nil && !requestTenant(r).Sees(project.Org) {
+		err = fmt.Errorf("project not found")
+	}
+	if err != nil {
+		if err.Error() == "project not found" {
+			http.Error(w, "Project not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error getting project: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	branch := r.URL.Query().Get("branch")
+	if branch == "" {
+		branch = project.DefaultBranch
+	}
+	build, err := bs.cachedLatestFinishedBuild(project.Name, branch)
+	if err != nil {
+		if err.Error() == "build not found" {
+			writePlainText(w, "unknown")
+			return
+		}
+		log.Printf("Error getting latest build: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	writePlainText(w, build.Status)
+}
+
+// Service status endpoint. Responds with the overall status of the status
+// page, e.g. "operational".
+func (bs *BuildService) statusTextHandler(w http.ResponseWriter, r *http.Request) {
+	page, _, _ := bs.statusPage()
+	writePlainText(w, page.Status)
+}
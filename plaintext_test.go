@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestBuildStatusTextHandler(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.On("GetBuild", 7).Return(&BuildRequest{ID: 7, Status: "running"}, nil)
+	mockDB.On("GetBuild", 8).Return(nil, fmt.Errorf("build not found"))
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/builds/{id}/status.txt", service.buildStatusTextHandler).Methods("GET")
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/builds/7/status.txt", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "text/plain; charset=utf-8", rr.Header().Get("Content-Type"))
+	assert.Equal(t, "running\n", rr.Body.String())
+
+	for path, code := range map[string]int{
+		"/api/v1/builds/8/status.txt":   http.StatusNotFound,
+		"/api/v1/builds/abc/status.txt": http.StatusBadRequest,
+	} {
+		rr = httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		assert.Equal(t, code, rr.Code, path)
+	}
+}
+
+func TestProjectStatusTextHandler(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.On("GetProjectByName", "api").Return(&Project{ID: 1, Name: "api", DefaultBranch: "main"}, nil)
+	mockDB.On("GetProjectByName", "missing").Return(nil, fmt.Errorf("project not found"))
+	mockDB.On("GetLatestFinishedBuild", "api", "main").Return(&BuildRequest{ID: 3, Status: "failed"}, nil)
+	mockDB.On("GetLatestFinishedBuild", "api", "release").Return(nil, fmt.Errorf("build not found"))
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/projects/{name}/status.txt", service.projectStatusTextHandler).Methods("GET")
+
+	for path, want := range map[string]string{
+		"/api/v1/projects/api/status.txt":                "failed\n",
+		"/api/v1/projects/api/status.txt?branch=release": "unknown\n",
+	} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		assert.Equal(t, http.StatusOK, rr.Code, path)
+		assert.Equal(t, want, rr.Body.String(), path)
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/projects/missing/status.txt", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestStatusTextHandler(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.On("Ping").Return(nil).Once()
+	mockDB.On("GetQueueStats", mock.AnythingOfType("time.Time")).Return(&QueueStats{}, nil).Once()
+	mockDB.On("ListIncidents", false).Return([]*Incident{{Kind: "incident", Impact: "minor", StartsAt: time.Now().Add(-time.Minute)}}, nil).Once()
+
+	rr := httptest.NewRecorder()
+	service.statusTextHandler(rr, httptest.NewRequest("GET", "/api/v1/status.txt", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "degraded\n", rr.Body.String())
+}
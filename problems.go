@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Severities of a build problem
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+)
+
+// Limits on the problems kept per build and the patterns a project may add
+const (
+	maxBuildProblems       = 100
+	maxProblemPatterns     = 20
+	maxProblemMessageBytes = 500
+)
+
+// BuildProblem is an error or warning found in a stage's log, pointing at the
+// line it was reported on so a UI can jump straight to it
+type BuildProblem struct {
+	// StageIndex is the stage's position in GET /builds/{id}/stages
+	StageIndex int    `json:"stage_index"`
+	Stage      string `json:"stage"`
+	// Line is the 1-based line of the stage's log, and Offset the byte offset
+	// of its start
+	Line     int    `json:"line"`
+	Offset   int    `json:"offset"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+	// File and FileLine are the source location the tool reported, if any
+	File     string `json:"file,omitempty"`
+	FileLine int    `json:"file_line,omitempty"`
+}
+
+// BuildProblems lists the problems of a build in log order
+type BuildProblems struct {
+	BuildID  int             `json:"build_id"`
+	Errors   int             `json:"errors"`
+	Warnings int             `json:"warnings"`
+	Problems []*BuildProblem `json:"problems"`
+}
+
+// problemPattern recognises problem lines. The named groups file, line,
+// message and severity fill in the problem; without a severity group the
+// pattern's own severity is used, and without a message group the whole line.
+type problemPattern struct {
+	re       *regexp.Regexp
+	severity string
+}
+
+// builtinProblemPatterns recognise the output of common compilers and test
+// runners. The first pattern matching a line wins.
+var builtinProblemPatterns = []problemPattern{
+	// gcc, clang, swiftc: main.c:12:5: error: ...
+	{regexp.MustCompile(`^(?P<file>[^\s:]+):(?P<line>\d+):(?:\d+:)? (?:fatal )?(?P<severity>error|warning): (?P<message>.+)$`), severityError},
+	// go build and go vet: ./main.go:12:5: undefined: x, and testing output
+	{regexp.MustCompile(`^\s*(?P<file>[^\s:]+\.go):(?P<line>\d+)(?::\d+)?: (?P<message>.+)$`), severityError},
+	// tsc: src/app.ts(12,5): error TS2304: ...
+	{regexp.MustCompile(`^(?P<file>\S+\.tsx?)\((?P<line>\d+),\d+\): (?P<severity>error|warning) (?P<message>TS\d+: .+)$`), severityError},
+	// maven and javac: [ERROR] /src/App.java:[12,5] cannot find symbol
+	{regexp.MustCompile(`^\[(?P<severity>ERROR|WARNING)\] (?:(?P<file>\S+\.(?:java|kt|scala)):\[(?P<line>\d+),\d+\] )?(?P<message>.+)$`), severityError},
+	// rustc and cargo: error[E0425]: cannot find value `x` in this scope
+	{regexp.MustCompile(`^(?P<severity>error|warning)(?:\[\w+\])?: (?P<message>.+)$`), severityError},
+	// go test: --- FAIL: TestX (0.00s)
+	{regexp.MustCompile(`^\s*--- FAIL: (?P<message>.+)$`), severityError},
+	{regexp.MustCompile(`^panic: (?P<message>.+)$`), severityError},
+	// pytest: FAILED tests/test_app.py::test_x - AssertionError
+	{regexp.MustCompile(`^FAILED (?P<file>[^\s:]+)::(?P<message>.+)$`), severityError},
+	// jest: ● suite › test
+	{regexp.MustCompile(`^\s*● (?P<message>.+)$`), severityError},
+	// npm: npm ERR! ...
+	{regexp.MustCompile(`^npm (?P<severity>ERR!|WARN) (?P<message>.+)$`), severityError},
+}
+
+// ansiEscape matches the colour codes many tools add to their output
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+
+// validateProblemPatterns checks a project's problem patterns compile
+func validateProblemPatterns(patterns []string) error {
+	if len(patterns) > maxProblemPatterns {
+		return fmt.Errorf("at most %d problem_patterns are allowed", maxProblemPatterns)
+	}
+	for _, pattern := range patterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("invalid problem_patterns regular expression %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// problemPatterns returns the patterns problems are extracted with: the
+// project's own, tried first, followed by the built-in ones. Project patterns
+// report errors unless they capture a severity.
+func problemPatterns(project *Project) []problemPattern {
+	var patterns []problemPattern
+	if project != nil {
+		for _, pattern := range project.ProblemPatterns {
+			if re, err := regexp.Compile(pattern); err == nil {
+				patterns = append(patterns, problemPattern{re, severityError})
+			}
+		}
+	}
+	return append(patterns, builtinProblemPatterns...)
+}
+
+// normalizeSeverity maps the severities tools report to error or warning
+func normalizeSeverity(severity string) string {
+	if strings.HasPrefix(strings.ToLower(severity), "warn") {
+		return severityWarning
+	}
+	return severityError
+}
+
+// match reports the problem a log line describes, if any
+func (pp problemPattern) match(line string) (*BuildProblem, bool) {
+	groups := pp.re.FindStringSubmatch(line)
+	if groups == nil {
+		return nil, false
+	}
+
+	problem := &BuildProblem{Severity: pp.severity, Message: strings.TrimSpace(line)}
+	for i, name := range pp.re.SubexpNames() {
+		value := groups[i]
+		if value == "" {
+			continue
+		}
+		switch name {
+		case "file":
+			problem.File = value
+		case "line":
+			problem.FileLine, _ = strconv.Atoi(value)
+		case "message":
+			problem.Message = strings.TrimSpace(value)
+		case "severity":
+			problem.Severity = normalizeSeverity(value)
+		}
+	}
+	if len(problem.Message) > maxProblemMessageBytes {
+		problem.Message = problem.Message[:maxProblemMessageBytes]
+	}
+	return problem, true
+}
+
+// extractProblems scans the logs of a build's stages for problems, keeping
+// the first maxBuildProblems
+func extractProblems(stages []*BuildStage, patterns []problemPattern) []*BuildProblem {
+	problems := []*BuildProblem{}
+	for index, stage := range stages {
+		scanner := bufio.NewScanner(strings.NewReader(stage.Log))
+		scanner.Buffer(make([]byte, 0, 4096), maxStageLogBytes+1)
+		offset := 0
+		for lineNo := 1; scanner.Scan(); lineNo++ {
+			raw := scanner.Text()
+			line := ansiEscape.ReplaceAllString(strings.TrimSuffix(raw, "\r"), "")
+			for _, pattern := range patterns {
+				problem, ok := pattern.match(line)
+				if !ok {
+					continue
+				}
+				problem.StageIndex, problem.Stage = index, stage.Name
+				problem.Line, problem.Offset = lineNo, offset
+				problems = append(problems, problem)
+				if len(problems) == maxBuildProblems {
+					return problems
+				}
+				break
+			}
+			offset += len(raw) + 1
+		}
+	}
+	return problems
+}
+
+// Build problems endpoint
+func (bs *BuildService) buildProblemsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid build ID", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := bs.db.GetBuild(id); err != nil {
+		if err.Error() == "build not found" {
+			http.Error(w, "Build not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error getting build: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	problems, err := bs.db.ListBuildProblems(id)
+	if err != nil {
+		log.Printf("Error listing build problems: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	result := BuildProblems{BuildID: id, Problems: problems}
+	for _, problem := range problems {
+		if problem.Severity == severityWarning {
+			result.Warnings++
+		} else {
+			result.Errors++
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
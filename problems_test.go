@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtractProblemsBuiltinPatterns(t *testing.T) {
+	stages := []*BuildStage{
+		{Name: "clone", Log: "Cloning into 'api'...\n"},
+		{Name: "build", Log: "go build ./...\n" +
+			"./main.go:12:5: undefined: handler\n" +
+			"src/app.ts(3,7): error TS2304: Cannot find name 'x'.\n" +
+			"lib.c:40:1: \x1b[35mwarning\x1b[0m: unused variable 'n'\n"},
+		{Name: "test", Log: "=== RUN   TestApi\n" +
+			"    api_test.go:20: expected 200, got 500\n" +
+			"--- FAIL: TestApi (0.01s)\n" +
+			"FAILED tests/test_app.py::test_index - AssertionError\r\n" +
+			"ok  \tother\t0.1s\n"},
+	}
+
+	problems := extractProblems(stages, problemPatterns(nil))
+	require.Len(t, problems, 6)
+
+	assert.Equal(t, &BuildProblem{StageIndex: 1, Stage: "build", Line: 2, Offset: 15, Severity: "error",
+		Message: "undefined: handler", File: "./main.go", FileLine: 12}, problems[0])
+	assert.Equal(t, "TS2304: Cannot find name 'x'.", problems[1].Message)
+	assert.Equal(t, 3, problems[1].FileLine)
+	assert.Equal(t, "warning", problems[2].Severity)
+	assert.Equal(t, "unused variable 'n'", problems[2].Message)
+
+	assert.Equal(t, "test", problems[3].Stage)
+	assert.Equal(t, 2, problems[3].Line)
+	assert.Equal(t, "api_test.go", problems[3].File)
+	assert.Equal(t, "TestApi (0.01s)", problems[4].Message)
+	assert.Equal(t, "tests/test_app.py", problems[5].File)
+	assert.Equal(t, "test_index - AssertionError", problems[5].Message)
+
+	// Offsets point at the start of the line in the stage's log
+	log := stages[2].Log
+	assert.Equal(t, "--- FAIL", log[problems[4].Offset:problems[4].Offset+8])
+}
+
+func TestExtractProblemsProjectPatterns(t *testing.T) {
+	project := &Project{ProblemPatterns: []string{
+		`^Lint (?P<severity>warning|error) in (?P<file>\S+): (?P<message>.+)$`,
+		`^BUILD BROKEN`,
+	}}
+	stages := []*BuildStage{{Name: "build", Log: "Lint warning in app.js: missing semicolon\nBUILD BROKEN by deploy script\n"}}
+
+	problems := extractProblems(stages, problemPatterns(project))
+	require.Len(t, problems, 2)
+	assert.Equal(t, "warning", problems[0].Severity)
+	assert.Equal(t, "app.js", problems[0].File)
+	assert.Equal(t, "missing semicolon", problems[0].Message)
+	assert.Equal(t, "error", problems[1].Severity)
+	assert.Equal(t, "BUILD BROKEN by deploy script", problems[1].Message)
+}
+
+func TestExtractProblemsLimit(t *testing.T) {
+	var log bytes.Buffer
+	for i := 0; i < maxBuildProblems+10; i++ {
+		fmt.Fprintf(&log, "error: failure %d\n", i)
+	}
+	problems := extractProblems([]*BuildStage{{Name: "build", Log: log.String()}}, problemPatterns(nil))
+	assert.Len(t, problems, maxBuildProblems)
+}
+
+func TestValidateProblemPatterns(t *testing.T) {
+	assert.NoError(t, validateProblemPatterns(nil))
+	assert.NoError(t, validateProblemPatterns([]string{`^ERROR: (?P<message>.+)$`}))
+	assert.Error(t, validateProblemPatterns([]string{`(unclosed`}))
+	assert.Error(t, validateProblemPatterns(make([]string, maxProblemPatterns+1)))
+}
+
+func TestUpdateProjectProblemPatterns(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.On("GetProject", 1).Return(&Project{ID: 1, Name: "api", GitURL: "https://github.com/acme/api", DefaultBranch: "main"}, nil)
+	mockDB.On("UpdateProject", mock.MatchedBy(func(p *Project) bool {
+		return len(p.ProblemPatterns) == 1 && p.ProblemPatterns[0] == `^FATAL`
+	})).Return(nil).Once()
+
+	update := func(body string) *httptest.ResponseRecorder {
+		req := mux.SetURLVars(httptest.NewRequest("PATCH", "/api/v1/projects/1", bytes.NewBufferString(body)), map[string]string{"id": "1"})
+		rr := httptest.NewRecorder()
+		service.updateProjectHandler(rr, req)
+		return rr
+	}
+
+	assert.Equal(t, http.StatusOK, update(`{"problem_patterns":["^FATAL"]}`).Code)
+	rr := update(`{"problem_patterns":["(unclosed"]}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "invalid problem_patterns")
+	mockDB.AssertExpectations(t)
+}
+
+func TestBuildProblemsHandler(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.On("GetBuild", 1).Return(&BuildRequest{ID: 1, Status: "failed"}, nil)
+	mockDB.On("ListBuildProblems", 1).Return([]*BuildProblem{
+		{StageIndex: 1, Stage: "build", Line: 4, Offset: 80, Severity: "warning", Message: "unused variable"},
+		{StageIndex: 2, Stage: "test", Line: 9, Offset: 310, Severity: "error", Message: "TestApi (0.01s)"},
+	}, nil)
+	mockDB.On("GetBuild", 2).Return(nil, fmt.Errorf("build not found"))
+
+	get := func(id string) *httptest.ResponseRecorder {
+		req := mux.SetURLVars(httptest.NewRequest("GET", "/api/v1/builds/"+id+"/problems", nil), map[string]string{"id": id})
+		rr := httptest.NewRecorder()
+		service.buildProblemsHandler(rr, req)
+		return rr
+	}
+
+	rr := get("1")
+	require.Equal(t, http.StatusOK, rr.Code)
+	var problems BuildProblems
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &problems))
+	assert.Equal(t, 1, problems.Errors)
+	assert.Equal(t, 1, problems.Warnings)
+	require.Len(t, problems.Problems, 2)
+	assert.Equal(t, 310, problems.Problems[1].Offset)
+
+	assert.Equal(t, http.StatusNotFound, get("2").Code)
+	assert.Equal(t, http.StatusBadRequest, get("x").Code)
+}
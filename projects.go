@@ -0,0 +1,465 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Project is a registered repository that builds can be triggered for
+type Project struct {
+	ID                 int    `json:"id" db:"id"`
+	Name               string `json:"name" db:"name"`
+	Org                string `json:"org,omitempty" db:"org"`
+	GitURL             string `json:"git_url" db:"git_url"`
+	DefaultBranch      string `json:"default_branch" db:"default_branch"`
+	SkipCIEnabled      bool   `json:"skip_ci_enabled" db:"skip_ci_enabled"`
+	SkipCIToken        string `json:"skip_ci_token,omitempty" db:"skip_ci_token"`
+	TagPattern         string `json:"tag_pattern,omitempty" db:"tag_pattern"`
+	ArtifactTagPattern string `json:"artifact_tag_pattern,omitempty" db:"artifact_tag_pattern"`
+	AutoVersion        bool   `json:"auto_version" db:"auto_version"`
+	BuildTimeout       int    `json:"build_timeout_seconds,omitempty" db:"build_timeout_seconds"`
+	MaxQueueWait       int    `json:"max_queue_wait_seconds,omitempty" db:"max_queue_wait_seconds"`
+	BuildImage         string `json:"build_image,omitempty" db:"build_image"`
+	// CPULimit and MemoryLimitMB limit the containers of the project's builds
+	// instead of DOCKER_CPUS and DOCKER_MEMORY_MB
+	CPULimit      float64 `json:"cpu_limit,omitempty" db:"cpu_limit"`
+	MemoryLimitMB int     `json:"memory_limit_mb,omitempty" db:"memory_limit_mb"`
+	// AutoApplyRecommendations sets the limits and timeout to the usage
+	// recommendations after each successful build
+	AutoApplyRecommendations bool `json:"auto_apply_recommendations" db:"auto_apply_recommendations"`
+	// Matrix runs each build once per combination of its values, unless the
+	// repository's pipeline file declares its own
+	Matrix BuildMatrix `json:"matrix,omitempty" db:"matrix"`
+	// NotifyOn is when the project's watchers are notified of finished
+	// builds: always, on-failure or on-recovery; empty for never
+	NotifyOn              string   `json:"notify_on,omitempty" db:"notify_on"`
+	NotifySlackWebhookURL string   `json:"notify_slack_webhook_url,omitempty" db:"notify_slack_webhook_url"`
+	NotifyEmails          []string `json:"notify_emails,omitempty" db:"notify_emails"`
+	// ProblemPatterns are regular expressions marking the project's own error
+	// lines in build logs, alongside the built-in compiler and test patterns
+	ProblemPatterns []string `json:"problem_patterns,omitempty" db:"problem_patterns"`
+	// MaxAutoRetries is how many times in a row a failed build is retried
+	// automatically when its failure is in AutoRetryCategories
+	MaxAutoRetries      int      `json:"max_auto_retries,omitempty" db:"max_auto_retries"`
+	AutoRetryCategories []string `json:"auto_retry_categories,omitempty" db:"auto_retry_categories"`
+	// QualityGatePolicy is how failed external quality gates affect the
+	// project: block-deploy, fail-build, or only annotate builds when empty
+	QualityGatePolicy string `json:"quality_gate_policy,omitempty" db:"quality_gate_policy"`
+	// Labels are copied onto the project's new builds
+	Labels      Labels     `json:"labels,omitempty" db:"labels"`
+	Paused      bool       `json:"paused"`
+	PausedAt    *time.Time `json:"paused_at,omitempty" db:"paused_at"`
+	PauseReason string     `json:"pause_reason,omitempty" db:"pause_reason"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at" db:"updated_at"`
+}
+
+// repositoryKey normalises the many spellings of a repository URL
+// (https, ssh, scp-style, with or without .git) to "host/owner/repo"
+func repositoryKey(raw string) string {
+	s := strings.ToLower(strings.TrimSpace(raw))
+
+	if u, err := url.Parse(s); err == nil && u.Host != "" {
+		s = u.Hostname() + u.Path
+	} else if at := strings.Index(s, "@"); at >= 0 {
+		// scp-style: git@host:owner/repo.git
+		s = strings.Replace(s[at+1:], ":", "/", 1)
+	}
+
+	s = strings.TrimSuffix(s, "/")
+	return strings.TrimSuffix(s, ".git")
+}
+
+// repositoryOrg returns the organization owning a repository: the first path
+// segment of its URL (the GitHub organization or top-level GitLab group)
+func repositoryOrg(raw string) string {
+	parts := strings.Split(repositoryKey(raw), "/")
+	if len(parts) < 3 {
+		return ""
+	}
+	return parts[1]
+}
+
+// Create project endpoint
+func (bs *BuildService) createProjectHandler(w http.ResponseWriter, r *http.Request) {
+	project := Project{SkipCIEnabled: true}
+	if err := json.NewDecoder(r.Body).Decode(&project); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if project.Name == "" || project.GitURL == "" {
+		http.Error(w, "name and git_url are required", http.StatusBadRequest)
+		return
+	}
+
+	if project.DefaultBranch == "" {
+		project.DefaultBranch = "main"
+	}
+
+	if !validTagPattern(project.TagPattern) || !validTagPattern(project.ArtifactTagPattern) {
+		http.Error(w, "tag_pattern and artifact_tag_pattern must be valid glob patterns", http.StatusBadRequest)
+		return
+	}
+
+	if !bs.validBuildTimeout(project.BuildTimeout) {
+		http.Error(w, "build_timeout_seconds must be between 0 and the queue lease duration", http.StatusBadRequest)
+		return
+	}
+
+	if project.MaxQueueWait < 0 {
+		http.Error(w, "max_queue_wait_seconds must not be negative", http.StatusBadRequest)
+		return
+	}
+	if project.CPULimit < 0 || project.MemoryLimitMB < 0 {
+		http.Error(w, "cpu_limit and memory_limit_mb must not be negative", http.StatusBadRequest)
+		return
+	}
+	if err := project.Matrix.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := validateNotifications(&project); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := validateProblemPatterns(project.ProblemPatterns); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := validateAutoRetry(&project); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := validateQualityGatePolicy(&project); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := project.Labels.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	project.Org = strings.ToLower(strings.TrimSpace(project.Org))
+	if tenant := requestTenant(r); tenant.Org != "" {
+		project.Org = tenant.Org
+	}
+	project.CreatedAt = time.Now().UTC()
+	project.UpdatedAt = time.Now().UTC()
+
+	id, err := bs.db.CreateProject(&project)
+	if err != nil {
+		if err.Error() == "project already exists" {
+			http.Error(w, "Project already exists", http.StatusConflict)
+			return
+		}
+		log.Printf("Error creating project: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	project.ID = id
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(project)
+}
+
+// Get project endpoint
+func (bs *BuildService) getProjectHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	project, err := bs.db.GetProject(id)
+	if err != nil {
+		if err.Error() == "project not found" {
+			http.Error(w, "Project not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error getting project: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(project)
+}
+
+// ProjectUpdate holds the fields of a project that can be changed after
+// creation; nil fields are left untouched
+type ProjectUpdate struct {
+	GitURL                   *string      `json:"git_url"`
+	DefaultBranch            *string      `json:"default_branch"`
+	SkipCIEnabled            *bool        `json:"skip_ci_enabled"`
+	SkipCIToken              *string      `json:"skip_ci_token"`
+	TagPattern               *string      `json:"tag_pattern"`
+	ArtifactTagPattern       *string      `json:"artifact_tag_pattern"`
+	AutoVersion              *bool        `json:"auto_version"`
+	BuildTimeout             *int         `json:"build_timeout_seconds"`
+	MaxQueueWait             *int         `json:"max_queue_wait_seconds"`
+	BuildImage               *string      `json:"build_image"`
+	CPULimit                 *float64     `json:"cpu_limit"`
+	MemoryLimitMB            *int         `json:"memory_limit_mb"`
+	AutoApplyRecommendations *bool        `json:"auto_apply_recommendations"`
+	Matrix                   *BuildMatrix `json:"matrix"`
+	NotifyOn                 *string      `json:"notify_on"`
+	NotifySlackWebhookURL    *string      `json:"notify_slack_webhook_url"`
+	NotifyEmails             *[]string    `json:"notify_emails"`
+	ProblemPatterns          *[]string    `json:"problem_patterns"`
+	MaxAutoRetries           *int         `json:"max_auto_retries"`
+	AutoRetryCategories      *[]string    `json:"auto_retry_categories"`
+	QualityGatePolicy        *string      `json:"quality_gate_policy"`
+	// Labels replace all of the project's labels
+	Labels *Labels `json:"labels"`
+}
+
+// Apply copies the set fields onto project
+func (pu *ProjectUpdate) Apply(project *Project) {
+	if pu.GitURL != nil {
+		project.GitURL = *pu.GitURL
+	}
+	if pu.DefaultBranch != nil {
+		project.DefaultBranch = *pu.DefaultBranch
+	}
+	if pu.SkipCIEnabled != nil {
+		project.SkipCIEnabled = *pu.SkipCIEnabled
+	}
+	if pu.SkipCIToken != nil {
+		project.SkipCIToken = *pu.SkipCIToken
+	}
+	if pu.TagPattern != nil {
+		project.TagPattern = *pu.TagPattern
+	}
+	if pu.ArtifactTagPattern != nil {
+		project.ArtifactTagPattern = *pu.ArtifactTagPattern
+	}
+	if pu.AutoVersion != nil {
+		project.AutoVersion = *pu.AutoVersion
+	}
+	if pu.BuildTimeout != nil {
+		project.BuildTimeout = *pu.BuildTimeout
+	}
+	if pu.MaxQueueWait != nil {
+		project.MaxQueueWait = *pu.MaxQueueWait
+	}
+	if pu.BuildImage != nil {
+		project.BuildImage = *pu.BuildImage
+	}
+	if pu.CPULimit != nil {
+		project.CPULimit = *pu.CPULimit
+	}
+	if pu.MemoryLimitMB != nil {
+		project.MemoryLimitMB = *pu.MemoryLimitMB
+	}
+	if pu.AutoApplyRecommendations != nil {
+		project.AutoApplyRecommendations = *pu.AutoApplyRecommendations
+	}
+	if pu.Matrix != nil {
+		project.Matrix = *pu.Matrix
+	}
+	if pu.NotifyOn != nil {
+		project.NotifyOn = *pu.NotifyOn
+	}
+	if pu.NotifySlackWebhookURL != nil {
+		project.NotifySlackWebhookURL = *pu.NotifySlackWebhookURL
+	}
+	if pu.NotifyEmails != nil {
+		project.NotifyEmails = *pu.NotifyEmails
+	}
+	if pu.ProblemPatterns != nil {
+		project.ProblemPatterns = *pu.ProblemPatterns
+	}
+	if pu.MaxAutoRetries != nil {
+		project.MaxAutoRetries = *pu.MaxAutoRetries
+	}
+	if pu.AutoRetryCategories != nil {
+		project.AutoRetryCategories = *pu.AutoRetryCategories
+	}
+	if pu.QualityGatePolicy != nil {
+		project.QualityGatePolicy = *pu.QualityGatePolicy
+	}
+	if pu.Labels != nil {
+		project.Labels = *pu.Labels
+	}
+}
+
+// validBuildTimeout checks a project's build timeout. Without heartbeats,
+// builds running longer than the queue lease would be handed to a second
+// worker, so the timeout must end them before the lease expires.
+func (bs *BuildService) validBuildTimeout(seconds int) bool {
+	if seconds < 0 {
+		return false
+	}
+	return bs.queue.heartbeatInterval > 0 || time.Duration(seconds)*time.Second < bs.queue.leaseDuration
+}
+
+// Update project endpoint
+func (bs *BuildService) updateProjectHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	var update ProjectUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	project, err := bs.db.GetProject(id)
+	if err != nil {
+		if err.Error() == "project not found" {
+			http.Error(w, "Project not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error getting project: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	update.Apply(project)
+	if project.GitURL == "" || project.DefaultBranch == "" {
+		http.Error(w, "git_url and default_branch cannot be empty", http.StatusBadRequest)
+		return
+	}
+	if !validTagPattern(project.TagPattern) || !validTagPattern(project.ArtifactTagPattern) {
+		http.Error(w, "tag_pattern and artifact_tag_pattern must be valid glob patterns", http.StatusBadRequest)
+		return
+	}
+	if !bs.validBuildTimeout(project.BuildTimeout) {
+		http.Error(w, "build_timeout_seconds must be between 0 and the queue lease duration", http.StatusBadRequest)
+		return
+	}
+	if project.MaxQueueWait < 0 {
+		http.Error(w, "max_queue_wait_seconds must not be negative", http.StatusBadRequest)
+		return
+	}
+	if project.CPULimit < 0 || project.MemoryLimitMB < 0 {
+		http.Error(w, "cpu_limit and memory_limit_mb must not be negative", http.StatusBadRequest)
+		return
+	}
+	if err := project.Matrix.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateNotifications(project); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateProblemPatterns(project.ProblemPatterns); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateAutoRetry(project); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateQualityGatePolicy(project); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := project.Labels.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	project.UpdatedAt = time.Now().UTC()
+
+	if err := bs.db.UpdateProject(project); err != nil {
+		log.Printf("Error updating project: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	bs.cache.InvalidateProject(project.Name)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(project)
+}
+
+// List projects endpoint. ?org= lists an org's projects when the request
+// isn't scoped to one, and ?label=key:value, repeated for several labels, the
+// projects having them.
+func (bs *BuildService) listProjectsHandler(w http.ResponseWriter, r *http.Request) {
+	labels, ok := labelFilter(w, r)
+	if !ok {
+		return
+	}
+
+	projects, err := bs.db.ListProjects(listOrg(r), labels)
+	if err != nil {
+		log.Printf("Error listing projects: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(projects)
+}
+
+// PauseRequest is the optional body of a pause request
+type PauseRequest struct {
+	Reason string `json:"reason"`
+}
+
+// Pause project endpoint. Builds of a paused project stay queued until it is resumed.
+func (bs *BuildService) pauseProjectHandler(w http.ResponseWriter, r *http.Request) {
+	// The body is optional
+	var req PauseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	bs.setProjectPaused(w, r, true, strings.TrimSpace(req.Reason))
+}
+
+// Resume project endpoint
+func (bs *BuildService) resumeProjectHandler(w http.ResponseWriter, r *http.Request) {
+	bs.setProjectPaused(w, r, false, "")
+}
+
+func (bs *BuildService) setProjectPaused(w http.ResponseWriter, r *http.Request, paused bool, reason string) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	project, err := bs.db.SetProjectPaused(id, paused, reason)
+	if err != nil {
+		if err.Error() == "project not found" {
+			http.Error(w, "Project not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error pausing project: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	bs.cache.InvalidateProject(project.Name)
+
+	if paused {
+		log.Printf("Paused scheduling of project %s: %s", project.Name, reason)
+	} else {
+		log.Printf("Resumed scheduling of project %s", project.Name)
+		// Builds that accumulated while paused can start right away
+		bs.queue.Notify()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(project)
+}
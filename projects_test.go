@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestCreateProjectHandler(t *testing.T) {
+	tests := []struct {
+		name           string
+		requestBody    map[string]interface{}
+		dbError        error
+		expectedStatus int
+	}{
+		{
+			name:           "successful project creation",
+			requestBody:    map[string]interface{}{"name": "test-project", "git_url": "https://github.com/test/repo.git"},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:           "missing git url",
+			requestBody:    map[string]interface{}{"name": "test-project"},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "duplicate project",
+			requestBody:    map[string]interface{}{"name": "test-project", "git_url": "https://github.com/test/repo.git"},
+			dbError:        fmt.Errorf("project already exists"),
+			expectedStatus: http.StatusConflict,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service, mockDB := setupTestService()
+			if tt.expectedStatus != http.StatusBadRequest {
+				mockDB.On("CreateProject", mock.AnythingOfType("*main.Project")).Return(1, tt.dbError).Once()
+			}
+
+			body, _ := json.Marshal(tt.requestBody)
+			rr := httptest.NewRecorder()
+			service.createProjectHandler(rr, httptest.NewRequest("POST", "/api/v1/projects", bytes.NewBuffer(body)))
+
+			assert.Equal(t, tt.expectedStatus, rr.Code)
+			if tt.expectedStatus == http.StatusCreated {
+				var project Project
+				assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &project))
+				assert.Equal(t, 1, project.ID)
+				assert.Equal(t, "main", project.DefaultBranch)
+			}
+			mockDB.AssertExpectations(t)
+		})
+	}
+}
+
+func TestGetProjectHandler(t *testing.T) {
+	service, mockDB := setupTestService()
+
+	mockDB.On("GetProject", 1).Return(&Project{ID: 1, Name: "test-project"}, nil).Once()
+	mockDB.On("GetProject", 2).Return(nil, fmt.Errorf("project not found")).Once()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/projects/{id}", service.getProjectHandler).Methods("GET")
+
+	for path, expected := range map[string]int{
+		"/api/v1/projects/1":   http.StatusOK,
+		"/api/v1/projects/2":   http.StatusNotFound,
+		"/api/v1/projects/abc": http.StatusBadRequest,
+	} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		assert.Equal(t, expected, rr.Code, path)
+	}
+
+	mockDB.AssertExpectations(t)
+}
+
+func TestUpdateProjectHandler(t *testing.T) {
+	service, mockDB := setupTestService()
+
+	mockDB.On("GetProject", 1).Return(&Project{ID: 1, Name: "test-project", GitURL: "https://github.com/test/repo.git", DefaultBranch: "main", SkipCIEnabled: true}, nil).Once()
+	mockDB.On("UpdateProject", mock.MatchedBy(func(p *Project) bool {
+		return !p.SkipCIEnabled && p.SkipCIToken == "[wip]" && p.DefaultBranch == "main"
+	})).Return(nil).Once()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/projects/{id}", service.updateProjectHandler).Methods("PATCH")
+
+	body := bytes.NewBufferString(`{"skip_ci_enabled": false, "skip_ci_token": "[wip]"}`)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("PATCH", "/api/v1/projects/1", body))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	mockDB.AssertExpectations(t)
+}
+
+func TestUpdateProjectBuildTimeout(t *testing.T) {
+	tests := []struct {
+		name           string
+		body           string
+		heartbeat      string
+		expectedStatus int
+	}{
+		{"valid", `{"build_timeout_seconds": 1800}`, "", http.StatusOK},
+		{"reset to global", `{"build_timeout_seconds": 0}`, "", http.StatusOK},
+		{"negative", `{"build_timeout_seconds": -1}`, "", http.StatusBadRequest},
+		{"longer than lease with heartbeats", `{"build_timeout_seconds": 3600}`, "", http.StatusOK},
+		{"shorter than lease without heartbeats", `{"build_timeout_seconds": 240}`, "0", http.StatusOK},
+		{"longer than lease without heartbeats", `{"build_timeout_seconds": 3600}`, "0", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("QUEUE_HEARTBEAT_INTERVAL", tt.heartbeat)
+			service, mockDB := setupTestService()
+			mockDB.On("GetProject", 1).Return(&Project{ID: 1, Name: "test-project", GitURL: "https://github.com/test/repo.git", DefaultBranch: "main"}, nil).Once()
+			if tt.expectedStatus == http.StatusOK {
+				mockDB.On("UpdateProject", mock.AnythingOfType("*main.Project")).Return(nil).Once()
+			}
+
+			router := mux.NewRouter()
+			router.HandleFunc("/api/v1/projects/{id}", service.updateProjectHandler).Methods("PATCH")
+
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, httptest.NewRequest("PATCH", "/api/v1/projects/1", bytes.NewBufferString(tt.body)))
+
+			assert.Equal(t, tt.expectedStatus, rr.Code)
+			mockDB.AssertExpectations(t)
+		})
+	}
+}
+
+func TestPauseAndResumeProjectHandlers(t *testing.T) {
+	service, mockDB := setupTestService()
+	pausedAt := time.Now()
+
+	mockDB.On("SetProjectPaused", 1, true, "runners are down").Return(&Project{ID: 1, Name: "test-project", Paused: true, PausedAt: &pausedAt, PauseReason: "runners are down"}, nil).Once()
+	mockDB.On("SetProjectPaused", 1, true, "").Return(&Project{ID: 1, Name: "test-project", Paused: true, PausedAt: &pausedAt}, nil).Once()
+	mockDB.On("SetProjectPaused", 1, false, "").Return(&Project{ID: 1, Name: "test-project"}, nil).Once()
+	mockDB.On("SetProjectPaused", 2, false, "").Return(nil, fmt.Errorf("project not found")).Once()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/projects/{id}/pause", service.pauseProjectHandler).Methods("POST")
+	router.HandleFunc("/api/v1/projects/{id}/resume", service.resumeProjectHandler).Methods("POST")
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/api/v1/projects/1/pause", bytes.NewBufferString(`{"reason": " runners are down "}`)))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var project Project
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &project))
+	assert.True(t, project.Paused)
+	assert.Equal(t, "runners are down", project.PauseReason)
+
+	for path, expected := range map[string]int{
+		"/api/v1/projects/1/pause":  http.StatusOK,
+		"/api/v1/projects/1/resume": http.StatusOK,
+		"/api/v1/projects/2/resume": http.StatusNotFound,
+		"/api/v1/projects/x/resume": http.StatusBadRequest,
+	} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("POST", path, nil))
+		assert.Equal(t, expected, rr.Code, path)
+	}
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("POST", "/api/v1/projects/1/pause", bytes.NewBufferString(`{`)))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	mockDB.AssertExpectations(t)
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// provenanceArtifactName is the artifact a build's provenance is stored
+	// as. Builds can't publish artifacts under this name themselves.
+	provenanceArtifactName = "provenance.intoto.json"
+	// provenancePayloadType is the DSSE payload type of in-toto statements
+	provenancePayloadType = "application/vnd.in-toto+json"
+	// provenanceBuildType identifies how to interpret the build definition
+	provenanceBuildType = "https://github.com/ambicuity/Cloud-Native-Microservice-for-Developer-Tools/build/v1"
+)
+
+// InTotoStatement attests to the artifacts listed as its subjects
+type InTotoStatement struct {
+	Type          string               `json:"_type"`
+	Subject       []ProvenanceSubject  `json:"subject"`
+	PredicateType string               `json:"predicateType"`
+	Predicate     *ProvenancePredicate `json:"predicate"`
+}
+
+// ProvenanceSubject is an artifact and its digests
+type ProvenanceSubject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+// ProvenancePredicate is a SLSA v1 provenance predicate: what was built,
+// from which sources, and by whom
+type ProvenancePredicate struct {
+	BuildDefinition ProvenanceBuildDefinition `json:"buildDefinition"`
+	RunDetails      ProvenanceRunDetails      `json:"runDetails"`
+}
+
+// ProvenanceBuildDefinition records the build's parameters and sources
+type ProvenanceBuildDefinition struct {
+	BuildType          string                 `json:"buildType"`
+	ExternalParameters map[string]interface{} `json:"externalParameters"`
+	InternalParameters ConfigSnapshot         `json:"internalParameters,omitempty"`
+	// ResolvedDependencies are the sources the build checked out
+	ResolvedDependencies []ProvenanceSubject `json:"resolvedDependencies,omitempty"`
+}
+
+// ProvenanceRunDetails identifies the builder and the build run
+type ProvenanceRunDetails struct {
+	Builder  ProvenanceBuilder  `json:"builder"`
+	Metadata ProvenanceMetadata `json:"metadata"`
+}
+
+// ProvenanceBuilder identifies the service that ran the build
+type ProvenanceBuilder struct {
+	ID string `json:"id"`
+}
+
+// ProvenanceMetadata describes the build run
+type ProvenanceMetadata struct {
+	InvocationID string     `json:"invocationId"`
+	StartedOn    *time.Time `json:"startedOn,omitempty"`
+	FinishedOn   time.Time  `json:"finishedOn"`
+}
+
+// ProvenanceEnvelope is a DSSE envelope holding a statement and its
+// signatures. The payload is base64 encoded in JSON.
+type ProvenanceEnvelope struct {
+	PayloadType string                `json:"payloadType"`
+	Payload     []byte                `json:"payload"`
+	Signatures  []ProvenanceSignature `json:"signatures"`
+}
+
+// ProvenanceSignature is an Ed25519 signature of an envelope's payload
+type ProvenanceSignature struct {
+	KeyID string `json:"keyid"`
+	Sig   []byte `json:"sig"`
+}
+
+// ProvenanceSigner signs provenance with an Ed25519 key
+type ProvenanceSigner struct {
+	key   ed25519.PrivateKey
+	keyID string
+}
+
+// NewProvenanceSignerFromEnv loads the PKCS #8 PEM Ed25519 key in
+// PROVENANCE_KEY_FILE. Returns nil, leaving provenance unsigned, when it's
+// unset.
+func NewProvenanceSignerFromEnv() (*ProvenanceSigner, error) {
+	file := os.Getenv("PROVENANCE_KEY_FILE")
+	if file == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return newProvenanceSigner(data)
+}
+
+// newProvenanceSigner parses a PKCS #8 PEM Ed25519 private key
+func newProvenanceSigner(data []byte) (*ProvenanceSigner, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("expected a PEM encoded PKCS #8 private key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("expected an Ed25519 key, got %T", parsed)
+	}
+
+	public, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(public)
+	return &ProvenanceSigner{key: key, keyID: "sha256:" + hex.EncodeToString(digest[:])}, nil
+}
+
+// PublicKeyPEM returns the PEM encoded public key that verifies signatures
+func (ps *ProvenanceSigner) PublicKeyPEM() []byte {
+	public, _ := x509.MarshalPKIXPublicKey(ps.key.Public())
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public})
+}
+
+// Sign signs an envelope's payload
+func (ps *ProvenanceSigner) Sign(envelope *ProvenanceEnvelope) {
+	sig := ed25519.Sign(ps.key, dssePAE(envelope.PayloadType, envelope.Payload))
+	envelope.Signatures = append(envelope.Signatures, ProvenanceSignature{KeyID: ps.keyID, Sig: sig})
+}
+
+// dssePAE is the DSSE pre-authentication encoding signatures are made over
+func dssePAE(payloadType string, payload []byte) []byte {
+	return []byte(fmt.Sprintf("DSSEv1 %d %s %d %s", len(payloadType), payloadType, len(payload), payload))
+}
+
+// verifyProvenance checks an envelope carries a valid signature by the key
+func verifyProvenance(envelope *ProvenanceEnvelope, key ed25519.PublicKey) bool {
+	message := dssePAE(envelope.PayloadType, envelope.Payload)
+	for _, signature := range envelope.Signatures {
+		if ed25519.Verify(key, message, signature.Sig) {
+			return true
+		}
+	}
+	return false
+}
+
+// provenanceStatement describes how a build produced its artifacts. Only
+// artifacts its pipeline published are subjects: anyone able to reach the
+// build's upload endpoint could have written the others.
+func (bs *BuildService) provenanceStatement(build *BuildRequest, artifacts []*Artifact, config ConfigSnapshot) *InTotoStatement {
+	subjects := []ProvenanceSubject{}
+	for _, artifact := range artifacts {
+		if !artifact.Published || artifact.Name == provenanceArtifactName {
+			continue
+		}
+		subjects = append(subjects, ProvenanceSubject{Name: artifact.Name, Digest: map[string]string{"sha256": artifact.SHA256}})
+	}
+
+	ref := "refs/heads/" + build.Branch
+	if build.Tag != "" {
+		ref = "refs/tags/" + build.Tag
+	}
+	parameters := map[string]interface{}{
+		"project":        build.ProjectName,
+		"repository":     build.GitURL,
+		"ref":            ref,
+		"trigger_source": build.TriggerSource,
+	}
+	if build.PullRequest != 0 {
+		parameters["pull_request"] = build.PullRequest
+	}
+	if len(build.Matrix) > 0 {
+		parameters["matrix"] = build.Matrix
+	}
+
+	var sources []ProvenanceSubject
+	if build.CommitSHA != "" {
+		sources = append(sources, ProvenanceSubject{
+			Name:   "git+" + build.GitURL + "@" + ref,
+			Digest: map[string]string{"gitCommit": build.CommitSHA},
+		})
+	}
+
+	return &InTotoStatement{
+		Type:          "https://in-toto.io/Statement/v1",
+		Subject:       subjects,
+		PredicateType: "https://slsa.dev/provenance/v1",
+		Predicate: &ProvenancePredicate{
+			BuildDefinition: ProvenanceBuildDefinition{
+				BuildType:            provenanceBuildType,
+				ExternalParameters:   parameters,
+				InternalParameters:   config,
+				ResolvedDependencies: sources,
+			},
+			RunDetails: ProvenanceRunDetails{
+				Builder: ProvenanceBuilder{ID: bs.links.Base("")},
+				Metadata: ProvenanceMetadata{
+					InvocationID: bs.links.BuildURL(build),
+					StartedOn:    build.StartedAt,
+					FinishedOn:   build.UpdatedAt,
+				},
+			},
+		},
+	}
+}
+
+// recordProvenance stores the signed provenance of a finished build
+// alongside its artifacts
+func (bs *BuildService) recordProvenance(ctx context.Context, build *BuildRequest, config ConfigSnapshot) {
+	artifacts, err := bs.db.ListArtifacts(build.ID)
+	if err != nil {
+		bs.errors.Capture("provenance", fmt.Errorf("listing artifacts: %w", err), build)
+		return
+	}
+	payload, err := json.Marshal(bs.provenanceStatement(build, artifacts, config))
+	if err != nil {
+		bs.errors.Capture("provenance", err, build)
+		return
+	}
+	envelope := &ProvenanceEnvelope{PayloadType: provenancePayloadType, Payload: payload, Signatures: []ProvenanceSignature{}}
+	if bs.provenance != nil {
+		bs.provenance.Sign(envelope)
+	}
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		bs.errors.Capture("provenance", err, build)
+		return
+	}
+
+	artifact := newArtifact(build, provenanceArtifactName, int64(len(data)), "application/json")
+	if err := bs.artifacts.put(ctx, artifact, bytes.NewReader(data)); err != nil {
+		bs.errors.Capture("provenance", fmt.Errorf("storing %s: %w", artifact.StorageKey, err), build)
+		return
+	}
+	if _, err := bs.db.CreateArtifact(artifact); err != nil {
+		bs.errors.Capture("provenance", fmt.Errorf("recording provenance: %w", err), build)
+	}
+}
+
+// Build provenance endpoint. Returns the DSSE envelope of the build's
+// provenance, signed when PROVENANCE_KEY_FILE is set.
+func (bs *BuildService) provenanceHandler(w http.ResponseWriter, r *http.Request) {
+	build, ok := bs.artifactBuild(w, r)
+	if !ok {
+		return
+	}
+	if !finishedStatuses[build.Status] {
+		http.Error(w, "Provenance is recorded once the build finishes", http.StatusConflict)
+		return
+	}
+
+	artifact, err := bs.db.GetArtifact(build.ID, provenanceArtifactName)
+	if err != nil {
+		if err.Error() == "artifact not found" {
+			http.Error(w, "Provenance not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error getting artifact: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	content, err := bs.artifacts.store.Get(r.Context(), artifact.StorageKey)
+	if err != nil {
+		if errors.Is(err, errArtifactNotFound) {
+			http.Error(w, "Provenance not found", http.StatusNotFound)
+			return
+		}
+		bs.errors.Capture("artifacts", fmt.Errorf("reading %s: %w", artifact.StorageKey, err), build)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer content.Close()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", `"`+artifact.SHA256+`"`)
+	io.Copy(w, content)
+}
+
+// Provenance public key endpoint
+func (bs *BuildService) provenanceKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if bs.provenance == nil {
+		http.Error(w, "Provenance signing is not configured", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Write(bs.provenance.PublicKeyPEM())
+}
+
+// reservedArtifactName reports names builds can't publish artifacts under
+func reservedArtifactName(name string) bool {
+	return strings.EqualFold(name, provenanceArtifactName)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// testProvenanceSigner returns a signer with a freshly generated key
+func testProvenanceSigner(t *testing.T) *ProvenanceSigner {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	signer, err := newProvenanceSigner(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	require.NoError(t, err)
+	return signer
+}
+
+// provenancePublicKey parses a signer's PEM public key
+func provenancePublicKey(t *testing.T, signer *ProvenanceSigner) ed25519.PublicKey {
+	block, _ := pem.Decode(signer.PublicKeyPEM())
+	require.NotNil(t, block)
+	public, err := x509.ParsePKIXPublicKey(block.Bytes)
+	require.NoError(t, err)
+	return public.(ed25519.PublicKey)
+}
+
+func TestProvenanceSigner(t *testing.T) {
+	signer := testProvenanceSigner(t)
+	public := provenancePublicKey(t, signer)
+	assert.True(t, strings.HasPrefix(signer.keyID, "sha256:"))
+
+	envelope := &ProvenanceEnvelope{PayloadType: provenancePayloadType, Payload: []byte(`{"_type":"statement"}`)}
+	signer.Sign(envelope)
+	require.Len(t, envelope.Signatures, 1)
+	assert.Equal(t, signer.keyID, envelope.Signatures[0].KeyID)
+	assert.True(t, verifyProvenance(envelope, public))
+
+	// Signatures cover the payload and its type
+	envelope.PayloadType = "text/plain"
+	assert.False(t, verifyProvenance(envelope, public))
+	envelope.PayloadType, envelope.Payload = provenancePayloadType, []byte(`{"_type":"forged"}`)
+	assert.False(t, verifyProvenance(envelope, public))
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(ecKey)
+	require.NoError(t, err)
+	_, err = newProvenanceSigner(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	assert.Error(t, err)
+	_, err = newProvenanceSigner([]byte("not a key"))
+	assert.Error(t, err)
+}
+
+func TestRecordProvenance(t *testing.T) {
+	service, mockDB := setupTestService()
+	service.artifacts.store = NewLocalArtifactStore(t.TempDir())
+	service.provenance = testProvenanceSigner(t)
+	started := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	build := &BuildRequest{ID: 3, ProjectName: "api", GitURL: "https://github.com/example/api.git", Tag: "v1.2.0",
+		CommitSHA: testCommitSHA, TriggerSource: "webhook", Status: "success", StartedAt: &started, UpdatedAt: started.Add(time.Minute)}
+
+	// Only artifacts the pipeline published are attested, not uploads
+	mockDB.On("ListArtifacts", 3).Return([]*Artifact{
+		{BuildID: 3, Name: "dist/api.tar.gz", SHA256: "abc123", Published: true},
+		{BuildID: 3, Name: "dist/api.exe", SHA256: "def456"},
+	}, nil)
+	var recorded *Artifact
+	mockDB.On("CreateArtifact", mock.AnythingOfType("*main.Artifact")).Run(func(args mock.Arguments) {
+		recorded = args.Get(0).(*Artifact)
+	}).Return(9, nil)
+
+	service.recordProvenance(context.Background(), build, ConfigSnapshot{"executor": "local"})
+	require.NotNil(t, recorded)
+	assert.Equal(t, provenanceArtifactName, recorded.Name)
+	assert.Equal(t, "builds/3/"+provenanceArtifactName, recorded.StorageKey)
+	assert.NotEmpty(t, recorded.SHA256)
+
+	content, err := service.artifacts.store.Get(context.Background(), recorded.StorageKey)
+	require.NoError(t, err)
+	defer content.Close()
+	var envelope ProvenanceEnvelope
+	require.NoError(t, json.NewDecoder(content).Decode(&envelope))
+	assert.True(t, verifyProvenance(&envelope, provenancePublicKey(t, service.provenance)))
+
+	var statement InTotoStatement
+	require.NoError(t, json.Unmarshal(envelope.Payload, &statement))
+	assert.Equal(t, "https://slsa.dev/provenance/v1", statement.PredicateType)
+	assert.Equal(t, []ProvenanceSubject{{Name: "dist/api.tar.gz", Digest: map[string]string{"sha256": "abc123"}}}, statement.Subject)
+	definition := statement.Predicate.BuildDefinition
+	assert.Equal(t, "refs/tags/v1.2.0", definition.ExternalParameters["ref"])
+	assert.Equal(t, "local", definition.InternalParameters["executor"])
+	assert.Equal(t, []ProvenanceSubject{{
+		Name:   "git+https://github.com/example/api.git@refs/tags/v1.2.0",
+		Digest: map[string]string{"gitCommit": testCommitSHA},
+	}}, definition.ResolvedDependencies)
+	assert.Equal(t, "http://localhost:8080/api/v1/builds/3", statement.Predicate.RunDetails.Metadata.InvocationID)
+}
+
+func TestProvenanceHandler(t *testing.T) {
+	service, mockDB := setupTestService()
+	service.artifacts.store = NewLocalArtifactStore(t.TempDir())
+	envelope := `{"payloadType":"application/vnd.in-toto+json","payload":"e30=","signatures":[]}`
+	provenance := &Artifact{BuildID: 3, Name: provenanceArtifactName, StorageKey: "builds/3/" + provenanceArtifactName}
+	require.NoError(t, service.artifacts.put(context.Background(), provenance, strings.NewReader(envelope)))
+
+	mockDB.On("GetBuild", 3).Return(&BuildRequest{ID: 3, Status: "success"}, nil)
+	mockDB.On("GetBuild", 4).Return(&BuildRequest{ID: 4, Status: "running"}, nil)
+	mockDB.On("GetBuild", 5).Return(&BuildRequest{ID: 5, Status: "failed"}, nil)
+	mockDB.On("GetBuild", 6).Return(nil, fmt.Errorf("build not found"))
+	mockDB.On("GetArtifact", 3, provenanceArtifactName).Return(provenance, nil)
+	mockDB.On("GetArtifact", 5, provenanceArtifactName).Return(nil, fmt.Errorf("artifact not found"))
+
+	get := func(id string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/v1/builds/"+id+"/provenance", nil)
+		req = mux.SetURLVars(req, map[string]string{"id": id})
+		rr := httptest.NewRecorder()
+		service.provenanceHandler(rr, req)
+		return rr
+	}
+
+	rr := get("3")
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, envelope, rr.Body.String())
+	assert.Equal(t, `"`+provenance.SHA256+`"`, rr.Header().Get("ETag"))
+
+	assert.Equal(t, http.StatusConflict, get("4").Code)
+	// Builds that finished before provenance was recorded have none
+	assert.Equal(t, http.StatusNotFound, get("5").Code)
+	assert.Equal(t, http.StatusNotFound, get("6").Code)
+	assert.Equal(t, http.StatusBadRequest, get("x").Code)
+
+	// Builds can't upload provenance of their own
+	req := httptest.NewRequest("PUT", "/api/v1/builds/4/artifacts/"+provenanceArtifactName, strings.NewReader("{}"))
+	req = mux.SetURLVars(req, map[string]string{"id": "4", "name": provenanceArtifactName})
+	rr = httptest.NewRecorder()
+	service.uploadArtifactHandler(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestProvenanceKeyHandler(t *testing.T) {
+	service, _ := setupTestService()
+	rr := httptest.NewRecorder()
+	service.provenanceKeyHandler(rr, httptest.NewRequest("GET", "/api/v1/provenance/public-key", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	service.provenance = testProvenanceSigner(t)
+	rr = httptest.NewRecorder()
+	service.provenanceKeyHandler(rr, httptest.NewRequest("GET", "/api/v1/provenance/public-key", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, string(service.provenance.PublicKeyPEM()), rr.Body.String())
+}
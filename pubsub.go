@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PubSubSink publishes build events to Google Cloud Pub/Sub topics, choosing
+// the topic by the organization owning the build's repository
+type PubSubSink struct {
+	topics   map[string]string
+	endpoint string
+	// tokens is nil when publishing to the emulator, which needs no auth
+	tokens *GCPTokenSource
+	health *IntegrationHealth
+	client *http.Client
+}
+
+// NewPubSubSinkFromEnv creates a Pub/Sub sink when PUBSUB_TOPICS is set, or
+// returns nil. PUBSUB_EMULATOR_HOST points it at a local emulator.
+func NewPubSubSinkFromEnv(health *IntegrationHealth) *PubSubSink {
+	topics := parseOrgTargets(os.Getenv("PUBSUB_TOPICS"))
+	if len(topics) == 0 {
+		return nil
+	}
+
+	sink := &PubSubSink{
+		topics:   topics,
+		endpoint: "https://pubsub.googleapis.com",
+		tokens:   NewGCPTokenSource(),
+		health:   health,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+	if emulator := os.Getenv("PUBSUB_EMULATOR_HOST"); emulator != "" {
+		sink.endpoint = "http://" + emulator
+		sink.tokens = nil
+	}
+	return sink
+}
+
+// Name identifies the integration
+func (ps *PubSubSink) Name() string {
+	return "pubsub"
+}
+
+// pubsubMessage is a single message of a publish request
+type pubsubMessage struct {
+	Data       []byte            `json:"data"`
+	Attributes map[string]string `json:"attributes"`
+}
+
+// Deliver publishes the event to the topic of the build's organization. The
+// message data is the event JSON; attributes carry the status, project and
+// build ID so subscriptions can filter without decoding it.
+func (ps *PubSubSink) Deliver(ctx context.Context, event BuildEvent) error {
+	topic, ok := orgTarget(ps.topics, &event.Build)
+	if !ok {
+		return nil
+	}
+	if !ps.health.Allow(ps.Name()) {
+		return errIntegrationDisabled
+	}
+
+	err := ps.publish(ctx, topic, event)
+	ps.health.Record(ps.Name(), err, &event.Build)
+	return err
+}
+
+func (ps *PubSubSink) publish(ctx context.Context, topic string, event BuildEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(map[string][]pubsubMessage{
+		"messages": {{
+			Data: data,
+			Attributes: map[string]string{
+				"status":   event.Build.Status,
+				"project":  event.Build.ProjectName,
+				"build_id": strconv.Itoa(event.Build.ID),
+			},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/v1/%s:publish", ps.endpoint, topic), bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if ps.tokens != nil {
+		token, err := ps.tokens.Token(ctx)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := ps.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("pubsub: publishing to %s: status %d: %s", topic, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPubSubSinkDeliver(t *testing.T) {
+	type published struct {
+		path          string
+		authorization string
+		messages      []pubsubMessage
+	}
+	var requests []published
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct{ Messages []pubsubMessage }
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		requests = append(requests, published{r.URL.Path, r.Header.Get("Authorization"), body.Messages})
+		if strings.Contains(r.URL.Path, "missing") {
+			http.Error(w, `{"error": {"code": 404, "message": "Resource not found"}}`, http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"messageIds": ["1"]}`))
+	}))
+	defer server.Close()
+
+	t.Setenv("PUBSUB_TOPICS", "acme=projects/acme-ci/topics/builds,*=projects/shared/topics/missing")
+	t.Setenv("PUBSUB_EMULATOR_HOST", strings.TrimPrefix(server.URL, "http://"))
+	service, mockDB := setupTestService()
+	sink := NewPubSubSinkFromEnv(service.integrations)
+	require.NotNil(t, sink)
+	assert.Nil(t, sink.tokens)
+
+	mockDB.On("GetIntegration", "pubsub").Return(nil, fmt.Errorf("integration not found"))
+	mockDB.On("ResetIntegrationFailures", "pubsub").Return(nil).Once()
+	mockDB.On("RecordIntegrationFailure", "pubsub", mock.AnythingOfType("string"), 10).
+		Return(&IntegrationState{Name: "pubsub", ConsecutiveFailures: 1}, nil).Once()
+
+	event := BuildEvent{Build: BuildRequest{ID: 42, ProjectName: "api", GitURL: "git@github.com:acme/api.git", Status: "success"}, Time: time.Now()}
+	require.NoError(t, sink.Deliver(context.Background(), event))
+
+	require.Len(t, requests, 1)
+	assert.Equal(t, "/v1/projects/acme-ci/topics/builds:publish", requests[0].path)
+	assert.Empty(t, requests[0].authorization)
+	require.Len(t, requests[0].messages, 1)
+	assert.Equal(t, map[string]string{"status": "success", "project": "api", "build_id": "42"}, requests[0].messages[0].Attributes)
+	var data BuildEvent
+	require.NoError(t, json.Unmarshal(requests[0].messages[0].Data, &data))
+	assert.Equal(t, 42, data.Build.ID)
+
+	other := event
+	other.Build.GitURL = "https://github.com/other/api.git"
+	err := sink.Deliver(context.Background(), other)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "status 404")
+	mockDB.AssertExpectations(t)
+}
+
+func TestPubSubSinkAuthenticates(t *testing.T) {
+	var authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			w.Write([]byte(`{"access_token": "ya29.token", "expires_in": 3600}`))
+			return
+		}
+		authorization = r.Header.Get("Authorization")
+		w.Write([]byte(`{"messageIds": ["1"]}`))
+	}))
+	defer server.Close()
+
+	t.Setenv("PUBSUB_TOPICS", "*=projects/ci/topics/builds")
+	t.Setenv("PUBSUB_EMULATOR_HOST", "")
+	service, mockDB := setupTestService()
+	sink := NewPubSubSinkFromEnv(service.integrations)
+	require.NotNil(t, sink)
+	sink.endpoint = server.URL
+	sink.tokens.metadata = server.URL
+
+	mockDB.On("GetIntegration", "pubsub").Return(nil, fmt.Errorf("integration not found")).Once()
+	mockDB.On("ResetIntegrationFailures", "pubsub").Return(nil).Once()
+
+	require.NoError(t, sink.Deliver(context.Background(), BuildEvent{Build: BuildRequest{ID: 1, GitURL: "https://github.com/acme/api"}}))
+	assert.Equal(t, "Bearer ya29.token", authorization)
+	mockDB.AssertExpectations(t)
+}
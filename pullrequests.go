@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// buildStatusContext names the commit status reporting pull request builds
+const buildStatusContext = "buildservice/build"
+
+// commitStatusTokenSecret is the project secret holding a token that reports
+// the project's commit statuses instead of GITHUB_TOKEN or GITLAB_TOKEN. It
+// is not passed to builds.
+const commitStatusTokenSecret = "COMMIT_STATUS_TOKEN"
+
+// commitStates maps build statuses to the commit status states of each forge.
+// Builds in other statuses aren't reported.
+var commitStates = map[string]map[string]string{
+	"github": {
+		"queued":    "pending",
+		"running":   "pending",
+		"success":   "success",
+		"failed":    "failure",
+		"timeout":   "failure",
+		"cancelled": "error",
+	},
+	"gitlab": {
+		"queued":    "pending",
+		"running":   "running",
+		"success":   "success",
+		"failed":    "failed",
+		"timeout":   "failed",
+		"cancelled": "canceled",
+	},
+}
+
+// commitStatusDescriptions describe the reported build statuses
+var commitStatusDescriptions = map[string]string{
+	"queued":    "Build #%d is queued",
+	"running":   "Build #%d is running",
+	"success":   "Build #%d succeeded",
+	"failed":    "Build #%d failed",
+	"timeout":   "Build #%d timed out",
+	"cancelled": "Build #%d was cancelled",
+}
+
+// PullRequestEvent is the forge-independent description of a pull or merge
+// request whose code was opened or updated
+type PullRequestEvent struct {
+	Number int
+	// MergeRef is the ref, below refs/, of the request's head merged into
+	// its target branch
+	MergeRef string
+	HeadSHA  string
+	Title    string
+	Author   string
+	// Fork is set when the head branch lives in another repository
+	Fork         bool
+	Repositories []string
+}
+
+// githubPullRequestPayload is the subset of GitHub's pull_request event we use
+type githubPullRequestPayload struct {
+	Action      string `json:"action"`
+	PullRequest struct {
+		Number int    `json:"number"`
+		Title  string `json:"title"`
+		User   struct {
+			Login string `json:"login"`
+		} `json:"user"`
+		Head struct {
+			SHA  string `json:"sha"`
+			Repo struct {
+				FullName string `json:"full_name"`
+			} `json:"repo"`
+		} `json:"head"`
+	} `json:"pull_request"`
+	Repository struct {
+		FullName string `json:"full_name"`
+		CloneURL string `json:"clone_url"`
+		SSHURL   string `json:"ssh_url"`
+		HTMLURL  string `json:"html_url"`
+	} `json:"repository"`
+}
+
+// gitlabMergeRequestPayload is the subset of GitLab's merge request hook we use
+type gitlabMergeRequestPayload struct {
+	User struct {
+		Username string `json:"username"`
+	} `json:"user"`
+	Project struct {
+		GitHTTPURL string `json:"git_http_url"`
+		GitSSHURL  string `json:"git_ssh_url"`
+		WebURL     string `json:"web_url"`
+	} `json:"project"`
+	ObjectAttributes struct {
+		IID             int    `json:"iid"`
+		Title           string `json:"title"`
+		Action          string `json:"action"`
+		SourceProjectID int    `json:"source_project_id"`
+		TargetProjectID int    `json:"target_project_id"`
+		// OldRev is only set on updates that pushed commits
+		OldRev     string `json:"oldrev"`
+		LastCommit struct {
+			ID string `json:"id"`
+		} `json:"last_commit"`
+	} `json:"object_attributes"`
+}
+
+// githubPullRequest validates the pipeline file of an opened or updated pull
+// request and builds its merge ref. Pull requests with an invalid pipeline
+// file aren't built.
+func (bs *BuildService) githubPullRequest(w http.ResponseWriter, r *http.Request, body []byte) {
+	var payload githubPullRequestPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		http.Error(w, "Invalid payload", http.StatusBadRequest)
+		return
+	}
+
+	switch payload.Action {
+	case "opened", "synchronize", "reopened":
+	default:
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	repositories := []string{payload.Repository.CloneURL, payload.Repository.SSHURL, payload.Repository.HTMLURL}
+	project, err := bs.findProject(repositories)
+	if err != nil {
+		if err.Error() == "project not found" {
+			http.Error(w, "No project registered for repository", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error looking up project: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	validation, err := bs.validatePullRequestPipeline(r.Context(), project, &payload)
+	if err != nil {
+		log.Printf("Error validating %s of pull request %d: %v", pipelineFile, payload.PullRequest.Number, err)
+		http.Error(w, "Error validating pipeline file", http.StatusBadGateway)
+		return
+	}
+	if validation != nil && !validation.Valid {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(validation)
+		return
+	}
+
+	pr := payload.PullRequest
+	bs.handlePullRequest(w, r, project, &PullRequestEvent{
+		Number:       pr.Number,
+		MergeRef:     fmt.Sprintf("pull/%d/merge", pr.Number),
+		HeadSHA:      pr.Head.SHA,
+		Title:        pr.Title,
+		Author:       pr.User.Login,
+		Fork:         !strings.EqualFold(pr.Head.Repo.FullName, payload.Repository.FullName),
+		Repositories: repositories,
+	})
+}
+
+// gitlabMergeRequest builds the merge ref of an opened or updated merge request
+func (bs *BuildService) gitlabMergeRequest(w http.ResponseWriter, r *http.Request) {
+	var payload gitlabMergeRequestPayload
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxWebhookPayload)).Decode(&payload); err != nil {
+		http.Error(w, "Invalid payload", http.StatusBadRequest)
+		return
+	}
+
+	mr := payload.ObjectAttributes
+	switch {
+	case mr.Action == "open", mr.Action == "reopen":
+	case mr.Action == "update" && mr.OldRev != "":
+	default:
+		// Closes, merges, approvals and edits of the description
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	repositories := []string{payload.Project.GitHTTPURL, payload.Project.GitSSHURL, payload.Project.WebURL}
+	project, err := bs.findProject(repositories)
+	if err != nil {
+		if err.Error() == "project not found" {
+			http.Error(w, "No project registered for repository", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error looking up project: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	bs.handlePullRequest(w, r, project, &PullRequestEvent{
+		Number:       mr.IID,
+		MergeRef:     fmt.Sprintf("merge-requests/%d/merge", mr.IID),
+		HeadSHA:      mr.LastCommit.ID,
+		Title:        mr.Title,
+		Author:       payload.User.Username,
+		Fork:         mr.SourceProjectID != mr.TargetProjectID,
+		Repositories: repositories,
+	})
+}
+
+// handlePullRequest enqueues a build of a pull request's merge ref. Its
+// progress is reported on the head commit by the CommitStatusReporter.
+func (bs *BuildService) handlePullRequest(w http.ResponseWriter, r *http.Request, project *Project, event *PullRequestEvent) {
+	sha := strings.ToLower(event.HeadSHA)
+	if !commitSHAPattern.MatchString(sha) {
+		http.Error(w, "Invalid payload", http.StatusBadRequest)
+		return
+	}
+
+	build := &BuildRequest{
+		ProjectName:     project.Name,
+		GitURL:          project.GitURL,
+		Branch:          event.MergeRef,
+		CommitSHA:       sha,
+		CommitMessage:   truncateCommitMessage(event.Title),
+		CommitAuthor:    event.Author,
+		TriggerSource:   triggerPullRequest,
+		Org:             project.Org,
+		PullRequest:     event.Number,
+		PullRequestFork: event.Fork,
+	}
+	if err := bs.enqueueBuild(r.Context(), build); err != nil {
+		log.Printf("Error creating build: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Queued build %d for %s pull request %d", build.ID, project.Name, event.Number)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(build)
+}
+
+// CommitStatusReporter reports the progress of pull request builds as commit
+// statuses of the request's head commit, which forges can require to pass
+// before merging. Statuses are reported with the project's
+// COMMIT_STATUS_TOKEN secret, or GITHUB_TOKEN or GITLAB_TOKEN.
+type CommitStatusReporter struct {
+	db     DatabaseInterface
+	health *IntegrationHealth
+	github *GitHubClient
+	gitlab *GitLabClient
+}
+
+// NewCommitStatusReporterFromEnv creates a commit status reporter for the
+// GitHub and GitLab APIs configured in the environment
+func NewCommitStatusReporterFromEnv(db DatabaseInterface, health *IntegrationHealth) *CommitStatusReporter {
+	return &CommitStatusReporter{
+		db:     db,
+		health: health,
+		github: newGitHubClient(os.Getenv("GITHUB_TOKEN")),
+		gitlab: newGitLabClient(os.Getenv("GITLAB_TOKEN")),
+	}
+}
+
+// Name identifies the integration
+func (cr *CommitStatusReporter) Name() string {
+	return "commit-statuses"
+}
+
+// Deliver reports the status of a pull request build
+func (cr *CommitStatusReporter) Deliver(ctx context.Context, event BuildEvent) error {
+	build := &event.Build
+	if build.PullRequest == 0 || build.CommitSHA == "" {
+		return nil
+	}
+
+	key := repositoryKey(build.GitURL)
+	host, repo, _ := strings.Cut(key, "/")
+	forge, token := "", ""
+	switch host {
+	case cr.github.Host():
+		forge, token = "github", cr.github.token
+	case cr.gitlab.Host():
+		forge, token = "gitlab", cr.gitlab.token
+	default:
+		return nil
+	}
+	state, ok := commitStates[forge][build.Status]
+	if !ok {
+		return nil
+	}
+
+	project, err := cr.db.GetProjectByName(build.ProjectName)
+	if err != nil {
+		if err.Error() == "project not found" {
+			return nil
+		}
+		return err
+	}
+	secrets, err := cr.db.ListProjectSecrets(project.ID)
+	if err != nil {
+		return err
+	}
+	for _, secret := range secrets {
+		if secret.Name == commitStatusTokenSecret {
+			token = secret.Value
+		}
+	}
+	if token == "" {
+		// Nothing to authenticate with
+		return nil
+	}
+
+	if !cr.health.Allow(cr.Name()) {
+		return errIntegrationDisabled
+	}
+	description := fmt.Sprintf(commitStatusDescriptions[build.Status], build.ID)
+	if forge == "github" {
+		err = newGitHubClient(token).SetStatus(ctx, repo, build.CommitSHA, state, description, buildStatusContext, event.URL)
+	} else {
+		err = newGitLabClient(token).SetStatus(ctx, repo, build.CommitSHA, state, description, buildStatusContext, event.URL)
+	}
+	if err != nil {
+		err = fmt.Errorf("reporting build %d on %s@%s: %w", build.ID, repo, build.CommitSHA, err)
+	}
+	cr.health.Record(cr.Name(), err, build)
+	return err
+}
+
+// SetStatus reports a commit status of the project, linking to targetURL
+// when it is set
+func (gl *GitLabClient) SetStatus(ctx context.Context, repo, sha, state, description, name, targetURL string) error {
+	status := map[string]string{"state": state, "description": description, "name": name}
+	if targetURL != "" {
+		status["target_url"] = targetURL
+	}
+	body, _ := json.Marshal(status)
+
+	path := fmt.Sprintf("/projects/%s/statuses/%s", url.PathEscape(repo), sha)
+	resp, err := gl.do(ctx, "POST", path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("gitlab api: unexpected status %d setting commit status", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGitLabMergeRequestWebhook(t *testing.T) {
+	t.Setenv("GITLAB_WEBHOOK_TOKEN", "gitlab-token")
+	service, mockDB := setupTestService()
+	mockDB.On("GetProjectByRepository", "gitlab.com/test/repo").
+		Return(&Project{ID: 2, Name: "gitlab-project", GitURL: "https://gitlab.com/test/repo.git", AutoVersion: true}, nil)
+	mockDB.On("CreateBuild", mock.MatchedBy(func(b *BuildRequest) bool {
+		return b.Branch == "merge-requests/4/merge" && b.PullRequest == 4 && b.PullRequestFork &&
+			b.CommitSHA == testCommitSHA && b.TriggerSource == triggerPullRequest && !b.AutoVersion
+	})).Return(9, nil).Once()
+
+	send := func(action, oldRev string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]interface{}{
+			"user":    map[string]string{"username": "jane"},
+			"project": map[string]string{"git_http_url": "https://gitlab.com/test/repo.git"},
+			"object_attributes": map[string]interface{}{
+				"iid":               4,
+				"title":             "Add login page",
+				"action":            action,
+				"oldrev":            oldRev,
+				"source_project_id": 12,
+				"target_project_id": 10,
+				"last_commit":       map[string]string{"id": testCommitSHA},
+			},
+		})
+		req := httptest.NewRequest("POST", "/api/v1/webhooks/gitlab", bytes.NewReader(body))
+		req.Header.Set("X-Gitlab-Token", "gitlab-token")
+		req.Header.Set("X-Gitlab-Event", "Merge Request Hook")
+		rr := httptest.NewRecorder()
+		service.gitlabWebhookHandler(rr, req)
+		return rr
+	}
+
+	rr := send("update", "0123456789abcdef0123456789abcdef01234567")
+	require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	var build BuildRequest
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &build))
+	assert.Equal(t, 9, build.ID)
+	assert.Equal(t, "Add login page", build.CommitMessage)
+	assert.Equal(t, "jane", build.CommitAuthor)
+
+	// Updates without new commits and closes don't change the code
+	assert.Equal(t, http.StatusAccepted, send("update", "").Code)
+	assert.Equal(t, http.StatusAccepted, send("close", "").Code)
+	mockDB.AssertExpectations(t)
+}
+
+func TestCommitStatusReporter(t *testing.T) {
+	var github, gitlab []map[string]string
+	var tokens []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := map[string]string{}
+		json.NewDecoder(r.Body).Decode(&status)
+		status["path"] = r.URL.EscapedPath()
+		if token := r.Header.Get("PRIVATE-TOKEN"); token != "" {
+			tokens = append(tokens, token)
+			gitlab = append(gitlab, status)
+		} else {
+			tokens = append(tokens, r.Header.Get("Authorization"))
+			github = append(github, status)
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+	t.Setenv("GITHUB_TOKEN", "gh-token")
+	t.Setenv("GITHUB_API_URL", server.URL)
+	t.Setenv("GITLAB_TOKEN", "")
+	// GitLab is told apart from GitHub by its host
+	t.Setenv("GITLAB_API_URL", strings.Replace(server.URL, "127.0.0.1", "localhost", 1)+"/api/v4")
+
+	service, mockDB := setupTestService()
+	mockDB.ExpectedCalls = nil
+	mockDB.On("GetIntegration", "commit-statuses").Return(nil, fmt.Errorf("integration not found"))
+	mockDB.On("ResetIntegrationFailures", "commit-statuses").Return(nil)
+	mockDB.On("GetProjectByName", "api").Return(&Project{ID: 1, Name: "api"}, nil)
+	mockDB.On("GetProjectByName", "web").Return(&Project{ID: 2, Name: "web"}, nil)
+	mockDB.On("ListProjectSecrets", 1).Return([]*ProjectSecret{}, nil)
+	mockDB.On("ListProjectSecrets", 2).Return([]*ProjectSecret{{Name: commitStatusTokenSecret, Value: "web-token"}}, nil)
+	reporter := NewCommitStatusReporterFromEnv(mockDB, service.integrations)
+
+	sha := testCommitSHA
+	deliver := func(build BuildRequest) {
+		require.NoError(t, reporter.Deliver(context.Background(), BuildEvent{Build: build, URL: "https://ci.example.com/builds/5"}))
+	}
+	deliver(BuildRequest{ID: 5, ProjectName: "api", GitURL: "https://127.0.0.1/acme/api.git", CommitSHA: sha, PullRequest: 3, Status: "running"})
+	deliver(BuildRequest{ID: 5, ProjectName: "api", GitURL: "https://127.0.0.1/acme/api.git", CommitSHA: sha, PullRequest: 3, Status: "timeout"})
+	// Branch builds, unreported statuses and other hosts aren't reported
+	deliver(BuildRequest{ID: 6, ProjectName: "api", GitURL: "https://127.0.0.1/acme/api.git", CommitSHA: sha, Status: "failed"})
+	deliver(BuildRequest{ID: 5, ProjectName: "api", GitURL: "https://127.0.0.1/acme/api.git", CommitSHA: sha, PullRequest: 3, Status: "draft"})
+	deliver(BuildRequest{ID: 7, ProjectName: "api", GitURL: "https://bitbucket.org/acme/api.git", CommitSHA: sha, PullRequest: 3, Status: "failed"})
+	// GitLab has no token configured but the project has its own
+	deliver(BuildRequest{ID: 8, ProjectName: "web", GitURL: "git@localhost:acme/web/site.git", CommitSHA: sha, PullRequest: 2, Status: "running"})
+
+	require.Len(t, github, 2)
+	assert.Equal(t, map[string]string{
+		"path":        "/repos/acme/api/statuses/" + sha,
+		"state":       "pending",
+		"description": "Build #5 is running",
+		"context":     buildStatusContext,
+		"target_url":  "https://ci.example.com/builds/5",
+	}, github[0])
+	assert.Equal(t, "failure", github[1]["state"])
+	assert.Equal(t, "Build #5 timed out", github[1]["description"])
+	assert.Equal(t, []string{"Bearer gh-token", "Bearer gh-token", "web-token"}, tokens)
+
+	require.Len(t, gitlab, 1)
+	assert.Equal(t, "/api/v4/projects/acme%2Fweb%2Fsite/statuses/"+sha, gitlab[0]["path"])
+	assert.Equal(t, "running", gitlab[0]["state"])
+	assert.Equal(t, buildStatusContext, gitlab[0]["name"])
+	mockDB.AssertExpectations(t)
+}
+
+func TestBuildSecretsOmitCommitStatusToken(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.ExpectedCalls = nil
+	mockDB.On("ListProjectSecrets", 1).Return([]*ProjectSecret{
+		{Name: "NPM_TOKEN", Value: "npm"},
+		{Name: commitStatusTokenSecret, Value: "status"},
+	}, nil)
+
+	secrets, err := service.buildSecrets(&Project{ID: 1})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"NPM_TOKEN": "npm"}, secrets)
+}
+
+func TestLocalExecutorChecksOutMergeRef(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	if _, err := exec.LookPath("make"); err != nil {
+		t.Skip("make not installed")
+	}
+
+	repo := t.TempDir()
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = repo
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(repo, "Makefile"), []byte("all:\n\t@exit 3\n"), 0o644))
+	git("init", "-q", "-b", "main")
+	git("add", "Makefile")
+	git("commit", "-q", "-m", "init")
+	// The merge ref fixes the build, the branch doesn't
+	require.NoError(t, os.WriteFile(filepath.Join(repo, "Makefile"), []byte("all:\n\t@echo merged\n"), 0o644))
+	git("commit", "-q", "-am", "merge")
+	git("update-ref", "refs/pull/1/merge", "HEAD")
+	git("reset", "-q", "--hard", "HEAD~1")
+
+	executor := NewLocalExecutor(t.TempDir())
+	executor.AllowedProtocols = append(executor.AllowedProtocols, "file")
+	result, err := executor.Execute(context.Background(), &BuildRequest{
+		ID:          1,
+		ProjectName: "test-project",
+		GitURL:      "file://" + repo,
+		Branch:      "pull/1/merge",
+		PullRequest: 1,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "success", result.Status, result.Stages[len(result.Stages)-1].Log)
+	assert.Contains(t, result.Stages[1].Log, "merged")
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// WorkerMetrics records the builds run by this worker process and pushes
+// them to a Prometheus Pushgateway. Ephemeral workers often exit before they
+// are scraped; pushed metrics outlive them, grouped by worker instance.
+type WorkerMetrics struct {
+	registry *prometheus.Registry
+	builds   *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	exitCode *prometheus.GaugeVec
+	lastRun  *prometheus.GaugeVec
+
+	// pusher is nil when PUSHGATEWAY_URL is unset
+	pusher   *push.Pusher
+	interval time.Duration
+	errors   *ErrorTracker
+	pending  chan struct{}
+}
+
+// NewWorkerMetrics creates worker metrics pushed to the Pushgateway at url
+// under job and instance, or only recorded when url is empty
+func NewWorkerMetrics(url, job, instance string, errors *ErrorTracker) *WorkerMetrics {
+	wm := &WorkerMetrics{
+		registry: prometheus.NewRegistry(),
+		builds: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "worker_builds_total",
+			Help: "Builds run by this worker, by project and status",
+		}, []string{"project", "status"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "worker_build_duration_seconds",
+			Help:    "Duration of builds run by this worker",
+			Buckets: []float64{10, 30, 60, 120, 300, 600, 1200, 1800, 3600},
+		}, []string{"project"}),
+		exitCode: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "worker_last_build_exit_code",
+			Help: "Exit code of the last build of each project run by this worker",
+		}, []string{"project"}),
+		lastRun: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "worker_last_build_timestamp_seconds",
+			Help: "Unix time the last build of each project run by this worker finished",
+		}, []string{"project"}),
+		errors:  errors,
+		pending: make(chan struct{}, 1),
+	}
+	wm.registry.MustRegister(wm.builds, wm.duration, wm.exitCode, wm.lastRun)
+
+	if url != "" {
+		wm.pusher = push.New(url, job).Grouping("instance", instance).Gatherer(wm.registry)
+	}
+	return wm
+}
+
+// NewWorkerMetricsFromEnv configures worker metrics from PUSHGATEWAY_URL,
+// PUSHGATEWAY_JOB and WORKER_INSTANCE (the hostname by default)
+func NewWorkerMetricsFromEnv(errors *ErrorTracker) *WorkerMetrics {
+	job := os.Getenv("PUSHGATEWAY_JOB")
+	if job == "" {
+		job = "build-service-worker"
+	}
+	instance := os.Getenv("WORKER_INSTANCE")
+	if instance == "" {
+		instance, _ = os.Hostname()
+	}
+
+	wm := NewWorkerMetrics(os.Getenv("PUSHGATEWAY_URL"), job, instance, errors)
+	if wm.pusher != nil {
+		if username := os.Getenv("PUSHGATEWAY_USERNAME"); username != "" {
+			wm.pusher.BasicAuth(username, os.Getenv("PUSHGATEWAY_PASSWORD"))
+		}
+	}
+	wm.interval = getEnvDuration("PUSHGATEWAY_INTERVAL", time.Minute)
+	return wm
+}
+
+// Observe records a finished build and schedules a push
+func (wm *WorkerMetrics) Observe(build *BuildRequest, status string, exitCode int, duration time.Duration) {
+	wm.builds.WithLabelValues(build.ProjectName, status).Inc()
+	wm.duration.WithLabelValues(build.ProjectName).Observe(duration.Seconds())
+	wm.exitCode.WithLabelValues(build.ProjectName).Set(float64(exitCode))
+	wm.lastRun.WithLabelValues(build.ProjectName).SetToCurrentTime()
+
+	select {
+	case wm.pending <- struct{}{}:
+	default:
+		// A push is already scheduled and will include this build
+	}
+}
+
+// Start pushes after every observed build, and every PUSHGATEWAY_INTERVAL so
+// the group is recreated should the Pushgateway restart, until ctx is
+// cancelled
+func (wm *WorkerMetrics) Start(ctx context.Context) {
+	if wm.pusher == nil {
+		return
+	}
+
+	go func() {
+		var tick <-chan time.Time
+		if wm.interval > 0 {
+			ticker := time.NewTicker(wm.interval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-wm.pending:
+			case <-tick:
+			}
+			wm.Flush(ctx)
+		}
+	}()
+}
+
+// Flush pushes the current metrics, replacing this instance's group. It is
+// called on shutdown so the last builds are not lost.
+func (wm *WorkerMetrics) Flush(ctx context.Context) {
+	if wm.pusher == nil {
+		return
+	}
+	if err := wm.pusher.PushContext(ctx); err != nil {
+		wm.errors.Capture("pushgateway", fmt.Errorf("pushing worker metrics: %w", err), nil)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWorkerMetricsPush(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		pushes []string
+	)
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		pushes = append(pushes, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer gateway.Close()
+
+	errors := NewErrorTracker(&LogErrorReporter{}, prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_errors_total"}, []string{"subsystem"}))
+	wm := NewWorkerMetrics(gateway.URL, "build-service-worker", "worker-1", errors)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wm.Start(ctx)
+
+	build := &BuildRequest{ID: 1, ProjectName: "api"}
+	wm.Observe(build, "success", 0, 42*time.Second)
+	wm.Observe(build, "failed", 2, 10*time.Second)
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(wm.builds.WithLabelValues("api", "success")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(wm.builds.WithLabelValues("api", "failed")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(wm.exitCode.WithLabelValues("api")))
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(pushes) > 0
+	}, time.Second, 5*time.Millisecond)
+	mu.Lock()
+	assert.Equal(t, "PUT /metrics/job/build-service-worker/instance/worker-1", pushes[0])
+	mu.Unlock()
+}
+
+func TestWorkerMetricsPushFailure(t *testing.T) {
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer gateway.Close()
+
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_errors_total"}, []string{"subsystem"})
+	wm := NewWorkerMetrics(gateway.URL, "job", "worker-1", NewErrorTracker(&LogErrorReporter{}, counter))
+
+	wm.Flush(context.Background())
+	assert.Equal(t, 1.0, testutil.ToFloat64(counter.WithLabelValues("pushgateway")))
+}
+
+func TestWorkerMetricsDisabled(t *testing.T) {
+	wm := NewWorkerMetrics("", "job", "worker-1", nil)
+	wm.Start(context.Background())
+	wm.Observe(&BuildRequest{ProjectName: "api"}, "success", 0, time.Second)
+	wm.Flush(context.Background())
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(wm.builds.WithLabelValues("api", "success")))
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Quality gate policies of a project. Without one, gate results are only
+// shown on the project's builds.
+const (
+	qualityGateBlockDeploy = "block-deploy"
+	qualityGateFailBuild   = "fail-build"
+)
+
+// Quality gate statuses
+const (
+	qualityGatePassed = "passed"
+	qualityGateFailed = "failed"
+)
+
+// QualityGate is the verdict of an external code quality tool, such as
+// SonarQube or Codacy, on a commit of a project
+type QualityGate struct {
+	ID          int    `json:"id"`
+	ProjectName string `json:"project_name"`
+	CommitSHA   string `json:"commit_sha"`
+	// Tool is the reporting tool, e.g. "sonarqube"
+	Tool string `json:"tool"`
+	// Name tells the gates of one tool apart, e.g. the SonarQube project key
+	Name       string                 `json:"name"`
+	Status     string                 `json:"status"`
+	URL        string                 `json:"url,omitempty"`
+	Conditions []QualityGateCondition `json:"conditions,omitempty"`
+	CreatedAt  time.Time              `json:"created_at"`
+	UpdatedAt  time.Time              `json:"updated_at"`
+}
+
+// QualityGateCondition is one of the metrics a gate checks
+type QualityGateCondition struct {
+	Metric    string `json:"metric"`
+	Status    string `json:"status"`
+	Value     string `json:"value,omitempty"`
+	Threshold string `json:"threshold,omitempty"`
+}
+
+// BuildQualityGates are the gates reported for a build's commit with their
+// combined verdict: failed when any gate failed, passed when all passed, and
+// pending before the first one is reported
+type BuildQualityGates struct {
+	Verdict string         `json:"verdict"`
+	Gates   []*QualityGate `json:"gates"`
+}
+
+// sonarQubePayload is the body of a SonarQube analysis webhook
+type sonarQubePayload struct {
+	ServerURL  string            `json:"serverUrl"`
+	Revision   string            `json:"revision"`
+	Properties map[string]string `json:"properties"`
+	Project    struct {
+		Key string `json:"key"`
+		URL string `json:"url"`
+	} `json:"project"`
+	QualityGate *struct {
+		Status     string `json:"status"`
+		Conditions []struct {
+			Metric         string `json:"metric"`
+			Status         string `json:"status"`
+			Value          string `json:"value"`
+			ErrorThreshold string `json:"errorThreshold"`
+		} `json:"conditions"`
+	} `json:"qualityGate"`
+}
+
+// validateQualityGatePolicy checks a project's quality_gate_policy
+func validateQualityGatePolicy(project *Project) error {
+	switch project.QualityGatePolicy {
+	case "", qualityGateBlockDeploy, qualityGateFailBuild:
+		return nil
+	}
+	return fmt.Errorf("quality_gate_policy must be %s or %s", qualityGateBlockDeploy, qualityGateFailBuild)
+}
+
+// verifySonarQubeSignature checks the X-Sonar-Webhook-HMAC-SHA256 HMAC of a payload
+func verifySonarQubeSignature(secret string, body []byte, signature string) bool {
+	expected, err := hex.DecodeString(signature)
+	if secret == "" || err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// failedQualityGate returns the first failed gate of a commit, or nil
+func (bs *BuildService) failedQualityGate(projectName, commitSHA string) (*QualityGate, error) {
+	if commitSHA == "" {
+		return nil, nil
+	}
+	gates, err := bs.db.ListQualityGates(projectName, commitSHA)
+	if err != nil {
+		return nil, err
+	}
+	for _, gate := range gates {
+		if gate.Status == qualityGateFailed {
+			return gate, nil
+		}
+	}
+	return nil, nil
+}
+
+// recordQualityGate stores a gate result and, when it failed and the project
+// fails builds on its quality gates, fails the commit's successful builds
+func (bs *BuildService) recordQualityGate(gate *QualityGate, project *Project) error {
+	if err := bs.db.SaveQualityGate(gate); err != nil {
+		return err
+	}
+	if gate.Status != qualityGateFailed || project.QualityGatePolicy != qualityGateFailBuild {
+		return nil
+	}
+
+	builds, err := bs.db.ListBuildsByCommit(gate.CommitSHA, false, "", nil)
+	if err != nil {
+		return fmt.Errorf("listing builds of %s: %w", gate.CommitSHA, err)
+	}
+	for _, build := range builds {
+		if build.ProjectName != project.Name || build.CommitSHA != gate.CommitSHA || build.Status != "success" {
+			continue
+		}
+		bs.failForQualityGate(build, gate)
+	}
+	return nil
+}
+
+// failForQualityGate marks a successful build failed by a quality gate
+func (bs *BuildService) failForQualityGate(build *BuildRequest, gate *QualityGate) {
+	exitCode := 0
+	if build.ExitCode != nil {
+		exitCode = *build.ExitCode
+	}
+	build.Status, build.FailureCategory = "failed", failureQualityGate
+	build.UpdatedAt = time.Now().UTC()
+	if err := bs.db.UpdateBuildResult(build.ID, build.Status, exitCode); err != nil {
+		bs.errors.Capture("quality-gates", fmt.Errorf("failing build for %s gate %s: %w", gate.Tool, gate.Name, err), build)
+		return
+	}
+	if err := bs.db.SetBuildFailureCategory(build.ID, build.FailureCategory); err != nil {
+		bs.errors.Capture("quality-gates", fmt.Errorf("recording failure category: %w", err), build)
+	}
+	bs.metrics.BuildFailures.WithLabelValues(build.ProjectName, build.FailureCategory).Inc()
+	log.Printf("Build %d failed by %s quality gate %s", build.ID, gate.Tool, gate.Name)
+	bs.events.Publish(build)
+}
+
+// enforceQualityGates fails a successful build whose commit already failed a
+// quality gate, when its project fails builds on their gates
+func (bs *BuildService) enforceQualityGates(build *BuildRequest, project *Project, commit *CommitInfo) {
+	if project == nil || project.QualityGatePolicy != qualityGateFailBuild {
+		return
+	}
+	sha := build.CommitSHA
+	if commit != nil && commit.SHA != "" {
+		sha = commit.SHA
+	}
+
+	gate, err := bs.failedQualityGate(project.Name, sha)
+	if err != nil {
+		bs.errors.Capture("quality-gates", fmt.Errorf("checking quality gates of %s: %w", sha, err), build)
+		return
+	}
+	if gate != nil {
+		build.Status, build.FailureCategory = "failed", failureQualityGate
+		log.Printf("Build %d failed by %s quality gate %s", build.ID, gate.Tool, gate.Name)
+	}
+}
+
+// deploymentBlockedBy returns the failed quality gate that keeps a build from
+// being deployed, or nil when its project doesn't enforce its gates
+func (bs *BuildService) deploymentBlockedBy(build *BuildRequest) (*QualityGate, error) {
+	project, err := bs.db.GetProjectByName(build.ProjectName)
+	if err != nil {
+		if err.Error() == "project not found" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if project.QualityGatePolicy == "" {
+		return nil, nil
+	}
+	return bs.failedQualityGate(project.Name, build.CommitSHA)
+}
+
+// qualityGateProject loads the project a gate is reported for, writing an
+// error response when it can't
+func (bs *BuildService) qualityGateProject(w http.ResponseWriter, r *http.Request, name string) (*Project, bool) {
+	project, err := bs.db.GetProjectByName(name)
+	if err == nil && !requestTenant(r).Sees(project.Org) {
+		err = fmt.Errorf("project not found")
+	}
+	if err != nil {
+		if err.Error() == "project not found" {
+			http.Error(w, "Project not found", http.StatusNotFound)
+			return nil, false
+		}
+		log.Printf("Error getting project: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return nil, false
+	}
+	return project, true
+}
+
+// SonarQube webhook endpoint. Records the quality gate of each analysis for
+// the analysed commit. The project is named by the sonar.analysis.project
+// analysis parameter, or else is the one named like the SonarQube project.
+func (bs *BuildService) sonarQubeWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookPayload))
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !verifySonarQubeSignature(os.Getenv("SONARQUBE_WEBHOOK_SECRET"), body, r.Header.Get("X-Sonar-Webhook-HMAC-SHA256")) {
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	var payload sonarQubePayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		http.Error(w, "Invalid payload", http.StatusBadRequest)
+		return
+	}
+	// Analyses without a gate or of uncommitted code have nothing to record
+	if payload.QualityGate == nil || payload.Revision == "" {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	projectName := payload.Properties["sonar.analysis.project"]
+	if projectName == "" {
+		projectName = payload.Project.Key
+	}
+	project, ok := bs.qualityGateProject(w, r, projectName)
+	if !ok {
+		return
+	}
+
+	gate := &QualityGate{
+		ProjectName: project.Name,
+		CommitSHA:   strings.ToLower(payload.Revision),
+		Tool:        "sonarqube",
+		Name:        payload.Project.Key,
+		Status:      qualityGatePassed,
+		URL:         payload.Project.URL,
+	}
+	if payload.QualityGate.Status == "ERROR" {
+		gate.Status = qualityGateFailed
+	}
+	if gate.URL == "" && payload.ServerURL != "" {
+		gate.URL = strings.TrimSuffix(payload.ServerURL, "/") + "/dashboard?id=" + payload.Project.Key
+	}
+	for _, condition := range payload.QualityGate.Conditions {
+		gate.Conditions = append(gate.Conditions, QualityGateCondition{
+			Metric:    condition.Metric,
+			Status:    condition.Status,
+			Value:     condition.Value,
+			Threshold: condition.ErrorThreshold,
+		})
+	}
+
+	if err := bs.recordQualityGate(gate, project); err != nil {
+		log.Printf("Error recording quality gate: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(gate)
+}
+
+// Report quality gate endpoint, for tools without a webhook of their own
+// such as Codacy, whose results a build step posts
+func (bs *BuildService) createQualityGateHandler(w http.ResponseWriter, r *http.Request) {
+	var gate QualityGate
+	if err := json.NewDecoder(r.Body).Decode(&gate); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	gate.CommitSHA = strings.ToLower(strings.TrimSpace(gate.CommitSHA))
+	gate.Tool = strings.ToLower(strings.TrimSpace(gate.Tool))
+	if gate.ProjectName == "" || gate.CommitSHA == "" || gate.Tool == "" {
+		http.Error(w, "project_name, commit_sha and tool are required", http.StatusBadRequest)
+		return
+	}
+	if gate.Status != qualityGatePassed && gate.Status != qualityGateFailed {
+		http.Error(w, "status must be passed or failed", http.StatusBadRequest)
+		return
+	}
+	if gate.Name == "" {
+		gate.Name = gate.ProjectName
+	}
+
+	project, ok := bs.qualityGateProject(w, r, gate.ProjectName)
+	if !ok {
+		return
+	}
+	if err := bs.recordQualityGate(&gate, project); err != nil {
+		log.Printf("Error recording quality gate: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(gate)
+}
+
+// Build quality gates endpoint
+func (bs *BuildService) buildQualityGatesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid build ID", http.StatusBadRequest)
+		return
+	}
+
+	build, err := bs.db.GetBuild(id)
+	if err != nil {
+		if err.Error() == "build not found" {
+			http.Error(w, "Build not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error getting build: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	result := &BuildQualityGates{Verdict: "pending", Gates: []*QualityGate{}}
+	if build.CommitSHA != "" {
+		if result.Gates, err = bs.db.ListQualityGates(build.ProjectName, build.CommitSHA); err != nil {
+			log.Printf("Error listing quality gates: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+	for _, gate := range result.Gates {
+		if result.Verdict != qualityGateFailed {
+			result.Verdict = gate.Status
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// sonarQubeRequest builds a signed SonarQube webhook request
+func sonarQubeRequest(secret, body string) *http.Request {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	req := httptest.NewRequest("POST", "/api/v1/webhooks/sonarqube", bytes.NewBufferString(body))
+	req.Header.Set("X-Sonar-Webhook-HMAC-SHA256", hex.EncodeToString(mac.Sum(nil)))
+	return req
+}
+
+func TestSonarQubeWebhookHandler(t *testing.T) {
+	t.Setenv("SONARQUBE_WEBHOOK_SECRET", "s3cret")
+	service, mockDB := setupTestService()
+	mockDB.On("GetProjectByName", "api").Return(&Project{ID: 1, Name: "api", QualityGatePolicy: qualityGateFailBuild}, nil)
+	mockDB.On("GetProjectByName", "missing").Return(nil, fmt.Errorf("project not found"))
+	mockDB.On("SaveQualityGate", mock.MatchedBy(func(g *QualityGate) bool {
+		return g.ProjectName == "api" && g.CommitSHA == "abc123" && g.Tool == "sonarqube" && g.Name == "org:api" &&
+			g.Status == qualityGateFailed && len(g.Conditions) == 1 && g.Conditions[0].Threshold == "80"
+	})).Return(nil).Once()
+	mockDB.On("ListBuildsByCommit", "abc123", false, "", Labels(nil)).Return([]*BuildRequest{
+		{ID: 1, ProjectName: "api", CommitSHA: "abc123", Status: "success"},
+		{ID: 2, ProjectName: "api", CommitSHA: "abc123", Status: "failed"},
+		{ID: 3, ProjectName: "web", CommitSHA: "abc123", Status: "success"},
+	}, nil).Once()
+	mockDB.On("UpdateBuildResult", 1, "failed", 0).Return(nil).Once()
+	mockDB.On("SetBuildFailureCategory", 1, failureQualityGate).Return(nil).Once()
+
+	body := `{"revision": "ABC123", "project": {"key": "org:api", "url": "https://sonar.example.com/dashboard?id=org:api"},
+		"properties": {"sonar.analysis.project": "api"},
+		"qualityGate": {"status": "ERROR", "conditions": [{"metric": "coverage", "status": "ERROR", "value": "61.2", "errorThreshold": "80"}]}}`
+	rr := httptest.NewRecorder()
+	service.sonarQubeWebhookHandler(rr, sonarQubeRequest("s3cret", body))
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Contains(t, rr.Body.String(), `"status":"failed"`)
+
+	rr = httptest.NewRecorder()
+	service.sonarQubeWebhookHandler(rr, sonarQubeRequest("wrong", body))
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	rr = httptest.NewRecorder()
+	service.sonarQubeWebhookHandler(rr, sonarQubeRequest("s3cret", `{"revision": "abc123", "project": {"key": "missing"}, "qualityGate": {"status": "OK"}}`))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	rr = httptest.NewRecorder()
+	service.sonarQubeWebhookHandler(rr, sonarQubeRequest("s3cret", `{"revision": "abc123", "project": {"key": "api"}}`))
+	assert.Equal(t, http.StatusAccepted, rr.Code, "analyses without a gate are ignored")
+	mockDB.AssertExpectations(t)
+}
+
+func TestSonarQubeWebhookRequiresSecret(t *testing.T) {
+	t.Setenv("SONARQUBE_WEBHOOK_SECRET", "")
+	service, _ := setupTestService()
+
+	rr := httptest.NewRecorder()
+	service.sonarQubeWebhookHandler(rr, sonarQubeRequest("", `{}`))
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+}
+
+func TestCreateQualityGateHandler(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.On("GetProjectByName", "api").Return(&Project{ID: 1, Name: "api"}, nil)
+	mockDB.On("SaveQualityGate", mock.MatchedBy(func(g *QualityGate) bool {
+		return g.Tool == "codacy" && g.Name == "api" && g.CommitSHA == "abc123"
+	})).Return(nil).Once()
+
+	post := func(body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		service.createQualityGateHandler(rr, httptest.NewRequest("POST", "/api/v1/quality-gates", bytes.NewBufferString(body)))
+		return rr
+	}
+
+	rr := post(`{"project_name": "api", "commit_sha": "ABC123", "tool": "Codacy", "status": "failed"}`)
+	assert.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+
+	for _, body := range []string{
+		`{"commit_sha": "abc123", "tool": "codacy", "status": "failed"}`,
+		`{"project_name": "api", "tool": "codacy", "status": "failed"}`,
+		`{"project_name": "api", "commit_sha": "abc123", "tool": "codacy", "status": "flaky"}`,
+		`{`,
+	} {
+		assert.Equal(t, http.StatusBadRequest, post(body).Code, body)
+	}
+	mockDB.AssertExpectations(t)
+}
+
+func TestBuildQualityGatesHandler(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.On("GetBuild", 1).Return(&BuildRequest{ID: 1, ProjectName: "api", CommitSHA: "abc123"}, nil)
+	mockDB.On("GetBuild", 2).Return(&BuildRequest{ID: 2, ProjectName: "api"}, nil)
+	mockDB.On("ListQualityGates", "api", "abc123").Return([]*QualityGate{
+		{Tool: "codacy", Name: "api", Status: qualityGateFailed},
+		{Tool: "sonarqube", Name: "api", Status: qualityGatePassed},
+	}, nil)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/builds/{id}/quality-gates", service.buildQualityGatesHandler).Methods("GET")
+
+	for path, want := range map[string]string{
+		"/api/v1/builds/1/quality-gates": `"verdict":"failed"`,
+		"/api/v1/builds/2/quality-gates": `"verdict":"pending","gates":[]`,
+	} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		assert.Equal(t, http.StatusOK, rr.Code, path)
+		assert.Contains(t, rr.Body.String(), want, path)
+	}
+}
+
+func TestEnforceQualityGates(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.On("ListQualityGates", "api", "abc123").Return([]*QualityGate{{Tool: "sonarqube", Name: "api", Status: qualityGateFailed}}, nil)
+	mockDB.On("ListQualityGates", "api", "def456").Return([]*QualityGate{{Tool: "sonarqube", Name: "api", Status: qualityGatePassed}}, nil)
+
+	build := &BuildRequest{ID: 1, ProjectName: "api", Status: "success"}
+	service.enforceQualityGates(build, &Project{Name: "api", QualityGatePolicy: qualityGateBlockDeploy}, &CommitInfo{SHA: "abc123"})
+	assert.Equal(t, "success", build.Status, "block-deploy leaves builds alone")
+
+	service.enforceQualityGates(build, &Project{Name: "api", QualityGatePolicy: qualityGateFailBuild}, &CommitInfo{SHA: "def456"})
+	assert.Equal(t, "success", build.Status)
+
+	service.enforceQualityGates(build, &Project{Name: "api", QualityGatePolicy: qualityGateFailBuild}, &CommitInfo{SHA: "abc123"})
+	assert.Equal(t, "failed", build.Status)
+	assert.Equal(t, failureQualityGate, build.FailureCategory)
+
+	assert.Error(t, validateQualityGatePolicy(&Project{QualityGatePolicy: "warn"}))
+	assert.NoError(t, validateQualityGatePolicy(&Project{QualityGatePolicy: qualityGateFailBuild}))
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// errLeaseLost stops a build whose worker no longer holds its lease, because
+// the lease expired and the build was requeued, or the build was cancelled
+var errLeaseLost = errors.New("build lease lost")
+
+// BuildQueue dispatches queued builds stored in the builds table to a pool of
+// workers. Builds are claimed under a lease, renewed by a heartbeat while they
+// run, so that work left behind by a crashed instance is picked up again once
+// the lease expires.
+type BuildQueue struct {
+	db            DatabaseInterface
+	handler       func(ctx context.Context, build *BuildRequest)
+	errors        *ErrorTracker
+	workers       int
+	workerID      string
+	hostname      string
+	startedAt     time.Time
+	fairShare     int
+	leaseDuration time.Duration
+	// heartbeatInterval is how often running builds' leases are renewed, 0
+	// to hold them for leaseDuration only
+	heartbeatInterval time.Duration
+	pollInterval      time.Duration
+	recoverInterval   time.Duration
+	// registerInterval is how often the workers' heartbeat is recorded
+	registerInterval time.Duration
+	wake             chan struct{}
+	wg               sync.WaitGroup
+
+	// maxAge is how long a build may wait queued before it expires, 0 for
+	// no limit
+	maxAge time.Duration
+	// expired is called with every build that expired
+	expired func(build *BuildRequest)
+}
+
+// NewBuildQueue creates a queue configured from the environment
+func NewBuildQueue(db DatabaseInterface, handler func(ctx context.Context, build *BuildRequest), errors *ErrorTracker) *BuildQueue {
+	hostname, _ := os.Hostname()
+	lease := getEnvDuration("QUEUE_LEASE_DURATION", 5*time.Minute)
+
+	return &BuildQueue{
+		db:                db,
+		handler:           handler,
+		errors:            errors,
+		workers:           getEnvInt("WORKER_COUNT", 4),
+		workerID:          fmt.Sprintf("%s-%d", hostname, os.Getpid()),
+		hostname:          hostname,
+		startedAt:         time.Now().UTC(),
+		fairShare:         getEnvInt("FAIR_SHARE_MAX_RUNNING", 0),
+		leaseDuration:     lease,
+		heartbeatInterval: getEnvDuration("QUEUE_HEARTBEAT_INTERVAL", lease/3),
+		maxAge:            getEnvDuration("QUEUE_MAX_AGE", 0),
+		pollInterval:      getEnvDuration("QUEUE_POLL_INTERVAL", 5*time.Second),
+		recoverInterval:   time.Minute,
+		registerInterval:  30 * time.Second,
+		wake:              make(chan struct{}, 1),
+	}
+}
+
+// Start recovers abandoned builds, expires stale ones, registers the workers
+// and launches the worker pool. Workers run
+// until ctx is cancelled; use Wait to block until they have exited.
+func (q *BuildQueue) Start(ctx context.Context) {
+	q.recoverExpired()
+	q.expireStale()
+	q.register()
+
+	q.wg.Add(q.workers + 1)
+	for i := 0; i < q.workers; i++ {
+		go q.worker(ctx)
+	}
+	go q.recoverLoop(ctx)
+
+	log.Printf("Build queue started with %d workers (worker id %s)", q.workers, q.workerID)
+}
+
+// Wait blocks until all workers have exited
+func (q *BuildQueue) Wait() {
+	q.wg.Wait()
+}
+
+// Notify wakes an idle worker so newly queued builds start without waiting
+// for the next poll
+func (q *BuildQueue) Notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *BuildQueue) worker(ctx context.Context) {
+	defer q.wg.Done()
+
+	ticker := time.NewTicker(q.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		for ctx.Err() == nil {
+			build, err := q.db.ClaimNextBuild(q.workerID, q.leaseDuration, q.fairShare)
+			if err != nil {
+				q.errors.Capture("queue", fmt.Errorf("claiming build: %w", err), nil)
+				break
+			}
+			if build == nil {
+				break
+			}
+			q.run(ctx, build)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// buildLeaseKey carries the queue that claimed a build in its context
+type buildLeaseKey struct{}
+
+// run handles a claimed build, renewing its lease every heartbeatInterval and
+// stopping it with errLeaseLost when the lease can't be renewed
+func (q *BuildQueue) run(ctx context.Context, build *BuildRequest) {
+	ctx, cancel := context.WithCancelCause(context.WithValue(ctx, buildLeaseKey{}, q))
+	defer cancel(nil)
+	if q.heartbeatInterval > 0 {
+		go q.heartbeat(ctx, build, cancel)
+	}
+	q.handler(ctx, build)
+}
+
+// heartbeat renews the lease of a running build. A renewal that fails keeps
+// the build running while the last confirmed lease lasts, so a brief database
+// outage doesn't stop every build.
+func (q *BuildQueue) heartbeat(ctx context.Context, build *BuildRequest, cancel context.CancelCauseFunc) {
+	ticker := time.NewTicker(q.heartbeatInterval)
+	defer ticker.Stop()
+	renewed := time.Now()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			held, err := q.renew(build)
+			if err != nil && time.Since(renewed) < q.leaseDuration {
+				continue
+			}
+			if !held {
+				cancel(errLeaseLost)
+				return
+			}
+			renewed = time.Now()
+		}
+	}
+}
+
+// renew extends the lease on a build, reporting false once another worker
+// may have it. When the renewal fails, whether the lease is still held is
+// unknown and the error is returned.
+func (q *BuildQueue) renew(build *BuildRequest) (bool, error) {
+	held, err := q.db.RenewBuildLease(build.ID, q.workerID, q.leaseDuration)
+	if err != nil {
+		q.errors.Capture("queue", fmt.Errorf("renewing lease: %w", err), build)
+		return false, err
+	}
+	if !held {
+		log.Printf("Build %d lost its lease, leaving it to whoever holds it now", build.ID)
+	}
+	return held, nil
+}
+
+// holdsLease renews the lease of a build run by a queue just before its
+// result is written, so a worker whose lease lapsed unnoticed can't overwrite
+// the result of the worker the build was handed to. Renewing rather than
+// checking guarantees the lease outlasts the writes that follow. A lease that
+// can't be renewed isn't held: the build is run again once it expires. Builds
+// not run by a queue are always held.
+func holdsLease(ctx context.Context, build *BuildRequest) bool {
+	q, ok := ctx.Value(buildLeaseKey{}).(*BuildQueue)
+	if !ok {
+		return true
+	}
+	held, err := q.renew(build)
+	return held && err == nil
+}
+
+func (q *BuildQueue) recoverLoop(ctx context.Context) {
+	defer q.wg.Done()
+
+	ticker := time.NewTicker(q.recoverInterval)
+	defer ticker.Stop()
+	heartbeat := time.NewTicker(q.registerInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			q.recoverExpired()
+			q.expireStale()
+		case <-heartbeat.C:
+			q.register()
+		}
+	}
+}
+
+// recoverExpired returns builds whose lease has lapsed to the queue
+func (q *BuildQueue) recoverExpired() {
+	n, err := q.db.RequeueExpiredBuilds()
+	if err != nil {
+		q.errors.Capture("queue", fmt.Errorf("requeueing expired builds: %w", err), nil)
+		return
+	}
+	if n > 0 {
+		log.Printf("Requeued %d builds with expired leases", n)
+		q.Notify()
+	}
+}
+
+// expireStale marks builds queued for longer than maxAge as expired, so
+// forgotten builds don't run days later against stale commits
+func (q *BuildQueue) expireStale() {
+	if q.maxAge <= 0 {
+		return
+	}
+
+	builds, err := q.db.ExpireQueuedBuilds(q.maxAge)
+	if err != nil {
+		q.errors.Capture("queue", fmt.Errorf("expiring stale builds: %w", err), nil)
+		return
+	}
+	for _, build := range builds {
+		log.Printf("Build %d expired after waiting in the queue for more than %s", build.ID, q.maxAge)
+		if q.expired != nil {
+			q.expired(build)
+		}
+	}
+}
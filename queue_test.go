@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func newTestQueue(db DatabaseInterface, handler func(ctx context.Context, build *BuildRequest)) *BuildQueue {
+	errors := NewErrorTracker(&LogErrorReporter{}, prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_errors_total"}, []string{"subsystem"}))
+	q := NewBuildQueue(db, handler, errors)
+	q.workers = 2
+	q.pollInterval = 10 * time.Millisecond
+	return q
+}
+
+func TestBuildQueueProcessesClaimedBuilds(t *testing.T) {
+	mockDB := new(MockDatabase)
+
+	mockDB.On("RequeueExpiredBuilds").Return(int64(0), nil)
+	mockDB.On("RegisterWorker", mock.MatchedBy(func(w *Worker) bool { return w.Slots == 2 && w.ID != "" })).Return(nil).Once()
+	mockDB.On("ClaimNextBuild", mock.AnythingOfType("string"), mock.AnythingOfType("time.Duration"), 0).
+		Return(&BuildRequest{ID: 1, ProjectName: "project-1"}, nil).Once()
+	mockDB.On("ClaimNextBuild", mock.AnythingOfType("string"), mock.AnythingOfType("time.Duration"), 0).
+		Return(&BuildRequest{ID: 2, ProjectName: "project-2"}, nil).Once()
+	mockDB.On("ClaimNextBuild", mock.AnythingOfType("string"), mock.AnythingOfType("time.Duration"), 0).
+		Return(nil, nil)
+
+	var mu sync.Mutex
+	var processed []int
+	q := newTestQueue(mockDB, func(ctx context.Context, build *BuildRequest) {
+		mu.Lock()
+		defer mu.Unlock()
+		processed = append(processed, build.ID)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	q.Start(ctx)
+
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(processed) == 2
+	}, time.Second, 5*time.Millisecond)
+
+	cancel()
+	q.Wait()
+
+	assert.ElementsMatch(t, []int{1, 2}, processed)
+}
+
+func TestBuildQueueRecoversExpiredLeasesOnStart(t *testing.T) {
+	mockDB := new(MockDatabase)
+
+	mockDB.On("RequeueExpiredBuilds").Return(int64(3), nil).Once()
+	mockDB.On("RegisterWorker", mock.Anything).Return(nil).Maybe()
+	mockDB.On("ClaimNextBuild", mock.AnythingOfType("string"), mock.AnythingOfType("time.Duration"), 0).
+		Return(nil, nil).Maybe()
+
+	q := newTestQueue(mockDB, func(ctx context.Context, build *BuildRequest) {})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	q.Start(ctx)
+	cancel()
+	q.Wait()
+
+	mockDB.AssertExpectations(t)
+}
+
+func TestBuildQueueExpiresStaleBuilds(t *testing.T) {
+	mockDB := new(MockDatabase)
+
+	mockDB.On("ExpireQueuedBuilds", time.Hour).
+		Return([]*BuildRequest{{ID: 1, Status: "expired"}, {ID: 2, Status: "expired"}}, nil).Once()
+
+	var expired []int
+	q := newTestQueue(mockDB, nil)
+	q.maxAge = time.Hour
+	q.expired = func(build *BuildRequest) { expired = append(expired, build.ID) }
+
+	q.expireStale()
+
+	assert.Equal(t, []int{1, 2}, expired)
+	mockDB.AssertExpectations(t)
+}
+
+func TestBuildQueueExpiryDisabledByDefault(t *testing.T) {
+	mockDB := new(MockDatabase)
+
+	q := newTestQueue(mockDB, nil)
+	q.expireStale()
+
+	mockDB.AssertNotCalled(t, "ExpireQueuedBuilds", mock.Anything)
+}
+
+func TestBuildQueueNotifyDoesNotBlock(t *testing.T) {
+	q := newTestQueue(new(MockDatabase), nil)
+
+	// Notify must never block even when no worker is listening
+	for i := 0; i < 10; i++ {
+		q.Notify()
+	}
+	assert.Len(t, q.wake, 1)
+}
+
+func TestBuildQueueHeartbeatRenewsLease(t *testing.T) {
+	mockDB := new(MockDatabase)
+	q := newTestQueue(mockDB, nil)
+	q.heartbeatInterval = 5 * time.Millisecond
+	mockDB.On("RenewBuildLease", 1, q.workerID, q.leaseDuration).Return(true, nil).Times(3)
+	mockDB.On("RenewBuildLease", 1, q.workerID, q.leaseDuration).Return(false, nil).Once()
+
+	var cause error
+	q.handler = func(ctx context.Context, build *BuildRequest) {
+		<-ctx.Done()
+		cause = context.Cause(ctx)
+	}
+	q.run(context.Background(), &BuildRequest{ID: 1})
+
+	assert.Equal(t, errLeaseLost, cause, "the build is stopped once another worker may have it")
+	mockDB.AssertExpectations(t)
+}
+
+func TestBuildQueueHeartbeatDuringOutage(t *testing.T) {
+	mockDB := new(MockDatabase)
+	q := newTestQueue(mockDB, nil)
+	q.heartbeatInterval = 5 * time.Millisecond
+	q.leaseDuration = 50 * time.Millisecond
+	mockDB.On("RenewBuildLease", 1, q.workerID, q.leaseDuration).Return(false, fmt.Errorf("connection refused"))
+
+	start := time.Now()
+	var cause error
+	q.handler = func(ctx context.Context, build *BuildRequest) {
+		<-ctx.Done()
+		cause = context.Cause(ctx)
+	}
+	q.run(context.Background(), &BuildRequest{ID: 1})
+
+	// The build keeps running until its last lease would have expired
+	assert.Equal(t, errLeaseLost, cause)
+	assert.GreaterOrEqual(t, time.Since(start), q.leaseDuration)
+}
+
+func TestHoldsLeaseRequiresRenewal(t *testing.T) {
+	mockDB := new(MockDatabase)
+	q := newTestQueue(mockDB, nil)
+	ctx := context.WithValue(context.Background(), buildLeaseKey{}, q)
+	mockDB.On("RenewBuildLease", 1, q.workerID, q.leaseDuration).Return(true, nil).Once()
+	mockDB.On("RenewBuildLease", 1, q.workerID, q.leaseDuration).Return(false, nil).Once()
+	mockDB.On("RenewBuildLease", 1, q.workerID, q.leaseDuration).Return(false, fmt.Errorf("connection refused")).Once()
+
+	assert.True(t, holdsLease(ctx, &BuildRequest{ID: 1}))
+	assert.False(t, holdsLease(ctx, &BuildRequest{ID: 1}))
+	assert.False(t, holdsLease(ctx, &BuildRequest{ID: 1}), "a lease that can't be renewed may have passed to another worker")
+	mockDB.AssertExpectations(t)
+}
+
+func TestProcessBuildLeavesLostBuildsAlone(t *testing.T) {
+	service, mockDB := setupTestService()
+	q := newTestQueue(mockDB, service.processBuild)
+	q.heartbeatInterval = 5 * time.Millisecond
+	mockDB.On("GetProjectByName", "test-project").Return(nil, fmt.Errorf("project not found")).Maybe()
+	mockDB.On("RenewBuildLease", 1, q.workerID, q.leaseDuration).Return(false, nil).Once()
+
+	q.run(context.Background(), &BuildRequest{ID: 1, ProjectName: "test-project", Status: "running"})
+
+	// The lease lapsed while the build ran, so its result isn't recorded
+	mockDB.AssertNotCalled(t, "UpdateBuildResult", mock.Anything, mock.Anything, mock.Anything)
+	mockDB.AssertNotCalled(t, "ReleaseBuild", mock.Anything)
+	mockDB.AssertExpectations(t)
+
+	assert.True(t, holdsLease(context.Background(), &BuildRequest{ID: 1}), "builds not run by a queue need no lease")
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Worker is an instance running builds from the queue, identified by the
+// worker ID its leases are held under
+type Worker struct {
+	ID       string `json:"id"`
+	Hostname string `json:"hostname"`
+	// Slots is how many builds the worker runs at once
+	Slots   int `json:"slots"`
+	Running int `json:"running"`
+	// Draining workers finish their running builds but claim no new ones
+	Draining    bool             `json:"draining"`
+	DrainingAt  *time.Time       `json:"draining_at,omitempty"`
+	StartedAt   time.Time        `json:"started_at"`
+	HeartbeatAt time.Time        `json:"heartbeat_at"`
+	Builds      []*InFlightBuild `json:"builds"`
+}
+
+// InFlightBuild is a running build and how long it has been running
+type InFlightBuild struct {
+	ID              int        `json:"id"`
+	ProjectName     string     `json:"project_name"`
+	Org             string     `json:"org,omitempty"`
+	WorkerID        string     `json:"worker_id"`
+	StartedAt       *time.Time `json:"started_at"`
+	LeaseExpiresAt  *time.Time `json:"lease_expires_at"`
+	DurationSeconds float64    `json:"duration_seconds"`
+}
+
+// QueueDepth counts the queued builds by what they wait for (ready,
+// dependencies or project_paused) and by org. Builds have no priority to
+// count them by: workers start the oldest, only deferring users over their
+// fair share.
+type QueueDepth struct {
+	Queued   int            `json:"queued"`
+	ByReason map[string]int `json:"by_reason"`
+	ByOrg    map[string]int `json:"by_org"`
+}
+
+// QueueControl is whether an admin has paused the queue
+type QueueControl struct {
+	Paused      bool       `json:"paused"`
+	PausedAt    *time.Time `json:"paused_at,omitempty"`
+	PauseReason string     `json:"pause_reason,omitempty"`
+}
+
+// QueueOverview is the state of the queue across every worker
+type QueueOverview struct {
+	QueueControl
+	Depth    *QueueDepth      `json:"depth"`
+	InFlight []*InFlightBuild `json:"in_flight"`
+}
+
+// register records the queue's workers with a heartbeat, so admins can see
+// and drain them
+func (q *BuildQueue) register() {
+	worker := &Worker{ID: q.workerID, Hostname: q.hostname, Slots: q.workers, StartedAt: q.startedAt}
+	if err := q.db.RegisterWorker(worker); err != nil {
+		q.errors.Capture("queue", fmt.Errorf("registering worker: %w", err), nil)
+	}
+}
+
+// workerStaleAfter is how long after its last heartbeat a worker is no longer
+// listed
+func (q *BuildQueue) workerStaleAfter() time.Duration {
+	return 3 * q.registerInterval
+}
+
+// List workers endpoint. Shows each live worker with the builds it's running.
+func (bs *BuildService) listWorkersHandler(w http.ResponseWriter, r *http.Request) {
+	workers, err := bs.db.ListWorkers(time.Now().Add(-bs.queue.workerStaleAfter()))
+	if err != nil {
+		log.Printf("Error listing workers: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	builds, err := bs.db.ListInFlightBuilds()
+	if err != nil {
+		log.Printf("Error listing running builds: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	byID := make(map[string]*Worker)
+	for _, worker := range workers {
+		worker.Builds = []*InFlightBuild{}
+		byID[worker.ID] = worker
+	}
+	for _, build := range builds {
+		if worker := byID[build.WorkerID]; worker != nil {
+			worker.Builds = append(worker.Builds, build)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(workers)
+}
+
+// Drain worker endpoint. The worker finishes its running builds but claims
+// no new ones.
+func (bs *BuildService) drainWorkerHandler(w http.ResponseWriter, r *http.Request) {
+	bs.setWorkerDraining(w, r, true)
+}
+
+// Undrain worker endpoint
+func (bs *BuildService) undrainWorkerHandler(w http.ResponseWriter, r *http.Request) {
+	bs.setWorkerDraining(w, r, false)
+}
+
+func (bs *BuildService) setWorkerDraining(w http.ResponseWriter, r *http.Request, draining bool) {
+	worker, err := bs.db.SetWorkerDraining(mux.Vars(r)["id"], draining)
+	if err != nil {
+		if err.Error() == "worker not found" {
+			http.Error(w, "Worker not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error draining worker: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if draining {
+		log.Printf("Draining worker %s with %d running build(s)", worker.ID, worker.Running)
+	} else {
+		log.Printf("Worker %s claims builds again", worker.ID)
+		bs.queue.Notify()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(worker)
+}
+
+// Queue overview endpoint. Shows whether the queue is paused, how many builds
+// wait and for what, and the running builds with their durations. The depth
+// is broken down by reason and org rather than priority, as builds have none.
+func (bs *BuildService) queueOverviewHandler(w http.ResponseWriter, r *http.Request) {
+	control, err := bs.db.GetQueueControl()
+	if err != nil {
+		log.Printf("Error getting queue state: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	depth, err := bs.db.GetQueueDepth()
+	if err != nil {
+		log.Printf("Error getting queue depth: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	builds, err := bs.db.ListInFlightBuilds()
+	if err != nil {
+		log.Printf("Error listing running builds: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(QueueOverview{QueueControl: *control, Depth: depth, InFlight: builds})
+}
+
+// Pause queue endpoint. No worker claims builds until the queue is resumed;
+// running builds carry on.
+func (bs *BuildService) pauseQueueHandler(w http.ResponseWriter, r *http.Request) {
+	// The body is optional
+	var req PauseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	bs.setQueuePaused(w, true, strings.TrimSpace(req.Reason))
+}
+
+// Resume queue endpoint
+func (bs *BuildService) resumeQueueHandler(w http.ResponseWriter, r *http.Request) {
+	bs.setQueuePaused(w, false, "")
+}
+
+func (bs *BuildService) setQueuePaused(w http.ResponseWriter, paused bool, reason string) {
+	control, err := bs.db.SetQueuePaused(paused, reason)
+	if err != nil {
+		log.Printf("Error pausing queue: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if paused {
+		log.Printf("Paused the build queue: %s", reason)
+	} else {
+		log.Printf("Resumed the build queue")
+		bs.queue.Notify()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(control)
+}
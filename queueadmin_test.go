@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListWorkersHandler(t *testing.T) {
+	service, mockDB := setupTestService()
+	started := time.Now().Add(-time.Minute)
+	mockDB.On("ListWorkers", mock.AnythingOfType("time.Time")).Return([]*Worker{
+		{ID: "host-a-1", Hostname: "host-a", Slots: 4, Running: 1},
+		{ID: "host-b-1", Hostname: "host-b", Slots: 4},
+	}, nil).Once()
+	mockDB.On("ListInFlightBuilds").Return([]*InFlightBuild{
+		{ID: 7, ProjectName: "project-1", WorkerID: "host-a-1", StartedAt: &started, DurationSeconds: 60},
+		{ID: 8, ProjectName: "project-2", WorkerID: "gone-1"},
+	}, nil).Once()
+
+	rr := httptest.NewRecorder()
+	service.listWorkersHandler(rr, httptest.NewRequest("GET", "/api/v1/admin/workers", nil))
+
+	require.Equal(t, http.StatusOK, rr.Code)
+	var workers []*Worker
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &workers))
+	require.Len(t, workers, 2)
+	require.Len(t, workers[0].Builds, 1)
+	assert.Equal(t, 7, workers[0].Builds[0].ID)
+	assert.Empty(t, workers[1].Builds)
+	mockDB.AssertExpectations(t)
+}
+
+func TestDrainWorkerHandlers(t *testing.T) {
+	service, mockDB := setupTestService()
+	now := time.Now()
+	mockDB.On("SetWorkerDraining", "host-a-1", true).Return(&Worker{ID: "host-a-1", Draining: true, DrainingAt: &now, Running: 2}, nil).Once()
+	mockDB.On("SetWorkerDraining", "host-a-1", false).Return(&Worker{ID: "host-a-1"}, nil).Once()
+	mockDB.On("SetWorkerDraining", "missing", true).Return(nil, fmt.Errorf("worker not found")).Once()
+
+	call := func(handler http.HandlerFunc, id string) *httptest.ResponseRecorder {
+		req := mux.SetURLVars(httptest.NewRequest("POST", "/api/v1/admin/workers/"+id+"/drain", nil), map[string]string{"id": id})
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr
+	}
+
+	rr := call(service.drainWorkerHandler, "host-a-1")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"draining":true`)
+	rr = call(service.undrainWorkerHandler, "host-a-1")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"draining":false`)
+	assert.Equal(t, http.StatusNotFound, call(service.drainWorkerHandler, "missing").Code)
+	mockDB.AssertExpectations(t)
+}
+
+func TestQueueOverviewHandler(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.On("GetQueueControl").Return(&QueueControl{}, nil).Once()
+	mockDB.On("GetQueueDepth").Return(&QueueDepth{
+		Queued:   5,
+		ByReason: map[string]int{"ready": 3, "dependencies": 2},
+		ByOrg:    map[string]int{"acme": 5},
+	}, nil).Once()
+	mockDB.On("ListInFlightBuilds").Return([]*InFlightBuild{{ID: 7, ProjectName: "project-1", WorkerID: "host-a-1"}}, nil).Once()
+
+	rr := httptest.NewRecorder()
+	service.queueOverviewHandler(rr, httptest.NewRequest("GET", "/api/v1/admin/queue", nil))
+
+	require.Equal(t, http.StatusOK, rr.Code)
+	var overview QueueOverview
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &overview))
+	assert.False(t, overview.Paused)
+	assert.Equal(t, 5, overview.Depth.Queued)
+	assert.Equal(t, 2, overview.Depth.ByReason["dependencies"])
+	require.Len(t, overview.InFlight, 1)
+
+	mockDB.On("GetQueueControl").Return(nil, fmt.Errorf("connection refused")).Once()
+	rr = httptest.NewRecorder()
+	service.queueOverviewHandler(rr, httptest.NewRequest("GET", "/api/v1/admin/queue", nil))
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+	mockDB.AssertExpectations(t)
+}
+
+func TestPauseAndResumeQueueHandlers(t *testing.T) {
+	service, mockDB := setupTestService()
+	now := time.Now()
+	mockDB.On("SetQueuePaused", true, "database upgrade").Return(&QueueControl{Paused: true, PausedAt: &now, PauseReason: "database upgrade"}, nil).Once()
+	mockDB.On("SetQueuePaused", true, "").Return(&QueueControl{Paused: true, PausedAt: &now}, nil).Once()
+	mockDB.On("SetQueuePaused", false, "").Return(&QueueControl{}, nil).Once()
+
+	rr := httptest.NewRecorder()
+	service.pauseQueueHandler(rr, httptest.NewRequest("POST", "/api/v1/admin/queue/pause", bytes.NewBufferString(`{"reason": " database upgrade "}`)))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"pause_reason":"database upgrade"`)
+
+	rr = httptest.NewRecorder()
+	service.pauseQueueHandler(rr, httptest.NewRequest("POST", "/api/v1/admin/queue/pause", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	rr = httptest.NewRecorder()
+	service.pauseQueueHandler(rr, httptest.NewRequest("POST", "/api/v1/admin/queue/pause", bytes.NewBufferString(`{`)))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = httptest.NewRecorder()
+	service.resumeQueueHandler(rr, httptest.NewRequest("POST", "/api/v1/admin/queue/resume", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"paused":false`)
+	mockDB.AssertExpectations(t)
+}
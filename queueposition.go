@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Reasons a queued build is waiting
+const (
+	queueReasonPaused       = "project_paused"
+	queueReasonDependencies = "dependencies"
+	queueReasonFairShare    = "fair_share"
+	queueReasonAhead        = "builds_ahead"
+	queueReasonQueuePaused  = "queue_paused"
+)
+
+// QueueState is the queue as seen by one queued build, following the order
+// ClaimNextBuild claims builds in
+type QueueState struct {
+	// Ahead counts the claimable builds that will be claimed first
+	Ahead   int
+	Queued  int
+	Running int
+	Paused  bool
+	// BlockedBy lists the dependencies that haven't succeeded yet
+	BlockedBy []int
+	// UserRunning and MaxRunning are the running builds of the user who
+	// triggered the build and their org's fair share
+	UserRunning int
+	MaxRunning  int
+	OverShare   bool
+	// StartedLastHour counts the builds claimed in the last hour, the rate
+	// the queue is draining at
+	StartedLastHour int
+	// QueuePaused is set while an admin has paused the whole queue
+	QueuePaused bool
+}
+
+// QueueConstraint is something delaying a queued build
+type QueueConstraint struct {
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+	// BuildIDs are the builds the constraint waits for, if any
+	BuildIDs []int `json:"build_ids,omitempty"`
+}
+
+// QueuePosition explains where a build is in the queue and why it hasn't
+// started
+type QueuePosition struct {
+	BuildID int    `json:"build_id"`
+	Status  string `json:"status"`
+	// Position is 1 for the next build to start; 0 once the build has left
+	// the queue
+	Position    int               `json:"position,omitempty"`
+	Queued      int               `json:"queued"`
+	Running     int               `json:"running"`
+	Constraints []QueueConstraint `json:"constraints"`
+	// EstimatedStartAt extrapolates from the builds started in the last
+	// hour. It's omitted for builds that can't start yet or when no builds
+	// started recently.
+	EstimatedStartAt *time.Time `json:"estimated_start_at,omitempty"`
+}
+
+// explainQueuePosition lists what delays a queued build and estimates when
+// it starts
+func explainQueuePosition(build *BuildRequest, state *QueueState, now time.Time) *QueuePosition {
+	position := &QueuePosition{
+		BuildID:     build.ID,
+		Status:      build.Status,
+		Position:    state.Ahead + 1,
+		Queued:      state.Queued,
+		Running:     state.Running,
+		Constraints: []QueueConstraint{},
+	}
+
+	blocked := false
+	if state.QueuePaused {
+		blocked = true
+		position.Constraints = append(position.Constraints, QueueConstraint{
+			Reason:  queueReasonQueuePaused,
+			Message: "The build queue is paused; no builds start until it's resumed",
+		})
+	}
+	if state.Paused {
+		blocked = true
+		position.Constraints = append(position.Constraints, QueueConstraint{
+			Reason:  queueReasonPaused,
+			Message: fmt.Sprintf("Project %s is paused; its builds start once it's resumed", build.ProjectName),
+		})
+	}
+	if len(state.BlockedBy) > 0 {
+		blocked = true
+		position.Constraints = append(position.Constraints, QueueConstraint{
+			Reason:   queueReasonDependencies,
+			Message:  fmt.Sprintf("Waiting for %d build(s) it depends on to succeed", len(state.BlockedBy)),
+			BuildIDs: state.BlockedBy,
+		})
+	}
+	if state.OverShare {
+		position.Constraints = append(position.Constraints, QueueConstraint{
+			Reason: queueReasonFairShare,
+			Message: fmt.Sprintf("%s is running %d of the %d builds per user org %q allows; other users' builds start first",
+				build.TriggeredBy, state.UserRunning, state.MaxRunning, build.Org),
+		})
+	}
+	if state.Ahead > 0 {
+		position.Constraints = append(position.Constraints, QueueConstraint{
+			Reason:  queueReasonAhead,
+			Message: fmt.Sprintf("%d build(s) ahead in the queue", state.Ahead),
+		})
+	}
+
+	if !blocked && state.StartedLastHour > 0 {
+		wait := time.Duration(float64(state.Ahead+1) / float64(state.StartedLastHour) * float64(time.Hour))
+		estimate := now.Add(wait).Truncate(time.Second)
+		position.EstimatedStartAt = &estimate
+	}
+	return position
+}
+
+// Build queue position endpoint
+func (bs *BuildService) queuePositionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid build ID", http.StatusBadRequest)
+		return
+	}
+
+	build, err := bs.db.GetBuild(id)
+	if err != nil {
+		if err.Error() == "build not found" {
+			http.Error(w, "Build not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error getting build: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	position := &QueuePosition{BuildID: build.ID, Status: build.Status, Constraints: []QueueConstraint{}}
+	if build.Status == "queued" {
+		state, err := bs.db.GetQueueState(id, bs.queue.fairShare)
+		switch {
+		case err == nil:
+			position = explainQueuePosition(build, state, time.Now().UTC())
+		case err.Error() == "build not queued":
+			// Claimed or cancelled since it was read
+			if current, err := bs.db.GetBuild(id); err == nil {
+				position.Status = current.Status
+			}
+		default:
+			log.Printf("Error getting queue state: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(position)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExplainQueuePosition(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	build := &BuildRequest{ID: 7, ProjectName: "api", Org: "acme", TriggeredBy: "alice", Status: "queued"}
+
+	// Next in line with 30 builds started in the last hour: about 2 minutes
+	position := explainQueuePosition(build, &QueueState{Queued: 1, Running: 4, StartedLastHour: 30}, now)
+	assert.Equal(t, 1, position.Position)
+	assert.Empty(t, position.Constraints)
+	require.NotNil(t, position.EstimatedStartAt)
+	assert.Equal(t, now.Add(2*time.Minute), *position.EstimatedStartAt)
+
+	position = explainQueuePosition(build, &QueueState{
+		Ahead: 2, Queued: 5, UserRunning: 2, MaxRunning: 2, OverShare: true, StartedLastHour: 60,
+	}, now)
+	assert.Equal(t, 3, position.Position)
+	reasons := []string{}
+	for _, constraint := range position.Constraints {
+		reasons = append(reasons, constraint.Reason)
+	}
+	assert.Equal(t, []string{queueReasonFairShare, queueReasonAhead}, reasons)
+	assert.Contains(t, position.Constraints[0].Message, "alice is running 2 of the 2 builds")
+	assert.Equal(t, now.Add(3*time.Minute), *position.EstimatedStartAt)
+
+	// Builds that can't start have no estimate
+	position = explainQueuePosition(build, &QueueState{Paused: true, BlockedBy: []int{3, 4}, StartedLastHour: 60}, now)
+	require.Len(t, position.Constraints, 2)
+	assert.Equal(t, queueReasonPaused, position.Constraints[0].Reason)
+	assert.Equal(t, []int{3, 4}, position.Constraints[1].BuildIDs)
+	assert.Nil(t, position.EstimatedStartAt)
+
+	position = explainQueuePosition(build, &QueueState{QueuePaused: true, StartedLastHour: 60}, now)
+	require.Len(t, position.Constraints, 1)
+	assert.Equal(t, queueReasonQueuePaused, position.Constraints[0].Reason)
+	assert.Nil(t, position.EstimatedStartAt)
+
+	// Nor does anything when no builds started recently
+	position = explainQueuePosition(build, &QueueState{Queued: 1}, now)
+	assert.Nil(t, position.EstimatedStartAt)
+}
+
+func TestQueuePositionHandler(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.On("GetBuild", 1).Return(&BuildRequest{ID: 1, Status: "queued"}, nil)
+	mockDB.On("GetBuild", 2).Return(&BuildRequest{ID: 2, Status: "success"}, nil)
+	mockDB.On("GetBuild", 3).Return(&BuildRequest{ID: 3, Status: "queued"}, nil).Once()
+	mockDB.On("GetBuild", 3).Return(&BuildRequest{ID: 3, Status: "running"}, nil)
+	mockDB.On("GetBuild", 4).Return(nil, fmt.Errorf("build not found"))
+	mockDB.On("GetQueueState", 1, 0).Return(&QueueState{Ahead: 4, Queued: 9, Running: 2, BlockedBy: []int{8}}, nil)
+	mockDB.On("GetQueueState", 3, 0).Return(nil, fmt.Errorf("build not queued"))
+
+	get := func(id string) (*httptest.ResponseRecorder, *QueuePosition) {
+		req := httptest.NewRequest("GET", "/api/v1/builds/"+id+"/queue-position", nil)
+		req = mux.SetURLVars(req, map[string]string{"id": id})
+		rr := httptest.NewRecorder()
+		service.queuePositionHandler(rr, req)
+		var position QueuePosition
+		if rr.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &position))
+		}
+		return rr, &position
+	}
+
+	_, position := get("1")
+	assert.Equal(t, 5, position.Position)
+	assert.Equal(t, 9, position.Queued)
+	require.Len(t, position.Constraints, 2)
+	assert.Equal(t, queueReasonDependencies, position.Constraints[0].Reason)
+
+	// Builds that left the queue have no position
+	rr, position := get("2")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "success", position.Status)
+	assert.Zero(t, position.Position)
+	assert.NotContains(t, rr.Body.String(), "position\":")
+
+	// Including those claimed in the meantime
+	_, position = get("3")
+	assert.Equal(t, "running", position.Status)
+	assert.Zero(t, position.Position)
+
+	rr, _ = get("4")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	rr, _ = get("x")
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ProjectQueueWait is the queue of a project with a queue wait SLA
+type ProjectQueueWait struct {
+	Project        string
+	MaxWait        time.Duration
+	Queued         int
+	OldestQueuedAt *time.Time
+}
+
+// QueueSLAMonitor watches how long builds of projects with a
+// max_queue_wait_seconds wait in the queue and alerts when the wait exceeds it.
+// It also reports the overall queue depth.
+type QueueSLAMonitor struct {
+	db       DatabaseInterface
+	errors   *ErrorTracker
+	interval time.Duration
+	depth    prometheus.Gauge
+	wait     *prometheus.GaugeVec
+	breached *prometheus.GaugeVec
+	breaches *prometheus.CounterVec
+
+	mu     sync.Mutex
+	active map[string]bool
+}
+
+// NewQueueSLAMonitor creates a monitor reporting into the given metrics
+func NewQueueSLAMonitor(db DatabaseInterface, errors *ErrorTracker, depth prometheus.Gauge, wait, breached *prometheus.GaugeVec, breaches *prometheus.CounterVec) *QueueSLAMonitor {
+	return &QueueSLAMonitor{
+		db:       db,
+		errors:   errors,
+		interval: getEnvDuration("QUEUE_SLA_CHECK_INTERVAL", 30*time.Second),
+		depth:    depth,
+		wait:     wait,
+		breached: breached,
+		breaches: breaches,
+		active:   make(map[string]bool),
+	}
+}
+
+// Start checks the queue every interval until ctx is cancelled
+func (qm *QueueSLAMonitor) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(qm.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				qm.Check(time.Now())
+			}
+		}
+	}()
+}
+
+// Check updates the queue depth and the metrics of every project with an SLA,
+// alerting once when a project starts breaching it
+func (qm *QueueSLAMonitor) Check(now time.Time) {
+	if stats, err := qm.db.GetQueueStats(now); err != nil {
+		qm.errors.Capture("queue-sla", fmt.Errorf("loading queue depth: %w", err), nil)
+	} else {
+		qm.depth.Set(float64(stats.Queued))
+	}
+
+	waits, err := qm.db.ProjectQueueWaits()
+	if err != nil {
+		qm.errors.Capture("queue-sla", fmt.Errorf("loading project queue waits: %w", err), nil)
+		return
+	}
+
+	qm.mu.Lock()
+	defer qm.mu.Unlock()
+
+	seen := make(map[string]bool, len(waits))
+	for _, wait := range waits {
+		seen[wait.Project] = true
+
+		var oldest time.Duration
+		if wait.OldestQueuedAt != nil {
+			oldest = now.Sub(*wait.OldestQueuedAt)
+		}
+		qm.wait.WithLabelValues(wait.Project).Set(oldest.Seconds())
+
+		breached := oldest > wait.MaxWait
+		switch {
+		case breached && !qm.active[wait.Project]:
+			qm.breached.WithLabelValues(wait.Project).Set(1)
+			qm.breaches.WithLabelValues(wait.Project).Inc()
+			qm.errors.Capture("queue-sla", fmt.Errorf("builds of %s have been queued for %s, above the %s SLA (%d waiting)",
+				wait.Project, oldest.Round(time.Second), wait.MaxWait, wait.Queued), nil)
+		case !breached && qm.active[wait.Project]:
+			qm.breached.WithLabelValues(wait.Project).Set(0)
+			log.Printf("Queue wait of %s is back within its %s SLA", wait.Project, wait.MaxWait)
+		case !breached:
+			qm.breached.WithLabelValues(wait.Project).Set(0)
+		}
+		qm.active[wait.Project] = breached
+	}
+
+	// Projects that dropped their SLA or were paused stop reporting
+	for project := range qm.active {
+		if !seen[project] {
+			delete(qm.active, project)
+			qm.wait.DeleteLabelValues(project)
+			qm.breached.DeleteLabelValues(project)
+		}
+	}
+}
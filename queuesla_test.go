@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestQueueSLAMonitorCheck(t *testing.T) {
+	service, mockDB := setupTestService()
+	monitor := service.queueSLA
+	now := time.Now()
+	recent := now.Add(-time.Minute)
+	old := now.Add(-20 * time.Minute)
+	mockDB.On("GetQueueStats", now).Return(&QueueStats{Queued: 7}, nil)
+
+	// Within the SLA
+	mockDB.On("ProjectQueueWaits").Return([]*ProjectQueueWait{
+		{Project: "api", MaxWait: 10 * time.Minute, Queued: 2, OldestQueuedAt: &recent},
+		{Project: "web", MaxWait: 10 * time.Minute},
+	}, nil).Once()
+	monitor.Check(now)
+	assert.Equal(t, float64(60), testutil.ToFloat64(service.metrics.QueueWait.WithLabelValues("api")))
+	assert.Equal(t, float64(0), testutil.ToFloat64(service.metrics.QueueSLABreached.WithLabelValues("api")))
+	assert.Equal(t, float64(0), testutil.ToFloat64(service.metrics.QueueWait.WithLabelValues("web")))
+	assert.Equal(t, float64(7), testutil.ToFloat64(service.metrics.QueueDepth))
+
+	// Breached: alerts once while it lasts
+	for i := 0; i < 2; i++ {
+		mockDB.On("ProjectQueueWaits").Return([]*ProjectQueueWait{
+			{Project: "api", MaxWait: 10 * time.Minute, Queued: 5, OldestQueuedAt: &old},
+		}, nil).Once()
+		monitor.Check(now)
+	}
+	assert.Equal(t, float64(1), testutil.ToFloat64(service.metrics.QueueSLABreached.WithLabelValues("api")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(service.metrics.QueueSLABreaches.WithLabelValues("api")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(service.metrics.BackgroundErrors.WithLabelValues("queue-sla")))
+	assert.Equal(t, 1, testutil.CollectAndCount(&service.metrics.QueueWait), "projects without an SLA are dropped")
+
+	// Recovered
+	mockDB.On("ProjectQueueWaits").Return([]*ProjectQueueWait{
+		{Project: "api", MaxWait: 10 * time.Minute},
+	}, nil).Once()
+	monitor.Check(now)
+	assert.Equal(t, float64(0), testutil.ToFloat64(service.metrics.QueueSLABreached.WithLabelValues("api")))
+
+	mockDB.On("ProjectQueueWaits").Return(nil, fmt.Errorf("connection refused")).Once()
+	monitor.Check(now)
+	assert.Equal(t, float64(2), testutil.ToFloat64(service.metrics.BackgroundErrors.WithLabelValues("queue-sla")))
+
+	mockDB.AssertExpectations(t)
+}
+
+func TestQueueSLAMonitorQueueDepthError(t *testing.T) {
+	service, mockDB := setupTestService()
+	service.metrics.QueueDepth.Set(3)
+	mockDB.On("GetQueueStats", mock.AnythingOfType("time.Time")).Return(nil, fmt.Errorf("connection refused")).Once()
+	mockDB.On("ProjectQueueWaits").Return([]*ProjectQueueWait{}, nil).Once()
+
+	service.queueSLA.Check(time.Now())
+	assert.Equal(t, float64(3), testutil.ToFloat64(service.metrics.QueueDepth), "depth is kept when it can't be loaded")
+	assert.Equal(t, float64(1), testutil.ToFloat64(service.metrics.BackgroundErrors.WithLabelValues("queue-sla")))
+	mockDB.AssertExpectations(t)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// unlimitedRoutes are never throttled: health checks and metrics scrapes come
+// from infrastructure, and forge webhooks are signed and arrive from shared
+// addresses
+var unlimitedRoutes = map[string]bool{
+	"/metrics":                true,
+	"/api/v1/health":          true,
+	"/api/v1/webhooks/github": true,
+	"/api/v1/webhooks/gitlab": true,
+}
+
+// rateLimitMaxBuckets bounds the clients tracked at once. Past it, clients
+// without a bucket share one until idle buckets are pruned.
+const rateLimitMaxBuckets = 100_000
+
+// rateLimitOverflow keys the bucket shared by clients over rateLimitMaxBuckets
+const rateLimitOverflow = "overflow"
+
+// RateLimit is the sustained rate and burst allowed to one client
+type RateLimit struct {
+	PerMinute int
+	Burst     int
+}
+
+// tokenBucket holds the tokens left to one client, refilled continuously
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// RateLimiter throttles each client with a token bucket. Clients whose
+// credentials were verified are keyed by them, others by their address, and
+// each kind has its own limit.
+type RateLimiter struct {
+	keyed     RateLimit
+	anonymous RateLimit
+	throttled *prometheus.CounterVec
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// NewRateLimiterFromEnv creates a rate limiter allowing RATE_LIMIT_PER_MINUTE
+// requests (bursts of RATE_LIMIT_BURST) to clients with an API key, and
+// RATE_LIMIT_ANONYMOUS_PER_MINUTE (bursts of RATE_LIMIT_ANONYMOUS_BURST) to
+// other clients. A zero rate disables limiting for that kind of client.
+func NewRateLimiterFromEnv(throttled *prometheus.CounterVec) *RateLimiter {
+	return &RateLimiter{
+		keyed: RateLimit{
+			PerMinute: getEnvInt("RATE_LIMIT_PER_MINUTE", 600),
+			Burst:     getEnvInt("RATE_LIMIT_BURST", 100),
+		},
+		anonymous: RateLimit{
+			PerMinute: getEnvInt("RATE_LIMIT_ANONYMOUS_PER_MINUTE", 120),
+			Burst:     getEnvInt("RATE_LIMIT_ANONYMOUS_BURST", 30),
+		},
+		throttled: throttled,
+		buckets:   make(map[string]*tokenBucket),
+	}
+}
+
+// clientKind tells whether a request is keyed by its credentials or its
+// address. Credentials the tenancy middleware didn't verify count for nothing,
+// or a client could pick a new bucket with every request.
+func clientKind(r *http.Request) string {
+	if requestTenant(r).identity() != "" {
+		return "api_key"
+	}
+	return "ip"
+}
+
+// Allow takes a token from the client's bucket. When the bucket is empty it
+// returns false and how long until the next token is available.
+func (rl *RateLimiter) Allow(client string, limit RateLimit, now time.Time) (bool, time.Duration) {
+	rate := float64(limit.PerMinute) / 60
+	burst := float64(limit.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	bucket, ok := rl.buckets[client]
+	if !ok && len(rl.buckets) >= rateLimitMaxBuckets {
+		rl.pruneLocked(now)
+		if len(rl.buckets) >= rateLimitMaxBuckets {
+			client = rateLimitOverflow
+			bucket, ok = rl.buckets[client]
+		}
+	}
+	if !ok {
+		bucket = &tokenBucket{tokens: burst, updated: now}
+		rl.buckets[client] = bucket
+	}
+	if elapsed := now.Sub(bucket.updated).Seconds(); elapsed > 0 {
+		bucket.tokens = math.Min(burst, bucket.tokens+elapsed*rate)
+		bucket.updated = now
+	}
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - bucket.tokens) / rate * float64(time.Second))
+	return false, wait
+}
+
+// Middleware answers requests of clients over their limit with
+// 429 Too Many Requests and a Retry-After header. It must run after the
+// tenancy middleware, which verifies the credentials clients are keyed by.
+func (rl *RateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeTemplate(r)
+		kind := clientKind(r)
+		limit := rl.keyed
+		if kind == "ip" {
+			limit = rl.anonymous
+		}
+		if limit.PerMinute <= 0 || unlimitedRoutes[route] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		allowed, wait := rl.Allow(kind+":"+callerID(r), limit, time.Now())
+		if !allowed {
+			rl.throttled.WithLabelValues(kind, route).Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Start drops the buckets of idle clients every minute until ctx is
+// cancelled. A bucket that has refilled completely is the same as no bucket.
+func (rl *RateLimiter) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				rl.prune(now)
+			}
+		}
+	}()
+}
+
+// prune removes the buckets untouched for longer than the slowest refill
+func (rl *RateLimiter) prune(now time.Time) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.pruneLocked(now)
+}
+
+// pruneLocked is prune for callers holding rl.mu
+func (rl *RateLimiter) pruneLocked(now time.Time) {
+	idle := time.Minute
+	for _, limit := range []RateLimit{rl.keyed, rl.anonymous} {
+		if limit.PerMinute > 0 {
+			if refill := time.Duration(float64(limit.Burst) / float64(limit.PerMinute) * float64(time.Minute)); refill > idle {
+				idle = refill
+			}
+		}
+	}
+
+	for client, bucket := range rl.buckets {
+		if now.Sub(bucket.updated) > idle {
+			delete(rl.buckets, client)
+		}
+	}
+}
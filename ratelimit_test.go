@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestRateLimiter(keyed, anonymous RateLimit) *RateLimiter {
+	metrics := NewMetrics()
+	return &RateLimiter{
+		keyed:     keyed,
+		anonymous: anonymous,
+		throttled: &metrics.HTTPThrottled,
+		buckets:   make(map[string]*tokenBucket),
+	}
+}
+
+// rateLimitedRouter serves an empty handler on route behind the limiter
+func rateLimitedRouter(rl *RateLimiter, route string) *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc(route, func(w http.ResponseWriter, r *http.Request) {})
+	router.Use(rl.Middleware)
+	return router
+}
+
+func TestRateLimiterAllowRefills(t *testing.T) {
+	rl := newTestRateLimiter(RateLimit{PerMinute: 60, Burst: 2}, RateLimit{})
+	now := time.Now()
+
+	allowed, _ := rl.Allow("a", rl.keyed, now)
+	assert.True(t, allowed)
+	allowed, _ = rl.Allow("a", rl.keyed, now)
+	assert.True(t, allowed)
+	allowed, wait := rl.Allow("a", rl.keyed, now)
+	assert.False(t, allowed)
+	assert.Equal(t, time.Second, wait)
+
+	// Other clients have their own bucket
+	allowed, _ = rl.Allow("b", rl.keyed, now)
+	assert.True(t, allowed)
+
+	// One token a second at 60 per minute
+	allowed, _ = rl.Allow("a", rl.keyed, now.Add(500*time.Millisecond))
+	assert.False(t, allowed)
+	allowed, _ = rl.Allow("a", rl.keyed, now.Add(time.Second))
+	assert.True(t, allowed)
+}
+
+func TestRateLimiterMiddleware(t *testing.T) {
+	rl := newTestRateLimiter(RateLimit{PerMinute: 60, Burst: 2}, RateLimit{PerMinute: 6, Burst: 1})
+	router := rateLimitedRouter(rl, "/api/v1/builds")
+
+	// keyID 0 sends credentials the tenancy middleware didn't verify
+	get := func(keyID int, addr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/v1/builds", nil)
+		req.RemoteAddr = addr
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer bsk_%d", keyID))
+		if keyID != 0 {
+			req = req.WithContext(context.WithValue(req.Context(), tenantContextKey{}, Tenant{Org: "acme", KeyID: keyID}))
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Anonymous clients are keyed by address, whatever credentials they make up
+	assert.Equal(t, http.StatusOK, get(0, "10.0.0.1:1234").Code)
+	rr := get(0, "10.0.0.1:5678")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, "10", rr.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusOK, get(0, "10.0.0.2:1234").Code)
+
+	// Clients with an API key are keyed by it, whatever their address
+	assert.Equal(t, http.StatusOK, get(1, "10.0.0.1:1234").Code)
+	assert.Equal(t, http.StatusOK, get(1, "10.0.0.3:1234").Code)
+	rr = get(1, "10.0.0.4:1234")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, "1", rr.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusOK, get(2, "10.0.0.1:1234").Code)
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(rl.throttled.WithLabelValues("ip", "/api/v1/builds")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(rl.throttled.WithLabelValues("api_key", "/api/v1/builds")))
+}
+
+func TestRateLimiterExemptions(t *testing.T) {
+	rl := newTestRateLimiter(RateLimit{}, RateLimit{PerMinute: 1, Burst: 1})
+
+	health := rateLimitedRouter(rl, "/api/v1/health")
+	for i := 0; i < 5; i++ {
+		rr := httptest.NewRecorder()
+		health.ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/health", nil))
+		assert.Equal(t, http.StatusOK, rr.Code)
+	}
+
+	// A zero rate disables limiting of keyed clients
+	builds := rateLimitedRouter(rl, "/api/v1/builds")
+	for i := 0; i < 5; i++ {
+		req := httptest.NewRequest("GET", "/api/v1/builds", nil)
+		req = req.WithContext(context.WithValue(req.Context(), tenantContextKey{}, Tenant{Admin: true}))
+		rr := httptest.NewRecorder()
+		builds.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+	}
+}
+
+func TestRateLimiterPrune(t *testing.T) {
+	rl := newTestRateLimiter(RateLimit{PerMinute: 60, Burst: 120}, RateLimit{})
+	now := time.Now()
+	rl.Allow("idle", rl.keyed, now.Add(-3*time.Minute))
+	rl.Allow("active", rl.keyed, now.Add(-time.Minute))
+
+	rl.prune(now)
+	assert.NotContains(t, rl.buckets, "idle")
+	assert.Contains(t, rl.buckets, "active")
+}
+
+func TestRateLimiterBoundsBuckets(t *testing.T) {
+	rl := newTestRateLimiter(RateLimit{PerMinute: 60, Burst: 1}, RateLimit{})
+	now := time.Now()
+	for i := 0; i < rateLimitMaxBuckets; i++ {
+		rl.buckets[fmt.Sprint(i)] = &tokenBucket{tokens: 1, updated: now}
+	}
+
+	// Once full, new clients share one bucket
+	allowed, _ := rl.Allow("new-1", rl.keyed, now)
+	assert.True(t, allowed)
+	allowed, _ = rl.Allow("new-2", rl.keyed, now)
+	assert.False(t, allowed)
+	assert.Len(t, rl.buckets, rateLimitMaxBuckets+1)
+
+	// Idle buckets make room again
+	allowed, _ = rl.Allow("new-3", rl.keyed, now.Add(time.Hour))
+	assert.True(t, allowed)
+	assert.Contains(t, rl.buckets, "new-3")
+}
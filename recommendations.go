@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// recommendationWindow is how many of a project's latest successful builds
+// recommendations are computed from
+const recommendationWindow = 100
+
+// Recommendations leave headroom over the observed usage so ordinary
+// variation between builds doesn't hit the limits
+const (
+	cpuHeadroom     = 1.25
+	memoryHeadroom  = 1.25
+	timeoutHeadroom = 1.5
+)
+
+// BuildUsage is the resource usage of a finished build
+type BuildUsage struct {
+	BuildID         int
+	CPUSeconds      float64
+	PeakMemoryBytes int64
+	DurationSeconds float64
+}
+
+// ResourceLimits are the limits of a project's builds. Zero leaves a limit
+// to the service's defaults.
+type ResourceLimits struct {
+	CPULimit      float64 `json:"cpu_limit"`
+	MemoryLimitMB int     `json:"memory_limit_mb"`
+	BuildTimeout  int     `json:"build_timeout_seconds"`
+}
+
+// ObservedUsage summarises the usage recommendations are computed from
+type ObservedUsage struct {
+	CPUCoresP95        float64 `json:"cpu_cores_p95"`
+	PeakMemoryMBP95    int     `json:"peak_memory_mb_p95"`
+	DurationSecondsP95 int     `json:"duration_seconds_p95"`
+	DurationSecondsP99 int     `json:"duration_seconds_p99"`
+}
+
+// ResourceRecommendations are the limits recommended for a project from the
+// usage of its latest successful builds. Recommended and Observed are only
+// set once MinBuilds builds recorded their usage.
+type ResourceRecommendations struct {
+	Project     string          `json:"project"`
+	Builds      int             `json:"builds"`
+	MinBuilds   int             `json:"min_builds"`
+	Current     ResourceLimits  `json:"current"`
+	Recommended *ResourceLimits `json:"recommended,omitempty"`
+	Observed    *ObservedUsage  `json:"observed,omitempty"`
+	AutoApply   bool            `json:"auto_apply"`
+}
+
+// percentile returns the nearest-rank p-th percentile of sorted values
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	return sorted[max(rank, 1)-1]
+}
+
+// roundUp rounds value up to a multiple of step
+func roundUp(value, step float64) float64 {
+	return math.Ceil(value/step) * step
+}
+
+// recommendLimits recommends limits from build usage: the 95th percentile of
+// CPU cores and peak memory and the 99th percentile of duration, with
+// headroom. Limits whose usage wasn't measured are left at zero.
+func recommendLimits(usages []*BuildUsage) (*ResourceLimits, *ObservedUsage) {
+	var cores, memory, durations []float64
+	for _, usage := range usages {
+		if usage.DurationSeconds > 0 {
+			cores = append(cores, usage.CPUSeconds/usage.DurationSeconds)
+			durations = append(durations, usage.DurationSeconds)
+		}
+		if usage.PeakMemoryBytes > 0 {
+			memory = append(memory, float64(usage.PeakMemoryBytes)/(1<<20))
+		}
+	}
+	sort.Float64s(cores)
+	sort.Float64s(memory)
+	sort.Float64s(durations)
+
+	observed := &ObservedUsage{
+		CPUCoresP95:        math.Round(percentile(cores, 95)*100) / 100,
+		PeakMemoryMBP95:    int(math.Ceil(percentile(memory, 95))),
+		DurationSecondsP95: int(math.Ceil(percentile(durations, 95))),
+		DurationSecondsP99: int(math.Ceil(percentile(durations, 99))),
+	}
+
+	limits := &ResourceLimits{}
+	if len(cores) > 0 {
+		limits.CPULimit = max(roundUp(percentile(cores, 95)*cpuHeadroom, 0.25), 0.25)
+		limits.BuildTimeout = int(roundUp(percentile(durations, 99)*timeoutHeadroom, 60))
+	}
+	if len(memory) > 0 {
+		limits.MemoryLimitMB = int(roundUp(percentile(memory, 95)*memoryHeadroom, 64))
+	}
+	return limits, observed
+}
+
+// resourceRecommendations computes the recommended limits of a project
+func (bs *BuildService) resourceRecommendations(project *Project) (*ResourceRecommendations, error) {
+	usages, err := bs.db.ListBuildUsage(project.Name, recommendationWindow)
+	if err != nil {
+		return nil, err
+	}
+
+	recommendations := &ResourceRecommendations{
+		Project:   project.Name,
+		Builds:    len(usages),
+		MinBuilds: bs.recommendationMinBuilds,
+		Current: ResourceLimits{
+			CPULimit:      project.CPULimit,
+			MemoryLimitMB: project.MemoryLimitMB,
+			BuildTimeout:  project.BuildTimeout,
+		},
+		AutoApply: project.AutoApplyRecommendations,
+	}
+	if len(usages) > 0 && len(usages) >= bs.recommendationMinBuilds {
+		recommendations.Recommended, recommendations.Observed = recommendLimits(usages)
+	}
+	return recommendations, nil
+}
+
+// Project resource recommendations endpoint
+func (bs *BuildService) recommendationsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	project, err := bs.db.GetProject(id)
+	if err != nil {
+		if err.Error() == "project not found" {
+			http.Error(w, "Project not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error getting project: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	recommendations, err := bs.resourceRecommendations(project)
+	if err != nil {
+		log.Printf("Error computing recommendations: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(recommendations)
+}
+
+// applyRecommendations sets the limits of a project that opted in to the
+// recommendations after a successful build. Unmeasured limits are kept, as
+// are timeouts the queue lease wouldn't allow.
+func (bs *BuildService) applyRecommendations(build *BuildRequest, project *Project) {
+	if project == nil || !project.AutoApplyRecommendations || build.Status != "success" {
+		return
+	}
+
+	// Reload the project so edits made while the build ran aren't undone
+	project, err := bs.db.GetProject(project.ID)
+	if err != nil {
+		bs.errors.Capture("recommendations", fmt.Errorf("loading project: %w", err), build)
+		return
+	}
+	if !project.AutoApplyRecommendations {
+		return
+	}
+	recommendations, err := bs.resourceRecommendations(project)
+	if err != nil {
+		bs.errors.Capture("recommendations", fmt.Errorf("computing recommendations: %w", err), build)
+		return
+	}
+	recommended := recommendations.Recommended
+	if recommended == nil {
+		return
+	}
+
+	limits := recommendations.Current
+	if recommended.CPULimit > 0 {
+		limits.CPULimit = recommended.CPULimit
+	}
+	if recommended.MemoryLimitMB > 0 {
+		limits.MemoryLimitMB = recommended.MemoryLimitMB
+	}
+	if recommended.BuildTimeout > 0 && bs.validBuildTimeout(recommended.BuildTimeout) {
+		limits.BuildTimeout = recommended.BuildTimeout
+	}
+	if limits == recommendations.Current {
+		return
+	}
+
+	project.CPULimit, project.MemoryLimitMB, project.BuildTimeout = limits.CPULimit, limits.MemoryLimitMB, limits.BuildTimeout
+	if err := bs.db.UpdateProject(project); err != nil {
+		bs.errors.Capture("recommendations", fmt.Errorf("applying recommendations: %w", err), build)
+		return
+	}
+	bs.cache.InvalidateProject(project.Name)
+	log.Printf("Applied recommended limits to %s: %.2f CPUs, %d MB memory, %ds timeout",
+		project.Name, limits.CPULimit, limits.MemoryLimitMB, limits.BuildTimeout)
+}
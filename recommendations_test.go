@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// usageHistory returns n builds using between 0.1 and 1 cores over 1 to 10
+// minutes with 100MB to 1000MB of memory
+func usageHistory(n int) []*BuildUsage {
+	usages := make([]*BuildUsage, n)
+	for i := range usages {
+		step := float64(i%10 + 1)
+		usages[i] = &BuildUsage{
+			BuildID:         n - i,
+			DurationSeconds: step * 60,
+			CPUSeconds:      step * 60 * step / 10,
+			PeakMemoryBytes: int64(step*100) << 20,
+		}
+	}
+	return usages
+}
+
+func TestRecommendLimits(t *testing.T) {
+	limits, observed := recommendLimits(usageHistory(20))
+	assert.Equal(t, &ObservedUsage{
+		CPUCoresP95:        1,
+		PeakMemoryMBP95:    1000,
+		DurationSecondsP95: 600,
+		DurationSecondsP99: 600,
+	}, observed)
+	// 1.25 cores, 1250MB rounded up to 1280MB and 15 minutes
+	assert.Equal(t, &ResourceLimits{CPULimit: 1.25, MemoryLimitMB: 1280, BuildTimeout: 900}, limits)
+
+	// Memory that wasn't measured isn't limited, and tiny builds still get
+	// a quarter of a core
+	limits, _ = recommendLimits([]*BuildUsage{{DurationSeconds: 10, CPUSeconds: 0.1}})
+	assert.Equal(t, &ResourceLimits{CPULimit: 0.25, BuildTimeout: 60}, limits)
+}
+
+func TestRecommendationsHandler(t *testing.T) {
+	service, mockDB := setupTestService()
+	service.recommendationMinBuilds = 20
+	mockDB.On("GetProject", 1).Return(&Project{ID: 1, Name: "api", MemoryLimitMB: 512, BuildTimeout: 1200}, nil)
+	mockDB.On("GetProject", 2).Return(nil, fmt.Errorf("project not found"))
+	mockDB.On("ListBuildUsage", "api", recommendationWindow).Return(usageHistory(5), nil).Once()
+	mockDB.On("ListBuildUsage", "api", recommendationWindow).Return(usageHistory(20), nil).Once()
+
+	get := func(id string) (*httptest.ResponseRecorder, *ResourceRecommendations) {
+		req := httptest.NewRequest("GET", "/api/v1/projects/"+id+"/recommendations", nil)
+		req = mux.SetURLVars(req, map[string]string{"id": id})
+		rr := httptest.NewRecorder()
+		service.recommendationsHandler(rr, req)
+		var recommendations ResourceRecommendations
+		if rr.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &recommendations))
+		}
+		return rr, &recommendations
+	}
+
+	// Too few builds to recommend anything yet
+	rr, recommendations := get("1")
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, 5, recommendations.Builds)
+	assert.Equal(t, 20, recommendations.MinBuilds)
+	assert.Equal(t, ResourceLimits{MemoryLimitMB: 512, BuildTimeout: 1200}, recommendations.Current)
+	assert.Nil(t, recommendations.Recommended)
+	assert.NotContains(t, rr.Body.String(), "recommended")
+
+	rr, recommendations = get("1")
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, &ResourceLimits{CPULimit: 1.25, MemoryLimitMB: 1280, BuildTimeout: 900}, recommendations.Recommended)
+	assert.Equal(t, 600, recommendations.Observed.DurationSecondsP99)
+
+	rr, _ = get("2")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	rr, _ = get("abc")
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	mockDB.AssertExpectations(t)
+}
+
+func TestApplyRecommendations(t *testing.T) {
+	service, mockDB := setupTestService()
+	service.recommendationMinBuilds = 20
+	project := &Project{ID: 1, Name: "api", AutoApplyRecommendations: true, CPULimit: 4}
+	mockDB.On("GetProject", 1).Return(project, nil)
+	mockDB.On("ListBuildUsage", "api", recommendationWindow).Return(usageHistory(20), nil)
+	mockDB.On("UpdateProject", mock.MatchedBy(func(p *Project) bool {
+		return p.CPULimit == 1.25 && p.MemoryLimitMB == 1280 && p.BuildTimeout == 900
+	})).Return(nil).Once()
+
+	service.applyRecommendations(&BuildRequest{ID: 3, ProjectName: "api", Status: "success"}, project)
+	mockDB.AssertExpectations(t)
+
+	// Failed builds and projects that didn't opt in are left alone
+	service.applyRecommendations(&BuildRequest{ID: 4, ProjectName: "api", Status: "failed"}, project)
+	service.applyRecommendations(&BuildRequest{ID: 5, ProjectName: "web", Status: "success"}, &Project{ID: 2, Name: "web"})
+	mockDB.AssertNumberOfCalls(t, "UpdateProject", 1)
+}
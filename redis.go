@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errRedisNil is returned for a key that doesn't exist
+var errRedisNil = errors.New("redis: nil")
+
+// RedisClient runs commands on a Redis server. It speaks RESP over a single
+// connection, redialled after any error, which is plenty for the handful of
+// cache lookups each request makes.
+type RedisClient struct {
+	server  *url.URL
+	timeout time.Duration
+
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// NewRedisClient creates a client for a redis:// or rediss:// (TLS) URL, with
+// the password and database number taken from the URL as redis-cli does
+func NewRedisClient(rawURL string, timeout time.Duration) (*RedisClient, error) {
+	server, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if server.Scheme != "redis" && server.Scheme != "rediss" {
+		return nil, fmt.Errorf("unsupported scheme %q", server.Scheme)
+	}
+	if server.Port() == "" {
+		server.Host = net.JoinHostPort(server.Hostname(), "6379")
+	}
+	if db := strings.Trim(server.Path, "/"); db != "" {
+		if _, err := strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid database %q", db)
+		}
+	}
+	return &RedisClient{server: server, timeout: timeout}, nil
+}
+
+// Get returns the value of a key, or errRedisNil when it doesn't exist
+func (rc *RedisClient) Get(ctx context.Context, key string) ([]byte, error) {
+	reply, err := rc.do(ctx, "GET", key)
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, errRedisNil
+	}
+	value, ok := reply.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("redis: unexpected reply %v to GET", reply)
+	}
+	return value, nil
+}
+
+// Set stores a value that expires after ttl
+func (rc *RedisClient) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	_, err := rc.do(ctx, "SET", key, string(value), "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	return err
+}
+
+// Del removes keys
+func (rc *RedisClient) Del(ctx context.Context, keys ...string) error {
+	_, err := rc.do(ctx, append([]string{"DEL"}, keys...)...)
+	return err
+}
+
+// Ping checks the server is reachable
+func (rc *RedisClient) Ping(ctx context.Context) error {
+	_, err := rc.do(ctx, "PING")
+	return err
+}
+
+// do runs a command and returns its reply: a string for simple strings, an
+// int64, []byte for bulk strings, nil for null replies and []interface{} for
+// arrays
+func (rc *RedisClient) do(ctx context.Context, args ...string) (interface{}, error) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if rc.conn == nil {
+		if err := rc.connect(ctx); err != nil {
+			return nil, fmt.Errorf("redis: connecting to %s: %w", rc.server.Host, err)
+		}
+	}
+
+	rc.conn.SetDeadline(connDeadline(ctx, rc.timeout))
+	reply, err := rc.roundTrip(args)
+	var serverErr redisError
+	if err != nil && !errors.As(err, &serverErr) {
+		// The connection is out of step with the server
+		rc.close()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("redis: %s: %w", args[0], err)
+	}
+	return reply, nil
+}
+
+// connect dials the server and authenticates and selects the database given
+// in the URL
+func (rc *RedisClient) connect(ctx context.Context) error {
+	dialer := &net.Dialer{Timeout: rc.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", rc.server.Host)
+	if err != nil {
+		return err
+	}
+	if rc.server.Scheme == "rediss" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: rc.server.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return err
+		}
+		conn = tlsConn
+	}
+	conn.SetDeadline(connDeadline(ctx, rc.timeout))
+	rc.conn, rc.reader = conn, bufio.NewReader(conn)
+
+	var setup [][]string
+	if user := rc.server.User; user != nil {
+		if password, ok := user.Password(); ok && user.Username() != "" {
+			setup = append(setup, []string{"AUTH", user.Username(), password})
+		} else if ok {
+			setup = append(setup, []string{"AUTH", password})
+		}
+	}
+	if db := strings.Trim(rc.server.Path, "/"); db != "" && db != "0" {
+		setup = append(setup, []string{"SELECT", db})
+	}
+	for _, args := range setup {
+		if _, err := rc.roundTrip(args); err != nil {
+			rc.close()
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+	}
+	return nil
+}
+
+// roundTrip writes a command as an array of bulk strings and reads its reply
+func (rc *RedisClient) roundTrip(args []string) (interface{}, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(rc.conn, b.String()); err != nil {
+		return nil, err
+	}
+	return readRedisReply(rc.reader)
+}
+
+// redisError is an error reply from the server
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+
+// readRedisReply reads a single RESP reply
+func readRedisReply(reader *bufio.Reader) (interface{}, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		value := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, value); err != nil {
+			return nil, err
+		}
+		return value[:size], nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil || count < 0 {
+			return nil, err
+		}
+		values := make([]interface{}, count)
+		for i := range values {
+			if values[i], err = readRedisReply(reader); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("unexpected reply %q", line)
+}
+
+func (rc *RedisClient) close() {
+	if rc.conn != nil {
+		rc.conn.Close()
+	}
+	rc.conn, rc.reader = nil, nil
+}
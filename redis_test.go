@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRedisServer answers GET, SET, DEL, AUTH, SELECT and PING from an
+// in-memory map, requiring AUTH with password when one is set
+type fakeRedisServer struct {
+	listener net.Listener
+	password string
+
+	mu       sync.Mutex
+	values   map[string]string
+	commands []string
+}
+
+func newFakeRedisServer(t *testing.T, password string) *fakeRedisServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := &fakeRedisServer{listener: listener, password: password, values: make(map[string]string)}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+// URL is the server's redis:// URL with the given user info and path
+func (fs *fakeRedisServer) URL(userinfo, path string) string {
+	return "redis://" + userinfo + fs.listener.Addr().String() + path
+}
+
+func (fs *fakeRedisServer) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	authed := fs.password == ""
+	for {
+		reply, err := readRedisReply(reader)
+		if err != nil {
+			return
+		}
+		var args []string
+		for _, arg := range reply.([]interface{}) {
+			args = append(args, string(arg.([]byte)))
+		}
+
+		fs.mu.Lock()
+		fs.commands = append(fs.commands, strings.Join(args, " "))
+		switch {
+		case args[0] == "AUTH":
+			authed = args[len(args)-1] == fs.password
+			if authed {
+				fmt.Fprint(conn, "+OK\r\n")
+			} else {
+				fmt.Fprint(conn, "-WRONGPASS invalid username-password pair\r\n")
+			}
+		case !authed:
+			fmt.Fprint(conn, "-NOAUTH Authentication required.\r\n")
+		case args[0] == "PING":
+			fmt.Fprint(conn, "+PONG\r\n")
+		case args[0] == "SELECT", args[0] == "SET":
+			if args[0] == "SET" {
+				fs.values[args[1]] = args[2]
+			}
+			fmt.Fprint(conn, "+OK\r\n")
+		case args[0] == "GET":
+			if value, ok := fs.values[args[1]]; ok {
+				fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(value), value)
+			} else {
+				fmt.Fprint(conn, "$-1\r\n")
+			}
+		case args[0] == "DEL":
+			deleted := 0
+			for _, key := range args[1:] {
+				if _, ok := fs.values[key]; ok {
+					delete(fs.values, key)
+					deleted++
+				}
+			}
+			fmt.Fprintf(conn, ":%d\r\n", deleted)
+		default:
+			fmt.Fprintf(conn, "-ERR unknown command '%s'\r\n", args[0])
+		}
+		fs.mu.Unlock()
+	}
+}
+
+func (fs *fakeRedisServer) Commands() []string {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return append([]string(nil), fs.commands...)
+}
+
+func TestRedisClient(t *testing.T) {
+	server := newFakeRedisServer(t, "s3cret")
+	client, err := NewRedisClient(server.URL(":s3cret@", "/2"), time.Second)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	_, err = client.Get(ctx, "missing")
+	assert.ErrorIs(t, err, errRedisNil)
+
+	require.NoError(t, client.Set(ctx, "key", []byte("value\r\nwith a newline"), time.Minute))
+	value, err := client.Get(ctx, "key")
+	require.NoError(t, err)
+	assert.Equal(t, "value\r\nwith a newline", string(value))
+
+	require.NoError(t, client.Del(ctx, "key", "missing"))
+	_, err = client.Get(ctx, "key")
+	assert.ErrorIs(t, err, errRedisNil)
+
+	assert.Equal(t, []string{"AUTH s3cret", "SELECT 2", "GET missing"}, server.Commands()[:3], "the connection is set up once")
+	assert.Contains(t, server.Commands(), "SET key value\r\nwith a newline PX 60000")
+}
+
+func TestRedisClientErrors(t *testing.T) {
+	server := newFakeRedisServer(t, "s3cret")
+	client, err := NewRedisClient(server.URL(":wrong@", ""), time.Second)
+	require.NoError(t, err)
+	err = client.Ping(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "WRONGPASS")
+
+	client, err = NewRedisClient(server.URL(":s3cret@", ""), time.Second)
+	require.NoError(t, err)
+	_, err = client.do(context.Background(), "FLUSHALL")
+	assert.EqualError(t, err, "redis: FLUSHALL: ERR unknown command 'FLUSHALL'")
+	assert.NoError(t, client.Ping(context.Background()), "error replies leave the connection usable")
+
+	for _, rawURL := range []string{"http://localhost", "redis://localhost/db"} {
+		_, err := NewRedisClient(rawURL, time.Second)
+		assert.Error(t, err, rawURL)
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ReleaseNotesRequest selects the range of builds to compile release notes
+// for. From and To are tags, whose latest successful build bounds the range,
+// or builds given as "#42"; FromBuild and ToBuild are the older way to give
+// builds.
+type ReleaseNotesRequest struct {
+	From      string `json:"from"`
+	To        string `json:"to"`
+	FromBuild int    `json:"from_build"`
+	ToBuild   int    `json:"to_build"`
+	Format    string `json:"format"`
+}
+
+// ReleaseCommit is a commit that was built successfully within the range
+type ReleaseCommit struct {
+	SHA     string `json:"sha"`
+	Branch  string `json:"branch"`
+	BuildID int    `json:"build_id"`
+}
+
+// ReleaseNotes summarises what changed between two builds of a project, from
+// the commit of the first (exclusive) to that of the second
+type ReleaseNotes struct {
+	Project      string          `json:"project"`
+	From         string          `json:"from"`
+	To           string          `json:"to"`
+	FromBuild    int             `json:"from_build"`
+	ToBuild      int             `json:"to_build"`
+	FromCommit   string          `json:"from_commit"`
+	ToCommit     string          `json:"to_commit"`
+	Commits      []ReleaseCommit `json:"commits"`
+	Issues       []string        `json:"issues"`
+	Artifacts    []*Artifact     `json:"artifacts"`
+	Builds       int             `json:"builds"`
+	FailedBuilds int             `json:"failed_builds"`
+	GeneratedAt  time.Time       `json:"generated_at"`
+
+	// baseURL is where the builds linked from the markdown are served
+	baseURL string
+}
+
+// compileReleaseNotes collects the successfully built commits and linked
+// issues of builds after from up to and including to, and the artifacts of to.
+// fromRef and toRef are the tags or "#42" build refs the bounds were given as.
+// The commit from was built from has already been released, so it isn't
+// listed again.
+func (bs *BuildService) compileReleaseNotes(project *Project, fromRef, toRef string, from, to *BuildRequest) (*ReleaseNotes, error) {
+	builds, err := bs.db.ListProjectBuildsBetween(project.Name, from.ID, to.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	notes := &ReleaseNotes{
+		Project:     project.Name,
+		From:        fromRef,
+		To:          toRef,
+		FromBuild:   from.ID,
+		ToBuild:     to.ID,
+		FromCommit:  from.CommitSHA,
+		ToCommit:    to.CommitSHA,
+		Commits:     []ReleaseCommit{},
+		Issues:      []string{},
+		GeneratedAt: time.Now().UTC(),
+		baseURL:     bs.links.Base(project.Org),
+	}
+
+	seenCommits := map[string]bool{from.CommitSHA: true}
+	seenIssues := make(map[string]bool)
+	for _, build := range builds {
+		notes.Builds++
+		if build.Status == "failed" || build.Status == "timeout" {
+			notes.FailedBuilds++
+		}
+		if build.Status != "success" {
+			continue
+		}
+
+		if build.CommitSHA != "" && !seenCommits[build.CommitSHA] {
+			seenCommits[build.CommitSHA] = true
+			notes.Commits = append(notes.Commits, ReleaseCommit{SHA: build.CommitSHA, Branch: build.Branch, BuildID: build.ID})
+		}
+
+		keys, err := bs.db.ListBuildIssues(build.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			if !seenIssues[key] {
+				seenIssues[key] = true
+				notes.Issues = append(notes.Issues, key)
+			}
+		}
+	}
+	sort.Strings(notes.Issues)
+
+	if notes.Artifacts, err = bs.db.ListArtifacts(to.ID); err != nil {
+		return nil, err
+	}
+
+	return notes, nil
+}
+
+// Markdown renders the release notes as a markdown document
+func (rn *ReleaseNotes) Markdown() string {
+	var b strings.Builder
+	base := rn.baseURL
+	if base == "" {
+		base = publicBaseURL()
+	}
+
+	fmt.Fprintf(&b, "# %s release notes\n\n", rn.Project)
+	fmt.Fprintf(&b, "Changes from %s to %s", releaseRefName(rn.From), releaseRefName(rn.To))
+	if rn.FromCommit != "" && rn.ToCommit != "" {
+		fmt.Fprintf(&b, " (`%s..%s`)", shortSHA(rn.FromCommit), shortSHA(rn.ToCommit))
+	}
+	fmt.Fprintf(&b, ", %d builds, %d failed.\n", rn.Builds, rn.FailedBuilds)
+
+	b.WriteString("\n## Issues\n\n")
+	if len(rn.Issues) == 0 {
+		b.WriteString("_No linked issues._\n")
+	}
+	for _, key := range rn.Issues {
+		fmt.Fprintf(&b, "- %s\n", key)
+	}
+
+	b.WriteString("\n## Commits\n\n")
+	if len(rn.Commits) == 0 {
+		b.WriteString("_No successfully built commits._\n")
+	}
+	for _, commit := range rn.Commits {
+		fmt.Fprintf(&b, "- `%s` on %s ([build #%d](%s))\n", shortSHA(commit.SHA), commit.Branch, commit.BuildID, fmt.Sprintf("%s/api/v1/builds/%d", base, commit.BuildID))
+	}
+
+	if len(rn.Artifacts) > 0 {
+		b.WriteString("\n## Artifacts\n\n")
+	}
+	for _, artifact := range rn.Artifacts {
+		fmt.Fprintf(&b, "- [%s](%s/api/v1/builds/%d/artifacts/%s) (%d bytes, sha256 `%s`)\n", artifact.Name, base, artifact.BuildID, artifact.Name, artifact.Size, artifact.SHA256)
+	}
+
+	return b.String()
+}
+
+// releaseRefName describes a bound of release notes in markdown
+func releaseRefName(ref string) string {
+	if strings.HasPrefix(ref, "#") {
+		return "build " + ref
+	}
+	return "`" + ref + "`"
+}
+
+// shortSHA abbreviates a commit hash for display
+func shortSHA(sha string) string {
+	if len(sha) > 12 {
+		return sha[:12]
+	}
+	return sha
+}
+
+// refTag returns the tag a release notes bound names, or "" for a build
+func refTag(ref string) string {
+	if strings.HasPrefix(ref, "#") {
+		return ""
+	}
+	return ref
+}
+
+// resolveReleaseRef finds the build a release notes bound refers to: the
+// build given as "#42", or the latest successful build of a tag. It returns
+// the status to respond with when it can't.
+func (bs *BuildService) resolveReleaseRef(project *Project, ref string) (*BuildRequest, int, error) {
+	if tag := refTag(ref); tag != "" {
+		build, err := bs.db.GetTagBuild(project.Name, tag)
+		if err != nil {
+			if err.Error() == "build not found" {
+				return nil, http.StatusNotFound, fmt.Errorf("No successful build of tag %s", tag)
+			}
+			return nil, http.StatusInternalServerError, err
+		}
+		return build, http.StatusOK, nil
+	}
+
+	buildID, err := strconv.Atoi(strings.TrimPrefix(ref, "#"))
+	if err != nil || buildID <= 0 {
+		return nil, http.StatusBadRequest, fmt.Errorf("Invalid build %s", ref)
+	}
+	build, err := bs.db.GetBuild(buildID)
+	if err != nil {
+		if err.Error() == "build not found" {
+			return nil, http.StatusNotFound, fmt.Errorf("Build %d not found", buildID)
+		}
+		return nil, http.StatusInternalServerError, err
+	}
+	if build.ProjectName != project.Name {
+		return nil, http.StatusBadRequest, fmt.Errorf("Build %d does not belong to project %s", buildID, project.Name)
+	}
+	return build, http.StatusOK, nil
+}
+
+// Release notes endpoint
+func (bs *BuildService) releaseNotesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	var req ReleaseNotesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.Format == "" {
+		req.Format = "json"
+	}
+	if req.Format != "json" && req.Format != "markdown" {
+		http.Error(w, "format must be json or markdown", http.StatusBadRequest)
+		return
+	}
+	if req.From == "" && req.FromBuild > 0 {
+		req.From = "#" + strconv.Itoa(req.FromBuild)
+	}
+	if req.To == "" && req.ToBuild > 0 {
+		req.To = "#" + strconv.Itoa(req.ToBuild)
+	}
+	if req.From == "" || req.To == "" {
+		http.Error(w, "from and to are required", http.StatusBadRequest)
+		return
+	}
+	if req.FromBuild > 0 && req.ToBuild > 0 && req.ToBuild <= req.FromBuild {
+		http.Error(w, "to must be newer than from", http.StatusBadRequest)
+		return
+	}
+
+	project, err := bs.db.GetProject(id)
+	if err != nil {
+		if err.Error() == "project not found" {
+			http.Error(w, "Project not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error getting project: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	var bounds [2]*BuildRequest
+	for i, ref := range []string{req.From, req.To} {
+		build, status, err := bs.resolveReleaseRef(project, ref)
+		if err != nil {
+			if status == http.StatusInternalServerError {
+				log.Printf("Error resolving release notes bound %q: %v", ref, err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		bounds[i] = build
+	}
+	if bounds[1].ID <= bounds[0].ID {
+		http.Error(w, "to must be newer than from", http.StatusBadRequest)
+		return
+	}
+
+	notes, err := bs.compileReleaseNotes(project, req.From, req.To, bounds[0], bounds[1])
+	if err != nil {
+		log.Printf("Error compiling release notes: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if req.Format == "markdown" {
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+		w.Write([]byte(notes.Markdown()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(notes)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReleaseNotesHandler(t *testing.T) {
+	project := &Project{ID: 1, Name: "api"}
+	from := &BuildRequest{ID: 10, ProjectName: "api", Status: "success"}
+	to := &BuildRequest{ID: 14, ProjectName: "api", Status: "success"}
+	builds := []*BuildRequest{
+		{ID: 11, ProjectName: "api", Branch: "main", CommitSHA: "aaaaaaaaaaaaaaaaaaaa", Status: "success"},
+		{ID: 12, ProjectName: "api", Branch: "main", CommitSHA: "bbbbbbbbbbbbbbbbbbbb", Status: "failed"},
+		{ID: 13, ProjectName: "api", Branch: "main", CommitSHA: "aaaaaaaaaaaaaaaaaaaa", Status: "success"},
+		{ID: 14, ProjectName: "api", Branch: "main", CommitSHA: "cccccccccccccccccccc", Status: "success"},
+	}
+
+	tests := []struct {
+		name           string
+		body           string
+		setupMock      func(*MockDatabase)
+		expectedStatus int
+		check          func(*testing.T, *httptest.ResponseRecorder)
+	}{
+		{
+			name: "json",
+			body: `{"from_build":10,"to_build":14}`,
+			setupMock: func(m *MockDatabase) {
+				m.On("GetProject", 1).Return(project, nil)
+				m.On("GetBuild", 10).Return(from, nil)
+				m.On("GetBuild", 14).Return(to, nil)
+				m.On("ListProjectBuildsBetween", "api", 10, 14).Return(builds, nil)
+				m.On("ListBuildIssues", 11).Return([]string{"PROJ-2"}, nil)
+				m.On("ListBuildIssues", 13).Return([]string{"PROJ-2"}, nil)
+				m.On("ListBuildIssues", 14).Return([]string{"PROJ-1"}, nil)
+				m.On("ListArtifacts", 14).Return([]*Artifact{}, nil)
+			},
+			expectedStatus: http.StatusOK,
+			check: func(t *testing.T, w *httptest.ResponseRecorder) {
+				var notes ReleaseNotes
+				require.NoError(t, json.NewDecoder(w.Body).Decode(&notes))
+				assert.Equal(t, []string{"PROJ-1", "PROJ-2"}, notes.Issues)
+				require.Len(t, notes.Commits, 2)
+				assert.Equal(t, 11, notes.Commits[0].BuildID)
+				assert.Equal(t, 14, notes.Commits[1].BuildID)
+				assert.Equal(t, 4, notes.Builds)
+				assert.Equal(t, 1, notes.FailedBuilds)
+			},
+		},
+		{
+			name: "markdown",
+			body: `{"from_build":10,"to_build":14,"format":"markdown"}`,
+			setupMock: func(m *MockDatabase) {
+				m.On("GetProject", 1).Return(project, nil)
+				m.On("GetBuild", 10).Return(from, nil)
+				m.On("GetBuild", 14).Return(to, nil)
+				m.On("ListProjectBuildsBetween", "api", 10, 14).Return(builds[3:], nil)
+				m.On("ListBuildIssues", 14).Return([]string{"PROJ-1"}, nil)
+				m.On("ListArtifacts", 14).Return([]*Artifact{{BuildID: 14, Name: "app.tar.gz", Size: 10}}, nil)
+			},
+			expectedStatus: http.StatusOK,
+			check: func(t *testing.T, w *httptest.ResponseRecorder) {
+				assert.Contains(t, w.Body.String(), "[app.tar.gz](http://localhost:8080/api/v1/builds/14/artifacts/app.tar.gz)")
+				assert.Contains(t, w.Header().Get("Content-Type"), "text/markdown")
+				assert.Contains(t, w.Body.String(), "- PROJ-1")
+				assert.Contains(t, w.Body.String(), "`cccccccccccc` on main")
+			},
+		},
+		{
+			name: "tag to tag",
+			body: `{"from":"v1.0.0","to":"v1.1.0","format":"markdown"}`,
+			setupMock: func(m *MockDatabase) {
+				m.On("GetProject", 1).Return(project, nil)
+				m.On("GetTagBuild", "api", "v1.0.0").Return(&BuildRequest{ID: 10, ProjectName: "api", Tag: "v1.0.0", CommitSHA: "aaaaaaaaaaaaaaaaaaaa", Status: "success"}, nil)
+				m.On("GetTagBuild", "api", "v1.1.0").Return(&BuildRequest{ID: 15, ProjectName: "api", Tag: "v1.1.0", CommitSHA: "cccccccccccccccccccc", Status: "success"}, nil)
+				m.On("ListProjectBuildsBetween", "api", 10, 15).Return(append(builds, &BuildRequest{ID: 15, ProjectName: "api", Tag: "v1.1.0", CommitSHA: "cccccccccccccccccccc", Status: "success"}), nil)
+				m.On("ListBuildIssues", 11).Return([]string{}, nil)
+				m.On("ListBuildIssues", 13).Return([]string{}, nil)
+				m.On("ListBuildIssues", 14).Return([]string{"PROJ-1"}, nil)
+				m.On("ListBuildIssues", 15).Return([]string{"PROJ-1"}, nil)
+				m.On("ListArtifacts", 15).Return([]*Artifact{}, nil)
+			},
+			expectedStatus: http.StatusOK,
+			check: func(t *testing.T, w *httptest.ResponseRecorder) {
+				body := w.Body.String()
+				assert.Contains(t, body, "Changes from `v1.0.0` to `v1.1.0` (`aaaaaaaaaaaa..cccccccccccc`), 5 builds, 1 failed.")
+				// v1.0.0 was built from aaaa, so only cccc is new
+				assert.NotContains(t, body, "`aaaaaaaaaaaa` on")
+				assert.Contains(t, body, "`cccccccccccc` on main ([build #14]")
+				assert.Contains(t, body, "- PROJ-1")
+			},
+		},
+		{
+			name: "tag to build",
+			body: `{"from":"v1.0.0","to":"#14"}`,
+			setupMock: func(m *MockDatabase) {
+				m.On("GetProject", 1).Return(project, nil)
+				m.On("GetTagBuild", "api", "v1.0.0").Return(from, nil)
+				m.On("GetBuild", 14).Return(to, nil)
+				m.On("ListProjectBuildsBetween", "api", 10, 14).Return(builds[3:], nil)
+				m.On("ListBuildIssues", 14).Return([]string{}, nil)
+				m.On("ListArtifacts", 14).Return([]*Artifact{}, nil)
+			},
+			expectedStatus: http.StatusOK,
+			check: func(t *testing.T, w *httptest.ResponseRecorder) {
+				var notes ReleaseNotes
+				require.NoError(t, json.NewDecoder(w.Body).Decode(&notes))
+				assert.Equal(t, "v1.0.0", notes.From)
+				assert.Equal(t, "#14", notes.To)
+				assert.Equal(t, 10, notes.FromBuild)
+				assert.Equal(t, 14, notes.ToBuild)
+			},
+		},
+		{
+			name: "tag never built",
+			body: `{"from":"v0.9.0","to":"v1.0.0"}`,
+			setupMock: func(m *MockDatabase) {
+				m.On("GetProject", 1).Return(project, nil)
+				m.On("GetTagBuild", "api", "v0.9.0").Return(nil, fmt.Errorf("build not found"))
+			},
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name: "tags out of order",
+			body: `{"from":"v1.1.0","to":"v1.0.0"}`,
+			setupMock: func(m *MockDatabase) {
+				m.On("GetProject", 1).Return(project, nil)
+				m.On("GetTagBuild", "api", "v1.1.0").Return(to, nil)
+				m.On("GetTagBuild", "api", "v1.0.0").Return(from, nil)
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name: "invalid build ref",
+			body: `{"from":"#first","to":"v1.0.0"}`,
+			setupMock: func(m *MockDatabase) {
+				m.On("GetProject", 1).Return(project, nil)
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "missing bound",
+			body:           `{"from":"v1.0.0"}`,
+			setupMock:      func(m *MockDatabase) {},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "invalid range",
+			body:           `{"from_build":14,"to_build":10}`,
+			setupMock:      func(m *MockDatabase) {},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "invalid format",
+			body:           `{"from_build":10,"to_build":14,"format":"pdf"}`,
+			setupMock:      func(m *MockDatabase) {},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name: "build from another project",
+			body: `{"from_build":10,"to_build":14}`,
+			setupMock: func(m *MockDatabase) {
+				m.On("GetProject", 1).Return(project, nil)
+				m.On("GetBuild", 10).Return(&BuildRequest{ID: 10, ProjectName: "web"}, nil)
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name: "build not found",
+			body: `{"from_build":10,"to_build":14}`,
+			setupMock: func(m *MockDatabase) {
+				m.On("GetProject", 1).Return(project, nil)
+				m.On("GetBuild", 10).Return(from, nil)
+				m.On("GetBuild", 14).Return(nil, fmt.Errorf("build not found"))
+			},
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service, mockDB := setupTestService()
+			tt.setupMock(mockDB)
+
+			router := mux.NewRouter()
+			router.HandleFunc("/api/v1/projects/{id}/release-notes", service.releaseNotesHandler)
+
+			req := httptest.NewRequest("POST", "/api/v1/projects/1/release-notes", strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			if tt.check != nil {
+				tt.check(t, w)
+			}
+			mockDB.AssertExpectations(t)
+		})
+	}
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// schedulerLockID is the advisory lock key held by the instance that runs
+// build schedules
+const schedulerLockID = 7_061_322_946
+
+// BuildSchedule enqueues builds of a project's branch at the times of a cron
+// expression, evaluated in Timezone
+type BuildSchedule struct {
+	ID        int    `json:"id" db:"id"`
+	ProjectID int    `json:"project_id" db:"project_id"`
+	Cron      string `json:"cron" db:"cron"`
+	Timezone  string `json:"timezone" db:"timezone"`
+	Branch    string `json:"branch" db:"branch"`
+	Enabled   bool   `json:"enabled" db:"enabled"`
+	// NextRunAt is when the schedule next enqueues a build, nil when disabled
+	NextRunAt   *time.Time `json:"next_run_at,omitempty" db:"next_run_at"`
+	LastRunAt   *time.Time `json:"last_run_at,omitempty" db:"last_run_at"`
+	LastBuildID *int       `json:"last_build_id,omitempty" db:"last_build_id"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at" db:"updated_at"`
+}
+
+// BuildScheduleUpdate holds the fields of a schedule that can be changed;
+// nil fields are left untouched
+type BuildScheduleUpdate struct {
+	Cron     *string `json:"cron"`
+	Timezone *string `json:"timezone"`
+	Branch   *string `json:"branch"`
+	Enabled  *bool   `json:"enabled"`
+}
+
+// Apply copies the set fields onto schedule
+func (su *BuildScheduleUpdate) Apply(schedule *BuildSchedule) {
+	if su.Cron != nil {
+		schedule.Cron = *su.Cron
+	}
+	if su.Timezone != nil {
+		schedule.Timezone = *su.Timezone
+	}
+	if su.Branch != nil {
+		schedule.Branch = *su.Branch
+	}
+	if su.Enabled != nil {
+		schedule.Enabled = *su.Enabled
+	}
+}
+
+// nextRun returns the first time after t the schedule fires, or an error when
+// its cron expression or time zone is invalid
+func (sc *BuildSchedule) nextRun(t time.Time) (time.Time, error) {
+	cron, err := parseCron(sc.Cron)
+	if err != nil {
+		return time.Time{}, err
+	}
+	location, err := time.LoadLocation(sc.Timezone)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unknown timezone %q", sc.Timezone)
+	}
+
+	next := cron.Next(t.In(location))
+	if next.IsZero() {
+		return next, fmt.Errorf("cron expression %q never fires", sc.Cron)
+	}
+	return next.UTC(), nil
+}
+
+// Validate checks the branch, cron expression and time zone of the schedule
+// and sets when it runs next
+func (sc *BuildSchedule) Validate(now time.Time) error {
+	if strings.HasPrefix(sc.Branch, "-") {
+		return fmt.Errorf("branch must not start with '-'")
+	}
+
+	next, err := sc.nextRun(now)
+	if err != nil {
+		return err
+	}
+	sc.NextRunAt = nil
+	if sc.Enabled {
+		sc.NextRunAt = &next
+	}
+	return nil
+}
+
+// AdvisoryLock is a database lock held until released or until its session
+// is lost
+type AdvisoryLock interface {
+	Held() bool
+	Release()
+}
+
+// BuildScheduler enqueues the builds of due schedules. Only the instance
+// holding the scheduler advisory lock runs schedules, so each run enqueues a
+// single build however many replicas are up; another instance takes over
+// when the leader stops.
+type BuildScheduler struct {
+	db       DatabaseInterface
+	enqueue  func(ctx context.Context, build *BuildRequest) error
+	errors   *ErrorTracker
+	leader   prometheus.Gauge
+	interval time.Duration
+
+	// lock is only used from the scheduler goroutine
+	lock AdvisoryLock
+}
+
+// NewBuildScheduler creates a scheduler checking for due schedules every
+// SCHEDULE_CHECK_INTERVAL
+func NewBuildScheduler(db DatabaseInterface, enqueue func(ctx context.Context, build *BuildRequest) error, errors *ErrorTracker, leader prometheus.Gauge) *BuildScheduler {
+	return &BuildScheduler{
+		db:       db,
+		enqueue:  enqueue,
+		errors:   errors,
+		leader:   leader,
+		interval: getEnvDuration("SCHEDULE_CHECK_INTERVAL", 30*time.Second),
+	}
+}
+
+// Start runs due schedules every interval until ctx is cancelled, then gives
+// up leadership
+func (s *BuildScheduler) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				s.resign()
+				return
+			case <-ticker.C:
+				if s.lead() {
+					s.RunDue(ctx, time.Now().UTC())
+				}
+			}
+		}
+	}()
+}
+
+// lead reports whether this instance is the leader, taking the scheduler
+// lock when it is free
+func (s *BuildScheduler) lead() bool {
+	if s.lock != nil {
+		if s.lock.Held() {
+			return true
+		}
+		log.Printf("Lost the build scheduler lock")
+		s.resign()
+	}
+
+	lock, err := s.db.TryAdvisoryLock(schedulerLockID)
+	if err != nil {
+		s.errors.Capture("scheduler", fmt.Errorf("acquiring scheduler lock: %w", err), nil)
+		return false
+	}
+	if lock == nil {
+		return false
+	}
+
+	log.Printf("Acquired the build scheduler lock, running build schedules")
+	s.lock = lock
+	s.leader.Set(1)
+	return true
+}
+
+func (s *BuildScheduler) resign() {
+	if s.lock != nil {
+		s.lock.Release()
+		s.lock = nil
+	}
+	s.leader.Set(0)
+}
+
+// RunDue enqueues a build for every schedule due at now. Runs missed while no
+// instance was leading are made up with a single build.
+func (s *BuildScheduler) RunDue(ctx context.Context, now time.Time) {
+	schedules, err := s.db.ListDueBuildSchedules(now)
+	if err != nil {
+		s.errors.Capture("scheduler", fmt.Errorf("listing due build schedules: %w", err), nil)
+		return
+	}
+
+	for _, schedule := range schedules {
+		if ctx.Err() != nil {
+			return
+		}
+		s.run(ctx, schedule, now)
+	}
+}
+
+func (s *BuildScheduler) run(ctx context.Context, schedule *BuildSchedule, now time.Time) {
+	// A schedule that can no longer be evaluated is disabled by leaving it
+	// without a next run
+	var next *time.Time
+	if t, err := schedule.nextRun(now); err != nil {
+		s.errors.Capture("scheduler", fmt.Errorf("build schedule %d: %w", schedule.ID, err), nil)
+	} else {
+		next = &t
+	}
+
+	project, err := s.db.GetProject(schedule.ProjectID)
+	if err != nil {
+		s.errors.Capture("scheduler", fmt.Errorf("loading project of build schedule %d: %w", schedule.ID, err), nil)
+		return
+	}
+
+	var buildID *int
+	if project.Paused {
+		log.Printf("Skipping build schedule %d: project %s is paused", schedule.ID, project.Name)
+	} else {
+		build := &BuildRequest{
+			ProjectName:   project.Name,
+			GitURL:        project.GitURL,
+			Branch:        schedule.Branch,
+			AutoVersion:   project.AutoVersion,
+			ScheduleID:    &schedule.ID,
+			TriggerSource: triggerSchedule,
+			Org:           project.Org,
+		}
+		if err := s.enqueue(ctx, build); err != nil {
+			// The schedule stays due and is retried on the next tick
+			s.errors.Capture("scheduler", fmt.Errorf("enqueueing build of schedule %d: %w", schedule.ID, err), nil)
+			return
+		}
+		log.Printf("Build schedule %d enqueued build %d of %s", schedule.ID, build.ID, project.Name)
+		buildID = &build.ID
+	}
+
+	if err := s.db.RecordBuildScheduleRun(schedule.ID, now, buildID, next); err != nil {
+		s.errors.Capture("scheduler", fmt.Errorf("recording run of build schedule %d: %w", schedule.ID, err), nil)
+	}
+}
+
+// Create build schedule endpoint
+func (bs *BuildService) createBuildScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	schedule := BuildSchedule{Timezone: "UTC", Enabled: true}
+	if err := json.NewDecoder(r.Body).Decode(&schedule); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	project, err := bs.db.GetProject(id)
+	if err != nil {
+		if err.Error() == "project not found" {
+			http.Error(w, "Project not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error getting project: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	schedule.ProjectID = project.ID
+	if schedule.Branch == "" {
+		schedule.Branch = project.DefaultBranch
+	}
+	if err := schedule.Validate(time.Now()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := bs.db.CreateBuildSchedule(&schedule); err != nil {
+		if err.Error() == "project not found" {
+			http.Error(w, "Project not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error creating build schedule: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(schedule)
+}
+
+// List build schedules endpoint
+func (bs *BuildService) listBuildSchedulesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	schedules, err := bs.db.ListBuildSchedules(id)
+	if err != nil {
+		log.Printf("Error listing build schedules: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(schedules)
+}
+
+// buildSchedule loads the schedule named in the request path, writing an
+// error response when it can't
+func (bs *BuildService) buildSchedule(w http.ResponseWriter, r *http.Request) (*BuildSchedule, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid build schedule ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	schedule, err := bs.db.GetBuildSchedule(id)
+	if err != nil {
+		if err.Error() == "build schedule not found" {
+			http.Error(w, "Build schedule not found", http.StatusNotFound)
+			return nil, false
+		}
+		log.Printf("Error getting build schedule: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return nil, false
+	}
+	return schedule, true
+}
+
+// Get build schedule endpoint
+func (bs *BuildService) getBuildScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	schedule, ok := bs.buildSchedule(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(schedule)
+}
+
+// Update build schedule endpoint. The next run is recalculated from now.
+func (bs *BuildService) updateBuildScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	var update BuildScheduleUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	schedule, ok := bs.buildSchedule(w, r)
+	if !ok {
+		return
+	}
+
+	update.Apply(schedule)
+	if schedule.Branch == "" {
+		http.Error(w, "branch must not be empty", http.StatusBadRequest)
+		return
+	}
+	if err := schedule.Validate(time.Now()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	schedule.UpdatedAt = time.Now().UTC()
+
+	if err := bs.db.UpdateBuildSchedule(schedule); err != nil {
+		log.Printf("Error updating build schedule: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(schedule)
+}
+
+// Delete build schedule endpoint
+func (bs *BuildService) deleteBuildScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid build schedule ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := bs.db.DeleteBuildSchedule(id); err != nil {
+		if err.Error() == "build schedule not found" {
+			http.Error(w, "Build schedule not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error deleting build schedule: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeAdvisoryLock is held until lost is set
+type fakeAdvisoryLock struct {
+	lost     bool
+	released bool
+}
+
+func (l *fakeAdvisoryLock) Held() bool { return !l.lost }
+func (l *fakeAdvisoryLock) Release()   { l.released = true }
+
+func TestCreateBuildScheduleHandler(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.On("GetProject", 3).Return(&Project{ID: 3, Name: "api", DefaultBranch: "develop"}, nil)
+	mockDB.On("GetProject", 4).Return(nil, fmt.Errorf("project not found"))
+	mockDB.On("CreateBuildSchedule", mock.MatchedBy(func(s *BuildSchedule) bool {
+		return s.ProjectID == 3 && s.Branch == "develop" && s.Timezone == "Europe/Berlin" && s.NextRunAt != nil
+	})).Run(func(args mock.Arguments) {
+		args.Get(0).(*BuildSchedule).ID = 9
+	}).Return(nil).Once()
+
+	create := func(project, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/v1/projects/"+project+"/schedules", bytes.NewBufferString(body))
+		req = mux.SetURLVars(req, map[string]string{"id": project})
+		rr := httptest.NewRecorder()
+		service.createBuildScheduleHandler(rr, req)
+		return rr
+	}
+
+	rr := create("3", `{"cron":"0 2 * * *","timezone":"Europe/Berlin"}`)
+	require.Equal(t, http.StatusCreated, rr.Code)
+	var schedule BuildSchedule
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &schedule))
+	assert.Equal(t, 9, schedule.ID)
+	assert.True(t, schedule.Enabled)
+	require.NotNil(t, schedule.NextRunAt)
+	assert.Equal(t, 2, schedule.NextRunAt.In(mustLoadLocation(t, "Europe/Berlin")).Hour())
+
+	rr = create("3", `{"cron":"0 25 * * *"}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "hour")
+	assert.Equal(t, http.StatusBadRequest, create("3", `{"cron":"@daily","timezone":"Mars/Olympus"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, create("3", `{"cron":"@daily","branch":"--upload-pack=x"}`).Code)
+	assert.Equal(t, http.StatusNotFound, create("4", `{"cron":"@daily"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, create("x", `{"cron":"@daily"}`).Code)
+	mockDB.AssertExpectations(t)
+}
+
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	location, err := time.LoadLocation(name)
+	require.NoError(t, err)
+	return location
+}
+
+func TestUpdateBuildScheduleHandler(t *testing.T) {
+	service, mockDB := setupTestService()
+	next := time.Now().Add(time.Hour)
+	mockDB.On("GetBuildSchedule", 9).Return(&BuildSchedule{ID: 9, ProjectID: 3, Cron: "@daily", Timezone: "UTC", Branch: "main", Enabled: true, NextRunAt: &next}, nil)
+	mockDB.On("GetBuildSchedule", 10).Return(nil, fmt.Errorf("build schedule not found"))
+	mockDB.On("UpdateBuildSchedule", mock.MatchedBy(func(s *BuildSchedule) bool {
+		return s.ID == 9 && !s.Enabled && s.NextRunAt == nil
+	})).Return(nil).Once()
+
+	update := func(id, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PATCH", "/api/v1/schedules/"+id, bytes.NewBufferString(body))
+		req = mux.SetURLVars(req, map[string]string{"id": id})
+		rr := httptest.NewRecorder()
+		service.updateBuildScheduleHandler(rr, req)
+		return rr
+	}
+
+	rr := update("9", `{"enabled":false}`)
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.NotContains(t, rr.Body.String(), "next_run_at")
+
+	assert.Equal(t, http.StatusBadRequest, update("9", `{"cron":"* * *"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, update("9", `{"branch":""}`).Code)
+	assert.Equal(t, http.StatusNotFound, update("10", `{"enabled":false}`).Code)
+	mockDB.AssertExpectations(t)
+}
+
+func TestDeleteBuildScheduleHandler(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.On("DeleteBuildSchedule", 9).Return(nil)
+	mockDB.On("DeleteBuildSchedule", 10).Return(fmt.Errorf("build schedule not found"))
+
+	remove := func(id string) int {
+		req := mux.SetURLVars(httptest.NewRequest("DELETE", "/api/v1/schedules/"+id, nil), map[string]string{"id": id})
+		rr := httptest.NewRecorder()
+		service.deleteBuildScheduleHandler(rr, req)
+		return rr.Code
+	}
+
+	assert.Equal(t, http.StatusNoContent, remove("9"))
+	assert.Equal(t, http.StatusNotFound, remove("10"))
+	assert.Equal(t, http.StatusBadRequest, remove("x"))
+}
+
+func TestBuildSchedulerRunDue(t *testing.T) {
+	service, mockDB := setupTestService()
+	now := time.Date(2030, 1, 2, 2, 0, 10, 0, time.UTC)
+	due := now.Add(-10 * time.Second)
+	mockDB.On("ListDueBuildSchedules", now).Return([]*BuildSchedule{
+		{ID: 9, ProjectID: 3, Cron: "0 2 * * *", Timezone: "UTC", Branch: "nightly", Enabled: true, NextRunAt: &due},
+		{ID: 10, ProjectID: 4, Cron: "0 2 * * *", Timezone: "UTC", Branch: "main", Enabled: true, NextRunAt: &due},
+	}, nil)
+	mockDB.On("GetProject", 3).Return(&Project{ID: 3, Name: "api", GitURL: "https://github.com/acme/api.git"}, nil)
+	mockDB.On("GetProject", 4).Return(&Project{ID: 4, Name: "web", Paused: true}, nil)
+	mockDB.On("CreateBuild", mock.MatchedBy(func(b *BuildRequest) bool {
+		return b.ProjectName == "api" && b.Branch == "nightly" && b.ScheduleID != nil && *b.ScheduleID == 9 && b.TriggerSource == triggerSchedule
+	})).Return(21, nil).Once()
+
+	tomorrow := time.Date(2030, 1, 3, 2, 0, 0, 0, time.UTC)
+	mockDB.On("RecordBuildScheduleRun", 9, now, mock.MatchedBy(func(id *int) bool { return id != nil && *id == 21 }), &tomorrow).Return(nil).Once()
+	// Paused projects' runs are skipped without a build
+	mockDB.On("RecordBuildScheduleRun", 10, now, (*int)(nil), &tomorrow).Return(nil).Once()
+
+	service.schedules.RunDue(context.Background(), now)
+	assert.Len(t, service.queue.wake, 1)
+	mockDB.AssertExpectations(t)
+}
+
+func TestBuildSchedulerLeadership(t *testing.T) {
+	service, mockDB := setupTestService()
+	scheduler := service.schedules
+
+	mockDB.On("TryAdvisoryLock", int64(schedulerLockID)).Return(nil, nil).Once()
+	assert.False(t, scheduler.lead())
+	assert.Equal(t, 0.0, testutil.ToFloat64(service.metrics.SchedulerLeader))
+
+	lock := &fakeAdvisoryLock{}
+	mockDB.On("TryAdvisoryLock", int64(schedulerLockID)).Return(lock, nil).Once()
+	assert.True(t, scheduler.lead())
+	assert.True(t, scheduler.lead())
+	assert.Equal(t, 1.0, testutil.ToFloat64(service.metrics.SchedulerLeader))
+
+	// Another instance may have taken over once the session is gone
+	lock.lost = true
+	mockDB.On("TryAdvisoryLock", int64(schedulerLockID)).Return(nil, nil).Once()
+	assert.False(t, scheduler.lead())
+	assert.True(t, lock.released)
+	assert.Equal(t, 0.0, testutil.ToFloat64(service.metrics.SchedulerLeader))
+
+	mockDB.On("TryAdvisoryLock", int64(schedulerLockID)).Return(nil, fmt.Errorf("connection refused")).Once()
+	assert.False(t, scheduler.lead())
+	assert.Equal(t, 1.0, testutil.ToFloat64(service.metrics.BackgroundErrors.WithLabelValues("scheduler")))
+	mockDB.AssertExpectations(t)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxSecretBytes caps the size of a secret value
+const maxSecretBytes = 64 << 10
+
+// errSecretsDisabled is returned when a secret is stored without a credential
+// keyring, which would leave it unencrypted
+var errSecretsDisabled = errors.New("secrets require CREDENTIAL_KEYS")
+
+// secretMask replaces secret values in build output
+const secretMask = "***"
+
+// ProjectSecret is a credential injected into the environment of a project's
+// builds. Its value is encrypted at rest and never returned by the API.
+type ProjectSecret struct {
+	ID        int    `json:"id"`
+	ProjectID int    `json:"project_id"`
+	Name      string `json:"name"`
+	Value     string `json:"-"`
+	// Version counts the values the secret has had, starting at 1
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ProjectSecretRequest sets the value of a secret
+type ProjectSecretRequest struct {
+	Value string `json:"value"`
+}
+
+// reservedSecretName reports whether a variable is set by the service
+// itself, so a secret can't replace it
+func reservedSecretName(name string) bool {
+	switch name {
+	case "BUILD_VERSION", "TRACEPARENT", "OTEL_EXPORTER_OTLP_ENDPOINT", "OTEL_EXPORTER_OTLP_PROTOCOL":
+		return true
+	}
+	for _, kv := range sandboxEnv("", nil) {
+		if strings.HasPrefix(kv, name+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// secretEnv returns the secrets as environment variables, in name order
+func secretEnv(secrets map[string]string) []string {
+	env := make([]string, 0, len(secrets))
+	for name, value := range secrets {
+		env = append(env, name+"="+value)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// secretMasker replaces the secrets' values in build output. Values are
+// masked longest first, so a secret containing another is masked whole.
+func secretMasker(secrets map[string]string) *strings.Replacer {
+	values := make([]string, 0, len(secrets))
+	for _, value := range secrets {
+		if value != "" {
+			values = append(values, value)
+		}
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+
+	pairs := make([]string, 0, 2*len(values))
+	for _, value := range values {
+		pairs = append(pairs, value, secretMask)
+	}
+	return strings.NewReplacer(pairs...)
+}
+
+// buildSecrets loads the secrets of the build's project for its environment
+func (bs *BuildService) buildSecrets(project *Project) (map[string]string, error) {
+	secrets, err := bs.db.ListProjectSecrets(project.ID)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(secrets))
+	for _, secret := range secrets {
+		// The commit status token is the service's, not the build's
+		if secret.Name != commitStatusTokenSecret {
+			values[secret.Name] = secret.Value
+		}
+	}
+	return values, nil
+}
+
+// List project secrets endpoint. Returns names and versions, never values.
+func (bs *BuildService) listProjectSecretsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	secrets, err := bs.db.ListProjectSecrets(id)
+	if err != nil {
+		log.Printf("Error listing project secrets: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(secrets)
+}
+
+// Set project secret endpoint. Creates the secret, or rotates it to a new
+// value with the next version.
+func (bs *BuildService) setProjectSecretHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+	name := vars["name"]
+	if !envNamePattern.MatchString(name) || len(name) > 255 {
+		http.Error(w, "Secret names must be environment variable names", http.StatusBadRequest)
+		return
+	}
+	if reservedSecretName(name) {
+		http.Error(w, fmt.Sprintf("%s is set by the build service", name), http.StatusBadRequest)
+		return
+	}
+
+	var req ProjectSecretRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 2*maxSecretBytes)).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Value == "" || len(req.Value) > maxSecretBytes {
+		http.Error(w, fmt.Sprintf("value must be between 1 and %d bytes", maxSecretBytes), http.StatusBadRequest)
+		return
+	}
+
+	if _, err := bs.db.GetProject(id); err != nil {
+		if err.Error() == "project not found" {
+			http.Error(w, "Project not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error getting project: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	secret := &ProjectSecret{ProjectID: id, Name: name, Value: req.Value}
+	if err := bs.db.SetProjectSecret(secret); err != nil {
+		if errors.Is(err, errSecretsDisabled) {
+			http.Error(w, "Secrets require CREDENTIAL_KEYS to be configured", http.StatusServiceUnavailable)
+			return
+		}
+		log.Printf("Error setting project secret: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if secret.Version == 1 {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(secret)
+}
+
+// Delete project secret endpoint
+func (bs *BuildService) deleteProjectSecretHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := bs.db.DeleteProjectSecret(id, vars["name"]); err != nil {
+		if err.Error() == "project secret not found" {
+			http.Error(w, "Secret not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error deleting project secret: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// secretsRouter routes the project secret endpoints
+func secretsRouter(service *BuildService) *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/projects/{id}/secrets", service.listProjectSecretsHandler).Methods("GET")
+	router.HandleFunc("/api/v1/projects/{id}/secrets/{name}", service.setProjectSecretHandler).Methods("PUT")
+	router.HandleFunc("/api/v1/projects/{id}/secrets/{name}", service.deleteProjectSecretHandler).Methods("DELETE")
+	return router
+}
+
+func TestSetProjectSecretHandler(t *testing.T) {
+	service, mockDB := setupTestService()
+	router := secretsRouter(service)
+	mockDB.On("GetProject", 4).Return(&Project{ID: 4, Name: "api"}, nil)
+	mockDB.On("GetProject", 5).Return(nil, fmt.Errorf("project not found"))
+	mockDB.On("SetProjectSecret", mock.MatchedBy(func(s *ProjectSecret) bool { return s.Name == "DEPLOY_KEY" })).Run(func(args mock.Arguments) {
+		args.Get(0).(*ProjectSecret).Version = 1
+	}).Return(nil).Once()
+	mockDB.On("SetProjectSecret", mock.MatchedBy(func(s *ProjectSecret) bool { return s.Name == "NPM_TOKEN" })).Run(func(args mock.Arguments) {
+		args.Get(0).(*ProjectSecret).Version = 2
+	}).Return(nil).Once()
+	mockDB.On("SetProjectSecret", mock.MatchedBy(func(s *ProjectSecret) bool { return s.Name == "PLAIN" })).Return(errSecretsDisabled).Once()
+
+	put := func(path, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("PUT", path, bytes.NewBufferString(body)))
+		return rr
+	}
+
+	rr := put("/api/v1/projects/4/secrets/DEPLOY_KEY", `{"value": "hunter2"}`)
+	require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	assert.Contains(t, rr.Body.String(), `"name":"DEPLOY_KEY"`)
+	assert.NotContains(t, rr.Body.String(), "hunter2", "values are never returned")
+
+	rr = put("/api/v1/projects/4/secrets/NPM_TOKEN", `{"value": "rotated"}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"version":2`)
+
+	rr = put("/api/v1/projects/4/secrets/PLAIN", `{"value": "x"}`)
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+
+	for path, body := range map[string]string{
+		"/api/v1/projects/4/secrets/1BAD":        `{"value": "x"}`,
+		"/api/v1/projects/4/secrets/NOT-VALID":   `{"value": "x"}`,
+		"/api/v1/projects/4/secrets/PATH":        `{"value": "/tmp"}`,
+		"/api/v1/projects/4/secrets/TRACEPARENT": `{"value": "x"}`,
+		"/api/v1/projects/4/secrets/EMPTY":       `{"value": ""}`,
+		"/api/v1/projects/4/secrets/BROKEN":      `{`,
+		"/api/v1/projects/x/secrets/TOKEN":       `{"value": "x"}`,
+	} {
+		assert.Equal(t, http.StatusBadRequest, put(path, body).Code, path)
+	}
+	assert.Equal(t, http.StatusNotFound, put("/api/v1/projects/5/secrets/TOKEN", `{"value": "x"}`).Code)
+	mockDB.AssertExpectations(t)
+}
+
+func TestListAndDeleteProjectSecrets(t *testing.T) {
+	service, mockDB := setupTestService()
+	router := secretsRouter(service)
+	mockDB.ExpectedCalls = nil
+	mockDB.On("ListProjectSecrets", 4).Return([]*ProjectSecret{{ID: 1, ProjectID: 4, Name: "DEPLOY_KEY", Value: "hunter2", Version: 3}}, nil).Once()
+	mockDB.On("DeleteProjectSecret", 4, "DEPLOY_KEY").Return(nil).Once()
+	mockDB.On("DeleteProjectSecret", 4, "MISSING").Return(fmt.Errorf("project secret not found")).Once()
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/projects/4/secrets", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"version":3`)
+	assert.NotContains(t, rr.Body.String(), "hunter2")
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("DELETE", "/api/v1/projects/4/secrets/DEPLOY_KEY", nil))
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("DELETE", "/api/v1/projects/4/secrets/MISSING", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	mockDB.AssertExpectations(t)
+}
+
+func TestSecretMasker(t *testing.T) {
+	assert.Nil(t, secretMasker(nil))
+	masker := secretMasker(map[string]string{"SHORT": "abc", "LONG": "abcdef", "EMPTY": ""})
+	assert.Equal(t, "token *** and ***!", masker.Replace("token abcdef and abc!"))
+
+	tb := &tailBuffer{limit: 64, mask: masker}
+	n, err := tb.Write([]byte("key=abcdef\n"))
+	require.NoError(t, err)
+	assert.Equal(t, 11, n, "the bytes given are reported written")
+	assert.Equal(t, "key=***\n", string(tb.Bytes()))
+
+	assert.Equal(t, []string{"A=1", "B=2"}, secretEnv(map[string]string{"B": "2", "A": "1"}))
+}
+
+func TestLocalExecutorInjectsSecrets(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	if _, err := exec.LookPath("make"); err != nil {
+		t.Skip("make not installed")
+	}
+
+	repo := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(repo, "Makefile"), []byte("all:\n\t@echo \"key is $$DEPLOY_KEY\"\n\t@test \"$$DEPLOY_KEY\" = hunter2\n"), 0o644))
+	for _, args := range [][]string{
+		{"init", "-q", "-b", "main"},
+		{"add", "Makefile"},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "init"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repo
+		require.NoError(t, cmd.Run())
+	}
+
+	executor := NewLocalExecutor(t.TempDir())
+	executor.AllowedProtocols = append(executor.AllowedProtocols, "file")
+	result, err := executor.Execute(context.Background(), &BuildRequest{
+		ID:          1,
+		ProjectName: "test-project",
+		GitURL:      "file://" + repo,
+		Branch:      "main",
+		Secrets:     map[string]string{"DEPLOY_KEY": "hunter2"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "success", result.Status)
+	assert.Contains(t, string(result.Output), "key is ***")
+	assert.NotContains(t, string(result.Output), "hunter2")
+	require.Len(t, result.Stages, 2)
+	assert.NotContains(t, result.Stages[1].Log, "hunter2")
+}
+
+func TestProcessBuildSecretsOnlyForProjectRepository(t *testing.T) {
+	tests := []struct {
+		name    string
+		gitURL  string
+		secrets map[string]string
+	}{
+		{"project repository", "git@github.com:acme/api.git", map[string]string{"DEPLOY_KEY": "hunter2"}},
+		{"foreign repository", "https://github.com/mallory/api.git", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service, mockDB := setupTestService()
+			mockDB.ExpectedCalls = nil
+			mockDB.On("ListWebhookSubscriptions").Return([]*WebhookSubscription{}, nil).Maybe()
+			mockDB.On("ListOrganizations").Return([]*Organization{}, nil).Maybe()
+			mockDB.On("GetImagePolicy", mock.Anything).Return(nil, fmt.Errorf("image policy not found")).Maybe()
+			mockDB.On("GetProjectByName", "api").Return(&Project{ID: 3, Name: "api", GitURL: "https://github.com/acme/api.git"}, nil)
+			mockDB.On("ListProjectSecrets", 3).Return([]*ProjectSecret{{Name: "DEPLOY_KEY", Value: "hunter2"}}, nil).Maybe()
+			mockDB.On("ReleaseBuild", 1).Return(nil)
+			builds := make(chan BuildRequest, 1)
+			service.executor = &fixedExecutor{err: context.Canceled, builds: builds}
+
+			// Interrupted before recording a result, which isn't of interest here
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			service.processBuild(ctx, &BuildRequest{ID: 1, ProjectName: "api", GitURL: tt.gitURL, Branch: "main", Status: "running"})
+
+			build := <-builds
+			assert.Equal(t, tt.secrets, build.Secrets)
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+)
+
+// semverPattern matches a semantic version with an optional "v" prefix
+var semverPattern = regexp.MustCompile(`^v?(0|[1-9]\d*)\.(0|[1-9]\d*)\.(0|[1-9]\d*)(?:-([0-9A-Za-z-]+(?:\.[0-9A-Za-z-]+)*))?(?:\+([0-9A-Za-z-]+(?:\.[0-9A-Za-z-]+)*))?$`)
+
+// Version is a parsed semantic version
+type Version struct {
+	Major      int
+	Minor      int
+	Patch      int
+	Prerelease string
+	Metadata   string
+}
+
+// parseSemver parses a tag such as "v1.2.3" or "1.2.3-rc.1+build.5"
+func parseSemver(tag string) (*Version, error) {
+	m := semverPattern.FindStringSubmatch(tag)
+	if m == nil {
+		return nil, fmt.Errorf("%q is not a semantic version", tag)
+	}
+
+	v := &Version{Prerelease: m[4], Metadata: m[5]}
+	v.Major, _ = strconv.Atoi(m[1])
+	v.Minor, _ = strconv.Atoi(m[2])
+	v.Patch, _ = strconv.Atoi(m[3])
+	return v, nil
+}
+
+// String formats the version without a "v" prefix
+func (v *Version) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if v.Prerelease != "" {
+		s += "-" + v.Prerelease
+	}
+	if v.Metadata != "" {
+		s += "+" + v.Metadata
+	}
+	return s
+}
+
+// tagVersion returns the semantic version named by a tag, or "" when the tag
+// is not a semantic version
+func tagVersion(tag string) string {
+	v, err := parseSemver(tag)
+	if err != nil {
+		return ""
+	}
+	return v.String()
+}
+
+// validTagPattern reports whether pattern is a well-formed glob
+func validTagPattern(pattern string) bool {
+	_, err := path.Match(pattern, "")
+	return err == nil
+}
+
+// matchTagPattern reports whether tag matches a glob pattern such as
+// "v*.*.*". An empty pattern matches nothing.
+func matchTagPattern(pattern, tag string) bool {
+	if pattern == "" || tag == "" {
+		return false
+	}
+	matched, err := path.Match(pattern, tag)
+	return err == nil && matched
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSemver(t *testing.T) {
+	v, err := parseSemver("v1.2.3-rc.1+build.5")
+	require.NoError(t, err)
+	assert.Equal(t, &Version{Major: 1, Minor: 2, Patch: 3, Prerelease: "rc.1", Metadata: "build.5"}, v)
+	assert.Equal(t, "1.2.3-rc.1+build.5", v.String())
+
+	for _, tag := range []string{"1.2", "v01.2.3", "release-1.2.3", "v1.2.3-", "nightly"} {
+		_, err := parseSemver(tag)
+		assert.Error(t, err, tag)
+	}
+}
+
+func TestTagVersion(t *testing.T) {
+	assert.Equal(t, "2.0.0", tagVersion("v2.0.0"))
+	assert.Equal(t, "", tagVersion("nightly"))
+	assert.Equal(t, "", tagVersion(""))
+}
+
+func TestMatchTagPattern(t *testing.T) {
+	assert.True(t, matchTagPattern("v*.*.*", "v1.2.3"))
+	assert.True(t, matchTagPattern("*", "nightly"))
+	assert.False(t, matchTagPattern("v*.*.*", "nightly"))
+	assert.False(t, matchTagPattern("", "v1.2.3"))
+	assert.False(t, matchTagPattern("v*", ""))
+
+	assert.True(t, validTagPattern("release-[0-9]*"))
+	assert.False(t, validTagPattern("release-[0-9"))
+}
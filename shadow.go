@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// shadowHistory is the number of recent comparisons kept for the admin report
+const shadowHistory = 100
+
+// ShadowComparison compares a build's recorded outcome with its shadow run
+type ShadowComparison struct {
+	BuildID         int       `json:"build_id"`
+	ProjectName     string    `json:"project_name"`
+	Outcome         string    `json:"outcome"`
+	PrimaryStatus   string    `json:"primary_status"`
+	ShadowStatus    string    `json:"shadow_status,omitempty"`
+	PrimaryExitCode int       `json:"primary_exit_code"`
+	ShadowExitCode  int       `json:"shadow_exit_code"`
+	PrimarySeconds  float64   `json:"primary_seconds"`
+	ShadowSeconds   float64   `json:"shadow_seconds"`
+	ShadowError     string    `json:"shadow_error,omitempty"`
+	ComparedAt      time.Time `json:"compared_at"`
+}
+
+// ShadowReport summarises the shadow executor's comparisons since startup
+type ShadowReport struct {
+	Executor   string             `json:"executor"`
+	SampleRate float64            `json:"sample_rate"`
+	Outcomes   map[string]int64   `json:"outcomes"`
+	Recent     []ShadowComparison `json:"recent"`
+}
+
+// shadowRun is the outcome of one executor's run of a build
+type shadowRun struct {
+	result   *BuildResult
+	err      error
+	duration time.Duration
+}
+
+// ShadowExecutor runs builds on the primary executor and, for a sample of
+// them, also on a shadow executor whose results are only compared, never
+// recorded. It lets a new backend be validated against production traffic.
+type ShadowExecutor struct {
+	primary    Executor
+	shadow     Executor
+	name       string
+	sampleRate float64
+	timeout    time.Duration
+	errors     *ErrorTracker
+	outcomes   *prometheus.CounterVec
+	ratio      prometheus.Histogram
+
+	mu      sync.Mutex
+	counts  map[string]int64
+	history []ShadowComparison
+}
+
+// NewShadowExecutorFromEnv wraps primary with the executor named in
+// SHADOW_EXECUTOR, or returns nil when no shadow executor is configured
+func NewShadowExecutorFromEnv(primary Executor, errors *ErrorTracker, outcomes *prometheus.CounterVec, ratio prometheus.Histogram) *ShadowExecutor {
+	name := os.Getenv("SHADOW_EXECUTOR")
+	if name == "" {
+		return nil
+	}
+
+	sampleRate := 0.1
+	if value := os.Getenv("SHADOW_SAMPLE_RATE"); value != "" {
+		if parsed, err := strconv.ParseFloat(value, 64); err == nil && parsed >= 0 && parsed <= 1 {
+			sampleRate = parsed
+		} else {
+			log.Printf("Ignoring invalid SHADOW_SAMPLE_RATE %q", value)
+		}
+	}
+
+	// The shadow gets neither live logs nor tag push credentials, so its
+	// runs can't be seen by users or change repositories
+	return &ShadowExecutor{
+		primary:    primary,
+		shadow:     newExecutor(name, nil),
+		name:       name,
+		sampleRate: sampleRate,
+		timeout:    getEnvDuration("SHADOW_TIMEOUT", time.Hour),
+		errors:     errors,
+		outcomes:   outcomes,
+		ratio:      ratio,
+		counts:     make(map[string]int64),
+	}
+}
+
+// Execute runs the build on the primary executor, starting a shadow run
+// alongside it for sampled builds. Only the primary result is returned.
+func (se *ShadowExecutor) Execute(ctx context.Context, build *BuildRequest) (*BuildResult, error) {
+	if se.sampleRate <= 0 || rand.Float64() >= se.sampleRate {
+		return se.primary.Execute(ctx, build)
+	}
+
+	shadowBuild := *build
+	shadowBuild.AutoVersion = false
+	shadowDone := make(chan shadowRun, 1)
+	go func() {
+		// The primary's context ends with the primary run, so the shadow
+		// run is bounded by its own timeout instead
+		shadowCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), se.timeout)
+		defer cancel()
+
+		start := time.Now()
+		result, err := se.shadow.Execute(shadowCtx, &shadowBuild)
+		shadowDone <- shadowRun{result: result, err: err, duration: time.Since(start)}
+	}()
+
+	start := time.Now()
+	result, err := se.primary.Execute(ctx, build)
+	primary := shadowRun{result: result, err: err, duration: time.Since(start)}
+	// Interrupted or timed out builds have no result to compare with
+	interrupted := ctx.Err() != nil
+
+	go func() {
+		shadow := <-shadowDone
+		if interrupted || primary.err != nil {
+			return
+		}
+		se.record(compareShadowRun(build, primary, shadow))
+	}()
+
+	return result, err
+}
+
+// compareShadowRun classifies a shadow run as a match, a mismatch or an error
+func compareShadowRun(build *BuildRequest, primary, shadow shadowRun) ShadowComparison {
+	comparison := ShadowComparison{
+		BuildID:         build.ID,
+		ProjectName:     build.ProjectName,
+		PrimaryStatus:   primary.result.Status,
+		PrimaryExitCode: primary.result.ExitCode,
+		PrimarySeconds:  primary.duration.Seconds(),
+		ShadowSeconds:   shadow.duration.Seconds(),
+		ComparedAt:      time.Now().UTC(),
+	}
+
+	switch {
+	case shadow.err != nil:
+		comparison.Outcome = "error"
+		comparison.ShadowError = shadow.err.Error()
+	case shadow.result.Status == primary.result.Status && shadow.result.ExitCode == primary.result.ExitCode:
+		comparison.Outcome = "match"
+	default:
+		comparison.Outcome = "mismatch"
+	}
+	if shadow.result != nil {
+		comparison.ShadowStatus = shadow.result.Status
+		comparison.ShadowExitCode = shadow.result.ExitCode
+	}
+	return comparison
+}
+
+func (se *ShadowExecutor) record(comparison ShadowComparison) {
+	se.outcomes.WithLabelValues(comparison.Outcome).Inc()
+	if comparison.Outcome != "error" && comparison.PrimarySeconds > 0 {
+		se.ratio.Observe(comparison.ShadowSeconds / comparison.PrimarySeconds)
+	}
+	if comparison.Outcome == "mismatch" {
+		log.Printf("Shadow executor %s disagrees on build %d: %s (exit %d) vs %s (exit %d)", se.name, comparison.BuildID,
+			comparison.PrimaryStatus, comparison.PrimaryExitCode, comparison.ShadowStatus, comparison.ShadowExitCode)
+	}
+	if comparison.Outcome == "error" {
+		se.errors.Capture("shadow", fmt.Errorf("shadow executor %s: %s", se.name, comparison.ShadowError), &BuildRequest{ID: comparison.BuildID, ProjectName: comparison.ProjectName})
+	}
+
+	se.mu.Lock()
+	defer se.mu.Unlock()
+	se.counts[comparison.Outcome]++
+	se.history = append(se.history, comparison)
+	if len(se.history) > shadowHistory {
+		se.history = se.history[len(se.history)-shadowHistory:]
+	}
+}
+
+// Report returns the comparison counts and the most recent comparisons, newest first
+func (se *ShadowExecutor) Report() *ShadowReport {
+	se.mu.Lock()
+	defer se.mu.Unlock()
+
+	report := &ShadowReport{
+		Executor:   se.name,
+		SampleRate: se.sampleRate,
+		Outcomes:   make(map[string]int64, len(se.counts)),
+		Recent:     make([]ShadowComparison, 0, len(se.history)),
+	}
+	for outcome, count := range se.counts {
+		report.Outcomes[outcome] = count
+	}
+	for i := len(se.history) - 1; i >= 0; i-- {
+		report.Recent = append(report.Recent, se.history[i])
+	}
+	return report
+}
+
+// Shadow executor report endpoint
+func (bs *BuildService) shadowReportHandler(w http.ResponseWriter, r *http.Request) {
+	if bs.shadow == nil {
+		http.Error(w, "Shadow executor not configured", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bs.shadow.Report())
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fixedExecutor returns a fixed result, recording the builds it was given
+type fixedExecutor struct {
+	result *BuildResult
+	err    error
+	builds chan BuildRequest
+}
+
+func (fe *fixedExecutor) Execute(ctx context.Context, build *BuildRequest) (*BuildResult, error) {
+	if fe.builds != nil {
+		fe.builds <- *build
+	}
+	return fe.result, fe.err
+}
+
+func TestCompareShadowRun(t *testing.T) {
+	build := &BuildRequest{ID: 1, ProjectName: "api"}
+	primary := shadowRun{result: &BuildResult{Status: "success"}, duration: 2 * time.Second}
+
+	tests := []struct {
+		name     string
+		shadow   shadowRun
+		expected string
+	}{
+		{"match", shadowRun{result: &BuildResult{Status: "success"}, duration: time.Second}, "match"},
+		{"different status", shadowRun{result: &BuildResult{Status: "failed", ExitCode: 2}}, "mismatch"},
+		{"error", shadowRun{err: fmt.Errorf("pod evicted")}, "error"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			comparison := compareShadowRun(build, primary, tt.shadow)
+			assert.Equal(t, tt.expected, comparison.Outcome)
+			assert.Equal(t, "success", comparison.PrimaryStatus)
+			assert.Equal(t, float64(2), comparison.PrimarySeconds)
+		})
+	}
+}
+
+func TestShadowExecutorReturnsPrimaryResult(t *testing.T) {
+	t.Setenv("SHADOW_EXECUTOR", "simulated")
+	t.Setenv("SHADOW_SAMPLE_RATE", "1")
+	service, _ := setupTestService()
+
+	primary := &fixedExecutor{result: &BuildResult{Status: "success"}}
+	shadowBuilds := make(chan BuildRequest, 1)
+	shadowExecutor := NewShadowExecutorFromEnv(primary, service.errors, &service.metrics.ShadowBuilds, service.metrics.ShadowDuration)
+	require.NotNil(t, shadowExecutor)
+	shadowExecutor.shadow = &fixedExecutor{result: &BuildResult{Status: "failed", ExitCode: 1}, builds: shadowBuilds}
+
+	result, err := shadowExecutor.Execute(context.Background(), &BuildRequest{ID: 7, ProjectName: "api", AutoVersion: true})
+	require.NoError(t, err)
+	assert.Equal(t, "success", result.Status)
+
+	shadowBuild := <-shadowBuilds
+	assert.Equal(t, 7, shadowBuild.ID)
+	assert.False(t, shadowBuild.AutoVersion, "shadow runs must not push version tags")
+
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(service.metrics.ShadowBuilds.WithLabelValues("mismatch")) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	report := shadowExecutor.Report()
+	assert.Equal(t, int64(1), report.Outcomes["mismatch"])
+	require.Len(t, report.Recent, 1)
+	assert.Equal(t, "failed", report.Recent[0].ShadowStatus)
+}
+
+func TestShadowExecutorSampling(t *testing.T) {
+	t.Setenv("SHADOW_EXECUTOR", "simulated")
+	t.Setenv("SHADOW_SAMPLE_RATE", "0")
+	service, _ := setupTestService()
+
+	shadowExecutor := NewShadowExecutorFromEnv(&fixedExecutor{result: &BuildResult{Status: "success"}}, service.errors, &service.metrics.ShadowBuilds, service.metrics.ShadowDuration)
+	shadowExecutor.shadow = &fixedExecutor{err: fmt.Errorf("should not run")}
+
+	for i := 0; i < 10; i++ {
+		_, err := shadowExecutor.Execute(context.Background(), &BuildRequest{ID: i})
+		require.NoError(t, err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	assert.Empty(t, shadowExecutor.Report().Outcomes)
+}
+
+func TestShadowReportHandler(t *testing.T) {
+	service, _ := setupTestService()
+
+	w := httptest.NewRecorder()
+	service.shadowReportHandler(w, httptest.NewRequest("GET", "/api/v1/admin/shadow", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	t.Setenv("SHADOW_EXECUTOR", "simulated")
+	service.shadow = NewShadowExecutorFromEnv(service.executor, service.errors, &service.metrics.ShadowBuilds, service.metrics.ShadowDuration)
+
+	w = httptest.NewRecorder()
+	service.shadowReportHandler(w, httptest.NewRequest("GET", "/api/v1/admin/shadow", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var report ShadowReport
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&report))
+	assert.Equal(t, "simulated", report.Executor)
+	assert.Equal(t, 0.1, report.SampleRate)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// skipCIDirectives are the commit message markers that suppress a build
+var skipCIDirectives = []string{"[skip ci]", "[ci skip]", "[no ci]"}
+
+// skipDirective returns the directive in message that asks for the build to
+// be skipped, or "" when the commit should be built. customToken is an
+// additional project-specific marker.
+func skipDirective(message, customToken string) string {
+	lower := strings.ToLower(message)
+
+	for _, directive := range skipCIDirectives {
+		if strings.Contains(lower, directive) {
+			return directive
+		}
+	}
+	if customToken != "" && strings.Contains(lower, strings.ToLower(customToken)) {
+		return customToken
+	}
+	return ""
+}
+
+// recordSkippedBuild stores a build that was deliberately not run so that the
+// push is still visible in the build history
+func (bs *BuildService) recordSkippedBuild(build *BuildRequest) error {
+	build.Status = "skipped"
+	build.SkipReason = skipCommitDirective
+	build.Version = tagVersion(build.Tag)
+	build.CreatedAt = time.Now().UTC()
+	build.UpdatedAt = time.Now().UTC()
+
+	id, err := bs.db.CreateBuild(build)
+	if err != nil {
+		return err
+	}
+
+	build.ID = id
+	bs.recordNotRun(build)
+	bs.events.Publish(build)
+	return nil
+}
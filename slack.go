@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// slackSignatureMaxAge rejects replayed slash command requests
+const slackSignatureMaxAge = 5 * time.Minute
+
+// slackAnnounceTimeout is how long a build triggered from Slack is held for
+// its announcement before it's queued without one
+const slackAnnounceTimeout = 30 * time.Second
+
+// SlackThread links a build to the Slack message its status updates are threaded under
+type SlackThread struct {
+	BuildID   int    `json:"build_id"`
+	ChannelID string `json:"channel_id"`
+	ThreadTS  string `json:"thread_ts"`
+}
+
+// verifySlackSignature checks the X-Slack-Signature of a request body
+func verifySlackSignature(secret, timestamp string, body []byte, signature string, now time.Time) bool {
+	if secret == "" || !strings.HasPrefix(signature, "v0=") {
+		return false
+	}
+
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if age := now.Sub(time.Unix(ts, 0)); age > slackSignatureMaxAge || age < -slackSignatureMaxAge {
+		return false
+	}
+
+	expected, err := hex.DecodeString(strings.TrimPrefix(signature, "v0="))
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "v0:%s:", timestamp)
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// parseSlackServiceAccounts parses SLACK_SERVICE_ACCOUNTS, a comma-separated
+// list of slack_user_id=service_account pairs
+func parseSlackServiceAccounts(value string) map[string]string {
+	accounts := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		user, account, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if ok && user != "" && account != "" {
+			accounts[user] = account
+		}
+	}
+	return accounts
+}
+
+// buildURL returns the externally reachable URL of a build
+func buildURL(id int) string {
+	return fmt.Sprintf("%s/api/v1/builds/%d", publicBaseURL(), id)
+}
+
+type slackCommandResponse struct {
+	ResponseType string `json:"response_type"`
+	Text         string `json:"text"`
+}
+
+func writeSlackResponse(w http.ResponseWriter, responseType, text string) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(slackCommandResponse{ResponseType: responseType, Text: text})
+}
+
+// Slack slash command endpoint: /build <project> [branch]
+func (bs *BuildService) slackCommandHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if !verifySlackSignature(os.Getenv("SLACK_SIGNING_SECRET"), r.Header.Get("X-Slack-Request-Timestamp"), body, r.Header.Get("X-Slack-Signature"), time.Now()) {
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Slack requires a 200 response; errors are reported back to the user
+	account, ok := parseSlackServiceAccounts(os.Getenv("SLACK_SERVICE_ACCOUNTS"))[form.Get("user_id")]
+	if !ok {
+		writeSlackResponse(w, "ephemeral", "You are not allowed to trigger builds. Ask an administrator to map your Slack user to a service account.")
+		return
+	}
+
+	args := strings.Fields(form.Get("text"))
+	if len(args) == 0 || len(args) > 2 {
+		writeSlackResponse(w, "ephemeral", "Usage: /build <project> [branch]")
+		return
+	}
+
+	project, err := bs.db.GetProjectByName(args[0])
+	if err != nil {
+		if err.Error() == "project not found" {
+			writeSlackResponse(w, "ephemeral", fmt.Sprintf("Unknown project %q.", args[0]))
+			return
+		}
+		log.Printf("Error getting project: %v", err)
+		writeSlackResponse(w, "ephemeral", "Something went wrong, please try again.")
+		return
+	}
+
+	build := &BuildRequest{
+		ProjectName:   project.Name,
+		GitURL:        project.GitURL,
+		Branch:        project.DefaultBranch,
+		AutoVersion:   project.AutoVersion,
+		TriggeredBy:   account,
+		TriggerSource: triggerManual,
+		Org:           project.Org,
+	}
+	if len(args) == 2 {
+		build.Branch = args[1]
+	}
+	if err := build.validate(); err != nil {
+		writeSlackResponse(w, "ephemeral", fmt.Sprintf("Invalid build: %v. Usage: /build <project> [branch]", err))
+		return
+	}
+	if bs.slack != nil {
+		// Hold the build as a draft until its announcement is posted, so its
+		// status updates have a thread to go to. The draft scheduler queues it
+		// anyway should the announcement never finish.
+		startAt := time.Now().UTC().Add(slackAnnounceTimeout)
+		build.StartAt = &startAt
+	}
+
+	if err := bs.enqueueBuild(r.Context(), build); err != nil {
+		log.Printf("Error creating build: %v", err)
+		writeSlackResponse(w, "ephemeral", "Something went wrong, please try again.")
+		return
+	}
+
+	text := fmt.Sprintf("Build #%d of %s@%s queued by <@%s>: %s", build.ID, build.ProjectName, build.Branch, form.Get("user_id"), bs.links.BuildURL(build))
+
+	if bs.slack == nil {
+		writeSlackResponse(w, "in_channel", text)
+		return
+	}
+
+	// Post the announcement ourselves so that status updates can be threaded
+	// under it. The build is still a draft until then.
+	writeSlackResponse(w, "ephemeral", fmt.Sprintf("Build #%d created; it's queued once its announcement is posted.", build.ID))
+	go func() {
+		bs.slack.announce(build.ID, form.Get("channel_id"), text)
+		bs.startAnnouncedBuild(build.ID)
+	}()
+}
+
+// startAnnouncedBuild queues a build triggered from Slack once its
+// announcement has been posted, unless the draft scheduler already has
+func (bs *BuildService) startAnnouncedBuild(id int) {
+	build, err := bs.db.StartDraftBuild(id)
+	if err != nil {
+		if err.Error() != "build is not a draft" {
+			bs.errors.Capture("slack", fmt.Errorf("starting announced build: %w", err), &BuildRequest{ID: id})
+		}
+		return
+	}
+
+	bs.events.Publish(build)
+	bs.queue.Notify()
+}
+
+// SlackNotifier posts build status updates into the Slack thread of builds
+// triggered from Slack
+type SlackNotifier struct {
+	db      DatabaseInterface
+	errors  *ErrorTracker
+	health  *IntegrationHealth
+	token   string
+	baseURL string
+	client  *http.Client
+}
+
+// NewSlackNotifierFromEnv returns a notifier when SLACK_BOT_TOKEN is set, otherwise nil
+func NewSlackNotifierFromEnv(db DatabaseInterface, errors *ErrorTracker, health *IntegrationHealth) *SlackNotifier {
+	token := os.Getenv("SLACK_BOT_TOKEN")
+	if token == "" {
+		return nil
+	}
+
+	return &SlackNotifier{
+		db:      db,
+		errors:  errors,
+		health:  health,
+		token:   token,
+		baseURL: "https://slack.com/api",
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Name identifies the integration
+func (sn *SlackNotifier) Name() string {
+	return "slack"
+}
+
+// Deliver posts a build's status change into its Slack thread
+func (sn *SlackNotifier) Deliver(ctx context.Context, event BuildEvent) error {
+	return sn.update(&event.Build)
+}
+
+func (sn *SlackNotifier) announce(buildID int, channelID, text string) {
+	if !sn.health.Allow("slack") {
+		return
+	}
+
+	ts, err := sn.postMessage(channelID, text, "")
+	if err != nil {
+		sn.health.Record("slack", fmt.Errorf("posting build announcement: %w", err), &BuildRequest{ID: buildID})
+		return
+	}
+	sn.health.Record("slack", nil, nil)
+
+	thread := &SlackThread{BuildID: buildID, ChannelID: channelID, ThreadTS: ts}
+	if err := sn.db.CreateSlackThread(thread); err != nil {
+		sn.errors.Capture("slack", fmt.Errorf("saving slack thread: %w", err), &BuildRequest{ID: buildID})
+	}
+}
+
+func (sn *SlackNotifier) update(build *BuildRequest) error {
+	if build.Status == "queued" {
+		return nil
+	}
+
+	thread, err := sn.db.GetSlackThread(build.ID)
+	if err != nil {
+		if err.Error() == "slack thread not found" {
+			return nil
+		}
+		sn.errors.Capture("slack", fmt.Errorf("loading slack thread: %w", err), build)
+		return err
+	}
+
+	if !sn.health.Allow("slack") {
+		return errIntegrationDisabled
+	}
+
+	text := fmt.Sprintf("Build #%d is now *%s*", build.ID, build.Status)
+	_, err = sn.postMessage(thread.ChannelID, text, thread.ThreadTS)
+	if err != nil {
+		err = fmt.Errorf("posting status update: %w", err)
+	}
+	sn.health.Record("slack", err, build)
+	return err
+}
+
+// postMessage calls chat.postMessage and returns the message timestamp
+func (sn *SlackNotifier) postMessage(channel, text, threadTS string) (string, error) {
+	payload := map[string]string{"channel": channel, "text": text}
+	if threadTS != "" {
+		payload["thread_ts"] = threadTS
+	}
+	body, _ := json.Marshal(payload)
+
+	req, err := http.NewRequest("POST", sn.baseURL+"/chat.postMessage", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("Authorization", "Bearer "+sn.token)
+
+	resp, err := sn.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		OK    bool   `json:"ok"`
+		TS    string `json:"ts"`
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	if !result.OK {
+		return "", fmt.Errorf("slack api error: %s", result.Error)
+	}
+	return result.TS, nil
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func signedSlackRequest(secret string, form url.Values, ts time.Time) *http.Request {
+	body := form.Encode()
+	timestamp := strconv.FormatInt(ts.Unix(), 10)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("v0:" + timestamp + ":" + body))
+
+	req := httptest.NewRequest("POST", "/api/v1/slack/commands", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Slack-Request-Timestamp", timestamp)
+	req.Header.Set("X-Slack-Signature", "v0="+hex.EncodeToString(mac.Sum(nil)))
+	return req
+}
+
+func TestVerifySlackSignature(t *testing.T) {
+	now := time.Now()
+	req := signedSlackRequest("signing-secret", url.Values{"text": {"api"}}, now)
+	body := []byte(url.Values{"text": {"api"}}.Encode())
+	ts := req.Header.Get("X-Slack-Request-Timestamp")
+	sig := req.Header.Get("X-Slack-Signature")
+
+	assert.True(t, verifySlackSignature("signing-secret", ts, body, sig, now))
+	assert.False(t, verifySlackSignature("other-secret", ts, body, sig, now))
+	assert.False(t, verifySlackSignature("signing-secret", ts, []byte("text=tampered"), sig, now))
+	assert.False(t, verifySlackSignature("signing-secret", ts, body, sig, now.Add(10*time.Minute)))
+	assert.False(t, verifySlackSignature("", ts, body, sig, now))
+}
+
+func TestSlackCommandHandler(t *testing.T) {
+	t.Setenv("SLACK_SIGNING_SECRET", "signing-secret")
+	t.Setenv("SLACK_SERVICE_ACCOUNTS", "U123=release-bot, U456=ci-bot")
+
+	project := &Project{ID: 1, Name: "api", GitURL: "https://github.com/test/api.git", DefaultBranch: "main"}
+
+	tests := []struct {
+		name         string
+		userID       string
+		text         string
+		setupMock    func(*MockDatabase)
+		expectedType string
+		expectedText string
+	}{
+		{
+			name:   "queues build on default branch",
+			userID: "U123",
+			text:   "api",
+			setupMock: func(m *MockDatabase) {
+				m.On("GetProjectByName", "api").Return(project, nil).Once()
+				m.On("CreateBuild", mock.MatchedBy(func(b *BuildRequest) bool {
+					return b.Branch == "main" && b.TriggeredBy == "release-bot"
+				})).Return(42, nil).Once()
+			},
+			expectedType: "in_channel",
+			expectedText: "Build #42 of api@main queued",
+		},
+		{
+			name:   "queues build on requested branch",
+			userID: "U456",
+			text:   "api feature/login",
+			setupMock: func(m *MockDatabase) {
+				m.On("GetProjectByName", "api").Return(project, nil).Once()
+				m.On("CreateBuild", mock.MatchedBy(func(b *BuildRequest) bool {
+					return b.Branch == "feature/login" && b.TriggeredBy == "ci-bot"
+				})).Return(43, nil).Once()
+			},
+			expectedType: "in_channel",
+			expectedText: "Build #43 of api@feature/login queued",
+		},
+		{
+			name:         "unmapped user",
+			userID:       "U999",
+			text:         "api",
+			expectedType: "ephemeral",
+			expectedText: "not allowed",
+		},
+		{
+			name:         "missing project",
+			userID:       "U123",
+			text:         "",
+			expectedType: "ephemeral",
+			expectedText: "Usage",
+		},
+		{
+			name:   "invalid branch",
+			userID: "U123",
+			text:   "api -x",
+			setupMock: func(m *MockDatabase) {
+				m.On("GetProjectByName", "api").Return(project, nil).Once()
+			},
+			expectedType: "ephemeral",
+			expectedText: "Usage",
+		},
+		{
+			name:   "unknown project",
+			userID: "U123",
+			text:   "nope",
+			setupMock: func(m *MockDatabase) {
+				m.On("GetProjectByName", "nope").Return(nil, fmt.Errorf("project not found")).Once()
+			},
+			expectedType: "ephemeral",
+			expectedText: "Unknown project",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service, mockDB := setupTestService()
+			if tt.setupMock != nil {
+				tt.setupMock(mockDB)
+			}
+
+			form := url.Values{"user_id": {tt.userID}, "text": {tt.text}, "channel_id": {"C1"}}
+			rr := httptest.NewRecorder()
+			service.slackCommandHandler(rr, signedSlackRequest("signing-secret", form, time.Now()))
+
+			assert.Equal(t, http.StatusOK, rr.Code)
+			var resp slackCommandResponse
+			require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+			assert.Equal(t, tt.expectedType, resp.ResponseType)
+			assert.Contains(t, resp.Text, tt.expectedText)
+			mockDB.AssertExpectations(t)
+		})
+	}
+}
+
+func TestSlackCommandHandlerInvalidSignature(t *testing.T) {
+	t.Setenv("SLACK_SIGNING_SECRET", "signing-secret")
+	service, _ := setupTestService()
+
+	rr := httptest.NewRecorder()
+	service.slackCommandHandler(rr, signedSlackRequest("wrong-secret", url.Values{"text": {"api"}}, time.Now()))
+
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+}
+
+func TestSlackCommandHandlerAnnouncesBeforeQueueing(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ok":true,"ts":"1700000000.000100"}`))
+	}))
+	defer server.Close()
+
+	t.Setenv("SLACK_SIGNING_SECRET", "signing-secret")
+	t.Setenv("SLACK_SERVICE_ACCOUNTS", "U123=release-bot")
+	t.Setenv("SLACK_BOT_TOKEN", "xoxb-test")
+	service, mockDB := setupTestService()
+	service.slack = NewSlackNotifierFromEnv(mockDB, service.errors, service.integrations)
+	service.slack.baseURL = server.URL
+
+	threadSaved := false
+	started := make(chan struct{})
+	mockDB.On("GetProjectByName", "api").Return(&Project{ID: 1, Name: "api", GitURL: "https://github.com/test/api.git", DefaultBranch: "main"}, nil).Once()
+	mockDB.On("CreateBuild", mock.MatchedBy(func(b *BuildRequest) bool {
+		return b.Status == "draft" && b.StartAt != nil && time.Until(*b.StartAt) <= slackAnnounceTimeout
+	})).Return(42, nil).Once()
+	mockDB.On("GetIntegration", "slack").Return(nil, fmt.Errorf("integration not found")).Maybe()
+	mockDB.On("ResetIntegrationFailures", "slack").Return(nil).Maybe()
+	mockDB.On("CreateSlackThread", &SlackThread{BuildID: 42, ChannelID: "C1", ThreadTS: "1700000000.000100"}).Run(func(mock.Arguments) {
+		threadSaved = true
+	}).Return(nil).Once()
+	mockDB.On("StartDraftBuild", 42).Run(func(mock.Arguments) {
+		assert.True(t, threadSaved, "the build starts only once its thread exists")
+		close(started)
+	}).Return(&BuildRequest{ID: 42, Status: "queued"}, nil).Once()
+
+	form := url.Values{"user_id": {"U123"}, "text": {"api"}, "channel_id": {"C1"}}
+	rr := httptest.NewRecorder()
+	service.slackCommandHandler(rr, signedSlackRequest("signing-secret", form, time.Now()))
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), "Build #42 created; it's queued once its announcement is posted")
+
+	select {
+	case <-started:
+	case <-time.After(2 * time.Second):
+		t.Fatal("build not started after its announcement")
+	}
+	mockDB.AssertExpectations(t)
+}
+
+func TestSlackNotifierPostsThreadUpdates(t *testing.T) {
+	posted := make(chan map[string]string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/chat.postMessage", r.URL.Path)
+		assert.Equal(t, "Bearer xoxb-test", r.Header.Get("Authorization"))
+
+		var payload map[string]string
+		json.NewDecoder(r.Body).Decode(&payload)
+		posted <- payload
+		w.Write([]byte(`{"ok":true,"ts":"1700000000.000200"}`))
+	}))
+	defer server.Close()
+
+	t.Setenv("SLACK_BOT_TOKEN", "xoxb-test")
+	service, mockDB := setupTestService()
+	service.slack = NewSlackNotifierFromEnv(mockDB, service.errors, service.integrations)
+	service.slack.baseURL = server.URL
+
+	mockDB.On("GetSlackThread", 42).Return(&SlackThread{BuildID: 42, ChannelID: "C1", ThreadTS: "1700000000.000100"}, nil).Once()
+	mockDB.On("GetIntegration", "slack").Return(nil, fmt.Errorf("integration not found")).Once()
+	mockDB.On("ResetIntegrationFailures", "slack").Return(nil).Maybe()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	service.delivery.Register(service.slack)
+	service.delivery.Start(ctx)
+
+	service.events.Publish(&BuildRequest{ID: 42, Status: "success"})
+
+	select {
+	case payload := <-posted:
+		assert.Equal(t, "C1", payload["channel"])
+		assert.Equal(t, "1700000000.000100", payload["thread_ts"])
+		assert.Contains(t, payload["text"], "success")
+	case <-time.After(2 * time.Second):
+		t.Fatal("no thread update posted")
+	}
+	mockDB.AssertExpectations(t)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// sseHeartbeatInterval is how often idle event streams send a keep-alive
+// comment so proxies don't close them
+var sseHeartbeatInterval = 15 * time.Second
+
+// Build events stream endpoint. Streams build status transitions as
+// server-sent events, optionally filtered to one project with ?project=.
+// Requests scoped to an org only receive the org's builds.
+func (bs *BuildService) buildEventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	project := r.URL.Query().Get("project")
+	tenant := requestTenant(r)
+
+	// Streams outlive the server's write timeout
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		log.Printf("Error clearing write deadline for event stream: %v", err)
+	}
+
+	events, unsubscribe := bs.events.Subscribe(64)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "retry: 5000\n\n")
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-bs.streamsDone:
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case event := <-events:
+			if project != "" && event.Build.ProjectName != project || !tenant.Sees(event.Build.Org) {
+				continue
+			}
+
+			data, err := json.Marshal(event)
+			if err != nil {
+				log.Printf("Error encoding build event: %v", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Build.Status, data)
+			flusher.Flush()
+		}
+	}
+}
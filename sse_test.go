@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildEventsHandler(t *testing.T) {
+	service, _ := setupTestService()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/builds/events", service.buildEventsHandler)
+	router.Use(service.deprecations.Middleware, service.accessLog.Middleware)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/api/v1/builds/events?project=api")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	reader := bufio.NewReader(resp.Body)
+	readEvent := func() (string, string) {
+		var name, data string
+		for {
+			line, err := reader.ReadString('\n')
+			require.NoError(t, err)
+			line = strings.TrimSuffix(line, "\n")
+			switch {
+			case line == "" && data != "":
+				return name, data
+			case strings.HasPrefix(line, "event: "):
+				name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				data = strings.TrimPrefix(line, "data: ")
+			}
+		}
+	}
+
+	// Wait for the subscription before publishing
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "retry: 5000\n", line)
+
+	service.events.Publish(&BuildRequest{ID: 1, ProjectName: "web", Status: "queued"})
+	service.events.Publish(&BuildRequest{ID: 2, ProjectName: "api", Status: "running"})
+
+	name, data := readEvent()
+	assert.Equal(t, "running", name)
+	var event BuildEvent
+	require.NoError(t, json.Unmarshal([]byte(data), &event))
+	assert.Equal(t, 2, event.Build.ID)
+
+	// Shutdown ends open streams
+	close(service.streamsDone)
+	done := make(chan struct{})
+	go func() {
+		for {
+			if _, err := reader.ReadString('\n'); err != nil {
+				close(done)
+				return
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("stream not closed on shutdown")
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxStageLogBytes caps the output kept for each stage
+const maxStageLogBytes = 16 * 1024
+
+// BuildStage is one phase of a build, such as clone, build, test or package
+type BuildStage struct {
+	Name string `json:"name"`
+	// Status is running, success, failed or skipped
+	Status     string     `json:"status"`
+	ExitCode   *int       `json:"exit_code,omitempty"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	// Log is the tail of the stage's output
+	Log string `json:"log,omitempty"`
+}
+
+// BuildStages lists the stages of a build in the order they ran
+type BuildStages struct {
+	BuildID int           `json:"build_id"`
+	Stages  []*BuildStage `json:"stages"`
+}
+
+// stageRecorder times the stages of a build and splits its output between
+// them. It is written to alongside the build's combined output.
+type stageRecorder struct {
+	stages []*BuildStage
+	// output collects the current stage's output, nil between stages
+	output *tailBuffer
+}
+
+// begin starts a stage
+func (sr *stageRecorder) begin(name string) {
+	now := time.Now().UTC()
+	sr.stages = append(sr.stages, &BuildStage{Name: name, Status: "running", StartedAt: &now})
+	sr.output = &tailBuffer{limit: maxStageLogBytes}
+}
+
+// finish ends the current stage, which failed when err is set or exitCode is
+// non-zero
+func (sr *stageRecorder) finish(exitCode int, err error) {
+	if sr.output == nil {
+		return
+	}
+	stage := sr.stages[len(sr.stages)-1]
+	now := time.Now().UTC()
+	stage.Status = "success"
+	if err != nil || exitCode != 0 {
+		stage.Status = "failed"
+	}
+	stage.ExitCode = &exitCode
+	stage.FinishedAt = &now
+	stage.Log = string(sr.output.Bytes())
+	sr.output = nil
+}
+
+// current returns the index of the running stage
+func (sr *stageRecorder) current() int {
+	return len(sr.stages) - 1
+}
+
+// skip records a stage that did not run because an earlier one failed
+func (sr *stageRecorder) skip(name string) {
+	sr.stages = append(sr.stages, &BuildStage{Name: name, Status: "skipped"})
+}
+
+func (sr *stageRecorder) Write(p []byte) (int, error) {
+	if sr.output != nil {
+		sr.output.Write(p)
+	}
+	return len(p), nil
+}
+
+// stageGroup is a run of consecutive build steps belonging to one stage
+type stageGroup struct {
+	name  string
+	steps [][]string
+}
+
+// stepStage names the stage a build tool command belongs to
+func stepStage(step []string) string {
+	for _, arg := range step[1:] {
+		switch arg {
+		case "test", "check", "verify":
+			return "test"
+		case "package", "pack", "publish", "dist":
+			return "package"
+		}
+	}
+	return "build"
+}
+
+// groupStages splits build steps into stages, merging consecutive steps of the
+// same stage
+func groupStages(steps [][]string) []stageGroup {
+	var groups []stageGroup
+	for _, step := range steps {
+		name := stepStage(step)
+		if len(groups) > 0 && groups[len(groups)-1].name == name {
+			groups[len(groups)-1].steps = append(groups[len(groups)-1].steps, step)
+			continue
+		}
+		groups = append(groups, stageGroup{name: name, steps: [][]string{step}})
+	}
+	return groups
+}
+
+// Build stages endpoint
+func (bs *BuildService) buildStagesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid build ID", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := bs.db.GetBuild(id); err != nil {
+		if err.Error() == "build not found" {
+			http.Error(w, "Build not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error getting build: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	stages, err := bs.db.ListBuildStages(id)
+	if err != nil {
+		log.Printf("Error listing build stages: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(BuildStages{BuildID: id, Stages: stages})
+}
+
+// buildStep loads the build and stage addressed by a step route, writing an
+// error response when it can't. Steps are numbered by their index in the
+// build's stages.
+func (bs *BuildService) buildStep(w http.ResponseWriter, r *http.Request) (*BuildRequest, *BuildStage, int, bool) {
+	step, err := strconv.Atoi(mux.Vars(r)["n"])
+	if err != nil || step < 0 {
+		http.Error(w, "Invalid step", http.StatusBadRequest)
+		return nil, nil, 0, false
+	}
+
+	build, ok := bs.artifactBuild(w, r)
+	if !ok {
+		return nil, nil, 0, false
+	}
+
+	stages, err := bs.db.ListBuildStages(build.ID)
+	if err != nil {
+		log.Printf("Error listing build stages: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return nil, nil, 0, false
+	}
+	if step >= len(stages) {
+		http.Error(w, "Step not found", http.StatusNotFound)
+		return nil, nil, 0, false
+	}
+
+	return build, stages[step], step, true
+}
+
+// Build step logs endpoint. Serves the tail of the step's output as plain
+// text, with the step's name and status in headers.
+func (bs *BuildService) buildStepLogsHandler(w http.ResponseWriter, r *http.Request) {
+	_, stage, _, ok := bs.buildStep(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Step-Name", stage.Name)
+	w.Header().Set("X-Step-Status", stage.Status)
+	w.Write([]byte(stage.Log))
+}
+
+// Build step artifacts endpoint
+func (bs *BuildService) buildStepArtifactsHandler(w http.ResponseWriter, r *http.Request) {
+	build, _, step, ok := bs.buildStep(w, r)
+	if !ok {
+		return
+	}
+
+	artifacts, err := bs.db.ListStepArtifacts(build.ID, step)
+	if err != nil {
+		log.Printf("Error listing step artifacts: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(artifacts)
+}
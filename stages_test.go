@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroupStages(t *testing.T) {
+	groups := groupStages([][]string{
+		{"npm", "ci"},
+		{"npm", "run", "build", "--if-present"},
+		{"npm", "run", "test", "--if-present"},
+		{"npm", "pack"},
+	})
+	require.Len(t, groups, 3)
+	assert.Equal(t, "build", groups[0].name)
+	assert.Len(t, groups[0].steps, 2)
+	assert.Equal(t, "test", groups[1].name)
+	assert.Equal(t, "package", groups[2].name)
+
+	groups = groupStages([][]string{{"go", "build", "./..."}, {"go", "test", "./..."}})
+	require.Len(t, groups, 2)
+	assert.Equal(t, "build", groups[0].name)
+	assert.Equal(t, "test", groups[1].name)
+}
+
+func TestStageRecorder(t *testing.T) {
+	stages := &stageRecorder{}
+	fmt.Fprintln(stages, "before any stage")
+	stages.begin("clone")
+	fmt.Fprintln(stages, "cloning")
+	stages.finish(0, nil)
+	stages.begin("build")
+	fmt.Fprintln(stages, "compiling")
+	stages.finish(2, nil)
+	stages.skip("test")
+
+	require.Len(t, stages.stages, 3)
+	assert.Equal(t, "success", stages.stages[0].Status)
+	assert.Equal(t, "cloning\n", stages.stages[0].Log)
+	assert.Equal(t, "failed", stages.stages[1].Status)
+	assert.Equal(t, 2, *stages.stages[1].ExitCode)
+	assert.Equal(t, "compiling\n", stages.stages[1].Log)
+	assert.NotNil(t, stages.stages[1].FinishedAt)
+	assert.Equal(t, "skipped", stages.stages[2].Status)
+	assert.Nil(t, stages.stages[2].StartedAt)
+}
+
+func TestBuildStagesHandler(t *testing.T) {
+	service, mockDB := setupTestService()
+	exitCode := 1
+	mockDB.On("GetBuild", 1).Return(&BuildRequest{ID: 1, Status: "failed"}, nil)
+	mockDB.On("ListBuildStages", 1).Return([]*BuildStage{
+		{Name: "clone", Status: "success"},
+		{Name: "test", Status: "failed", ExitCode: &exitCode, Log: "FAIL"},
+	}, nil)
+	mockDB.On("GetBuild", 2).Return(nil, fmt.Errorf("build not found"))
+
+	get := func(id string) *httptest.ResponseRecorder {
+		req := mux.SetURLVars(httptest.NewRequest("GET", "/api/v1/builds/"+id+"/stages", nil), map[string]string{"id": id})
+		rr := httptest.NewRecorder()
+		service.buildStagesHandler(rr, req)
+		return rr
+	}
+
+	rr := get("1")
+	require.Equal(t, http.StatusOK, rr.Code)
+	var stages BuildStages
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &stages))
+	require.Len(t, stages.Stages, 2)
+	assert.Equal(t, "test", stages.Stages[1].Name)
+	assert.Equal(t, "FAIL", stages.Stages[1].Log)
+
+	assert.Equal(t, http.StatusNotFound, get("2").Code)
+	assert.Equal(t, http.StatusBadRequest, get("x").Code)
+}
+
+func TestBuildStepHandlers(t *testing.T) {
+	service, mockDB := setupTestService()
+	step := 2
+	mockDB.On("GetBuild", 1).Return(&BuildRequest{ID: 1, Status: "success"}, nil)
+	mockDB.On("ListBuildStages", 1).Return([]*BuildStage{
+		{Name: "clone", Status: "success", Log: "Cloning into 'src'...\n"},
+		{Name: "build", Status: "success", Log: "go build ./...\n"},
+		{Name: "artifacts", Status: "success", Log: "published artifact app.tar.gz (10 bytes)\n"},
+	}, nil)
+	mockDB.On("ListStepArtifacts", 1, 2).Return([]*Artifact{{ID: 4, BuildID: 1, Name: "app.tar.gz", Step: &step}}, nil)
+	mockDB.On("ListStepArtifacts", 1, 1).Return([]*Artifact{}, nil)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/builds/{id}/steps/{n}/logs", service.buildStepLogsHandler)
+	router.HandleFunc("/api/v1/builds/{id}/steps/{n}/artifacts", service.buildStepArtifactsHandler)
+	get := func(path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		return rr
+	}
+
+	rr := get("/api/v1/builds/1/steps/1/logs")
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "go build ./...\n", rr.Body.String())
+	assert.Equal(t, "build", rr.Header().Get("X-Step-Name"))
+	assert.Equal(t, "success", rr.Header().Get("X-Step-Status"))
+
+	rr = get("/api/v1/builds/1/steps/2/artifacts")
+	require.Equal(t, http.StatusOK, rr.Code)
+	var artifacts []*Artifact
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &artifacts))
+	require.Len(t, artifacts, 1)
+	assert.Equal(t, "app.tar.gz", artifacts[0].Name)
+	assert.JSONEq(t, `[]`, get("/api/v1/builds/1/steps/1/artifacts").Body.String())
+
+	assert.Equal(t, http.StatusNotFound, get("/api/v1/builds/1/steps/3/logs").Code)
+	assert.Equal(t, http.StatusBadRequest, get("/api/v1/builds/1/steps/-1/logs").Code)
+	assert.Equal(t, http.StatusBadRequest, get("/api/v1/builds/1/steps/x/artifacts").Code)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// staleBranchActivity are the trigger sources showing someone still works on
+// a branch. Scheduled, upstream and automatic retry builds keep running on
+// branches nobody pushes to.
+var staleBranchActivity = []string{triggerManual, triggerWebhook, triggerRetry, triggerBootstrap}
+
+// staleBranchLockID is the advisory lock key held by the instance that
+// sweeps stale branches
+const staleBranchLockID = 7_061_322_947
+
+// defaultStaleBranchDays is how long a branch goes without activity before
+// it's stale
+const defaultStaleBranchDays = 30
+
+// StaleBranch is a branch of a project without pushes or manual builds for
+// the staleness window
+type StaleBranch struct {
+	Branch string `json:"branch"`
+	// LastActivityAt is when the branch was last pushed to or built by hand,
+	// nil when it never was
+	LastActivityAt *time.Time `json:"last_activity_at,omitempty"`
+	// LastBuildAt and LastBuildID are of the branch's newest build of any
+	// kind, nil for branches only known from their schedules
+	LastBuildAt *time.Time `json:"last_build_at,omitempty"`
+	LastBuildID *int       `json:"last_build_id,omitempty"`
+	// ScheduleIDs are the branch's enabled build schedules
+	ScheduleIDs []int `json:"schedule_ids"`
+}
+
+// StaleBranchReport lists the stale branches of a project
+type StaleBranchReport struct {
+	Project string `json:"project"`
+	Days    int    `json:"days"`
+	// Before is the cutoff: branches without activity since are stale
+	Before   time.Time      `json:"before"`
+	Branches []*StaleBranch `json:"branches"`
+}
+
+// StaleBranchSweeper periodically finds the stale branches of every project
+// and optionally disables their build schedules. Like the scheduler, only
+// the instance holding its advisory lock sweeps.
+type StaleBranchSweeper struct {
+	db       DatabaseInterface
+	errors   *ErrorTracker
+	days     int
+	interval time.Duration
+	// disableSchedules turns off the schedules of stale branches
+	disableSchedules bool
+
+	// lock is only used from the sweeper goroutine
+	lock AdvisoryLock
+}
+
+// NewStaleBranchSweeperFromEnv creates a sweeper treating branches as stale
+// after STALE_BRANCH_DAYS and checking every STALE_BRANCH_INTERVAL. Schedules
+// are only disabled with STALE_BRANCH_DISABLE_SCHEDULES.
+func NewStaleBranchSweeperFromEnv(db DatabaseInterface, errors *ErrorTracker) *StaleBranchSweeper {
+	return &StaleBranchSweeper{
+		db:               db,
+		errors:           errors,
+		days:             getEnvInt("STALE_BRANCH_DAYS", defaultStaleBranchDays),
+		interval:         getEnvDuration("STALE_BRANCH_INTERVAL", 24*time.Hour),
+		disableSchedules: getEnvBool("STALE_BRANCH_DISABLE_SCHEDULES", false),
+	}
+}
+
+// Start sweeps every interval until ctx is cancelled, then gives up the lock
+func (ss *StaleBranchSweeper) Start(ctx context.Context) {
+	if ss.interval <= 0 || ss.days <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(ss.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				ss.resign()
+				return
+			case <-ticker.C:
+				if ss.lead() {
+					ss.Sweep(time.Now())
+				}
+			}
+		}
+	}()
+}
+
+// lead reports whether this instance sweeps, taking the stale branch lock
+// when it is free
+func (ss *StaleBranchSweeper) lead() bool {
+	if ss.lock != nil {
+		if ss.lock.Held() {
+			return true
+		}
+		log.Printf("Lost the stale branch sweeper lock")
+		ss.resign()
+	}
+
+	lock, err := ss.db.TryAdvisoryLock(staleBranchLockID)
+	if err != nil {
+		ss.errors.Capture("stale-branches", fmt.Errorf("acquiring stale branch sweeper lock: %w", err), nil)
+		return false
+	}
+	if lock == nil {
+		return false
+	}
+
+	log.Printf("Acquired the stale branch sweeper lock, sweeping stale branches")
+	ss.lock = lock
+	return true
+}
+
+func (ss *StaleBranchSweeper) resign() {
+	if ss.lock != nil {
+		ss.lock.Release()
+		ss.lock = nil
+	}
+}
+
+// staleBranchCutoff is the time branches without activity since are stale
+func staleBranchCutoff(now time.Time, days int) time.Time {
+	return now.UTC().Add(-time.Duration(days) * 24 * time.Hour)
+}
+
+// Sweep finds the stale branches of every project, disabling their
+// schedules when configured to, and returns how many branches are stale.
+// Webhook triggers are left alone: they only build on a push, which makes
+// the branch active again.
+func (ss *StaleBranchSweeper) Sweep(now time.Time) int {
+	projects, err := ss.db.ListProjects("", nil)
+	if err != nil {
+		ss.errors.Capture("stale-branches", fmt.Errorf("listing projects: %w", err), nil)
+		return 0
+	}
+
+	cutoff := staleBranchCutoff(now, ss.days)
+	stale := 0
+	for _, project := range projects {
+		branches, err := ss.db.ListStaleBranches(project, cutoff, staleBranchActivity)
+		if err != nil {
+			ss.errors.Capture("stale-branches", fmt.Errorf("listing stale branches of %s: %w", project.Name, err), nil)
+			continue
+		}
+		stale += len(branches)
+
+		for _, branch := range branches {
+			if !ss.disableSchedules || len(branch.ScheduleIDs) == 0 {
+				continue
+			}
+			disabled, err := ss.db.DisableBuildSchedules(branch.ScheduleIDs)
+			if err != nil {
+				ss.errors.Capture("stale-branches", fmt.Errorf("disabling schedules of %s %s: %w", project.Name, branch.Branch, err), nil)
+				continue
+			}
+			if disabled > 0 {
+				log.Printf("Disabled %d schedule(s) of stale branch %s of project %s", disabled, branch.Branch, project.Name)
+			}
+		}
+	}
+
+	if stale > 0 {
+		log.Printf("Found %d branches without activity in %d days", stale, ss.days)
+	}
+	return stale
+}
+
+// Stale branches endpoint. ?days= overrides STALE_BRANCH_DAYS.
+func (bs *BuildService) staleBranchesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	days := bs.staleBranches.days
+	if days <= 0 {
+		days = defaultStaleBranchDays
+	}
+	if value := r.URL.Query().Get("days"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxStatsDays {
+			http.Error(w, fmt.Sprintf("days must be between 1 and %d", maxStatsDays), http.StatusBadRequest)
+			return
+		}
+		days = parsed
+	}
+
+	project, err := bs.db.GetProject(id)
+	if err != nil {
+		if err.Error() == "project not found" {
+			http.Error(w, "Project not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error getting project: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	report := StaleBranchReport{Project: project.Name, Days: days, Before: staleBranchCutoff(time.Now(), days)}
+	report.Branches, err = bs.db.ListStaleBranches(project, report.Before, staleBranchActivity)
+	if err != nil {
+		log.Printf("Error listing stale branches: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
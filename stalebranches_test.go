@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStaleBranchSweeperSweep(t *testing.T) {
+	service, mockDB := setupTestService()
+	sweeper := &StaleBranchSweeper{db: mockDB, errors: service.errors, days: 30}
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	cutoff := now.AddDate(0, 0, -30)
+	web := &Project{ID: 1, Name: "web", DefaultBranch: "main"}
+	api := &Project{ID: 2, Name: "api", DefaultBranch: "main"}
+
+	mockDB.On("ListProjects", "", Labels(nil)).Return([]*Project{web, api}, nil)
+	mockDB.On("ListStaleBranches", web, cutoff, staleBranchActivity).Return([]*StaleBranch{
+		{Branch: "feature/old", ScheduleIDs: []int{3, 4}},
+		{Branch: "spike", ScheduleIDs: []int{}},
+	}, nil)
+	mockDB.On("ListStaleBranches", api, cutoff, staleBranchActivity).Return(nil, fmt.Errorf("connection refused"))
+
+	// Reporting alone leaves the schedules running
+	assert.Equal(t, 2, sweeper.Sweep(now))
+	mockDB.AssertNotCalled(t, "DisableBuildSchedules", mock.Anything)
+
+	sweeper.disableSchedules = true
+	mockDB.On("DisableBuildSchedules", []int{3, 4}).Return(int64(2), nil).Once()
+	assert.Equal(t, 2, sweeper.Sweep(now))
+	mockDB.AssertExpectations(t)
+}
+
+func TestStaleBranchSweeperLeadership(t *testing.T) {
+	service, mockDB := setupTestService()
+	sweeper := &StaleBranchSweeper{db: mockDB, errors: service.errors, days: 30}
+
+	mockDB.On("TryAdvisoryLock", int64(staleBranchLockID)).Return(nil, nil).Once()
+	assert.False(t, sweeper.lead())
+
+	lock := &fakeAdvisoryLock{}
+	mockDB.On("TryAdvisoryLock", int64(staleBranchLockID)).Return(lock, nil).Once()
+	assert.True(t, sweeper.lead())
+	assert.True(t, sweeper.lead())
+
+	// Another instance may have taken over once the session is gone
+	lock.lost = true
+	mockDB.On("TryAdvisoryLock", int64(staleBranchLockID)).Return(nil, nil).Once()
+	assert.False(t, sweeper.lead())
+	assert.True(t, lock.released)
+
+	mockDB.On("TryAdvisoryLock", int64(staleBranchLockID)).Return(nil, fmt.Errorf("connection refused")).Once()
+	assert.False(t, sweeper.lead())
+	assert.Equal(t, 1.0, testutil.ToFloat64(service.metrics.BackgroundErrors.WithLabelValues("stale-branches")))
+	mockDB.AssertExpectations(t)
+}
+
+func TestStaleBranchesHandler(t *testing.T) {
+	service, mockDB := setupTestService()
+	project := &Project{ID: 1, Name: "web", DefaultBranch: "main"}
+	lastBuild := time.Now().AddDate(0, 0, -40)
+	buildID := 12
+	mockDB.On("GetProject", 1).Return(project, nil)
+	mockDB.On("GetProject", 2).Return(nil, fmt.Errorf("project not found"))
+	mockDB.On("ListStaleBranches", project, mock.MatchedBy(func(before time.Time) bool {
+		return time.Since(before) > 6*24*time.Hour && time.Since(before) < 8*24*time.Hour
+	}), staleBranchActivity).Return([]*StaleBranch{
+		{Branch: "feature/old", LastActivityAt: &lastBuild, LastBuildAt: &lastBuild, LastBuildID: &buildID, ScheduleIDs: []int{3}},
+	}, nil).Once()
+
+	call := func(id, query string) *httptest.ResponseRecorder {
+		req := mux.SetURLVars(httptest.NewRequest("GET", "/api/v1/projects/"+id+"/stale-branches"+query, nil), map[string]string{"id": id})
+		rr := httptest.NewRecorder()
+		service.staleBranchesHandler(rr, req)
+		return rr
+	}
+
+	rr := call("1", "?days=7")
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"days":7`)
+	assert.Contains(t, rr.Body.String(), `"branch":"feature/old"`)
+	assert.Contains(t, rr.Body.String(), `"schedule_ids":[3]`)
+
+	assert.Equal(t, http.StatusBadRequest, call("1", "?days=0").Code)
+	assert.Equal(t, http.StatusNotFound, call("2", "").Code)
+	mockDB.AssertExpectations(t)
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxStatsDays bounds the period build statistics cover
+const maxStatsDays = 366
+
+// ProjectStats summarises a project's finished builds
+type ProjectStats struct {
+	Project   string `json:"project"`
+	Builds    int    `json:"builds"`
+	Succeeded int    `json:"succeeded"`
+	Failed    int    `json:"failed"`
+	// SuccessRate is the share of finished builds that succeeded, 0 to 1
+	SuccessRate        float64 `json:"success_rate"`
+	AvgDurationSeconds float64 `json:"avg_duration_seconds"`
+	P50DurationSeconds float64 `json:"p50_duration_seconds"`
+	P95DurationSeconds float64 `json:"p95_duration_seconds"`
+}
+
+// DurationStats summarises how long the builds finished in one window took
+type DurationStats struct {
+	Start              time.Time `json:"start"`
+	Builds             int       `json:"builds"`
+	AvgDurationSeconds float64   `json:"avg_duration_seconds"`
+	P50DurationSeconds float64   `json:"p50_duration_seconds"`
+	P95DurationSeconds float64   `json:"p95_duration_seconds"`
+}
+
+// DailyBuildCount counts the builds created on one day
+type DailyBuildCount struct {
+	Day       time.Time `json:"day"`
+	Builds    int       `json:"builds"`
+	Succeeded int       `json:"succeeded"`
+	Failed    int       `json:"failed"`
+	// Skipped and Blocked count the builds that deliberately weren't run,
+	// which aren't failures
+	Skipped int `json:"skipped"`
+	Blocked int `json:"blocked"`
+}
+
+// FlakyProject measures how often a project's builds both fail and pass on
+// the same commit
+type FlakyProject struct {
+	Project string `json:"project"`
+	// Commits counts the commits built more than once, and FlakyCommits
+	// those with both a failed and a successful build
+	Commits      int     `json:"commits"`
+	FlakyCommits int     `json:"flaky_commits"`
+	FlakeRate    float64 `json:"flake_rate"`
+}
+
+// statsIntervals are the windows durations can be grouped by, as Postgres
+// date_trunc fields
+var statsIntervals = map[string]bool{"hour": true, "day": true, "week": true, "month": true}
+
+// StatsCache keeps computed statistics for a short while, since the
+// aggregates scan many builds and dashboards poll them
+type StatsCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]statsEntry
+}
+
+type statsEntry struct {
+	body    []byte
+	expires time.Time
+}
+
+// NewStatsCacheFromEnv creates a cache keeping statistics for
+// STATS_CACHE_TTL; zero disables caching
+func NewStatsCacheFromEnv() *StatsCache {
+	return &StatsCache{
+		ttl:     getEnvDuration("STATS_CACHE_TTL", time.Minute),
+		entries: make(map[string]statsEntry),
+	}
+}
+
+// Get returns the encoded statistics cached under key, computing and caching
+// them when missing or expired
+func (sc *StatsCache) Get(key string, now time.Time, compute func() (interface{}, error)) ([]byte, error) {
+	sc.mu.Lock()
+	entry, ok := sc.entries[key]
+	sc.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.body, nil
+	}
+
+	stats, err := compute()
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(stats)
+	if err != nil {
+		return nil, err
+	}
+	if sc.ttl <= 0 {
+		return body, nil
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for k, e := range sc.entries {
+		if !now.Before(e.expires) {
+			delete(sc.entries, k)
+		}
+	}
+	sc.entries[key] = statsEntry{body: body, expires: now.Add(sc.ttl)}
+	return body, nil
+}
+
+// statsSince parses the days query parameter, defaulting to 30, and returns
+// the start of the first day it covers, writing an error response when it is
+// invalid
+func statsSince(w http.ResponseWriter, r *http.Request, now time.Time) (time.Time, bool) {
+	days := 30
+	if value := r.URL.Query().Get("days"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxStatsDays {
+			http.Error(w, "days must be between 1 and 366", http.StatusBadRequest)
+			return time.Time{}, false
+		}
+		days = parsed
+	}
+	return now.UTC().Truncate(24*time.Hour).AddDate(0, 0, 1-days), true
+}
+
+// writeStats serves statistics from the cache, keyed by the request's org,
+// path and query
+func (bs *BuildService) writeStats(w http.ResponseWriter, r *http.Request, now time.Time, compute func() (interface{}, error)) {
+	body, err := bs.stats.Get(listOrg(r)+" "+r.URL.RequestURI(), now, compute)
+	if err != nil {
+		log.Printf("Error computing build statistics: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// Project statistics endpoint
+func (bs *BuildService) projectStatsHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	since, ok := statsSince(w, r, now)
+	if !ok {
+		return
+	}
+
+	bs.writeStats(w, r, now, func() (interface{}, error) {
+		return bs.db.GetProjectStats(since, listOrg(r))
+	})
+}
+
+// Build duration statistics endpoint. ?interval= groups the builds by hour,
+// day (the default), week or month, and ?project= limits them to a project.
+func (bs *BuildService) durationStatsHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	since, ok := statsSince(w, r, now)
+	if !ok {
+		return
+	}
+	interval := r.URL.Query().Get("interval")
+	if interval == "" {
+		interval = "day"
+	}
+	if !statsIntervals[interval] {
+		http.Error(w, "interval must be hour, day, week or month", http.StatusBadRequest)
+		return
+	}
+	project := r.URL.Query().Get("project")
+
+	bs.writeStats(w, r, now, func() (interface{}, error) {
+		return bs.db.GetDurationStats(since, interval, project, listOrg(r))
+	})
+}
+
+// Builds per day endpoint. ?project= limits the counts to a project.
+func (bs *BuildService) dailyBuildStatsHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	since, ok := statsSince(w, r, now)
+	if !ok {
+		return
+	}
+	project := r.URL.Query().Get("project")
+
+	bs.writeStats(w, r, now, func() (interface{}, error) {
+		return bs.db.GetDailyBuildCounts(since, project, listOrg(r))
+	})
+}
+
+// Flakiest projects endpoint, most flaky first. ?limit= caps the number of
+// projects, 10 by default.
+func (bs *BuildService) flakyProjectsHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	since, ok := statsSince(w, r, now)
+	if !ok {
+		return
+	}
+	limit := 10
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > 100 {
+			http.Error(w, "limit must be between 1 and 100", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	bs.writeStats(w, r, now, func() (interface{}, error) {
+		return bs.db.GetFlakyProjects(since, listOrg(r), limit)
+	})
+}
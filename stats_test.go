@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatsCache(t *testing.T) {
+	cache := &StatsCache{ttl: time.Minute, entries: make(map[string]statsEntry)}
+	now := time.Now()
+	calls := 0
+	compute := func() (interface{}, error) {
+		calls++
+		return map[string]int{"calls": calls}, nil
+	}
+
+	body, err := cache.Get("/a", now, compute)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"calls":1}`, string(body))
+
+	body, _ = cache.Get("/a", now.Add(30*time.Second), compute)
+	assert.JSONEq(t, `{"calls":1}`, string(body))
+	body, _ = cache.Get("/b", now, compute)
+	assert.JSONEq(t, `{"calls":2}`, string(body))
+
+	// Expired entries are recomputed
+	body, _ = cache.Get("/a", now.Add(time.Minute), compute)
+	assert.JSONEq(t, `{"calls":3}`, string(body))
+
+	// Errors aren't cached
+	_, err = cache.Get("/c", now, func() (interface{}, error) { return nil, fmt.Errorf("database error") })
+	assert.Error(t, err)
+	assert.NotContains(t, cache.entries, "/c")
+}
+
+func TestStatsCacheDisabled(t *testing.T) {
+	cache := &StatsCache{entries: make(map[string]statsEntry)}
+	calls := 0
+	for i := 0; i < 2; i++ {
+		cache.Get("/a", time.Now(), func() (interface{}, error) { calls++; return nil, nil })
+	}
+	assert.Equal(t, 2, calls)
+}
+
+func getStats(handler http.HandlerFunc, url string) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	handler(rr, httptest.NewRequest("GET", url, nil))
+	return rr
+}
+
+func TestProjectStatsHandler(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.On("GetProjectStats", mock.MatchedBy(func(since time.Time) bool {
+		return since.Equal(time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -6))
+	}), "").Return([]*ProjectStats{{Project: "api", Builds: 4, Succeeded: 3, Failed: 1, SuccessRate: 0.75}}, nil).Once()
+
+	rr := getStats(service.projectStatsHandler, "/api/v1/stats/projects?days=7")
+	require.Equal(t, http.StatusOK, rr.Code)
+	var stats []ProjectStats
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &stats))
+	require.Len(t, stats, 1)
+	assert.Equal(t, 0.75, stats[0].SuccessRate)
+
+	// Served from the cache the second time
+	assert.Equal(t, http.StatusOK, getStats(service.projectStatsHandler, "/api/v1/stats/projects?days=7").Code)
+	assert.Equal(t, http.StatusBadRequest, getStats(service.projectStatsHandler, "/api/v1/stats/projects?days=400").Code)
+	mockDB.AssertExpectations(t)
+}
+
+func TestDurationStatsHandler(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.On("GetDurationStats", mock.AnythingOfType("time.Time"), "week", "api", "").
+		Return([]*DurationStats{{Builds: 10, AvgDurationSeconds: 42, P95DurationSeconds: 90}}, nil).Once()
+	mockDB.On("GetDurationStats", mock.AnythingOfType("time.Time"), "day", "", "").
+		Return(nil, fmt.Errorf("database error")).Once()
+
+	rr := getStats(service.durationStatsHandler, "/api/v1/stats/durations?interval=week&project=api")
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"p95_duration_seconds":90`)
+
+	assert.Equal(t, http.StatusInternalServerError, getStats(service.durationStatsHandler, "/api/v1/stats/durations").Code)
+	assert.Equal(t, http.StatusBadRequest, getStats(service.durationStatsHandler, "/api/v1/stats/durations?interval=year").Code)
+	mockDB.AssertExpectations(t)
+}
+
+func TestDailyBuildStatsHandler(t *testing.T) {
+	service, mockDB := setupTestService()
+	day := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	mockDB.On("GetDailyBuildCounts", mock.AnythingOfType("time.Time"), "", "").
+		Return([]*DailyBuildCount{{Day: day, Builds: 12, Succeeded: 10, Failed: 2}}, nil).Once()
+
+	rr := getStats(service.dailyBuildStatsHandler, "/api/v1/stats/daily")
+	require.Equal(t, http.StatusOK, rr.Code)
+	var counts []DailyBuildCount
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &counts))
+	require.Len(t, counts, 1)
+	assert.Equal(t, 12, counts[0].Builds)
+	mockDB.AssertExpectations(t)
+}
+
+func TestFlakyProjectsHandler(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.On("GetFlakyProjects", mock.AnythingOfType("time.Time"), "", 3).
+		Return([]*FlakyProject{{Project: "web", Commits: 4, FlakyCommits: 2, FlakeRate: 0.5}}, nil).Once()
+
+	rr := getStats(service.flakyProjectsHandler, "/api/v1/stats/flaky?limit=3")
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"flake_rate":0.5`)
+	assert.Equal(t, http.StatusBadRequest, getStats(service.flakyProjectsHandler, "/api/v1/stats/flaky?limit=0").Code)
+	mockDB.AssertExpectations(t)
+}
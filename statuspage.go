@@ -0,0 +1,440 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Overall statuses shown on the status page, from best to worst
+const (
+	statusOperational = "operational"
+	statusMaintenance = "maintenance"
+	statusDegraded    = "degraded"
+	statusMajorOutage = "major_outage"
+)
+
+// statusDescriptions are the human readable forms of the overall statuses
+var statusDescriptions = map[string]string{
+	statusOperational: "All systems operational",
+	statusMaintenance: "Scheduled maintenance in progress",
+	statusDegraded:    "Degraded performance",
+	statusMajorOutage: "Major outage",
+}
+
+// upcomingMaintenanceWindow is how far ahead scheduled maintenance is announced
+const upcomingMaintenanceWindow = 7 * 24 * time.Hour
+
+// Incident is an ongoing incident or a maintenance window announced on the
+// status page. Kind is incident or maintenance; Impact is none, minor or major.
+type Incident struct {
+	ID         int        `json:"id" db:"id"`
+	Kind       string     `json:"kind" db:"kind"`
+	Impact     string     `json:"impact" db:"impact"`
+	Title      string     `json:"title" db:"title"`
+	Message    string     `json:"message,omitempty" db:"message"`
+	StartsAt   time.Time  `json:"starts_at" db:"starts_at"`
+	EndsAt     *time.Time `json:"ends_at,omitempty" db:"ends_at"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty" db:"resolved_at"`
+	CreatedAt  time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at" db:"updated_at"`
+}
+
+// Active reports whether the incident is in effect at the given time
+func (i *Incident) Active(now time.Time) bool {
+	return i.ResolvedAt == nil && !i.StartsAt.After(now) && (i.EndsAt == nil || i.EndsAt.After(now))
+}
+
+// IncidentUpdate holds the fields of an incident that can be changed; nil
+// fields are left untouched. Setting resolved closes the incident.
+type IncidentUpdate struct {
+	Impact   *string    `json:"impact"`
+	Title    *string    `json:"title"`
+	Message  *string    `json:"message"`
+	StartsAt *time.Time `json:"starts_at"`
+	EndsAt   *time.Time `json:"ends_at"`
+	Resolved *bool      `json:"resolved"`
+}
+
+// validIncident checks the fields of a new or updated incident
+func validIncident(incident *Incident) error {
+	if incident.Kind != "incident" && incident.Kind != "maintenance" {
+		return fmt.Errorf("kind must be incident or maintenance")
+	}
+	if incident.Impact != "none" && incident.Impact != "minor" && incident.Impact != "major" {
+		return fmt.Errorf("impact must be none, minor or major")
+	}
+	if strings.TrimSpace(incident.Title) == "" {
+		return fmt.Errorf("title is required")
+	}
+	if incident.EndsAt != nil && !incident.EndsAt.After(incident.StartsAt) {
+		return fmt.Errorf("ends_at must be after starts_at")
+	}
+	return nil
+}
+
+// QueueStats summarises the build queue
+type QueueStats struct {
+	Queued         int
+	Running        int
+	OldestQueuedAt *time.Time
+	// Started counts builds started in the sampled period; WaitP50 and
+	// WaitP95 are percentiles of how long they were queued
+	Started int
+	WaitP50 time.Duration
+	WaitP95 time.Duration
+}
+
+// StatusPage is the public summary of the service's health
+type StatusPage struct {
+	Status              string      `json:"status"`
+	Description         string      `json:"description"`
+	Database            string      `json:"database"`
+	Queue               StatusQueue `json:"queue"`
+	Incidents           []*Incident `json:"incidents"`
+	UpcomingMaintenance []*Incident `json:"upcoming_maintenance"`
+	UpdatedAt           time.Time   `json:"updated_at"`
+}
+
+// StatusQueue describes queue latency on the status page
+type StatusQueue struct {
+	Queued            int     `json:"queued"`
+	Running           int     `json:"running"`
+	OldestWaitSeconds float64 `json:"oldest_wait_seconds"`
+	WaitP50Seconds    float64 `json:"wait_p50_seconds"`
+	WaitP95Seconds    float64 `json:"wait_p95_seconds"`
+}
+
+// StatusPageCache holds the rendered status page so that heavy traffic from
+// embedding pages doesn't reach the database
+type StatusPageCache struct {
+	ttl           time.Duration
+	degradedAfter time.Duration
+
+	mu      sync.Mutex
+	page    *StatusPage
+	body    []byte
+	etag    string
+	expires time.Time
+}
+
+// NewStatusPageCache creates a status page cache configured from the environment
+func NewStatusPageCache() *StatusPageCache {
+	return &StatusPageCache{
+		ttl:           getEnvDuration("STATUS_CACHE_TTL", 30*time.Second),
+		degradedAfter: getEnvDuration("STATUS_QUEUE_DEGRADED_AFTER", 15*time.Minute),
+	}
+}
+
+// Invalidate forces the next request to rebuild the page
+func (sc *StatusPageCache) Invalidate() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.expires = time.Time{}
+}
+
+// statusPage returns the current status page, its JSON encoding and ETag
+func (bs *BuildService) statusPage() (*StatusPage, []byte, string) {
+	sc := bs.statusCache
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	now := time.Now().UTC()
+	if now.Before(sc.expires) {
+		return sc.page, sc.body, sc.etag
+	}
+
+	page := bs.compileStatusPage(now, sc.degradedAfter)
+	body, _ := json.Marshal(page)
+	// UpdatedAt changes on every rebuild, so it's left out of the ETag
+	unstamped := *page
+	unstamped.UpdatedAt = time.Time{}
+	tag, _ := json.Marshal(unstamped)
+	sum := sha256.Sum256(tag)
+
+	sc.page, sc.body, sc.etag = page, body, `"`+hex.EncodeToString(sum[:8])+`"`
+	sc.expires = now.Add(sc.ttl)
+	return sc.page, sc.body, sc.etag
+}
+
+// localizedStatusPage returns the status page with its description in the
+// locale, and an ETag that differs between locales
+func (bs *BuildService) localizedStatusPage(locale string) (*StatusPage, []byte, string) {
+	page, body, etag := bs.statusPage()
+	if locale == defaultLocale {
+		return page, body, etag
+	}
+
+	localized := *page
+	localized.Description = bs.catalog.Translate(locale, page.Description)
+	body, _ = json.Marshal(localized)
+	return &localized, body, strings.TrimSuffix(etag, `"`) + "-" + locale + `"`
+}
+
+// compileStatusPage gathers health, queue latency and incidents into a status page
+func (bs *BuildService) compileStatusPage(now time.Time, degradedAfter time.Duration) *StatusPage {
+	page := &StatusPage{
+		Status:              statusOperational,
+		Database:            "connected",
+		Incidents:           []*Incident{},
+		UpcomingMaintenance: []*Incident{},
+		UpdatedAt:           now,
+	}
+	worsen := func(status string) {
+		rank := map[string]int{statusOperational: 0, statusMaintenance: 1, statusDegraded: 2, statusMajorOutage: 3}
+		if rank[status] > rank[page.Status] {
+			page.Status = status
+		}
+	}
+
+	if err := bs.db.Ping(); err != nil {
+		page.Database = "disconnected"
+		page.Status = statusMajorOutage
+		page.Description = statusDescriptions[page.Status]
+		return page
+	}
+
+	stats, err := bs.db.GetQueueStats(now.Add(-time.Hour))
+	if err != nil {
+		log.Printf("Error getting queue stats: %v", err)
+		worsen(statusDegraded)
+	} else {
+		page.Queue = StatusQueue{
+			Queued:         stats.Queued,
+			Running:        stats.Running,
+			WaitP50Seconds: stats.WaitP50.Seconds(),
+			WaitP95Seconds: stats.WaitP95.Seconds(),
+		}
+		if stats.OldestQueuedAt != nil {
+			page.Queue.OldestWaitSeconds = now.Sub(*stats.OldestQueuedAt).Seconds()
+			if now.Sub(*stats.OldestQueuedAt) > degradedAfter {
+				worsen(statusDegraded)
+			}
+		}
+	}
+
+	incidents, err := bs.db.ListIncidents(false)
+	if err != nil {
+		log.Printf("Error listing incidents: %v", err)
+	}
+	for _, incident := range incidents {
+		switch {
+		case incident.Active(now):
+			page.Incidents = append(page.Incidents, incident)
+			switch {
+			case incident.Impact == "major":
+				worsen(statusMajorOutage)
+			case incident.Impact == "minor":
+				worsen(statusDegraded)
+			case incident.Kind == "maintenance":
+				worsen(statusMaintenance)
+			}
+		case incident.Kind == "maintenance" && incident.StartsAt.After(now) && incident.StartsAt.Before(now.Add(upcomingMaintenanceWindow)):
+			page.UpcomingMaintenance = append(page.UpcomingMaintenance, incident)
+		}
+	}
+
+	page.Description = statusDescriptions[page.Status]
+	return page
+}
+
+// writeCacheHeaders sets the caching headers of status responses and reports
+// whether the client's copy is still current
+func (bs *BuildService) writeCacheHeaders(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(bs.statusCache.ttl.Seconds())))
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// Status endpoint. Unauthenticated and cacheable so it can be embedded.
+func (bs *BuildService) statusHandler(w http.ResponseWriter, r *http.Request) {
+	_, body, etag := bs.localizedStatusPage(requestLocale(r))
+	if bs.writeCacheHeaders(w, r, etag) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// statusPageView is the status page in the locale of the request
+type statusPageView struct {
+	*StatusPage
+	Lang    string
+	catalog *Catalog
+}
+
+// T translates a string of the page
+func (v statusPageView) T(format string, args ...interface{}) string {
+	return v.catalog.Sprintf(v.Lang, format, args...)
+}
+
+// Minutes formats a wait in minutes
+func (v statusPageView) Minutes(seconds float64) string {
+	return v.T("%.1f min", seconds/60)
+}
+
+// statusPageTemplate renders the embeddable HTML status page
+var statusPageTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html lang="{{.Lang}}">
+<head>
+  <meta charset="utf-8">
+  <title>{{.T "Build Service Status"}}</title>
+  <style>
+    body { font-family: sans-serif; margin: 1rem; color: #222; }
+    .status { padding: .75rem 1rem; border-radius: 4px; color: #fff; font-weight: bold; }
+    .operational { background: #2e7d32; } .maintenance { background: #1565c0; }
+    .degraded { background: #ef6c00; } .major_outage { background: #c62828; }
+    small { color: #666; }
+  </style>
+</head>
+<body>
+  <div class="status {{.Status}}">{{.Description}}</div>
+  <p>{{.T "Queue: %d waiting, %d running. Typical wait %s (95th percentile %s)." .Queue.Queued .Queue.Running (.Minutes .Queue.WaitP50Seconds) (.Minutes .Queue.WaitP95Seconds)}}</p>
+  {{range .Incidents}}<h3>{{.Title}}</h3><p>{{.Message}}</p><small>{{$.T "Since %s" (.StartsAt.Format "2006-01-02 15:04 MST")}}</small>{{end}}
+  {{if .UpcomingMaintenance}}<h2>{{.T "Scheduled maintenance"}}</h2>{{end}}
+  {{range .UpcomingMaintenance}}<h3>{{.Title}}</h3><p>{{.Message}}</p><small>{{if .EndsAt}}{{$.T "%s to %s" (.StartsAt.Format "2006-01-02 15:04 MST") (.EndsAt.Format "2006-01-02 15:04 MST")}}{{else}}{{.StartsAt.Format "2006-01-02 15:04 MST"}}{{end}}</small>{{end}}
+  <p><small>{{.T "Updated %s" (.UpdatedAt.Format "2006-01-02 15:04:05 MST")}}</small></p>
+</body>
+</html>
+`))
+
+// Status page endpoint. Renders the status as a small HTML page for iframes.
+func (bs *BuildService) statusPageHandler(w http.ResponseWriter, r *http.Request) {
+	page, _, etag := bs.localizedStatusPage(requestLocale(r))
+	if bs.writeCacheHeaders(w, r, etag) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	view := statusPageView{StatusPage: page, Lang: requestLocale(r), catalog: bs.catalog}
+	if err := statusPageTemplate.Execute(w, view); err != nil {
+		log.Printf("Error rendering status page: %v", err)
+	}
+}
+
+// List incidents endpoint
+func (bs *BuildService) listIncidentsHandler(w http.ResponseWriter, r *http.Request) {
+	incidents, err := bs.db.ListIncidents(r.URL.Query().Get("all") == "true")
+	if err != nil {
+		log.Printf("Error listing incidents: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(incidents)
+}
+
+// Create incident endpoint
+func (bs *BuildService) createIncidentHandler(w http.ResponseWriter, r *http.Request) {
+	var incident Incident
+	if err := json.NewDecoder(r.Body).Decode(&incident); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if incident.StartsAt.IsZero() {
+		incident.StartsAt = time.Now().UTC()
+	}
+	if incident.Impact == "" {
+		incident.Impact = "none"
+	}
+	incident.ResolvedAt = nil
+	if err := validIncident(&incident); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := bs.db.CreateIncident(&incident); err != nil {
+		log.Printf("Error creating incident: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	bs.statusCache.Invalidate()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(incident)
+}
+
+// Update incident endpoint
+func (bs *BuildService) updateIncidentHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid incident ID", http.StatusBadRequest)
+		return
+	}
+
+	var update IncidentUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil && err != io.EOF {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	incident, err := bs.db.GetIncident(id)
+	if err != nil {
+		if err.Error() == "incident not found" {
+			http.Error(w, "Incident not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error getting incident: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now().UTC()
+	if update.Impact != nil {
+		incident.Impact = *update.Impact
+	}
+	if update.Title != nil {
+		incident.Title = *update.Title
+	}
+	if update.Message != nil {
+		incident.Message = *update.Message
+	}
+	if update.StartsAt != nil {
+		incident.StartsAt = *update.StartsAt
+	}
+	if update.EndsAt != nil {
+		incident.EndsAt = update.EndsAt
+	}
+	if update.Resolved != nil {
+		incident.ResolvedAt = nil
+		if *update.Resolved {
+			incident.ResolvedAt = &now
+		}
+	}
+	if err := validIncident(incident); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	incident.UpdatedAt = now
+
+	if err := bs.db.UpdateIncident(incident); err != nil {
+		log.Printf("Error updating incident: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	bs.statusCache.Invalidate()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(incident)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompileStatusPage(t *testing.T) {
+	now := time.Now().UTC()
+	old := now.Add(-time.Hour)
+	recent := now.Add(-time.Minute)
+	later := now.Add(time.Hour)
+
+	tests := []struct {
+		name             string
+		pingError        error
+		stats            *QueueStats
+		incidents        []*Incident
+		expectedStatus   string
+		expectedActive   int
+		expectedUpcoming int
+	}{
+		{"operational", nil, &QueueStats{Queued: 2, OldestQueuedAt: &recent}, nil, statusOperational, 0, 0},
+		{"database down", fmt.Errorf("connection refused"), nil, nil, statusMajorOutage, 0, 0},
+		{"queue backlog", nil, &QueueStats{Queued: 40, OldestQueuedAt: &old}, nil, statusDegraded, 0, 0},
+		{"maintenance in progress", nil, &QueueStats{}, []*Incident{{Kind: "maintenance", Impact: "none", StartsAt: old, EndsAt: &later}}, statusMaintenance, 1, 0},
+		{"major incident", nil, &QueueStats{}, []*Incident{{Kind: "incident", Impact: "major", StartsAt: old}, {Kind: "incident", Impact: "minor", StartsAt: old}}, statusMajorOutage, 2, 0},
+		{"upcoming maintenance", nil, &QueueStats{}, []*Incident{{Kind: "maintenance", Impact: "none", StartsAt: later}}, statusOperational, 0, 1},
+		{"ended maintenance", nil, &QueueStats{}, []*Incident{{Kind: "maintenance", Impact: "none", StartsAt: old, EndsAt: &recent}}, statusOperational, 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service, mockDB := setupTestService()
+			mockDB.On("Ping").Return(tt.pingError).Once()
+			if tt.pingError == nil {
+				mockDB.On("GetQueueStats", mock.AnythingOfType("time.Time")).Return(tt.stats, nil).Once()
+				mockDB.On("ListIncidents", false).Return(tt.incidents, nil).Once()
+			}
+
+			page := service.compileStatusPage(now, 15*time.Minute)
+			assert.Equal(t, tt.expectedStatus, page.Status)
+			assert.Equal(t, statusDescriptions[tt.expectedStatus], page.Description)
+			assert.Len(t, page.Incidents, tt.expectedActive)
+			assert.Len(t, page.UpcomingMaintenance, tt.expectedUpcoming)
+			mockDB.AssertExpectations(t)
+		})
+	}
+}
+
+func TestStatusHandlerCaching(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.On("Ping").Return(nil).Once()
+	mockDB.On("GetQueueStats", mock.AnythingOfType("time.Time")).Return(&QueueStats{Queued: 1, WaitP50: 30 * time.Second}, nil).Once()
+	mockDB.On("ListIncidents", false).Return([]*Incident{}, nil).Once()
+
+	req := httptest.NewRequest("GET", "/api/v1/status", nil)
+	w := httptest.NewRecorder()
+	service.statusHandler(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "public, max-age=30", w.Header().Get("Cache-Control"))
+	assert.Equal(t, "*", w.Header().Get("Access-Control-Allow-Origin"))
+	etag := w.Header().Get("ETag")
+	require.NotEmpty(t, etag)
+
+	var page StatusPage
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&page))
+	assert.Equal(t, statusOperational, page.Status)
+	assert.Equal(t, float64(30), page.Queue.WaitP50Seconds)
+
+	// Served from the cache without touching the database
+	req = httptest.NewRequest("GET", "/status", nil)
+	req.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	service.statusPageHandler(w, req)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+
+	req = httptest.NewRequest("GET", "/status", nil)
+	w = httptest.NewRecorder()
+	service.statusPageHandler(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "All systems operational")
+
+	mockDB.AssertExpectations(t)
+}
+
+func TestCreateIncidentHandler(t *testing.T) {
+	tests := []struct {
+		name           string
+		body           string
+		expectedStatus int
+	}{
+		{"incident", `{"kind":"incident","impact":"minor","title":"Slow builds"}`, http.StatusCreated},
+		{"maintenance", `{"kind":"maintenance","title":"Database upgrade","starts_at":"2030-01-01T00:00:00Z","ends_at":"2030-01-01T01:00:00Z"}`, http.StatusCreated},
+		{"missing title", `{"kind":"incident","impact":"minor"}`, http.StatusBadRequest},
+		{"unknown kind", `{"kind":"outage","impact":"minor","title":"Down"}`, http.StatusBadRequest},
+		{"ends before start", `{"kind":"maintenance","title":"Upgrade","starts_at":"2030-01-01T01:00:00Z","ends_at":"2030-01-01T00:00:00Z"}`, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service, mockDB := setupTestService()
+			if tt.expectedStatus == http.StatusCreated {
+				mockDB.On("CreateIncident", mock.AnythingOfType("*main.Incident")).Return(nil).Once()
+			}
+
+			req := httptest.NewRequest("POST", "/api/v1/admin/incidents", bytes.NewBufferString(tt.body))
+			w := httptest.NewRecorder()
+			service.createIncidentHandler(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			mockDB.AssertExpectations(t)
+		})
+	}
+}
+
+func TestUpdateIncidentHandler(t *testing.T) {
+	service, mockDB := setupTestService()
+	incident := &Incident{ID: 3, Kind: "incident", Impact: "major", Title: "Workers down", StartsAt: time.Now().Add(-time.Hour)}
+	mockDB.On("GetIncident", 3).Return(incident, nil).Once()
+	mockDB.On("UpdateIncident", mock.AnythingOfType("*main.Incident")).Return(nil).Once()
+	mockDB.On("GetIncident", 9).Return(nil, fmt.Errorf("incident not found")).Once()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/admin/incidents/{id}", service.updateIncidentHandler).Methods("PATCH")
+
+	req := httptest.NewRequest("PATCH", "/api/v1/admin/incidents/3", bytes.NewBufferString(`{"message":"Recovered","resolved":true}`))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var response Incident
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+	assert.Equal(t, "Recovered", response.Message)
+	assert.NotNil(t, response.ResolvedAt)
+
+	req = httptest.NewRequest("PATCH", "/api/v1/admin/incidents/9", bytes.NewBufferString(`{"resolved":true}`))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	mockDB.AssertExpectations(t)
+}
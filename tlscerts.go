@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hostCertificate is a certificate loaded from TLS_CERT_DIR, with the
+// modification time of its files when it was loaded
+type hostCertificate struct {
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// HostCertificates picks the server certificate by SNI hostname, so
+// organizations' vanity domains can have their own certificates. A host's
+// certificate is read from <host>.crt and <host>.key in TLS_CERT_DIR and
+// reloaded when the files change; hosts without one get the default
+// certificate, from TLS_CERT_FILE and TLS_KEY_FILE, which are reloaded the
+// same way, or from the PEM in TLS_CERT and TLS_KEY.
+type HostCertificates struct {
+	dir      string
+	certFile string
+	keyFile  string
+	fallback *tls.Certificate
+	// clientCAFile, when set, holds the CAs client certificates are verified
+	// against; it's reloaded when it changes
+	clientCAFile string
+	clientAuth   tls.ClientAuthType
+
+	mu        sync.Mutex
+	certs     map[string]*hostCertificate
+	clientCAs *x509.CertPool
+	caModTime time.Time
+}
+
+// clientAuthModes are the values of TLS_CLIENT_AUTH
+var clientAuthModes = map[string]tls.ClientAuthType{
+	"require":  tls.RequireAndVerifyClientCert,
+	"optional": tls.VerifyClientCertIfGiven,
+}
+
+// NewHostCertificatesFromEnv loads the certificates configured by
+// TLS_CERT_FILE, TLS_KEY_FILE, TLS_CERT, TLS_KEY and TLS_CERT_DIR, and the
+// client CAs in TLS_CLIENT_CA_FILE. Returns nil, to serve plain HTTP, when
+// no certificate is configured.
+func NewHostCertificatesFromEnv() (*HostCertificates, error) {
+	certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	certPEM, keyPEM := os.Getenv("TLS_CERT"), os.Getenv("TLS_KEY")
+	dir := os.Getenv("TLS_CERT_DIR")
+	clientCAFile := os.Getenv("TLS_CLIENT_CA_FILE")
+	if certFile == "" && keyFile == "" && certPEM == "" && keyPEM == "" && dir == "" {
+		if clientCAFile != "" {
+			return nil, fmt.Errorf("TLS_CLIENT_CA_FILE is set without a server certificate")
+		}
+		return nil, nil
+	}
+
+	hc := &HostCertificates{dir: dir, certs: make(map[string]*hostCertificate), clientCAFile: clientCAFile}
+	switch {
+	case (certFile != "" || keyFile != "") && (certPEM != "" || keyPEM != ""):
+		return nil, fmt.Errorf("set either TLS_CERT_FILE and TLS_KEY_FILE or TLS_CERT and TLS_KEY")
+	case certFile != "" || keyFile != "":
+		if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+			return nil, fmt.Errorf("loading TLS_CERT_FILE and TLS_KEY_FILE: %w", err)
+		}
+		hc.certFile, hc.keyFile = certFile, keyFile
+	case certPEM != "" || keyPEM != "":
+		cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+		if err != nil {
+			return nil, fmt.Errorf("parsing TLS_CERT and TLS_KEY: %w", err)
+		}
+		hc.fallback = &cert
+	}
+
+	if clientCAFile != "" {
+		mode := os.Getenv("TLS_CLIENT_AUTH")
+		if mode == "" {
+			mode = "require"
+		}
+		clientAuth, ok := clientAuthModes[mode]
+		if !ok {
+			return nil, fmt.Errorf("TLS_CLIENT_AUTH must be require or optional, got %q", mode)
+		}
+		hc.clientAuth = clientAuth
+		if hc.loadClientCAs() == nil {
+			return nil, fmt.Errorf("TLS_CLIENT_CA_FILE %s has no readable certificates", clientCAFile)
+		}
+	}
+	return hc, nil
+}
+
+// TLSConfig returns the server's TLS configuration
+func (hc *HostCertificates) TLSConfig() *tls.Config {
+	config := &tls.Config{
+		GetCertificate: hc.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	if hc.clientCAFile != "" {
+		config.ClientAuth = hc.clientAuth
+		config.ClientCAs = hc.loadClientCAs()
+		// Each handshake verifies against the CAs as currently on disk
+		config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			current := config.Clone()
+			current.GetConfigForClient = nil
+			current.ClientCAs = hc.loadClientCAs()
+			return current, nil
+		}
+	}
+	return config
+}
+
+// GetCertificate returns the certificate for the hostname the client asked for
+func (hc *HostCertificates) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if cert := hc.load(hello.ServerName); cert != nil {
+		return cert, nil
+	}
+	if hc.certFile != "" {
+		// Cached under the empty name, which isn't a hostname
+		if cert := hc.loadPair("", hc.certFile, hc.keyFile); cert != nil {
+			return cert, nil
+		}
+	}
+	if hc.fallback == nil {
+		return nil, fmt.Errorf("no certificate for %q", hello.ServerName)
+	}
+	return hc.fallback, nil
+}
+
+// load returns the certificate in the directory for host, or nil when there
+// isn't a readable one
+func (hc *HostCertificates) load(host string) *tls.Certificate {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if hc.dir == "" || !domainPattern.MatchString(host) {
+		return nil
+	}
+	return hc.loadPair(host, filepath.Join(hc.dir, host+".crt"), filepath.Join(hc.dir, host+".key"))
+}
+
+// loadPair returns the certificate in certFile and keyFile, cached under name
+// until the files change, or nil when there isn't a readable one
+func (hc *HostCertificates) loadPair(name, certFile, keyFile string) *tls.Certificate {
+	info, err := os.Stat(certFile)
+	if err != nil {
+		return nil
+	}
+	modTime := info.ModTime()
+	if keyInfo, err := os.Stat(keyFile); err == nil && keyInfo.ModTime().After(modTime) {
+		modTime = keyInfo.ModTime()
+	}
+
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if cached := hc.certs[name]; cached != nil && cached.modTime.Equal(modTime) {
+		return cached.cert
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		// Keep serving the previous certificate while a renewal is written
+		if cached := hc.certs[name]; cached != nil {
+			return cached.cert
+		}
+		return nil
+	}
+	hc.certs[name] = &hostCertificate{cert: &cert, modTime: modTime}
+	return &cert
+}
+
+// loadClientCAs returns the CAs in TLS_CLIENT_CA_FILE, reloading them when
+// the file changes, or nil when it has never been readable
+func (hc *HostCertificates) loadClientCAs() *x509.CertPool {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	info, err := os.Stat(hc.clientCAFile)
+	if err != nil || (hc.clientCAs != nil && info.ModTime().Equal(hc.caModTime)) {
+		return hc.clientCAs
+	}
+
+	bundle, err := os.ReadFile(hc.clientCAFile)
+	if err != nil {
+		return hc.clientCAs
+	}
+	pool := x509.NewCertPool()
+	// Keep the previous CAs while a rotated bundle is written
+	if !pool.AppendCertsFromPEM(bundle) {
+		return hc.clientCAs
+	}
+	hc.clientCAs, hc.caModTime = pool, info.ModTime()
+	return pool
+}
+
+// clientCertificateName returns the common name of the verified client
+// certificate a request was made with, or ""
+func clientCertificateName(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
+
+// httpsRedirect redirects plain HTTP requests to the same URL over HTTPS on
+// httpsPort. Methods other than GET and HEAD get a 308 so clients resend
+// their body.
+func httpsRedirect(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+		status := http.StatusMovedPermanently
+		if r.Method != "GET" && r.Method != "HEAD" {
+			status = http.StatusPermanentRedirect
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), status)
+	})
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestCertificate writes a self-signed certificate for host to
+// <dir>/<name>.crt and <dir>/<name>.key
+func writeTestCertificate(t *testing.T, dir, name, host string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+}
+
+func TestHostCertificatesPickTheCertificateBySNI(t *testing.T) {
+	dir := t.TempDir()
+	writeTestCertificate(t, dir, "default", "ci.example.com")
+	writeTestCertificate(t, dir, "ci.acme.dev", "ci.acme.dev")
+	t.Setenv("TLS_CERT_FILE", filepath.Join(dir, "default.crt"))
+	t.Setenv("TLS_KEY_FILE", filepath.Join(dir, "default.key"))
+	t.Setenv("TLS_CERT_DIR", dir)
+
+	certs, err := NewHostCertificatesFromEnv()
+	require.NoError(t, err)
+	require.NotNil(t, certs)
+
+	commonName := func(host string) string {
+		cert, err := certs.GetCertificate(&tls.ClientHelloInfo{ServerName: host})
+		require.NoError(t, err)
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		require.NoError(t, err)
+		return leaf.Subject.CommonName
+	}
+	assert.Equal(t, "ci.acme.dev", commonName("CI.acme.dev"))
+	assert.Equal(t, "ci.example.com", commonName("ci.globex.dev"))
+	assert.Equal(t, "ci.example.com", commonName("../default"), "hostnames can't escape the directory")
+
+	// Renewed certificates are picked up
+	writeTestCertificate(t, dir, "ci.acme.dev", "ci.acme.dev")
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(filepath.Join(dir, "ci.acme.dev.crt"), later, later))
+	before := certs.certs["ci.acme.dev"].cert
+	assert.Equal(t, "ci.acme.dev", commonName("ci.acme.dev"))
+	assert.NotSame(t, before, certs.certs["ci.acme.dev"].cert)
+}
+
+func TestHostCertificatesFromEnv(t *testing.T) {
+	t.Setenv("TLS_CERT_FILE", "")
+	t.Setenv("TLS_KEY_FILE", "")
+	t.Setenv("TLS_CERT_DIR", "")
+	certs, err := NewHostCertificatesFromEnv()
+	assert.NoError(t, err)
+	assert.Nil(t, certs, "TLS is off by default")
+
+	t.Setenv("TLS_CERT_FILE", filepath.Join(t.TempDir(), "missing.crt"))
+	_, err = NewHostCertificatesFromEnv()
+	assert.Error(t, err)
+}
+
+func TestHostCertificatesReloadTheDefaultCertificate(t *testing.T) {
+	dir := t.TempDir()
+	writeTestCertificate(t, dir, "default", "ci.example.com")
+	t.Setenv("TLS_CERT_FILE", filepath.Join(dir, "default.crt"))
+	t.Setenv("TLS_KEY_FILE", filepath.Join(dir, "default.key"))
+	t.Setenv("TLS_CERT_DIR", "")
+
+	certs, err := NewHostCertificatesFromEnv()
+	require.NoError(t, err)
+	first, err := certs.GetCertificate(&tls.ClientHelloInfo{ServerName: "ci.example.com"})
+	require.NoError(t, err)
+
+	writeTestCertificate(t, dir, "default", "ci.example.com")
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(filepath.Join(dir, "default.crt"), later, later))
+	renewed, err := certs.GetCertificate(&tls.ClientHelloInfo{ServerName: "ci.example.com"})
+	require.NoError(t, err)
+	assert.NotEqual(t, first.Certificate[0], renewed.Certificate[0])
+
+	// A half-written renewal doesn't interrupt service
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "default.key"), []byte("partial"), 0o600))
+	current, err := certs.GetCertificate(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	assert.Equal(t, renewed.Certificate[0], current.Certificate[0])
+}
+
+func TestHostCertificatesFromPEMEnv(t *testing.T) {
+	dir := t.TempDir()
+	writeTestCertificate(t, dir, "default", "ci.example.com")
+	certPEM, err := os.ReadFile(filepath.Join(dir, "default.crt"))
+	require.NoError(t, err)
+	keyPEM, err := os.ReadFile(filepath.Join(dir, "default.key"))
+	require.NoError(t, err)
+	t.Setenv("TLS_CERT_FILE", "")
+	t.Setenv("TLS_KEY_FILE", "")
+	t.Setenv("TLS_CERT_DIR", "")
+	t.Setenv("TLS_CERT", string(certPEM))
+	t.Setenv("TLS_KEY", string(keyPEM))
+
+	certs, err := NewHostCertificatesFromEnv()
+	require.NoError(t, err)
+	cert, err := certs.GetCertificate(&tls.ClientHelloInfo{ServerName: "ci.example.com"})
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	assert.Equal(t, "ci.example.com", leaf.Subject.CommonName)
+
+	t.Setenv("TLS_CERT_FILE", filepath.Join(dir, "default.crt"))
+	t.Setenv("TLS_KEY_FILE", filepath.Join(dir, "default.key"))
+	_, err = NewHostCertificatesFromEnv()
+	assert.Error(t, err, "only one default certificate can be configured")
+
+	t.Setenv("TLS_CERT_FILE", "")
+	t.Setenv("TLS_KEY_FILE", "")
+	t.Setenv("TLS_KEY", "not a key")
+	_, err = NewHostCertificatesFromEnv()
+	assert.Error(t, err)
+}
+
+// testCA is a certificate authority issuing client certificates in tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a client certificate for name signed by the CA
+func (ca *testCA) issue(t *testing.T, name string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestHostCertificatesVerifyClientCertificates(t *testing.T) {
+	dir := t.TempDir()
+	writeTestCertificate(t, dir, "default", "ci.example.com")
+	ca, otherCA := newTestCA(t), newTestCA(t)
+	caFile := filepath.Join(dir, "clients.pem")
+	require.NoError(t, os.WriteFile(caFile, ca.pem, 0o600))
+	t.Setenv("TLS_CERT_FILE", filepath.Join(dir, "default.crt"))
+	t.Setenv("TLS_KEY_FILE", filepath.Join(dir, "default.key"))
+	t.Setenv("TLS_CERT_DIR", "")
+	t.Setenv("TLS_CLIENT_CA_FILE", caFile)
+
+	serve := func(mode string) *httptest.Server {
+		t.Setenv("TLS_CLIENT_AUTH", mode)
+		certs, err := NewHostCertificatesFromEnv()
+		require.NoError(t, err)
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, clientCertificateName(r))
+		}))
+		server.TLS = certs.TLSConfig()
+		server.StartTLS()
+		t.Cleanup(server.Close)
+		return server
+	}
+	get := func(server *httptest.Server, cert *tls.Certificate) (string, error) {
+		config := &tls.Config{InsecureSkipVerify: true}
+		if cert != nil {
+			config.Certificates = []tls.Certificate{*cert}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	deployer, stranger := ca.issue(t, "deployer"), otherCA.issue(t, "stranger")
+	server := serve("")
+	name, err := get(server, &deployer)
+	require.NoError(t, err)
+	assert.Equal(t, "deployer", name)
+	_, err = get(server, nil)
+	assert.Error(t, err, "a client certificate is required by default")
+	_, err = get(server, &stranger)
+	assert.Error(t, err)
+
+	// Rotated CA bundles are picked up
+	require.NoError(t, os.WriteFile(caFile, append(ca.pem, otherCA.pem...), 0o600))
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(caFile, later, later))
+	name, err = get(server, &stranger)
+	require.NoError(t, err)
+	assert.Equal(t, "stranger", name)
+
+	// Optional verification lets clients without a certificate in
+	server = serve("optional")
+	name, err = get(server, nil)
+	require.NoError(t, err)
+	assert.Empty(t, name)
+	name, err = get(server, &deployer)
+	require.NoError(t, err)
+	assert.Equal(t, "deployer", name)
+
+	t.Setenv("TLS_CLIENT_AUTH", "sometimes")
+	_, err = NewHostCertificatesFromEnv()
+	assert.Error(t, err)
+	t.Setenv("TLS_CLIENT_AUTH", "")
+	t.Setenv("TLS_CERT_FILE", "")
+	t.Setenv("TLS_KEY_FILE", "")
+	_, err = NewHostCertificatesFromEnv()
+	assert.Error(t, err, "client verification needs TLS")
+}
+
+func TestHTTPSRedirect(t *testing.T) {
+	tests := []struct {
+		method, target, port string
+		status               int
+		location             string
+	}{
+		{"GET", "http://ci.example.com/api/v1/builds?status=failed", "443", http.StatusMovedPermanently, "https://ci.example.com/api/v1/builds?status=failed"},
+		{"GET", "http://ci.example.com:8080/health", "8443", http.StatusMovedPermanently, "https://ci.example.com:8443/health"},
+		{"POST", "http://ci.example.com/api/v1/builds", "443", http.StatusPermanentRedirect, "https://ci.example.com/api/v1/builds"},
+	}
+	for _, tt := range tests {
+		rr := httptest.NewRecorder()
+		httpsRedirect(tt.port).ServeHTTP(rr, httptest.NewRequest(tt.method, tt.target, nil))
+		assert.Equal(t, tt.status, rr.Code, tt.target)
+		assert.Equal(t, tt.location, rr.Header().Get("Location"), tt.target)
+	}
+}
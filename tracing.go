@@ -0,0 +1,479 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Span kinds and status codes of the OTLP trace data model
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindConsumer = 5
+
+	spanStatusOK    = 1
+	spanStatusError = 2
+)
+
+// SpanContext identifies a span within a trace, as carried by the W3C
+// traceparent header
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+// parseTraceParent parses a version 00 traceparent header value
+func parseTraceParent(value string) (SpanContext, bool) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil || sc.TraceID == [16]byte{} {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil || sc.SpanID == [8]byte{} {
+		return sc, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return sc, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, true
+}
+
+// TraceParent formats the span context as a traceparent header value
+func (sc SpanContext) TraceParent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(sc.TraceID[:]) + "-" + hex.EncodeToString(sc.SpanID[:]) + "-" + flags
+}
+
+// Span is a timed operation in a trace. A nil span, as started by a disabled
+// tracer, ignores everything.
+type Span struct {
+	tracer     *Tracer
+	name       string
+	kind       int
+	context    SpanContext
+	parent     [8]byte
+	start      time.Time
+	attributes map[string]interface{}
+	err        error
+}
+
+// Context returns the span's context, zero for a nil span
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.context
+}
+
+// TraceParent returns the traceparent that makes new spans children of s,
+// or "" for a nil span
+func (s *Span) TraceParent() string {
+	if s == nil {
+		return ""
+	}
+	return s.context.TraceParent()
+}
+
+// SetAttribute records a string, bool or integer attribute on the span
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s != nil {
+		s.attributes[key] = value
+	}
+}
+
+// SetError marks the span as failed
+func (s *Span) SetError(err error) {
+	if s != nil {
+		s.err = err
+	}
+}
+
+// End finishes the span now and queues it for export
+func (s *Span) End() {
+	s.EndAt(time.Now())
+}
+
+// EndAt finishes the span at the given time and queues it for export
+func (s *Span) EndAt(end time.Time) {
+	if s == nil || !s.context.Sampled {
+		return
+	}
+	s.tracer.export(otlpSpan(s, end))
+}
+
+type spanContextKey struct{}
+
+// spanFromContext returns the span stored in ctx by the tracing middleware
+func spanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanContextKey{}).(*Span)
+	return span
+}
+
+// Tracer records spans of API requests and builds and exports them to an
+// OpenTelemetry collector over OTLP/HTTP with JSON encoding. Spans are
+// batched and sent in the background.
+type Tracer struct {
+	endpoint string
+	headers  map[string]string
+	service  string
+	client   *http.Client
+	errors   *ErrorTracker
+
+	spans     chan map[string]interface{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewTracerFromEnv returns a tracer exporting to OTEL_EXPORTER_OTLP_ENDPOINT,
+// or nil when tracing is disabled
+func NewTracerFromEnv(errors *ErrorTracker) *Tracer {
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	if endpoint == "" {
+		return nil
+	}
+
+	headers := make(map[string]string)
+	for _, pair := range strings.Split(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), ",") {
+		if key, value, ok := strings.Cut(pair, "="); ok {
+			headers[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+	service := os.Getenv("OTEL_SERVICE_NAME")
+	if service == "" {
+		service = "build-service"
+	}
+	return NewTracer(endpoint, service, headers, errors)
+}
+
+// NewTracer creates a tracer posting to the /v1/traces path of endpoint
+func NewTracer(endpoint, service string, headers map[string]string, errors *ErrorTracker) *Tracer {
+	t := &Tracer{
+		endpoint: strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		headers:  headers,
+		service:  service,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		errors:   errors,
+		spans:    make(chan map[string]interface{}, 1000),
+		done:     make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// Start begins a span. Its parent is the span in ctx or, failing that, the
+// traceparent given; without either it starts a new trace. The returned
+// context carries the new span.
+func (t *Tracer) Start(ctx context.Context, name string, kind int, traceParent string) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	span := &Span{tracer: t, name: name, kind: kind, start: time.Now(), attributes: make(map[string]interface{})}
+	if parent := spanFromContext(ctx); parent != nil {
+		span.context.TraceID, span.parent, span.context.Sampled = parent.context.TraceID, parent.context.SpanID, parent.context.Sampled
+	} else if parent, ok := parseTraceParent(traceParent); ok {
+		span.context.TraceID, span.parent, span.context.Sampled = parent.TraceID, parent.SpanID, parent.Sampled
+	} else {
+		rand.Read(span.context.TraceID[:])
+		span.context.Sampled = true
+	}
+	rand.Read(span.context.SpanID[:])
+	return context.WithValue(ctx, spanContextKey{}, span), span
+}
+
+// Record exports a finished child of the span in ctx covering start to end
+func (t *Tracer) Record(ctx context.Context, name string, start, end time.Time) {
+	_, span := t.Start(ctx, name, spanKindInternal, "")
+	if span != nil {
+		span.start = start
+	}
+	span.EndAt(end)
+}
+
+// Middleware records a server span for every request, continuing the trace
+// of an incoming traceparent header
+func (t *Tracer) Middleware(next http.Handler) http.Handler {
+	if t == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeTemplate(r)
+		ctx, span := t.Start(r.Context(), r.Method+" "+route, spanKindServer, r.Header.Get("traceparent"))
+		span.SetAttribute("http.request.method", r.Method)
+		span.SetAttribute("http.route", route)
+
+		rw := newResponseWriter(w)
+		next.ServeHTTP(rw, r.WithContext(ctx))
+
+		span.SetAttribute("http.response.status_code", rw.status)
+		if rw.status >= 500 {
+			span.SetError(fmt.Errorf("%s", http.StatusText(rw.status)))
+		}
+		span.End()
+	})
+}
+
+// export queues a span for the next batch
+func (t *Tracer) export(span map[string]interface{}) {
+	select {
+	case t.spans <- span:
+	default:
+		log.Printf("Tracer buffer full, dropping span %v", span["name"])
+	}
+}
+
+// Forward sends OTLP/JSON trace data reported by build tooling on to the
+// collector as it is
+func (t *Tracer) Forward(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range t.headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// run sends spans in batches of up to 100, at least every five seconds
+func (t *Tracer) run() {
+	defer close(t.done)
+
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	var batch []map[string]interface{}
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.send(batch); err != nil {
+			t.errors.Capture("tracing", fmt.Errorf("exporting %d spans: %w", len(batch), err), nil)
+		}
+		batch = nil
+	}
+
+	for {
+		select {
+		case span, ok := <-t.spans:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, span)
+			if len(batch) >= 100 {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func (t *Tracer) send(spans []map[string]interface{}) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(map[string]interface{}{"service.name": t.service}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "build-service"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return t.Forward(ctx, body)
+}
+
+// Close stops accepting spans and waits for queued spans to be sent
+func (t *Tracer) Close(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	t.closeOnce.Do(func() { close(t.spans) })
+
+	select {
+	case <-t.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// otlpSpan encodes a finished span in the OTLP/JSON format
+func otlpSpan(s *Span, end time.Time) map[string]interface{} {
+	span := map[string]interface{}{
+		"traceId":           hex.EncodeToString(s.context.TraceID[:]),
+		"spanId":            hex.EncodeToString(s.context.SpanID[:]),
+		"name":              s.name,
+		"kind":              s.kind,
+		"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(end.UnixNano(), 10),
+		"attributes":        otlpAttributes(s.attributes),
+		"status":            map[string]interface{}{"code": spanStatusOK},
+	}
+	if s.parent != [8]byte{} {
+		span["parentSpanId"] = hex.EncodeToString(s.parent[:])
+	}
+	if s.err != nil {
+		span["status"] = map[string]interface{}{"code": spanStatusError, "message": s.err.Error()}
+	}
+	return span
+}
+
+// otlpAttributes encodes attributes as OTLP key/value pairs
+func otlpAttributes(attributes map[string]interface{}) []interface{} {
+	encoded := make([]interface{}, 0, len(attributes))
+	for key, value := range attributes {
+		var v map[string]interface{}
+		switch value := value.(type) {
+		case bool:
+			v = map[string]interface{}{"boolValue": value}
+		case int:
+			v = map[string]interface{}{"intValue": strconv.Itoa(value)}
+		default:
+			v = map[string]interface{}{"stringValue": fmt.Sprint(value)}
+		}
+		encoded = append(encoded, map[string]interface{}{"key": key, "value": v})
+	}
+	return encoded
+}
+
+// Build traces endpoint. Accepts OTLP/JSON spans from the tooling of a running
+// build and forwards them to the collector, provided they belong to the
+// build's own trace.
+func (bs *BuildService) buildTracesHandler(w http.ResponseWriter, r *http.Request) {
+	if bs.tracer == nil {
+		http.Error(w, "Tracing is disabled", http.StatusNotFound)
+		return
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid build ID", http.StatusBadRequest)
+		return
+	}
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		http.Error(w, "Only OTLP/JSON is supported", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	build, err := bs.db.GetBuild(id)
+	if err != nil {
+		if err.Error() == "build not found" {
+			http.Error(w, "Build not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error getting build: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if build.Status != "running" {
+		http.Error(w, "Build is not running", http.StatusConflict)
+		return
+	}
+	sc, ok := parseTraceParent(build.TraceParent)
+	if !ok {
+		http.Error(w, "Build has no trace", http.StatusConflict)
+		return
+	}
+
+	var data struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []interface{} `json:"attributes"`
+			} `json:"resource"`
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceID string `json:"traceId"`
+				} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	var raw map[string]interface{}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 4<<20))
+	if err != nil || json.Unmarshal(body, &data) != nil || json.Unmarshal(body, &raw) != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Spans may only join the build's trace, not any other
+	traceID := hex.EncodeToString(sc.TraceID[:])
+	for _, rs := range data.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			for _, span := range ss.Spans {
+				if !strings.EqualFold(span.TraceID, traceID) {
+					http.Error(w, "Spans must belong to the build's trace", http.StatusBadRequest)
+					return
+				}
+			}
+		}
+	}
+
+	// Tag every resource with the build so spans can be found by it
+	resourceSpans, _ := raw["resourceSpans"].([]interface{})
+	for i, rs := range data.ResourceSpans {
+		entry, ok := resourceSpans[i].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		resource, ok := entry["resource"].(map[string]interface{})
+		if !ok {
+			resource = make(map[string]interface{})
+			entry["resource"] = resource
+		}
+		resource["attributes"] = append(rs.Resource.Attributes, otlpAttributes(map[string]interface{}{"build.id": build.ID})...)
+	}
+	body, _ = json.Marshal(raw)
+
+	if err := bs.tracer.Forward(r.Context(), body); err != nil {
+		bs.errors.Capture("tracing", fmt.Errorf("forwarding spans: %w", err), build)
+		http.Error(w, "Failed to forward spans", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte("{}"))
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCollector records the bodies of OTLP requests it receives
+type testCollector struct {
+	*httptest.Server
+	mu     sync.Mutex
+	bodies []map[string]interface{}
+}
+
+func newTestCollector() *testCollector {
+	c := &testCollector{}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var data map[string]interface{}
+		json.Unmarshal(body, &data)
+		c.mu.Lock()
+		c.bodies = append(c.bodies, data)
+		c.mu.Unlock()
+	}))
+	return c
+}
+
+// spans returns every span received, by name
+func (c *testCollector) spans() map[string]map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	spans := make(map[string]map[string]interface{})
+	for _, body := range c.bodies {
+		for _, rs := range body["resourceSpans"].([]interface{}) {
+			for _, ss := range rs.(map[string]interface{})["scopeSpans"].([]interface{}) {
+				for _, span := range ss.(map[string]interface{})["spans"].([]interface{}) {
+					span := span.(map[string]interface{})
+					spans[span["name"].(string)] = span
+				}
+			}
+		}
+	}
+	return spans
+}
+
+func testTracer(endpoint string) *Tracer {
+	errors := NewErrorTracker(&LogErrorReporter{}, prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_errors_total"}, []string{"subsystem"}))
+	return NewTracer(endpoint, "build-service", map[string]string{"Authorization": "Bearer token"}, errors)
+}
+
+func TestTraceParent(t *testing.T) {
+	sc, ok := parseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	require.True(t, ok)
+	assert.True(t, sc.Sampled)
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", sc.TraceParent())
+
+	for _, value := range []string{
+		"",
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473z-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+	} {
+		_, ok := parseTraceParent(value)
+		assert.False(t, ok, value)
+	}
+}
+
+func TestTracerMiddleware(t *testing.T) {
+	collector := newTestCollector()
+	defer collector.Close()
+	tracer := testTracer(collector.URL)
+
+	var traceParent string
+	router := mux.NewRouter()
+	router.Use(tracer.Middleware)
+	router.HandleFunc("/api/v1/builds/{id}", func(w http.ResponseWriter, r *http.Request) {
+		traceParent = spanFromContext(r.Context()).TraceParent()
+		tracer.Record(r.Context(), "lookup", time.Now().Add(-time.Second), time.Now())
+	})
+
+	req := httptest.NewRequest("GET", "/api/v1/builds/7", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	require.NoError(t, tracer.Close(context.Background()))
+
+	// The request continues the caller's trace and is propagated to builds
+	sc, ok := parseTraceParent(traceParent)
+	require.True(t, ok)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceParent()[3:35])
+
+	spans := collector.spans()
+	require.Contains(t, spans, "GET /api/v1/builds/{id}")
+	server := spans["GET /api/v1/builds/{id}"]
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", server["traceId"])
+	assert.Equal(t, "00f067aa0ba902b7", server["parentSpanId"])
+	assert.Equal(t, float64(spanKindServer), server["kind"])
+	require.Contains(t, spans, "lookup")
+	assert.Equal(t, server["spanId"], spans["lookup"]["parentSpanId"])
+}
+
+func TestTracerDisabled(t *testing.T) {
+	var tracer *Tracer
+	ctx, span := tracer.Start(context.Background(), "build 1", spanKindConsumer, "")
+	span.SetAttribute("build.id", 1)
+	span.SetError(assert.AnError)
+	span.End()
+	tracer.Record(ctx, "build.queued", time.Now(), time.Now())
+	assert.Equal(t, "", span.TraceParent())
+	assert.Nil(t, spanFromContext(ctx))
+	assert.NoError(t, tracer.Close(context.Background()))
+}
+
+func TestBuildTracesHandler(t *testing.T) {
+	collector := newTestCollector()
+	defer collector.Close()
+	service, mockDB := setupTestService()
+	service.tracer = testTracer(collector.URL)
+	defer service.tracer.Close(context.Background())
+
+	mockDB.On("GetBuild", 1).Return(&BuildRequest{ID: 1, Status: "running", TraceParent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}, nil)
+	mockDB.On("GetBuild", 2).Return(&BuildRequest{ID: 2, Status: "success", TraceParent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}, nil)
+
+	post := func(id, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/v1/builds/"+id+"/otlp/v1/traces", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		req = mux.SetURLVars(req, map[string]string{"id": id})
+		rr := httptest.NewRecorder()
+		service.buildTracesHandler(rr, req)
+		return rr
+	}
+	spans := func(traceID string) string {
+		return `{"resourceSpans":[{"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"go test"}}]},"scopeSpans":[{"spans":[{"traceId":"` + traceID + `","spanId":"1111111111111111","name":"compile"}]}]}]}`
+	}
+
+	assert.Equal(t, http.StatusOK, post("1", spans("4bf92f3577b34da6a3ce929d0e0e4736")).Code)
+	assert.Equal(t, http.StatusBadRequest, post("1", spans("ffffffffffffffffffffffffffffffff")).Code)
+	assert.Equal(t, http.StatusBadRequest, post("1", `{`).Code)
+	assert.Equal(t, http.StatusConflict, post("2", spans("4bf92f3577b34da6a3ce929d0e0e4736")).Code)
+
+	require.Contains(t, collector.spans(), "compile")
+	collector.mu.Lock()
+	resource := collector.bodies[0]["resourceSpans"].([]interface{})[0].(map[string]interface{})["resource"].(map[string]interface{})
+	collector.mu.Unlock()
+	assert.Contains(t, resource["attributes"], map[string]interface{}{"key": "build.id", "value": map[string]interface{}{"intValue": "1"}})
+
+	service.tracer = nil
+	assert.Equal(t, http.StatusNotFound, post("1", spans("4bf92f3577b34da6a3ce929d0e0e4736")).Code)
+}
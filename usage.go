@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// APIUsage is the number of requests of one caller to one endpoint on one day.
+// Callers are stored as a truncated hash so the table holds no credentials or
+// addresses.
+type APIUsage struct {
+	Day           time.Time `json:"day" db:"day"`
+	Org           string    `json:"org" db:"org"`
+	Method        string    `json:"method" db:"method"`
+	Route         string    `json:"route" db:"route"`
+	Client        string    `json:"client" db:"client"`
+	ClientVersion string    `json:"client_version" db:"client_version"`
+	Caller        string    `json:"-" db:"caller"`
+	Requests      int64     `json:"requests" db:"requests"`
+	Errors        int64     `json:"errors" db:"errors"`
+	LastSeen      time.Time `json:"last_seen" db:"last_seen"`
+}
+
+// UsageCount aggregates requests and distinct callers
+type UsageCount struct {
+	Requests      int64 `json:"requests"`
+	Errors        int64 `json:"errors"`
+	UniqueCallers int64 `json:"unique_callers"`
+}
+
+// EndpointUsage is the usage of one endpoint
+type EndpointUsage struct {
+	Method string `json:"method"`
+	Route  string `json:"route"`
+	UsageCount
+}
+
+// OrgUsage is the usage of one organization
+type OrgUsage struct {
+	Org string `json:"org"`
+	UsageCount
+}
+
+// ClientVersionUsage is the usage of one client or SDK version
+type ClientVersionUsage struct {
+	Client  string `json:"client"`
+	Version string `json:"version"`
+	UsageCount
+}
+
+// UsageReport summarises API usage since a given day
+type UsageReport struct {
+	Since     time.Time            `json:"since"`
+	Org       string               `json:"org,omitempty"`
+	Total     UsageCount           `json:"total"`
+	Endpoints []EndpointUsage      `json:"endpoints"`
+	Orgs      []OrgUsage           `json:"orgs"`
+	Clients   []ClientVersionUsage `json:"clients"`
+}
+
+type usageKey struct {
+	day                                 string
+	org, method, route, client, version string
+	caller                              string
+}
+
+// UsageTracker counts requests per endpoint, organization, client version and
+// caller in memory and periodically adds the counts to the api_usage table
+type UsageTracker struct {
+	db        DatabaseInterface
+	errors    *ErrorTracker
+	interval  time.Duration
+	retention time.Duration
+
+	mu      sync.Mutex
+	pending map[usageKey]*APIUsage
+}
+
+// NewUsageTrackerFromEnv creates a usage tracker configured from the environment
+func NewUsageTrackerFromEnv(db DatabaseInterface, errors *ErrorTracker) *UsageTracker {
+	return &UsageTracker{
+		db:        db,
+		errors:    errors,
+		interval:  getEnvDuration("USAGE_FLUSH_INTERVAL", time.Minute),
+		retention: getEnvDuration("USAGE_RETENTION", 90*24*time.Hour),
+		pending:   make(map[usageKey]*APIUsage),
+	}
+}
+
+// requestOrg returns the organization a request was made on behalf of, as
+// set by the API gateway in X-Organization
+func requestOrg(r *http.Request) string {
+	if org := strings.ToLower(strings.TrimSpace(r.Header.Get("X-Organization"))); org != "" {
+		return org
+	}
+	return "unknown"
+}
+
+// callerID identifies the caller by its verified credentials, falling back
+// to its address, hashed so that neither is stored. It must run after the
+// tenancy middleware, which verifies them.
+func callerID(r *http.Request) string {
+	identity := requestTenant(r).identity()
+	if identity == "" {
+		identity = "ip:" + clientIP(r)
+	}
+
+	sum := sha256.Sum256([]byte(identity))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Middleware counts every request. It must run after the deprecation
+// middleware, which identifies the client.
+func (ut *UsageTracker) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := newResponseWriter(w)
+		next.ServeHTTP(rw, r)
+
+		client := clientFromContext(r.Context())
+		ut.record(usageKey{
+			org:     requestOrg(r),
+			method:  r.Method,
+			route:   routeTemplate(r),
+			client:  client.Name,
+			version: client.Version,
+			caller:  callerID(r),
+		}, rw.status >= 400, time.Now().UTC())
+	})
+}
+
+func (ut *UsageTracker) record(key usageKey, failed bool, now time.Time) {
+	day := now.Truncate(24 * time.Hour)
+	key.day = day.Format("2006-01-02")
+
+	ut.mu.Lock()
+	defer ut.mu.Unlock()
+
+	usage := ut.pending[key]
+	if usage == nil {
+		usage = &APIUsage{
+			Day:           day,
+			Org:           key.org,
+			Method:        key.method,
+			Route:         key.route,
+			Client:        key.client,
+			ClientVersion: key.version,
+			Caller:        key.caller,
+		}
+		ut.pending[key] = usage
+	}
+	usage.Requests++
+	if failed {
+		usage.Errors++
+	}
+	usage.LastSeen = now
+}
+
+// Start flushes counts every interval and prunes usage older than the
+// retention period daily. Call Flush on shutdown to keep the final counts.
+func (ut *UsageTracker) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(ut.interval)
+		defer ticker.Stop()
+		lastPrune := time.Time{}
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				ut.Flush()
+
+				if ut.retention > 0 && time.Since(lastPrune) > 24*time.Hour {
+					lastPrune = time.Now()
+					if n, err := ut.db.DeleteAPIUsageBefore(time.Now().Add(-ut.retention)); err != nil {
+						ut.errors.Capture("usage", err, nil)
+					} else if n > 0 {
+						log.Printf("Pruned %d API usage rows", n)
+					}
+				}
+			}
+		}
+	}()
+}
+
+// Flush adds the pending counts to the database. Counts that fail to save
+// are kept for the next flush.
+func (ut *UsageTracker) Flush() {
+	ut.mu.Lock()
+	pending := ut.pending
+	ut.pending = make(map[usageKey]*APIUsage)
+	ut.mu.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+
+	records := make([]*APIUsage, 0, len(pending))
+	for _, usage := range pending {
+		records = append(records, usage)
+	}
+	if err := ut.db.RecordAPIUsage(records); err != nil {
+		ut.errors.Capture("usage", err, nil)
+
+		ut.mu.Lock()
+		defer ut.mu.Unlock()
+		for key, usage := range pending {
+			if current := ut.pending[key]; current != nil {
+				current.Requests += usage.Requests
+				current.Errors += usage.Errors
+				continue
+			}
+			ut.pending[key] = usage
+		}
+	}
+}
+
+// Usage report endpoint
+func (bs *BuildService) usageReportHandler(w http.ResponseWriter, r *http.Request) {
+	days := 30
+	if value := r.URL.Query().Get("days"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > 366 {
+			http.Error(w, "days must be between 1 and 366", http.StatusBadRequest)
+			return
+		}
+		days = parsed
+	}
+	org := strings.ToLower(r.URL.Query().Get("org"))
+
+	// Include the pending counts of this instance
+	bs.usage.Flush()
+
+	since := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, 1-days)
+	report, err := bs.db.GetUsageReport(since, org)
+	if err != nil {
+		log.Printf("Error getting usage report: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
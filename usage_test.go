@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCallerID(t *testing.T) {
+	withKey := httptest.NewRequest("GET", "/", nil)
+	withKey = withKey.WithContext(context.WithValue(withKey.Context(), tenantContextKey{}, Tenant{Org: "acme", KeyID: 7}))
+	unverified := httptest.NewRequest("GET", "/", nil)
+	unverified.RemoteAddr = "10.0.0.1:5000"
+	unverified.Header.Set("Authorization", "Bearer made-up")
+	direct := httptest.NewRequest("GET", "/", nil)
+	direct.RemoteAddr = "10.0.0.1:5000"
+
+	assert.Len(t, callerID(withKey), 16)
+	assert.NotEqual(t, callerID(withKey), callerID(direct))
+	assert.Equal(t, callerID(unverified), callerID(direct), "unverified credentials don't identify the caller")
+}
+
+func TestUsageTrackerMiddleware(t *testing.T) {
+	service, mockDB := setupTestService()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/builds/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if mux.Vars(r)["id"] == "404" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	router.Use(service.deprecations.Middleware, service.usage.Middleware)
+
+	for _, id := range []string{"1", "2", "404"} {
+		req := httptest.NewRequest("GET", "/api/v1/builds/"+id, nil)
+		req.Header.Set("X-Client-Version", "buildctl/1.4.0")
+		req.Header.Set("X-Organization", "Payments")
+		req.RemoteAddr = "10.0.0.1:5000"
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	var recorded []*APIUsage
+	mockDB.On("RecordAPIUsage", mock.Anything).Run(func(args mock.Arguments) {
+		recorded = args.Get(0).([]*APIUsage)
+	}).Return(nil).Once()
+	service.usage.Flush()
+
+	require.Len(t, recorded, 1)
+	assert.Equal(t, "payments", recorded[0].Org)
+	assert.Equal(t, "/api/v1/builds/{id}", recorded[0].Route)
+	assert.Equal(t, "buildctl", recorded[0].Client)
+	assert.Equal(t, "1.4.0", recorded[0].ClientVersion)
+	assert.Equal(t, int64(3), recorded[0].Requests)
+	assert.Equal(t, int64(1), recorded[0].Errors)
+
+	// Nothing left to flush
+	service.usage.Flush()
+	mockDB.AssertExpectations(t)
+}
+
+func TestUsageTrackerKeepsCountsWhenFlushFails(t *testing.T) {
+	service, mockDB := setupTestService()
+	key := usageKey{org: "unknown", method: "GET", route: "/api/v1/builds", client: "curl", caller: "abc"}
+	now := time.Now().UTC()
+
+	service.usage.record(key, false, now)
+	mockDB.On("RecordAPIUsage", mock.Anything).Return(fmt.Errorf("connection refused")).Once()
+	service.usage.Flush()
+
+	service.usage.record(key, false, now)
+	mockDB.On("RecordAPIUsage", mock.MatchedBy(func(records []*APIUsage) bool {
+		return len(records) == 1 && records[0].Requests == 2
+	})).Return(nil).Once()
+	service.usage.Flush()
+
+	mockDB.AssertExpectations(t)
+}
+
+func TestUsageReportHandler(t *testing.T) {
+	tests := []struct {
+		name           string
+		query          string
+		org            string
+		expectedStatus int
+	}{
+		{"default", "", "", http.StatusOK},
+		{"one org", "?days=7&org=Payments", "payments", http.StatusOK},
+		{"invalid days", "?days=0", "", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service, mockDB := setupTestService()
+			if tt.expectedStatus == http.StatusOK {
+				report := &UsageReport{Org: tt.org, Total: UsageCount{Requests: 10, UniqueCallers: 2}}
+				mockDB.On("GetUsageReport", mock.AnythingOfType("time.Time"), tt.org).Return(report, nil).Once()
+			}
+
+			req := httptest.NewRequest("GET", "/api/v1/admin/usage"+tt.query, nil)
+			w := httptest.NewRecorder()
+			service.usageReportHandler(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			if tt.expectedStatus == http.StatusOK {
+				var report UsageReport
+				require.NoError(t, json.NewDecoder(w.Body).Decode(&report))
+				assert.Equal(t, int64(10), report.Total.Requests)
+			}
+			mockDB.AssertExpectations(t)
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Version bumps in increasing order of significance
+const (
+	bumpNone = iota
+	bumpPatch
+	bumpMinor
+	bumpMajor
+)
+
+// conventionalHeaderPattern matches a conventional commit header such as
+// "feat(api)!: drop v1 endpoints"
+var conventionalHeaderPattern = regexp.MustCompile(`^(\w+)(?:\([^)]*\))?(!)?: `)
+
+// commitBump returns the version bump a conventional commit message calls for
+func commitBump(message string) int {
+	if strings.Contains(message, "BREAKING CHANGE:") || strings.Contains(message, "BREAKING-CHANGE:") {
+		return bumpMajor
+	}
+
+	m := conventionalHeaderPattern.FindStringSubmatch(strings.TrimSpace(message))
+	if m == nil {
+		return bumpNone
+	}
+	if m[2] == "!" {
+		return bumpMajor
+	}
+
+	switch strings.ToLower(m[1]) {
+	case "feat":
+		return bumpMinor
+	case "fix", "perf":
+		return bumpPatch
+	default:
+		return bumpNone
+	}
+}
+
+// nextVersion computes the version following current for the given commit
+// messages. It returns nil when none of the commits warrant a release.
+func nextVersion(current *Version, messages []string) *Version {
+	bump := bumpNone
+	for _, message := range messages {
+		bump = max(bump, commitBump(message))
+	}
+
+	next := &Version{Major: current.Major, Minor: current.Minor, Patch: current.Patch}
+	switch bump {
+	case bumpMajor:
+		next.Major++
+		next.Minor, next.Patch = 0, 0
+	case bumpMinor:
+		next.Minor++
+		next.Patch = 0
+	case bumpPatch:
+		next.Patch++
+	default:
+		return nil
+	}
+	return next
+}
+
+// versionTagPattern selects the tags considered by the versioning step
+const versionTagPattern = "v[0-9]*.[0-9]*.[0-9]*"
+
+// autoVersions reports whether a build runs the versioning step: only builds
+// of a project with auto_version, of its own repository and default branch,
+// are released, so the tag credentials never go to a repository the caller
+// picked. Matrix combinations are built as the version of their matrix build.
+func autoVersions(build *BuildRequest, project *Project) bool {
+	if project == nil || !project.AutoVersion || build.Tag != "" || build.PullRequest != 0 || build.ParentBuildID != nil {
+		return false
+	}
+	return build.Branch == project.DefaultBranch && repositoryKey(build.GitURL) == repositoryKey(project.GitURL)
+}
+
+// calculateVersion is the optional versioning step. It computes the next
+// version from the conventional commits since the last version tag. It
+// returns the version of the checked out commit, or "" when the repository
+// has never been released, and the tag to release it under once the build
+// succeeds, or "" when there's nothing to release.
+func (le *LocalExecutor) calculateVersion(ctx context.Context, workspace, srcDir string, output *tailBuffer) (string, string, int, error) {
+	fmt.Fprintln(output, "--- calculating version from conventional commits")
+
+	// The checkout is shallow; versioning needs the history and tags
+	fetch := []string{"git", "fetch", "--quiet", "--tags", "--unshallow", "origin"}
+	if exitCode, err := le.run(ctx, workspace, srcDir, output, fetch); err != nil || exitCode != 0 {
+		return "", "", exitCode, err
+	}
+
+	var stdout bytes.Buffer
+	describe := []string{"git", "describe", "--tags", "--abbrev=0", "--match", versionTagPattern, "HEAD"}
+	exitCode, err := le.runCapture(ctx, workspace, srcDir, &stdout, output, describe)
+	if err != nil {
+		return "", "", exitCode, err
+	}
+
+	current := &Version{}
+	lastTag := strings.TrimSpace(stdout.String())
+	logRange := "HEAD"
+	if exitCode == 0 {
+		if current, err = parseSemver(lastTag); err != nil {
+			fmt.Fprintf(output, "%v\n", err)
+			return "", "", -1, nil
+		}
+		logRange = lastTag + "..HEAD"
+	} else {
+		fmt.Fprintln(output, "no previous version tag, starting from 0.0.0")
+		lastTag = ""
+	}
+
+	stdout.Reset()
+	history := []string{"git", "log", "--format=%B%x1e", logRange}
+	if exitCode, err := le.runCapture(ctx, workspace, srcDir, &stdout, output, history); err != nil || exitCode != 0 {
+		return "", "", exitCode, err
+	}
+	messages := strings.Split(stdout.String(), "\x1e")
+
+	next := nextVersion(current, messages)
+	if next == nil {
+		fmt.Fprintf(output, "no releasable commits since %s, not tagging\n", lastTag)
+		if lastTag == "" {
+			return "", "", 0, nil
+		}
+		return current.String(), "", 0, nil
+	}
+
+	fmt.Fprintf(output, "next version is %s, tagged once the build succeeds\n", next)
+	return next.String(), "v" + next.String(), 0, nil
+}
+
+// pushVersionTag tags the checked out commit as a release and pushes the tag
+func (le *LocalExecutor) pushVersionTag(ctx context.Context, workspace, srcDir string, output *tailBuffer, build *BuildRequest, tag string) (int, error) {
+	fmt.Fprintf(output, "--- releasing %s\n", tag)
+	annotate := []string{"git", "tag", "-a", tag, "-m", "Release " + tag}
+	if exitCode, err := le.run(ctx, workspace, srcDir, output, annotate, gitIdentityEnv()...); err != nil || exitCode != 0 {
+		return exitCode, err
+	}
+
+	push := []string{"git", "push", "--quiet", "origin", "refs/tags/" + tag}
+	return le.run(ctx, workspace, srcDir, output, push, le.pushCredentialsEnv(build.GitURL)...)
+}
+
+// gitIdentityEnv sets the identity recorded on tags created by the service
+func gitIdentityEnv() []string {
+	return []string{
+		"GIT_COMMITTER_NAME=build-service",
+		"GIT_COMMITTER_EMAIL=build-service@localhost",
+		"GIT_AUTHOR_NAME=build-service",
+		"GIT_AUTHOR_EMAIL=build-service@localhost",
+	}
+}
+
+// pushCredentialsEnv passes the configured tag push credentials to git as an
+// HTTP header through GIT_CONFIG_* variables, keeping them out of the command
+// line and the build output
+func (le *LocalExecutor) pushCredentialsEnv(gitURL string) []string {
+	u, err := url.Parse(gitURL)
+	if le.TagToken == "" || err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+		return nil
+	}
+
+	username := le.TagUsername
+	if username == "" {
+		username = "x-access-token"
+	}
+	credentials := base64.StdEncoding.EncodeToString([]byte(username + ":" + le.TagToken))
+
+	return []string{
+		"GIT_CONFIG_COUNT=1",
+		"GIT_CONFIG_KEY_0=http.extraHeader",
+		"GIT_CONFIG_VALUE_0=Authorization: Basic " + credentials,
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// maxSlowRequests is how many slow requests the watchdog keeps
+	maxSlowRequests = 50
+	// maxStackBytes bounds the stack kept for a slow request
+	maxStackBytes = 16 << 10
+	// maxStackDump bounds the dump of all goroutines a sample is taken from
+	maxStackDump = 8 << 20
+)
+
+// streamingRoutes hold their requests open by design and are left out of the
+// latency budget
+var streamingRoutes = map[string]bool{
+	"/api/v1/builds/events":    true,
+	"/api/v1/builds/{id}/wait": true,
+	"/api/v1/ws":               true,
+}
+
+// SlowRequest is a request whose handler exceeded the latency budget
+type SlowRequest struct {
+	Method    string    `json:"method"`
+	Route     string    `json:"route"`
+	StartedAt time.Time `json:"started_at"`
+	// DurationMS is how long the request took, or had taken when it was
+	// reported while still running
+	DurationMS int64 `json:"duration_ms"`
+	Finished   bool  `json:"finished"`
+	// Stack is the handler's goroutine stack, sampled while it was over
+	// budget. Requests that finished between samples have none.
+	Stack string `json:"stack,omitempty"`
+}
+
+// InFlightRequest is a request being served
+type InFlightRequest struct {
+	Method    string    `json:"method"`
+	Route     string    `json:"route"`
+	StartedAt time.Time `json:"started_at"`
+	ElapsedMS int64     `json:"elapsed_ms"`
+}
+
+// WatchdogReport lists the requests being served and recent slow requests,
+// newest first
+type WatchdogReport struct {
+	BudgetMS int64             `json:"budget_ms"`
+	InFlight []InFlightRequest `json:"in_flight"`
+	Slow     []SlowRequest     `json:"slow"`
+}
+
+type activeRequest struct {
+	method, route string
+	start         time.Time
+	goroutine     int64
+	slow          *SlowRequest
+}
+
+// RequestWatchdog counts the requests in flight per route and samples the
+// stacks of handlers running longer than a latency budget, which points at
+// slow queries and lock contention before they become outages
+type RequestWatchdog struct {
+	budget   time.Duration
+	inFlight *prometheus.GaugeVec
+	slow     *prometheus.CounterVec
+
+	mu     sync.Mutex
+	nextID uint64
+	active map[uint64]*activeRequest
+	recent []*SlowRequest
+}
+
+// NewRequestWatchdogFromEnv creates a watchdog with the SLOW_REQUEST_THRESHOLD
+// budget; a budget of 0 only counts requests in flight
+func NewRequestWatchdogFromEnv(inFlight *prometheus.GaugeVec, slow *prometheus.CounterVec) *RequestWatchdog {
+	return &RequestWatchdog{
+		budget:   getEnvDuration("SLOW_REQUEST_THRESHOLD", 2*time.Second),
+		inFlight: inFlight,
+		slow:     slow,
+		active:   make(map[uint64]*activeRequest),
+	}
+}
+
+// Middleware tracks each request while its handler runs
+func (rw *RequestWatchdog) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeTemplate(r)
+		gauge := rw.inFlight.WithLabelValues(r.Method, route)
+		gauge.Inc()
+		defer gauge.Dec()
+
+		if rw.budget <= 0 || streamingRoutes[route] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		req := &activeRequest{method: r.Method, route: route, start: time.Now(), goroutine: goroutineID()}
+		rw.mu.Lock()
+		rw.nextID++
+		id := rw.nextID
+		rw.active[id] = req
+		rw.mu.Unlock()
+
+		defer rw.finish(id, req)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// finish records the duration of a request that was reported as slow, or
+// reports it now if it exceeded the budget between samples
+func (rw *RequestWatchdog) finish(id uint64, req *activeRequest) {
+	elapsed := time.Since(req.start)
+
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	delete(rw.active, id)
+	switch {
+	case req.slow != nil:
+		req.slow.DurationMS, req.slow.Finished = elapsed.Milliseconds(), true
+	case elapsed > rw.budget:
+		rw.report(req, elapsed, "")
+		req.slow.Finished = true
+	}
+}
+
+// report records a slow request; the caller holds rw.mu
+func (rw *RequestWatchdog) report(req *activeRequest, elapsed time.Duration, stack string) {
+	req.slow = &SlowRequest{
+		Method:     req.method,
+		Route:      req.route,
+		StartedAt:  req.start.UTC(),
+		DurationMS: elapsed.Milliseconds(),
+		Stack:      stack,
+	}
+	rw.recent = append(rw.recent, req.slow)
+	if len(rw.recent) > maxSlowRequests {
+		rw.recent = rw.recent[len(rw.recent)-maxSlowRequests:]
+	}
+	rw.slow.WithLabelValues(req.method, req.route).Inc()
+
+	if stack == "" {
+		log.Printf("Slow request: %s %s took %s (budget %s)", req.method, req.route, elapsed.Round(time.Millisecond), rw.budget)
+	} else {
+		log.Printf("Slow request: %s %s running for %s (budget %s):\n%s", req.method, req.route, elapsed.Round(time.Millisecond), rw.budget, stack)
+	}
+}
+
+// Start samples the requests over budget twice per budget until ctx is done
+func (rw *RequestWatchdog) Start(ctx context.Context) {
+	if rw.budget <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(rw.budget / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				rw.Sample(now)
+			}
+		}
+	}()
+}
+
+// Sample reports the requests running over budget at now that weren't
+// reported yet, with the stacks of their handlers
+func (rw *RequestWatchdog) Sample(now time.Time) {
+	rw.mu.Lock()
+	var overdue []*activeRequest
+	for _, req := range rw.active {
+		if req.slow == nil && now.Sub(req.start) > rw.budget {
+			overdue = append(overdue, req)
+		}
+	}
+	rw.mu.Unlock()
+	if len(overdue) == 0 {
+		return
+	}
+
+	// A single dump serves every overdue request; it's taken outside the
+	// lock since it stops the world
+	stacks := goroutineStacks()
+
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	for _, req := range overdue {
+		// Requests that finished meanwhile were reported by finish
+		if req.slow == nil {
+			rw.report(req, now.Sub(req.start), stacks[req.goroutine])
+		}
+	}
+}
+
+// Report returns the requests in flight and the recent slow requests
+func (rw *RequestWatchdog) Report() WatchdogReport {
+	now := time.Now()
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	report := WatchdogReport{BudgetMS: rw.budget.Milliseconds(), InFlight: []InFlightRequest{}, Slow: []SlowRequest{}}
+	for _, req := range rw.active {
+		report.InFlight = append(report.InFlight, InFlightRequest{
+			Method:    req.method,
+			Route:     req.route,
+			StartedAt: req.start.UTC(),
+			ElapsedMS: now.Sub(req.start).Milliseconds(),
+		})
+	}
+	sort.Slice(report.InFlight, func(i, j int) bool { return report.InFlight[i].StartedAt.After(report.InFlight[j].StartedAt) })
+	for i := len(rw.recent) - 1; i >= 0; i-- {
+		report.Slow = append(report.Slow, *rw.recent[i])
+	}
+	return report
+}
+
+// goroutineID returns the ID of the calling goroutine, parsed from the
+// "goroutine N [running]:" header of its stack
+func goroutineID() int64 {
+	var buf [64]byte
+	header := buf[:runtime.Stack(buf[:], false)]
+	header = bytes.TrimPrefix(header, []byte("goroutine "))
+	if i := bytes.IndexByte(header, ' '); i > 0 {
+		id, _ := strconv.ParseInt(string(header[:i]), 10, 64)
+		return id
+	}
+	return 0
+}
+
+// goroutineStacks dumps the stacks of all goroutines, keyed by goroutine ID
+func goroutineStacks() map[int64]string {
+	buf := make([]byte, 256<<10)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) || len(buf) >= maxStackDump {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+
+	stacks := make(map[int64]string)
+	for _, stack := range bytes.Split(buf, []byte("\n\n")) {
+		header, _, _ := bytes.Cut(stack, []byte(" "))
+		if string(header) != "goroutine" {
+			continue
+		}
+		rest := bytes.TrimPrefix(stack, []byte("goroutine "))
+		i := bytes.IndexByte(rest, ' ')
+		if i <= 0 {
+			continue
+		}
+		id, err := strconv.ParseInt(string(rest[:i]), 10, 64)
+		if err != nil {
+			continue
+		}
+		if len(stack) > maxStackBytes {
+			stack = stack[:maxStackBytes]
+		}
+		stacks[id] = string(stack)
+	}
+	return stacks
+}
+
+// Request watchdog endpoint
+func (bs *BuildService) requestWatchdogHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bs.watchdog.Report())
+}
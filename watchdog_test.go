@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestWatchdog(budget time.Duration) *RequestWatchdog {
+	metrics := NewMetrics()
+	return &RequestWatchdog{
+		budget:   budget,
+		inFlight: &metrics.HTTPInFlight,
+		slow:     &metrics.HTTPSlowRequests,
+		active:   make(map[uint64]*activeRequest),
+	}
+}
+
+// watchdogRouter serves handler on route behind the watchdog
+func watchdogRouter(rw *RequestWatchdog, route string, handler http.HandlerFunc) *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc(route, handler)
+	router.Use(rw.Middleware)
+	return router
+}
+
+// blockedHandler is a handler stuck until release is closed
+func blockedHandler(entered, release chan struct{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		<-release
+	}
+}
+
+func TestRequestWatchdogSamplesSlowHandlers(t *testing.T) {
+	rw := newTestWatchdog(time.Second)
+	entered, release := make(chan struct{}), make(chan struct{})
+	router := watchdogRouter(rw, "/api/v1/builds/{id}", blockedHandler(entered, release))
+
+	done := make(chan struct{})
+	go func() {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/v1/builds/7", nil))
+		close(done)
+	}()
+	<-entered
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(rw.inFlight.WithLabelValues("GET", "/api/v1/builds/{id}")))
+	report := rw.Report()
+	require.Len(t, report.InFlight, 1)
+	assert.Equal(t, "/api/v1/builds/{id}", report.InFlight[0].Route)
+
+	// Within budget nothing is reported
+	rw.Sample(time.Now())
+	assert.Empty(t, rw.Report().Slow)
+
+	rw.Sample(time.Now().Add(2 * time.Second))
+	rw.Sample(time.Now().Add(3 * time.Second))
+	report = rw.Report()
+	require.Len(t, report.Slow, 1)
+	assert.False(t, report.Slow[0].Finished)
+	assert.GreaterOrEqual(t, report.Slow[0].DurationMS, int64(2000))
+	assert.Contains(t, report.Slow[0].Stack, "blockedHandler")
+	assert.Equal(t, 1.0, testutil.ToFloat64(rw.slow.WithLabelValues("GET", "/api/v1/builds/{id}")))
+
+	close(release)
+	<-done
+	report = rw.Report()
+	assert.Empty(t, report.InFlight)
+	require.Len(t, report.Slow, 1)
+	assert.True(t, report.Slow[0].Finished)
+	assert.Less(t, report.Slow[0].DurationMS, int64(2000))
+	assert.Equal(t, 0.0, testutil.ToFloat64(rw.inFlight.WithLabelValues("GET", "/api/v1/builds/{id}")))
+}
+
+func TestRequestWatchdogReportsSlowRequestsBetweenSamples(t *testing.T) {
+	rw := newTestWatchdog(time.Millisecond)
+	router := watchdogRouter(rw, "/api/v1/builds", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(5 * time.Millisecond)
+	})
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/v1/builds", nil))
+
+	report := rw.Report()
+	require.Len(t, report.Slow, 1)
+	assert.True(t, report.Slow[0].Finished)
+	assert.Empty(t, report.Slow[0].Stack)
+	assert.Equal(t, 1.0, testutil.ToFloat64(rw.slow.WithLabelValues("GET", "/api/v1/builds")))
+}
+
+func TestRequestWatchdogSkipsStreamingRoutes(t *testing.T) {
+	rw := newTestWatchdog(time.Millisecond)
+	router := watchdogRouter(rw, "/api/v1/builds/events", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(5 * time.Millisecond)
+	})
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/v1/builds/events", nil))
+
+	assert.Empty(t, rw.Report().Slow)
+}
+
+func TestRequestWatchdogKeepsRecentSlowRequests(t *testing.T) {
+	rw := newTestWatchdog(time.Second)
+	for i := 0; i < maxSlowRequests+5; i++ {
+		rw.mu.Lock()
+		rw.report(&activeRequest{method: "GET", route: "/r" + strings.Repeat("x", i), start: time.Now()}, 2*time.Second, "")
+		rw.mu.Unlock()
+	}
+
+	report := rw.Report()
+	require.Len(t, report.Slow, maxSlowRequests)
+	// Newest first
+	assert.Equal(t, "/r"+strings.Repeat("x", maxSlowRequests+4), report.Slow[0].Route)
+}
+
+func TestGoroutineID(t *testing.T) {
+	id := goroutineID()
+	assert.NotZero(t, id)
+
+	other := make(chan int64)
+	go func() { other <- goroutineID() }()
+	assert.NotEqual(t, id, <-other)
+
+	assert.Contains(t, goroutineStacks()[id], "TestGoroutineID")
+}
+
+func TestRequestWatchdogHandler(t *testing.T) {
+	service := NewBuildServiceWithRegistry(new(MockDatabase), prometheus.NewRegistry())
+
+	rr := httptest.NewRecorder()
+	service.requestWatchdogHandler(rr, httptest.NewRequest("GET", "/api/v1/admin/requests", nil))
+
+	require.Equal(t, http.StatusOK, rr.Code)
+	var report WatchdogReport
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &report))
+	assert.Equal(t, int64(2000), report.BudgetMS)
+	assert.NotNil(t, report.Slow)
+}
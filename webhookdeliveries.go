@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Build lifecycle events sent to webhook subscriptions
+const (
+	webhookEventCreated   = "created"
+	webhookEventStarted   = "started"
+	webhookEventCompleted = "completed"
+)
+
+// webhookEvents are the lifecycle events a webhook subscription can filter on
+var webhookEvents = map[string]bool{
+	webhookEventCreated:   true,
+	webhookEventStarted:   true,
+	webhookEventCompleted: true,
+}
+
+// Webhook delivery statuses
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed"
+)
+
+// webhookEvent returns the lifecycle event a build status belongs to
+func webhookEvent(status string) string {
+	switch status {
+	case "draft", "queued":
+		return webhookEventCreated
+	case "running":
+		return webhookEventStarted
+	default:
+		return webhookEventCompleted
+	}
+}
+
+// WebhookDelivery records the delivery of one build event to a webhook
+// subscription, kept as the subscription's delivery history
+type WebhookDelivery struct {
+	ID             int    `json:"id" db:"id"`
+	SubscriptionID int    `json:"subscription_id" db:"subscription_id"`
+	BuildID        int    `json:"build_id" db:"build_id"`
+	Event          string `json:"event" db:"event"`
+	BuildStatus    string `json:"build_status" db:"build_status"`
+	// Payload is the body sent to the receiver, signed again on every attempt
+	Payload        json.RawMessage `json:"payload" db:"payload"`
+	Status         string          `json:"status" db:"status"`
+	Attempts       int             `json:"attempts" db:"attempts"`
+	ResponseStatus int             `json:"response_status,omitempty" db:"response_status"`
+	LastError      string          `json:"last_error,omitempty" db:"last_error"`
+	NextAttemptAt  *time.Time      `json:"next_attempt_at,omitempty" db:"next_attempt_at"`
+	DeliveredAt    *time.Time      `json:"delivered_at,omitempty" db:"delivered_at"`
+	CreatedAt      time.Time       `json:"created_at" db:"created_at"`
+	UpdatedAt      time.Time       `json:"updated_at" db:"updated_at"`
+}
+
+// attempt sends a delivery and records the outcome, scheduling the next
+// attempt with exponential backoff until maxAttempts have failed
+func (ws *WebhookSink) attempt(ctx context.Context, subscription *WebhookSubscription, delivery *WebhookDelivery, build *BuildRequest) error {
+	status, err := ws.post(ctx, subscription, delivery)
+
+	now := time.Now().UTC()
+	delivery.Attempts++
+	delivery.ResponseStatus = status
+	delivery.NextAttemptAt = nil
+	delivery.UpdatedAt = now
+	switch {
+	case err == nil:
+		delivery.Status, delivery.LastError, delivery.DeliveredAt = deliveryDelivered, "", &now
+	case delivery.Attempts >= ws.maxAttempts:
+		delivery.Status, delivery.LastError = deliveryFailed, err.Error()
+	default:
+		next := now.Add(outboxBackoff(delivery.Attempts))
+		delivery.Status, delivery.LastError, delivery.NextAttemptAt = deliveryPending, err.Error(), &next
+	}
+
+	if err := ws.db.UpdateWebhookDelivery(delivery); err != nil {
+		log.Printf("Error recording webhook delivery %d: %v", delivery.ID, err)
+	}
+	ws.health.Record(webhookIntegration(subscription.ID), err, build)
+	return err
+}
+
+// Start retries pending deliveries until ctx is cancelled
+func (ws *WebhookSink) Start(ctx context.Context) {
+	go ws.run(ctx)
+}
+
+func (ws *WebhookSink) run(ctx context.Context) {
+	retry := time.NewTicker(ws.retryInterval)
+	defer retry.Stop()
+	prune := time.NewTicker(time.Hour)
+	defer prune.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-retry.C:
+			ws.retryDue(ctx)
+		case <-prune.C:
+			if n, err := ws.db.DeleteWebhookDeliveriesBefore(time.Now().Add(-ws.retention)); err != nil {
+				log.Printf("Error pruning webhook deliveries: %v", err)
+			} else if n > 0 {
+				log.Printf("Pruned %d webhook deliveries", n)
+			}
+		}
+	}
+}
+
+// retryDue claims the deliveries whose next attempt is due and sends them
+func (ws *WebhookSink) retryDue(ctx context.Context) {
+	// Claimed deliveries are hidden from other instances until the lease expires
+	deliveries, err := ws.db.ClaimWebhookDeliveries(50, time.Minute)
+	if err != nil {
+		log.Printf("Error claiming webhook deliveries: %v", err)
+		return
+	}
+
+	for _, delivery := range deliveries {
+		if ctx.Err() != nil {
+			return
+		}
+
+		subscription, err := ws.db.GetWebhookSubscription(delivery.SubscriptionID)
+		if err != nil {
+			log.Printf("Error loading webhook subscription %d: %v", delivery.SubscriptionID, err)
+			continue
+		}
+
+		switch {
+		case !subscription.Enabled:
+			delivery.Status, delivery.LastError, delivery.NextAttemptAt = deliveryFailed, "webhook subscription disabled", nil
+			delivery.UpdatedAt = time.Now().UTC()
+			if err := ws.db.UpdateWebhookDelivery(delivery); err != nil {
+				log.Printf("Error recording webhook delivery %d: %v", delivery.ID, err)
+			}
+		case !ws.health.Allow(webhookIntegration(subscription.ID)):
+			// Hold deliveries until an admin re-enables the integration
+			next := time.Now().UTC().Add(ws.retryInterval)
+			delivery.NextAttemptAt, delivery.UpdatedAt = &next, time.Now().UTC()
+			if err := ws.db.UpdateWebhookDelivery(delivery); err != nil {
+				log.Printf("Error deferring webhook delivery %d: %v", delivery.ID, err)
+			}
+		default:
+			if err := ws.attempt(ctx, subscription, delivery, nil); err != nil && delivery.Status == deliveryFailed {
+				log.Printf("Giving up on webhook delivery %d after %d attempts: %v", delivery.ID, delivery.Attempts, err)
+			}
+		}
+	}
+}
+
+// List webhook deliveries endpoint
+func (bs *BuildService) listWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status != "" && status != deliveryPending && status != deliveryDelivered && status != deliveryFailed {
+		http.Error(w, "status must be pending, delivered or failed", http.StatusBadRequest)
+		return
+	}
+
+	subscription, ok := bs.webhookSubscription(w, r)
+	if !ok {
+		return
+	}
+
+	deliveries, err := bs.db.ListWebhookDeliveries(subscription.ID, status, 100)
+	if err != nil {
+		log.Printf("Error listing webhook deliveries: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+// webhookDelivery loads the delivery named in the request path, writing an
+// error response when it can't
+func (bs *BuildService) webhookDelivery(w http.ResponseWriter, r *http.Request) (*WebhookDelivery, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid webhook delivery ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	delivery, err := bs.db.GetWebhookDelivery(id)
+	if err != nil {
+		if err.Error() == "webhook delivery not found" {
+			http.Error(w, "Webhook delivery not found", http.StatusNotFound)
+			return nil, false
+		}
+		log.Printf("Error getting webhook delivery: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return nil, false
+	}
+	return delivery, true
+}
+
+// Get webhook delivery endpoint
+func (bs *BuildService) getWebhookDeliveryHandler(w http.ResponseWriter, r *http.Request) {
+	delivery, ok := bs.webhookDelivery(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(delivery)
+}
+
+// Replay webhook delivery endpoint. The failed delivery is sent once more
+// with its original payload and the outcome is returned.
+func (bs *BuildService) replayWebhookDeliveryHandler(w http.ResponseWriter, r *http.Request) {
+	delivery, ok := bs.webhookDelivery(w, r)
+	if !ok {
+		return
+	}
+	if delivery.Status != deliveryFailed {
+		http.Error(w, fmt.Sprintf("Only failed deliveries can be replayed, delivery is %s", delivery.Status), http.StatusConflict)
+		return
+	}
+
+	subscription, err := bs.db.GetWebhookSubscription(delivery.SubscriptionID)
+	if err != nil {
+		if err.Error() == "webhook subscription not found" {
+			http.Error(w, "Webhook subscription not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error getting webhook subscription: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// The outcome is part of the returned delivery
+	bs.webhooks.attempt(r.Context(), subscription, delivery, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(delivery)
+}
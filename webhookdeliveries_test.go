@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookEvent(t *testing.T) {
+	assert.Equal(t, "created", webhookEvent("queued"))
+	assert.Equal(t, "created", webhookEvent("draft"))
+	assert.Equal(t, "started", webhookEvent("running"))
+	for _, status := range []string{"success", "failed", "timeout", "cancelled", "expired", "skipped"} {
+		assert.Equal(t, "completed", webhookEvent(status))
+	}
+}
+
+func newTestWebhookSink() (*WebhookSink, *MockDatabase) {
+	service, _ := setupTestService()
+	mockDB := new(MockDatabase)
+	sink := NewWebhookSinkFromEnv(mockDB, NewIntegrationHealth(mockDB, service.errors, &service.metrics.Integrations))
+	mockDB.On("GetIntegration", mock.AnythingOfType("string")).Return(nil, fmt.Errorf("integration not found")).Maybe()
+	mockDB.On("ResetIntegrationFailures", mock.AnythingOfType("string")).Return(nil).Maybe()
+	mockDB.On("RecordIntegrationFailure", mock.AnythingOfType("string"), mock.AnythingOfType("string"), 10).Return(&IntegrationState{ConsecutiveFailures: 1}, nil).Maybe()
+	mockDB.On("UpdateWebhookDelivery", mock.AnythingOfType("*main.WebhookDelivery")).Return(nil).Maybe()
+	return sink, mockDB
+}
+
+func TestWebhookSinkRetriesWithBackoff(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "build.started", r.Header.Get("X-Build-Lifecycle-Event"))
+		assert.Equal(t, "7", r.Header.Get("X-Build-Delivery"))
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	sink, _ := newTestWebhookSink()
+	sink.maxAttempts = 3
+	subscription := &WebhookSubscription{ID: 1, URL: server.URL, Enabled: true}
+	delivery := &WebhookDelivery{ID: 7, SubscriptionID: 1, Event: "started", BuildStatus: "running", Payload: []byte(`{}`), Status: deliveryPending}
+
+	before := time.Now()
+	require.Error(t, sink.attempt(context.Background(), subscription, delivery, nil))
+	assert.Equal(t, deliveryPending, delivery.Status)
+	require.NotNil(t, delivery.NextAttemptAt)
+	assert.WithinDuration(t, before.Add(10*time.Second), *delivery.NextAttemptAt, time.Second)
+
+	require.Error(t, sink.attempt(context.Background(), subscription, delivery, nil))
+	assert.WithinDuration(t, before.Add(20*time.Second), *delivery.NextAttemptAt, time.Second)
+	assert.Equal(t, "unexpected status 503", delivery.LastError)
+
+	require.NoError(t, sink.attempt(context.Background(), subscription, delivery, nil))
+	assert.Equal(t, deliveryDelivered, delivery.Status)
+	assert.Equal(t, 3, delivery.Attempts)
+	assert.Equal(t, http.StatusOK, delivery.ResponseStatus)
+	assert.Nil(t, delivery.NextAttemptAt)
+	assert.NotNil(t, delivery.DeliveredAt)
+}
+
+func TestWebhookSinkRetryDue(t *testing.T) {
+	var received atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received.Add(1)
+	}))
+	defer server.Close()
+
+	sink, mockDB := newTestWebhookSink()
+	due := &WebhookDelivery{ID: 1, SubscriptionID: 1, Payload: []byte(`{}`), Status: deliveryPending, Attempts: 1}
+	orphaned := &WebhookDelivery{ID: 2, SubscriptionID: 2, Payload: []byte(`{}`), Status: deliveryPending, Attempts: 1}
+	mockDB.On("ClaimWebhookDeliveries", 50, time.Minute).Return([]*WebhookDelivery{due, orphaned}, nil).Once()
+	mockDB.On("GetWebhookSubscription", 1).Return(&WebhookSubscription{ID: 1, URL: server.URL, Enabled: true}, nil)
+	mockDB.On("GetWebhookSubscription", 2).Return(&WebhookSubscription{ID: 2, URL: server.URL}, nil)
+
+	sink.retryDue(context.Background())
+
+	assert.Equal(t, int32(1), received.Load())
+	assert.Equal(t, deliveryDelivered, due.Status)
+	assert.Equal(t, 2, due.Attempts)
+	assert.Equal(t, deliveryFailed, orphaned.Status)
+	assert.Equal(t, "webhook subscription disabled", orphaned.LastError)
+	mockDB.AssertExpectations(t)
+}
+
+func TestListWebhookDeliveriesHandler(t *testing.T) {
+	service, mockDB := setupTestService()
+	mockDB.On("GetWebhookSubscription", 1).Return(&WebhookSubscription{ID: 1}, nil)
+	mockDB.On("ListWebhookDeliveries", 1, "failed", 100).Return([]*WebhookDelivery{{ID: 3, SubscriptionID: 1, Status: deliveryFailed, Payload: []byte(`{"id":9}`)}}, nil).Once()
+
+	list := func(query string) *httptest.ResponseRecorder {
+		req := mux.SetURLVars(httptest.NewRequest("GET", "/api/v1/webhooks/subscriptions/1/deliveries"+query, nil), map[string]string{"id": "1"})
+		rr := httptest.NewRecorder()
+		service.listWebhookDeliveriesHandler(rr, req)
+		return rr
+	}
+
+	rr := list("?status=failed")
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"payload":{"id":9}`)
+	assert.Equal(t, http.StatusBadRequest, list("?status=lost").Code)
+	mockDB.AssertExpectations(t)
+}
+
+func TestReplayWebhookDeliveryHandler(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	service, mockDB := setupTestService()
+	mockDB.On("GetWebhookDelivery", 1).Return(&WebhookDelivery{ID: 1, SubscriptionID: 1, Payload: []byte(`{}`), Status: deliveryFailed, Attempts: 8}, nil)
+	mockDB.On("GetWebhookDelivery", 2).Return(&WebhookDelivery{ID: 2, SubscriptionID: 1, Status: deliveryDelivered}, nil)
+	mockDB.On("GetWebhookDelivery", 3).Return(nil, fmt.Errorf("webhook delivery not found"))
+	mockDB.On("GetWebhookSubscription", 1).Return(&WebhookSubscription{ID: 1, URL: server.URL, Enabled: true}, nil)
+	mockDB.On("UpdateWebhookDelivery", mock.MatchedBy(func(d *WebhookDelivery) bool {
+		return d.ID == 1 && d.Status == deliveryDelivered && d.Attempts == 9
+	})).Return(nil).Once()
+	mockDB.On("ResetIntegrationFailures", "webhook:1").Return(nil).Once()
+
+	replay := func(id string) *httptest.ResponseRecorder {
+		req := mux.SetURLVars(httptest.NewRequest("POST", "/api/v1/webhooks/deliveries/"+id+"/replay", nil), map[string]string{"id": id})
+		rr := httptest.NewRecorder()
+		service.replayWebhookDeliveryHandler(rr, req)
+		return rr
+	}
+
+	rr := replay("1")
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"status":"delivered"`)
+	assert.Equal(t, http.StatusConflict, replay("2").Code)
+	assert.Equal(t, http.StatusNotFound, replay("3").Code)
+	assert.Equal(t, http.StatusBadRequest, replay("x").Code)
+	mockDB.AssertExpectations(t)
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// maxWebhookPayload bounds the size of incoming webhook bodies
+const maxWebhookPayload = 5 << 20
+
+// PushEvent is the forge-independent description of a push
+type PushEvent struct {
+	Ref       string
+	CommitSHA string
+	Message   string
+	// Author is the head commit's author as "Name <email>"
+	Author       string
+	Deleted      bool
+	Repositories []string
+}
+
+// Branch returns the pushed branch, or "" when the ref is not a branch
+func (pe *PushEvent) Branch() string {
+	if !strings.HasPrefix(pe.Ref, "refs/heads/") {
+		return ""
+	}
+	return strings.TrimPrefix(pe.Ref, "refs/heads/")
+}
+
+// Tag returns the pushed tag, or "" when the ref is not a tag
+func (pe *PushEvent) Tag() string {
+	if !strings.HasPrefix(pe.Ref, "refs/tags/") {
+		return ""
+	}
+	return strings.TrimPrefix(pe.Ref, "refs/tags/")
+}
+
+// githubPushPayload is the subset of GitHub's push event we use
+type githubPushPayload struct {
+	Ref        string `json:"ref"`
+	After      string `json:"after"`
+	Deleted    bool   `json:"deleted"`
+	HeadCommit struct {
+		Message string `json:"message"`
+		Author  struct {
+			Name  string `json:"name"`
+			Email string `json:"email"`
+		} `json:"author"`
+	} `json:"head_commit"`
+	Repository struct {
+		CloneURL string `json:"clone_url"`
+		SSHURL   string `json:"ssh_url"`
+		HTMLURL  string `json:"html_url"`
+	} `json:"repository"`
+}
+
+// gitlabPushPayload is the subset of GitLab's push hook we use
+type gitlabPushPayload struct {
+	Ref         string `json:"ref"`
+	After       string `json:"after"`
+	CheckoutSHA string `json:"checkout_sha"`
+	Commits     []struct {
+		ID      string `json:"id"`
+		Message string `json:"message"`
+		Author  struct {
+			Name  string `json:"name"`
+			Email string `json:"email"`
+		} `json:"author"`
+	} `json:"commits"`
+	Project struct {
+		GitHTTPURL string `json:"git_http_url"`
+		GitSSHURL  string `json:"git_ssh_url"`
+		WebURL     string `json:"web_url"`
+	} `json:"project"`
+}
+
+// verifyGitHubSignature checks the X-Hub-Signature-256 HMAC of a payload
+func verifyGitHubSignature(secret string, body []byte, signature string) bool {
+	if secret == "" || !strings.HasPrefix(signature, "sha256=") {
+		return false
+	}
+
+	expected, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// GitHub webhook endpoint
+func (bs *BuildService) githubWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookPayload))
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if !verifyGitHubSignature(os.Getenv("GITHUB_WEBHOOK_SECRET"), body, r.Header.Get("X-Hub-Signature-256")) {
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Header.Get("X-GitHub-Event") {
+	case "ping":
+		w.WriteHeader(http.StatusOK)
+		return
+	case "push":
+	case "pull_request":
+		bs.githubPullRequest(w, r, body)
+		return
+	default:
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	var payload githubPushPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		http.Error(w, "Invalid payload", http.StatusBadRequest)
+		return
+	}
+
+	bs.handlePush(w, r, &PushEvent{
+		Ref:       payload.Ref,
+		CommitSHA: payload.After,
+		Message:   payload.HeadCommit.Message,
+		Author:    commitAuthor(payload.HeadCommit.Author.Name, payload.HeadCommit.Author.Email),
+		Deleted:   payload.Deleted,
+		Repositories: []string{
+			payload.Repository.CloneURL,
+			payload.Repository.SSHURL,
+			payload.Repository.HTMLURL,
+		},
+	})
+}
+
+// GitLab webhook endpoint. GitLab authenticates hooks with a shared secret
+// token rather than an HMAC signature.
+func (bs *BuildService) gitlabWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	token := os.Getenv("GITLAB_WEBHOOK_TOKEN")
+	provided := r.Header.Get("X-Gitlab-Token")
+	if token == "" || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Header.Get("X-Gitlab-Event") {
+	case "Push Hook", "Tag Push Hook":
+	case "Merge Request Hook":
+		bs.gitlabMergeRequest(w, r)
+		return
+	default:
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	var payload gitlabPushPayload
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxWebhookPayload)).Decode(&payload); err != nil {
+		http.Error(w, "Invalid payload", http.StatusBadRequest)
+		return
+	}
+
+	var message, author string
+	for _, commit := range payload.Commits {
+		if commit.ID == payload.CheckoutSHA {
+			message, author = commit.Message, commitAuthor(commit.Author.Name, commit.Author.Email)
+		}
+	}
+
+	bs.handlePush(w, r, &PushEvent{
+		Ref:       payload.Ref,
+		CommitSHA: payload.CheckoutSHA,
+		Message:   message,
+		Author:    author,
+		Deleted:   payload.CheckoutSHA == "",
+		Repositories: []string{
+			payload.Project.GitHTTPURL,
+			payload.Project.GitSSHURL,
+			payload.Project.WebURL,
+		},
+	})
+}
+
+// handlePush maps a push to its project and enqueues a build of the pushed
+// commit. Tag pushes only build when the tag matches the project's tag_pattern.
+func (bs *BuildService) handlePush(w http.ResponseWriter, r *http.Request, event *PushEvent) {
+	branch, tag := event.Branch(), event.Tag()
+	if (branch == "" && tag == "") || event.Deleted || strings.Trim(event.CommitSHA, "0") == "" {
+		// Other refs and deletions don't trigger builds
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	project, err := bs.findProject(event.Repositories)
+	if err != nil {
+		if err.Error() == "project not found" {
+			http.Error(w, "No project registered for repository", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error looking up project: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if bs.mirrors != nil {
+		// Checkouts from the mirror wait for a running update, so builds of
+		// the push usually find its commit there
+		go bs.mirrors.Update(context.Background(), project.GitURL)
+	}
+
+	if tag != "" && !matchTagPattern(project.TagPattern, tag) {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	build := &BuildRequest{
+		ProjectName:   project.Name,
+		GitURL:        project.GitURL,
+		Branch:        branch,
+		Tag:           tag,
+		CommitSHA:     strings.ToLower(event.CommitSHA),
+		CommitMessage: truncateCommitMessage(event.Message),
+		CommitAuthor:  event.Author,
+		TriggerSource: triggerWebhook,
+		AutoVersion:   project.AutoVersion,
+		Org:           project.Org,
+	}
+	ref := branch
+	if tag != "" {
+		ref = tag
+	}
+
+	if directive := skipDirective(event.Message, project.SkipCIToken); directive != "" && project.SkipCIEnabled {
+		if err := bs.recordSkippedBuild(build); err != nil {
+			log.Printf("Error recording skipped build: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("Skipped build %d for %s@%s: commit message contains %s", build.ID, project.Name, ref, directive)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(build)
+		return
+	}
+
+	if err := bs.enqueueBuild(r.Context(), build); err != nil {
+		log.Printf("Error creating build: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Queued build %d for %s@%s from push webhook", build.ID, project.Name, ref)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(build)
+}
+
+// findProject returns the project registered for any of the repository URLs
+func (bs *BuildService) findProject(repositories []string) (*Project, error) {
+	seen := make(map[string]bool)
+
+	for _, repo := range repositories {
+		key := repositoryKey(repo)
+		if repo == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		project, err := bs.db.GetProjectByRepository(key)
+		if err == nil || err.Error() != "project not found" {
+			return project, err
+		}
+	}
+
+	return nil, fmt.Errorf("project not found")
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+const testCommitSHA = "8f3c2b1a9d7e6f5a4b3c2d1e0f9a8b7c6d5e4f3a"
+
+func signGitHubPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func githubPushBody(ref, after string) []byte {
+	return githubPushBodyWithMessage(ref, after, "Update README")
+}
+
+func githubPushBodyWithMessage(ref, after, message string) []byte {
+	body, _ := json.Marshal(map[string]interface{}{
+		"ref":   ref,
+		"after": after,
+		"head_commit": map[string]interface{}{
+			"message": message,
+			"author":  map[string]interface{}{"name": "Jane Doe", "email": "jane@example.com"},
+		},
+		"repository": map[string]interface{}{
+			"clone_url": "https://github.com/Test/Repo.git",
+			"ssh_url":   "git@github.com:Test/Repo.git",
+			"html_url":  "https://github.com/Test/Repo",
+		},
+	})
+	return body
+}
+
+func TestRepositoryKey(t *testing.T) {
+	for _, raw := range []string{
+		"https://github.com/test/repo.git",
+		"https://GitHub.com/Test/Repo",
+		"git@github.com:test/repo.git",
+		"ssh://git@github.com:22/test/repo.git",
+		"https://github.com/test/repo/",
+	} {
+		assert.Equal(t, "github.com/test/repo", repositoryKey(raw), raw)
+	}
+}
+
+func TestSkipDirective(t *testing.T) {
+	tests := []struct {
+		message     string
+		customToken string
+		expected    string
+	}{
+		{message: "Fix typo [skip ci]", expected: "[skip ci]"},
+		{message: "Docs only\n\n[CI SKIP]", expected: "[ci skip]"},
+		{message: "[no ci] wip", expected: "[no ci]"},
+		{message: "Fix build", expected: ""},
+		{message: "Bump deps [deps-only]", customToken: "[deps-only]", expected: "[deps-only]"},
+		{message: "Bump deps", customToken: "[deps-only]", expected: ""},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, skipDirective(tt.message, tt.customToken), tt.message)
+	}
+}
+
+func TestGitHubWebhookHandler(t *testing.T) {
+	t.Setenv("GITHUB_WEBHOOK_SECRET", "webhook-secret")
+
+	project := &Project{ID: 1, Name: "test-project", GitURL: "https://github.com/test/repo.git", DefaultBranch: "main", SkipCIEnabled: true}
+	projectWithoutSkip := &Project{ID: 1, Name: "test-project", GitURL: "https://github.com/test/repo.git", DefaultBranch: "main"}
+	projectWithTags := &Project{ID: 1, Name: "test-project", GitURL: "https://github.com/test/repo.git", DefaultBranch: "main", TagPattern: "v*.*.*"}
+
+	tests := []struct {
+		name           string
+		event          string
+		body           []byte
+		secret         string
+		setupMock      func(*MockDatabase)
+		expectedStatus int
+	}{
+		{
+			name:   "push to branch queues build",
+			event:  "push",
+			body:   githubPushBody("refs/heads/feature/x", testCommitSHA),
+			secret: "webhook-secret",
+			setupMock: func(m *MockDatabase) {
+				m.On("GetProjectByRepository", "github.com/test/repo").Return(project, nil).Once()
+				m.On("CreateBuild", mock.MatchedBy(func(b *BuildRequest) bool {
+					return b.ProjectName == "test-project" && b.Branch == "feature/x" && b.CommitSHA == testCommitSHA && b.Status == "queued" &&
+						b.CommitMessage == "Update README" && b.CommitAuthor == "Jane Doe <jane@example.com>" && b.TriggerSource == triggerWebhook
+				})).Return(42, nil).Once()
+			},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:   "skip directive records skipped build",
+			event:  "push",
+			body:   githubPushBodyWithMessage("refs/heads/main", testCommitSHA, "Fix typo [skip ci]"),
+			secret: "webhook-secret",
+			setupMock: func(m *MockDatabase) {
+				m.On("GetProjectByRepository", "github.com/test/repo").Return(project, nil).Once()
+				m.On("CreateBuild", mock.MatchedBy(func(b *BuildRequest) bool {
+					return b.Status == "skipped" && b.SkipReason == skipCommitDirective
+				})).Return(43, nil).Once()
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "skip directive ignored when disabled for project",
+			event:  "push",
+			body:   githubPushBodyWithMessage("refs/heads/main", testCommitSHA, "Fix typo [ci skip]"),
+			secret: "webhook-secret",
+			setupMock: func(m *MockDatabase) {
+				m.On("GetProjectByRepository", "github.com/test/repo").Return(projectWithoutSkip, nil).Once()
+				m.On("CreateBuild", mock.MatchedBy(func(b *BuildRequest) bool {
+					return b.Status == "queued"
+				})).Return(44, nil).Once()
+			},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:           "invalid signature",
+			event:          "push",
+			body:           githubPushBody("refs/heads/main", testCommitSHA),
+			secret:         "wrong-secret",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "ping",
+			event:          "ping",
+			body:           []byte(`{"zen":"Keep it logically awesome."}`),
+			secret:         "webhook-secret",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "unhandled event",
+			event:          "issues",
+			body:           []byte(`{}`),
+			secret:         "webhook-secret",
+			expectedStatus: http.StatusAccepted,
+		},
+		{
+			name:   "tag push ignored without tag pattern",
+			event:  "push",
+			body:   githubPushBody("refs/tags/v1.0.0", testCommitSHA),
+			secret: "webhook-secret",
+			setupMock: func(m *MockDatabase) {
+				m.On("GetProjectByRepository", "github.com/test/repo").Return(project, nil).Once()
+			},
+			expectedStatus: http.StatusAccepted,
+		},
+		{
+			name:   "tag push matching tag pattern queues build",
+			event:  "push",
+			body:   githubPushBody("refs/tags/v1.2.0-rc.1", testCommitSHA),
+			secret: "webhook-secret",
+			setupMock: func(m *MockDatabase) {
+				m.On("GetProjectByRepository", "github.com/test/repo").Return(projectWithTags, nil).Once()
+				m.On("CreateBuild", mock.MatchedBy(func(b *BuildRequest) bool {
+					return b.Tag == "v1.2.0-rc.1" && b.Version == "1.2.0-rc.1" && b.Branch == "" && b.Status == "queued"
+				})).Return(45, nil).Once()
+			},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:   "tag push not matching tag pattern ignored",
+			event:  "push",
+			body:   githubPushBody("refs/tags/nightly", testCommitSHA),
+			secret: "webhook-secret",
+			setupMock: func(m *MockDatabase) {
+				m.On("GetProjectByRepository", "github.com/test/repo").Return(projectWithTags, nil).Once()
+			},
+			expectedStatus: http.StatusAccepted,
+		},
+		{
+			name:           "branch deletion ignored",
+			event:          "push",
+			body:           githubPushBody("refs/heads/old", "0000000000000000000000000000000000000000"),
+			secret:         "webhook-secret",
+			expectedStatus: http.StatusAccepted,
+		},
+		{
+			name:   "unknown repository",
+			event:  "push",
+			body:   githubPushBody("refs/heads/main", testCommitSHA),
+			secret: "webhook-secret",
+			setupMock: func(m *MockDatabase) {
+				m.On("GetProjectByRepository", "github.com/test/repo").Return(nil, fmt.Errorf("project not found")).Once()
+			},
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service, mockDB := setupTestService()
+			if tt.setupMock != nil {
+				tt.setupMock(mockDB)
+			}
+
+			req := httptest.NewRequest("POST", "/api/v1/webhooks/github", bytes.NewReader(tt.body))
+			req.Header.Set("X-GitHub-Event", tt.event)
+			req.Header.Set("X-Hub-Signature-256", signGitHubPayload(tt.secret, tt.body))
+			rr := httptest.NewRecorder()
+
+			service.githubWebhookHandler(rr, req)
+
+			assert.Equal(t, tt.expectedStatus, rr.Code)
+			mockDB.AssertExpectations(t)
+		})
+	}
+}
+
+func TestGitLabWebhookHandler(t *testing.T) {
+	t.Setenv("GITLAB_WEBHOOK_TOKEN", "gitlab-token")
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"ref":          "refs/heads/main",
+		"checkout_sha": testCommitSHA,
+		"commits": []map[string]interface{}{{
+			"id":      testCommitSHA,
+			"message": "Add login page\n",
+			"author":  map[string]interface{}{"name": "Jane Doe", "email": "jane@example.com"},
+		}},
+		"project": map[string]interface{}{
+			"git_http_url": "https://gitlab.com/test/repo.git",
+			"git_ssh_url":  "git@gitlab.com:test/repo.git",
+		},
+	})
+
+	t.Run("valid token queues build", func(t *testing.T) {
+		service, mockDB := setupTestService()
+		mockDB.On("GetProjectByRepository", "gitlab.com/test/repo").
+			Return(&Project{ID: 2, Name: "gitlab-project", GitURL: "https://gitlab.com/test/repo.git"}, nil).Once()
+		mockDB.On("CreateBuild", mock.AnythingOfType("*main.BuildRequest")).Return(7, nil).Once()
+
+		req := httptest.NewRequest("POST", "/api/v1/webhooks/gitlab", bytes.NewReader(body))
+		req.Header.Set("X-Gitlab-Token", "gitlab-token")
+		req.Header.Set("X-Gitlab-Event", "Push Hook")
+		rr := httptest.NewRecorder()
+
+		service.gitlabWebhookHandler(rr, req)
+
+		assert.Equal(t, http.StatusCreated, rr.Code)
+		var build BuildRequest
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &build))
+		assert.Equal(t, 7, build.ID)
+		assert.Equal(t, "gitlab-project", build.ProjectName)
+		assert.Equal(t, "Add login page", build.CommitMessage)
+		assert.Equal(t, "Jane Doe <jane@example.com>", build.CommitAuthor)
+		assert.Equal(t, triggerWebhook, build.TriggerSource)
+		mockDB.AssertExpectations(t)
+	})
+
+	t.Run("invalid token", func(t *testing.T) {
+		service, _ := setupTestService()
+
+		req := httptest.NewRequest("POST", "/api/v1/webhooks/gitlab", bytes.NewReader(body))
+		req.Header.Set("X-Gitlab-Token", "nope")
+		req.Header.Set("X-Gitlab-Event", "Push Hook")
+		rr := httptest.NewRecorder()
+
+		service.gitlabWebhookHandler(rr, req)
+
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	})
+}
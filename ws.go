@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// wsGUID is the fixed key suffix from RFC 6455 used to compute Sec-WebSocket-Accept
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+// WebSocket close codes
+const (
+	wsCloseGoingAway     = 1001
+	wsCloseProtocolError = 1002
+	wsCloseTooLarge      = 1009
+)
+
+// wsMaxMessageSize bounds the size of messages accepted from clients
+const wsMaxMessageSize = 64 * 1024
+
+// wsPingInterval is how often the server pings idle clients. Clients that
+// send nothing, not even a pong, for two intervals are disconnected.
+var wsPingInterval = 30 * time.Second
+
+// wsWriteTimeout bounds how long a single frame write may block
+const wsWriteTimeout = 10 * time.Second
+
+// errWSMessageTooLarge is returned when a client message exceeds wsMaxMessageSize
+var errWSMessageTooLarge = errors.New("websocket message too large")
+
+// wsClientMessage is a subscription change sent by a client
+type wsClientMessage struct {
+	Type    string `json:"type"`
+	Project string `json:"project,omitempty"`
+	BuildID int    `json:"build_id,omitempty"`
+}
+
+// wsServerMessage is a message pushed to clients. Type is one of build, log,
+// subscribed, unsubscribed or error.
+type wsServerMessage struct {
+	Type    string      `json:"type"`
+	Event   *BuildEvent `json:"event,omitempty"`
+	Log     *LogLine    `json:"log,omitempty"`
+	Project string      `json:"project,omitempty"`
+	BuildID int         `json:"build_id,omitempty"`
+	Error   string      `json:"error,omitempty"`
+}
+
+// wsConn is a server-side WebSocket connection. Writes may come from several
+// goroutines; reads must come from one.
+type wsConn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	writeMu sync.Mutex
+	// closeSent is set once a close frame has been written; guarded by writeMu
+	closeSent bool
+}
+
+// upgradeWebSocket performs the RFC 6455 opening handshake and takes over the
+// underlying connection
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	if !headerContainsToken(r.Header, "Connection", "upgrade") || !headerContainsToken(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "Expected WebSocket upgrade", http.StatusBadRequest)
+		return nil, fmt.Errorf("not a websocket upgrade request")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, fmt.Errorf("unsupported websocket version %q", r.Header.Get("Sec-WebSocket-Version"))
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		http.Error(w, "Invalid Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, fmt.Errorf("invalid websocket key")
+	}
+
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "WebSocket unsupported", http.StatusInternalServerError)
+		return nil, fmt.Errorf("hijacking connection: %w", err)
+	}
+	// The server's read and write timeouts don't apply to long-lived sockets
+	conn.SetDeadline(time.Time{})
+
+	sum := sha1.Sum([]byte(key + wsGUID))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(sum[:]))
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("writing handshake: %w", err)
+	}
+
+	return &wsConn{conn: conn, reader: rw.Reader}, nil
+}
+
+// headerContainsToken reports whether a comma-separated header contains token
+func headerContainsToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeFrame sends a single unfragmented frame
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	header := []byte{0x80 | opcode}
+	switch {
+	case len(payload) < 126:
+		header = append(header, byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		header = append(header, 126)
+		header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	default:
+		header = append(header, 127)
+		header = binary.BigEndian.AppendUint64(header, uint64(len(payload)))
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	// Only one close frame may be sent, whichever side starts the handshake
+	if opcode == wsClose {
+		if c.closeSent {
+			return nil
+		}
+		c.closeSent = true
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if _, err := c.conn.Write(append(header, payload...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// writeJSON sends v as a text message
+func (c *wsConn) writeJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.writeFrame(wsText, data)
+}
+
+// writeClose sends a close frame with the given status code and reason
+func (c *wsConn) writeClose(code int, reason string) error {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	return c.writeFrame(wsClose, append(payload, reason...))
+}
+
+// readFrame reads one frame, unmasking its payload
+func (c *wsConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(c.reader, header[:]); err != nil {
+		return
+	}
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0F
+	if header[0]&0x70 != 0 {
+		return fin, opcode, nil, fmt.Errorf("unexpected reserved bits")
+	}
+	if header[1]&0x80 == 0 {
+		return fin, opcode, nil, fmt.Errorf("client frames must be masked")
+	}
+
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.reader, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.reader, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > wsMaxMessageSize {
+		return fin, opcode, nil, errWSMessageTooLarge
+	}
+
+	var mask [4]byte
+	if _, err = io.ReadFull(c.reader, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.reader, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// readMessage returns the next data message, answering pings along the way.
+// It returns io.EOF once the client has sent a close frame.
+func (c *wsConn) readMessage() ([]byte, error) {
+	var message []byte
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		// Any traffic, including pongs, shows the client is alive
+		c.conn.SetReadDeadline(time.Now().Add(2 * wsPingInterval))
+
+		switch opcode {
+		case wsPing:
+			if err := c.writeFrame(wsPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			c.writeFrame(wsClose, payload)
+			return nil, io.EOF
+		case wsText, wsBinary:
+			message = payload
+		case wsContinuation:
+			if message == nil {
+				return nil, fmt.Errorf("unexpected continuation frame")
+			}
+			if len(message)+len(payload) > wsMaxMessageSize {
+				return nil, errWSMessageTooLarge
+			}
+			message = append(message, payload...)
+		default:
+			return nil, fmt.Errorf("unknown opcode %d", opcode)
+		}
+
+		if fin {
+			return message, nil
+		}
+	}
+}
+
+// Close closes the underlying connection
+func (c *wsConn) Close() error {
+	return c.conn.Close()
+}
+
+// wsSubscriptions is the set of projects and builds a connection follows
+type wsSubscriptions struct {
+	// org limits the events delivered to an org's builds, when the
+	// connection is scoped to one
+	org      string
+	projects map[string]bool
+	builds   map[int]bool
+	// running tracks running builds of subscribed projects so their logs are
+	// delivered too
+	running map[int]bool
+}
+
+// matchEvent reports whether a build event should be delivered
+func (s *wsSubscriptions) matchEvent(event BuildEvent) bool {
+	if s.org != "" && event.Build.Org != s.org {
+		return false
+	}
+	if s.projects[event.Build.ProjectName] {
+		if event.Build.Status == "running" {
+			s.running[event.Build.ID] = true
+		} else {
+			delete(s.running, event.Build.ID)
+		}
+		return true
+	}
+	return s.builds[event.Build.ID]
+}
+
+// matchLog reports whether a log line should be delivered
+func (s *wsSubscriptions) matchLog(line LogLine) bool {
+	return s.builds[line.BuildID] || s.running[line.BuildID]
+}
+
+// apply updates the subscriptions from a client message and returns the reply
+func (s *wsSubscriptions) apply(msg wsClientMessage) wsServerMessage {
+	if (msg.Project == "") == (msg.BuildID == 0) {
+		return wsServerMessage{Type: "error", Error: "exactly one of project or build_id is required"}
+	}
+
+	switch msg.Type {
+	case "subscribe":
+		if msg.Project != "" {
+			s.projects[msg.Project] = true
+		} else {
+			s.builds[msg.BuildID] = true
+		}
+		return wsServerMessage{Type: "subscribed", Project: msg.Project, BuildID: msg.BuildID}
+	case "unsubscribe":
+		if msg.Project != "" {
+			delete(s.projects, msg.Project)
+		} else {
+			delete(s.builds, msg.BuildID)
+		}
+		return wsServerMessage{Type: "unsubscribed", Project: msg.Project, BuildID: msg.BuildID}
+	default:
+		return wsServerMessage{Type: "error", Error: "type must be subscribe or unsubscribe"}
+	}
+}
+
+// WebSocket endpoint. Pushes build events and log lines for the projects and
+// builds each connection subscribes to.
+func (bs *BuildService) webSocketHandler(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgradeWebSocket(w, r)
+	if err != nil {
+		log.Printf("WebSocket upgrade failed: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	events, unsubscribeEvents := bs.events.Subscribe(64)
+	defer unsubscribeEvents()
+	logs, unsubscribeLogs := bs.logs.Subscribe(256)
+	defer unsubscribeLogs()
+
+	// The reader owns all reads and hands client messages to the loop below,
+	// which owns the subscriptions
+	messages := make(chan wsClientMessage)
+	readerDone := make(chan error, 1)
+	conn.conn.SetReadDeadline(time.Now().Add(2 * wsPingInterval))
+	go func() {
+		for {
+			data, err := conn.readMessage()
+			if err != nil {
+				readerDone <- err
+				return
+			}
+
+			var msg wsClientMessage
+			if err := json.Unmarshal(data, &msg); err != nil {
+				conn.writeJSON(wsServerMessage{Type: "error", Error: "invalid message"})
+				continue
+			}
+			select {
+			case messages <- msg:
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}()
+
+	tenant := requestTenant(r)
+	subscriptions := &wsSubscriptions{
+		org:      tenant.Org,
+		projects: make(map[string]bool),
+		builds:   make(map[int]bool),
+		running:  make(map[int]bool),
+	}
+
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+
+	for {
+		var err error
+		select {
+		case err = <-readerDone:
+			switch {
+			case err == io.EOF:
+			case errors.Is(err, errWSMessageTooLarge):
+				conn.writeClose(wsCloseTooLarge, "message too large")
+			case errors.Is(err, net.ErrClosed):
+			default:
+				conn.writeClose(wsCloseProtocolError, "protocol error")
+			}
+			return
+		case <-bs.streamsDone:
+			// Tell the client we're going away and give it a moment to
+			// acknowledge before the connection is dropped
+			conn.writeClose(wsCloseGoingAway, "server shutting down")
+			select {
+			case <-readerDone:
+			case <-time.After(time.Second):
+			}
+			return
+		case <-ping.C:
+			err = conn.writeFrame(wsPing, nil)
+		case msg := <-messages:
+			// Builds of other orgs can't be followed, for their logs
+			reply := wsServerMessage{Type: "error", Error: "build not found"}
+			if msg.Type != "subscribe" || msg.BuildID == 0 || bs.tenantSeesBuild(tenant, msg.BuildID) {
+				reply = subscriptions.apply(msg)
+			}
+			err = conn.writeJSON(reply)
+		case event := <-events:
+			if subscriptions.matchEvent(event) {
+				err = conn.writeJSON(wsServerMessage{Type: "build", Event: &event})
+			}
+		case line := <-logs:
+			if subscriptions.matchLog(line) {
+				err = conn.writeJSON(wsServerMessage{Type: "log", Log: &line})
+			}
+		}
+
+		if err != nil {
+			log.Printf("Closing WebSocket: %v", err)
+			return
+		}
+	}
+}
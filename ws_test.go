@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testWSClient is a minimal WebSocket client for exercising the server
+type testWSClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dialTestWS(t *testing.T, serverURL string) *testWSClient {
+	conn, err := net.Dial("tcp", strings.TrimPrefix(serverURL, "http://"))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	_, err = io.WriteString(conn, "GET /api/v1/ws HTTP/1.1\r\nHost: test\r\nUpgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	require.NoError(t, err)
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	// Example key and accept value from RFC 6455
+	require.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", resp.Header.Get("Sec-WebSocket-Accept"))
+
+	return &testWSClient{t: t, conn: conn, reader: reader}
+}
+
+func (c *testWSClient) send(opcode byte, payload []byte) {
+	mask := []byte{1, 2, 3, 4}
+	frame := []byte{0x80 | opcode, 0x80 | byte(len(payload))}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	_, err := c.conn.Write(frame)
+	require.NoError(c.t, err)
+}
+
+func (c *testWSClient) sendJSON(v interface{}) {
+	data, _ := json.Marshal(v)
+	c.send(wsText, data)
+}
+
+func (c *testWSClient) read() (byte, []byte) {
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var header [2]byte
+	_, err := io.ReadFull(c.reader, header[:])
+	require.NoError(c.t, err)
+
+	length := int(header[1] & 0x7F)
+	if length == 126 {
+		var ext [2]byte
+		io.ReadFull(c.reader, ext[:])
+		length = int(binary.BigEndian.Uint16(ext[:]))
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(c.reader, payload)
+	require.NoError(c.t, err)
+	return header[0] & 0x0F, payload
+}
+
+func (c *testWSClient) readMessage() wsServerMessage {
+	opcode, payload := c.read()
+	require.Equal(c.t, byte(wsText), opcode)
+	var msg wsServerMessage
+	require.NoError(c.t, json.Unmarshal(payload, &msg))
+	return msg
+}
+
+func newTestWSServer(service *BuildService) *httptest.Server {
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/ws", service.webSocketHandler)
+	router.Use(service.deprecations.Middleware, service.accessLog.Middleware)
+	return httptest.NewServer(router)
+}
+
+func TestWebSocketSubscriptions(t *testing.T) {
+	service, _ := setupTestService()
+	server := newTestWSServer(service)
+	defer server.Close()
+
+	client := dialTestWS(t, server.URL)
+
+	client.sendJSON(wsClientMessage{Type: "subscribe", Project: "api"})
+	assert.Equal(t, wsServerMessage{Type: "subscribed", Project: "api"}, client.readMessage())
+	client.sendJSON(wsClientMessage{Type: "subscribe", BuildID: 9})
+	assert.Equal(t, wsServerMessage{Type: "subscribed", BuildID: 9}, client.readMessage())
+
+	service.events.Publish(&BuildRequest{ID: 1, ProjectName: "web", Status: "running"})
+	service.events.Publish(&BuildRequest{ID: 2, ProjectName: "api", Status: "running"})
+
+	msg := client.readMessage()
+	assert.Equal(t, "build", msg.Type)
+	require.NotNil(t, msg.Event)
+	assert.Equal(t, 2, msg.Event.Build.ID)
+
+	// Logs follow running builds of subscribed projects and subscribed builds
+	service.logs.Publish(1, "ignored")
+	service.logs.Publish(2, "go build ./...")
+	service.logs.Publish(9, "npm test")
+
+	msg = client.readMessage()
+	assert.Equal(t, "log", msg.Type)
+	require.NotNil(t, msg.Log)
+	assert.Equal(t, LogLine{BuildID: 2, Line: "go build ./...", Time: msg.Log.Time}, *msg.Log)
+
+	msg = client.readMessage()
+	require.NotNil(t, msg.Log)
+	assert.Equal(t, 9, msg.Log.BuildID)
+
+	client.sendJSON(wsClientMessage{Type: "subscribe"})
+	assert.Equal(t, "error", client.readMessage().Type)
+
+	// Pings are answered with the same payload
+	client.send(wsPing, []byte("hello"))
+	opcode, payload := client.read()
+	assert.Equal(t, byte(wsPong), opcode)
+	assert.Equal(t, "hello", string(payload))
+
+	client.send(wsClose, binary.BigEndian.AppendUint16(nil, 1000))
+	opcode, _ = client.read()
+	assert.Equal(t, byte(wsClose), opcode)
+}
+
+func TestWebSocketClosesOnShutdown(t *testing.T) {
+	service, _ := setupTestService()
+	server := newTestWSServer(service)
+	defer server.Close()
+
+	client := dialTestWS(t, server.URL)
+	client.sendJSON(wsClientMessage{Type: "subscribe", Project: "api"})
+	client.readMessage()
+
+	close(service.streamsDone)
+
+	opcode, payload := client.read()
+	assert.Equal(t, byte(wsClose), opcode)
+	assert.Equal(t, uint16(wsCloseGoingAway), binary.BigEndian.Uint16(payload))
+}
+
+func TestWebSocketRejectsPlainRequests(t *testing.T) {
+	service, _ := setupTestService()
+
+	rr := httptest.NewRecorder()
+	service.webSocketHandler(rr, httptest.NewRequest("GET", "/api/v1/ws", nil))
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestLogBusWriter(t *testing.T) {
+	bus := NewLogBus()
+	lines, unsubscribe := bus.Subscribe(8)
+	defer unsubscribe()
+
+	writer := bus.Writer(3)
+	writer.Write([]byte("first\r\nsec"))
+	writer.Write([]byte("ond\nthi"))
+	writer.Close()
+
+	for _, expected := range []string{"first", "second", "thi"} {
+		line := <-lines
+		assert.Equal(t, 3, line.BuildID)
+		assert.Equal(t, expected, line.Line)
+	}
+}